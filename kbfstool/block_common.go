@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/fsrpc"
+	"github.com/keybase/kbfs/kbfsblock"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/libkbfs"
+	"github.com/keybase/kbfs/tlf"
+	"golang.org/x/net/context"
+)
+
+// blockPointerRegexp matches the output of BlockPointer.String().
+var blockPointerRegexp = regexp.MustCompile(
+	"^BlockPointer\\{ID: ([0-9a-f]+), KeyGen: (-?[0-9]+), " +
+		"DataVer: ([0-9]+), Context: Context\\{Creator: ([0-9a-f]+)" +
+		"(?:, Writer: ([0-9a-f]+))?(?:, RefNonce: ([0-9a-f]+))?" +
+		"(, BlockType: MD)?\\}, DirectType: ([a-z]+)\\}$")
+
+func parseBlockPointer(ptrStr string) (libkbfs.BlockPointer, error) {
+	matches := blockPointerRegexp.FindStringSubmatch(ptrStr)
+	if matches == nil {
+		return libkbfs.BlockPointer{},
+			fmt.Errorf("Could not parse block pointer %q", ptrStr)
+	}
+
+	id, err := kbfsblock.IDFromString(matches[1])
+	if err != nil {
+		return libkbfs.BlockPointer{}, err
+	}
+
+	keyGen, err := strconv.Atoi(matches[2])
+	if err != nil {
+		return libkbfs.BlockPointer{}, err
+	}
+
+	dataVer, err := strconv.Atoi(matches[3])
+	if err != nil {
+		return libkbfs.BlockPointer{}, err
+	}
+
+	var refNonce kbfsblock.RefNonce
+	if len(matches[6]) > 0 {
+		nonceBytes, err := hex.DecodeString(matches[6])
+		if err != nil {
+			return libkbfs.BlockPointer{}, err
+		}
+		if len(nonceBytes) != len(refNonce) {
+			return libkbfs.BlockPointer{}, fmt.Errorf(
+				"Ref nonce %q has the wrong length", matches[6])
+		}
+		copy(refNonce[:], nonceBytes)
+	}
+
+	bType := keybase1.BlockType_DATA
+	if len(matches[7]) > 0 {
+		bType = keybase1.BlockType_MD
+	}
+
+	var directType libkbfs.BlockDirectType
+	switch matches[8] {
+	case "unknown":
+		directType = libkbfs.UnknownDirectType
+	case "direct":
+		directType = libkbfs.DirectBlock
+	case "indirect":
+		directType = libkbfs.IndirectBlock
+	default:
+		return libkbfs.BlockPointer{}, fmt.Errorf(
+			"Unknown direct type %q", matches[8])
+	}
+
+	return libkbfs.BlockPointer{
+		ID:         id,
+		KeyGen:     libkbfs.KeyGen(keyGen),
+		DataVer:    libkbfs.DataVer(dataVer),
+		DirectType: directType,
+		Context: kbfsblock.MakeContext(
+			keybase1.UserOrTeamID(matches[4]),
+			keybase1.UserOrTeamID(matches[5]), refNonce, bType),
+	}, nil
+}
+
+// blockType is the kind of block a block pointer is expected to
+// point to.
+type blockType int
+
+const (
+	unknownBlockType blockType = iota
+	fileBlockType
+	dirBlockType
+)
+
+func parseBlockType(typeStr string) (blockType, error) {
+	switch typeStr {
+	case "", "auto":
+		return unknownBlockType, nil
+	case "file":
+		return fileBlockType, nil
+	case "dir":
+		return dirBlockType, nil
+	default:
+		return unknownBlockType, fmt.Errorf(
+			"Unknown block type %q", typeStr)
+	}
+}
+
+// blockInput is a block resolved from the command line, along with
+// the metadata needed to decrypt it.
+type blockInput struct {
+	tlfID tlf.ID
+	kmd   libkbfs.KeyMetadata
+	ptr   libkbfs.BlockPointer
+	bType blockType
+}
+
+// addBlockInputFlags adds the flags common to all block subcommands
+// to the given flag set.
+func addBlockInputFlags(flags *flag.FlagSet) (off *int64, typeStr *string) {
+	off = flags.Int64("off", 0,
+		"When given a file path, the offset of the block to use.")
+	typeStr = flags.String("type", "auto",
+		"The type of the block: file, dir, or auto.")
+	return off, typeStr
+}
+
+// parseBlockInput resolves either a TLF and a block pointer, or a
+// path and a file offset, into a block.
+func parseBlockInput(ctx context.Context, config libkbfs.Config,
+	args []string, off int64, typeStr string) (blockInput, error) {
+	bType, err := parseBlockType(typeStr)
+	if err != nil {
+		return blockInput{}, err
+	}
+
+	switch len(args) {
+	case 1:
+		return parsePathBlockInput(ctx, config, args[0], off, bType)
+	case 2:
+		tlfID, err := getTlfID(ctx, config, args[0])
+		if err != nil {
+			return blockInput{}, err
+		}
+
+		ptr, err := parseBlockPointer(args[1])
+		if err != nil {
+			return blockInput{}, err
+		}
+
+		irmd, err := config.MDOps().GetForTLF(ctx, tlfID)
+		if err != nil {
+			return blockInput{}, err
+		}
+		if irmd == (libkbfs.ImmutableRootMetadata{}) {
+			return blockInput{}, fmt.Errorf(
+				"No metadata found for TLF %s", tlfID)
+		}
+
+		return blockInput{tlfID, irmd, ptr, bType}, nil
+	default:
+		return blockInput{}, fmt.Errorf(
+			"either a path, or a TLF and a block pointer, " +
+				"must be specified")
+	}
+}
+
+func parsePathBlockInput(ctx context.Context, config libkbfs.Config,
+	pathStr string, off int64, bType blockType) (blockInput, error) {
+	p, err := fsrpc.NewPath(pathStr)
+	if err != nil {
+		return blockInput{}, err
+	}
+
+	if p.PathType != fsrpc.TLFPathType {
+		return blockInput{}, fmt.Errorf("%s is not a TLF path", p)
+	}
+
+	n, ei, err := p.GetNode(ctx, config)
+	if err != nil {
+		return blockInput{}, err
+	}
+
+	switch ei.Type {
+	case libkbfs.File, libkbfs.Exec:
+		bType = fileBlockType
+	case libkbfs.Dir:
+		bType = dirBlockType
+	default:
+		return blockInput{}, fmt.Errorf(
+			"%s is a %s, which has no blocks", p, ei.Type)
+	}
+
+	md, err := config.KBFSOps().GetNodeMetadata(ctx, n)
+	if err != nil {
+		return blockInput{}, err
+	}
+
+	tlfID := n.GetFolderBranch().Tlf
+	irmd, err := config.MDOps().GetForTLF(ctx, tlfID)
+	if err != nil {
+		return blockInput{}, err
+	}
+	if irmd == (libkbfs.ImmutableRootMetadata{}) {
+		return blockInput{}, fmt.Errorf(
+			"No metadata found for TLF %s", tlfID)
+	}
+
+	ptr := md.BlockInfo.BlockPointer
+	if bType == fileBlockType {
+		ptr, err = findFileBlockAtOffset(ctx, config, irmd, ptr, off)
+		if err != nil {
+			return blockInput{}, err
+		}
+	}
+
+	return blockInput{tlfID, irmd, ptr, bType}, nil
+}
+
+// findFileBlockAtOffset walks down the block tree of the file with
+// the given top block, and returns the pointer to the direct block
+// that contains the given offset.
+func findFileBlockAtOffset(ctx context.Context, config libkbfs.Config,
+	kmd libkbfs.KeyMetadata, ptr libkbfs.BlockPointer, off int64) (
+	libkbfs.BlockPointer, error) {
+	for {
+		buf, serverHalf, err := config.BlockServer().Get(
+			ctx, kmd.TlfID(), ptr.ID, ptr.Context)
+		if err != nil {
+			return libkbfs.BlockPointer{}, err
+		}
+
+		block, err := decryptBlock(
+			ctx, config, kmd, ptr, fileBlockType, buf, serverHalf)
+		if err != nil {
+			return libkbfs.BlockPointer{}, err
+		}
+
+		fblock := block.(*libkbfs.FileBlock)
+		if !fblock.IsInd {
+			return ptr, nil
+		}
+
+		if len(fblock.IPtrs) == 0 {
+			return libkbfs.BlockPointer{}, fmt.Errorf(
+				"Indirect block %s has no children", ptr)
+		}
+
+		// Find the last child whose offset is at most `off`.
+		next := fblock.IPtrs[0]
+		for _, iptr := range fblock.IPtrs[1:] {
+			if iptr.Off > off {
+				break
+			}
+			next = iptr
+		}
+		ptr = next.BlockPointer
+	}
+}
+
+// decryptBlock unmasks the block key using the given server half,
+// and decrypts and decodes the given encrypted block.  If bType is
+// unknownBlockType, it first tries to decode the block as a dir
+// block, and then as a file block.
+func decryptBlock(ctx context.Context, config libkbfs.Config,
+	kmd libkbfs.KeyMetadata, ptr libkbfs.BlockPointer, bType blockType,
+	buf []byte, serverHalf kbfscrypto.BlockCryptKeyServerHalf) (
+	libkbfs.Block, error) {
+	tlfCryptKey, err := config.KeyManager().
+		GetTLFCryptKeyForBlockDecryption(ctx, kmd, ptr)
+	if err != nil {
+		return nil, err
+	}
+
+	blockCryptKey := kbfscrypto.UnmaskBlockCryptKey(
+		serverHalf, tlfCryptKey)
+
+	var encryptedBlock libkbfs.EncryptedBlock
+	err = config.Codec().Decode(buf, &encryptedBlock)
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []libkbfs.Block
+	switch bType {
+	case fileBlockType:
+		candidates = []libkbfs.Block{libkbfs.NewFileBlock()}
+	case dirBlockType:
+		candidates = []libkbfs.Block{libkbfs.NewDirBlock()}
+	default:
+		candidates = []libkbfs.Block{
+			libkbfs.NewDirBlock(), libkbfs.NewFileBlock()}
+	}
+
+	for _, block := range candidates {
+		err = config.Crypto().DecryptBlock(
+			encryptedBlock, kmd.TlfID(), blockCryptKey, block)
+		if err == nil {
+			block.SetEncodedSize(uint32(len(buf)))
+			return block, nil
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+
+	"github.com/davecgh/go-spew/spew"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+const blockGetUsageStr = `Usage:
+  kbfstool block get [-type file|dir|auto] TLF BlockPointer
+  kbfstool block get [-off offset] path
+
+`
+
+const blockDumpUsageStr = `Usage:
+  kbfstool block dump [-type file|dir|auto] TLF BlockPointer
+  kbfstool block dump [-off offset] path
+
+`
+
+func blockFetch(ctx context.Context, config libkbfs.Config,
+	input blockInput) (libkbfs.Block, error) {
+	buf, serverHalf, err := config.BlockServer().Get(
+		ctx, input.tlfID, input.ptr.ID, input.ptr.Context)
+	if err != nil {
+		return nil, err
+	}
+
+	return decryptBlock(ctx, config, input.kmd, input.ptr, input.bType,
+		buf, serverHalf)
+}
+
+func blockPrintDirBlock(dblock *libkbfs.DirBlock) {
+	if dblock.IsInd {
+		fmt.Printf("Type: dir block (indirect)\n")
+		fmt.Printf("IPtrs (%d):\n", len(dblock.IPtrs))
+		for _, iptr := range dblock.IPtrs {
+			fmt.Printf("  off=%q: %v\n", iptr.Off, iptr.BlockInfo)
+		}
+		return
+	}
+
+	fmt.Printf("Type: dir block (direct)\n")
+	names := make([]string, 0, len(dblock.Children))
+	for name := range dblock.Children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Printf("Children (%d):\n", len(names))
+	for _, name := range names {
+		de := dblock.Children[name]
+		if de.Type == libkbfs.Sym {
+			fmt.Printf("  %s: type=%s target=%q\n",
+				name, de.Type, de.SymPath)
+			continue
+		}
+		fmt.Printf("  %s: type=%s size=%d %v\n",
+			name, de.Type, de.Size, de.BlockInfo)
+	}
+}
+
+func blockPrintFileBlock(fblock *libkbfs.FileBlock) {
+	if fblock.IsInd {
+		fmt.Printf("Type: file block (indirect)\n")
+		fmt.Printf("IPtrs (%d):\n", len(fblock.IPtrs))
+		for _, iptr := range fblock.IPtrs {
+			holes := ""
+			if iptr.Holes {
+				holes = " (has holes)"
+			}
+			fmt.Printf("  off=%d%s: %v\n",
+				iptr.Off, holes, iptr.BlockInfo)
+		}
+		return
+	}
+
+	fmt.Printf("Type: file block (direct)\n")
+	fmt.Printf("Contents: %s\n", byteCountStr(len(fblock.Contents)))
+}
+
+func blockGetOrDump(ctx context.Context, config libkbfs.Config,
+	args []string, dump bool) (exitStatus int) {
+	name, usageStr := "get", blockGetUsageStr
+	if dump {
+		name, usageStr = "dump", blockDumpUsageStr
+	}
+	flags := flag.NewFlagSet("kbfs block "+name, flag.ContinueOnError)
+	off, typeStr := addBlockInputFlags(flags)
+	err := flags.Parse(args)
+	if err != nil {
+		printError("block "+name, err)
+		return 1
+	}
+
+	if flags.NArg() < 1 {
+		fmt.Print(usageStr + blockInputUsageStr)
+		return 1
+	}
+
+	input, err := parseBlockInput(ctx, config, flags.Args(), *off, *typeStr)
+	if err != nil {
+		printError("block "+name, err)
+		return 1
+	}
+
+	block, err := blockFetch(ctx, config, input)
+	if err != nil {
+		printError("block "+name, err)
+		return 1
+	}
+
+	fmt.Printf("Block pointer: %v\n", input.ptr)
+	fmt.Printf("Encoded size: %s\n",
+		byteCountStr(int(block.GetEncodedSize())))
+
+	if dump {
+		c := spew.NewDefaultConfig()
+		c.Indent = "  "
+		c.DisablePointerAddresses = true
+		c.DisableCapacities = true
+		c.SortKeys = true
+		fmt.Printf("%s", c.Sdump(block))
+		return 0
+	}
+
+	switch b := block.(type) {
+	case *libkbfs.DirBlock:
+		blockPrintDirBlock(b)
+	case *libkbfs.FileBlock:
+		blockPrintFileBlock(b)
+	}
+	return 0
+}
+
+func blockGet(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
+	return blockGetOrDump(ctx, config, args, false)
+}
+
+func blockDump(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
+	return blockGetOrDump(ctx, config, args, true)
+}
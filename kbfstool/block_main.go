@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+const blockUsageStr = `Usage:
+  kbfstool block [<subcommand>] [<args>]
+
+The possible subcommands are:
+  get	      Fetch a block and print a summary of its contents
+  dump	      Fetch a block and dump its full decoded contents
+  refs	      List the references to a block known to the block server
+  verify      Check a block's ID against the hash of its contents
+`
+
+const blockInputUsageStr = `Each block must be given either as:
+
+  TLF BlockPointer
+  [-off offset] path
+
+where TLF is in the same format as in md dump, BlockPointer is in the
+format printed by the KBFS logs, e.g.
+
+  "BlockPointer{ID: 0123..., KeyGen: 1, DataVer: 1,
+    Context: Context{Creator: 0123..., RefNonce: 0123...},
+    DirectType: direct}",
+
+and path is a keybase path (e.g., "/keybase/private/user1/file").
+For a file path, the block used is the direct block containing the
+given offset (0 by default); for a directory path, it's the top
+block of the directory.
+
+`
+
+func blockMain(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
+	if len(args) < 1 {
+		fmt.Print(blockUsageStr)
+		return 1
+	}
+
+	cmd := args[0]
+	args = args[1:]
+
+	switch cmd {
+	case "get":
+		return blockGet(ctx, config, args)
+	case "dump":
+		return blockDump(ctx, config, args)
+	case "refs":
+		return blockRefs(ctx, config, args)
+	case "verify":
+		return blockVerify(ctx, config, args)
+	default:
+		printError("block", fmt.Errorf("unknown command '%s'", cmd))
+		return 1
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+
+	"github.com/keybase/kbfs/kbfsblock"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+const blockRefsUsageStr = `Usage:
+  kbfstool block refs TLF BlockPointer
+  kbfstool block refs [-off offset] path
+
+Only block servers that store their data locally (e.g., when run with
+-bserver=dir:/path) can list their references.
+
+`
+
+func blockRefs(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs block refs", flag.ContinueOnError)
+	off, typeStr := addBlockInputFlags(flags)
+	err := flags.Parse(args)
+	if err != nil {
+		printError("block refs", err)
+		return 1
+	}
+
+	if flags.NArg() < 1 {
+		fmt.Print(blockRefsUsageStr + blockInputUsageStr)
+		return 1
+	}
+
+	input, err := parseBlockInput(ctx, config, flags.Args(), *off, *typeStr)
+	if err != nil {
+		printError("block refs", err)
+		return 1
+	}
+
+	refs, err := libkbfs.GetLocalBlockRefs(
+		ctx, config.BlockServer(), input.tlfID, input.ptr.ID)
+	if err != nil {
+		printError("block refs", err)
+		return 1
+	}
+
+	nonces := make([]kbfsblock.RefNonce, 0, len(refs))
+	for nonce := range refs {
+		nonces = append(nonces, nonce)
+	}
+	sort.Slice(nonces, func(i, j int) bool {
+		return nonces[i].String() < nonces[j].String()
+	})
+
+	fmt.Printf("References to %s (%d):\n", input.ptr.ID, len(refs))
+	for _, nonce := range nonces {
+		ref := refs[nonce]
+		status := "live"
+		if ref.Archived {
+			status = "archived"
+		}
+		current := ""
+		if nonce == input.ptr.RefNonce {
+			current = " (given pointer)"
+		}
+		fmt.Printf("  %s: %s %v%s\n", nonce, status, ref.Context, current)
+	}
+
+	return 0
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+
+	"github.com/keybase/kbfs/kbfshash"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+const blockVerifyUsageStr = `Usage:
+  kbfstool block verify [-r] [-type file|dir|auto] TLF BlockPointer
+  kbfstool block verify [-r] [-off offset] path
+
+`
+
+// blockVerifyOne checks that the ID of the given block matches the
+// hash of its encrypted contents, and that it can be decrypted and
+// decoded.  If recursive is set, it does the same for all the
+// indirect children of the block.
+func blockVerifyOne(ctx context.Context, config libkbfs.Config,
+	input blockInput, recursive bool) (err error) {
+	fmt.Printf("Verifying %v...\n", input.ptr)
+	defer func() {
+		if err != nil {
+			fmt.Printf("Got error while verifying %s: %v\n",
+				input.ptr.ID, err)
+		}
+	}()
+
+	buf, serverHalf, err := config.BlockServer().Get(
+		ctx, input.tlfID, input.ptr.ID, input.ptr.Context)
+	if err != nil {
+		return err
+	}
+
+	h, err := kbfshash.DefaultHash(buf)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(h.Bytes(), input.ptr.ID.Bytes()) {
+		return fmt.Errorf("ID mismatch: contents hash to %s", h)
+	}
+	fmt.Printf("ID matches the hash of %s\n", byteCountStr(len(buf)))
+
+	block, err := decryptBlock(ctx, config, input.kmd, input.ptr,
+		input.bType, buf, serverHalf)
+	if err != nil {
+		return err
+	}
+
+	if !recursive {
+		return nil
+	}
+
+	var children []libkbfs.BlockPointer
+	switch b := block.(type) {
+	case *libkbfs.DirBlock:
+		input.bType = dirBlockType
+		for _, iptr := range b.IPtrs {
+			children = append(children, iptr.BlockPointer)
+		}
+	case *libkbfs.FileBlock:
+		input.bType = fileBlockType
+		for _, iptr := range b.IPtrs {
+			children = append(children, iptr.BlockPointer)
+		}
+	}
+
+	for _, ptr := range children {
+		input.ptr = ptr
+		childErr := blockVerifyOne(ctx, config, input, recursive)
+		if childErr != nil && err == nil {
+			err = childErr
+		}
+	}
+	// Children errors have already been printed.
+	if err != nil {
+		return fmt.Errorf("verification of a child block failed")
+	}
+	return nil
+}
+
+func blockVerify(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs block verify", flag.ContinueOnError)
+	off, typeStr := addBlockInputFlags(flags)
+	recursive := flags.Bool("r", false,
+		"Also verify all the indirect children of the block.")
+	err := flags.Parse(args)
+	if err != nil {
+		printError("block verify", err)
+		return 1
+	}
+
+	if flags.NArg() < 1 {
+		fmt.Print(blockVerifyUsageStr + blockInputUsageStr)
+		return 1
+	}
+
+	input, err := parseBlockInput(ctx, config, flags.Args(), *off, *typeStr)
+	if err != nil {
+		printError("block verify", err)
+		return 1
+	}
+
+	err = blockVerifyOne(ctx, config, input, *recursive)
+	if err != nil {
+		return 1
+	}
+
+	fmt.Printf("Verified %s\n", input.ptr.ID)
+	return 0
+}
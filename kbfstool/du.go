@@ -0,0 +1,146 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+
+	"github.com/keybase/kbfs/fsrpc"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+const duUsageStr = `Usage:
+  kbfstool du [flags] /keybase/[public|private]/tlf[/path/to/dir]...
+
+Displays the disk usage of each given directory, and of each
+directory under it unless -s is given. Usage is the total encoded
+size of all the unique blocks in a directory's subtree.
+
+`
+
+func humanByteCountStr(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%c", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func printDirUsage(p fsrpc.Path, usage libkbfs.DirUsage, human, all bool) {
+	sizeStr := fmt.Sprintf("%d", usage.Bytes)
+	if human {
+		sizeStr = humanByteCountStr(usage.Bytes)
+	}
+	if all {
+		fmt.Printf("%s\t%d blocks\t%d files\t%d dirs\t%s\n", sizeStr,
+			usage.Blocks, usage.Files, usage.Dirs, p)
+	} else {
+		fmt.Printf("%s\t%s\n", sizeStr, p)
+	}
+}
+
+// duOne prints the usage of every directory under the given one
+// (down to maxDepth levels, if non-negative), and then of the
+// directory itself, like du(1).
+func duOne(ctx context.Context, config libkbfs.Config, p fsrpc.Path,
+	n libkbfs.Node, maxDepth int, human, all bool) error {
+	kbfsOps := config.KBFSOps()
+	if maxDepth != 0 {
+		children, err := kbfsOps.GetDirChildren(ctx, n)
+		if err != nil {
+			return err
+		}
+		var names []string
+		for name, ei := range children {
+			if ei.Type == libkbfs.Dir {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			childNode, _, err := kbfsOps.Lookup(ctx, n, name)
+			if err != nil {
+				return err
+			}
+			childPath, err := p.Join(name)
+			if err != nil {
+				return err
+			}
+			err = duOne(ctx, config, childPath, childNode, maxDepth-1,
+				human, all)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	usage, err := kbfsOps.GetDirUsage(ctx, n)
+	if err != nil {
+		return err
+	}
+	printDirUsage(p, usage, human, all)
+	return nil
+}
+
+func du(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs du", flag.ContinueOnError)
+	summarize := flags.Bool("s", false,
+		"Only display the usage of each given directory.")
+	maxDepth := flags.Int("d", -1,
+		"Only display directories at most this many levels deep, "+
+			"if non-negative.")
+	human := flags.Bool("h", false, "Print sizes in human-readable form.")
+	all := flags.Bool("a", false,
+		"Also print the number of blocks, files and directories.")
+	err := flags.Parse(args)
+	if err != nil {
+		printError("du", err)
+		return 1
+	}
+
+	nodePathStrs := flags.Args()
+	if len(nodePathStrs) == 0 {
+		fmt.Print(duUsageStr)
+		return 1
+	}
+
+	depth := *maxDepth
+	if *summarize {
+		depth = 0
+	}
+
+	for _, nodePathStr := range nodePathStrs {
+		p, err := fsrpc.NewPath(nodePathStr)
+		if err != nil {
+			printError("du", err)
+			exitStatus = 1
+			continue
+		}
+
+		if p.PathType != fsrpc.TLFPathType {
+			printError("du", fmt.Errorf("%s is not a path in a TLF", p))
+			exitStatus = 1
+			continue
+		}
+
+		n, err := p.GetDirNode(ctx, config)
+		if err != nil {
+			printError("du", err)
+			exitStatus = 1
+			continue
+		}
+
+		err = duOne(ctx, config, p, n, depth, *human, *all)
+		if err != nil {
+			printError("du", err)
+			exitStatus = 1
+		}
+	}
+	return exitStatus
+}
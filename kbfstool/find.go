@@ -0,0 +1,157 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/kbfs/fsrpc"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+const findUsageStr = `Usage:
+  kbfstool find [flags] /keybase/[public|private]/tlf[/path/to/dir]
+
+Searches the local index of the given TLF for entries under the
+given directory that match all the given flags. The index is built
+the first time a TLF is searched, which may take a while for large
+TLFs.
+
+`
+
+func parseFindTypes(typeStr string) ([]libkbfs.EntryType, error) {
+	if typeStr == "" {
+		return nil, nil
+	}
+	var types []libkbfs.EntryType
+	for _, t := range strings.Split(typeStr, ",") {
+		switch t {
+		case "f":
+			types = append(types, libkbfs.File, libkbfs.Exec)
+		case "x":
+			types = append(types, libkbfs.Exec)
+		case "d":
+			types = append(types, libkbfs.Dir)
+		case "l":
+			types = append(types, libkbfs.Sym)
+		default:
+			return nil, fmt.Errorf("unknown entry type %q", t)
+		}
+	}
+	return types, nil
+}
+
+func findHelper(ctx context.Context, config libkbfs.Config,
+	p fsrpc.Path, query libkbfs.SearchQuery, longFormat bool) error {
+	if p.PathType != fsrpc.TLFPathType {
+		return fmt.Errorf("%s is not a path in a TLF", p)
+	}
+
+	tlfHandle, err := fsrpc.ParseTlfHandle(
+		ctx, config.KBPKI(), p.TLFName, p.TLFType)
+	if err != nil {
+		return err
+	}
+
+	kbfsOps := config.KBFSOps()
+	rootNode, _, err := kbfsOps.GetOrCreateRootNode(
+		ctx, tlfHandle, libkbfs.MasterBranch)
+	if err != nil {
+		return err
+	}
+
+	query.PathPrefix = strings.Join(p.TLFComponents, "/")
+	results, err := kbfsOps.FindEntries(
+		ctx, rootNode.GetFolderBranch(), query)
+	if err != nil {
+		return err
+	}
+
+	tlfPath := fsrpc.Path{
+		PathType: fsrpc.TLFPathType,
+		TLFType:  p.TLFType,
+		TLFName:  string(tlfHandle.GetCanonicalName()),
+	}
+	for _, r := range results {
+		fullPath := tlfPath.String() + "/" + r.Path
+		if longFormat {
+			mtimeStr := time.Unix(0, r.Mtime).Format("Jan 02 15:04")
+			fmt.Printf("%s\t%d\t%s\t%s\t%s\n",
+				computeModeStr(r.Type), r.Size, r.LastWriter,
+				mtimeStr, fullPath)
+		} else {
+			fmt.Printf("%s\n", fullPath)
+		}
+	}
+	return nil
+}
+
+func find(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs find", flag.ContinueOnError)
+	name := flags.String("name", "",
+		"Only find entries whose name matches this glob pattern.")
+	typeStr := flags.String("type", "",
+		"Only find entries of these comma-separated types: "+
+			"f (file), x (executable), d (directory), l (symlink).")
+	minSize := flags.Uint64("min-size", 0,
+		"Only find entries of at least this many bytes.")
+	maxSize := flags.Uint64("max-size", 0,
+		"Only find entries of at most this many bytes, if non-zero.")
+	newer := flags.Duration("newer", 0,
+		"Only find entries modified within this duration, if non-zero.")
+	older := flags.Duration("older", 0,
+		"Only find entries modified before this duration ago, if non-zero.")
+	writer := flags.String("writer", "",
+		"Only find entries last written by this user.")
+	limit := flags.Int("limit", 0,
+		"Stop after this many results, if non-zero.")
+	longFormat := flags.Bool("l", false, "List in long format.")
+	err := flags.Parse(args)
+	if err != nil {
+		printError("find", err)
+		return 1
+	}
+
+	if len(flags.Args()) != 1 {
+		fmt.Print(findUsageStr)
+		return 1
+	}
+
+	types, err := parseFindTypes(*typeStr)
+	if err != nil {
+		printError("find", err)
+		return 1
+	}
+
+	query := libkbfs.SearchQuery{
+		NamePattern: *name,
+		Types:       types,
+		MinSize:     *minSize,
+		MaxSize:     *maxSize,
+		LastWriter:  libkb.NewNormalizedUsername(*writer),
+		Limit:       *limit,
+	}
+	now := config.Clock().Now()
+	if *newer != 0 {
+		query.ModifiedAfter = now.Add(-*newer)
+	}
+	if *older != 0 {
+		query.ModifiedBefore = now.Add(-*older)
+	}
+
+	p, err := fsrpc.NewPath(flags.Arg(0))
+	if err != nil {
+		printError("find", err)
+		return 1
+	}
+
+	err = findHelper(ctx, config, p, query, *longFormat)
+	if err != nil {
+		printError("find", err)
+		return 1
+	}
+	return 0
+}
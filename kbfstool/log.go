@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/keybase/kbfs/fsrpc"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+const logUsageStr = `Usage:
+  kbfstool log [flags] /keybase/[public|private]/tlf[/path/to/dir]
+
+Displays the history of updates to the given TLF, newest first,
+restricted to ops that affect the given path if there is one.
+
+`
+
+func printUpdateSummary(u libkbfs.UpdateSummary, showOps bool) {
+	fmt.Printf("%d\t%s\t%s\t%d ops\n", u.Revision,
+		u.ServerTime.Format("2006-01-02 15:04:05"), u.Writer, len(u.Ops))
+	if !showOps {
+		return
+	}
+	for _, o := range u.Ops {
+		if o.Path != "" {
+			fmt.Printf("\t%s\t%s\n", o.Type, o.Path)
+		} else {
+			fmt.Printf("\t%s\n", o.Op)
+		}
+	}
+}
+
+func logHelper(ctx context.Context, config libkbfs.Config, p fsrpc.Path,
+	filter libkbfs.UpdateHistoryFilter, cursor kbfsmd.Revision, limit int,
+	showOps, jsonFormat bool) error {
+	if p.PathType != fsrpc.TLFPathType {
+		return fmt.Errorf("%s is not a path in a TLF", p)
+	}
+
+	tlfHandle, err := fsrpc.ParseTlfHandle(
+		ctx, config.KBPKI(), p.TLFName, p.TLFType)
+	if err != nil {
+		return err
+	}
+
+	kbfsOps := config.KBFSOps()
+	rootNode, _, err := kbfsOps.GetOrCreateRootNode(
+		ctx, tlfHandle, libkbfs.MasterBranch)
+	if err != nil {
+		return err
+	}
+	folderBranch := rootNode.GetFolderBranch()
+
+	filter.PathPrefix = strings.Join(p.TLFComponents, "/")
+	enc := json.NewEncoder(os.Stdout)
+	numPrinted := 0
+	for {
+		pageLimit := 0
+		if limit > 0 {
+			pageLimit = limit - numPrinted
+		}
+		page, err := kbfsOps.GetUpdateHistoryPage(
+			ctx, folderBranch, cursor, pageLimit, filter)
+		if err != nil {
+			return err
+		}
+		for _, u := range page.Updates {
+			if jsonFormat {
+				err = enc.Encode(u)
+				if err != nil {
+					return err
+				}
+			} else {
+				printUpdateSummary(u, showOps)
+			}
+		}
+		numPrinted += len(page.Updates)
+		if page.NextCursor == kbfsmd.RevisionUninitialized ||
+			(limit > 0 && numPrinted >= limit) {
+			return nil
+		}
+		cursor = page.NextCursor
+	}
+}
+
+func logCmd(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs log", flag.ContinueOnError)
+	writers := flags.String("writer", "",
+		"Only show updates by these comma-separated users.")
+	newer := flags.Duration("newer", 0,
+		"Only show updates made within this duration, if non-zero.")
+	older := flags.Duration("older", 0,
+		"Only show updates made before this duration ago, if non-zero.")
+	opTypes := flags.String("op", "",
+		"Only show ops of these comma-separated types: create, rm, "+
+			"rename, sync, setAttr, resolution, rekey, gc.")
+	start := flags.Int64("rev", 0,
+		"Start at this revision instead of the latest one, if non-zero.")
+	limit := flags.Int("limit", 0,
+		"Stop after this many updates, if non-zero.")
+	showOps := flags.Bool("v", false, "Show the ops of each update.")
+	jsonFormat := flags.Bool("json", false,
+		"Print each update as a JSON object.")
+	err := flags.Parse(args)
+	if err != nil {
+		printError("log", err)
+		return 1
+	}
+
+	if len(flags.Args()) != 1 {
+		fmt.Print(logUsageStr)
+		return 1
+	}
+
+	var filter libkbfs.UpdateHistoryFilter
+	if *writers != "" {
+		filter.Writers = strings.Split(*writers, ",")
+	}
+	if *opTypes != "" {
+		filter.OpTypes = strings.Split(*opTypes, ",")
+	}
+	now := config.Clock().Now()
+	if *newer != 0 {
+		filter.Since = now.Add(-*newer)
+	}
+	if *older != 0 {
+		filter.Until = now.Add(-*older)
+	}
+
+	p, err := fsrpc.NewPath(flags.Arg(0))
+	if err != nil {
+		printError("log", err)
+		return 1
+	}
+
+	err = logHelper(ctx, config, p, filter, kbfsmd.Revision(*start),
+		*limit, *showOps, *jsonFormat)
+	if err != nil {
+		printError("log", err)
+		return 1
+	}
+	return 0
+}
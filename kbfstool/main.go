@@ -37,10 +37,14 @@ Defaults:
 The possible commands are:
   stat		Display file status
   ls		List directory contents
+  find		Search for entries in a TLF
+  du		Display disk usage of directories
+  log		Display the update history of a TLF
   mkdir		Make directories
   read		Dump file to stdout
   write		Write stdin to file
   md            Operate on metadata objects
+  block         Operate on data blocks
 
 `
 
@@ -99,6 +103,12 @@ func realMain() (exitStatus int) {
 		return stat(ctx, config, args)
 	case "ls":
 		return ls(ctx, config, args)
+	case "find":
+		return find(ctx, config, args)
+	case "du":
+		return du(ctx, config, args)
+	case "log":
+		return logCmd(ctx, config, args)
 	case "mkdir":
 		return mkdir(ctx, config, args)
 	case "read":
@@ -107,6 +117,8 @@ func realMain() (exitStatus int) {
 		return write(ctx, config, args)
 	case "md":
 		return mdMain(ctx, config, args)
+	case "block":
+		return blockMain(ctx, config, args)
 	default:
 		printError("kbfs", fmt.Errorf("unknown command '%s'", cmd))
 		return 1
@@ -15,6 +15,8 @@ The possible subcommands are:
   check	      Check metadata objects and their associated blocks for errors
   reset	      Reset a broken top-level folder
   force-qr    Append a fake quota reclamation record to the folder history
+  marks       Inspect or reset the highest verified revisions of folders
+  retention   Inspect or set the retention policy of a folder
 `
 
 func mdMain(ctx context.Context, config libkbfs.Config, args []string) (exitStatus int) {
@@ -35,6 +37,10 @@ func mdMain(ctx context.Context, config libkbfs.Config, args []string) (exitStat
 		return mdReset(ctx, config, args)
 	case "force-qr":
 		return mdForceQR(ctx, config, args)
+	case "marks":
+		return mdMarks(ctx, config, args)
+	case "retention":
+		return mdRetention(ctx, config, args)
 	default:
 		printError("md", fmt.Errorf("unknown command '%s'", cmd))
 		return 1
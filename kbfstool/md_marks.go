@@ -0,0 +1,105 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// mdMarksGetTlfID is like getTlfID, but if the server is serving a
+// rolled-back head, it still returns the ID of the TLF, so that its
+// mark can be reset.
+func mdMarksGetTlfID(
+	ctx context.Context, config libkbfs.Config, tlfStr string) (
+	tlf.ID, error) {
+	tlfID, err := getTlfID(ctx, config, tlfStr)
+	if e, ok := errors.Cause(err).(libkbfs.MDRollbackError); ok {
+		fmt.Printf("Got rollback error for %q: %s\n", tlfStr, e)
+		return e.TlfID, nil
+	}
+	return tlfID, err
+}
+
+func mdMarksOne(ctx context.Context, config libkbfs.Config, tlfStr string,
+	reset, dryRun bool) error {
+	tlfID, err := mdMarksGetTlfID(ctx, config, tlfStr)
+	if err != nil {
+		return err
+	}
+
+	mark, ok, err := libkbfs.GetMDHighWaterMark(config, tlfID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		fmt.Printf("No high-water mark for %s (%q)\n", tlfID, tlfStr)
+		return nil
+	}
+	fmt.Printf("High-water mark for %s (%q): revision %d, MD ID %s\n",
+		tlfID, tlfStr, mark.Revision, mark.MdID)
+
+	if !reset {
+		return nil
+	}
+
+	if dryRun {
+		fmt.Print("Dry-run set; not resetting\n")
+		return nil
+	}
+
+	err = libkbfs.ResetMDHighWaterMark(config, tlfID)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Reset high-water mark for %s\n", tlfID)
+	return nil
+}
+
+const mdMarksUsageStr = `Usage:
+  kbfstool md marks [-reset] [-d] tlf [tlfs...]
+
+Prints the highest revision of each given TLF that has been verified
+by this device, which the MD server isn't allowed to roll back past.
+With -reset, also forgets it, which is needed after the TLF is
+legitimately rolled back.  Do this while KBFS isn't running, since
+a running client only reads each mark once.
+
+Each tlf can be:
+
+  - a TLF ID string (32 hex digits),
+  - or a keybase TLF path (e.g., "/keybase/public/user1,user2", or
+    "/keybase/private/user1,assertion2").
+
+`
+
+func mdMarks(ctx context.Context, config libkbfs.Config,
+	args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs md marks", flag.ContinueOnError)
+	reset := flags.Bool("reset", false, "Reset the high-water marks.")
+	dryRun := flags.Bool("d", false, "Dry run: don't actually do anything.")
+	err := flags.Parse(args)
+	if err != nil {
+		printError("md marks", err)
+		return 1
+	}
+
+	inputs := flags.Args()
+	if len(inputs) < 1 {
+		fmt.Print(mdMarksUsageStr)
+		return 1
+	}
+
+	for _, input := range inputs {
+		err := mdMarksOne(ctx, config, input, *reset, *dryRun)
+		if err != nil {
+			printError("md marks", err)
+			return 1
+		}
+	}
+
+	return 0
+}
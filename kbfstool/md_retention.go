@@ -0,0 +1,98 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/keybase/kbfs/fsrpc"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+func mdRetentionOne(ctx context.Context, config libkbfs.Config,
+	tlfPath, policyJSON string, clearPolicy, dryRun bool) error {
+	irmd, err := mdParseAndGet(ctx, config, tlfPath)
+	if err != nil {
+		return err
+	}
+	if p := irmd.RetentionPolicy(); p != nil {
+		fmt.Printf("Retention policy of %s as of revision %d: %+v\n",
+			tlfPath, irmd.Revision(), *p)
+	} else {
+		fmt.Printf("No retention policy for %s as of revision %d\n",
+			tlfPath, irmd.Revision())
+	}
+
+	if policyJSON == "" && !clearPolicy {
+		return nil
+	}
+
+	var policy *libkbfs.RetentionPolicy
+	if !clearPolicy {
+		p, err := libkbfs.ParseRetentionPolicy([]byte(policyJSON))
+		if err != nil {
+			return err
+		}
+		policy = &p
+	}
+
+	if dryRun {
+		fmt.Printf("Dry-run set; not setting retention policy %+v\n", policy)
+		return nil
+	}
+
+	p, err := fsrpc.NewPath(tlfPath)
+	if err != nil {
+		return err
+	}
+	rootNode, err := p.GetDirNode(ctx, config)
+	if err != nil {
+		return err
+	}
+	err = config.KBFSOps().SetRetentionPolicy(
+		ctx, rootNode.GetFolderBranch(), policy)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Set retention policy of %s\n", tlfPath)
+	return nil
+}
+
+const mdRetentionUsageStr = `Usage:
+  kbfstool md retention [-set <policy> | -clear] [-d] /keybase/[public|private]/user1,assertion2
+
+Prints the retention policy stored in the given TLF's metadata, which
+quota reclamation follows on every device.  With -set, replaces it
+with the given JSON policy, e.g. '{"minUnrefAge": "90d",
+"keepRevisions": 100}' or '{"neverReclaim": true}'.  With -clear,
+removes it, so that each device goes back to its local
+-retention-policies file, if any.
+
+`
+
+func mdRetention(ctx context.Context, config libkbfs.Config,
+	args []string) (exitStatus int) {
+	flags := flag.NewFlagSet("kbfs md retention", flag.ContinueOnError)
+	set := flags.String("set", "", "The JSON retention policy to store.")
+	clearPolicy := flags.Bool("clear", false, "Remove the stored retention policy.")
+	dryRun := flags.Bool("d", false, "Dry run: don't actually do anything.")
+	err := flags.Parse(args)
+	if err != nil {
+		printError("md retention", err)
+		return 1
+	}
+
+	inputs := flags.Args()
+	if len(inputs) != 1 || (*set != "" && *clearPolicy) {
+		fmt.Print(mdRetentionUsageStr)
+		return 1
+	}
+
+	err = mdRetentionOne(ctx, config, inputs[0], *set, *clearPolicy, *dryRun)
+	if err != nil {
+		printError("md retention", err)
+		return 1
+	}
+
+	return 0
+}
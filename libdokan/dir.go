@@ -291,6 +291,14 @@ func (d *Dir) open(ctx context.Context, oc *openContext, path []string) (dokan.F
 
 		leaf := len(path) == 1
 
+		// The usage file describes the directory it's in.
+		if leaf && path[0] == libfs.UsageFileName {
+			if err := oc.ReturningFileAllowed(); err != nil {
+				return nil, false, err
+			}
+			return NewDirUsageFile(d.folder, d.node), false, nil
+		}
+
 		// Check if this is a per-file metainformation file, if so
 		// return the corresponding SpecialReadFile.
 		if leaf && strings.HasPrefix(path[0], libfs.FileInfoPrefix) {
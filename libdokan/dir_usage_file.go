@@ -0,0 +1,24 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libdokan
+
+import (
+	"time"
+
+	"github.com/keybase/kbfs/libfs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// NewDirUsageFile returns a special read file that contains a text
+// representation of the disk usage of the given directory.
+func NewDirUsageFile(folder *Folder, dir libkbfs.Node) *SpecialReadFile {
+	return &SpecialReadFile{
+		read: func(ctx context.Context) ([]byte, time.Time, error) {
+			return libfs.GetEncodedDirUsage(ctx, folder.fs.config, dir)
+		},
+		fs: folder.fs,
+	}
+}
@@ -0,0 +1,37 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libdokan
+
+import (
+	"github.com/keybase/kbfs/dokan"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// ReencryptionFile represents a write-only file where any write of
+// at least one byte triggers either enabling or disabling background
+// re-encryption of the folder's blocks that use old key generations.
+type ReencryptionFile struct {
+	folder *Folder
+	enable bool
+	specialWriteFile
+}
+
+// WriteFile implements writes for dokan.
+func (f *ReencryptionFile) WriteFile(ctx context.Context, fi *dokan.FileInfo, bs []byte, offset int64) (n int, err error) {
+	f.folder.fs.logEnter(ctx, "ReencryptionFile WriteFile")
+	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+	f.folder.fs.log.CDebugf(ctx, "ReencryptionFile (enable: %t) Write",
+		f.enable)
+	if len(bs) == 0 {
+		return 0, nil
+	}
+	err = f.folder.fs.config.KBFSOps().SetBackgroundReencryption(
+		ctx, f.folder.getFolderBranch(), f.enable)
+	if err != nil {
+		return 0, err
+	}
+	return len(bs), nil
+}
@@ -38,6 +38,22 @@ func handleTLFSpecialFile(name string, folder *Folder) dokan.File {
 			enable: true,
 		}
 
+	case libfs.DisableReencryptionFileName:
+		return &ReencryptionFile{
+			folder: folder,
+		}
+
+	case libfs.EnableReencryptionFileName:
+		return &ReencryptionFile{
+			folder: folder,
+			enable: true,
+		}
+
+	case libfs.MakeImmutableFileName:
+		return &MakeImmutableFile{
+			folder: folder,
+		}
+
 	case libfs.RekeyFileName:
 		return &RekeyFile{
 			folder: folder,
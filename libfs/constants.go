@@ -36,6 +36,21 @@ const DisableUpdatesFileName = ".kbfs_disable_updates"
 // file -- it can be reached anywhere within a top-level folder.
 const EnableUpdatesFileName = ".kbfs_enable_updates"
 
+// EnableReencryptionFileName is the name of the file that enables
+// background re-encryption of old blocks -- it can be reached
+// anywhere within a top-level folder.
+const EnableReencryptionFileName = ".kbfs_enable_reencryption"
+
+// DisableReencryptionFileName is the name of the file that disables
+// background re-encryption of old blocks -- it can be reached
+// anywhere within a top-level folder.
+const DisableReencryptionFileName = ".kbfs_disable_reencryption"
+
+// MakeImmutableFileName is the name of the file that permanently
+// turns a top-level folder into a write-once, read-many folder -- it
+// can be reached anywhere within a top-level folder.
+const MakeImmutableFileName = ".kbfs_make_immutable"
+
 // ResetCachesFileName is the name of the KBFS unstaging file.
 const ResetCachesFileName = ".kbfs_reset_caches"
 
@@ -90,5 +105,10 @@ const DisableDebugServerFileName = ".kbfs_disable_debug_server"
 // it can be reached anywhere within a top-level folder.
 const EditHistoryName = ".kbfs_edit_history"
 
+// UsageFileName is the name of the KBFS per-directory disk usage
+// file -- it can be reached in any directory within a top-level
+// folder, and describes the usage of that directory.
+const UsageFileName = ".kbfs_usage"
+
 // FileInfoPrefix is the prefix of the per-file metadata files.
 const FileInfoPrefix = ".kbfs_fileinfo_"
@@ -0,0 +1,25 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfs
+
+import (
+	"time"
+
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// GetEncodedDirUsage returns serialized JSON containing the disk
+// usage of the given directory.
+func GetEncodedDirUsage(ctx context.Context, config libkbfs.Config,
+	dir libkbfs.Node) (data []byte, t time.Time, err error) {
+	usage, err := config.KBFSOps().GetDirUsage(ctx, dir)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	data, err = PrettyJSON(usage)
+	return data, time.Time{}, err
+}
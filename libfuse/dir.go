@@ -378,6 +378,10 @@ func (f *Folder) writePermMode(ctx context.Context,
 	return original, nil
 }
 
+// ufImmutable is the chflags(2) user immutable flag (UF_IMMUTABLE)
+// on OS X, which maps to a read-only KBFS entry.
+const ufImmutable = 0x2
+
 // fillAttrWithUIDAndWritePerm sets attributes based on the entry info, and
 // pops in correct UID and write permissions. It only handles fields common to
 // all entryinfo types.
@@ -396,6 +400,20 @@ func (f *Folder) fillAttrWithUIDAndWritePerm(
 		return err
 	}
 
+	if ei.Mode.IsPermSet() {
+		// Explicitly-set permissions replace the defaults, but
+		// non-writers still can't write.
+		perm := ei.Mode.Perm(ei.Type)
+		if a.Mode&0200 == 0 {
+			perm &^= 0222
+		}
+		a.Mode = a.Mode&^os.ModePerm | perm
+	}
+	if ei.Mode.IsReadOnly() {
+		a.Mode &^= 0222
+		a.Flags |= ufImmutable
+	}
+
 	return nil
 }
 
@@ -505,7 +523,10 @@ func (d *Dir) attr(ctx context.Context, a *fuse.Attr) (err error) {
 		return err
 	}
 
-	a.Mode |= os.ModeDir | 0500
+	a.Mode |= os.ModeDir
+	if !de.Mode.IsPermSet() {
+		a.Mode |= 0500
+	}
 	return nil
 }
 
@@ -531,6 +552,11 @@ func (d *Dir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.Lo
 		return specialNode, nil
 	}
 
+	// The usage file describes this particular directory.
+	if req.Name == libfs.UsageFileName {
+		return NewDirUsageFile(d, &resp.EntryValid), nil
+	}
+
 	// Check if this is a per-file metainformation file, if so
 	// return the corresponding SpecialReadFile.
 	if strings.HasPrefix(req.Name, libfs.FileInfoPrefix) {
@@ -712,8 +738,8 @@ func (d *Dir) Rename(ctx context.Context, req *fuse.RenameRequest,
 			req.OldName, req.NewName))
 	defer func() { d.folder.fs.config.MaybeFinishTrace(ctx, err) }()
 
-	d.folder.fs.log.CDebugf(ctx, "Dir Rename %s -> %s",
-		req.OldName, req.NewName)
+	d.folder.fs.log.CDebugf(ctx, "Dir Rename %s -> %s (flags %#x)",
+		req.OldName, req.NewName, req.Flags)
 	defer func() { d.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
 
 	var realNewDir *Dir
@@ -738,8 +764,15 @@ func (d *Dir) Rename(ctx context.Context, req *fuse.RenameRequest,
 		return fuse.Errno(syscall.EIO)
 	}
 
+	// The renameat2(2) flags RENAME_NOREPLACE and RENAME_EXCHANGE
+	// have the same values as their libkbfs counterparts; anything
+	// else, like RENAME_WHITEOUT, is rejected by KBFSOps.
+	if req.Flags > math.MaxUint8 {
+		return fuse.Errno(syscall.EINVAL)
+	}
 	err = d.folder.fs.config.KBFSOps().Rename(ctx,
-		d.node, req.OldName, realNewDir.node, req.NewName)
+		d.node, req.OldName, realNewDir.node, req.NewName,
+		libkbfs.RenameFlags(req.Flags))
 
 	switch e := err.(type) {
 	case nil:
@@ -836,16 +869,25 @@ func (d *Dir) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.
 	defer func() { d.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
 
 	if valid.Mode() {
-		// You can't set the mode on KBFS directories, but we don't
-		// want to return EPERM because that unnecessarily fails some
-		// applications like unzip.  Instead ignore it, print a debug
-		// message, and advertise this behavior on the
-		// "understand_kbfs" doc online.
-		d.folder.fs.log.CDebugf(ctx, "Ignoring unsupported attempt to set "+
-			"the mode on a directory")
+		err := d.folder.fs.config.KBFSOps().SetPerm(
+			ctx, d.node, req.Mode.Perm())
+		if err != nil {
+			return err
+		}
 		valid &^= fuse.SetattrMode
 	}
 
+	if valid.Flags() {
+		// Only the user immutable flag is supported; other chflags(2)
+		// flags are ignored.
+		err := d.folder.fs.config.KBFSOps().SetReadOnly(
+			ctx, d.node, req.Flags&ufImmutable != 0)
+		if err != nil {
+			return err
+		}
+		valid &^= fuse.SetattrFlags
+	}
+
 	if valid.Mtime() {
 		err := d.folder.fs.config.KBFSOps().SetMtime(
 			ctx, d.node, &req.Mtime)
@@ -0,0 +1,26 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/keybase/kbfs/libfs"
+)
+
+// NewDirUsageFile returns a special read file that contains a text
+// representation of the disk usage of the given directory.
+func NewDirUsageFile(
+	dir *Dir, entryValid *time.Duration) *SpecialReadFile {
+	*entryValid = 0
+	return &SpecialReadFile{
+		read: func(ctx context.Context) ([]byte, time.Time, error) {
+			return libfs.GetEncodedDirUsage(
+				ctx, dir.folder.fs.config, dir.node)
+		},
+	}
+}
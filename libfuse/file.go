@@ -6,12 +6,14 @@ package libfuse
 
 import (
 	"fmt"
+	"math"
 	"os"
 	"sync"
 
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
 	"github.com/keybase/kbfs/libkbfs"
+	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 )
 
@@ -68,6 +70,9 @@ func (f *File) fillAttrWithMode(
 	if err = f.folder.fillAttrWithUIDAndWritePerm(ctx, ei, a); err != nil {
 		return err
 	}
+	if ei.Mode.IsPermSet() {
+		return nil
+	}
 	a.Mode |= 0400
 	if ei.Type == libkbfs.Exec {
 		a.Mode |= 0100
@@ -247,6 +252,57 @@ func (f *File) Write(ctx context.Context, req *fuse.WriteRequest,
 	return nil
 }
 
+var _ fs.HandleCopyFileRanger = (*File)(nil)
+
+// CopyFileRange implements the fs.HandleCopyFileRanger interface for
+// File.  It only handles copying the whole of a file into an empty
+// file in the same folder, which KBFS can do without moving any data
+// by sharing the source's blocks.  Anything else gets EOPNOTSUPP, and
+// the kernel copies the data itself.  FICLONE (cp --reflink) never
+// reaches us, since the kernel serves it through remap_file_range,
+// which FUSE doesn't implement, and OSXFUSE never sends this request.
+func (f *File) CopyFileRange(ctx context.Context,
+	req *fuse.CopyFileRangeRequest, resp *fuse.CopyFileRangeResponse,
+	handleOut fs.Handle) (err error) {
+	dest, ok := handleOut.(*File)
+	if !ok || dest == f || dest.folder != f.folder || req.Flags != 0 ||
+		req.Offset != 0 || req.OffsetOut != 0 {
+		return fuse.ENOTSUP
+	}
+
+	ctx = f.folder.fs.config.MaybeStartTrace(ctx, "File.CopyFileRange",
+		fmt.Sprintf("%s -> %s len=%d", f.node.GetBasename(),
+			dest.node.GetBasename(), req.Len))
+	defer func() { f.folder.fs.config.MaybeFinishTrace(ctx, err) }()
+
+	f.folder.fs.log.CDebugf(ctx, "File CopyFileRange len=%d", req.Len)
+	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+
+	ei, err := f.folder.fs.config.KBFSOps().Stat(ctx, f.node)
+	if err != nil {
+		return err
+	}
+	if ei.Size > req.Len || ei.Size > math.MaxUint32 {
+		return fuse.ENOTSUP
+	}
+	if ei.Size == 0 {
+		return nil
+	}
+
+	dest.eiCache.destroy()
+	_, err = f.folder.fs.config.KBFSOps().CopyFileContents(
+		ctx, f.node, dest.node)
+	switch errors.Cause(err).(type) {
+	case nil:
+	case libkbfs.FileNotEmptyError, libkbfs.CopyAcrossDirsError:
+		return fuse.ENOTSUP
+	default:
+		return err
+	}
+	resp.Size = uint32(ei.Size)
+	return nil
+}
+
 var _ fs.NodeSetattrer = (*File)(nil)
 
 // Setattr implements the fs.NodeSetattrer interface for File.
@@ -271,10 +327,9 @@ func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest,
 	}
 
 	if valid.Mode() {
-		// Unix has 3 exec bits, KBFS has one; we follow the user-exec bit.
-		exec := req.Mode&0100 != 0
-		err := f.folder.fs.config.KBFSOps().SetEx(
-			ctx, f.node, exec)
+		// The user-exec bit also sets the KBFS exec type.
+		err := f.folder.fs.config.KBFSOps().SetPerm(
+			ctx, f.node, req.Mode.Perm())
 		if err != nil {
 			return err
 		}
@@ -307,8 +362,16 @@ func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest,
 	// things we don't need to explicitly handle
 	valid &^= fuse.SetattrLockOwner | fuse.SetattrHandle
 
-	// KBFS has no concept of chflags(2); explicitly ignore those
-	valid &^= fuse.SetattrFlags
+	if valid.Flags() {
+		// Only the user immutable flag is supported; other chflags(2)
+		// flags are ignored.
+		err := f.folder.fs.config.KBFSOps().SetReadOnly(
+			ctx, f.node, req.Flags&ufImmutable != 0)
+		if err != nil {
+			return err
+		}
+		valid &^= fuse.SetattrFlags
+	}
 
 	if valid != 0 {
 		// don't let an unhandled operation slip by without error
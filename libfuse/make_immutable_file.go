@@ -0,0 +1,49 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// MakeImmutableFile represents a write-only file where any write of
+// at least one byte permanently turns the folder into a write-once,
+// read-many folder.
+type MakeImmutableFile struct {
+	folder *Folder
+}
+
+var _ fs.Node = (*MakeImmutableFile)(nil)
+
+// Attr implements the fs.Node interface for MakeImmutableFile.
+func (f *MakeImmutableFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Size = 0
+	a.Mode = 0222
+	return nil
+}
+
+var _ fs.Handle = (*MakeImmutableFile)(nil)
+
+var _ fs.HandleWriter = (*MakeImmutableFile)(nil)
+
+// Write implements the fs.HandleWriter interface for MakeImmutableFile.
+func (f *MakeImmutableFile) Write(ctx context.Context, req *fuse.WriteRequest,
+	resp *fuse.WriteResponse) (err error) {
+	f.folder.fs.log.CDebugf(ctx, "MakeImmutableFile Write")
+	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+	if len(req.Data) == 0 {
+		return nil
+	}
+	err = f.folder.fs.config.KBFSOps().MakeImmutable(
+		ctx, f.folder.getFolderBranch())
+	if err != nil {
+		return err
+	}
+	resp.Size = len(req.Data)
+	return nil
+}
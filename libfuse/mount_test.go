@@ -913,6 +913,57 @@ func TestRenameOverwrite(t *testing.T) {
 	}
 }
 
+// Linux kernels negotiate the newest protocol we speak, so renameat2
+// flags get through; OSXFUSE caps out at 7.19, and must still work
+// without them.
+func TestProtocolNegotiation(t *testing.T) {
+	p, err := fuse.NegotiateProtocol(fuse.Protocol{Major: 7, Minor: 31})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, e := p, (fuse.Protocol{Major: 7, Minor: 28}); g != e {
+		t.Errorf("wrong protocol: %v != %v", g, e)
+	}
+	if !p.HasCopyFileRange() || !p.HasRenameFlags() || !p.HasBatchForget() {
+		t.Errorf("missing features in %v", p)
+	}
+
+	p, err = fuse.NegotiateProtocol(fuse.Protocol{Major: 7, Minor: 26})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, e := p, (fuse.Protocol{Major: 7, Minor: 26}); g != e {
+		t.Errorf("wrong protocol: %v != %v", g, e)
+	}
+	if p.HasCopyFileRange() || !p.HasRenameFlags() {
+		t.Errorf("wrong features in %v", p)
+	}
+
+	p, err = fuse.NegotiateProtocol(fuse.Protocol{Major: 7, Minor: 19})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, e := p, (fuse.Protocol{Major: 7, Minor: 19}); g != e {
+		t.Errorf("wrong protocol: %v != %v", g, e)
+	}
+	if p.HasCopyFileRange() || p.HasRenameFlags() || !p.HasBatchForget() {
+		t.Errorf("wrong features in %v", p)
+	}
+
+	p, err = fuse.NegotiateProtocol(fuse.Protocol{Major: 7, Minor: 12})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.HasRenameFlags() || p.HasBatchForget() {
+		t.Errorf("wrong features in %v", p)
+	}
+
+	_, err = fuse.NegotiateProtocol(fuse.Protocol{Major: 7, Minor: 7})
+	if _, ok := err.(*fuse.OldVersionError); !ok {
+		t.Errorf("unexpected error for an old kernel: %v", err)
+	}
+}
+
 func TestRenameCrossDir(t *testing.T) {
 	ctx := libkbfs.BackgroundContextWithCancellationDelayer()
 	defer libkbfs.CleanupCancellationDelayer(ctx)
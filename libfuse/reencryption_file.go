@@ -0,0 +1,51 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libfuse
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/net/context"
+)
+
+// ReencryptionFile represents a write-only file where any write of
+// at least one byte triggers either enabling or disabling background
+// re-encryption of the folder's blocks that use old key generations.
+type ReencryptionFile struct {
+	folder *Folder
+	enable bool
+}
+
+var _ fs.Node = (*ReencryptionFile)(nil)
+
+// Attr implements the fs.Node interface for ReencryptionFile.
+func (f *ReencryptionFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Size = 0
+	a.Mode = 0222
+	return nil
+}
+
+var _ fs.Handle = (*ReencryptionFile)(nil)
+
+var _ fs.HandleWriter = (*ReencryptionFile)(nil)
+
+// Write implements the fs.HandleWriter interface for ReencryptionFile.
+func (f *ReencryptionFile) Write(ctx context.Context, req *fuse.WriteRequest,
+	resp *fuse.WriteResponse) (err error) {
+	f.folder.fs.log.CDebugf(ctx, "ReencryptionFile (enable: %t) Write",
+		f.enable)
+	defer func() { f.folder.reportErr(ctx, libkbfs.WriteMode, err) }()
+	if len(req.Data) == 0 {
+		return nil
+	}
+	err = f.folder.fs.config.KBFSOps().SetBackgroundReencryption(
+		ctx, f.folder.getFolderBranch(), f.enable)
+	if err != nil {
+		return err
+	}
+	resp.Size = len(req.Data)
+	return nil
+}
@@ -0,0 +1,133 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// +build linux,amd64
+
+package libfuse
+
+import (
+	"os"
+	"path"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/keybase/kbfs/libkbfs"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// The vendored golang.org/x/sys/unix doesn't define these for
+	// amd64 yet.
+	sysRenameat2    = 316
+	renameNoReplace = 1 << 0
+	renameExchange  = 1 << 1
+)
+
+func renameat2(oldPath, newPath string, flags uint) error {
+	oldPtr, err := syscall.BytePtrFromString(oldPath)
+	if err != nil {
+		return err
+	}
+	newPtr, err := syscall.BytePtrFromString(newPath)
+	if err != nil {
+		return err
+	}
+	atFdcwd := unix.AT_FDCWD
+	_, _, errno := syscall.Syscall6(sysRenameat2,
+		uintptr(atFdcwd), uintptr(unsafe.Pointer(oldPtr)),
+		uintptr(atFdcwd), uintptr(unsafe.Pointer(newPtr)),
+		uintptr(flags), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func checkFileContents(t *testing.T, p string, expected string) {
+	buf, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatalf("read error: %v", err)
+	}
+	if g, e := string(buf), expected; g != e {
+		t.Errorf("bad file contents in %s: %q != %q", p, g, e)
+	}
+}
+
+func TestRenameNoReplace(t *testing.T) {
+	ctx := libkbfs.BackgroundContextWithCancellationDelayer()
+	defer libkbfs.CleanupCancellationDelayer(ctx)
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(ctx, t, config)
+	mnt, _, cancelFn := makeFS(t, ctx, config)
+	defer mnt.Close()
+	defer cancelFn()
+
+	p1 := path.Join(mnt.Dir, PrivateName, "jdoe", "old")
+	p2 := path.Join(mnt.Dir, PrivateName, "jdoe", "new")
+	p3 := path.Join(mnt.Dir, PrivateName, "jdoe", "other")
+	const input = "hello, world\n"
+	if err := ioutil.WriteFile(p1, []byte(input), 0644); err != nil {
+		t.Fatal(err)
+	}
+	syncFilename(t, p1)
+	if err := ioutil.WriteFile(p2, []byte("keeper\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	syncFilename(t, p2)
+
+	if err := renameat2(p1, p2, renameNoReplace); err != syscall.EEXIST {
+		t.Fatalf("expected EEXIST, got %v", err)
+	}
+	checkFileContents(t, p1, input)
+	checkFileContents(t, p2, "keeper\n")
+
+	if err := renameat2(p1, p3, renameNoReplace); err != nil {
+		t.Fatal(err)
+	}
+	checkDir(t, path.Join(mnt.Dir, PrivateName, "jdoe"), map[string]fileInfoCheck{
+		"new":   nil,
+		"other": nil,
+	})
+	checkFileContents(t, p3, input)
+}
+
+func TestRenameExchange(t *testing.T) {
+	ctx := libkbfs.BackgroundContextWithCancellationDelayer()
+	defer libkbfs.CleanupCancellationDelayer(ctx)
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	defer libkbfs.CheckConfigAndShutdown(ctx, t, config)
+	mnt, _, cancelFn := makeFS(t, ctx, config)
+	defer mnt.Close()
+	defer cancelFn()
+
+	p1 := path.Join(mnt.Dir, PrivateName, "jdoe", "a")
+	p2 := path.Join(mnt.Dir, PrivateName, "jdoe", "d")
+	const input = "hello, world\n"
+	if err := ioutil.WriteFile(p1, []byte(input), 0644); err != nil {
+		t.Fatal(err)
+	}
+	syncFilename(t, p1)
+	if err := ioutil.Mkdir(p2, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Older clients would misapply an exchange.
+	if err := renameat2(p1, p2, renameExchange); err != syscall.EINVAL {
+		t.Fatalf("expected EINVAL, got %v", err)
+	}
+
+	config.SetOpsVersion(libkbfs.RenameExchangeOpsVer)
+	if err := renameat2(p1, p2, renameExchange); err != nil {
+		t.Fatal(err)
+	}
+	checkDir(t, path.Join(mnt.Dir, PrivateName, "jdoe"), map[string]fileInfoCheck{
+		"a": mustBeDir,
+		"d": func(fi os.FileInfo) error {
+			return mustBeFileWithSize(fi, int64(len(input)))
+		},
+	})
+	checkFileContents(t, p2, input)
+}
@@ -103,6 +103,22 @@ func handleTLFSpecialFile(
 			enable: true,
 		}
 
+	case libfs.DisableReencryptionFileName:
+		return &ReencryptionFile{
+			folder: folder,
+		}
+
+	case libfs.EnableReencryptionFileName:
+		return &ReencryptionFile{
+			folder: folder,
+			enable: true,
+		}
+
+	case libfs.MakeImmutableFileName:
+		return &MakeImmutableFile{
+			folder: folder,
+		}
+
 	case libfs.RekeyFileName:
 		return &RekeyFile{
 			folder: folder,
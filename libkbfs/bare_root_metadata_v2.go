@@ -520,6 +520,11 @@ func (md *BareRootMetadataV2) CheckValidSuccessor(
 		}
 	}
 
+	// (7) Check that an immutable folder stays immutable.
+	if md.IsImmutableSet() && !nextMd.IsImmutableSet() {
+		return errors.New("Successor of an immutable MD isn't immutable")
+	}
+
 	// TODO: Check that the successor (bare) TLF handle is the
 	// same or more resolved.
 
@@ -997,6 +1002,16 @@ func (md *BareRootMetadataV2) SetUnmerged() {
 	md.WriterMetadataV2.WFlags |= MetadataFlagUnmerged
 }
 
+// IsImmutableSet implements the BareRootMetadata interface for BareRootMetadataV2.
+func (md *BareRootMetadataV2) IsImmutableSet() bool {
+	return (md.WriterMetadataV2.WFlags & MetadataFlagImmutable) != 0
+}
+
+// SetImmutable implements the MutableBareRootMetadata interface for BareRootMetadataV2.
+func (md *BareRootMetadataV2) SetImmutable() {
+	md.WriterMetadataV2.WFlags |= MetadataFlagImmutable
+}
+
 // SetBranchID implements the MutableBareRootMetadata interface for BareRootMetadataV2.
 func (md *BareRootMetadataV2) SetBranchID(bid BranchID) {
 	md.WriterMetadataV2.BID = bid
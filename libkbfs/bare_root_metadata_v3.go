@@ -573,6 +573,11 @@ func (md *BareRootMetadataV3) CheckValidSuccessor(
 		}
 	}
 
+	// (7) Check that an immutable folder stays immutable.
+	if md.IsImmutableSet() && !nextMd.IsImmutableSet() {
+		return errors.New("Successor of an immutable MD isn't immutable")
+	}
+
 	// TODO: Check that the successor (bare) TLF handle is the
 	// same or more resolved.
 
@@ -1082,6 +1087,16 @@ func (md *BareRootMetadataV3) SetUnmerged() {
 	md.WriterMetadata.WFlags |= MetadataFlagUnmerged
 }
 
+// IsImmutableSet implements the BareRootMetadata interface for BareRootMetadataV3.
+func (md *BareRootMetadataV3) IsImmutableSet() bool {
+	return (md.WriterMetadata.WFlags & MetadataFlagImmutable) != 0
+}
+
+// SetImmutable implements the MutableBareRootMetadata interface for BareRootMetadataV3.
+func (md *BareRootMetadataV3) SetImmutable() {
+	md.WriterMetadata.WFlags |= MetadataFlagImmutable
+}
+
 // SetBranchID implements the MutableBareRootMetadata interface for BareRootMetadataV3.
 func (md *BareRootMetadataV3) SetBranchID(bid BranchID) {
 	md.WriterMetadata.BID = bid
@@ -234,6 +234,15 @@ func (s *blockDiskStore) getData(id kbfsblock.ID) (
 
 // All functions below are public functions.
 
+func (s *blockDiskStore) getRefs(id kbfsblock.ID) (blockRefMap, error) {
+	info, err := s.getInfo(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return info.Refs, nil
+}
+
 func (s *blockDiskStore) hasAnyRef(id kbfsblock.ID) (bool, error) {
 	info, err := s.getInfo(id)
 	if err != nil {
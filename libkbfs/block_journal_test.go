@@ -467,7 +467,7 @@ func TestBlockJournalFlush(t *testing.T) {
 
 		err = flushBlockEntries(
 			ctx, j.log, j.deferLog, blockServer, bcache, reporter,
-			tlfID, CanonicalTlfName("fake TLF"), entries)
+			tlfID, CanonicalTlfName("fake TLF"), entries, nil)
 		require.NoError(t, err)
 
 		flushedBytes, err = j.removeFlushedEntries(
@@ -543,7 +543,7 @@ func flushBlockJournalOne(ctx context.Context, t *testing.T,
 	require.Equal(t, 1, entries.length())
 	err = flushBlockEntries(ctx, j.log, j.deferLog, blockServer,
 		bcache, reporter, tlfID, CanonicalTlfName("fake TLF"),
-		entries)
+		entries, nil)
 	require.NoError(t, err)
 	flushedBytes, err = j.removeFlushedEntries(
 		ctx, entries, tlfID, reporter)
@@ -722,7 +722,7 @@ func TestBlockJournalFlushMDRevMarker(t *testing.T) {
 	require.Equal(t, 2, entries.length())
 	err = flushBlockEntries(ctx, j.log, j.deferLog, blockServer,
 		bcache, reporter, tlfID, CanonicalTlfName("fake TLF"),
-		entries)
+		entries, nil)
 	require.NoError(t, err)
 	flushedBytes, err := j.removeFlushedEntries(
 		ctx, entries, tlfID, reporter)
@@ -788,7 +788,7 @@ func TestBlockJournalFlushMDRevMarkerForPendingLocalSquash(t *testing.T) {
 
 	err = flushBlockEntries(ctx, j.log, j.deferLog, blockServer,
 		bcache, reporter, tlfID, CanonicalTlfName("fake TLF"),
-		entries)
+		entries, nil)
 	require.NoError(t, err)
 
 	flushedBytes, err := j.removeFlushedEntries(
@@ -862,7 +862,7 @@ func TestBlockJournalIgnoreBlocks(t *testing.T) {
 	require.Equal(t, bID4, entries.puts.blockStates[1].blockPtr.ID)
 	err = flushBlockEntries(ctx, j.log, j.deferLog, blockServer,
 		bcache, reporter, tlfID, CanonicalTlfName("fake TLF"),
-		entries)
+		entries, nil)
 	require.NoError(t, err)
 	flushedBytes, err := j.removeFlushedEntries(
 		ctx, entries, tlfID, reporter)
@@ -921,7 +921,7 @@ func TestBlockJournalSaveUntilMDFlush(t *testing.T) {
 		require.NoError(t, err)
 		err = flushBlockEntries(ctx, j.log, j.deferLog, blockServer,
 			bcache, reporter, tlfID, CanonicalTlfName("fake TLF"),
-			entries)
+			entries, nil)
 		require.NoError(t, err)
 		flushedBytes, err := j.removeFlushedEntries(
 			ctx, entries, tlfID, reporter)
@@ -8,11 +8,13 @@ import (
 	"github.com/keybase/kbfs/kbfsblock"
 	"github.com/keybase/kbfs/kbfscrypto"
 	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 )
 
 type blockOpsConfig interface {
 	dataVersioner
+	blockCryptVersioner
 	logMaker
 	blockCacher
 	blockServerGetter
@@ -20,6 +22,7 @@ type blockOpsConfig interface {
 	cryptoPureGetter
 	keyGetterGetter
 	diskBlockCacheGetter
+	blockTransferControllersGetter
 }
 
 // BlockOpsStandard implements the BlockOps interface by relaying
@@ -51,7 +54,12 @@ func NewBlockOpsStandard(config blockOpsConfig,
 
 // Get implements the BlockOps interface for BlockOpsStandard.
 func (b *BlockOpsStandard) Get(ctx context.Context, kmd KeyMetadata,
-	blockPtr BlockPointer, block Block, lifetime BlockCacheLifetime) error {
+	blockPtr BlockPointer, block Block, lifetime BlockCacheLifetime) (
+	err error) {
+	ctx = startSpan(ctx, "BlockOps.Get",
+		spanAttrTLF(kmd.TlfID()), spanAttrBlockID(blockPtr.ID))
+	defer func() { finishSpan(ctx, err) }()
+
 	// Check the journal explicitly first, so we don't get stuck in
 	// the block-fetching queue.
 	if journalBServer, ok := b.config.BlockServer().(journalBlockServer); ok {
@@ -70,7 +78,7 @@ func (b *BlockOpsStandard) Get(ctx context.Context, kmd KeyMetadata,
 	b.log.LazyTrace(ctx, "BOps: Requesting %s", blockPtr.ID)
 
 	errCh := b.queue.Request(ctx, defaultOnDemandRequestPriority, kmd, blockPtr, block, lifetime)
-	err := <-errCh
+	err = <-errCh
 
 	b.log.LazyTrace(ctx, "BOps: Request fulfilled for %s (err=%v)", blockPtr.ID, err)
 
@@ -134,7 +142,16 @@ func (b *BlockOpsStandard) Ready(ctx context.Context, kmd KeyMetadata,
 	}
 
 	blockKey := kbfscrypto.UnmaskBlockCryptKey(serverHalf, tlfCryptKey)
-	plainSize, encryptedBlock, err := crypto.EncryptBlock(block, blockKey)
+	var encryptedBlock EncryptedBlock
+	switch ver := b.config.BlockCryptVersion(); ver {
+	case EncryptionSecretbox:
+		plainSize, encryptedBlock, err = crypto.EncryptBlock(block, blockKey)
+	case EncryptionAESGCM:
+		plainSize, encryptedBlock, err = crypto.EncryptBlockAEAD(
+			block, kmd.TlfID(), blockKey, b.config.BlockPadding())
+	default:
+		err = errors.WithStack(UnknownEncryptionVer{ver})
+	}
 	if err != nil {
 		return
 	}
@@ -145,8 +162,9 @@ func (b *BlockOpsStandard) Ready(ctx context.Context, kmd KeyMetadata,
 	}
 
 	readyBlockData = ReadyBlockData{
-		buf:        buf,
-		serverHalf: serverHalf,
+		buf:           buf,
+		serverHalf:    serverHalf,
+		encryptionVer: encryptedBlock.Version,
 	}
 
 	encodedSize := readyBlockData.GetEncodedSize()
@@ -10,6 +10,7 @@ import (
 	"testing"
 
 	"github.com/golang/mock/gomock"
+	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/client/go/protocol/keybase1"
 	"github.com/keybase/kbfs/kbfsblock"
 	"github.com/keybase/kbfs/kbfscodec"
@@ -84,6 +85,8 @@ type testBlockOpsConfig struct {
 	cp      cryptoPure
 	cache   BlockCache
 	diskBlockCacheGetter
+	cryptVer EncryptionVer
+	padding  BlockPadding
 }
 
 var _ blockOpsConfig = (*testBlockOpsConfig)(nil)
@@ -108,6 +111,18 @@ func (config testBlockOpsConfig) DataVersion() DataVer {
 	return ChildHolesDataVer
 }
 
+func (config testBlockOpsConfig) BlockCryptVersion() EncryptionVer {
+	return config.cryptVer
+}
+
+func (config testBlockOpsConfig) BlockPadding() BlockPadding {
+	return config.padding
+}
+
+func (config testBlockOpsConfig) BlockTransferControllers() *BlockTransferControllers {
+	return nil
+}
+
 func makeTestBlockOpsConfig(t *testing.T) testBlockOpsConfig {
 	lm := newTestLogMaker(t)
 	codecGetter := newTestCodecGetter()
@@ -115,7 +130,8 @@ func makeTestBlockOpsConfig(t *testing.T) testBlockOpsConfig {
 	crypto := MakeCryptoCommon(codecGetter.Codec())
 	cache := NewBlockCacheStandard(10, getDefaultCleanBlockCacheCapacity())
 	dbcg := newTestDiskBlockCacheGetter(t, nil)
-	return testBlockOpsConfig{codecGetter, lm, bserver, crypto, cache, dbcg}
+	return testBlockOpsConfig{codecGetter, lm, bserver, crypto, cache, dbcg,
+		EncryptionSecretbox, BlockPaddingPowerOfTwo}
 }
 
 // TestBlockOpsReadySuccess checks that BlockOpsStandard.Ready()
@@ -156,10 +172,61 @@ func TestBlockOpsReadySuccess(t *testing.T) {
 
 	decryptedBlock := &FileBlock{}
 	err = config.cryptoPure().DecryptBlock(
-		encryptedBlock, blockCryptKey, decryptedBlock)
+		encryptedBlock, tlfID, blockCryptKey, decryptedBlock)
+	require.NoError(t, err)
+	decryptedBlock.SetEncodedSize(uint32(readyBlockData.GetEncodedSize()))
+	require.Equal(t, block, decryptedBlock)
+}
+
+// TestBlockOpsReadyAEADSuccess checks that BlockOpsStandard.Ready()
+// encrypts its given block with AES-GCM when configured to, and that
+// the result is bound to the TLF.
+func TestBlockOpsReadyAEADSuccess(t *testing.T) {
+	config := makeTestBlockOpsConfig(t)
+	config.cryptVer = EncryptionAESGCM
+	config.padding = BlockPaddingPadme
+	bops := NewBlockOpsStandard(config, testBlockRetrievalWorkerQueueSize,
+		testPrefetchWorkerQueueSize)
+	defer bops.Shutdown()
+
+	tlfID := tlf.FakeID(0, tlf.Private)
+	var latestKeyGen KeyGen = 5
+	kmd := makeFakeKeyMetadata(tlfID, latestKeyGen)
+
+	block := &FileBlock{
+		Contents: []byte{1, 2, 3, 4, 5},
+	}
+
+	ctx := context.Background()
+	id, _, readyBlockData, err := bops.Ready(ctx, kmd, block)
+	require.NoError(t, err)
+	require.Equal(t, EncryptionAESGCM, readyBlockData.encryptionVer)
+
+	err = kbfsblock.VerifyID(readyBlockData.buf, id)
+	require.NoError(t, err)
+
+	var encryptedBlock EncryptedBlock
+	err = config.Codec().Decode(readyBlockData.buf, &encryptedBlock)
+	require.NoError(t, err)
+	require.Equal(t, EncryptionAESGCM, encryptedBlock.Version)
+
+	blockCryptKey := kbfscrypto.UnmaskBlockCryptKey(
+		readyBlockData.serverHalf,
+		kmd.keys[latestKeyGen-FirstValidKeyGen])
+
+	decryptedBlock := &FileBlock{}
+	err = config.cryptoPure().DecryptBlock(
+		encryptedBlock, tlfID, blockCryptKey, decryptedBlock)
 	require.NoError(t, err)
 	decryptedBlock.SetEncodedSize(uint32(readyBlockData.GetEncodedSize()))
 	require.Equal(t, block, decryptedBlock)
+
+	// The same ciphertext must not decrypt in the context of a
+	// different TLF.
+	err = config.cryptoPure().DecryptBlock(
+		encryptedBlock, tlf.FakeID(1, tlf.Private), blockCryptKey,
+		&FileBlock{})
+	require.IsType(t, libkb.DecryptionError{}, errors.Cause(err))
 }
 
 // TestBlockOpsReadyFailKeyGet checks that BlockOpsStandard.Ready()
@@ -509,7 +576,7 @@ type badBlockDecryptor struct {
 }
 
 func (c badBlockDecryptor) DecryptBlock(encryptedBlock EncryptedBlock,
-	key kbfscrypto.BlockCryptKey, block Block) error {
+	tlfID tlf.ID, key kbfscrypto.BlockCryptKey, block Block) error {
 	return errors.New("could not decrypt block")
 }
 
@@ -32,6 +32,7 @@ type blockRetrievalPartialConfig interface {
 	logMaker
 	blockCacher
 	diskBlockCacheGetter
+	blockTransferControllersGetter
 }
 
 type blockRetrievalConfig interface {
@@ -147,13 +148,16 @@ func newBlockRetrievalQueue(numWorkers int, numPrefetchWorkers int,
 			numWorkers+numPrefetchWorkers),
 	}
 	q.prefetcher = newBlockPrefetcher(q, config)
+	// Only on-demand gets are adaptively limited; the prefetch
+	// workers are few enough not to need it.
+	gets := config.BlockTransferControllers().Gets()
 	for i := 0; i < numWorkers; i++ {
 		q.workers = append(q.workers, newBlockRetrievalWorker(
-			config.blockGetter(), q, workerCh))
+			config.blockGetter(), q, workerCh, gets))
 	}
 	for i := 0; i < numPrefetchWorkers; i++ {
 		q.workers = append(q.workers, newBlockRetrievalWorker(
-			config.blockGetter(), q, prefetchWorkerCh))
+			config.blockGetter(), q, prefetchWorkerCh, nil))
 	}
 	return q
 }
@@ -6,6 +6,8 @@ package libkbfs
 
 import (
 	"io"
+
+	"golang.org/x/net/context"
 )
 
 // blockRetrievalWorker processes blockRetrievalQueue requests
@@ -14,6 +16,12 @@ type blockRetrievalWorker struct {
 	stopCh chan struct{}
 	queue  *blockRetrievalQueue
 	workCh <-chan struct{}
+	// cc, if non-nil, limits how many workers sharing it can be
+	// getting blocks at once.
+	cc *ConcurrencyController
+	// ccCtx is canceled on shutdown, to stop waiting for cc.
+	ccCtx    context.Context
+	ccCancel context.CancelFunc
 }
 
 // run runs the worker loop until Shutdown is called
@@ -30,14 +38,19 @@ func (brw *blockRetrievalWorker) run() {
 
 // newBlockRetrievalWorker returns a blockRetrievalWorker for a given
 // blockRetrievalQueue, using the passed in blockGetter to obtain blocks for
-// requests.
+// requests.  If `cc` is non-nil, the worker waits for it before
+// starting each request.
 func newBlockRetrievalWorker(bg blockGetter, q *blockRetrievalQueue,
-	workCh <-chan struct{}) *blockRetrievalWorker {
+	workCh <-chan struct{}, cc *ConcurrencyController) *blockRetrievalWorker {
+	ccCtx, ccCancel := context.WithCancel(context.Background())
 	brw := &blockRetrievalWorker{
 		blockGetter: bg,
 		stopCh:      make(chan struct{}),
 		queue:       q,
 		workCh:      workCh,
+		cc:          cc,
+		ccCtx:       ccCtx,
+		ccCancel:    ccCancel,
 	}
 	go brw.run()
 	return brw
@@ -49,17 +62,32 @@ func newBlockRetrievalWorker(bg blockGetter, q *blockRetrievalQueue,
 // results.
 func (brw *blockRetrievalWorker) HandleRequest() (err error) {
 	var retrieval *blockRetrieval
+	var block Block
 	select {
 	case <-brw.workCh:
+		// Wait for a slot before popping, so that the request we
+		// work on is the most important one at the time we can
+		// actually start it.
+		done, ccErr := brw.cc.Acquire(brw.ccCtx)
+		if ccErr != nil {
+			return io.EOF
+		}
 		retrieval = brw.queue.popIfNotEmpty()
 		if retrieval == nil {
+			done(-1, nil)
 			return nil
 		}
+		defer func() {
+			size := 0
+			if err == nil && block != nil {
+				size = int(block.GetEncodedSize())
+			}
+			done(size, err)
+		}()
 	case <-brw.stopCh:
 		return io.EOF
 	}
 
-	var block Block
 	defer func() {
 		brw.queue.FinalizeRequest(retrieval, block, err)
 	}()
@@ -77,7 +105,13 @@ func (brw *blockRetrievalWorker) HandleRequest() (err error) {
 		block = retrieval.requests[0].block.NewEmpty()
 	}()
 
-	return brw.getBlock(retrieval.ctx, retrieval.kmd, retrieval.blockPtr, block)
+	// The retrieval's context carries the span of the first
+	// request, if any, so the fetch shows up in that trace.
+	ctx := startSpan(retrieval.ctx, "blockRetrievalWorker.getBlock",
+		spanAttrTLF(retrieval.kmd.TlfID()),
+		spanAttrBlockID(retrieval.blockPtr.ID))
+	defer func() { finishSpan(ctx, err) }()
+	return brw.getBlock(ctx, retrieval.kmd, retrieval.blockPtr, block)
 }
 
 // Shutdown shuts down the blockRetrievalWorker once its current work is done.
@@ -86,5 +120,6 @@ func (brw *blockRetrievalWorker) Shutdown() {
 	case <-brw.stopCh:
 	default:
 		close(brw.stopCh)
+		brw.ccCancel()
 	}
 }
@@ -5,6 +5,8 @@
 package libkbfs
 
 import (
+	"fmt"
+
 	"github.com/keybase/kbfs/kbfsblock"
 	"github.com/keybase/kbfs/kbfscodec"
 	"github.com/keybase/kbfs/kbfscrypto"
@@ -94,9 +96,13 @@ func doOneBlockPut(ctx context.Context, bserv BlockServer, reporter Reporter,
 //
 // Returns a slice of block pointers that resulted in recoverable
 // errors and should be removed by the caller from any saved state.
+//
+// If `cc` is non-nil, it decides how many of the puts may be in
+// flight at once, up to maxParallelBlockPuts.
 func doBlockPuts(ctx context.Context, bserv BlockServer, bcache BlockCache,
 	reporter Reporter, log, deferLog traceLogger, tlfID tlf.ID, tlfName CanonicalTlfName,
-	bps blockPutState) (blocksToRemove []BlockPointer, err error) {
+	bps blockPutState, cc *ConcurrencyController) (
+	blocksToRemove []BlockPointer, err error) {
 	blockCount := len(bps.blockStates)
 	log.LazyTrace(ctx, "doBlockPuts with %d blocks", blockCount)
 	defer func() {
@@ -118,8 +124,13 @@ func doBlockPuts(ctx context.Context, bserv BlockServer, bcache BlockCache,
 
 	worker := func() error {
 		for blockState := range blocks {
-			err := doOneBlockPut(groupCtx, bserv, reporter, tlfID,
+			done, err := cc.Acquire(groupCtx)
+			if err != nil {
+				return err
+			}
+			err = doOneBlockPut(groupCtx, bserv, reporter, tlfID,
 				tlfName, blockState, blocksToRemoveChan)
+			done(blockState.readyBlockData.GetEncodedSize(), err)
 			if err != nil {
 				return err
 			}
@@ -189,7 +200,8 @@ func assembleBlock(ctx context.Context, keyGetter blockKeyGetter,
 	}
 
 	// decrypt the block
-	err = cryptoPure.DecryptBlock(encryptedBlock, blockCryptKey, block)
+	err = cryptoPure.DecryptBlock(
+		encryptedBlock, kmd.TlfID(), blockCryptKey, block)
 	if err != nil {
 		return err
 	}
@@ -197,3 +209,74 @@ func assembleBlock(ctx context.Context, keyGetter blockKeyGetter,
 	block.SetEncodedSize(uint32(len(buf)))
 	return nil
 }
+
+// LocalBlockRef describes a single reference to a block, as recorded
+// by a block server that stores its data locally.
+type LocalBlockRef struct {
+	Context  kbfsblock.Context
+	Archived bool
+}
+
+// GetLocalBlockRefs returns all the references to the given block
+// ID, keyed by their ref nonces, that are known to the given block
+// server.  This only works for block servers that store their data
+// locally (possibly wrapped by the measured, chaos or journal block
+// servers), since the remote block server doesn't expose its
+// reference lists; it's meant for debugging tools.
+func GetLocalBlockRefs(ctx context.Context, bserv BlockServer,
+	tlfID tlf.ID, id kbfsblock.ID) (
+	map[kbfsblock.RefNonce]LocalBlockRef, error) {
+	for {
+		switch b := bserv.(type) {
+		case BlockServerMeasured:
+			bserv = b.delegate
+			continue
+		case BlockServerChaos:
+			bserv = b.BlockServer
+			continue
+		case journalBlockServer:
+			bserv = b.BlockServer
+			continue
+		}
+		break
+	}
+
+	bserverLocal, ok := bserv.(blockServerLocal)
+	if !ok {
+		return nil, errors.Errorf(
+			"Block server of type %T doesn't expose block references",
+			bserv)
+	}
+
+	refs, err := bserverLocal.getRefs(ctx, tlfID, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(refs) == 0 {
+		return nil, kbfsblock.BServerErrorBlockNonExistent{
+			Msg: fmt.Sprintf("Block ID %s does not exist.", id)}
+	}
+
+	res := make(map[kbfsblock.RefNonce]LocalBlockRef, len(refs))
+	for nonce, entry := range refs {
+		res[nonce] = LocalBlockRef{
+			Context:  entry.Context,
+			Archived: entry.Status == archivedBlockRef,
+		}
+	}
+	return res, nil
+}
+
+// blockTransferControllersForTlf returns the controllers that should
+// limit block transfers made directly on behalf of the given TLF.  It
+// returns nil if the TLF is journaled, since then those transfers
+// only go to local disk, and the journal's own flushes to the server
+// are limited separately.
+func blockTransferControllersForTlf(
+	config Config, tlfID tlf.ID) *BlockTransferControllers {
+	if TLFJournalEnabled(config, tlfID) {
+		return nil
+	}
+	return config.BlockTransferControllers()
+}
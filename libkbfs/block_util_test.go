@@ -5,8 +5,12 @@ import (
 	"testing"
 
 	"github.com/golang/mock/gomock"
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/client/go/protocol/keybase1"
 	"github.com/keybase/kbfs/kbfsblock"
+	"github.com/keybase/kbfs/kbfscrypto"
 	"github.com/keybase/kbfs/tlf"
+	metrics "github.com/rcrowley/go-metrics"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/net/context"
 )
@@ -99,3 +103,47 @@ func TestBlockUtilPutFail(t *testing.T) {
 	err := putBlockToServer(ctx, bserver, tlfID, blockPtr, readyBlockData)
 	require.Equal(t, expectedErr, err)
 }
+
+func TestBlockUtilGetLocalBlockRefs(t *testing.T) {
+	ctx := context.Background()
+	bserver := NewBlockServerMemory(logger.NewTestLogger(t))
+	defer bserver.Shutdown(ctx)
+
+	tlfID := tlf.FakeID(1, tlf.Private)
+	uid := keybase1.MakeTestUID(1).AsUserOrTeam()
+	data := []byte{1, 2, 3, 4}
+	id, err := kbfsblock.MakePermanentID(data)
+	require.NoError(t, err)
+	serverHalf, err := kbfscrypto.MakeRandomBlockCryptKeyServerHalf()
+	require.NoError(t, err)
+
+	bCtx := kbfsblock.MakeFirstContext(uid, keybase1.BlockType_DATA)
+	err = bserver.Put(ctx, tlfID, id, bCtx, data, serverHalf)
+	require.NoError(t, err)
+
+	nonce, err := kbfsblock.MakeRefNonce()
+	require.NoError(t, err)
+	bCtx2 := kbfsblock.MakeContext(uid, uid, nonce, keybase1.BlockType_DATA)
+	err = bserver.AddBlockReference(ctx, tlfID, id, bCtx2)
+	require.NoError(t, err)
+	err = bserver.ArchiveBlockReferences(
+		ctx, tlfID, kbfsblock.ContextMap{id: {bCtx2}})
+	require.NoError(t, err)
+
+	// Make sure wrapped block servers are unwrapped.
+	measured := NewBlockServerMeasured(bserver, metrics.NewRegistry())
+	refs, err := GetLocalBlockRefs(ctx, measured, tlfID, id)
+	require.NoError(t, err)
+	require.Equal(t, map[kbfsblock.RefNonce]LocalBlockRef{
+		kbfsblock.ZeroRefNonce: {Context: bCtx},
+		nonce:                  {Context: bCtx2, Archived: true},
+	}, refs)
+
+	chaos := BlockServerChaos{BlockServer: measured}
+	refs, err = GetLocalBlockRefs(ctx, chaos, tlfID, id)
+	require.NoError(t, err)
+	require.Len(t, refs, 2)
+
+	_, err = GetLocalBlockRefs(ctx, measured, tlfID, kbfsblock.FakeID(2))
+	require.IsType(t, kbfsblock.BServerErrorBlockNonExistent{}, err)
+}
@@ -370,6 +370,25 @@ func (b *BlockServerDisk) getAllRefsForTest(ctx context.Context, tlfID tlf.ID) (
 	return tlfStorage.store.getAllRefsForTest()
 }
 
+// getRefs implements the blockServerLocal interface for
+// BlockServerDisk.
+func (b *BlockServerDisk) getRefs(
+	ctx context.Context, tlfID tlf.ID, id kbfsblock.ID) (
+	blockRefMap, error) {
+	tlfStorage, err := b.getStorage(tlfID)
+	if err != nil {
+		return nil, err
+	}
+
+	tlfStorage.lock.RLock()
+	defer tlfStorage.lock.RUnlock()
+	if tlfStorage.store == nil {
+		return nil, errBlockServerDiskShutdown
+	}
+
+	return tlfStorage.store.getRefs(id)
+}
+
 // IsUnflushed implements the BlockServer interface for BlockServerDisk.
 func (b *BlockServerDisk) IsUnflushed(ctx context.Context, tlfID tlf.ID,
 	_ kbfsblock.ID) (bool, error) {
@@ -378,6 +378,25 @@ func (b *BlockServerMemory) getAllRefsForTest(
 	return res, nil
 }
 
+// getRefs implements the blockServerLocal interface for
+// BlockServerMemory.
+func (b *BlockServerMemory) getRefs(
+	ctx context.Context, tlfID tlf.ID, id kbfsblock.ID) (
+	blockRefMap, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	if b.m == nil {
+		return nil, errBlockServerMemoryShutdown
+	}
+
+	entry, ok := b.m[id]
+	if !ok || entry.tlfID != tlfID {
+		return make(blockRefMap), nil
+	}
+	return entry.refs.deepCopy(), nil
+}
+
 func (b *BlockServerMemory) numBlocks() int {
 	b.lock.RLock()
 	defer b.lock.RUnlock()
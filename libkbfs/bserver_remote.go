@@ -376,6 +376,9 @@ func makeBlockReference(id kbfsblock.ID, context kbfsblock.Context) keybase1.Blo
 func (b *BlockServerRemote) Get(ctx context.Context, tlfID tlf.ID, id kbfsblock.ID,
 	context kbfsblock.Context) (
 	buf []byte, serverHalf kbfscrypto.BlockCryptKeyServerHalf, err error) {
+	ctx = startSpan(ctx, "BlockServerRemote.Get",
+		spanAttrTLF(tlfID), spanAttrBlockID(id))
+	defer func() { finishSpan(ctx, err) }()
 	size := -1
 	b.log.LazyTrace(ctx, "BServer: Get %s", id)
 	defer func() {
@@ -417,6 +420,9 @@ func (b *BlockServerRemote) Get(ctx context.Context, tlfID tlf.ID, id kbfsblock.
 func (b *BlockServerRemote) Put(ctx context.Context, tlfID tlf.ID, id kbfsblock.ID,
 	bContext kbfsblock.Context, buf []byte,
 	serverHalf kbfscrypto.BlockCryptKeyServerHalf) (err error) {
+	ctx = startSpan(ctx, "BlockServerRemote.Put",
+		spanAttrTLF(tlfID), spanAttrBlockID(id))
+	defer func() { finishSpan(ctx, err) }()
 	dbc := b.config.DiskBlockCache()
 	if dbc != nil {
 		go dbc.Put(ctx, tlfID, id, buf, serverHalf)
@@ -452,6 +458,9 @@ func (b *BlockServerRemote) Put(ctx context.Context, tlfID tlf.ID, id kbfsblock.
 // PutAgain implements the BlockServer interface for BlockServerRemote
 func (b *BlockServerRemote) PutAgain(ctx context.Context, tlfID tlf.ID, id kbfsblock.ID,
 	bContext kbfsblock.Context, buf []byte, serverHalf kbfscrypto.BlockCryptKeyServerHalf) (err error) {
+	ctx = startSpan(ctx, "BlockServerRemote.PutAgain",
+		spanAttrTLF(tlfID), spanAttrBlockID(id))
+	defer func() { finishSpan(ctx, err) }()
 	dbc := b.config.DiskBlockCache()
 	if dbc != nil {
 		go dbc.Put(ctx, tlfID, id, buf, serverHalf)
@@ -485,6 +494,9 @@ func (b *BlockServerRemote) PutAgain(ctx context.Context, tlfID tlf.ID, id kbfsb
 // AddBlockReference implements the BlockServer interface for BlockServerRemote
 func (b *BlockServerRemote) AddBlockReference(ctx context.Context, tlfID tlf.ID,
 	id kbfsblock.ID, context kbfsblock.Context) (err error) {
+	ctx = startSpan(ctx, "BlockServerRemote.AddBlockReference",
+		spanAttrTLF(tlfID), spanAttrBlockID(id))
+	defer func() { finishSpan(ctx, err) }()
 	b.log.LazyTrace(ctx, "BServer: AddRef %s", id)
 	defer func() {
 		b.log.LazyTrace(ctx, "BServer: AddRef %s done (err=%v)", id, err)
@@ -510,6 +522,9 @@ func (b *BlockServerRemote) AddBlockReference(ctx context.Context, tlfID tlf.ID,
 // BlockServerRemote
 func (b *BlockServerRemote) RemoveBlockReferences(ctx context.Context,
 	tlfID tlf.ID, contexts kbfsblock.ContextMap) (liveCounts map[kbfsblock.ID]int, err error) {
+	ctx = startSpan(ctx, "BlockServerRemote.RemoveBlockReferences",
+		spanAttrTLF(tlfID))
+	defer func() { finishSpan(ctx, err) }()
 	// TODO: Define a more compact printout of contexts.
 	b.log.LazyTrace(ctx, "BServer: RemRef %v", contexts)
 	defer func() {
@@ -537,6 +552,9 @@ func (b *BlockServerRemote) RemoveBlockReferences(ctx context.Context,
 // BlockServerRemote
 func (b *BlockServerRemote) ArchiveBlockReferences(ctx context.Context,
 	tlfID tlf.ID, contexts kbfsblock.ContextMap) (err error) {
+	ctx = startSpan(ctx, "BlockServerRemote.ArchiveBlockReferences",
+		spanAttrTLF(tlfID))
+	defer func() { finishSpan(ctx, err) }()
 	b.log.LazyTrace(ctx, "BServer: ArchiveRef %v", contexts)
 	defer func() {
 		b.log.LazyTrace(ctx, "BServer: ArchiveRef %v done (err=%v)", contexts, err)
@@ -0,0 +1,328 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// bulkFileWriterMaxPuts is the number of block puts a bulk file
+// writer keeps in flight.  Each one holds an encrypted block in
+// memory until it finishes.
+const bulkFileWriterMaxPuts = 4
+
+var errBulkFileWriterDone = errors.New("Bulk file writer is already done")
+
+// bulkFileWriter implements the BulkFileWriter interface.  It builds
+// the file's block tree from the bottom up, as the data arrives:
+// every time a leaf block fills up, it's readied and put, and its
+// pointer is added to the in-progress indirect block one level up.
+// When an indirect block fills up, the same happens to it in turn.
+// So besides the blocks being put, it only ever holds one leaf block
+// and one indirect block per level of the tree.
+type bulkFileWriter struct {
+	fbo       *folderBranchOps
+	dir       Node
+	name      string
+	entryType EntryType
+	md        ImmutableRootMetadata
+	chargedTo keybase1.UserOrTeamID
+	cc        *ConcurrencyController
+
+	// The block puts run under putCtx, since they outlive the
+	// Write calls that start them.
+	putCtx    context.Context
+	putCancel context.CancelFunc
+	putSem    chan struct{}
+	putWG     sync.WaitGroup
+
+	// putLock protects putErr and putInfos.
+	putLock sync.Mutex
+	putErr  error
+	// putInfos holds every block that has been put successfully.
+	putInfos []BlockInfo
+
+	leaf    *FileBlock
+	leafOff int64
+	size    int64
+	// levels[i] is the in-progress indirect block `i+1` levels
+	// above the leaves.
+	levels []*FileBlock
+	// err is set once the writer fails or finishes; after that,
+	// only Abort does anything.
+	err error
+}
+
+var _ BulkFileWriter = (*bulkFileWriter)(nil)
+
+func newBulkFileWriter(ctx context.Context, fbo *folderBranchOps,
+	dir Node, name string, entryType EntryType, md ImmutableRootMetadata,
+	chargedTo keybase1.UserOrTeamID) *bulkFileWriter {
+	putCtx, putCancel := context.WithCancel(ctx)
+	return &bulkFileWriter{
+		fbo:       fbo,
+		dir:       dir,
+		name:      name,
+		entryType: entryType,
+		md:        md,
+		chargedTo: chargedTo,
+		cc: blockTransferControllersForTlf(
+			fbo.config, md.TlfID()).Puts(),
+		putCtx:    putCtx,
+		putCancel: putCancel,
+		putSem:    make(chan struct{}, bulkFileWriterMaxPuts),
+		leaf:      NewFileBlock().(*FileBlock),
+	}
+}
+
+func (w *bulkFileWriter) getPutErr() error {
+	w.putLock.Lock()
+	defer w.putLock.Unlock()
+	return w.putErr
+}
+
+// readyAndPut readies `block`, and starts putting it in the
+// background.  It returns the block's info right away, so that it
+// can be added to its parent.
+func (w *bulkFileWriter) readyAndPut(
+	ctx context.Context, block *FileBlock) (BlockInfo, error) {
+	config := w.fbo.config
+	info, _, readyBlockData, err := ReadyBlock(
+		ctx, config.BlockCache(), config.BlockOps(), config.cryptoPure(),
+		w.md.ReadOnly(), block, w.chargedTo, keybase1.BlockType_DATA)
+	if err != nil {
+		return BlockInfo{}, err
+	}
+
+	select {
+	case w.putSem <- struct{}{}:
+	case <-ctx.Done():
+		return BlockInfo{}, errors.WithStack(ctx.Err())
+	}
+	w.putWG.Add(1)
+	go func() {
+		defer w.putWG.Done()
+		defer func() { <-w.putSem }()
+		done, err := w.cc.Acquire(w.putCtx)
+		if err == nil {
+			err = PutBlockCheckLimitErrs(w.putCtx, config.BlockServer(),
+				config.Reporter(), w.md.TlfID(), info.BlockPointer,
+				readyBlockData, w.md.GetTlfHandle().GetCanonicalName())
+			done(readyBlockData.GetEncodedSize(), err)
+		}
+
+		w.putLock.Lock()
+		defer w.putLock.Unlock()
+		if err != nil {
+			if w.putErr == nil {
+				w.putErr = err
+				// Don't bother finishing the other puts.
+				w.putCancel()
+			}
+			return
+		}
+		w.putInfos = append(w.putInfos, info)
+	}()
+	return info, nil
+}
+
+// addPtr adds a pointer to the indirect block `height` levels above
+// the leaves, first putting that block if it's full.
+func (w *bulkFileWriter) addPtr(
+	ctx context.Context, height int, info BlockInfo, off int64) error {
+	if height == len(w.levels) {
+		w.levels = append(w.levels, &FileBlock{
+			CommonBlock: CommonBlock{IsInd: true},
+		})
+	}
+	block := w.levels[height]
+	if len(block.IPtrs) >= w.fbo.config.BlockSplitter().MaxPtrsPerBlock() {
+		fullInfo, err := w.readyAndPut(ctx, block)
+		if err != nil {
+			return err
+		}
+		err = w.addPtr(ctx, height+1, fullInfo, block.IPtrs[0].Off)
+		if err != nil {
+			return err
+		}
+		block = &FileBlock{CommonBlock: CommonBlock{IsInd: true}}
+		w.levels[height] = block
+	}
+	block.IPtrs = append(block.IPtrs, IndirectFilePtr{
+		BlockInfo: info,
+		Off:       off,
+	})
+	return nil
+}
+
+func (w *bulkFileWriter) flushLeaf(ctx context.Context) error {
+	info, err := w.readyAndPut(ctx, w.leaf)
+	if err != nil {
+		return err
+	}
+	err = w.addPtr(ctx, 0, info, w.leafOff)
+	if err != nil {
+		return err
+	}
+	w.leafOff += int64(len(w.leaf.Contents))
+	w.leaf = NewFileBlock().(*FileBlock)
+	return nil
+}
+
+func (w *bulkFileWriter) write(ctx context.Context, data []byte) error {
+	if err := w.getPutErr(); err != nil {
+		return err
+	}
+	bsplit := w.fbo.config.BlockSplitter()
+	for len(data) > 0 {
+		n := bsplit.CopyUntilSplit(
+			w.leaf, true, data, int64(len(w.leaf.Contents)))
+		if n == 0 {
+			if len(w.leaf.Contents) == 0 {
+				return errors.New("Block splitter won't fill an empty block")
+			}
+			// The leaf is full.
+			err := w.flushLeaf(ctx)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		data = data[n:]
+		w.size += n
+	}
+	return nil
+}
+
+// Write implements the BulkFileWriter interface for bulkFileWriter.
+func (w *bulkFileWriter) Write(ctx context.Context, data []byte) error {
+	if w.err != nil {
+		return w.err
+	}
+	err := w.write(ctx, data)
+	if err != nil {
+		// The tree might be half-updated, so the writer can't be
+		// used anymore.
+		w.err = err
+		return err
+	}
+	return nil
+}
+
+// finish puts everything that hasn't been put yet, waits for all the
+// puts to finish, and returns the info of the top block of the file.
+func (w *bulkFileWriter) finish(ctx context.Context) (BlockInfo, error) {
+	var top BlockInfo
+	if len(w.levels) == 0 {
+		// The whole file fits in one block, which might be empty.
+		info, err := w.readyAndPut(ctx, w.leaf)
+		if err != nil {
+			return BlockInfo{}, err
+		}
+		top = info
+	} else {
+		if len(w.leaf.Contents) > 0 {
+			err := w.flushLeaf(ctx)
+			if err != nil {
+				return BlockInfo{}, err
+			}
+		}
+		// Put the partial indirect blocks from the bottom up.  The
+		// loop bound is re-evaluated on purpose, since adding a
+		// pointer can add a level.
+		for height := 0; height < len(w.levels); height++ {
+			block := w.levels[height]
+			if height < len(w.levels)-1 {
+				info, err := w.readyAndPut(ctx, block)
+				if err != nil {
+					return BlockInfo{}, err
+				}
+				err = w.addPtr(ctx, height+1, info, block.IPtrs[0].Off)
+				if err != nil {
+					return BlockInfo{}, err
+				}
+				continue
+			}
+
+			if len(block.IPtrs) == 1 {
+				// No need for a top block with only one child.
+				top = block.IPtrs[0].BlockInfo
+				break
+			}
+			info, err := w.readyAndPut(ctx, block)
+			if err != nil {
+				return BlockInfo{}, err
+			}
+			top = info
+		}
+	}
+
+	w.putWG.Wait()
+	if err := w.getPutErr(); err != nil {
+		return BlockInfo{}, err
+	}
+	return top, nil
+}
+
+// cleanUp deletes all the blocks that were put, unless `md` made it
+// to the server after all.  If `md` is nil, the blocks are always
+// deleted.
+func (w *bulkFileWriter) cleanUp(md *RootMetadata) {
+	w.putCancel()
+	w.putWG.Wait()
+
+	w.putLock.Lock()
+	defer w.putLock.Unlock()
+	if len(w.putInfos) == 0 {
+		return
+	}
+	bps := newBlockPutState(len(w.putInfos))
+	for _, info := range w.putInfos {
+		bps.addNewBlock(info.BlockPointer, nil, ReadyBlockData{}, nil)
+	}
+	w.putInfos = nil
+	if md == nil {
+		w.fbo.fbm.cleanUpBlockState(w.md.ReadOnly(), bps, blockDeleteAlways)
+	} else {
+		w.fbo.fbm.cleanUpBlockState(md.ReadOnly(), bps, blockDeleteOnMDFail)
+	}
+}
+
+// Close implements the BulkFileWriter interface for bulkFileWriter.
+func (w *bulkFileWriter) Close(ctx context.Context) (EntryInfo, error) {
+	if w.err != nil {
+		return EntryInfo{}, w.err
+	}
+	w.err = errBulkFileWriterDone
+
+	top, err := w.finish(ctx)
+	if err != nil {
+		w.cleanUp(nil)
+		return EntryInfo{}, err
+	}
+
+	de, md, err := w.fbo.commitBulkFile(ctx, w.dir, w.name, w.entryType,
+		top, uint64(w.size), w.putInfos)
+	if err != nil {
+		w.cleanUp(md)
+		return EntryInfo{}, err
+	}
+	w.putCancel()
+	return de.EntryInfo, nil
+}
+
+// Abort implements the BulkFileWriter interface for bulkFileWriter.
+func (w *bulkFileWriter) Abort(ctx context.Context) error {
+	if w.err == errBulkFileWriterDone {
+		return nil
+	}
+	w.err = errBulkFileWriterDone
+	w.cleanUp(nil)
+	return nil
+}
@@ -0,0 +1,110 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBulkFileWriter(t *testing.T) {
+	var u1 libkb.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, u1)
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	// Use small blocks with few pointers each, so the file has a
+	// multi-level tree with partial blocks at every level.
+	config.SetBlockSplitter(&BlockSplitterSimple{20, 3, 8 * 1024})
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, u1.String(), tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fb := rootNode.GetFolderBranch()
+
+	data := make([]byte, 200)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	t.Log("Write a file in uneven chunks.")
+	w, err := kbfsOps.CreateBulkFile(ctx, rootNode, "a", true)
+	require.NoError(t, err)
+	for i := 0; i < len(data); i += 7 {
+		end := i + 7
+		if end > len(data) {
+			end = len(data)
+		}
+		err = w.Write(ctx, data[i:end])
+		require.NoError(t, err)
+	}
+
+	t.Log("The file doesn't exist until the writer is closed.")
+	_, _, err = kbfsOps.Lookup(ctx, rootNode, "a")
+	require.IsType(t, NoSuchNameError{}, errors.Cause(err))
+
+	ei, err := w.Close(ctx)
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(data)), ei.Size)
+	require.Equal(t, Exec, ei.Type)
+
+	nodeA, _, err := kbfsOps.Lookup(ctx, rootNode, "a")
+	require.NoError(t, err)
+	gotData := make([]byte, len(data))
+	n, err := kbfsOps.Read(ctx, nodeA, gotData, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.Equal(t, data, gotData)
+
+	t.Log("The file can be appended to the regular way.")
+	err = kbfsOps.Write(ctx, nodeA, []byte{0xff}, int64(len(data)))
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	gotData = make([]byte, len(data)+1)
+	_, err = kbfsOps.Read(ctx, nodeA, gotData, 0)
+	require.NoError(t, err)
+	require.Equal(t, append(data, 0xff), gotData)
+
+	t.Log("Empty files work too.")
+	w, err = kbfsOps.CreateBulkFile(ctx, rootNode, "b", false)
+	require.NoError(t, err)
+	ei, err = w.Close(ctx)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), ei.Size)
+	require.Equal(t, File, ei.Type)
+
+	t.Log("Existing names are rejected.")
+	_, err = kbfsOps.CreateBulkFile(ctx, rootNode, "a", false)
+	require.IsType(t, NameExistsError{}, errors.Cause(err))
+
+	t.Log("Names taken while the file was being written are rejected.")
+	w, err = kbfsOps.CreateBulkFile(ctx, rootNode, "c", false)
+	require.NoError(t, err)
+	err = w.Write(ctx, data)
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateFile(ctx, rootNode, "c", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	_, err = w.Close(ctx)
+	require.IsType(t, NameExistsError{}, errors.Cause(err))
+	err = w.Abort(ctx)
+	require.NoError(t, err)
+
+	t.Log("An aborted file never appears.")
+	w, err = kbfsOps.CreateBulkFile(ctx, rootNode, "d", false)
+	require.NoError(t, err)
+	err = w.Write(ctx, data)
+	require.NoError(t, err)
+	err = w.Abort(ctx)
+	require.NoError(t, err)
+	_, err = w.Close(ctx)
+	require.Error(t, err)
+	_, _, err = kbfsOps.Lookup(ctx, rootNode, "d")
+	require.IsType(t, NoSuchNameError{}, errors.Cause(err))
+}
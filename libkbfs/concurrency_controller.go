@@ -0,0 +1,365 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+	"time"
+
+	"github.com/keybase/kbfs/kbfsblock"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+const (
+	// initialParallelBlockPuts is the number of concurrent block
+	// puts (and downgrades) allowed before anything has been
+	// measured.  It grows quickly from there, up to
+	// maxParallelBlockPuts.
+	initialParallelBlockPuts = 10
+	// congestionLatencyFactor is how many times slower than the
+	// fastest recent request a request needs to be before it's taken
+	// as a sign of congestion.
+	congestionLatencyFactor = 4
+	// minCongestionLatency is the latency under which no request is
+	// ever taken as a sign of congestion, no matter how fast the
+	// other requests have been.
+	minCongestionLatency = 250 * time.Millisecond
+	// minLatencyResetInterval is how long the fastest observed
+	// latency is remembered.  Forgetting it lets the controller
+	// adapt when the client moves to a slower network.
+	minLatencyResetInterval = 1 * time.Minute
+	// throughputSampleInterval is the length of the window over
+	// which each throughput sample is measured.
+	throughputSampleInterval = 1 * time.Second
+	// smallRequestBytes is the size under which a request's latency
+	// is only compared with other small requests.  Small requests,
+	// like reference adds, directory blocks or gets served from a
+	// local journal, are much faster than full data block puts, so
+	// comparing the two would make every full put look congested.
+	smallRequestBytes = 64 * 1024
+)
+
+// ConcurrencyControllerStatus describes the current state of a
+// ConcurrencyController.
+type ConcurrencyControllerStatus struct {
+	Limit     int
+	MinLimit  int
+	MaxLimit  int
+	InFlight  int
+	SlowStart bool
+	// MinLatency is the fastest recent latency of requests of at
+	// least smallRequestBytes, and MinSmallLatency that of smaller
+	// requests.
+	MinLatency            time.Duration
+	MinSmallLatency       time.Duration
+	SmoothedLatency       time.Duration
+	ThroughputBytesPerSec int64
+	// Congestions counts how many times the limit was cut.
+	Congestions int64
+}
+
+// ConcurrencyController limits the number of concurrent requests of
+// one kind, and adapts that limit to the latency and throughput of
+// the requests, in the style of TCP congestion control.  The limit
+// starts in "slow start," where it grows by one for every successful
+// request (doubling about once per round trip), until the first sign
+// of congestion.  After that, it grows by about one per round trip,
+// and is halved each time a request times out, is throttled by the
+// server, or takes much longer than the fastest recent request of
+// similar size.
+//
+// All methods are goroutine-safe, and a nil *ConcurrencyController
+// imposes no limit at all.
+type ConcurrencyController struct {
+	clock    Clock
+	minLimit int
+	maxLimit int
+
+	lock sync.Mutex
+	// limit is fractional, so that it can grow by less than one
+	// request per completed request.
+	limit    float64
+	ssthresh float64
+	inFlight int
+	// changeCh is closed, and replaced, whenever a request
+	// finishes, to wake up anyone waiting for a free slot.
+	changeCh chan struct{}
+
+	// Small and large requests keep separate minimum latencies;
+	// see smallRequestBytes.
+	minLatency      minLatencyTracker
+	minSmallLatency minLatencyTracker
+	smoothedLatency time.Duration
+	lastDecrease    time.Time
+	sampleStart     time.Time
+	sampleBytes     int64
+	throughput      float64
+	congestions     int64
+}
+
+// NewConcurrencyController creates a new ConcurrencyController that
+// allows `initialLimit` concurrent requests, and never fewer than
+// `minLimit` or more than `maxLimit` of them.
+func NewConcurrencyController(
+	clock Clock, minLimit, initialLimit, maxLimit int) *ConcurrencyController {
+	if minLimit < 1 {
+		minLimit = 1
+	}
+	if maxLimit < minLimit {
+		maxLimit = minLimit
+	}
+	if initialLimit < minLimit {
+		initialLimit = minLimit
+	} else if initialLimit > maxLimit {
+		initialLimit = maxLimit
+	}
+	return &ConcurrencyController{
+		clock:    clock,
+		minLimit: minLimit,
+		maxLimit: maxLimit,
+		limit:    float64(initialLimit),
+		ssthresh: float64(maxLimit),
+		changeCh: make(chan struct{}),
+	}
+}
+
+// Acquire blocks until the caller may start a new request, or until
+// `ctx` is canceled.  On success, the caller must call `done` exactly
+// once when the request finishes, with the number of bytes
+// transferred and the request's error, if any.  A negative byte
+// count means the request was never actually made, and frees the
+// slot without affecting the limit.
+func (cc *ConcurrencyController) Acquire(ctx context.Context) (
+	done func(bytes int, err error), err error) {
+	if cc == nil {
+		return func(int, error) {}, nil
+	}
+	for {
+		cc.lock.Lock()
+		if cc.inFlight < int(cc.limit) {
+			cc.inFlight++
+			cc.lock.Unlock()
+			start := cc.clock.Now()
+			return func(bytes int, err error) {
+				cc.finish(start, bytes, err)
+			}, nil
+		}
+		changeCh := cc.changeCh
+		cc.lock.Unlock()
+
+		select {
+		case <-changeCh:
+		case <-ctx.Done():
+			return nil, errors.WithStack(ctx.Err())
+		}
+	}
+}
+
+// minLatencyTracker remembers the fastest recent latency of one
+// class of requests.
+type minLatencyTracker struct {
+	latency time.Duration
+	setTime time.Time
+}
+
+// update records a new latency sample, and returns the resulting
+// minimum latency.
+func (mlt *minLatencyTracker) update(
+	now time.Time, latency time.Duration) time.Duration {
+	if mlt.latency == 0 || latency < mlt.latency ||
+		now.Sub(mlt.setTime) > minLatencyResetInterval {
+		mlt.latency = latency
+		mlt.setTime = now
+	}
+	return mlt.latency
+}
+
+func isCongestionError(err error) bool {
+	cause := errors.Cause(err)
+	if _, ok := cause.(kbfsblock.BServerErrorThrottle); ok {
+		return true
+	}
+	return cause == context.DeadlineExceeded
+}
+
+func (cc *ConcurrencyController) finish(start time.Time, bytes int, err error) {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+	cc.inFlight--
+	defer func() {
+		close(cc.changeCh)
+		cc.changeCh = make(chan struct{})
+	}()
+
+	if bytes < 0 {
+		return
+	}
+
+	now := cc.clock.Now()
+	if err != nil {
+		if isCongestionError(err) {
+			cc.decreaseLocked(now)
+		}
+		// Other errors, like cancellations or missing blocks, say
+		// nothing about the state of the network.
+		return
+	}
+
+	latency := now.Sub(start)
+	var minLatency time.Duration
+	if bytes < smallRequestBytes {
+		minLatency = cc.minSmallLatency.update(now, latency)
+	} else {
+		minLatency = cc.minLatency.update(now, latency)
+	}
+	if cc.smoothedLatency == 0 {
+		cc.smoothedLatency = latency
+	} else {
+		cc.smoothedLatency = (7*cc.smoothedLatency + latency) / 8
+	}
+
+	if cc.sampleStart.IsZero() {
+		cc.sampleStart = start
+	}
+	cc.sampleBytes += int64(bytes)
+	if elapsed := now.Sub(cc.sampleStart); elapsed >= throughputSampleInterval {
+		rate := float64(cc.sampleBytes) / elapsed.Seconds()
+		if cc.throughput == 0 {
+			cc.throughput = rate
+		} else {
+			cc.throughput = (7*cc.throughput + rate) / 8
+		}
+		cc.sampleStart = now
+		cc.sampleBytes = 0
+	}
+
+	if latency > minCongestionLatency &&
+		latency > congestionLatencyFactor*minLatency {
+		cc.decreaseLocked(now)
+		return
+	}
+
+	// Only grow the limit if it's actually being used; otherwise a
+	// trickle of requests would push it up without ever testing
+	// whether the network can handle it.
+	if cc.inFlight+1 < int(cc.limit) {
+		return
+	}
+	if cc.limit < cc.ssthresh {
+		cc.limit++
+	} else {
+		cc.limit += 1 / cc.limit
+	}
+	if cc.limit > float64(cc.maxLimit) {
+		cc.limit = float64(cc.maxLimit)
+	}
+}
+
+func (cc *ConcurrencyController) decreaseLocked(now time.Time) {
+	// All the requests that were in flight together when the
+	// network got congested are likely to report it, so only react
+	// once per round trip.
+	if !cc.lastDecrease.IsZero() &&
+		now.Sub(cc.lastDecrease) < cc.smoothedLatency {
+		return
+	}
+	cc.lastDecrease = now
+	cc.congestions++
+	cc.limit /= 2
+	if cc.limit < float64(cc.minLimit) {
+		cc.limit = float64(cc.minLimit)
+	}
+	cc.ssthresh = cc.limit
+}
+
+// Status returns the current state of the controller.
+func (cc *ConcurrencyController) Status() ConcurrencyControllerStatus {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+	return ConcurrencyControllerStatus{
+		Limit:                 int(cc.limit),
+		MinLimit:              cc.minLimit,
+		MaxLimit:              cc.maxLimit,
+		InFlight:              cc.inFlight,
+		SlowStart:             cc.limit < cc.ssthresh,
+		MinLatency:            cc.minLatency.latency,
+		MinSmallLatency:       cc.minSmallLatency.latency,
+		SmoothedLatency:       cc.smoothedLatency,
+		ThroughputBytesPerSec: int64(cc.throughput),
+		Congestions:           cc.congestions,
+	}
+}
+
+// BlockTransferStatus describes the state of the controllers that
+// limit concurrent block transfers.
+type BlockTransferStatus struct {
+	Puts       ConcurrencyControllerStatus
+	Gets       ConcurrencyControllerStatus
+	Downgrades ConcurrencyControllerStatus
+}
+
+// BlockTransferControllers holds the controllers that limit the
+// number of concurrent block transfers between this client and the
+// block server.  All methods work on a nil *BlockTransferControllers,
+// which imposes no limits.
+type BlockTransferControllers struct {
+	puts       *ConcurrencyController
+	gets       *ConcurrencyController
+	downgrades *ConcurrencyController
+}
+
+// NewBlockTransferControllers creates a new set of controllers.
+// `numGetWorkers` is the number of block retrieval workers, which is
+// the most block gets that can ever be in flight at once.
+func NewBlockTransferControllers(
+	clock Clock, numGetWorkers int) *BlockTransferControllers {
+	return &BlockTransferControllers{
+		puts: NewConcurrencyController(
+			clock, 1, initialParallelBlockPuts, maxParallelBlockPuts),
+		gets: NewConcurrencyController(
+			clock, 1, maxParallelBlockGets, numGetWorkers),
+		downgrades: NewConcurrencyController(
+			clock, 1, initialParallelBlockPuts, maxParallelBlockPuts),
+	}
+}
+
+// Puts returns the controller for block puts and reference adds.
+func (btc *BlockTransferControllers) Puts() *ConcurrencyController {
+	if btc == nil {
+		return nil
+	}
+	return btc.puts
+}
+
+// Gets returns the controller for on-demand block gets.
+func (btc *BlockTransferControllers) Gets() *ConcurrencyController {
+	if btc == nil {
+		return nil
+	}
+	return btc.gets
+}
+
+// Downgrades returns the controller for batches of block archives
+// and deletes.
+func (btc *BlockTransferControllers) Downgrades() *ConcurrencyController {
+	if btc == nil {
+		return nil
+	}
+	return btc.downgrades
+}
+
+// Status returns the state of all the controllers, or nil if there
+// aren't any.
+func (btc *BlockTransferControllers) Status() *BlockTransferStatus {
+	if btc == nil {
+		return nil
+	}
+	return &BlockTransferStatus{
+		Puts:       btc.puts.Status(),
+		Gets:       btc.gets.Status(),
+		Downgrades: btc.downgrades.Status(),
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/keybase/kbfs/kbfsblock"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestConcurrencyControllerSlowStart(t *testing.T) {
+	clock := newTestClockNow()
+	cc := NewConcurrencyController(clock, 1, 2, 4)
+	ctx := context.Background()
+
+	done1, err := cc.Acquire(ctx)
+	require.NoError(t, err)
+	done2, err := cc.Acquire(ctx)
+	require.NoError(t, err)
+
+	t.Log("A third request has to wait for a slot.")
+	canceledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = cc.Acquire(canceledCtx)
+	require.Equal(t, context.Canceled, errors.Cause(err))
+
+	clock.Add(10 * time.Millisecond)
+	done1(1000, nil)
+	status := cc.Status()
+	require.Equal(t, 3, status.Limit)
+	require.Equal(t, 1, status.InFlight)
+	require.True(t, status.SlowStart)
+	require.Equal(t, 10*time.Millisecond, status.MinSmallLatency)
+
+	t.Log("A request that didn't fill the limit doesn't grow it.")
+	done2(1000, nil)
+	require.Equal(t, 3, cc.Status().Limit)
+
+	t.Log("The limit never grows past the maximum.")
+	for i := 0; i < 2; i++ {
+		var dones []func(int, error)
+		for j := 0; j < cc.Status().Limit; j++ {
+			done, err := cc.Acquire(ctx)
+			require.NoError(t, err)
+			dones = append(dones, done)
+		}
+		for _, done := range dones {
+			done(1000, nil)
+		}
+	}
+	status = cc.Status()
+	require.Equal(t, 4, status.Limit)
+	require.False(t, status.SlowStart)
+}
+
+func TestConcurrencyControllerCongestion(t *testing.T) {
+	clock := newTestClockNow()
+	cc := NewConcurrencyController(clock, 1, 8, 8)
+	ctx := context.Background()
+
+	done, err := cc.Acquire(ctx)
+	require.NoError(t, err)
+	clock.Add(10 * time.Millisecond)
+	done(1000, nil)
+
+	t.Log("A request much slower than the fastest one halves the limit.")
+	done, err = cc.Acquire(ctx)
+	require.NoError(t, err)
+	clock.Add(time.Second)
+	done(1000, nil)
+	status := cc.Status()
+	require.Equal(t, 4, status.Limit)
+	require.False(t, status.SlowStart)
+	require.Equal(t, int64(1), status.Congestions)
+
+	t.Log("Only one decrease happens per round trip.")
+	done, err = cc.Acquire(ctx)
+	require.NoError(t, err)
+	done(0, errors.WithStack(context.DeadlineExceeded))
+	require.Equal(t, 4, cc.Status().Limit)
+
+	t.Log("Server throttling is congestion too.")
+	clock.Add(2 * time.Second)
+	done, err = cc.Acquire(ctx)
+	require.NoError(t, err)
+	done(0, kbfsblock.BServerErrorThrottle{})
+	status = cc.Status()
+	require.Equal(t, 2, status.Limit)
+	require.Equal(t, int64(2), status.Congestions)
+
+	t.Log("Other errors, and abandoned requests, are ignored.")
+	clock.Add(2 * time.Second)
+	done, err = cc.Acquire(ctx)
+	require.NoError(t, err)
+	done(0, context.Canceled)
+	done, err = cc.Acquire(ctx)
+	require.NoError(t, err)
+	done(-1, nil)
+	status = cc.Status()
+	require.Equal(t, 2, status.Limit)
+	require.Equal(t, 0, status.InFlight)
+}
+
+func TestConcurrencyControllerRequestSizes(t *testing.T) {
+	clock := newTestClockNow()
+	cc := NewConcurrencyController(clock, 1, 8, 8)
+	ctx := context.Background()
+
+	done, err := cc.Acquire(ctx)
+	require.NoError(t, err)
+	clock.Add(10 * time.Millisecond)
+	done(100, nil)
+
+	t.Log("A full block isn't compared with a tiny request.")
+	done, err = cc.Acquire(ctx)
+	require.NoError(t, err)
+	clock.Add(time.Second)
+	done(512*1024, nil)
+	status := cc.Status()
+	require.Equal(t, 8, status.Limit)
+	require.Equal(t, int64(0), status.Congestions)
+	require.Equal(t, 10*time.Millisecond, status.MinSmallLatency)
+	require.Equal(t, time.Second, status.MinLatency)
+
+	t.Log("But it is compared with other full blocks.")
+	done, err = cc.Acquire(ctx)
+	require.NoError(t, err)
+	clock.Add(5 * time.Second)
+	done(512*1024, nil)
+	status = cc.Status()
+	require.Equal(t, 4, status.Limit)
+	require.Equal(t, int64(1), status.Congestions)
+}
+
+func TestBlockTransferControllersNil(t *testing.T) {
+	var btc *BlockTransferControllers
+	require.Nil(t, btc.Status())
+	done, err := btc.Puts().Acquire(context.Background())
+	require.NoError(t, err)
+	done(0, nil)
+}
@@ -66,6 +66,7 @@ type ConfigLocal struct {
 	bcache         BlockCache
 	dirtyBcache    DirtyBlockCache
 	diskBlockCache DiskBlockCache
+	diskMDCache    DiskMDCache
 	codec          kbfscodec.Codec
 	mdops          MDOps
 	kops           KeyOps
@@ -86,6 +87,7 @@ type ConfigLocal struct {
 	noBGFlush      bool // logic opposite so the default value is the common setting
 	rwpWaitTime    time.Duration
 	diskLimiter    DiskLimiter
+	transfers      *BlockTransferControllers
 
 	maxNameBytes uint32
 	maxDirBytes  uint64
@@ -94,10 +96,12 @@ type ConfigLocal struct {
 
 	traceLock    sync.RWMutex
 	traceEnabled bool
+	spanExporter SpanExporter
 
 	qrPeriod                       time.Duration
 	qrUnrefAge                     time.Duration
 	qrMinHeadAge                   time.Duration
+	retentionPolicies              *RetentionPolicies
 	delayedCancellationGracePeriod time.Duration
 
 	// allKnownConfigsForTesting is used for testing, and contains all created
@@ -118,6 +122,15 @@ type ConfigLocal struct {
 	// metadataVersion is the version to use when creating new metadata.
 	metadataVersion MetadataVer
 
+	// opsVersion is the newest version of ops to write.
+	opsVersion OpsVer
+
+	// blockCryptVersion is the encryption version to use for new
+	// blocks, and blockPadding is the padding scheme to use with
+	// EncryptionAESGCM.
+	blockCryptVersion EncryptionVer
+	blockPadding      BlockPadding
+
 	mode InitMode
 
 	quotaUsage map[keybase1.UserOrTeamID]*EventuallyConsistentQuotaUsage
@@ -321,6 +334,9 @@ func NewConfigLocal(mode InitMode, loggerFn func(module string) logger.Logger,
 	config.bgFlushDirOpBatchSize = bgFlushDirOpBatchSizeDefault
 	config.bgFlushPeriod = bgFlushPeriodDefault
 	config.metadataVersion = defaultClientMetadataVer
+	config.opsVersion = defaultClientOpsVer
+	config.blockCryptVersion = defaultClientBlockCryptVer
+	config.blockPadding = defaultClientBlockPadding
 	config.quotaUsage =
 		make(map[keybase1.UserOrTeamID]*EventuallyConsistentQuotaUsage)
 
@@ -460,6 +476,13 @@ func (c *ConfigLocal) DiskBlockCache() DiskBlockCache {
 	return c.diskBlockCache
 }
 
+// DiskMDCache implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) DiskMDCache() DiskMDCache {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.diskMDCache
+}
+
 // DiskLimiter implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) DiskLimiter() DiskLimiter {
 	c.lock.RLock()
@@ -692,9 +715,51 @@ func (c *ConfigLocal) SetMetadataVersion(mdVer MetadataVer) {
 	c.metadataVersion = mdVer
 }
 
+// OpsVersion implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) OpsVersion() OpsVer {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.opsVersion
+}
+
+// SetOpsVersion implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetOpsVersion(ver OpsVer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.opsVersion = ver
+}
+
+// BlockCryptVersion implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) BlockCryptVersion() EncryptionVer {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.blockCryptVersion
+}
+
+// SetBlockCryptVersion implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetBlockCryptVersion(ver EncryptionVer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.blockCryptVersion = ver
+}
+
+// BlockPadding implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) BlockPadding() BlockPadding {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.blockPadding
+}
+
+// SetBlockPadding implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetBlockPadding(padding BlockPadding) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.blockPadding = padding
+}
+
 // DataVersion implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) DataVersion() DataVer {
-	return AtLeastTwoLevelsOfChildrenDataVer
+	return AEADEncryptionDataVer
 }
 
 // DoBackgroundFlushes implements the Config interface for ConfigLocal.
@@ -763,6 +828,33 @@ func (c *ConfigLocal) QuotaReclamationMinHeadAge() time.Duration {
 	return c.qrMinHeadAge
 }
 
+// RetentionPolicies implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) RetentionPolicies() *RetentionPolicies {
+	return c.retentionPolicies
+}
+
+// SetRetentionPolicies implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetRetentionPolicies(rp *RetentionPolicies) {
+	c.retentionPolicies = rp
+}
+
+// BlockTransferControllers implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) BlockTransferControllers() *BlockTransferControllers {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.transfers
+}
+
+// SetBlockTransferControllers implements the Config interface for
+// ConfigLocal.
+func (c *ConfigLocal) SetBlockTransferControllers(
+	btc *BlockTransferControllers) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.transfers = btc
+}
+
 // ReqsBufSize implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) ReqsBufSize() int {
 	return 20
@@ -897,6 +989,8 @@ func (c *ConfigLocal) SetTraceOptions(enabled bool) {
 // MaybeStartTrace implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) MaybeStartTrace(
 	ctx context.Context, family, title string) context.Context {
+	ctx = startRootSpan(ctx, c.SpanExporter(), family, spanAttrTitle(title))
+
 	traceEnabled := func() bool {
 		c.traceLock.RLock()
 		defer c.traceLock.RUnlock()
@@ -914,6 +1008,7 @@ func (c *ConfigLocal) MaybeStartTrace(
 
 // MaybeFinishTrace implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) MaybeFinishTrace(ctx context.Context, err error) {
+	finishSpan(ctx, err)
 	if tr, ok := trace.FromContext(ctx); ok {
 		if err != nil {
 			tr.LazyPrintf("err=%+v", err)
@@ -923,6 +1018,20 @@ func (c *ConfigLocal) MaybeFinishTrace(ctx context.Context, err error) {
 	}
 }
 
+// SpanExporter implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SpanExporter() SpanExporter {
+	c.traceLock.RLock()
+	defer c.traceLock.RUnlock()
+	return c.spanExporter
+}
+
+// SetSpanExporter implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetSpanExporter(e SpanExporter) {
+	c.traceLock.Lock()
+	defer c.traceLock.Unlock()
+	c.spanExporter = e
+}
+
 // SetTLFValidDuration implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) SetTLFValidDuration(r time.Duration) {
 	c.tlfValidDuration = r
@@ -1027,6 +1136,16 @@ func (c *ConfigLocal) Shutdown(ctx context.Context) error {
 	if dbc != nil {
 		dbc.Shutdown(ctx)
 	}
+	dmc := c.DiskMDCache()
+	if dmc != nil {
+		dmc.Shutdown(ctx)
+	}
+	if se := c.SpanExporter(); se != nil {
+		err = se.Shutdown(ctx)
+		if err != nil {
+			errorList = append(errorList, err)
+		}
+	}
 
 	if len(errorList) == 1 {
 		return errorList[0]
@@ -1187,3 +1306,14 @@ func (c *ConfigLocal) SetDiskBlockCache(dbc DiskBlockCache) {
 	}
 	c.diskBlockCache = dbc
 }
+
+// SetDiskMDCache implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetDiskMDCache(dmc DiskMDCache) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	ctx := context.TODO()
+	if c.diskMDCache != nil {
+		c.diskMDCache.Shutdown(ctx)
+	}
+	c.diskMDCache = dmc
+}
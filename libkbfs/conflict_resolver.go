@@ -1371,6 +1371,181 @@ outer:
 	return nil
 }
 
+// forkUnmergedRename undoes the unmerged rename of the file with the
+// given original pointer, by dropping the rm half of the rename and
+// turning the create half into a fresh copy of the unmerged version
+// of the file.  The original file is left under its old name.
+func forkUnmergedRename(ptr BlockPointer, info renameInfo,
+	unmergedChains *crChains) error {
+	oldParent := unmergedChains.byOriginal[info.originalOldParent]
+	for _, op := range oldParent.ops {
+		ro, ok := op.(*rmOp)
+		if !ok {
+			continue
+		}
+		if ro.OldName == info.oldName {
+			ro.dropThis = true
+			break
+		}
+	}
+	unmergedChain := unmergedChains.byOriginal[ptr]
+	newParent := unmergedChains.byOriginal[info.originalNewParent]
+	for _, npOp := range newParent.ops {
+		co, ok := npOp.(*createOp)
+		if !ok {
+			continue
+		}
+		if co.NewName == info.newName && co.renamed {
+			co.forceCopy = true
+			co.renamed = false
+			if unmergedChain != nil {
+				co.AddRefBlock(unmergedChain.mostRecent)
+				co.DelRefBlock(ptr)
+				// Clear out the ops on the file itself, as we
+				// will be doing a fresh create instead.
+				unmergedChain.ops = nil
+			}
+			break
+		}
+	}
+	// Reset the chain of the forked file to the most recent
+	// pointer, since we want to avoid any local notifications
+	// linking the old version of the file to the new one.
+	if unmergedChain != nil && ptr != unmergedChain.mostRecent {
+		err := unmergedChains.changeOriginal(
+			ptr, unmergedChain.mostRecent)
+		if err != nil {
+			return err
+		}
+		unmergedChains.createdOriginals[unmergedChain.mostRecent] = true
+	}
+	return nil
+}
+
+// preserveImmutableMergedEntries makes sure the unmerged branch can't
+// remove any entries from a write-once, read-many merged branch.
+// Unmerged removals are dropped, and files renamed on the unmerged
+// branch are forked, leaving the originals under their old names.
+// Renamed directories keep their new names, since that doesn't lose
+// any of their contents.  Such operations can only be left over from
+// before the folder was made immutable.
+func (cr *ConflictResolver) preserveImmutableMergedEntries(
+	ctx context.Context, unmergedChains *crChains) error {
+	type rmKey struct {
+		parent BlockPointer
+		name   string
+	}
+	keepRms := make(map[rmKey]bool)
+	for ptr, info := range unmergedChains.renamedOriginals {
+		if unmergedChains.isDeleted(ptr) {
+			continue
+		}
+		newParent, ok := unmergedChains.byOriginal[info.originalNewParent]
+		if !ok {
+			return NoChainFoundError{info.originalNewParent}
+		}
+		isDir := false
+		found := false
+		for _, op := range newParent.ops {
+			co, ok := op.(*createOp)
+			if ok && co.renamed && co.NewName == info.newName {
+				isDir = co.Type == Dir
+				found = true
+				break
+			}
+		}
+		if !found {
+			// Already forked while fixing rename conflicts.
+			continue
+		}
+		if isDir {
+			keepRms[rmKey{info.originalOldParent, info.oldName}] = true
+			continue
+		}
+		cr.log.CDebugf(ctx, "Forking file renamed on the unmerged branch "+
+			"from %s -> %s in an immutable folder", info.oldName,
+			info.newName)
+		err := forkUnmergedRename(ptr, info, unmergedChains)
+		if err != nil {
+			return err
+		}
+	}
+
+	for original, chain := range unmergedChains.byOriginal {
+		for _, op := range chain.ops {
+			ro, ok := op.(*rmOp)
+			if !ok || ro.dropThis || keepRms[rmKey{original, ro.OldName}] {
+				continue
+			}
+			cr.log.CDebugf(ctx, "Dropping unmerged removal of %s in an "+
+				"immutable folder", ro.OldName)
+			ro.dropThis = true
+		}
+	}
+	return nil
+}
+
+// forkImmutableFileActions replaces any action that would put the
+// unmerged contents of a file over the merged file in a write-once,
+// read-many folder with one that puts the unmerged version under a
+// new conflict name instead, leaving the merged file untouched.
+func (cr *ConflictResolver) forkImmutableFileActions(ctx context.Context,
+	unmergedChain *crChain, mergedPath path, actions crActionList) (
+	crActionList, error) {
+	var so *syncOp
+	for _, op := range unmergedChain.ops {
+		if realOp, ok := op.(*syncOp); ok {
+			so = realOp
+		}
+	}
+	if so == nil {
+		return actions, nil
+	}
+
+	var newActions crActionList
+	forked := false
+	for _, action := range actions {
+		overwrites := false
+		switch realAction := action.(type) {
+		case *copyUnmergedEntryAction:
+			overwrites = true
+		case *copyUnmergedAttrAction:
+			for _, attr := range realAction.attr {
+				if attr == sizeAttr {
+					overwrites = true
+				}
+			}
+		case *renameUnmergedAction:
+			// Already forked because of a conflicting merged write.
+			forked = true
+		}
+		if !overwrites {
+			newActions = append(newActions, action)
+			continue
+		}
+		if forked {
+			continue
+		}
+
+		toName, err := cr.config.ConflictRenamer().ConflictRename(
+			ctx, so, mergedPath.tailName())
+		if err != nil {
+			return nil, err
+		}
+		cr.log.CDebugf(ctx, "Forking unmerged changes to %s as %s in an "+
+			"immutable folder", mergedPath.tailName(), toName)
+		newActions = append(newActions, &renameUnmergedAction{
+			fromName: so.getFinalPath().tailName(),
+			toName:   toName,
+			unmergedParentMostRecent: so.getFinalPath().parentPath().
+				tailPointer(),
+			mergedParentMostRecent: mergedPath.parentPath().tailPointer(),
+		})
+		forked = true
+	}
+	return newActions, nil
+}
+
 // crConflictCheckQuick checks whether the two given chains have any
 // direct conflicts.  TODO: currently this is a little pessimistic
 // because it assumes any set attrs are in conflict, when in reality
@@ -1446,44 +1621,9 @@ func (cr *ConflictResolver) fixRenameConflicts(ctx context.Context,
 			cr.log.CDebugf(ctx, "File that was renamed on the unmerged "+
 				"branch from %s -> %s has conflicting edits, forking "+
 				"(original ptr %v)", info.oldName, info.newName, ptr)
-			oldParent := unmergedChains.byOriginal[info.originalOldParent]
-			for _, op := range oldParent.ops {
-				ro, ok := op.(*rmOp)
-				if !ok {
-					continue
-				}
-				if ro.OldName == info.oldName {
-					ro.dropThis = true
-					break
-				}
-			}
-			newParent := unmergedChains.byOriginal[info.originalNewParent]
-			for _, npOp := range newParent.ops {
-				co, ok := npOp.(*createOp)
-				if !ok {
-					continue
-				}
-				if co.NewName == info.newName && co.renamed {
-					co.forceCopy = true
-					co.renamed = false
-					co.AddRefBlock(unmergedChain.mostRecent)
-					co.DelRefBlock(ptr)
-					// Clear out the ops on the file itself, as we
-					// will be doing a fresh create instead.
-					unmergedChain.ops = nil
-					break
-				}
-			}
-			// Reset the chain of the forked file to the most recent
-			// pointer, since we want to avoid any local notifications
-			// linking the old version of the file to the new one.
-			if ptr != unmergedChain.mostRecent {
-				err := unmergedChains.changeOriginal(
-					ptr, unmergedChain.mostRecent)
-				if err != nil {
-					return nil, err
-				}
-				unmergedChains.createdOriginals[unmergedChain.mostRecent] = true
+			err := forkUnmergedRename(ptr, info, unmergedChains)
+			if err != nil {
+				return nil, err
 			}
 			continue
 		}
@@ -1941,6 +2081,17 @@ func (cr *ConflictResolver) getActionsToMerge(
 			return nil, err
 		}
 
+		// Never overwrite the contents of a file that existed before
+		// the unmerged branch in an immutable folder.
+		if mergedChains.mostRecentChainMDInfo.immutable &&
+			unmergedChain.isFile() && !unmergedChains.isCreated(original) {
+			actions, err = cr.forkImmutableFileActions(
+				ctx, unmergedChain, mergedPath, actions)
+			if err != nil {
+				return nil, err
+			}
+		}
+
 		if len(actions) > 0 {
 			actionMap[mergedPath.tailPointer()] = actions
 		}
@@ -1967,8 +2118,9 @@ func collapseActions(unmergedChains *crChains, unmergedPaths []path,
 
 		fileActions := actionMap[p.tailPointer()]
 
-		// If this is a directory with setAttr(mtime)-related actions,
-		// just those action should be collapsed into the parent.
+		// If this is a directory with setAttr(mtime or
+		// mode)-related actions, just those action should be
+		// collapsed into the parent.
 		if !chain.isFile() {
 			var parentActions crActionList
 			var otherDirActions crActionList
@@ -1976,13 +2128,15 @@ func collapseActions(unmergedChains *crChains, unmergedPaths []path,
 				moved := false
 				switch realAction := action.(type) {
 				case *copyUnmergedAttrAction:
-					if realAction.attr[0] == mtimeAttr && !realAction.moved {
+					if (realAction.attr[0] == mtimeAttr ||
+						realAction.attr[0] == modeAttr) && !realAction.moved {
 						realAction.moved = true
 						parentActions = append(parentActions, realAction)
 						moved = true
 					}
 				case *renameUnmergedAction:
-					if realAction.causedByAttr == mtimeAttr &&
+					if (realAction.causedByAttr == mtimeAttr ||
+						realAction.causedByAttr == modeAttr) &&
 						!realAction.moved {
 						realAction.moved = true
 						parentActions = append(parentActions, realAction)
@@ -1994,7 +2148,7 @@ func collapseActions(unmergedChains *crChains, unmergedPaths []path,
 				}
 			}
 			if len(parentActions) == 0 {
-				// A directory with no mtime actions, so treat it
+				// A directory with no mtime or mode actions, so treat it
 				// normally.
 				continue
 			}
@@ -2081,6 +2235,14 @@ func (cr *ConflictResolver) computeActions(ctx context.Context,
 	}
 	newUnmergedPaths = append(newUnmergedPaths, moreNewUnmergedPaths...)
 
+	// An immutable folder must never lose any merged entries.
+	if mergedChains.mostRecentChainMDInfo.immutable {
+		err := cr.preserveImmutableMergedEntries(ctx, unmergedChains)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
 	// Recreate any modified merged nodes that were rm'd in the
 	// unmerged branch.
 	if err := cr.addMergedRecreates(
@@ -2946,7 +3108,8 @@ func (cr *ConflictResolver) completeResolution(ctx context.Context,
 	// Put all the blocks.  TODO: deal with recoverable block errors?
 	_, err = doBlockPuts(ctx, cr.config.BlockServer(), cr.config.BlockCache(),
 		cr.config.Reporter(), cr.log, cr.deferLog, md.TlfID(),
-		md.GetTlfHandle().GetCanonicalName(), *bps)
+		md.GetTlfHandle().GetCanonicalName(), *bps,
+		blockTransferControllersForTlf(cr.config, md.TlfID()).Puts())
 	if err != nil {
 		return err
 	}
@@ -682,7 +682,8 @@ func TestCRMergedChainsRenamedDirectory(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Couldn't make dir: %v", err)
 	}
-	err = config1.KBFSOps().Rename(ctx, dirB1, "dirC", dirD1, "dirC")
+	err = config1.KBFSOps().Rename(ctx, dirB1, "dirC", dirD1, "dirC",
+		RenameFlagsNone)
 	if err != nil {
 		t.Fatalf("Couldn't remove dir: %v", err)
 	}
@@ -824,7 +825,8 @@ func TestCRMergedChainsComplex(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Couldn't remove dir: %v", err)
 	}
-	err = config1.KBFSOps().Rename(ctx, dirG1, "dirH", dirA1, "dirI")
+	err = config1.KBFSOps().Rename(ctx, dirG1, "dirH", dirA1, "dirI",
+		RenameFlagsNone)
 	if err != nil {
 		t.Fatalf("Couldn't remove dir: %v", err)
 	}
@@ -850,7 +852,8 @@ func TestCRMergedChainsComplex(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Couldn't create file: %v", err)
 	}
-	err = config2.KBFSOps().Rename(ctx, dirC2, "file4", dirH2, "file4")
+	err = config2.KBFSOps().Rename(ctx, dirC2, "file4", dirH2, "file4",
+		RenameFlagsNone)
 	if err != nil {
 		t.Fatalf("Couldn't remove dir: %v", err)
 	}
@@ -967,7 +970,8 @@ func TestCRMergedChainsRenameCycleSimple(t *testing.T) {
 	}
 
 	// user1 moves dirB into dirA
-	err = config1.KBFSOps().Rename(ctx, dirRoot1, "dirB", dirA1, "dirB")
+	err = config1.KBFSOps().Rename(ctx, dirRoot1, "dirB", dirA1, "dirB",
+		RenameFlagsNone)
 	if err != nil {
 		t.Fatalf("Couldn't make dir: %v", err)
 	}
@@ -977,7 +981,8 @@ func TestCRMergedChainsRenameCycleSimple(t *testing.T) {
 	}
 
 	// user2 moves dirA into dirB
-	err = config2.KBFSOps().Rename(ctx, dirRoot2, "dirA", dirB2, "dirA")
+	err = config2.KBFSOps().Rename(ctx, dirRoot2, "dirA", dirB2, "dirA",
+		RenameFlagsNone)
 	if err != nil {
 		t.Fatalf("Couldn't make dir: %v", err)
 	}
@@ -12,6 +12,7 @@ import (
 const (
 	KeybaseServiceName     = "keybase-service"
 	MDServiceName          = "md-server"
+	BlockServiceName       = "block-server"
 	LoginStatusUpdateName  = "login"
 	LogoutStatusUpdateName = "logout"
 )
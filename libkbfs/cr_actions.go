@@ -190,6 +190,9 @@ func (cuea *copyUnmergedEntryAction) do(ctx context.Context,
 				unmergedEntry.Type = cuea.unmergedEntry.Type
 			case mtimeAttr:
 				unmergedEntry.Mtime = cuea.unmergedEntry.Mtime
+			case modeAttr:
+				unmergedEntry.Type = cuea.unmergedEntry.Type
+				unmergedEntry.Mode = cuea.unmergedEntry.Mode
 			}
 		}
 	}
@@ -383,6 +386,9 @@ type copyUnmergedAttrAction struct {
 	toName   string
 	attr     []attrChange
 	moved    bool // move this action to the parent at most one time
+	// If true, combine the merged and unmerged modes instead of
+	// copying the unmerged one, because both branches changed it.
+	mergeModes bool
 }
 
 func (cuaa *copyUnmergedAttrAction) swapUnmergedBlock(
@@ -410,6 +416,15 @@ func (cuaa *copyUnmergedAttrAction) do(ctx context.Context,
 			mergedEntry.Type = unmergedEntry.Type
 		case mtimeAttr:
 			mergedEntry.Mtime = unmergedEntry.Mtime
+		case modeAttr:
+			if cuaa.mergeModes {
+				mergedEntry.Type, mergedEntry.Mode = mergeEntryModes(
+					mergedEntry.Type, mergedEntry.Mode,
+					unmergedEntry.Type, unmergedEntry.Mode)
+			} else {
+				mergedEntry.Type = unmergedEntry.Type
+				mergedEntry.Mode = unmergedEntry.Mode
+			}
 		case sizeAttr:
 			mergedEntry.Size = unmergedEntry.Size
 			mergedEntry.EncodedSize = unmergedEntry.EncodedSize
@@ -444,8 +459,26 @@ func (cuaa *copyUnmergedAttrAction) updateOps(unmergedMostRecent BlockPointer,
 }
 
 func (cuaa *copyUnmergedAttrAction) String() string {
-	return fmt.Sprintf("copyUnmergedAttr: %s -> %s (%s)",
-		cuaa.fromName, cuaa.toName, cuaa.attr)
+	return fmt.Sprintf("copyUnmergedAttr: %s -> %s (%s, merge modes=%t)",
+		cuaa.fromName, cuaa.toName, cuaa.attr, cuaa.mergeModes)
+}
+
+// mergeEntryModes combines two concurrently-set modes of the same
+// entry, along with the types that carry their executable bits.  The
+// result only grants permissions that both modes grant, and is
+// read-only if either mode is.
+func mergeEntryModes(mergedType EntryType, mergedMode EntryMode,
+	unmergedType EntryType, unmergedMode EntryMode) (EntryType, EntryMode) {
+	perm := mergedMode.Perm(mergedType) & unmergedMode.Perm(unmergedType)
+	mode := (mergedMode | unmergedMode) &^ EntryModePerm
+	if mergedMode.IsPermSet() || unmergedMode.IsPermSet() {
+		mode = mode.WithPerm(perm)
+	}
+	t := mergedType
+	if t == Exec && perm&0100 == 0 {
+		t = File
+	}
+	return t, mode
 }
 
 // rmMergedEntryAction says that the merged entry for the given name
@@ -948,6 +981,8 @@ func (cal crActionList) collapse() crActionList {
 			case *copyUnmergedAttrAction:
 				// Add attributes to the current top action, if not
 				// already there.
+				topAction.mergeModes =
+					topAction.mergeModes || action.mergeModes
 				for _, a := range action.attr {
 					found := false
 					for _, topA := range topAction.attr {
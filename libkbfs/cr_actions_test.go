@@ -5,6 +5,7 @@
 package libkbfs
 
 import (
+	"os"
 	"reflect"
 	"testing"
 )
@@ -17,7 +18,8 @@ func TestCRActionsCollapseNoChange(t *testing.T) {
 			DirEntry{}, nil},
 		&renameUnmergedAction{"old3", "new3", "", 0, false, zeroPtr, zeroPtr},
 		&renameMergedAction{"old4", "new4", ""},
-		&copyUnmergedAttrAction{"old5", "new5", []attrChange{mtimeAttr}, false},
+		&copyUnmergedAttrAction{"old5", "new5", []attrChange{mtimeAttr}, false,
+			false},
 	}
 
 	newList := al.collapse()
@@ -28,7 +30,8 @@ func TestCRActionsCollapseNoChange(t *testing.T) {
 
 func TestCRActionsCollapseEntry(t *testing.T) {
 	al := crActionList{
-		&copyUnmergedAttrAction{"old", "new", []attrChange{mtimeAttr}, false},
+		&copyUnmergedAttrAction{"old", "new", []attrChange{mtimeAttr}, false,
+			false},
 		&copyUnmergedEntryAction{"old", "new", "", false, false,
 			DirEntry{}, nil},
 		&renameUnmergedAction{"old", "new", "", 0, false, zeroPtr, zeroPtr},
@@ -65,14 +68,17 @@ func TestCRActionsCollapseEntry(t *testing.T) {
 }
 func TestCRActionsCollapseAttr(t *testing.T) {
 	al := crActionList{
-		&copyUnmergedAttrAction{"old", "new", []attrChange{mtimeAttr}, false},
-		&copyUnmergedAttrAction{"old", "new", []attrChange{exAttr}, false},
-		&copyUnmergedAttrAction{"old", "new", []attrChange{mtimeAttr}, false},
+		&copyUnmergedAttrAction{"old", "new", []attrChange{mtimeAttr}, false,
+			false},
+		&copyUnmergedAttrAction{"old", "new", []attrChange{exAttr}, false,
+			false},
+		&copyUnmergedAttrAction{"old", "new", []attrChange{mtimeAttr}, false,
+			false},
 	}
 
 	expected := crActionList{
 		&copyUnmergedAttrAction{"old", "new", []attrChange{mtimeAttr, exAttr},
-			false},
+			false, false},
 	}
 
 	newList := al.collapse()
@@ -81,3 +87,37 @@ func TestCRActionsCollapseAttr(t *testing.T) {
 			expected, newList)
 	}
 }
+
+func TestCRActionsMergeEntryModes(t *testing.T) {
+	// Only the permissions granted on both sides survive.
+	typ, mode := mergeEntryModes(Exec, EntryMode(0).WithPerm(0750),
+		Exec, EntryMode(0).WithPerm(0710)|EntryModeReadOnly)
+	if typ != Exec {
+		t.Errorf("Unexpected type: %s", typ)
+	}
+	if g, e := mode.Perm(typ), os.FileMode(0710); g != e {
+		t.Errorf("Unexpected perm: %s vs %s", g, e)
+	}
+	if !mode.IsReadOnly() {
+		t.Errorf("Read-only flag was dropped")
+	}
+
+	// Losing the owner's exec bit on either side clears the type.
+	typ, mode = mergeEntryModes(Exec, EntryMode(0).WithPerm(0755),
+		File, EntryMode(0).WithPerm(0644))
+	if typ != File {
+		t.Errorf("Unexpected type: %s", typ)
+	}
+	if g, e := mode.Perm(typ), os.FileMode(0644); g != e {
+		t.Errorf("Unexpected perm: %s vs %s", g, e)
+	}
+	if mode.IsReadOnly() {
+		t.Errorf("Unexpected read-only flag")
+	}
+
+	// Two unset modes stay unset.
+	_, mode = mergeEntryModes(File, 0, File, 0)
+	if mode.IsPermSet() {
+		t.Errorf("Unexpected perm: %s", mode)
+	}
+}
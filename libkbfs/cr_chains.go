@@ -235,8 +235,8 @@ func (cc *crChain) identifyType(ctx context.Context, fbo *folderBlockOps,
 	}
 
 	// If any op is setAttr (ex or size) or sync, this is a file
-	// chain.  If it only has a setAttr/mtime, we don't know what it
-	// is, so fall through and fetch the block unless we come across
+	// chain.  If it only has a setAttr/mtime or setAttr/mode, we
+	// don't know what it is, so fall through and fetch the block unless we come across
 	// another op that can determine the type.
 	var parentDir BlockPointer
 	for _, op := range cc.ops {
@@ -245,12 +245,13 @@ func (cc *crChain) identifyType(ctx context.Context, fbo *folderBlockOps,
 			cc.file = true
 			return nil
 		case *setAttrOp:
-			if realOp.Attr != mtimeAttr {
+			if realOp.Attr != mtimeAttr && realOp.Attr != modeAttr {
 				cc.file = true
 				return nil
 			}
-			// We can't tell the file type from an mtimeAttr, so we
-			// may have to actually fetch the block to figure it out.
+			// We can't tell the file type from an mtimeAttr or a
+			// modeAttr, so we may have to actually fetch the block to
+			// figure it out.
 			parentDir = realOp.Dir.Ref
 		default:
 			return nil
@@ -389,6 +390,9 @@ func (ri renameInfo) String() string {
 type mostRecentChainMetadataInfo struct {
 	kmd      KeyMetadata
 	rootInfo BlockInfo
+	// immutable is true if the most recent MD belongs to a
+	// write-once, read-many folder.
+	immutable bool
 }
 
 // crChains contains a crChain for every KBFS node affected by the
@@ -535,17 +539,14 @@ func (ccs *crChains) makeChainForOp(op op) error {
 			return err
 		}
 
-		ndu := realOp.NewDir.Unref
-		ndr := realOp.NewDir.Ref
-		if realOp.NewDir == (blockUpdate{}) {
-			// this is a rename within the same directory
-			ndu = realOp.OldDir.Unref
-			ndr = realOp.OldDir.Ref
-		}
+		nd := realOp.newDirUpdate()
+		ndu := nd.Unref
+		ndr := nd.Ref
 
-		if len(realOp.Unrefs()) > 0 {
-			// Something was overwritten; make an explicit rm for it
-			// so we can check for conflicts.
+		if len(realOp.Unrefs()) > 0 || realOp.isExchange() {
+			// Something was overwritten, or is being moved to the
+			// old name; make an explicit rm for it so we can check
+			// for conflicts.
 			roOverwrite, err := newRmOp(realOp.NewName, ndu)
 			if err != nil {
 				return err
@@ -565,54 +566,32 @@ func (ccs *crChains) makeChainForOp(op op) error {
 			}
 		}
 
-		co, err := newCreateOp(realOp.NewName, ndu, realOp.RenamedType)
+		cos, err := realOp.createOps()
 		if err != nil {
 			return err
 		}
-		co.setWriterInfo(realOp.getWriterInfo())
-		co.setLocalTimestamp(realOp.getLocalTimestamp())
-		co.renamed = true
-		// ndr may be zero if this is a post-resolution chain,
-		// so set co.Dir.Ref manually.
-		co.Dir.Ref = ndr
-		err = ccs.addOp(ndr, co)
-		if err != nil {
-			return err
+		for _, co := range cos {
+			err = ccs.addOp(co.Dir.Ref, co)
+			if err != nil {
+				return err
+			}
 		}
 
 		// also keep track of the new parent for the renamed node
 		if realOp.Renamed.IsInitialized() {
-			newParentChain, ok := ccs.byMostRecent[ndr]
-			if !ok {
-				return fmt.Errorf("While renaming, couldn't find the chain "+
-					"for the new parent %v", ndr)
-			}
-			oldParentChain, ok := ccs.byMostRecent[realOp.OldDir.Ref]
-			if !ok {
-				return fmt.Errorf("While renaming, couldn't find the chain "+
-					"for the old parent %v", ndr)
-			}
-
-			renamedOriginal := realOp.Renamed
-			if renamedChain, ok := ccs.byMostRecent[realOp.Renamed]; ok {
-				renamedOriginal = renamedChain.original
+			err = ccs.trackRename(realOp.Renamed, realOp.OldDir.Ref,
+				realOp.OldName, ndr, realOp.NewName, cos[0])
+			if err != nil {
+				return err
 			}
-			// Use the previous old info if there is one already,
-			// in case this node has been renamed multiple times.
-			ri, ok := ccs.renamedOriginals[renamedOriginal]
-			if !ok {
-				// Otherwise make a new one.
-				ri = renameInfo{
-					originalOldParent: oldParentChain.original,
-					oldName:           realOp.OldName,
-				}
+		}
+		// and of the old parent for the exchanged node
+		if realOp.isExchange() && realOp.Exchanged.IsInitialized() {
+			err = ccs.trackRename(realOp.Exchanged, ndr, realOp.NewName,
+				realOp.OldDir.Ref, realOp.OldName, cos[1])
+			if err != nil {
+				return err
 			}
-			ri.originalNewParent = newParentChain.original
-			ri.newName = realOp.NewName
-			ccs.renamedOriginals[renamedOriginal] = ri
-			// Remember what you create, in case we need to merge
-			// directories after a rename.
-			co.AddRefBlock(renamedOriginal)
 		}
 	case *syncOp:
 		err := ccs.addOp(realOp.File.Ref, op)
@@ -646,6 +625,47 @@ func (ccs *crChains) makeChainForOp(op op) error {
 	return nil
 }
 
+// trackRename records that the node with the given most recent
+// pointer was renamed from oldName in the directory with the most
+// recent pointer oldParent, to newName in newParent.  co is the
+// create op made for the node in the new parent.
+func (ccs *crChains) trackRename(renamed BlockPointer,
+	oldParent BlockPointer, oldName string, newParent BlockPointer,
+	newName string, co *createOp) error {
+	newParentChain, ok := ccs.byMostRecent[newParent]
+	if !ok {
+		return fmt.Errorf("While renaming, couldn't find the chain "+
+			"for the new parent %v", newParent)
+	}
+	oldParentChain, ok := ccs.byMostRecent[oldParent]
+	if !ok {
+		return fmt.Errorf("While renaming, couldn't find the chain "+
+			"for the old parent %v", oldParent)
+	}
+
+	renamedOriginal := renamed
+	if renamedChain, ok := ccs.byMostRecent[renamed]; ok {
+		renamedOriginal = renamedChain.original
+	}
+	// Use the previous old info if there is one already,
+	// in case this node has been renamed multiple times.
+	ri, ok := ccs.renamedOriginals[renamedOriginal]
+	if !ok {
+		// Otherwise make a new one.
+		ri = renameInfo{
+			originalOldParent: oldParentChain.original,
+			oldName:           oldName,
+		}
+	}
+	ri.originalNewParent = newParentChain.original
+	ri.newName = newName
+	ccs.renamedOriginals[renamedOriginal] = ri
+	// Remember what you create, in case we need to merge
+	// directories after a rename.
+	co.AddRefBlock(renamedOriginal)
+	return nil
+}
+
 func (ccs *crChains) makeChainForNewOpWithUpdate(
 	targetPtr BlockPointer, newOp op, update *blockUpdate) error {
 	oldUpdate := *update
@@ -830,6 +850,7 @@ type chainMetadata interface {
 	Revision() kbfsmd.Revision
 	Data() *PrivateMetadata
 	LocalTimestamp() time.Time
+	IsImmutableSet() bool
 }
 
 // newCRChains builds a new crChains object from the given list of
@@ -914,8 +935,9 @@ func newCRChains(
 	}
 
 	ccs.mostRecentChainMDInfo = mostRecentChainMetadataInfo{
-		kmd:      mostRecentMD,
-		rootInfo: mostRecentMD.Data().Dir.BlockInfo,
+		kmd:       mostRecentMD,
+		rootInfo:  mostRecentMD.Data().Dir.BlockInfo,
+		immutable: mostRecentMD.IsImmutableSet(),
 	}
 
 	return ccs, nil
@@ -992,7 +1014,8 @@ func (ccs *crChains) copyOpAndRevertUnrefsToOriginals(currOp op) op {
 	case *renameOp:
 		newRenameOp := *realOp
 		unrefs = append(unrefs, &newRenameOp.OldDir.Unref,
-			&newRenameOp.NewDir.Unref, &newRenameOp.Renamed)
+			&newRenameOp.NewDir.Unref, &newRenameOp.Renamed,
+			&newRenameOp.Exchanged)
 		newOp = &newRenameOp
 	case *syncOp:
 		newSyncOp := *realOp
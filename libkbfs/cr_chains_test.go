@@ -246,6 +246,58 @@ func TestCRChainsRenameOp(t *testing.T) {
 	testCRCheckOps(t, cc, dir1Unref, []op{rmo})
 }
 
+func TestCRChainsExchangeOp(t *testing.T) {
+	chainMD := newChainMDForTest(t)
+
+	currPtr, ptrs, revPtrs := testCRInitPtrs(3)
+	rootPtrUnref := ptrs[0]
+	dir1Unref := ptrs[1]
+	dir2Unref := ptrs[2]
+	filePtr := BlockPointer{ID: kbfsblock.FakeID(currPtr)}
+	currPtr++
+	subdirPtr := BlockPointer{ID: kbfsblock.FakeID(currPtr)}
+	currPtr++
+	expected := make(map[BlockPointer]BlockPointer)
+	expectedRenames := make(map[BlockPointer]renameInfo)
+
+	oldName, newName := "old", "new"
+	ro, err := newRenameOp(oldName, dir1Unref, newName, dir2Unref, filePtr, File)
+	require.NoError(t, err)
+	ro.Flags = RenameExchange
+	ro.Exchanged = subdirPtr
+	ro.ExchangedType = Dir
+	expectedRenames[filePtr] = renameInfo{dir1Unref, "old", dir2Unref, "new"}
+	expectedRenames[subdirPtr] = renameInfo{dir2Unref, "new", dir1Unref, "old"}
+	_ = testCRFillOpPtrs(currPtr, expected, revPtrs,
+		[]BlockPointer{rootPtrUnref, dir1Unref, dir2Unref}, ro)
+	chainMD.AddOp(ro)
+	chainMD.data.Dir.BlockPointer = expected[rootPtrUnref]
+
+	chainMDs := []chainMetadata{chainMD}
+	cc, err := newCRChains(
+		context.Background(), makeChainCodec(), chainMDs, nil, true)
+	if err != nil {
+		t.Fatalf("Error making chains: %v", err)
+	}
+
+	checkExpectedChains(t, expected, expectedRenames, rootPtrUnref, cc, true)
+
+	// Each directory loses its old entry and gets the other one,
+	// without unreferencing anything.
+	rmo1, err := newRmOp(oldName, dir1Unref)
+	require.NoError(t, err)
+	co1, err := newCreateOp(oldName, dir1Unref, Dir)
+	require.NoError(t, err)
+	co1.renamed = true
+	testCRCheckOps(t, cc, dir1Unref, []op{rmo1, co1})
+	rmo2, err := newRmOp(newName, dir2Unref)
+	require.NoError(t, err)
+	co2, err := newCreateOp(newName, dir2Unref, File)
+	require.NoError(t, err)
+	co2.renamed = true
+	testCRCheckOps(t, cc, dir2Unref, []op{rmo2, co2})
+}
+
 func testCRChainsMultiOps(t *testing.T) ([]chainMetadata, BlockPointer) {
 	// To start, we have: root/dir1/dir2/file1 and root/dir3/file2
 	// Sequence of operations:
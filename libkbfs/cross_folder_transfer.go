@@ -0,0 +1,705 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	stdpath "path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+const (
+	// crossFolderTransferChunkSize is how much file data a
+	// cross-folder transfer reads and writes at a time.
+	crossFolderTransferChunkSize = 512 * 1024
+	// crossFolderTransferSyncInterval is how many bytes of a file a
+	// cross-folder transfer writes between syncs, which bounds the
+	// amount of dirty data it holds, and how much it has to redo
+	// after an interruption.
+	crossFolderTransferSyncInterval = 16 * 1024 * 1024
+	// crossFolderTransferCheckpointEntries is how many finished
+	// entries a cross-folder transfer lets pile up before it syncs
+	// the destination and records them as done.
+	crossFolderTransferCheckpointEntries = 100
+)
+
+// FolderPath names an entry in a top-level folder by the folder's
+// name and type, and the names of the entries on the way to it.
+// Unlike a Node, it stays meaningful across restarts.
+type FolderPath struct {
+	TlfName string   `codec:"n"`
+	TlfType tlf.Type `codec:"t"`
+	Path    []string `codec:"p"`
+}
+
+// CrossFolderTransferPhase says how far a cross-folder transfer has
+// gotten.
+type CrossFolderTransferPhase int
+
+const (
+	// CrossFolderTransferCopying means entries are still being
+	// copied to the destination.
+	CrossFolderTransferCopying CrossFolderTransferPhase = 1
+	// CrossFolderTransferRemovingSource means the destination is
+	// complete and flushed to the server, and the source of a move
+	// is being removed.
+	CrossFolderTransferRemovingSource CrossFolderTransferPhase = 2
+)
+
+// CrossFolderTransferState is the recorded progress of an unfinished
+// cross-folder transfer.
+type CrossFolderTransferState struct {
+	Src   FolderPath               `codec:"s"`
+	Dest  FolderPath               `codec:"d"`
+	Move  bool                     `codec:"m"`
+	Phase CrossFolderTransferPhase `codec:"p"`
+	// Done holds the paths, relative to Src, of the entries that
+	// have been completely copied and synced.  Src itself is ".",
+	// and a directory is only done once all its children are.  It's
+	// kept in a separate journal, rather than in the state file
+	// itself, so that recording an entry doesn't rewrite all the
+	// others.
+	Done map[string]bool `codec:"c"`
+	// Current is the path, relative to Src, of the file being
+	// copied, if any, and CurrentOffset is how much of it has been
+	// synced to the destination.
+	Current       string `codec:"f"`
+	CurrentOffset int64  `codec:"o"`
+}
+
+func crossFolderTransfersRootFromStorageRoot(storageRoot string) string {
+	return filepath.Join(storageRoot, "kbfs_transfers")
+}
+
+func crossFolderTransfersDoneRootFromStorageRoot(storageRoot string) string {
+	return filepath.Join(storageRoot, "kbfs_transfers_done")
+}
+
+// crossFolderTransferDoneEntry is an entry in the journal of done
+// paths of a cross-folder transfer.
+type crossFolderTransferDoneEntry struct {
+	Paths []string `codec:"p"`
+}
+
+// crossFolderTransferRun is the in-memory progress of a cross-folder
+// transfer while it's being run.
+type crossFolderTransferRun struct {
+	id     string
+	state  *CrossFolderTransferState
+	destFB FolderBranch
+	// pending holds the paths of the entries that have been copied,
+	// but not necessarily synced, and so aren't recorded as done
+	// yet.
+	pending []string
+}
+
+// crossFolderTransfers runs cross-folder transfers, and keeps the
+// state of each unfinished one in its own file under the storage
+// root, along with a journal of its done entries, so that it can be
+// resumed or rolled back after a restart.  If there is no storage
+// root, the states are only kept in memory.
+type crossFolderTransfers struct {
+	config Config
+	log    logger.Logger
+	// If empty, states are only kept in memory.
+	dir     string
+	doneDir string
+	// syncInterval is how many bytes of a file are written between
+	// syncs.  It's only changed by tests.
+	syncInterval int64
+
+	// Protects memStates, memDone and running.
+	lock      sync.Mutex
+	memStates map[string]CrossFolderTransferState
+	memDone   map[string]map[string]bool
+	// running holds the IDs of the transfers being run or rolled
+	// back right now.
+	running map[string]bool
+}
+
+func newCrossFolderTransfers(config Config,
+	log logger.Logger) *crossFolderTransfers {
+	t := &crossFolderTransfers{
+		config:       config,
+		log:          log,
+		syncInterval: crossFolderTransferSyncInterval,
+		running:      make(map[string]bool),
+	}
+	if storageRoot := config.StorageRoot(); storageRoot == "" {
+		t.memStates = make(map[string]CrossFolderTransferState)
+		t.memDone = make(map[string]map[string]bool)
+	} else {
+		t.dir = crossFolderTransfersRootFromStorageRoot(storageRoot)
+		t.doneDir = crossFolderTransfersDoneRootFromStorageRoot(storageRoot)
+	}
+	return t
+}
+
+func checkCrossFolderTransferID(id string) error {
+	if id == "" || id == "." || id == ".." || strings.ContainsAny(id, `/\`) {
+		return errors.Errorf("Invalid cross-folder transfer ID %q", id)
+	}
+	return nil
+}
+
+func (t *crossFolderTransfers) statePath(id string) string {
+	return filepath.Join(t.dir, id)
+}
+
+func (t *crossFolderTransfers) doneJournalLocked(id string) (
+	*diskJournal, error) {
+	return makeDiskJournal(t.config.Codec(), filepath.Join(t.doneDir, id),
+		reflect.TypeOf(crossFolderTransferDoneEntry{}))
+}
+
+func (t *crossFolderTransfers) readDoneLocked(
+	id string, done map[string]bool) error {
+	if t.dir == "" {
+		for p := range t.memDone[id] {
+			done[p] = true
+		}
+		return nil
+	}
+	j, err := t.doneJournalLocked(id)
+	if err != nil {
+		return err
+	}
+	if j.empty() {
+		return nil
+	}
+	earliest, err := j.readEarliestOrdinal()
+	if err != nil {
+		return err
+	}
+	latest, err := j.readLatestOrdinal()
+	if err != nil {
+		return err
+	}
+	for o := earliest; o <= latest; o++ {
+		entry, err := j.readJournalEntry(o)
+		if err != nil {
+			return err
+		}
+		for _, p := range entry.(crossFolderTransferDoneEntry).Paths {
+			done[p] = true
+		}
+	}
+	return nil
+}
+
+func (t *crossFolderTransfers) getState(id string) (
+	state CrossFolderTransferState, ok bool, err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.dir == "" {
+		state, ok = t.memStates[id]
+	} else {
+		err = kbfscodec.DeserializeFromFile(
+			t.config.Codec(), t.statePath(id), &state)
+		if ioutil.IsNotExist(err) {
+			return CrossFolderTransferState{}, false, nil
+		} else if err != nil {
+			return CrossFolderTransferState{}, false, err
+		}
+		ok = true
+	}
+	if !ok {
+		return CrossFolderTransferState{}, false, nil
+	}
+	// State files written before the done journal existed might
+	// still have their own done entries.
+	done := make(map[string]bool, len(state.Done))
+	for p := range state.Done {
+		done[p] = true
+	}
+	err = t.readDoneLocked(id, done)
+	if err != nil {
+		return CrossFolderTransferState{}, false, err
+	}
+	state.Done = done
+	return state, true, nil
+}
+
+// putState records everything in the given state except its done
+// entries, which are recorded with addDone.
+func (t *crossFolderTransfers) putState(
+	id string, state CrossFolderTransferState) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	state.Done = nil
+	if t.dir == "" {
+		t.memStates[id] = state
+		return nil
+	}
+	return kbfscodec.SerializeToFile(
+		t.config.Codec(), state, t.statePath(id))
+}
+
+// addDone records the given paths as done, in addition to the ones
+// already recorded.
+func (t *crossFolderTransfers) addDone(id string, paths []string) error {
+	if len(paths) == 0 {
+		return nil
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.dir == "" {
+		done := t.memDone[id]
+		if done == nil {
+			done = make(map[string]bool)
+			t.memDone[id] = done
+		}
+		for _, p := range paths {
+			done[p] = true
+		}
+		return nil
+	}
+	j, err := t.doneJournalLocked(id)
+	if err != nil {
+		return err
+	}
+	_, err = j.appendJournalEntry(nil, crossFolderTransferDoneEntry{
+		Paths: paths,
+	})
+	return err
+}
+
+func (t *crossFolderTransfers) removeState(id string) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.dir == "" {
+		delete(t.memStates, id)
+		delete(t.memDone, id)
+		return nil
+	}
+	// Remove the done journal first, so that a crash in between
+	// only loses progress, and a new transfer with the same ID
+	// never sees old done entries.
+	err := ioutil.RemoveAll(filepath.Join(t.doneDir, id))
+	if err != nil {
+		return err
+	}
+	err = ioutil.Remove(t.statePath(id))
+	if ioutil.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// startRunning marks the transfer with the given ID as running, and
+// returns a function that unmarks it.
+func (t *crossFolderTransfers) startRunning(id string) (func(), error) {
+	err := checkCrossFolderTransferID(id)
+	if err != nil {
+		return nil, err
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.running[id] {
+		return nil, errors.Errorf(
+			"Cross-folder transfer %s is already running", id)
+	}
+	t.running[id] = true
+	return func() {
+		t.lock.Lock()
+		defer t.lock.Unlock()
+		delete(t.running, id)
+	}, nil
+}
+
+// lookupParent returns the node of the directory holding the entry
+// at p, and the entry's name.
+func (t *crossFolderTransfers) lookupParent(
+	ctx context.Context, p FolderPath) (Node, string, error) {
+	if len(p.Path) == 0 {
+		return nil, "", errors.Errorf(
+			"Can't transfer the top-level folder %s", p.TlfName)
+	}
+	h, err := parseTlfHandleLoose(
+		ctx, t.config.KBPKI(), p.TlfName, p.TlfType)
+	if err != nil {
+		return nil, "", err
+	}
+	kbfsOps := t.config.KBFSOps()
+	node, _, err := kbfsOps.GetOrCreateRootNode(ctx, h, MasterBranch)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, name := range p.Path[:len(p.Path)-1] {
+		node, _, err = kbfsOps.Lookup(ctx, node, name)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	return node, p.Path[len(p.Path)-1], nil
+}
+
+// lookupIfExists looks up the given name in dir, and returns a nil
+// error and false if it doesn't exist.
+func (t *crossFolderTransfers) lookupIfExists(
+	ctx context.Context, dir Node, name string) (
+	Node, EntryInfo, bool, error) {
+	node, ei, err := t.config.KBFSOps().Lookup(ctx, dir, name)
+	if _, ok := errors.Cause(err).(NoSuchNameError); ok {
+		return nil, EntryInfo{}, false, nil
+	} else if err != nil {
+		return nil, EntryInfo{}, false, err
+	}
+	return node, ei, true, nil
+}
+
+func sortedChildNames(children map[string]EntryInfo) []string {
+	names := make([]string, 0, len(children))
+	for name := range children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// transfer starts or resumes the transfer with the given ID.
+func (t *crossFolderTransfers) transfer(ctx context.Context, id string,
+	src, dest FolderPath, move bool) error {
+	stopRunning, err := t.startRunning(id)
+	if err != nil {
+		return err
+	}
+	defer stopRunning()
+
+	state, ok, err := t.getState(id)
+	if err != nil {
+		return err
+	}
+	if ok {
+		if !reflect.DeepEqual(state.Src, src) ||
+			!reflect.DeepEqual(state.Dest, dest) || state.Move != move {
+			return errors.Errorf("Cross-folder transfer %s was started "+
+				"with different arguments", id)
+		}
+		t.log.CDebugf(ctx, "Resuming cross-folder transfer %s in phase %d",
+			id, state.Phase)
+	} else {
+		destParent, destName, err := t.lookupParent(ctx, dest)
+		if err != nil {
+			return err
+		}
+		_, _, exists, err := t.lookupIfExists(ctx, destParent, destName)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return NameExistsError{destName}
+		}
+		state = CrossFolderTransferState{
+			Src:   src,
+			Dest:  dest,
+			Move:  move,
+			Phase: CrossFolderTransferCopying,
+			Done:  make(map[string]bool),
+		}
+		err = t.putState(id, state)
+		if err != nil {
+			return err
+		}
+	}
+
+	if state.Phase == CrossFolderTransferCopying {
+		err = t.copyAll(ctx, id, &state)
+		if err != nil {
+			return err
+		}
+		if !move {
+			return t.removeState(id)
+		}
+		state.Phase = CrossFolderTransferRemovingSource
+		err = t.putState(id, state)
+		if err != nil {
+			return err
+		}
+	}
+
+	srcParent, srcName, err := t.lookupParent(ctx, state.Src)
+	if err != nil {
+		return err
+	}
+	err = t.removeTree(ctx, srcParent, srcName)
+	if err != nil {
+		return err
+	}
+	return t.removeState(id)
+}
+
+// copyAll copies everything under the transfer's source that isn't
+// done yet, and waits for the destination to be flushed.
+func (t *crossFolderTransfers) copyAll(ctx context.Context, id string,
+	state *CrossFolderTransferState) error {
+	srcParent, srcName, err := t.lookupParent(ctx, state.Src)
+	if err != nil {
+		return err
+	}
+	destParent, destName, err := t.lookupParent(ctx, state.Dest)
+	if err != nil {
+		return err
+	}
+	run := &crossFolderTransferRun{
+		id:     id,
+		state:  state,
+		destFB: destParent.GetFolderBranch(),
+	}
+	err = t.copyEntry(ctx, run, srcParent, srcName, destParent, destName, ".")
+	if err != nil {
+		return err
+	}
+	err = t.checkpoint(ctx, run)
+	if err != nil {
+		return err
+	}
+	return WaitForTLFJournal(ctx, t.config, run.destFB.Tlf, t.log)
+}
+
+// recordPending records the pending entries of the run as done.
+// The caller must have synced the destination since they were
+// copied.
+func (t *crossFolderTransfers) recordPending(
+	run *crossFolderTransferRun) error {
+	err := t.addDone(run.id, run.pending)
+	if err != nil {
+		return err
+	}
+	for _, p := range run.pending {
+		run.state.Done[p] = true
+	}
+	run.pending = nil
+	return nil
+}
+
+// checkpoint syncs the destination, and then records the pending
+// entries of the run as done.
+func (t *crossFolderTransfers) checkpoint(
+	ctx context.Context, run *crossFolderTransferRun) error {
+	err := t.config.KBFSOps().SyncAll(ctx, run.destFB)
+	if err != nil {
+		return err
+	}
+	return t.recordPending(run)
+}
+
+// copyEntry copies the entry srcName in srcParent to destName in
+// destParent, recursively, skipping whatever is already done.  rel
+// is the entry's path relative to the transfer's source.
+func (t *crossFolderTransfers) copyEntry(ctx context.Context,
+	run *crossFolderTransferRun, srcParent Node, srcName string,
+	destParent Node, destName string, rel string) error {
+	if run.state.Done[rel] {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+
+	kbfsOps := t.config.KBFSOps()
+	srcNode, srcEI, err := kbfsOps.Lookup(ctx, srcParent, srcName)
+	if err != nil {
+		return err
+	}
+	destNode, _, destExists, err := t.lookupIfExists(
+		ctx, destParent, destName)
+	if err != nil {
+		return err
+	}
+
+	switch srcEI.Type {
+	case Sym:
+		if !destExists {
+			_, err = kbfsOps.CreateLink(
+				ctx, destParent, destName, srcEI.SymPath)
+		}
+	case Dir:
+		if !destExists {
+			destNode, _, err = kbfsOps.CreateDir(ctx, destParent, destName)
+			if err != nil {
+				return err
+			}
+		}
+		children, err := kbfsOps.GetDirChildren(ctx, srcNode)
+		if err != nil {
+			return err
+		}
+		for _, name := range sortedChildNames(children) {
+			err = t.copyEntry(ctx, run, srcNode, name,
+				destNode, name, stdpath.Join(rel, name))
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		err = t.copyFile(
+			ctx, run, srcNode, srcEI, destParent, destName, destNode, rel)
+		if err != nil {
+			return err
+		}
+		// copyFile just synced the destination.
+		run.pending = append(run.pending, rel)
+		return t.recordPending(run)
+	}
+	if err != nil {
+		return err
+	}
+
+	run.pending = append(run.pending, rel)
+	if len(run.pending) < crossFolderTransferCheckpointEntries {
+		return nil
+	}
+	return t.checkpoint(ctx, run)
+}
+
+// copyFile copies the data of the file srcNode to destName in
+// destParent, resuming from the recorded offset if the file was
+// being copied when the transfer was interrupted, and syncs the
+// destination.  destNode is nil if the destination doesn't exist
+// yet.
+func (t *crossFolderTransfers) copyFile(ctx context.Context,
+	run *crossFolderTransferRun, srcNode Node, srcEI EntryInfo,
+	destParent Node, destName string, destNode Node, rel string) error {
+	state := run.state
+	var offset int64
+	if state.Current == rel {
+		offset = state.CurrentOffset
+		t.log.CDebugf(ctx, "Resuming copy of %s at offset %d", rel, offset)
+	} else {
+		state.Current, state.CurrentOffset = rel, 0
+		err := t.putState(run.id, *state)
+		if err != nil {
+			return err
+		}
+	}
+
+	kbfsOps := t.config.KBFSOps()
+	var err error
+	if destNode != nil {
+		// Drop anything written after the last sync.
+		err = kbfsOps.Truncate(ctx, destNode, uint64(offset))
+	} else if offset != 0 {
+		err = errors.Errorf("The destination of partly-copied file %s "+
+			"is missing", rel)
+	} else {
+		destNode, _, err = kbfsOps.CreateFile(
+			ctx, destParent, destName, srcEI.Type == Exec, NoExcl)
+	}
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, crossFolderTransferChunkSize)
+	synced := offset
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		n, err := kbfsOps.Read(ctx, srcNode, buf, offset)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		err = kbfsOps.Write(ctx, destNode, buf[:n], offset)
+		if err != nil {
+			return err
+		}
+		offset += n
+		if offset-synced >= t.syncInterval {
+			err = t.checkpoint(ctx, run)
+			if err != nil {
+				return err
+			}
+			synced = offset
+			state.CurrentOffset = offset
+			err = t.putState(run.id, *state)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err = kbfsOps.SyncAll(ctx, run.destFB)
+	if err != nil {
+		return err
+	}
+	state.Current, state.CurrentOffset = "", 0
+	return nil
+}
+
+// removeTree removes the entry name in parent, recursively, if it
+// exists.
+func (t *crossFolderTransfers) removeTree(
+	ctx context.Context, parent Node, name string) error {
+	node, ei, exists, err := t.lookupIfExists(ctx, parent, name)
+	if err != nil || !exists {
+		return err
+	}
+	kbfsOps := t.config.KBFSOps()
+	if ei.Type != Dir {
+		return kbfsOps.RemoveEntry(ctx, parent, name)
+	}
+	children, err := kbfsOps.GetDirChildren(ctx, node)
+	if err != nil {
+		return err
+	}
+	for _, child := range sortedChildNames(children) {
+		err = t.removeTree(ctx, node, child)
+		if err != nil {
+			return err
+		}
+	}
+	return kbfsOps.RemoveDir(ctx, parent, name)
+}
+
+// rollBack removes the destination of the unfinished transfer with
+// the given ID, and forgets the transfer.
+func (t *crossFolderTransfers) rollBack(ctx context.Context, id string) error {
+	stopRunning, err := t.startRunning(id)
+	if err != nil {
+		return err
+	}
+	defer stopRunning()
+
+	state, ok, err := t.getState(id)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.Errorf("No cross-folder transfer %s", id)
+	}
+	if state.Phase != CrossFolderTransferCopying {
+		return errors.Errorf("Cross-folder transfer %s is removing its "+
+			"source, and can only be resumed", id)
+	}
+
+	destParent, destName, err := t.lookupParent(ctx, state.Dest)
+	if err != nil {
+		return err
+	}
+	t.log.CDebugf(ctx, "Rolling back cross-folder transfer %s", id)
+	err = t.removeTree(ctx, destParent, destName)
+	if err != nil {
+		return err
+	}
+	return t.removeState(id)
+}
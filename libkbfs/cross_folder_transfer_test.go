@@ -0,0 +1,315 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func makeCrossFolderTransferTestTree(ctx context.Context, t *testing.T,
+	kbfsOps KBFSOps, rootNode Node, data []byte) {
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "d")
+	require.NoError(t, err)
+	fileNode, _, err := kbfsOps.CreateFile(ctx, dirNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	subdirNode, _, err := kbfsOps.CreateDir(ctx, dirNode, "e")
+	require.NoError(t, err)
+	fileNode, _, err = kbfsOps.CreateFile(ctx, subdirNode, "b", true, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, data[:10], 0)
+	require.NoError(t, err)
+	_, err = kbfsOps.CreateLink(ctx, dirNode, "l", "a")
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+}
+
+func checkCrossFolderTransferTestTree(ctx context.Context, t *testing.T,
+	kbfsOps KBFSOps, dirNode Node, data []byte) {
+	children, err := kbfsOps.GetDirChildren(ctx, dirNode)
+	require.NoError(t, err)
+	require.Len(t, children, 3)
+	require.Equal(t, File, children["a"].Type)
+	require.Equal(t, Dir, children["e"].Type)
+	require.Equal(t, Sym, children["l"].Type)
+	require.Equal(t, "a", children["l"].SymPath)
+
+	fileNode, _, err := kbfsOps.Lookup(ctx, dirNode, "a")
+	require.NoError(t, err)
+	gotData := make([]byte, len(data)+1)
+	n, err := kbfsOps.Read(ctx, fileNode, gotData, 0)
+	require.NoError(t, err)
+	require.Equal(t, data, gotData[:n])
+
+	subdirNode, _, err := kbfsOps.Lookup(ctx, dirNode, "e")
+	require.NoError(t, err)
+	fileNode, ei, err := kbfsOps.Lookup(ctx, subdirNode, "b")
+	require.NoError(t, err)
+	require.Equal(t, Exec, ei.Type)
+	n, err = kbfsOps.Read(ctx, fileNode, gotData, 0)
+	require.NoError(t, err)
+	require.Equal(t, data[:10], gotData[:n])
+}
+
+func TestCrossFolderTransferCopy(t *testing.T) {
+	var u1, u2 libkb.NormalizedUsername = "u1", "u2"
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, u1, u2)
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	config.KBFSOps().(*KBFSOpsStandard).transfers.syncInterval = 30
+
+	kbfsOps := config.KBFSOps()
+	srcRoot := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	data := make([]byte, 100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	makeCrossFolderTransferTestTree(ctx, t, kbfsOps, srcRoot, data)
+
+	src := FolderPath{"u1", tlf.Private, []string{"d"}}
+	dest := FolderPath{"u1,u2", tlf.Private, []string{"d2"}}
+	err := kbfsOps.TransferAcrossFolders(ctx, "copy", src, dest, false)
+	require.NoError(t, err)
+	_, ok, err := kbfsOps.CrossFolderTransferStatus("copy")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// The source is still there.
+	dirNode, _, err := kbfsOps.Lookup(ctx, srcRoot, "d")
+	require.NoError(t, err)
+	checkCrossFolderTransferTestTree(ctx, t, kbfsOps, dirNode, data)
+
+	// The other writer can read the copy, which is encrypted with
+	// the destination folder's keys.
+	config2 := ConfigAsUser(config, u2)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+	kbfsOps2 := config2.KBFSOps()
+	destRoot2 := GetRootNodeOrBust(ctx, t, config2, "u1,u2", tlf.Private)
+	dirNode2, _, err := kbfsOps2.Lookup(ctx, destRoot2, "d2")
+	require.NoError(t, err)
+	checkCrossFolderTransferTestTree(ctx, t, kbfsOps2, dirNode2, data)
+
+	// The destination must not exist.
+	err = kbfsOps.TransferAcrossFolders(ctx, "copy2", src, dest, false)
+	require.IsType(t, NameExistsError{}, errors.Cause(err))
+	_, ok, err = kbfsOps.CrossFolderTransferStatus("copy2")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	err = kbfsOps.TransferAcrossFolders(ctx, "../x", src, dest, false)
+	require.Error(t, err)
+}
+
+func TestCrossFolderTransferResumeMove(t *testing.T) {
+	var u1, u2 libkb.NormalizedUsername = "u1", "u2"
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, u1, u2)
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	transfers := config.KBFSOps().(*KBFSOpsStandard).transfers
+	transfers.syncInterval = 30
+
+	kbfsOps := config.KBFSOps()
+	srcRoot := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	data := make([]byte, 100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	makeCrossFolderTransferTestTree(ctx, t, kbfsOps, srcRoot, data)
+
+	t.Log("Pretend a move was interrupted in the middle of d/a, after " +
+		"some unsynced garbage was written past the recorded offset.")
+	destRoot := GetRootNodeOrBust(ctx, t, config, "u1,u2", tlf.Private)
+	destDir, _, err := kbfsOps.CreateDir(ctx, destRoot, "d2")
+	require.NoError(t, err)
+	destFile, _, err := kbfsOps.CreateFile(ctx, destDir, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, destFile, data[:30], 0)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, destFile, []byte{0xff, 0xff}, 30)
+	require.NoError(t, err)
+
+	src := FolderPath{"u1", tlf.Private, []string{"d"}}
+	dest := FolderPath{"u1,u2", tlf.Private, []string{"d2"}}
+	err = transfers.putState("move", CrossFolderTransferState{
+		Src:           src,
+		Dest:          dest,
+		Move:          true,
+		Phase:         CrossFolderTransferCopying,
+		Current:       "a",
+		CurrentOffset: 30,
+	})
+	require.NoError(t, err)
+
+	// Resuming with different arguments fails.
+	err = kbfsOps.TransferAcrossFolders(ctx, "move", src, dest, false)
+	require.Error(t, err)
+
+	err = kbfsOps.TransferAcrossFolders(ctx, "move", src, dest, true)
+	require.NoError(t, err)
+	_, ok, err := kbfsOps.CrossFolderTransferStatus("move")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	_, _, err = kbfsOps.Lookup(ctx, srcRoot, "d")
+	require.IsType(t, NoSuchNameError{}, errors.Cause(err))
+	checkCrossFolderTransferTestTree(ctx, t, kbfsOps, destDir, data)
+
+	t.Log("A move that was interrupted while removing its source " +
+		"can't be rolled back, but can be resumed.")
+	makeCrossFolderTransferTestTree(ctx, t, kbfsOps, srcRoot, data)
+	dest.Path = []string{"d3"}
+	err = transfers.putState("move2", CrossFolderTransferState{
+		Src:   src,
+		Dest:  dest,
+		Move:  true,
+		Phase: CrossFolderTransferRemovingSource,
+	})
+	require.NoError(t, err)
+	err = kbfsOps.RollBackCrossFolderTransfer(ctx, "move2")
+	require.Error(t, err)
+	err = kbfsOps.TransferAcrossFolders(ctx, "move2", src, dest, true)
+	require.NoError(t, err)
+	_, _, err = kbfsOps.Lookup(ctx, srcRoot, "d")
+	require.IsType(t, NoSuchNameError{}, errors.Cause(err))
+}
+
+func TestCrossFolderTransferRollBack(t *testing.T) {
+	var u1, u2 libkb.NormalizedUsername = "u1", "u2"
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, u1, u2)
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	transfers := config.KBFSOps().(*KBFSOpsStandard).transfers
+
+	kbfsOps := config.KBFSOps()
+	srcRoot := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	data := make([]byte, 100)
+	makeCrossFolderTransferTestTree(ctx, t, kbfsOps, srcRoot, data)
+
+	destRoot := GetRootNodeOrBust(ctx, t, config, "u1,u2", tlf.Private)
+	destDir, _, err := kbfsOps.CreateDir(ctx, destRoot, "d2")
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateFile(ctx, destDir, "a", false, NoExcl)
+	require.NoError(t, err)
+
+	src := FolderPath{"u1", tlf.Private, []string{"d"}}
+	dest := FolderPath{"u1,u2", tlf.Private, []string{"d2"}}
+	err = transfers.putState("move", CrossFolderTransferState{
+		Src:   src,
+		Dest:  dest,
+		Move:  true,
+		Phase: CrossFolderTransferCopying,
+	})
+	require.NoError(t, err)
+	err = transfers.addDone("move", []string{"a"})
+	require.NoError(t, err)
+	state, ok, err := kbfsOps.CrossFolderTransferStatus("move")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, map[string]bool{"a": true}, state.Done)
+
+	err = kbfsOps.RollBackCrossFolderTransfer(ctx, "move")
+	require.NoError(t, err)
+	_, ok, err = kbfsOps.CrossFolderTransferStatus("move")
+	require.NoError(t, err)
+	require.False(t, ok)
+	_, _, err = kbfsOps.Lookup(ctx, destRoot, "d2")
+	require.IsType(t, NoSuchNameError{}, errors.Cause(err))
+	dirNode, _, err := kbfsOps.Lookup(ctx, srcRoot, "d")
+	require.NoError(t, err)
+	checkCrossFolderTransferTestTree(ctx, t, kbfsOps, dirNode, data)
+
+	err = kbfsOps.RollBackCrossFolderTransfer(ctx, "move")
+	require.Error(t, err)
+}
+
+func TestCrossFolderTransferDoneAfterSync(t *testing.T) {
+	var u1, u2 libkb.NormalizedUsername = "u1", "u2"
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, u1, u2)
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	transfers := config.KBFSOps().(*KBFSOpsStandard).transfers
+
+	// Keep the states on disk, to exercise the done journal.
+	tempdir, err := ioutil.TempDir(os.TempDir(), "cross_folder_transfer")
+	require.NoError(t, err)
+	defer func() {
+		err := ioutil.RemoveAll(tempdir)
+		assert.NoError(t, err)
+	}()
+	transfers.dir = crossFolderTransfersRootFromStorageRoot(tempdir)
+	transfers.doneDir = crossFolderTransfersDoneRootFromStorageRoot(tempdir)
+
+	kbfsOps := config.KBFSOps()
+	srcRoot := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	data := make([]byte, 100)
+	makeCrossFolderTransferTestTree(ctx, t, kbfsOps, srcRoot, data)
+	srcDir, _, err := kbfsOps.Lookup(ctx, srcRoot, "d")
+	require.NoError(t, err)
+
+	destRoot := GetRootNodeOrBust(ctx, t, config, "u1,u2", tlf.Private)
+	destDir, _, err := kbfsOps.CreateDir(ctx, destRoot, "d2")
+	require.NoError(t, err)
+
+	src := FolderPath{"u1", tlf.Private, []string{"d"}}
+	dest := FolderPath{"u1,u2", tlf.Private, []string{"d2"}}
+	err = transfers.putState("copy", CrossFolderTransferState{
+		Src:   src,
+		Dest:  dest,
+		Phase: CrossFolderTransferCopying,
+	})
+	require.NoError(t, err)
+	state, ok, err := transfers.getState("copy")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	t.Log("A copied symlink isn't done until the destination is synced.")
+	run := &crossFolderTransferRun{
+		id:     "copy",
+		state:  &state,
+		destFB: destRoot.GetFolderBranch(),
+	}
+	err = transfers.copyEntry(ctx, run, srcDir, "l", destDir, "l", "l")
+	require.NoError(t, err)
+	require.Equal(t, []string{"l"}, run.pending)
+	gotState, _, err := transfers.getState("copy")
+	require.NoError(t, err)
+	require.Len(t, gotState.Done, 0)
+
+	t.Log("A copied file is done as soon as it's copied, along with " +
+		"everything before it, since copying it syncs.")
+	err = transfers.copyEntry(ctx, run, srcDir, "a", destDir, "a", "a")
+	require.NoError(t, err)
+	require.Len(t, run.pending, 0)
+	gotState, _, err = transfers.getState("copy")
+	require.NoError(t, err)
+	require.Equal(t, map[string]bool{"a": true, "l": true}, gotState.Done)
+
+	t.Log("State updates don't lose the done entries.")
+	err = transfers.putState("copy", gotState)
+	require.NoError(t, err)
+	err = transfers.copyAll(ctx, "copy", &gotState)
+	require.NoError(t, err)
+	gotState, _, err = transfers.getState("copy")
+	require.NoError(t, err)
+	require.True(t, gotState.Done["."])
+	require.True(t, gotState.Done["e/b"])
+	checkCrossFolderTransferTestTree(ctx, t, kbfsOps, destDir, data)
+
+	err = transfers.removeState("copy")
+	require.NoError(t, err)
+	_, ok, err = transfers.getState("copy")
+	require.NoError(t, err)
+	require.False(t, ok)
+	_, err = ioutil.Stat(filepath.Join(transfers.doneDir, "copy"))
+	require.True(t, ioutil.IsNotExist(err))
+}
@@ -5,9 +5,12 @@
 package libkbfs
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/rand"
 	"encoding/binary"
 	"io"
+	"math/bits"
 
 	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/client/go/protocol/keybase1"
@@ -253,6 +256,69 @@ func (c CryptoCommon) decryptData(encryptedData encryptedData, key [32]byte) ([]
 	return decryptedData, nil
 }
 
+// blockAdditionalData returns the associated data bound to blocks
+// encrypted with EncryptionAESGCM.  Ideally this would include the
+// block ID, but that's the hash of the encrypted block, so it isn't
+// known until after encryption; instead, the ID is checked against
+// the encrypted data whenever a block is fetched.
+func blockAdditionalData(tlfID tlf.ID) []byte {
+	return append([]byte("KBFS block "), tlfID.Bytes()...)
+}
+
+func newAESGCM(key [32]byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return aead, nil
+}
+
+func (c CryptoCommon) encryptDataAESGCM(
+	data []byte, key [32]byte, ad []byte) (encryptedData, error) {
+	aead, err := newAESGCM(key)
+	if err != nil {
+		return encryptedData{}, err
+	}
+
+	// Every block has its own key, so random nonces are safe.
+	nonce := make([]byte, aead.NonceSize())
+	err = kbfscrypto.RandRead(nonce)
+	if err != nil {
+		return encryptedData{}, err
+	}
+
+	return encryptedData{
+		Version:       EncryptionAESGCM,
+		Nonce:         nonce,
+		EncryptedData: aead.Seal(nil, nonce, data, ad),
+	}, nil
+}
+
+func (c CryptoCommon) decryptDataAESGCM(
+	encryptedData encryptedData, key [32]byte, ad []byte) ([]byte, error) {
+	aead, err := newAESGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(encryptedData.Nonce) != aead.NonceSize() {
+		return nil, errors.WithStack(
+			InvalidNonceError{encryptedData.Nonce})
+	}
+
+	decryptedData, err := aead.Open(
+		nil, encryptedData.Nonce, encryptedData.EncryptedData, ad)
+	if err != nil {
+		return nil, errors.WithStack(libkb.DecryptionError{})
+	}
+
+	return decryptedData, nil
+}
+
 // DecryptPrivateMetadata implements the Crypto interface for CryptoCommon.
 func (c CryptoCommon) DecryptPrivateMetadata(
 	encryptedPmd EncryptedPrivateMetadata, key kbfscrypto.TLFCryptKey) (
@@ -297,11 +363,42 @@ func powerOfTwoEqualOrGreater(n int) int {
 	return n
 }
 
+// padmeLength returns the length that a block of n bytes is padded
+// to by the Padmé scheme, which keeps only the top
+// floor(log2(floor(log2(n))))+1 bits of the length.
+// https://lbarman.ch/blog/padme/
+func padmeLength(n int) int {
+	if n <= minBlockSize {
+		return minBlockSize
+	}
+
+	e := bits.Len(uint(n)) - 1 // floor(log2(n))
+	s := bits.Len(uint(e))     // floor(log2(e)) + 1
+	mask := 1<<uint(e-s) - 1
+	return (n + mask) &^ mask
+}
+
 const padPrefixSize = 4
 
-// padBlock adds zero padding to an encoded block.
+// padBlock adds zero padding to an encoded block, up to the next
+// power of two.
 func (c CryptoCommon) padBlock(block []byte) ([]byte, error) {
-	totalLen := powerOfTwoEqualOrGreater(len(block))
+	return c.padBlockWithScheme(block, BlockPaddingPowerOfTwo)
+}
+
+// padBlockWithScheme adds zero padding to an encoded block according
+// to the given scheme.
+func (c CryptoCommon) padBlockWithScheme(
+	block []byte, padding BlockPadding) ([]byte, error) {
+	var totalLen int
+	switch padding {
+	case BlockPaddingPowerOfTwo:
+		totalLen = powerOfTwoEqualOrGreater(len(block))
+	case BlockPaddingPadme:
+		totalLen = padmeLength(len(block))
+	default:
+		return nil, errors.WithStack(UnknownBlockPaddingError{padding})
+	}
 
 	buf := make([]byte, padPrefixSize+totalLen)
 	binary.LittleEndian.PutUint32(buf, uint32(len(block)))
@@ -353,12 +450,46 @@ func (c CryptoCommon) EncryptBlock(block Block, key kbfscrypto.BlockCryptKey) (
 	return plainSize, encryptedBlock, nil
 }
 
+// EncryptBlockAEAD implements the Crypto interface for CryptoCommon.
+func (c CryptoCommon) EncryptBlockAEAD(block Block, tlfID tlf.ID,
+	key kbfscrypto.BlockCryptKey, padding BlockPadding) (
+	plainSize int, encryptedBlock EncryptedBlock, err error) {
+	encodedBlock, err := c.codec.Encode(block)
+	if err != nil {
+		return -1, EncryptedBlock{}, err
+	}
+
+	paddedBlock, err := c.padBlockWithScheme(encodedBlock, padding)
+	if err != nil {
+		return -1, EncryptedBlock{}, err
+	}
+
+	encryptedData, err := c.encryptDataAESGCM(
+		paddedBlock, key.Data(), blockAdditionalData(tlfID))
+	if err != nil {
+		return -1, EncryptedBlock{}, err
+	}
+
+	plainSize = len(encodedBlock)
+	encryptedBlock = EncryptedBlock{encryptedData}
+	return plainSize, encryptedBlock, nil
+}
+
 // DecryptBlock implements the Crypto interface for CryptoCommon.
 func (c CryptoCommon) DecryptBlock(
-	encryptedBlock EncryptedBlock, key kbfscrypto.BlockCryptKey,
-	block Block) error {
-	paddedBlock, err := c.decryptData(
-		encryptedBlock.encryptedData, key.Data())
+	encryptedBlock EncryptedBlock, tlfID tlf.ID,
+	key kbfscrypto.BlockCryptKey, block Block) error {
+	var paddedBlock []byte
+	var err error
+	switch encryptedBlock.Version {
+	case EncryptionAESGCM:
+		paddedBlock, err = c.decryptDataAESGCM(
+			encryptedBlock.encryptedData, key.Data(),
+			blockAdditionalData(tlfID))
+	default:
+		paddedBlock, err = c.decryptData(
+			encryptedBlock.encryptedData, key.Data())
+	}
 	if err != nil {
 		return err
 	}
@@ -16,6 +16,7 @@ import (
 	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/kbfs/kbfscodec"
 	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/tlf"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -116,11 +117,35 @@ func TestCryptoCommonEncryptDecryptBlock(t *testing.T) {
 	require.NoError(t, err)
 
 	var decryptedBlock TestBlock
-	err = c.DecryptBlock(encryptedBlock, key, &decryptedBlock)
+	err = c.DecryptBlock(
+		encryptedBlock, tlf.FakeID(1, tlf.Private), key, &decryptedBlock)
 	require.NoError(t, err)
 	require.Equal(t, block, decryptedBlock)
 }
 
+func TestCryptoCommonEncryptDecryptBlockAEAD(t *testing.T) {
+	c := MakeCryptoCommon(kbfscodec.NewMsgpack())
+
+	block := TestBlock{42}
+	key := makeFakeBlockCryptKey(t)
+	tlfID := tlf.FakeID(1, tlf.Private)
+
+	_, encryptedBlock, err := c.EncryptBlockAEAD(
+		&block, tlfID, key, BlockPaddingPadme)
+	require.NoError(t, err)
+	require.Equal(t, EncryptionAESGCM, encryptedBlock.Version)
+
+	var decryptedBlock TestBlock
+	err = c.DecryptBlock(encryptedBlock, tlfID, key, &decryptedBlock)
+	require.NoError(t, err)
+	require.Equal(t, block, decryptedBlock)
+
+	// A block moved to another TLF must fail to decrypt.
+	err = c.DecryptBlock(
+		encryptedBlock, tlf.FakeID(2, tlf.Private), key, &decryptedBlock)
+	require.Equal(t, libkb.DecryptionError{}, errors.Cause(err))
+}
+
 // Test that crypto.EncryptTLFCryptKeyClientHalf() encrypts its
 // passed-in client half properly.
 func TestCryptoCommonEncryptTLFCryptKeyClientHalf(t *testing.T) {
@@ -274,7 +299,7 @@ func checkDecryptionFailures(
 	// Wrong version.
 
 	encryptedDataWrongVersion := encryptedData
-	encryptedDataWrongVersion.Version++
+	encryptedDataWrongVersion.Version = EncryptionAESGCM + 1
 	err := decryptFn(encryptedDataWrongVersion, key)
 	assert.Equal(t,
 		UnknownEncryptionVer{encryptedDataWrongVersion.Version},
@@ -381,7 +406,9 @@ func TestDecryptBlockSecretboxSeal(t *testing.T) {
 	encryptedBlock := EncryptedBlock{secretboxSealEncoded(t, &c, paddedBlock, cryptKey.Data())}
 
 	var decryptedBlock TestBlock
-	err = c.DecryptBlock(encryptedBlock, cryptKey, &decryptedBlock)
+	err = c.DecryptBlock(
+		encryptedBlock, tlf.FakeID(1, tlf.Private), cryptKey,
+		&decryptedBlock)
 	require.NoError(t, err)
 	require.Equal(t, block, decryptedBlock)
 }
@@ -399,7 +426,9 @@ func TestDecryptEncryptedBlock(t *testing.T) {
 	require.NoError(t, err)
 
 	var decryptedBlock TestBlock
-	err = c.DecryptBlock(encryptedBlock, cryptKey, &decryptedBlock)
+	err = c.DecryptBlock(
+		encryptedBlock, tlf.FakeID(1, tlf.Private), cryptKey,
+		&decryptedBlock)
 	require.NoError(t, err)
 	require.Equal(t, block, decryptedBlock)
 }
@@ -420,6 +449,38 @@ func TestDecryptBlockFailures(t *testing.T) {
 			var dummy TestBlock
 			return c.DecryptBlock(
 				EncryptedBlock{encryptedData},
+				tlf.FakeID(1, tlf.Private),
+				key.(kbfscrypto.BlockCryptKey), &dummy)
+		},
+		func(key interface{}) interface{} {
+			cryptKey := key.(kbfscrypto.BlockCryptKey)
+			cryptKeyCorruptData := cryptKey.Data()
+			cryptKeyCorruptData[0] = ^cryptKeyCorruptData[0]
+			cryptKeyCorrupt := kbfscrypto.MakeBlockCryptKey(
+				cryptKeyCorruptData)
+			return cryptKeyCorrupt
+		})
+}
+
+// Test various failure cases for crypto.DecryptBlock() with
+// AES-GCM-encrypted blocks.
+func TestDecryptBlockAEADFailures(t *testing.T) {
+	c := MakeCryptoCommon(kbfscodec.NewMsgpack())
+
+	cryptKey := makeFakeBlockCryptKey(t)
+	tlfID := tlf.FakeID(1, tlf.Private)
+
+	block := TestBlock{50}
+
+	_, encryptedBlock, err := c.EncryptBlockAEAD(
+		&block, tlfID, cryptKey, BlockPaddingPadme)
+	require.NoError(t, err)
+
+	checkDecryptionFailures(t, encryptedBlock.encryptedData, cryptKey,
+		func(encryptedData encryptedData, key interface{}) error {
+			var dummy TestBlock
+			return c.DecryptBlock(
+				EncryptedBlock{encryptedData}, tlfID,
 				key.(kbfscrypto.BlockCryptKey), &dummy)
 		},
 		func(key interface{}) interface{} {
@@ -484,6 +545,49 @@ func TestBlockDepadding(t *testing.T) {
 	require.NoError(t, err)
 }
 
+// Test that Padmé padding results in a larger block that leaks
+// few bits of the length, with bounded overhead.
+func TestBlockPaddingPadme(t *testing.T) {
+	var c CryptoCommon
+	f := func(b []byte, extra uint16) bool {
+		// Make sure lengths above minBlockSize get exercised.
+		b = append(b, make([]byte, int(extra))...)
+		padded, err := c.padBlockWithScheme(b, BlockPaddingPadme)
+		if err != nil {
+			t.Logf("padBlockWithScheme err: %s", err)
+			return false
+		}
+		// len of slice without uint32 prefix:
+		h := len(padded) - padPrefixSize
+		if h < len(b) || h < minBlockSize {
+			t.Logf("padded len %d too small for input len %d",
+				h, len(b))
+			return false
+		}
+		if len(b) > minBlockSize && h-len(b) > len(b)/8 {
+			t.Logf("padded len %d has too much overhead for "+
+				"input len %d", h, len(b))
+			return false
+		}
+		depadded, err := c.depadBlock(padded)
+		if err != nil {
+			t.Logf("depadBlock err: %s", err)
+			return false
+		}
+		return bytes.Equal(b, depadded)
+	}
+
+	err := quick.Check(f, nil)
+	require.NoError(t, err)
+
+	// Spot-check a few lengths.
+	require.Equal(t, minBlockSize, padmeLength(0))
+	require.Equal(t, minBlockSize, padmeLength(minBlockSize))
+	require.Equal(t, 272, padmeLength(257))
+	require.Equal(t, 1<<20, padmeLength(1<<20))
+	require.Equal(t, 1<<20+1<<15, padmeLength(1<<20+1))
+}
+
 // Test padding of blocks results in blocks at least 2^8.
 func TestBlockPadMinimum(t *testing.T) {
 	var c CryptoCommon
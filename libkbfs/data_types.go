@@ -7,6 +7,7 @@ package libkbfs
 import (
 	"encoding/hex"
 	"fmt"
+	"os"
 	"reflect"
 	"strings"
 	"time"
@@ -80,17 +81,57 @@ const (
 	// EncryptionSecretbox is the encryption version that uses
 	// nacl/secretbox or nacl/box.
 	EncryptionSecretbox EncryptionVer = 1
+	// EncryptionAESGCM is the encryption version that uses
+	// AES-256-GCM, binding the TLF ID as associated data.  It is
+	// only used for blocks, which are padded according to a
+	// BlockPadding scheme.
+	EncryptionAESGCM EncryptionVer = 2
+
+	// Keep using secretbox for new blocks by default, until enough
+	// clients can read EncryptionAESGCM blocks.
+	defaultClientBlockCryptVer EncryptionVer = EncryptionSecretbox
 )
 
 func (v EncryptionVer) String() string {
 	switch v {
 	case EncryptionSecretbox:
 		return "EncryptionSecretbox"
+	case EncryptionAESGCM:
+		return "EncryptionAESGCM"
 	default:
 		return fmt.Sprintf("EncryptionVer(%d)", v)
 	}
 }
 
+// BlockPadding denotes the scheme used to pad encoded blocks before
+// they are encrypted, to hide their exact sizes.  The padded format
+// is the same for all schemes, so it doesn't need to be recorded
+// with the block.
+type BlockPadding int
+
+const (
+	// BlockPaddingPowerOfTwo pads each block up to the next power
+	// of two, which can waste up to half of each block.
+	BlockPaddingPowerOfTwo BlockPadding = 1
+	// BlockPaddingPadme pads each block using the Padmé scheme,
+	// which leaks only O(log log n) bits of the size of an n-byte
+	// block, with an overhead of at most about 12%.
+	BlockPaddingPadme BlockPadding = 2
+
+	defaultClientBlockPadding BlockPadding = BlockPaddingPadme
+)
+
+func (p BlockPadding) String() string {
+	switch p {
+	case BlockPaddingPowerOfTwo:
+		return "BlockPaddingPowerOfTwo"
+	case BlockPaddingPadme:
+		return "BlockPaddingPadme"
+	default:
+		return fmt.Sprintf("BlockPadding(%d)", p)
+	}
+}
+
 // encryptedData is encrypted data with a nonce and a version.
 type encryptedData struct {
 	// Exported only for serialization purposes. Should only be
@@ -183,6 +224,47 @@ const (
 	defaultClientMetadataVer MetadataVer = SegregatedKeyBundlesVer
 )
 
+// OpsVer is the version of the ops a client writes into new MD
+// revisions.  Older clients silently misapply ops they don't
+// understand, rather than refusing them, so an op that needs a
+// newer OpsVer is only written once the user has said that every
+// device using their folders understands it.
+type OpsVer int
+
+const (
+	// FirstValidOpsVer covers the ops that every client
+	// understands.
+	FirstValidOpsVer OpsVer = 1
+	// RenameExchangeOpsVer is the first ops version that allows
+	// renameOps exchanging two entries.
+	RenameExchangeOpsVer OpsVer = 2
+	// ModeAttrOpsVer is the first ops version that allows
+	// setAttrOps changing the permission bits or read-only flag
+	// of an entry.
+	ModeAttrOpsVer OpsVer = 3
+	// ImmutableOpsVer is the first ops version that allows making
+	// a folder immutable.  Older clients ignore the flag, and would
+	// keep overwriting and removing its data.
+	ImmutableOpsVer OpsVer = 4
+
+	defaultClientOpsVer OpsVer = FirstValidOpsVer
+)
+
+func (v OpsVer) String() string {
+	switch v {
+	case FirstValidOpsVer:
+		return "OpsVer(FirstValid)"
+	case RenameExchangeOpsVer:
+		return "OpsVer(RenameExchange)"
+	case ModeAttrOpsVer:
+		return "OpsVer(ModeAttr)"
+	case ImmutableOpsVer:
+		return "OpsVer(Immutable)"
+	default:
+		return fmt.Sprintf("OpsVer(%d)", v)
+	}
+}
+
 func (v MetadataVer) String() string {
 	switch v {
 	case FirstValidMetadataVer:
@@ -231,6 +313,8 @@ func (v MetadataVer) String() string {
 // one indirect pointer with an indirect DirectType [although if it
 // holds for one, it should hold for all], and all of its indirect
 // pointers must have DataVer 3, by c).
+// e) Any block encrypted with EncryptionAESGCM is v4 instead, whatever
+// a) through d) would otherwise require.
 type DataVer int
 
 const (
@@ -245,6 +329,11 @@ const (
 	// blocks that have multiple levels of indirection below them
 	// (i.e., indirect blocks that point to other indirect blocks).
 	AtLeastTwoLevelsOfChildrenDataVer DataVer = 3
+	// AEADEncryptionDataVer is the data version for blocks
+	// encrypted with EncryptionAESGCM, regardless of their
+	// structure.  Older clients will refuse to read them with a
+	// NewDataVersionError, rather than failing to decrypt them.
+	AEADEncryptionDataVer DataVer = 4
 )
 
 // BlockRef is a block ID/ref nonce pair, which defines a unique
@@ -372,6 +461,8 @@ type ReadyBlockData struct {
 	// These fields should not be used outside of putBlockToServer.
 	buf        []byte
 	serverHalf kbfscrypto.BlockCryptKeyServerHalf
+	// encryptionVer is the version the block was encrypted with.
+	encryptionVer EncryptionVer
 }
 
 // GetEncodedSize returns the size of the encoded (and encrypted)
@@ -609,6 +700,37 @@ func (o Excl) String() string {
 	}
 }
 
+// RenameFlags modify the behavior of a rename, like the flags of the
+// renameat2 system call.
+type RenameFlags uint8
+
+const (
+	// RenameFlagsNone indicates a plain rename, which replaces any
+	// existing entry with the new name.
+	RenameFlagsNone RenameFlags = 0
+
+	// RenameNoReplace indicates the rename must fail if an entry
+	// with the new name already exists.
+	RenameNoReplace RenameFlags = 1
+
+	// RenameExchange indicates the old and new entries, which must
+	// both exist, should be swapped atomically.
+	RenameExchange RenameFlags = 2
+)
+
+func (f RenameFlags) String() string {
+	switch f {
+	case RenameFlagsNone:
+		return "none"
+	case RenameNoReplace:
+		return "noreplace"
+	case RenameExchange:
+		return "exchange"
+	default:
+		return fmt.Sprintf("<invalid RenameFlags %d>", uint8(f))
+	}
+}
+
 // EntryInfo is the (non-block-related) info a directory knows about
 // its child.
 //
@@ -623,6 +745,80 @@ type EntryInfo struct {
 	Mtime int64
 	// Ctime is in unix nanoseconds
 	Ctime int64
+	// Mode holds explicitly-set permission bits and flags.
+	Mode EntryMode `codec:",omitempty"`
+}
+
+// EntryMode holds the POSIX permission bits and flags of a directory
+// entry.  Entries whose permissions have never been set explicitly
+// have no permission bits in their mode, and use the defaults for
+// their type instead.
+type EntryMode uint32
+
+const (
+	// EntryModePerm covers the POSIX permission bits of an EntryMode.
+	EntryModePerm EntryMode = 0777
+
+	// EntryModePermSet indicates that the permission bits of an
+	// EntryMode have been set explicitly.
+	EntryModePermSet EntryMode = 1 << 16
+
+	// EntryModeReadOnly marks an entry that can't be written to,
+	// removed, renamed, or (for a directory) have its children
+	// changed, until the flag is cleared.
+	EntryModeReadOnly EntryMode = 1 << 17
+)
+
+// IsPermSet returns whether the permission bits of m have been set
+// explicitly.
+func (m EntryMode) IsPermSet() bool {
+	return m&EntryModePermSet != 0
+}
+
+// IsReadOnly returns whether m marks its entry as read-only.
+func (m EntryMode) IsReadOnly() bool {
+	return m&EntryModeReadOnly != 0
+}
+
+// Perm returns the permission bits for an entry of type t with mode
+// m.  For files, the user-executable bit always follows whether t is
+// Exec.
+func (m EntryMode) Perm(t EntryType) os.FileMode {
+	if !m.IsPermSet() {
+		switch t {
+		case Dir, Exec:
+			return 0700
+		case Sym:
+			return 0777
+		default:
+			return 0600
+		}
+	}
+	perm := os.FileMode(m & EntryModePerm)
+	switch t {
+	case Exec:
+		perm |= 0100
+	case File:
+		perm &^= 0100
+	}
+	return perm
+}
+
+// WithPerm returns a copy of m with the given permission bits set
+// explicitly.
+func (m EntryMode) WithPerm(perm os.FileMode) EntryMode {
+	return m&^EntryModePerm | EntryMode(perm.Perm()) | EntryModePermSet
+}
+
+func (m EntryMode) String() string {
+	perm := "default"
+	if m.IsPermSet() {
+		perm = fmt.Sprintf("%#o", uint32(m&EntryModePerm))
+	}
+	if m.IsReadOnly() {
+		return perm + ",readonly"
+	}
+	return perm
 }
 
 // ReportedError represents an error reported by KBFS.
@@ -660,7 +856,11 @@ func (m MergeStatus) String() string {
 // OpSummary describes the changes performed by a single op, and is
 // suitable for encoding directly as JSON.
 type OpSummary struct {
-	Op      string
+	Op   string
+	Type string
+	// Path is the path affected by the op, relative to the TLF
+	// root, if known.
+	Path    string
 	Refs    []string
 	Unrefs  []string
 	Updates map[string]string
@@ -668,11 +868,14 @@ type OpSummary struct {
 
 // UpdateSummary describes the operations done by a single MD revision.
 type UpdateSummary struct {
-	Revision  kbfsmd.Revision
-	Date      time.Time
-	Writer    string
-	LiveBytes uint64 // the "DiskUsage" for the TLF as of this revision
-	Ops       []OpSummary
+	Revision kbfsmd.Revision
+	Date     time.Time
+	// ServerTime is when the MD server accepted the update,
+	// adjusted for the local clock.
+	ServerTime time.Time
+	Writer     string
+	LiveBytes  uint64 // the "DiskUsage" for the TLF as of this revision
+	Ops        []OpSummary
 }
 
 // TLFUpdateHistory gives all the summaries of all updates in a TLF's
@@ -0,0 +1,244 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/keybase/kbfs/kbfsblock"
+	"golang.org/x/net/context"
+)
+
+// DirUsage describes the disk usage of a directory, including the
+// directory itself and everything under it.  Each unique block is
+// counted only once, by its encoded size.  Blocks that haven't been
+// synced yet don't have an encoded size, and so don't contribute to
+// Bytes.  Files and Dirs count all the files and subdirectories
+// under the directory, at any depth.
+type DirUsage struct {
+	Bytes  uint64
+	Blocks int
+	Files  int
+	Dirs   int
+}
+
+// dirUsageEntry is the cached usage of a single directory.  Only
+// aggregate totals are kept, so the usage of a parent directory can
+// be summed from those of its children; they count every block
+// reference, not every unique block.  A block can only be referenced
+// more than once if some reference to it has a non-zero ref nonce,
+// so those are counted too, and the unique blocks of a directory
+// with any of them are found on demand instead.
+type dirUsageEntry struct {
+	usage      DirUsage
+	sharedRefs int
+}
+
+// dirUsageCacheCapacity is the maximum number of directories whose
+// usage is cached per TLF.
+const dirUsageCacheCapacity = 1000
+
+// dirUsageCache computes and caches the disk usage of the
+// directories in a TLF.  Entries are keyed by the block pointer of
+// the directory, which changes whenever anything under it is synced,
+// but they are also dropped eagerly from BatchChanges, since dirty
+// changes keep the same pointers.  Entries for pointers that have
+// been superseded eventually fall out of the LRU.
+type dirUsageCache struct {
+	fbo     *folderBranchOps
+	entries *lru.Cache
+}
+
+var _ Observer = (*dirUsageCache)(nil)
+
+func newDirUsageCache(fbo *folderBranchOps) *dirUsageCache {
+	entries, err := lru.New(dirUsageCacheCapacity)
+	if err != nil {
+		panic(err.Error())
+	}
+	return &dirUsageCache{
+		fbo:     fbo,
+		entries: entries,
+	}
+}
+
+func (duc *dirUsageCache) get(ptr BlockPointer) *dirUsageEntry {
+	if entry, ok := duc.entries.Get(ptr); ok {
+		return entry.(*dirUsageEntry)
+	}
+	return nil
+}
+
+// invalidatePath drops the cached usage of every directory along the
+// given path, since all of their totals include the tail.
+func (duc *dirUsageCache) invalidatePath(p path) {
+	for _, pn := range p.path {
+		duc.entries.Remove(pn.BlockPointer)
+	}
+}
+
+// forEachFileBlock calls `f` with each block of the file at the given
+// path.
+func (duc *dirUsageCache) forEachFileBlock(ctx context.Context,
+	lState *lockState, kmd KeyMetadata, file path, de DirEntry,
+	f func(ptr BlockPointer, encodedSize uint32)) error {
+	f(de.BlockPointer, de.EncodedSize)
+	infos, err := duc.fbo.blocks.GetIndirectFileBlockInfos(
+		ctx, lState, kmd, file)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		f(info.BlockPointer, info.EncodedSize)
+	}
+	return nil
+}
+
+// compute returns the totals of the directory at the given path,
+// whose own block has the given encoded size, using and filling in
+// the cached totals of each directory in its subtree.
+func (duc *dirUsageCache) compute(ctx context.Context,
+	lState *lockState, kmd KeyMetadata, dir path, encodedSize uint32) (
+	*dirUsageEntry, error) {
+	ptr := dir.tailPointer()
+	if entry := duc.get(ptr); entry != nil {
+		return entry, nil
+	}
+
+	dblock, err := duc.fbo.blocks.GetDirBlockForReading(
+		ctx, lState, kmd, ptr, dir.Branch, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &dirUsageEntry{}
+	addRef := func(ptr BlockPointer, encodedSize uint32) {
+		entry.usage.Bytes += uint64(encodedSize)
+		entry.usage.Blocks++
+		if ptr.RefNonce != kbfsblock.ZeroRefNonce {
+			entry.sharedRefs++
+		}
+	}
+	addRef(ptr, encodedSize)
+	for name, de := range dblock.Children {
+		childPath := dir.ChildPath(name, de.BlockPointer)
+		switch de.Type {
+		case Sym:
+			continue
+		case Dir:
+			childEntry, err := duc.compute(
+				ctx, lState, kmd, childPath, de.EncodedSize)
+			if err != nil {
+				return nil, err
+			}
+			entry.usage.Bytes += childEntry.usage.Bytes
+			entry.usage.Blocks += childEntry.usage.Blocks
+			entry.usage.Files += childEntry.usage.Files
+			entry.usage.Dirs += childEntry.usage.Dirs + 1
+			entry.sharedRefs += childEntry.sharedRefs
+		default:
+			err := duc.forEachFileBlock(
+				ctx, lState, kmd, childPath, de, addRef)
+			if err != nil {
+				return nil, err
+			}
+			entry.usage.Files++
+		}
+	}
+
+	duc.entries.Add(ptr, entry)
+	return entry, nil
+}
+
+// collectBlocks adds the unique blocks of the subtree at the given
+// path to `blocks`, without using the cache.
+func (duc *dirUsageCache) collectBlocks(ctx context.Context,
+	lState *lockState, kmd KeyMetadata, dir path, encodedSize uint32,
+	blocks map[kbfsblock.ID]uint32) error {
+	ptr := dir.tailPointer()
+	blocks[ptr.ID] = encodedSize
+	dblock, err := duc.fbo.blocks.GetDirBlockForReading(
+		ctx, lState, kmd, ptr, dir.Branch, dir)
+	if err != nil {
+		return err
+	}
+
+	addBlock := func(ptr BlockPointer, encodedSize uint32) {
+		blocks[ptr.ID] = encodedSize
+	}
+	for name, de := range dblock.Children {
+		childPath := dir.ChildPath(name, de.BlockPointer)
+		switch de.Type {
+		case Sym:
+			continue
+		case Dir:
+			err := duc.collectBlocks(
+				ctx, lState, kmd, childPath, de.EncodedSize, blocks)
+			if err != nil {
+				return err
+			}
+		default:
+			err := duc.forEachFileBlock(
+				ctx, lState, kmd, childPath, de, addBlock)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// usage returns the usage of the directory at the given path, whose
+// own block has the given encoded size.  Only if its subtree has
+// shared block references are its unique blocks collected, and then
+// only for as long as the call takes.
+func (duc *dirUsageCache) usage(ctx context.Context,
+	lState *lockState, kmd KeyMetadata, dir path, encodedSize uint32) (
+	DirUsage, error) {
+	entry, err := duc.compute(ctx, lState, kmd, dir, encodedSize)
+	if err != nil {
+		return DirUsage{}, err
+	}
+	if entry.sharedRefs == 0 {
+		return entry.usage, nil
+	}
+
+	blocks := make(map[kbfsblock.ID]uint32)
+	err = duc.collectBlocks(ctx, lState, kmd, dir, encodedSize, blocks)
+	if err != nil {
+		return DirUsage{}, err
+	}
+	usage := entry.usage
+	usage.Bytes = 0
+	for _, size := range blocks {
+		usage.Bytes += uint64(size)
+	}
+	usage.Blocks = len(blocks)
+	return usage, nil
+}
+
+// LocalChange implements the Observer interface for dirUsageCache.
+func (duc *dirUsageCache) LocalChange(
+	ctx context.Context, node Node, write WriteRange) {
+	// Unsynced writes don't change any encoded sizes, and the sync
+	// will be reported in a batch.
+}
+
+// BatchChanges implements the Observer interface for dirUsageCache.
+func (duc *dirUsageCache) BatchChanges(
+	ctx context.Context, changes []NodeChange) {
+	if duc.entries.Len() == 0 {
+		return
+	}
+	for _, change := range changes {
+		duc.invalidatePath(duc.fbo.nodeCache.PathFromNode(change.Node))
+	}
+}
+
+// TlfHandleChange implements the Observer interface for
+// dirUsageCache.
+func (duc *dirUsageCache) TlfHandleChange(
+	ctx context.Context, newHandle *TlfHandle) {
+	// Nothing to do.
+}
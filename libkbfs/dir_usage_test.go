@@ -0,0 +1,100 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDirUsage(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "u1")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	fb := rootNode.GetFolderBranch()
+	kbfsOps := config.KBFSOps()
+
+	dirA, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	fileB, _, err := kbfsOps.CreateFile(ctx, dirA, "b", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileB, []byte("hello"), 0)
+	require.NoError(t, err)
+	dirC, _, err := kbfsOps.CreateDir(ctx, dirA, "c")
+	require.NoError(t, err)
+	dirE, _, err := kbfsOps.CreateDir(ctx, rootNode, "e")
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateFile(ctx, dirE, "f", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	checkRootUsage := func() {
+		usage, err := kbfsOps.GetDirUsage(ctx, rootNode)
+		require.NoError(t, err)
+		md, err := config.MDOps().GetForTLF(ctx, fb.Tlf)
+		require.NoError(t, err)
+		require.Equal(t, md.DiskUsage(), usage.Bytes)
+	}
+
+	checkRootUsage()
+	usage, err := kbfsOps.GetDirUsage(ctx, dirA)
+	require.NoError(t, err)
+	require.Equal(t, 1, usage.Files)
+	require.Equal(t, 1, usage.Dirs)
+	require.Equal(t, 3, usage.Blocks)
+
+	usage, err = kbfsOps.GetDirUsage(ctx, dirC)
+	require.NoError(t, err)
+	require.Equal(t, DirUsage{Bytes: usage.Bytes, Blocks: 1}, usage)
+
+	_, err = kbfsOps.GetDirUsage(ctx, fileB)
+	require.IsType(t, NotDirError{}, err)
+
+	t.Log("Changing one directory invalidates only it and its parents")
+	ops := getOps(config, fb.Tlf)
+	pathE, err := ops.pathFromNodeForRead(dirE)
+	require.NoError(t, err)
+	require.NotNil(t, ops.dirUsage.get(pathE.tailPointer()))
+	pathA, err := ops.pathFromNodeForRead(dirA)
+	require.NoError(t, err)
+	require.NotNil(t, ops.dirUsage.get(pathA.tailPointer()))
+
+	fileG, _, err := kbfsOps.CreateFile(ctx, dirC, "g", false, NoExcl)
+	require.NoError(t, err)
+	require.Nil(t, ops.dirUsage.get(pathA.tailPointer()))
+	require.NotNil(t, ops.dirUsage.get(pathE.tailPointer()))
+	err = kbfsOps.Write(ctx, fileG, []byte("world"), 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	checkRootUsage()
+	usage, err = kbfsOps.GetDirUsage(ctx, dirA)
+	require.NoError(t, err)
+	require.Equal(t, 2, usage.Files)
+	require.Equal(t, 1, usage.Dirs)
+	require.Equal(t, 4, usage.Blocks)
+
+	t.Log("A copy shares its block with the original, so it's " +
+		"only counted once")
+	_, err = kbfsOps.CopyFile(ctx, fileB, dirA, "b2")
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	usage, err = kbfsOps.GetDirUsage(ctx, dirA)
+	require.NoError(t, err)
+	require.Equal(t, 3, usage.Files)
+	require.Equal(t, 4, usage.Blocks)
+	pathA, err = ops.pathFromNodeForRead(dirA)
+	require.NoError(t, err)
+	entry := ops.dirUsage.get(pathA.tailPointer())
+	require.NotNil(t, entry)
+	require.Equal(t, 1, entry.sharedRefs)
+	require.Equal(t, 5, entry.usage.Blocks)
+}
@@ -294,6 +294,20 @@ func (df *dirtyFile) finishSync() error {
 	return nil
 }
 
+// dirtyPointers returns the pointers of all the file's blocks that
+// have dirty copies in the dirty block cache.
+func (df *dirtyFile) dirtyPointers() []BlockPointer {
+	df.lock.Lock()
+	defer df.lock.Unlock()
+	var ptrs []BlockPointer
+	for ptr, state := range df.fileBlockStates {
+		if state.copy == blockAlreadyCopied && !state.orphaned {
+			ptrs = append(ptrs, ptr)
+		}
+	}
+	return ptrs
+}
+
 func (df *dirtyFile) addErrListener(listener chan<- error) {
 	df.lock.Lock()
 	defer df.lock.Unlock()
@@ -0,0 +1,571 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"golang.org/x/net/context"
+)
+
+const (
+	diskMDCacheDbFilename = "diskCacheMD.leveldb"
+	diskMDCacheVersion    = 1
+	// Key prefixes within the leveldb.
+	diskMDCacheLocalKeyKey    = "l"
+	diskMDCacheHeadPrefix     = "m"
+	diskMDCacheHandlePrefix   = "h"
+	diskMDCacheCryptKeyPrefix = "c"
+)
+
+var diskMDCacheHandleMACDeriving = []byte("KBFS disk MD cache handle MAC")
+
+func diskMDCacheRootFromStorageRoot(storageRoot string) string {
+	return filepath.Join(storageRoot, "kbfs_md_cache")
+}
+
+// diskMDCacheConfig specifies the interfaces that a
+// DiskMDCacheStandard needs to perform its functions. This adheres to
+// the standard libkbfs Config API.
+type diskMDCacheConfig interface {
+	codecGetter
+	logMaker
+	cryptoGetter
+	currentSessionGetterGetter
+}
+
+// diskMDCacheLocalKey is the key that all the entries of the cache
+// are encrypted with, itself encrypted for the crypt key of the
+// device that created it, the same way TLF crypt key client halves
+// are.  So only that device, with the help of the local keybase
+// service, can read the cache.
+type diskMDCacheLocalKey struct {
+	Version        int                              `codec:"v"`
+	CryptPublicKey kbfscrypto.CryptPublicKey        `codec:"k"`
+	EPubKey        kbfscrypto.TLFEphemeralPublicKey `codec:"e"`
+	ClientHalf     EncryptedTLFCryptKeyClientHalf   `codec:"c"`
+}
+
+// diskMDCacheHead is a verified merged MD head, as stored in the
+// cache.
+type diskMDCacheHead struct {
+	TlfID          tlf.ID                  `codec:"t"`
+	Version        MetadataVer             `codec:"v"`
+	MD             []byte                  `codec:"m"`
+	WKB            *TLFWriterKeyBundleV3   `codec:"w,omitempty"`
+	RKB            *TLFReaderKeyBundleV3   `codec:"r,omitempty"`
+	MdID           kbfsmd.ID               `codec:"i"`
+	WriterKey      kbfscrypto.VerifyingKey `codec:"k"`
+	LocalTimestamp int64                   `codec:"ts"`
+}
+
+// diskMDCacheHeadEntry is the value stored under a head key.  The
+// revision is kept outside of the encrypted part, so that older heads
+// can be skipped without decrypting anything.
+type diskMDCacheHeadEntry struct {
+	Revision kbfsmd.Revision `codec:"r"`
+	Head     encryptedData   `codec:"h"`
+}
+
+// DiskMDCacheStandard is the standard implementation of DiskMDCache.
+// It keeps the latest verified merged head of every TLF this device
+// has read, and the TLF crypt keys it has unwrapped, in a leveldb
+// under the storage root.  All entries are encrypted with a local key
+// that only this device can unwrap, so another user logging into the
+// same storage root causes the cache to be wiped.
+type DiskMDCacheStandard struct {
+	config diskMDCacheConfig
+	log    logger.Logger
+	crypto CryptoCommon
+
+	// Protects all the fields below.  After Shutdown is called, db
+	// is nil.
+	lock sync.Mutex
+	db   *leveldb.DB
+	// The local key, and the device it's encrypted for, once it
+	// has been unwrapped.
+	localKey     *kbfscrypto.TLFCryptKey
+	localKeyFor  kbfscrypto.CryptPublicKey
+	handleMACKey []byte
+}
+
+var _ DiskMDCache = (*DiskMDCacheStandard)(nil)
+
+// newDiskMDCacheStandardFromStorage creates a new
+// *DiskMDCacheStandard with the passed-in storage.Storage as its
+// storage layer.
+func newDiskMDCacheStandardFromStorage(
+	config diskMDCacheConfig, stor storage.Storage) (
+	*DiskMDCacheStandard, error) {
+	db, err := openLevelDB(stor)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &DiskMDCacheStandard{
+		config: config,
+		log:    config.MakeLogger("DMC"),
+		crypto: MakeCryptoCommon(config.Codec()),
+		db:     db,
+	}, nil
+}
+
+// newDiskMDCacheStandard creates a new *DiskMDCacheStandard with a
+// specified directory on the filesystem as storage.
+func newDiskMDCacheStandard(config diskMDCacheConfig, dirPath string) (
+	*DiskMDCacheStandard, error) {
+	dbPath := filepath.Join(
+		versionPathFromVersion(dirPath, diskMDCacheVersion),
+		diskMDCacheDbFilename)
+	stor, err := storage.OpenFile(dbPath, false)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	cache, err := newDiskMDCacheStandardFromStorage(config, stor)
+	if err != nil {
+		stor.Close()
+		return nil, err
+	}
+	return cache, nil
+}
+
+func (cache *DiskMDCacheStandard) getLocked(key []byte) ([]byte, error) {
+	if cache.db == nil {
+		return nil, errors.WithStack(DiskCacheClosedError{"Get"})
+	}
+	buf, err := cache.db.Get(key, nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return buf, nil
+}
+
+// wipeLocked deletes every entry from the cache.
+func (cache *DiskMDCacheStandard) wipeLocked() error {
+	return cache.deletePrefixLocked(nil)
+}
+
+// deletePrefixLocked deletes every entry whose key starts with the
+// given prefix.
+func (cache *DiskMDCacheStandard) deletePrefixLocked(prefix []byte) error {
+	iter := cache.db.NewIterator(util.BytesPrefix(prefix), nil)
+	defer iter.Release()
+	var batch leveldb.Batch
+	for iter.Next() {
+		batch.Delete(append([]byte(nil), iter.Key()...))
+	}
+	if err := iter.Error(); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(cache.db.Write(&batch, nil))
+}
+
+// makeLocalKeyLocked makes a new local key encrypted for the given
+// device, and wipes all the entries encrypted with the old one.
+func (cache *DiskMDCacheStandard) makeLocalKeyLocked(
+	ctx context.Context, cryptPublicKey kbfscrypto.CryptPublicKey) (
+	kbfscrypto.TLFCryptKey, error) {
+	var data [32]byte
+	err := kbfscrypto.RandRead(data[:])
+	if err != nil {
+		return kbfscrypto.TLFCryptKey{}, err
+	}
+	ePubKey, ePrivKey, err := cache.config.Crypto().MakeRandomTLFEphemeralKeys()
+	if err != nil {
+		return kbfscrypto.TLFCryptKey{}, err
+	}
+	clientHalf, err := cache.config.Crypto().EncryptTLFCryptKeyClientHalf(
+		ePrivKey, cryptPublicKey, kbfscrypto.MakeTLFCryptKeyClientHalf(data))
+	if err != nil {
+		return kbfscrypto.TLFCryptKey{}, err
+	}
+	buf, err := cache.config.Codec().Encode(diskMDCacheLocalKey{
+		Version:        diskMDCacheVersion,
+		CryptPublicKey: cryptPublicKey,
+		EPubKey:        ePubKey,
+		ClientHalf:     clientHalf,
+	})
+	if err != nil {
+		return kbfscrypto.TLFCryptKey{}, err
+	}
+
+	cache.log.CDebugf(ctx, "Making a new local key for the disk MD cache")
+	err = cache.wipeLocked()
+	if err != nil {
+		return kbfscrypto.TLFCryptKey{}, err
+	}
+	err = cache.db.Put([]byte(diskMDCacheLocalKeyKey), buf, nil)
+	if err != nil {
+		return kbfscrypto.TLFCryptKey{}, errors.WithStack(err)
+	}
+	return kbfscrypto.MakeTLFCryptKey(data), nil
+}
+
+// getLocalKeyLocked returns the local key, unwrapping it with the
+// current device's crypt key if needed, or making a new one if the
+// cache belongs to a different device.
+func (cache *DiskMDCacheStandard) getLocalKeyLocked(
+	ctx context.Context) (kbfscrypto.TLFCryptKey, error) {
+	session, err := cache.config.CurrentSessionGetter().GetCurrentSession(ctx)
+	if err != nil {
+		return kbfscrypto.TLFCryptKey{}, err
+	}
+	if cache.localKey != nil && cache.localKeyFor == session.CryptPublicKey {
+		return *cache.localKey, nil
+	}
+
+	buf, err := cache.getLocked([]byte(diskMDCacheLocalKeyKey))
+	if err != nil {
+		return kbfscrypto.TLFCryptKey{}, err
+	}
+	var key kbfscrypto.TLFCryptKey
+	var stored diskMDCacheLocalKey
+	if buf != nil {
+		err = cache.config.Codec().Decode(buf, &stored)
+		if err != nil {
+			return kbfscrypto.TLFCryptKey{}, err
+		}
+	}
+	if buf != nil && stored.Version == diskMDCacheVersion &&
+		stored.CryptPublicKey == session.CryptPublicKey {
+		clientHalf, err := cache.config.Crypto().DecryptTLFCryptKeyClientHalf(
+			ctx, stored.EPubKey, stored.ClientHalf)
+		if err != nil {
+			return kbfscrypto.TLFCryptKey{}, err
+		}
+		key = kbfscrypto.MakeTLFCryptKey(clientHalf.Data())
+	} else {
+		key, err = cache.makeLocalKeyLocked(ctx, session.CryptPublicKey)
+		if err != nil {
+			return kbfscrypto.TLFCryptKey{}, err
+		}
+	}
+
+	keyData := key.Data()
+	mac := hmac.New(sha256.New, keyData[:])
+	mac.Write(diskMDCacheHandleMACDeriving)
+	cache.handleMACKey = mac.Sum(nil)
+	cache.localKey = &key
+	cache.localKeyFor = session.CryptPublicKey
+	return key, nil
+}
+
+func (cache *DiskMDCacheStandard) encryptLocked(ctx context.Context,
+	obj interface{}, dbKey []byte) (encryptedData, error) {
+	key, err := cache.getLocalKeyLocked(ctx)
+	if err != nil {
+		return encryptedData{}, err
+	}
+	plain, err := cache.config.Codec().Encode(obj)
+	if err != nil {
+		return encryptedData{}, err
+	}
+	// Bind each entry to its key, so entries can't be swapped.
+	return cache.crypto.encryptDataAESGCM(plain, key.Data(), dbKey)
+}
+
+func (cache *DiskMDCacheStandard) decryptLocked(ctx context.Context,
+	ed encryptedData, dbKey []byte, objPtr interface{}) error {
+	key, err := cache.getLocalKeyLocked(ctx)
+	if err != nil {
+		return err
+	}
+	plain, err := cache.crypto.decryptDataAESGCM(ed, key.Data(), dbKey)
+	if err != nil {
+		return err
+	}
+	return cache.config.Codec().Decode(plain, objPtr)
+}
+
+func diskMDCacheHeadKey(tlfID tlf.ID) []byte {
+	return append([]byte(diskMDCacheHeadPrefix), tlfID.Bytes()...)
+}
+
+func (cache *DiskMDCacheStandard) handleKeyLocked(
+	ctx context.Context, handle *TlfHandle) ([]byte, error) {
+	// Make sure handleMACKey is set.
+	_, err := cache.getLocalKeyLocked(ctx)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, cache.handleMACKey)
+	mac.Write([]byte(handle.GetCanonicalPath()))
+	return mac.Sum([]byte(diskMDCacheHandlePrefix)), nil
+}
+
+func diskMDCacheCryptKeyKey(tlfID tlf.ID, keyGen KeyGen) []byte {
+	key := append([]byte(diskMDCacheCryptKeyPrefix), tlfID.Bytes()...)
+	var genBytes [8]byte
+	binary.BigEndian.PutUint64(genBytes[:], uint64(keyGen))
+	return append(key, genBytes[:]...)
+}
+
+func (cache *DiskMDCacheStandard) getHeadEntryLocked(tlfID tlf.ID) (
+	entry diskMDCacheHeadEntry, ok bool, err error) {
+	buf, err := cache.getLocked(diskMDCacheHeadKey(tlfID))
+	if err != nil || buf == nil {
+		return diskMDCacheHeadEntry{}, false, err
+	}
+	err = cache.config.Codec().Decode(buf, &entry)
+	if err != nil {
+		return diskMDCacheHeadEntry{}, false, err
+	}
+	return entry, true, nil
+}
+
+// GetHead implements the DiskMDCache interface for DiskMDCacheStandard.
+func (cache *DiskMDCacheStandard) GetHead(
+	ctx context.Context, tlfID tlf.ID) (
+	ImmutableBareRootMetadata, kbfscrypto.VerifyingKey, error) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	entry, ok, err := cache.getHeadEntryLocked(tlfID)
+	if err != nil || !ok {
+		return ImmutableBareRootMetadata{}, kbfscrypto.VerifyingKey{}, err
+	}
+
+	var head diskMDCacheHead
+	err = cache.decryptLocked(
+		ctx, entry.Head, diskMDCacheHeadKey(tlfID), &head)
+	if err != nil {
+		return ImmutableBareRootMetadata{}, kbfscrypto.VerifyingKey{}, err
+	}
+	if head.TlfID != tlfID {
+		return ImmutableBareRootMetadata{}, kbfscrypto.VerifyingKey{},
+			errors.Errorf("Cached head for %s is for %s", tlfID, head.TlfID)
+	}
+
+	brmd, err := DecodeRootMetadata(cache.config.Codec(), tlfID,
+		head.Version, SegregatedKeyBundlesVer, head.MD)
+	if err != nil {
+		return ImmutableBareRootMetadata{}, kbfscrypto.VerifyingKey{}, err
+	}
+	var extra ExtraMetadata
+	if head.WKB != nil && head.RKB != nil {
+		extra = NewExtraMetadataV3(*head.WKB, *head.RKB, false, false)
+	}
+	return MakeImmutableBareRootMetadata(brmd, extra, head.MdID,
+			time.Unix(0, head.LocalTimestamp)),
+		head.WriterKey, nil
+}
+
+// GetTlfID implements the DiskMDCache interface for DiskMDCacheStandard.
+func (cache *DiskMDCacheStandard) GetTlfID(
+	ctx context.Context, handle *TlfHandle) (tlf.ID, bool, error) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	key, err := cache.handleKeyLocked(ctx, handle)
+	if err != nil {
+		return tlf.ID{}, false, err
+	}
+	buf, err := cache.getLocked(key)
+	if err != nil || buf == nil {
+		return tlf.ID{}, false, err
+	}
+	var tlfID tlf.ID
+	err = tlfID.UnmarshalBinary(buf)
+	if err != nil {
+		return tlf.ID{}, false, err
+	}
+	return tlfID, true, nil
+}
+
+// PutHead implements the DiskMDCache interface for DiskMDCacheStandard.
+func (cache *DiskMDCacheStandard) PutHead(
+	ctx context.Context, irmd ImmutableRootMetadata) error {
+	if irmd.MergedStatus() != Merged {
+		return errors.Errorf(
+			"Can't cache unmerged revision %d", irmd.Revision())
+	}
+
+	tlfID := irmd.TlfID()
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	entry, ok, err := cache.getHeadEntryLocked(tlfID)
+	if err != nil {
+		return err
+	}
+	if ok && entry.Revision >= irmd.Revision() {
+		return nil
+	}
+
+	buf, err := cache.config.Codec().Encode(irmd.bareMd)
+	if err != nil {
+		return err
+	}
+	head := diskMDCacheHead{
+		TlfID:          tlfID,
+		Version:        irmd.Version(),
+		MD:             buf,
+		MdID:           irmd.MdID(),
+		WriterKey:      irmd.LastModifyingWriterVerifyingKey(),
+		LocalTimestamp: irmd.LocalTimestamp().UnixNano(),
+	}
+	if extraV3, ok := irmd.extra.(*ExtraMetadataV3); ok {
+		head.WKB = &extraV3.wkb
+		head.RKB = &extraV3.rkb
+	}
+
+	headKey := diskMDCacheHeadKey(tlfID)
+	ed, err := cache.encryptLocked(ctx, head, headKey)
+	if err != nil {
+		return err
+	}
+	buf, err = cache.config.Codec().Encode(
+		diskMDCacheHeadEntry{irmd.Revision(), ed})
+	if err != nil {
+		return err
+	}
+	handleKey, err := cache.handleKeyLocked(ctx, irmd.GetTlfHandle())
+	if err != nil {
+		return err
+	}
+
+	var batch leveldb.Batch
+	batch.Put(headKey, buf)
+	batch.Put(handleKey, tlfID.Bytes())
+	return errors.WithStack(cache.db.Write(&batch, nil))
+}
+
+// GetTLFCryptKey implements the DiskMDCache interface for
+// DiskMDCacheStandard.
+func (cache *DiskMDCacheStandard) GetTLFCryptKey(ctx context.Context,
+	tlfID tlf.ID, keyGen KeyGen) (kbfscrypto.TLFCryptKey, error) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	dbKey := diskMDCacheCryptKeyKey(tlfID, keyGen)
+	buf, err := cache.getLocked(dbKey)
+	if err != nil {
+		return kbfscrypto.TLFCryptKey{}, err
+	}
+	if buf == nil {
+		return kbfscrypto.TLFCryptKey{}, KeyCacheMissError{tlfID, keyGen}
+	}
+	var ed encryptedData
+	err = cache.config.Codec().Decode(buf, &ed)
+	if err != nil {
+		return kbfscrypto.TLFCryptKey{}, err
+	}
+	var key kbfscrypto.TLFCryptKey
+	err = cache.decryptLocked(ctx, ed, dbKey, &key)
+	if err != nil {
+		return kbfscrypto.TLFCryptKey{}, err
+	}
+	return key, nil
+}
+
+// PutTLFCryptKey implements the DiskMDCache interface for
+// DiskMDCacheStandard.
+func (cache *DiskMDCacheStandard) PutTLFCryptKey(ctx context.Context,
+	tlfID tlf.ID, keyGen KeyGen, key kbfscrypto.TLFCryptKey) error {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if cache.db == nil {
+		return errors.WithStack(DiskCacheClosedError{"Put"})
+	}
+	dbKey := diskMDCacheCryptKeyKey(tlfID, keyGen)
+	ed, err := cache.encryptLocked(ctx, key, dbKey)
+	if err != nil {
+		return err
+	}
+	buf, err := cache.config.Codec().Encode(ed)
+	if err != nil {
+		return err
+	}
+	return errors.WithStack(cache.db.Put(dbKey, buf, nil))
+}
+
+// DeleteTLFCryptKeys implements the DiskMDCache interface for
+// DiskMDCacheStandard.
+func (cache *DiskMDCacheStandard) DeleteTLFCryptKeys(
+	ctx context.Context, tlfID tlf.ID) error {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if cache.db == nil {
+		return errors.WithStack(DiskCacheClosedError{"Delete"})
+	}
+	return cache.deletePrefixLocked(append(
+		[]byte(diskMDCacheCryptKeyPrefix), tlfID.Bytes()...))
+}
+
+// DeleteAllTLFCryptKeys implements the DiskMDCache interface for
+// DiskMDCacheStandard.
+func (cache *DiskMDCacheStandard) DeleteAllTLFCryptKeys(
+	ctx context.Context) error {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if cache.db == nil {
+		return errors.WithStack(DiskCacheClosedError{"Delete"})
+	}
+	return cache.deletePrefixLocked([]byte(diskMDCacheCryptKeyPrefix))
+}
+
+// Shutdown implements the DiskMDCache interface for DiskMDCacheStandard.
+func (cache *DiskMDCacheStandard) Shutdown(ctx context.Context) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if cache.db == nil {
+		return
+	}
+	if err := cache.db.Close(); err != nil {
+		cache.log.CWarningf(ctx, "Couldn't close the disk MD cache: %+v",
+			err)
+	}
+	cache.db = nil
+	cache.localKey = nil
+}
+
+// putTLFCryptKeyInDiskMDCache caches the given TLF crypt key in the
+// disk MD cache, if there is one.  Failures are only logged, since
+// the caller has also cached the key in memory.
+func putTLFCryptKeyInDiskMDCache(ctx context.Context,
+	config diskMDCacheGetter, log logger.Logger, tlfID tlf.ID,
+	keyGen KeyGen, key kbfscrypto.TLFCryptKey) {
+	dmc := config.DiskMDCache()
+	if dmc == nil {
+		return
+	}
+	err := dmc.PutTLFCryptKey(ctx, tlfID, keyGen, key)
+	if err != nil {
+		log.CDebugf(ctx, "Couldn't put key %d for %s in the disk MD "+
+			"cache: %+v", keyGen, tlfID, err)
+	}
+}
+
+// deleteTLFCryptKeysFromDiskMDCache purges the TLF crypt keys of the
+// given TLF from the disk MD cache, if there is one, or those of all
+// TLFs if tlfID is tlf.NullID.  Failures are only logged; the cached
+// keys are only ever used while the MD server is unreachable.
+func deleteTLFCryptKeysFromDiskMDCache(ctx context.Context,
+	config diskMDCacheGetter, log logger.Logger, tlfID tlf.ID) {
+	dmc := config.DiskMDCache()
+	if dmc == nil {
+		return
+	}
+	var err error
+	if tlfID == tlf.NullID {
+		err = dmc.DeleteAllTLFCryptKeys(ctx)
+	} else {
+		err = dmc.DeleteTLFCryptKeys(ctx, tlfID)
+	}
+	if err != nil {
+		log.CDebugf(ctx, "Couldn't delete the keys for %s from the "+
+			"disk MD cache: %+v", tlfID, err)
+	}
+}
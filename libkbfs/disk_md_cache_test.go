@@ -0,0 +1,219 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"golang.org/x/net/context"
+)
+
+// offlineShimMDServer acts like an MD server that can't be reached
+// when asked for heads.
+type offlineShimMDServer struct {
+	MDServer
+}
+
+func (s offlineShimMDServer) GetForHandle(ctx context.Context,
+	handle tlf.Handle, mStatus MergeStatus) (
+	tlf.ID, *RootMetadataSigned, error) {
+	return tlf.ID{}, nil, errors.New("offline")
+}
+
+func (s offlineShimMDServer) GetForTLF(
+	ctx context.Context, id tlf.ID, bid BranchID, mStatus MergeStatus) (
+	*RootMetadataSigned, error) {
+	return nil, errors.New("offline")
+}
+
+func (s offlineShimMDServer) IsConnected() bool {
+	return false
+}
+
+func TestDiskMDCachePutAndGet(t *testing.T) {
+	var u1 libkb.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, u1)
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	cache, err := newDiskMDCacheStandardFromStorage(
+		config, storage.NewMemStorage())
+	require.NoError(t, err)
+	defer cache.Shutdown(ctx)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, u1.String(), tlf.Private)
+	fb := rootNode.GetFolderBranch()
+	head, err := config.MDOps().GetForTLF(ctx, fb.Tlf)
+	require.NoError(t, err)
+
+	t.Log("Nothing is cached at first")
+	ibrmd, _, err := cache.GetHead(ctx, fb.Tlf)
+	require.NoError(t, err)
+	require.Nil(t, ibrmd.BareRootMetadata)
+	_, ok, err := cache.GetTlfID(ctx, head.GetTlfHandle())
+	require.NoError(t, err)
+	require.False(t, ok)
+	_, err = cache.GetTLFCryptKey(ctx, fb.Tlf, FirstValidKeyGen)
+	require.IsType(t, KeyCacheMissError{}, err)
+
+	t.Log("Heads can be looked up by TLF ID and by handle")
+	err = cache.PutHead(ctx, head)
+	require.NoError(t, err)
+	ibrmd, key, err := cache.GetHead(ctx, fb.Tlf)
+	require.NoError(t, err)
+	require.Equal(t, head.Revision(), ibrmd.RevisionNumber())
+	require.Equal(t, head.MdID(), ibrmd.mdID)
+	require.Equal(t, head.LastModifyingWriterVerifyingKey(), key)
+	id, ok, err := cache.GetTlfID(ctx, head.GetTlfHandle())
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, fb.Tlf, id)
+
+	t.Log("Older heads don't replace newer ones")
+	kbfsOps := config.KBFSOps()
+	_, _, err = kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	newHead, err := config.MDOps().GetForTLF(ctx, fb.Tlf)
+	require.NoError(t, err)
+	err = cache.PutHead(ctx, newHead)
+	require.NoError(t, err)
+	err = cache.PutHead(ctx, head)
+	require.NoError(t, err)
+	ibrmd, _, err = cache.GetHead(ctx, fb.Tlf)
+	require.NoError(t, err)
+	require.Equal(t, newHead.Revision(), ibrmd.RevisionNumber())
+
+	t.Log("Keys round-trip")
+	tlfCryptKey := kbfscrypto.MakeTLFCryptKey([32]byte{0x1})
+	err = cache.PutTLFCryptKey(ctx, fb.Tlf, FirstValidKeyGen, tlfCryptKey)
+	require.NoError(t, err)
+	gotKey, err := cache.GetTLFCryptKey(ctx, fb.Tlf, FirstValidKeyGen)
+	require.NoError(t, err)
+	require.Equal(t, tlfCryptKey, gotKey)
+	_, err = cache.GetTLFCryptKey(ctx, fb.Tlf, FirstValidKeyGen+1)
+	require.IsType(t, KeyCacheMissError{}, err)
+
+	t.Log("Entries can't be read after the cache is shut down")
+	cache.Shutdown(ctx)
+	_, err = cache.GetTLFCryptKey(ctx, fb.Tlf, FirstValidKeyGen)
+	require.IsType(t, DiskCacheClosedError{}, errors.Cause(err))
+}
+
+func TestDiskMDCacheServesHeadsOffline(t *testing.T) {
+	var u1 libkb.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, u1)
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	cache, err := newDiskMDCacheStandardFromStorage(
+		config, storage.NewMemStorage())
+	require.NoError(t, err)
+	config.SetDiskMDCache(cache)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, u1.String(), tlf.Private)
+	fb := rootNode.GetFolderBranch()
+	kbfsOps := config.KBFSOps()
+	_, _, err = kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	head, err := config.MDOps().GetForTLF(ctx, fb.Tlf)
+	require.NoError(t, err)
+
+	t.Log("A new client can read the TLF without the MD server")
+	config2 := ConfigAsUser(config, u1)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+	config2.SetDiskMDCache(cache)
+	mdserv2 := config2.MDServer()
+	config2.SetMDServer(offlineShimMDServer{mdserv2})
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, u1.String(), tlf.Private)
+	kbfsOps2 := config2.KBFSOps()
+	_, _, err = kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	head2, err := config2.MDOps().GetForTLF(ctx, fb.Tlf)
+	require.NoError(t, err)
+	require.Equal(t, head.MdID(), head2.MdID())
+	require.True(t, head2.fromDiskCache)
+
+	t.Log("Writes fail until the MD server is reachable again")
+	_, _, err = kbfsOps2.CreateDir(ctx, rootNode2, "b")
+	require.IsType(t, OfflineReadOnlyError{}, errors.Cause(err))
+	config2.SetMDServer(mdserv2)
+	_, _, err = kbfsOps2.CreateDir(ctx, rootNode2, "b")
+	require.NoError(t, err)
+	err = kbfsOps2.SyncAll(ctx, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+}
+
+func TestDiskMDCacheRevokedDeviceLosesKeys(t *testing.T) {
+	var u1, u2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx, cancel := kbfsOpsConcurInit(t, u1, u2)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+	clock := newTestClockNow()
+	config1.SetClock(clock)
+
+	config2 := ConfigAsUser(config1, u2)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+	session2, err := config2.KBPKI().GetCurrentSession(ctx)
+	require.NoError(t, err)
+	uid2 := session2.UID
+	cache, err := newDiskMDCacheStandardFromStorage(
+		config2, storage.NewMemStorage())
+	require.NoError(t, err)
+	config2.SetDiskMDCache(cache)
+
+	t.Log("User 2 has a second device")
+	AddDeviceForLocalUserOrBust(t, config1, uid2)
+	devIndex := AddDeviceForLocalUserOrBust(t, config2, uid2)
+	config2Dev2 := ConfigAsUser(config2, u2)
+	defer CheckConfigAndShutdown(ctx, t, config2Dev2)
+	SwitchDeviceForLocalUserOrBust(t, config2Dev2, devIndex)
+
+	name := u1.String() + "," + u2.String()
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, name, tlf.Private)
+	fb := rootNode1.GetFolderBranch()
+	kbfsOps1 := config1.KBFSOps()
+	_, _, err = kbfsOps1.CreateDir(ctx, rootNode1, "a")
+	require.NoError(t, err)
+	err = kbfsOps1.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	t.Log("User 2's first device reads the folder, caching its key")
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, name, tlf.Private)
+	_, _, err = config2.KBFSOps().Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	_, err = cache.GetTLFCryptKey(ctx, fb.Tlf, FirstValidKeyGen)
+	require.NoError(t, err)
+
+	t.Log("Revoke that device, and have user 1 rekey the folder")
+	clock.Add(1 * time.Minute)
+	RevokeDeviceForLocalUserOrBust(t, config1, uid2, 0)
+	RevokeDeviceForLocalUserOrBust(t, config2Dev2, uid2, 0)
+	_, err = RequestRekeyAndWaitForOneFinishEvent(ctx, kbfsOps1, fb.Tlf)
+	require.NoError(t, err)
+
+	t.Log("A new client on the revoked device can't read the folder, " +
+		"even with the disk cache, and its cached keys are gone")
+	config2Revoked := ConfigAsUser(config2, u2)
+	defer CheckConfigAndShutdown(ctx, t, config2Revoked)
+	config2Revoked.SetDiskMDCache(cache)
+	_, err = GetRootNodeForTest(ctx, config2Revoked, name, tlf.Private)
+	require.IsType(t, NeedSelfRekeyError{}, errors.Cause(err))
+	_, err = cache.GetTLFCryptKey(ctx, fb.Tlf, FirstValidKeyGen)
+	require.IsType(t, KeyCacheMissError{}, err)
+
+	t.Log("User 2's other device can still read it")
+	rootNode2Dev2 := GetRootNodeOrBust(
+		ctx, t, config2Dev2, name, tlf.Private)
+	_, _, err = config2Dev2.KBFSOps().Lookup(ctx, rootNode2Dev2, "a")
+	require.NoError(t, err)
+}
@@ -6,6 +6,7 @@ package libkbfs
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/client/go/protocol/keybase1"
@@ -158,6 +159,54 @@ func (e RenameAcrossDirsError) Error() string {
 	return fmt.Sprintf("Cannot rename across directories")
 }
 
+// InvalidRenameFlagsError indicates that the user tried to rename
+// with an unsupported combination of flags.
+type InvalidRenameFlagsError struct {
+	Flags RenameFlags
+}
+
+// Error implements the error interface for InvalidRenameFlagsError.
+func (e InvalidRenameFlagsError) Error() string {
+	return fmt.Sprintf("Invalid rename flags: %s", e.Flags)
+}
+
+// OpsVersionTooLowError indicates that an operation would write an
+// op that needs a newer OpsVer than the configured one, because
+// older clients would misapply it.
+type OpsVersionTooLowError struct {
+	Op     string
+	Needed OpsVer
+	Cur    OpsVer
+}
+
+// Error implements the error interface for OpsVersionTooLowError.
+func (e OpsVersionTooLowError) Error() string {
+	return fmt.Sprintf("%s needs ops version %d, but only %d is enabled, "+
+		"since older clients might not understand it", e.Op,
+		e.Needed, e.Cur)
+}
+
+// CopyAcrossDirsError indicates that the user tried to copy a file
+// by reference into a different top-level folder.
+type CopyAcrossDirsError struct {
+}
+
+// Error implements the error interface for CopyAcrossDirsError
+func (e CopyAcrossDirsError) Error() string {
+	return "Cannot copy by reference across top-level folders"
+}
+
+// FileNotEmptyError indicates that the user tried to replace the
+// contents of a file that isn't empty with a copy of another file.
+type FileNotEmptyError struct {
+	Name string
+}
+
+// Error implements the error interface for FileNotEmptyError
+func (e FileNotEmptyError) Error() string {
+	return fmt.Sprintf("%s is not empty", e.Name)
+}
+
 // ErrorFileAccessError indicates that the user tried to perform an
 // operation on the ErrorFile that is not allowed.
 type ErrorFileAccessError struct {
@@ -444,6 +493,56 @@ func (e MDMismatchError) Error() string {
 		e.Revision, e.Dir, e.TlfID, e.Err)
 }
 
+// MerkleProofsUnsupportedError indicates that the MD server doesn't
+// serve Merkle proofs of its TLF heads at all.
+type MerkleProofsUnsupportedError struct{}
+
+// Error implements the error interface for
+// MerkleProofsUnsupportedError.
+func (e MerkleProofsUnsupportedError) Error() string {
+	return "The MD server doesn't serve Merkle proofs"
+}
+
+// MerkleVerificationError indicates that an MD object couldn't be
+// verified against the MD server's Merkle tree, which means the
+// server may have forked or rolled back the given top-level folder.
+type MerkleVerificationError struct {
+	Revision kbfsmd.Revision
+	TlfID    tlf.ID
+	Err      error
+}
+
+// Error implements the error interface for MerkleVerificationError.
+func (e MerkleVerificationError) Error() string {
+	return fmt.Sprintf("Could not verify metadata (revision=%d) for "+
+		"folder %s against the Merkle tree: %s",
+		e.Revision, e.TlfID, e.Err)
+}
+
+// MDRollbackError indicates that the MD server served a merged
+// revision of a TLF that is older than, or diverges from, a revision
+// this device has already verified.  Either the server is
+// misbehaving, or the TLF was legitimately rolled back, in which
+// case the mark can be reset with `kbfstool md marks -reset`.
+type MDRollbackError struct {
+	TlfID    tlf.ID
+	Revision kbfsmd.Revision
+	MdID     kbfsmd.ID
+	Mark     MDHighWaterMark
+}
+
+// Error implements the error interface for MDRollbackError.
+func (e MDRollbackError) Error() string {
+	if e.Revision == e.Mark.Revision {
+		return fmt.Sprintf("The MD server served MD %s for revision %d "+
+			"of folder %s, but this device previously verified MD %s "+
+			"for that revision", e.MdID, e.Revision, e.TlfID, e.Mark.MdID)
+	}
+	return fmt.Sprintf("The MD server served revision %d as the head "+
+		"of folder %s, but this device previously verified revision %d",
+		e.Revision, e.TlfID, e.Mark.Revision)
+}
+
 // NoSuchMDError indicates that there is no MD object for the given
 // folder, revision, and merged status.
 type NoSuchMDError struct {
@@ -671,6 +770,17 @@ func (e UnknownEncryptionVer) Error() string {
 	return fmt.Sprintf("Unknown encryption version %d", int(e.ver))
 }
 
+// UnknownBlockPaddingError indicates that a block padding scheme is
+// not known.
+type UnknownBlockPaddingError struct {
+	padding BlockPadding
+}
+
+// Error implements the error interface for UnknownBlockPaddingError.
+func (e UnknownBlockPaddingError) Error() string {
+	return fmt.Sprintf("Unknown block padding %d", int(e.padding))
+}
+
 // InvalidNonceError indicates that an invalid cryptographic nonce was
 // detected.
 type InvalidNonceError struct {
@@ -718,6 +828,60 @@ func (e WrongOpsError) Error() string {
 		"branch %s", e.opsFB.Tlf, e.opsFB.Branch, e.nodeFB.Tlf, e.nodeFB.Branch)
 }
 
+// TransactionInProgressError indicates that an operation needed to
+// sync a folder branch with an open transaction, or that a
+// transaction was begun on a folder branch that already has one.
+type TransactionInProgressError struct {
+	FolderBranch FolderBranch
+}
+
+// Error implements the error interface for TransactionInProgressError.
+func (e TransactionInProgressError) Error() string {
+	return fmt.Sprintf("A transaction is in progress on folder %v, "+
+		"branch %s", e.FolderBranch.Tlf, e.FolderBranch.Branch)
+}
+
+// TransactionTooLargeError indicates that a write was refused
+// because the dirty block cache is full, and nothing can be synced
+// to make room until the open transaction is committed or aborted.
+type TransactionTooLargeError struct {
+	FolderBranch FolderBranch
+}
+
+// Error implements the error interface for TransactionTooLargeError.
+func (e TransactionTooLargeError) Error() string {
+	return fmt.Sprintf("The transaction on folder %v, branch %s, has "+
+		"filled the dirty block cache; commit or abort it to make room",
+		e.FolderBranch.Tlf, e.FolderBranch.Branch)
+}
+
+// TransactionExpiredError indicates that a transaction was aborted
+// because it was left open for longer than Timeout, so its changes
+// were discarded.
+type TransactionExpiredError struct {
+	FolderBranch FolderBranch
+	Timeout      time.Duration
+}
+
+// Error implements the error interface for TransactionExpiredError.
+func (e TransactionExpiredError) Error() string {
+	return fmt.Sprintf("The transaction on folder %v, branch %s, was "+
+		"aborted after being open for more than %s",
+		e.FolderBranch.Tlf, e.FolderBranch.Branch, e.Timeout)
+}
+
+// NoTransactionError indicates that a transaction was committed or
+// aborted on a folder branch that doesn't have an open one.
+type NoTransactionError struct {
+	FolderBranch FolderBranch
+}
+
+// Error implements the error interface for NoTransactionError.
+func (e NoTransactionError) Error() string {
+	return fmt.Sprintf("No transaction is in progress on folder %v, "+
+		"branch %s", e.FolderBranch.Tlf, e.FolderBranch.Branch)
+}
+
 // NodeNotFoundError indicates that we tried to find a node for the
 // given BlockPointer and failed.
 type NodeNotFoundError struct {
@@ -1291,3 +1455,63 @@ type NoUpdatesWhileDirtyError struct{}
 func (e NoUpdatesWhileDirtyError) Error() string {
 	return "Ignoring MD updates while writes are dirty"
 }
+
+// OfflineReadOnlyError indicates that a TLF can't be written to,
+// because its head was read from the disk MD cache and the MD server
+// can't be reached to check that the head is still the latest.
+type OfflineReadOnlyError struct {
+	Tlf tlf.ID
+	Err error
+}
+
+// Error implements the error interface for OfflineReadOnlyError.
+func (e OfflineReadOnlyError) Error() string {
+	return fmt.Sprintf("%s is read-only while the MD server can't be "+
+		"reached: %v", e.Tlf, e.Err)
+}
+
+// ChaosInjectedError is returned by a fault-injecting server wrapper
+// when it fails a call on purpose.
+type ChaosInjectedError struct {
+	Service string
+	Op      string
+	// Disconnected is true if the call failed because of an
+	// injected disconnect.
+	Disconnected bool
+}
+
+// Error implements the error interface for ChaosInjectedError.
+func (e ChaosInjectedError) Error() string {
+	if e.Disconnected {
+		return fmt.Sprintf("Injected disconnect of %s during %s",
+			e.Service, e.Op)
+	}
+	return fmt.Sprintf("Injected error in %s %s", e.Service, e.Op)
+}
+
+// ImmutableFolderError indicates an attempt to remove, rename or
+// overwrite existing data in a write-once, read-many folder.
+type ImmutableFolderError struct {
+	Op       string
+	Filename string
+}
+
+// Error implements the error interface for ImmutableFolderError.
+func (e ImmutableFolderError) Error() string {
+	return fmt.Sprintf("Can't %s %s: the folder is write-once, read-many",
+		e.Op, e.Filename)
+}
+
+// ReadOnlyEntryError indicates an attempt to modify, remove or rename
+// an entry that has been marked read-only, or to change the contents
+// of a read-only directory.
+type ReadOnlyEntryError struct {
+	Op       string
+	Filename string
+}
+
+// Error implements the error interface for ReadOnlyEntryError.
+func (e ReadOnlyEntryError) Error() string {
+	return fmt.Sprintf("Can't %s %s: the entry is read-only",
+		e.Op, e.Filename)
+}
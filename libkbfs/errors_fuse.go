@@ -28,6 +28,14 @@ func (e NoSuchTeamError) Errno() fuse.Errno {
 	return fuse.Errno(syscall.ENOENT)
 }
 
+var _ fuse.ErrorNumber = NameExistsError{""}
+
+// Errno implements the fuse.ErrorNumber interface for
+// NameExistsError
+func (e NameExistsError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.EEXIST)
+}
+
 var _ fuse.ErrorNumber = DirNotEmptyError{""}
 
 // Errno implements the fuse.ErrorNumber interface for
@@ -144,6 +152,23 @@ func (e RenameAcrossDirsError) Errno() fuse.Errno {
 	return fuse.Errno(syscall.EXDEV)
 }
 
+var _ fuse.ErrorNumber = InvalidRenameFlagsError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// InvalidRenameFlagsError.
+func (e InvalidRenameFlagsError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.EINVAL)
+}
+
+var _ fuse.ErrorNumber = OpsVersionTooLowError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// OpsVersionTooLowError.  EINVAL lets callers fall back, as they would
+// on a file system without support for the operation.
+func (e OpsVersionTooLowError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.EINVAL)
+}
+
 var _ fuse.ErrorNumber = &ErrDiskLimitTimeout{}
 
 // Errno implements the fuse.ErrorNumber interface for
@@ -151,3 +176,35 @@ var _ fuse.ErrorNumber = &ErrDiskLimitTimeout{}
 func (e *ErrDiskLimitTimeout) Errno() fuse.Errno {
 	return fuse.Errno(syscall.ENOSPC)
 }
+
+var _ fuse.ErrorNumber = OfflineReadOnlyError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// OfflineReadOnlyError.
+func (e OfflineReadOnlyError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.EROFS)
+}
+
+var _ fuse.ErrorNumber = CopyAcrossDirsError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// CopyAcrossDirsError.
+func (e CopyAcrossDirsError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.EXDEV)
+}
+
+var _ fuse.ErrorNumber = ImmutableFolderError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// ImmutableFolderError.
+func (e ImmutableFolderError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.EPERM)
+}
+
+var _ fuse.ErrorNumber = ReadOnlyEntryError{}
+
+// Errno implements the fuse.ErrorNumber interface for
+// ReadOnlyEntryError.
+func (e ReadOnlyEntryError) Errno() fuse.Errno {
+	return fuse.Errno(syscall.EPERM)
+}
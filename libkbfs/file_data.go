@@ -465,6 +465,36 @@ func (fd *fileData) getIndirectBlocksForOffsetRange(ctx context.Context,
 	return pfr, nil
 }
 
+// getLeafPtrsForOffsetRange returns the pointers to the leaf blocks
+// that hold the data in the half-inclusive offset range `[startOff,
+// endOff)`, in order, without fetching the leaf blocks themselves.
+// If the file has no indirect blocks, it returns nil.
+func (fd *fileData) getLeafPtrsForOffsetRange(ctx context.Context,
+	startOff, endOff int64) ([]BlockPointer, error) {
+	topBlock, _, err := fd.getter(
+		ctx, fd.kmd, fd.rootBlockPointer(), fd.file, blockRead)
+	if err != nil {
+		return nil, err
+	}
+	if !topBlock.IsInd {
+		return nil, nil
+	}
+
+	pfr, err := fd.getIndirectBlocksForOffsetRange(
+		ctx, topBlock, startOff, endOff)
+	if err != nil {
+		return nil, err
+	}
+	ptrs := make([]BlockPointer, 0, len(pfr))
+	for _, p := range pfr {
+		if len(p) == 0 {
+			continue
+		}
+		ptrs = append(ptrs, p[len(p)-1].childIPtr().BlockPointer)
+	}
+	return ptrs, nil
+}
+
 // getByteSlicesInOffsetRange returns an ordered, continuous slice of
 // byte ranges for the data described by the half-inclusive offset
 // range `[startOff, endOff)`.  If `endOff` == -1, it returns data to
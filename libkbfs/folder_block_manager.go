@@ -24,6 +24,7 @@ type fbmHelper interface {
 	getMostRecentFullyMergedMD(ctx context.Context) (
 		ImmutableRootMetadata, error)
 	finalizeGCOp(ctx context.Context, gco *GCOp) error
+	reencryptOldBlocks(ctx context.Context) (KeyGen, error)
 }
 
 const (
@@ -107,6 +108,26 @@ type folderBlockManager struct {
 	reclamationCancelLock sync.Mutex
 	reclamationCancel     context.CancelFunc
 
+	// reencryptChan signals the manager to start re-encrypting
+	// blocks that use old key generations.
+	reencryptChan chan struct{}
+
+	// reencryptionGroup tracks the outstanding re-encryptions.
+	reencryptionGroup kbfssync.RepeatedWaitGroup
+
+	reencryptionCancelLock sync.Mutex
+	reencryptionCancel     context.CancelFunc
+
+	// reencryptLock protects whether background re-encryption is
+	// enabled, as of the latest merged MD, the latest key generation
+	// that all the blocks are known to be encrypted with, and the
+	// latest key generation that a pending or running pass will
+	// re-encrypt to.
+	reencryptLock         sync.Mutex
+	reencryptEnabled      bool
+	reencryptedKeyGen     KeyGen
+	reencryptTargetKeyGen KeyGen
+
 	helper fbmHelper
 
 	// Remembers what happened last time during quota reclamation.
@@ -115,6 +136,9 @@ type folderBlockManager struct {
 	lastQROldEnoughRev  kbfsmd.Revision
 	wasLastQRComplete   bool
 	lastReclamationTime time.Time
+	// lastQRPolicy is the retention policy that was in effect
+	// for the last QR.
+	lastQRPolicy RetentionPolicy
 }
 
 func newFolderBlockManager(config Config, fb FolderBranch,
@@ -132,6 +156,7 @@ func newFolderBlockManager(config Config, fb FolderBranch,
 		blocksToDeleteChan:        make(chan blocksToDelete, 25),
 		blocksToDeletePauseChan:   make(chan (<-chan struct{})),
 		forceReclamationChan:      make(chan struct{}, 1),
+		reencryptChan:             make(chan struct{}, 1),
 		helper:                    helper,
 	}
 	// Pass in the BlockOps here so that the archive goroutine
@@ -150,6 +175,7 @@ func newFolderBlockManager(config Config, fb FolderBranch,
 	go fbm.deleteBlocksInBackground()
 	if fb.Branch == MasterBranch {
 		go fbm.reclaimQuotaInBackground()
+		go fbm.reencryptInBackground()
 	}
 	return fbm
 }
@@ -211,11 +237,32 @@ func (fbm *folderBlockManager) cancelReclamation() {
 	}
 }
 
+func (fbm *folderBlockManager) setReencryptionCancel(
+	cancel context.CancelFunc) {
+	fbm.reencryptionCancelLock.Lock()
+	defer fbm.reencryptionCancelLock.Unlock()
+	fbm.reencryptionCancel = cancel
+}
+
+func (fbm *folderBlockManager) cancelReencryption() {
+	reencryptionCancel := func() context.CancelFunc {
+		fbm.reencryptionCancelLock.Lock()
+		defer fbm.reencryptionCancelLock.Unlock()
+		reencryptionCancel := fbm.reencryptionCancel
+		fbm.reencryptionCancel = nil
+		return reencryptionCancel
+	}()
+	if reencryptionCancel != nil {
+		reencryptionCancel()
+	}
+}
+
 func (fbm *folderBlockManager) shutdown() {
 	close(fbm.shutdownChan)
 	fbm.cancelArchive()
 	fbm.cancelBlocksToDelete()
 	fbm.cancelReclamation()
+	fbm.cancelReencryption()
 }
 
 // cleanUpBlockState cleans up any blocks that may have been orphaned
@@ -403,6 +450,46 @@ func (fbm *folderBlockManager) forceQuotaReclamation() {
 	}
 }
 
+func (fbm *folderBlockManager) waitForReencryption(ctx context.Context) error {
+	return fbm.reencryptionGroup.Wait(ctx)
+}
+
+// signalReencryptionLocked starts a new re-encryption pass, unless
+// one is already pending.  reencryptLock must be held by the caller.
+func (fbm *folderBlockManager) signalReencryptionLocked() {
+	fbm.reencryptionGroup.Add(1)
+	select {
+	case fbm.reencryptChan <- struct{}{}:
+	default:
+		fbm.reencryptionGroup.Done()
+	}
+}
+
+// maybeReencrypt is called with the state of each new merged head.
+// It starts a re-encryption pass if background re-encryption was
+// just enabled, or if it's enabled and the folder has a newer key
+// generation than any finished or pending pass.  Disabling it
+// cancels any pass in progress.
+func (fbm *folderBlockManager) maybeReencrypt(
+	enabled bool, latestKeyGen KeyGen) {
+	fbm.reencryptLock.Lock()
+	defer fbm.reencryptLock.Unlock()
+	wasEnabled := fbm.reencryptEnabled
+	fbm.reencryptEnabled = enabled
+	if !enabled {
+		if wasEnabled {
+			fbm.cancelReencryption()
+		}
+		return
+	}
+	if wasEnabled && (latestKeyGen <= fbm.reencryptedKeyGen ||
+		latestKeyGen <= fbm.reencryptTargetKeyGen) {
+		return
+	}
+	fbm.reencryptTargetKeyGen = latestKeyGen
+	fbm.signalReencryptionLocked()
+}
+
 // doChunkedDowngrades sends batched archive or delete messages to the
 // block server for the given block pointers.  For deletes, it returns
 // a list of block IDs that no longer have any references.
@@ -412,6 +499,7 @@ func (fbm *folderBlockManager) doChunkedDowngrades(ctx context.Context,
 	fbm.log.CDebugf(ctx, "Downgrading %d pointers (archive=%t)",
 		len(ptrs), archive)
 	bops := fbm.config.BlockOps()
+	cc := blockTransferControllersForTlf(fbm.config, tlfID).Downgrades()
 
 	// Round up to find the number of chunks.
 	numChunks := (len(ptrs) + numPointersToDowngradePerChunk - 1) /
@@ -438,6 +526,11 @@ func (fbm *folderBlockManager) doChunkedDowngrades(ctx context.Context,
 		defer wg.Done()
 		for chunk := range chunks {
 			var res workerResult
+			done, err := cc.Acquire(ctx)
+			if err != nil {
+				chunkResults <- workerResult{err: err}
+				return
+			}
 			fbm.log.CDebugf(ctx, "Downgrading chunk of %d pointers", len(chunk))
 			if archive {
 				res.err = bops.Archive(ctx, tlfID, chunk)
@@ -452,6 +545,7 @@ func (fbm *folderBlockManager) doChunkedDowngrades(ctx context.Context,
 					}
 				}
 			}
+			done(0, res.err)
 			chunkResults <- res
 			select {
 			// return early if the context has been canceled
@@ -727,24 +821,27 @@ func (fbm *folderBlockManager) deleteBlocksInBackground() {
 	}
 }
 
-func (fbm *folderBlockManager) isOldEnough(rmd ImmutableRootMetadata) bool {
+func (fbm *folderBlockManager) isOldEnough(
+	rmd ImmutableRootMetadata, policy RetentionPolicy) bool {
 	// Trust the server's timestamp on this MD.
 	mtime := rmd.localTimestamp
-	unrefAge := fbm.config.QuotaReclamationMinUnrefAge()
+	unrefAge := policy.minUnrefAge(fbm.config)
 	return mtime.Add(unrefAge).Before(fbm.config.Clock().Now())
 }
 
 // getMostRecentOldEnoughAndGCRevisions returns the most recent MD
-// that's older than the unref age, as well as the latest revision
-// that was scrubbed by the previous gc op.
+// that's older than the unref age and that the retention policy lets
+// us reclaim up to, as well as the latest revision that was scrubbed
+// by the previous gc op.
 func (fbm *folderBlockManager) getMostRecentOldEnoughAndGCRevisions(
-	ctx context.Context, head ReadOnlyRootMetadata) (
+	ctx context.Context, head ReadOnlyRootMetadata, policy RetentionPolicy) (
 	mostRecentOldEnoughRev, lastGCRev kbfsmd.Revision, err error) {
 	// Walk backwards until we find one that is old enough.  Also,
 	// look out for the previous GCOp.  TODO: Eventually get rid of
 	// this scan once we have some way to get the MD corresponding to
 	// a given timestamp.
 	currHead := head.Revision()
+	latestReclaimableRev := policy.latestReclaimableRev(head.Revision())
 	mostRecentOldEnoughRev = kbfsmd.RevisionUninitialized
 	lastGCRev = kbfsmd.RevisionUninitialized
 	if head.data.LastGCRevision >= kbfsmd.RevisionInitial {
@@ -771,10 +868,10 @@ func (fbm *folderBlockManager) getMostRecentOldEnoughAndGCRevisions(
 		for i := len(rmds) - 1; i >= 0; i-- {
 			rmd := rmds[i]
 			if mostRecentOldEnoughRev == kbfsmd.RevisionUninitialized &&
-				fbm.isOldEnough(rmd) {
+				rmd.Revision() <= latestReclaimableRev &&
+				fbm.isOldEnough(rmd, policy) {
 				fbm.log.CDebugf(ctx, "Revision %d is older than the unref "+
-					"age %s", rmd.Revision(),
-					fbm.config.QuotaReclamationMinUnrefAge())
+					"age %s", rmd.Revision(), policy.minUnrefAge(fbm.config))
 				mostRecentOldEnoughRev = rmd.Revision()
 			}
 
@@ -969,13 +1066,14 @@ func (fbm *folderBlockManager) finalizeReclamation(ctx context.Context,
 		func() error { return fbm.helper.finalizeGCOp(ctx, gco) })
 }
 
-func (fbm *folderBlockManager) isQRNecessary(
-	ctx context.Context, head ImmutableRootMetadata) bool {
+func (fbm *folderBlockManager) isQRNecessary(ctx context.Context,
+	head ImmutableRootMetadata, policy RetentionPolicy) bool {
 	fbm.lastQRLock.Lock()
 	defer fbm.lastQRLock.Unlock()
 	if head == (ImmutableRootMetadata{}) {
 		return false
 	}
+	policyChanged := policy != fbm.lastQRPolicy
 
 	session, err := fbm.config.KBPKI().GetCurrentSession(ctx)
 	if err != nil {
@@ -1005,22 +1103,24 @@ func (fbm *folderBlockManager) isQRNecessary(
 
 	// Do QR if:
 	//   * The head has changed since last time, OR
-	//   * The last QR did not completely clean every available thing
-	if head.Revision() != fbm.lastQRHeadRev || !fbm.wasLastQRComplete {
+	//   * The last QR did not completely clean every available thing, OR
+	//   * The retention policy has changed since last time
+	if head.Revision() != fbm.lastQRHeadRev || !fbm.wasLastQRComplete ||
+		policyChanged {
 		return true
 	}
 
 	// Do QR if the head was not reclaimable at the last QR time, but
 	// is old enough now.
 	return fbm.lastQRHeadRev > fbm.lastQROldEnoughRev &&
-		fbm.isOldEnough(head)
+		fbm.isOldEnough(head, policy)
 }
 
 func (fbm *folderBlockManager) doReclamation(timer *time.Timer) (err error) {
 	ctx, cancel := context.WithCancel(fbm.ctxWithFBMID(context.Background()))
 	fbm.setReclamationCancel(cancel)
 	defer fbm.cancelReclamation()
-	defer timer.Reset(fbm.config.QuotaReclamationPeriod())
+	defer func() { timer.Reset(fbm.reclamationPeriod()) }()
 	defer fbm.reclamationGroup.Done()
 
 	// Don't set a context deadline.  For users that have written a
@@ -1057,7 +1157,17 @@ func (fbm *folderBlockManager) doReclamation(timer *time.Timer) (err error) {
 			head.GetTlfHandle().GetCanonicalPath())
 	}
 
-	if !fbm.isQRNecessary(ctx, head) {
+	policy := retentionPolicyForMD(fbm.config, fbm.id, head.ReadOnly())
+	if policy.NeverReclaim {
+		fbm.log.CDebugf(ctx, "Skipping QR; the retention policy keeps "+
+			"the full history")
+		fbm.lastQRLock.Lock()
+		defer fbm.lastQRLock.Unlock()
+		fbm.lastQRPolicy = policy
+		return nil
+	}
+
+	if !fbm.isQRNecessary(ctx, head, policy) {
 		// Nothing has changed since last time, or the current head is
 		// too new, so no need to do any QR.
 		return nil
@@ -1073,6 +1183,7 @@ func (fbm *folderBlockManager) doReclamation(timer *time.Timer) (err error) {
 			fbm.lastQRHeadRev = head.Revision()
 			fbm.lastQROldEnoughRev = mostRecentOldEnoughRev
 			fbm.wasLastQRComplete = complete
+			fbm.lastQRPolicy = policy
 		}
 		if !reclamationTime.IsZero() {
 			fbm.lastReclamationTime = reclamationTime
@@ -1102,7 +1213,8 @@ func (fbm *folderBlockManager) doReclamation(timer *time.Timer) (err error) {
 	}()
 
 	mostRecentOldEnoughRev, lastGCRev, err :=
-		fbm.getMostRecentOldEnoughAndGCRevisions(ctx, head.ReadOnly())
+		fbm.getMostRecentOldEnoughAndGCRevisions(
+			ctx, head.ReadOnly(), policy)
 	if err != nil {
 		return err
 	}
@@ -1183,6 +1295,64 @@ func (fbm *folderBlockManager) reclaimQuotaInBackground() {
 	}
 }
 
+func (fbm *folderBlockManager) doReencryption() (err error) {
+	ctx, cancel := context.WithCancel(fbm.ctxWithFBMID(context.Background()))
+	fbm.setReencryptionCancel(cancel)
+	defer fbm.cancelReencryption()
+	// Re-encryption goes through the normal write and sync paths,
+	// which need to be able to delay cancellation.
+	ctx, err = NewContextWithCancellationDelayer(ctx)
+	if err != nil {
+		return err
+	}
+	defer CleanupCancellationDelayer(ctx)
+
+	fbm.log.CDebugf(ctx, "Starting re-encryption process")
+	defer func() {
+		fbm.log.CDebugf(ctx, "Ending re-encryption process: %v", err)
+	}()
+
+	// The re-encrypted blocks are written as a normal revision, which
+	// unreferences the old blocks; QR will reclaim them once they are
+	// old enough.
+	keyGen, err := fbm.helper.reencryptOldBlocks(ctx)
+
+	fbm.reencryptLock.Lock()
+	defer fbm.reencryptLock.Unlock()
+	if err != nil {
+		// Let the next new head try again.
+		fbm.reencryptTargetKeyGen = fbm.reencryptedKeyGen
+		return err
+	}
+	if keyGen > fbm.reencryptedKeyGen {
+		fbm.reencryptedKeyGen = keyGen
+	}
+	return nil
+}
+
+func (fbm *folderBlockManager) reencryptInBackground() {
+	for {
+		select {
+		case <-fbm.shutdownChan:
+			return
+		case <-fbm.reencryptChan:
+		}
+
+		// Errors are logged and reported in the folder status; the
+		// next key rotation or enabling will try again.
+		_ = fbm.doReencryption()
+		fbm.reencryptionGroup.Done()
+	}
+}
+
+// reclamationPeriod returns how long to wait before the next QR,
+// following the retention policy in effect for the last QR.
+func (fbm *folderBlockManager) reclamationPeriod() time.Duration {
+	fbm.lastQRLock.Lock()
+	defer fbm.lastQRLock.Unlock()
+	return fbm.lastQRPolicy.period(fbm.config)
+}
+
 func (fbm *folderBlockManager) getLastQRData() (time.Time, kbfsmd.Revision) {
 	fbm.lastQRLock.Lock()
 	defer fbm.lastQRLock.Unlock()
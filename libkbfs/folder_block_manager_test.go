@@ -13,6 +13,8 @@ import (
 	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/kbfs/kbfsblock"
 	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/net/context"
 )
 
@@ -710,6 +712,173 @@ func TestQuotaReclamationMinHeadAge(t *testing.T) {
 	}
 }
 
+// Test that quota reclamation honors per-TLF retention policies.
+func TestQuotaReclamationRetentionPolicy(t *testing.T) {
+	var userName libkb.NormalizedUsername = "test_user"
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, userName)
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	clock, now := newTestClockAndTimeNow()
+	config.SetClock(clock)
+
+	rootNode := GetRootNodeOrBust(
+		ctx, t, config, userName.String(), tlf.Private)
+	kbfsOps := config.KBFSOps()
+	_, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	if err != nil {
+		t.Fatalf("Couldn't create dir: %+v", err)
+	}
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync all: %v", err)
+	}
+	err = kbfsOps.RemoveDir(ctx, rootNode, "a")
+	if err != nil {
+		t.Fatalf("Couldn't remove dir: %+v", err)
+	}
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync all: %v", err)
+	}
+
+	// Make the removal old enough to reclaim under the default policy.
+	clock.Set(now.Add(2 * config.QuotaReclamationMinUnrefAge()))
+	_, _, err = kbfsOps.CreateDir(ctx, rootNode, "b")
+	if err != nil {
+		t.Fatalf("Couldn't create dir: %+v", err)
+	}
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync all: %v", err)
+	}
+	err = kbfsOps.SyncFromServerForTesting(ctx, rootNode.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync from server: %+v", err)
+	}
+
+	bserverLocal, ok := config.BlockServer().(blockServerLocal)
+	if !ok {
+		t.Fatalf("Bad block server")
+	}
+	tlfID := rootNode.GetFolderBranch().Tlf
+	preQRBlocks, err := bserverLocal.getAllRefsForTest(ctx, tlfID)
+	if err != nil {
+		t.Fatalf("Couldn't get blocks: %+v", err)
+	}
+
+	ops := kbfsOps.(*KBFSOpsStandard).getOpsByNode(ctx, rootNode)
+	doQR := func(policies string) int {
+		var rp *RetentionPolicies
+		if policies != "" {
+			rp, err = ParseRetentionPolicies([]byte(policies))
+			if err != nil {
+				t.Fatalf("Couldn't parse policies: %+v", err)
+			}
+		}
+		config.SetRetentionPolicies(rp)
+		ops.fbm.forceQuotaReclamation()
+		err = ops.fbm.waitForQuotaReclamations(ctx)
+		if err != nil {
+			t.Fatalf("Couldn't wait for QR: %+v", err)
+		}
+		blocks, err := bserverLocal.getAllRefsForTest(ctx, tlfID)
+		if err != nil {
+			t.Fatalf("Couldn't get blocks: %+v", err)
+		}
+		return totalBlockRefs(blocks)
+	}
+
+	pre := totalBlockRefs(preQRBlocks)
+	if post := doQR(`{"folders": {"` + tlfID.String() +
+		`": {"neverReclaim": true}}}`); post != pre {
+		t.Fatalf("Blocks reclaimed despite neverReclaim: pre: %d, post %d",
+			pre, post)
+	}
+	if post := doQR(`{"folders": {"/keybase/private/test_user": ` +
+		`{"keepRevisions": 10}}}`); post != pre {
+		t.Fatalf("Blocks reclaimed despite keepRevisions: pre: %d, post %d",
+			pre, post)
+	}
+
+	// Dropping the policy should let the next QR reclaim the blocks.
+	if post := doQR(""); post >= pre {
+		t.Errorf("Blocks didn't shrink after reclamation: pre: %d, post %d",
+			pre, post)
+	}
+}
+
+// Test that a retention policy stored in the MD is honored by other
+// devices, which have no local retention policies.
+func TestQuotaReclamationRetentionPolicyInMD(t *testing.T) {
+	var userName libkb.NormalizedUsername = "test_user"
+	config1, _, ctx, cancel := kbfsOpsInitNoMocks(t, userName)
+	defer kbfsTestShutdownNoMocks(t, config1, ctx, cancel)
+	clock, now := newTestClockAndTimeNow()
+	config1.SetClock(clock)
+	config2 := ConfigAsUser(config1, userName)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+
+	rootNode1 := GetRootNodeOrBust(
+		ctx, t, config1, userName.String(), tlf.Private)
+	fb := rootNode1.GetFolderBranch()
+	kbfsOps1 := config1.KBFSOps()
+	err := kbfsOps1.SetRetentionPolicy(
+		ctx, fb, &RetentionPolicy{KeepRevisions: 10})
+	require.NoError(t, err)
+
+	_, _, err = kbfsOps1.CreateDir(ctx, rootNode1, "a")
+	require.NoError(t, err)
+	err = kbfsOps1.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	err = kbfsOps1.RemoveDir(ctx, rootNode1, "a")
+	require.NoError(t, err)
+	err = kbfsOps1.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	t.Log("The policy carries over to later revisions")
+	head, err := config1.MDOps().GetForTLF(ctx, fb.Tlf)
+	require.NoError(t, err)
+	require.Equal(t,
+		&RetentionPolicy{KeepRevisions: 10}, head.RetentionPolicy())
+
+	// Make the removal old enough to reclaim under the default policy.
+	clock.Set(now.Add(2 * config1.QuotaReclamationMinUnrefAge()))
+	_, _, err = kbfsOps1.CreateDir(ctx, rootNode1, "b")
+	require.NoError(t, err)
+	err = kbfsOps1.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	bserverLocal, ok := config1.BlockServer().(blockServerLocal)
+	require.True(t, ok)
+	preQRBlocks, err := bserverLocal.getAllRefsForTest(ctx, fb.Tlf)
+	require.NoError(t, err)
+	pre := totalBlockRefs(preQRBlocks)
+
+	rootNode2 := GetRootNodeOrBust(
+		ctx, t, config2, userName.String(), tlf.Private)
+	ops2 := config2.KBFSOps().(*KBFSOpsStandard).getOpsByNode(ctx, rootNode2)
+	doQR := func() int {
+		err := config2.KBFSOps().SyncFromServerForTesting(ctx, fb)
+		require.NoError(t, err)
+		ops2.fbm.forceQuotaReclamation()
+		err = ops2.fbm.waitForQuotaReclamations(ctx)
+		require.NoError(t, err)
+		blocks, err := bserverLocal.getAllRefsForTest(ctx, fb.Tlf)
+		require.NoError(t, err)
+		return totalBlockRefs(blocks)
+	}
+
+	t.Log("Another device follows the policy in the MD")
+	require.Equal(t, pre, doQR())
+
+	t.Log("Clearing the policy lets the other device reclaim the blocks")
+	err = kbfsOps1.SetRetentionPolicy(ctx, fb, nil)
+	require.NoError(t, err)
+	ops1 := kbfsOps1.(*KBFSOpsStandard).getOpsByNode(ctx, rootNode1)
+	err = ops1.fbm.waitForQuotaReclamations(ctx)
+	require.NoError(t, err)
+	require.True(t, doQR() < pre)
+}
+
 // Test that quota reclamation makes GCOps to account for other GCOps,
 // to make sure clients don't waste time scanning over a bunch of old
 // GCOps when there is nothing to be done.
@@ -800,3 +969,189 @@ func TestQuotaReclamationGCOpsForGCOps(t *testing.T) {
 		t.Fatalf("Last GCOp revision was unexpected: %d vs %d", g, e)
 	}
 }
+
+func checkReencryptedEntry(ctx context.Context, t *testing.T,
+	ops *folderBranchOps, n Node, keyGen KeyGen) {
+	de, err := ops.statEntry(ctx, n)
+	if err != nil {
+		t.Fatalf("Couldn't stat: %+v", err)
+	}
+	if de.KeyGen != keyGen {
+		t.Fatalf("Entry %s has key gen %d, expected %d",
+			ops.nodeCache.PathFromNode(n), de.KeyGen, keyGen)
+	}
+}
+
+// Test that background re-encryption rewrites all the non-empty
+// files and directories of a folder with the latest key generation,
+// without changing their contents or mtimes.
+func TestBackgroundReencryption(t *testing.T) {
+	var userName libkb.NormalizedUsername = "test_user"
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, userName)
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	clock := newTestClockNow()
+	config.SetClock(clock)
+
+	session, err := config.KBPKI().GetCurrentSession(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	AddDeviceForLocalUserOrBust(t, config, session.UID)
+
+	rootNode := GetRootNodeOrBust(
+		ctx, t, config, userName.String(), tlf.Private)
+	fb := rootNode.GetFolderBranch()
+	kbfsOps := config.KBFSOps()
+	dirA, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	if err != nil {
+		t.Fatalf("Couldn't create dir: %+v", err)
+	}
+	fileB, _, err := kbfsOps.CreateFile(ctx, dirA, "b", false, NoExcl)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %+v", err)
+	}
+	data := []byte("hello world")
+	err = kbfsOps.Write(ctx, fileB, data, 0)
+	if err != nil {
+		t.Fatalf("Couldn't write file: %+v", err)
+	}
+	dirC, _, err := kbfsOps.CreateDir(ctx, rootNode, "c")
+	if err != nil {
+		t.Fatalf("Couldn't create dir: %+v", err)
+	}
+	dirD, _, err := kbfsOps.CreateDir(ctx, dirC, "d")
+	if err != nil {
+		t.Fatalf("Couldn't create dir: %+v", err)
+	}
+	// A directory whose only child is read-only and has nothing to
+	// re-encrypt itself.
+	dirE, _, err := kbfsOps.CreateDir(ctx, rootNode, "e")
+	if err != nil {
+		t.Fatalf("Couldn't create dir: %+v", err)
+	}
+	fileF, _, err := kbfsOps.CreateFile(ctx, dirE, "f", false, NoExcl)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %+v", err)
+	}
+	config.SetOpsVersion(ModeAttrOpsVer)
+	err = kbfsOps.SetReadOnly(ctx, fileF, true)
+	if err != nil {
+		t.Fatalf("Couldn't set read-only: %+v", err)
+	}
+	err = kbfsOps.SyncAll(ctx, fb)
+	if err != nil {
+		t.Fatalf("Couldn't sync all: %v", err)
+	}
+	_, oldEI, err := kbfsOps.Lookup(ctx, dirA, "b")
+	if err != nil {
+		t.Fatalf("Couldn't lookup file: %+v", err)
+	}
+
+	ops := kbfsOps.(*KBFSOpsStandard).getOpsByNode(ctx, rootNode)
+	err = kbfsOps.SetBackgroundReencryption(ctx, fb, true)
+	if err != nil {
+		t.Fatalf("Couldn't enable re-encryption: %+v", err)
+	}
+	err = ops.fbm.waitForReencryption(ctx)
+	if err != nil {
+		t.Fatalf("Couldn't wait for re-encryption: %+v", err)
+	}
+	checkReencryptedEntry(ctx, t, ops, fileB, FirstValidKeyGen)
+
+	t.Log("Revoke the second device and rekey")
+	clock.Add(1 * time.Minute)
+	RevokeDeviceForLocalUserOrBust(t, config, session.UID, 1)
+	_, err = RequestRekeyAndWaitForOneFinishEvent(ctx, kbfsOps, fb.Tlf)
+	if err != nil {
+		t.Fatalf("Couldn't rekey: %+v", err)
+	}
+	newKeyGen := FirstValidKeyGen + 1
+	md, _ := ops.getHead(makeFBOLockState())
+	if keyGen := md.LatestKeyGeneration(); keyGen != newKeyGen {
+		t.Fatalf("Unexpected key gen after rekey: %d", keyGen)
+	}
+
+	err = ops.fbm.waitForReencryption(ctx)
+	if err != nil {
+		t.Fatalf("Couldn't wait for re-encryption: %+v", err)
+	}
+
+	md, _ = ops.getHead(makeFBOLockState())
+	if md.data.Dir.KeyGen != newKeyGen {
+		t.Fatalf("Root has key gen %d", md.data.Dir.KeyGen)
+	}
+	checkReencryptedEntry(ctx, t, ops, dirA, newKeyGen)
+	checkReencryptedEntry(ctx, t, ops, fileB, newKeyGen)
+	checkReencryptedEntry(ctx, t, ops, dirC, newKeyGen)
+	checkReencryptedEntry(ctx, t, ops, dirD, newKeyGen)
+	checkReencryptedEntry(ctx, t, ops, dirE, newKeyGen)
+
+	_, newEI, err := kbfsOps.Lookup(ctx, dirA, "b")
+	if err != nil {
+		t.Fatalf("Couldn't lookup file: %+v", err)
+	}
+	if newEI.Mtime != oldEI.Mtime {
+		t.Fatalf("Mtime changed from %d to %d", oldEI.Mtime, newEI.Mtime)
+	}
+	gotData := make([]byte, len(data))
+	n, err := kbfsOps.Read(ctx, fileB, gotData, 0)
+	if err != nil {
+		t.Fatalf("Couldn't read file: %+v", err)
+	}
+	if !bytes.Equal(data, gotData[:n]) {
+		t.Fatalf("Read %q, expected %q", gotData[:n], data)
+	}
+
+	status, _, err := kbfsOps.FolderStatus(ctx, fb)
+	if err != nil {
+		t.Fatalf("Couldn't get status: %+v", err)
+	}
+	if status.Reencryption == nil {
+		t.Fatal("No re-encryption status")
+	}
+	expectedStatus := ReencryptionStatus{
+		TargetKeyGen:       newKeyGen,
+		EntriesChecked:     6,
+		EntriesReencrypted: 3,
+	}
+	if *status.Reencryption != expectedStatus {
+		t.Fatalf("Unexpected re-encryption status: %+v",
+			*status.Reencryption)
+	}
+
+	t.Log("Re-encryption writes fail during a transaction")
+	err = kbfsOps.BeginTransaction(ctx, fb)
+	if err != nil {
+		t.Fatalf("Couldn't begin transaction: %+v", err)
+	}
+	lState := makeFBOLockState()
+	md, _ = ops.getHead(lState)
+	_, err = ops.rewriteForReencryption(
+		ctx, lState, md.ReadOnly(), fileB, data, 0, newEI.Mtime)
+	if _, ok := errors.Cause(err).(TransactionInProgressError); !ok {
+		t.Fatalf("Unexpected error during a transaction: %+v", err)
+	}
+	err = kbfsOps.AbortTransaction(ctx, fb)
+	if err != nil {
+		t.Fatalf("Couldn't abort transaction: %+v", err)
+	}
+
+	t.Log("A restarted client keeps re-encrypting")
+	config2 := ConfigAsUser(config, userName)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+	rootNode2 := GetRootNodeOrBust(
+		ctx, t, config2, userName.String(), tlf.Private)
+	ops2 := config2.KBFSOps().(*KBFSOpsStandard).getOpsByNode(ctx, rootNode2)
+	err = ops2.fbm.waitForReencryption(ctx)
+	if err != nil {
+		t.Fatalf("Couldn't wait for re-encryption: %+v", err)
+	}
+	ops2.fbm.reencryptLock.Lock()
+	enabled := ops2.fbm.reencryptEnabled
+	reencryptedKeyGen := ops2.fbm.reencryptedKeyGen
+	ops2.fbm.reencryptLock.Unlock()
+	if !enabled || reencryptedKeyGen != newKeyGen {
+		t.Fatalf("Restarted client has re-encryption enabled=%t at "+
+			"key gen %d", enabled, reencryptedKeyGen)
+	}
+}
@@ -260,6 +260,10 @@ type folderBlockOps struct {
 	// call PathFromNode() only under blockLock (see nodeCache
 	// comments in folder_branch_ops.go).
 	nodeCache NodeCache
+
+	// readAhead detects sequential reads, and is goroutine-safe on
+	// its own.
+	readAhead *readAheadTracker
 }
 
 // Only exported methods of folderBlockOps should be used outside of this
@@ -405,14 +409,17 @@ func (fbo *folderBlockOps) getBlockHelperLocked(ctx context.Context,
 	// fetch the block, and add to cache
 	block := newBlock()
 	bops := fbo.config.BlockOps()
+	getCtx := startSpan(ctx, "folderBlockOps.getBlock",
+		spanAttrTLF(fbo.id()), spanAttrBlockID(ptr.ID))
 	var err error
 	if rtype != blockReadParallel && rtype != blockLookup {
 		fbo.blockLock.DoRUnlockedIfPossible(lState, func(*lockState) {
-			err = bops.Get(ctx, kmd, ptr, block, lifetime)
+			err = bops.Get(getCtx, kmd, ptr, block, lifetime)
 		})
 	} else {
-		err = bops.Get(ctx, kmd, ptr, block, lifetime)
+		err = bops.Get(getCtx, kmd, ptr, block, lifetime)
 	}
+	finishSpan(getCtx, err)
 	if err != nil {
 		return nil, err
 	}
@@ -1073,6 +1080,84 @@ func (fbo *folderBlockOps) RenameDirEntryInCache(lState *lockState,
 	}), nil
 }
 
+// ExchangeDirEntriesInCache swaps the entry named oldName in
+// oldParent, whose dir entry is oldDe, with the entry named newName
+// in newParent, whose dir entry is newDe, in the cache.  The given
+// entries should already have their new ctimes set.  It returns a
+// function that can be used to undo the effects of this cache change.
+func (fbo *folderBlockOps) ExchangeDirEntriesInCache(lState *lockState,
+	oldParent path, oldName string, oldDe DirEntry, newParent path,
+	newName string, newDe DirEntry) (dirCacheUndoFn, error) {
+	fbo.blockLock.Lock(lState)
+	defer fbo.blockLock.Unlock(lState)
+	if newParent.tailPointer() == oldParent.tailPointer() &&
+		oldName == newName {
+		// Noop
+		return nil, nil
+	}
+	// Remove each name first, so that a cached addition of a
+	// different entry type can't shadow the swapped-in entry.
+	var undoFns []func()
+	undoFns = append(undoFns,
+		fbo.removeDirEntryInCacheLocked(lState, oldParent, oldName,
+			DirEntry{}),
+		fbo.removeDirEntryInCacheLocked(lState, newParent, newName,
+			DirEntry{}),
+		fbo.addDirEntryInCacheLocked(lState, newParent, newName, oldDe),
+		fbo.addDirEntryInCacheLocked(lState, oldParent, oldName, newDe))
+	undoAll := func() {
+		for i := len(undoFns) - 1; i >= 0; i-- {
+			undoFns[i]()
+		}
+	}
+
+	newParentNode := fbo.nodeCache.Get(newParent.tailRef())
+	undoMove, err := fbo.nodeCache.Move(oldDe.Ref(), newParentNode, newName)
+	if err != nil {
+		undoAll()
+		return nil, err
+	}
+	if undoMove != nil {
+		undoFns = append(undoFns, undoMove)
+	}
+	oldParentNode := fbo.nodeCache.Get(oldParent.tailRef())
+	undoMove, err = fbo.nodeCache.Move(newDe.Ref(), oldParentNode, oldName)
+	if err != nil {
+		undoAll()
+		return nil, err
+	}
+	if undoMove != nil {
+		undoFns = append(undoFns, undoMove)
+	}
+
+	// Only the ctimes change on the entries themselves.
+	for _, de := range []DirEntry{oldDe, newDe} {
+		if de.Type == Sym {
+			// Symlinks are cached in their parent's addedSyms.
+			continue
+		}
+		ref := de.Ref()
+		cacheEntry, ok := fbo.deCache[ref]
+		cacheEntryCopy := cacheEntry.deepCopy()
+		if ok && cacheEntry.dirEntry.IsInitialized() {
+			cacheEntry.dirEntry.Ctime = de.Ctime
+		} else {
+			cacheEntry.dirEntry = de
+		}
+		fbo.deCache[ref] = cacheEntry
+		if ok {
+			undoFns = append(undoFns, func() {
+				fbo.deCache[ref] = cacheEntryCopy
+			})
+		} else {
+			undoFns = append(undoFns, func() {
+				delete(fbo.deCache, ref)
+			})
+		}
+	}
+	return fbo.wrapWithBlockLock(undoAll), nil
+}
+
 func (fbo *folderBlockOps) setCachedAttrLocked(
 	lState *lockState, ref BlockRef, attr attrChange, realEntry *DirEntry,
 	doCreate bool) {
@@ -1090,6 +1175,9 @@ func (fbo *folderBlockOps) setCachedAttrLocked(
 		fileEntry.dirEntry.Type = realEntry.Type
 	case mtimeAttr:
 		fileEntry.dirEntry.Mtime = realEntry.Mtime
+	case modeAttr:
+		fileEntry.dirEntry.Type = realEntry.Type
+		fileEntry.dirEntry.Mode = realEntry.Mode
 	}
 	fileEntry.dirEntry.Ctime = realEntry.Ctime
 	fbo.deCache[ref] = fileEntry
@@ -1439,6 +1527,32 @@ func (fbo *folderBlockOps) GetDirtyEntryEvenIfDeleted(
 	return fbo.getDirtyEntryLocked(ctx, lState, kmd, file, true)
 }
 
+// GetSyncedFileSize returns the size of the given file as of its
+// last sync, ignoring any outstanding writes or truncates.  A file
+// that has never been synced has size 0. file must have a valid
+// parent.
+func (fbo *folderBlockOps) GetSyncedFileSize(
+	ctx context.Context, lState *lockState, kmd KeyMetadata,
+	file path) (uint64, error) {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+
+	if !file.hasValidParent() {
+		return 0, InvalidParentPathError{file}
+	}
+	// Skip the cached dirty entries, which track the unsynced size.
+	dblock, err := fbo.getDirLocked(
+		ctx, lState, kmd, *file.parentPath(), blockRead)
+	if err != nil {
+		return 0, err
+	}
+	de, ok := dblock.Children[file.tailName()]
+	if !ok || de.BlockPointer != file.tailPointer() {
+		return 0, nil
+	}
+	return de.Size, nil
+}
+
 // UpdateDirtyEntry returns the possibly-dirty DirEntry of the given
 // file in its parent DirBlock. file doesn't need to have a valid
 // parent (i.e., it could be the root dir).
@@ -1785,7 +1899,74 @@ func (fbo *folderBlockOps) Read(
 
 	var id keybase1.UserOrTeamID // Data reads don't depend on the id.
 	fd := fbo.newFileData(lState, filePath, id, kmd)
-	return fd.read(ctx, dest, off)
+	n, err := fd.read(ctx, dest, off)
+	if err != nil {
+		return 0, err
+	}
+	if n > 0 {
+		fbo.readAheadLocked(ctx, lState, kmd, filePath, fd, off, n)
+	}
+	return n, nil
+}
+
+// readAheadLocked records a read of `n` bytes at `off` in `file`, and
+// if the file is being read sequentially, asks the block retrieval
+// queue for the blocks that are likely to be read next.  Errors are
+// only logged, since read-ahead is just an optimization.
+func (fbo *folderBlockOps) readAheadLocked(
+	ctx context.Context, lState *lockState, kmd KeyMetadata, file path,
+	fd *fileData, off, n int64) {
+	fbo.blockLock.AssertAnyLocked(lState)
+	if fbo.readAhead == nil {
+		return
+	}
+
+	ptr := file.tailPointer()
+	start, end := fbo.readAhead.update(ptr.Ref(), off, n)
+	if start == end {
+		return
+	}
+	// Dirty files may point to blocks that aren't on the server yet.
+	if _, ok := fbo.dirtyFiles[ptr]; ok {
+		return
+	}
+
+	ptrs, err := fd.getLeafPtrsForOffsetRange(ctx, start, end)
+	if err != nil {
+		fbo.log.CDebugf(ctx, "Couldn't get read-ahead pointers for %v: %+v",
+			ptr, err)
+		return
+	} else if len(ptrs) == 0 {
+		return
+	}
+
+	retriever := fbo.config.BlockOps().BlockRetriever()
+	bcache := fbo.config.BlockCache()
+	issued := 0
+	for _, childPtr := range ptrs {
+		if _, err := bcache.Get(childPtr); err == nil {
+			continue
+		}
+		// Don't tie the requests to the reader's context, which
+		// will be canceled as soon as the read returns.
+		raCtx, cancel := context.WithTimeout(
+			context.Background(), prefetchTimeout)
+		errCh := retriever.Request(raCtx, readAheadPriority, kmd, childPtr,
+			&FileBlock{}, TransientEntry)
+		issued++
+		go func() {
+			defer cancel()
+			if err := <-errCh; err != nil {
+				fbo.log.CDebugf(raCtx, "Read-ahead of %v failed: %+v",
+					childPtr, err)
+			}
+		}()
+	}
+	if issued > 0 {
+		fbo.log.CDebugf(ctx, "Reading ahead %d blocks in [%d, %d) of %v",
+			issued, start, end, ptr)
+		fbo.readAhead.markIssued(issued)
+	}
 }
 
 func (fbo *folderBlockOps) maybeWaitOnDeferredWrites(
@@ -1992,19 +2173,53 @@ func (fbo *folderBlockOps) writeDataLocked(
 func (fbo *folderBlockOps) Write(
 	ctx context.Context, lState *lockState, kmd KeyMetadata,
 	file Node, data []byte, off int64) error {
+	_, err := fbo.writeHelper(ctx, lState, kmd, file, data, off, nil)
+	return err
+}
+
+// RewriteForReencryption writes the given data, which must have just
+// been read from the same range of the given file, back into the
+// file, so that the blocks it covers are re-encrypted with the
+// latest key generation on the next sync.  The file's mtime is left
+// as `mtime`.  If the file's mtime doesn't match `mtime` when the
+// block lock is taken, the file must have been changed concurrently,
+// so nothing is written and false is returned.
+func (fbo *folderBlockOps) RewriteForReencryption(
+	ctx context.Context, lState *lockState, kmd KeyMetadata,
+	file Node, data []byte, off int64, mtime int64) (bool, error) {
+	return fbo.writeHelper(ctx, lState, kmd, file, data, off, &mtime)
+}
+
+// restoreCachedMtimeLocked overrides the mtime of the given file's
+// cached dirty entry.
+func (fbo *folderBlockOps) restoreCachedMtimeLocked(
+	lState *lockState, file path, mtime int64) {
+	fbo.blockLock.AssertLocked(lState)
+	cacheEntry := fbo.deCache[file.tailRef()]
+	cacheEntry.dirEntry.Mtime = mtime
+	fbo.deCache[file.tailRef()] = cacheEntry
+}
+
+// writeHelper writes the given data to the given file.  If
+// `keepMtime` is non-nil, the write only happens if the file's
+// current mtime matches it, and the mtime is left unchanged by the
+// write.  It returns whether the write happened.
+func (fbo *folderBlockOps) writeHelper(
+	ctx context.Context, lState *lockState, kmd KeyMetadata,
+	file Node, data []byte, off int64, keepMtime *int64) (bool, error) {
 	// If there is too much unflushed data, we should wait until some
 	// of it gets flush so our memory usage doesn't grow without
 	// bound.
 	c, err := fbo.config.DirtyBlockCache().RequestPermissionToDirty(ctx,
 		fbo.id(), int64(len(data)))
 	if err != nil {
-		return err
+		return false, err
 	}
 	defer fbo.config.DirtyBlockCache().UpdateUnsyncedBytes(fbo.id(),
 		-int64(len(data)), false)
 	err = fbo.maybeWaitOnDeferredWrites(ctx, lState, file, c)
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	fbo.blockLock.Lock(lState)
@@ -2012,7 +2227,19 @@ func (fbo *folderBlockOps) Write(
 
 	filePath, err := fbo.pathFromNodeForBlockWriteLocked(lState, file)
 	if err != nil {
-		return err
+		return false, err
+	}
+
+	if keepMtime != nil {
+		de, err := fbo.getDirtyEntryLocked(ctx, lState, kmd, filePath, true)
+		if err != nil {
+			return false, err
+		}
+		if de.Mtime != *keepMtime {
+			fbo.log.CDebugf(ctx, "File %v changed concurrently; not "+
+				"rewriting it", filePath.tailPointer())
+			return false, nil
+		}
 	}
 
 	defer func() {
@@ -2022,7 +2249,10 @@ func (fbo *folderBlockOps) Write(
 	latestWrite, dirtyPtrs, newlyDirtiedChildBytes, err := fbo.writeDataLocked(
 		ctx, lState, kmd, filePath, data, off)
 	if err != nil {
-		return err
+		return false, err
+	}
+	if keepMtime != nil {
+		fbo.restoreCachedMtimeLocked(lState, filePath, *keepMtime)
 	}
 
 	fbo.observers.localChange(ctx, file, latestWrite)
@@ -2053,13 +2283,16 @@ func (fbo *folderBlockOps) Write(
 				// deferred, so no need to check the new ptrs.
 				_, _, _, err = fbo.writeDataLocked(
 					ctx, lState, kmd, f, dataCopy, off)
+				if err == nil && keepMtime != nil {
+					fbo.restoreCachedMtimeLocked(lState, f, *keepMtime)
+				}
 				return err
 			})
 		ds.waitBytes += newlyDirtiedChildBytes
 		fbo.deferred[filePath.tailRef()] = ds
 	}
 
-	return nil
+	return true, nil
 }
 
 // truncateExtendLocked is called by truncateLocked to extend a file and
@@ -2330,6 +2563,46 @@ func (fbo *folderBlockOps) ClearCacheInfo(lState *lockState, file path) error {
 	return fbo.clearCacheInfoLocked(lState, file)
 }
 
+// DiscardAllDirtyState throws away all unsynced writes, truncates
+// and directory changes in this folder, including the dirty blocks
+// of newly-created entries.  The caller must hold mdWriterLock, so
+// that no sync is in progress, and must then bring the node cache
+// back in line with the current head.
+func (fbo *folderBlockOps) DiscardAllDirtyState(lState *lockState) error {
+	fbo.blockLock.Lock(lState)
+	defer fbo.blockLock.Unlock(lState)
+
+	dirtyBcache := fbo.config.DirtyBlockCache()
+	for ptr, df := range fbo.dirtyFiles {
+		for _, dirtyPtr := range df.dirtyPointers() {
+			err := dirtyBcache.Delete(fbo.id(), dirtyPtr, fbo.branch())
+			if err != nil {
+				return err
+			}
+		}
+		err := df.finishSync()
+		if err != nil {
+			return err
+		}
+		delete(fbo.dirtyFiles, ptr)
+	}
+	// Dirty directories, and new entries, are cached under the
+	// pointers of their nodes.
+	for _, n := range fbo.nodeCache.AllNodes() {
+		ptr := fbo.nodeCache.PathFromNode(n).tailPointer()
+		err := dirtyBcache.Delete(fbo.id(), ptr, fbo.branch())
+		if err != nil {
+			return err
+		}
+	}
+
+	fbo.deCache = make(map[BlockRef]deCacheEntry)
+	fbo.unrefCache = make(map[BlockRef]*syncInfo)
+	fbo.deferred = make(map[BlockRef]deferredState)
+	fbo.doDeferWrite = false
+	return nil
+}
+
 // revertSyncInfoAfterRecoverableError updates the saved sync info to
 // include all the blocks from before the error, except for those that
 // have encountered recoverable block errors themselves.
@@ -2397,6 +2670,12 @@ func ReadyBlock(ctx context.Context, bcache BlockCache, bops BlockOps,
 		if err != nil {
 			return
 		}
+		if ptr.IsInitialized() && ptr.KeyGen < kmd.LatestKeyGeneration() {
+			// Don't reuse blocks encrypted with an old key
+			// generation, so that rewritten data always ends up
+			// encrypted with the latest key.
+			ptr = BlockPointer{}
+		}
 	} else if dBlock, ok := block.(*DirBlock); ok {
 		if dBlock.IsInd {
 			panic("Indirect directory blocks aren't supported yet")
@@ -2422,10 +2701,16 @@ func ReadyBlock(ctx context.Context, bcache BlockCache, bops BlockOps,
 		// In case we're deduping an old pointer with an unknown block type.
 		ptr.DirectType = directType
 	} else {
+		dataVer := block.DataVersion()
+		if readyBlockData.encryptionVer == EncryptionAESGCM {
+			// Clients that don't understand AES-GCM blocks must
+			// not try to read this one.
+			dataVer = AEADEncryptionDataVer
+		}
 		ptr = BlockPointer{
 			ID:         bid,
 			KeyGen:     kmd.LatestKeyGeneration(),
-			DataVer:    block.DataVersion(),
+			DataVer:    dataVer,
 			DirectType: directType,
 			Context:    kbfsblock.MakeFirstContext(chargedTo, bType),
 		}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"os"
 	"reflect"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -89,6 +90,9 @@ const (
 	// If it's been more than this long since our last update, check
 	// the current head before downloading all of the new revisions.
 	fastForwardTimeThresh = 15 * time.Minute
+	// A transaction that is still open after this long is aborted,
+	// in case the client that began it has gone away.
+	transactionTimeout = 10 * time.Minute
 	// If there are more than this many new revisions, fast forward
 	// rather than downloading them all.
 	fastForwardRevThresh = 50
@@ -248,6 +252,25 @@ type folderBranchOps struct {
 	// should only be taken in the following order to avoid deadlock:
 	mdWriterLock leveledMutex // taken by any method making MD modifications
 	dirOps       []cachedDirOp
+	// dirsToRewrite holds directories whose blocks must be
+	// rewritten by the next sync, even though nothing in them
+	// changed.  Protected by mdWriterLock.
+	dirsToRewrite map[NodeID]Node
+	// inTxn is true while a transaction is open, and only internal
+	// syncs may flush its changes.  txnGen counts transactions, so
+	// that txnTimer only aborts the one it was started for.
+	// txnExpired is set when txnTimer aborts a transaction, so that
+	// the following commit can say so.  Protected by mdWriterLock.
+	inTxn      bool
+	txnGen     uint64
+	txnTimer   *time.Timer
+	txnTimeout time.Duration
+	txnExpired bool
+	// reencryptWriteLock is held by each background re-encryption
+	// write from its transaction check until the write is done, and
+	// by BeginTransaction, so that re-encrypted data never ends up in
+	// a transaction.  It's taken before mdWriterLock.
+	reencryptWriteLock sync.Mutex
 
 	// protects access to head, headStatus, latestMergedRevision,
 	// and hasBeenCleared.
@@ -331,6 +354,15 @@ type folderBranchOps struct {
 
 	editHistory *TlfEditHistory
 
+	// Cached disk usage of the directories in this TLF.
+	dirUsage *dirUsageCache
+
+	// The local search index for this TLF, created when the TLF
+	// first becomes readable if it's kept on disk, or else the
+	// first time it's needed.
+	searchIndexLock sync.Mutex
+	searchIndex     *tlfSearchIndex
+
 	branchChanges      kbfssync.RepeatedWaitGroup
 	mdFlushes          kbfssync.RepeatedWaitGroup
 	forcedFastForwards kbfssync.RepeatedWaitGroup
@@ -403,6 +435,7 @@ func newFolderBranchOps(config Config, fb FolderBranch,
 			unrefCache: make(map[BlockRef]*syncInfo),
 			deCache:    make(map[BlockRef]deCacheEntry),
 			nodeCache:  nodeCache,
+			readAhead:  newReadAheadTracker(config.MetricsRegistry()),
 		},
 		nodeCache:       nodeCache,
 		log:             traceLogger{log},
@@ -411,6 +444,7 @@ func newFolderBranchOps(config Config, fb FolderBranch,
 		updatePauseChan: make(chan (<-chan struct{})),
 		forceSyncChan:   forceSyncChan,
 		syncNeededChan:  make(chan struct{}, 1),
+		txnTimeout:      transactionTimeout,
 	}
 	fbo.prepper = folderUpdatePrepper{
 		config:       config,
@@ -421,6 +455,8 @@ func newFolderBranchOps(config Config, fb FolderBranch,
 	fbo.cr = NewConflictResolver(config, fbo)
 	fbo.fbm = newFolderBlockManager(config, fb, fbo)
 	fbo.editHistory = NewTlfEditHistory(config, fbo, log)
+	fbo.dirUsage = newDirUsageCache(fbo)
+	observers.add(fbo.dirUsage)
 	fbo.rekeyFSM = NewRekeyFSM(fbo)
 	if config.DoBackgroundFlushes() {
 		go fbo.backgroundFlusher()
@@ -468,6 +504,11 @@ func (fbo *folderBranchOps) Shutdown(ctx context.Context) error {
 	fbo.cr.Shutdown()
 	fbo.fbm.shutdown()
 	fbo.editHistory.Shutdown()
+	fbo.searchIndexLock.Lock()
+	if fbo.searchIndex != nil {
+		fbo.searchIndex.shutdown()
+	}
+	fbo.searchIndexLock.Unlock()
 	fbo.rekeyFSM.Shutdown()
 	// Wait for the update goroutine to finish, so that we don't have
 	// any races with logging during test reporting.
@@ -504,6 +545,24 @@ func (fbo *folderBranchOps) AddFavorite(ctx context.Context,
 	return errors.New("AddFavorite is not supported by folderBranchOps")
 }
 
+func (fbo *folderBranchOps) TransferAcrossFolders(ctx context.Context,
+	id string, src, dest FolderPath, move bool) error {
+	return errors.New(
+		"TransferAcrossFolders is not supported by folderBranchOps")
+}
+
+func (fbo *folderBranchOps) CrossFolderTransferStatus(id string) (
+	CrossFolderTransferState, bool, error) {
+	return CrossFolderTransferState{}, false, errors.New(
+		"CrossFolderTransferStatus is not supported by folderBranchOps")
+}
+
+func (fbo *folderBranchOps) RollBackCrossFolderTransfer(
+	ctx context.Context, id string) error {
+	return errors.New(
+		"RollBackCrossFolderTransfer is not supported by folderBranchOps")
+}
+
 func (fbo *folderBranchOps) addToFavorites(ctx context.Context,
 	favorites *Favorites, created bool) (err error) {
 	lState := makeFBOLockState()
@@ -792,11 +851,24 @@ func (fbo *folderBranchOps) setHeadLocked(
 		return errors.New("Must swap in block changes before setting head")
 	}
 
+	rekeyed := !isFirstHead && md.MergedStatus() == Merged &&
+		md.LatestKeyGeneration() > fbo.head.LatestKeyGeneration()
 	fbo.head = md
 	if isFirstHead && headStatus == headTrusted {
 		fbo.headStatus = headTrusted
 	}
 	fbo.status.setRootMetadata(md)
+	if md.MergedStatus() == Merged {
+		fbo.fbm.maybeReencrypt(
+			md.BackgroundReencryption(), md.LatestKeyGeneration())
+	}
+	if rekeyed {
+		// A new key generation usually means a device or member was
+		// removed, so drop the keys cached on disk; the ones this
+		// device can still get will be cached again next time
+		// they're fetched from the server.
+		deleteTLFCryptKeysFromDiskMDCache(ctx, fbo.config, fbo.log, fbo.id())
+	}
 	if isFirstHead {
 		// Start registering for updates right away, using this MD
 		// as a starting point. For now only the master branch can
@@ -811,6 +883,17 @@ func (fbo *folderBranchOps) setHeadLocked(
 		// which may indicate that a rekey successfully took place.
 		fbo.config.Reporter().Notify(ctx, mdReadSuccessNotification(
 			md.GetTlfHandle(), md.TlfID().Type() == tlf.Public))
+
+		// Start indexing the folder as soon as it can be read, so
+		// the first search doesn't have to wait for the whole
+		// walk.  Only do it when the index is kept on disk, where
+		// it's only rebuilt if it's out of date; an in-memory
+		// index is built by the first search instead.
+		if fbo.branch() == MasterBranch &&
+			fbo.config.Mode() != InitMinimal &&
+			fbo.config.StorageRoot() != "" {
+			go fbo.startSearchIndex(md)
+		}
 	}
 	return nil
 }
@@ -1229,6 +1312,13 @@ func (fbo *folderBranchOps) getMDForWriteLockedForFilename(
 		return ImmutableRootMetadata{}, err
 	}
 
+	if md.fromDiskCache && !TLFJournalEnabled(fbo.config, fbo.id()) {
+		md, err = fbo.refreshHeadFromDiskCacheLocked(ctx, lState)
+		if err != nil {
+			return ImmutableRootMetadata{}, err
+		}
+	}
+
 	session, err := fbo.config.KBPKI().GetCurrentSession(ctx)
 	if err != nil {
 		return ImmutableRootMetadata{}, err
@@ -1245,6 +1335,33 @@ func (fbo *folderBranchOps) getMDForWriteLockedForFilename(
 	return md, nil
 }
 
+// refreshHeadFromDiskCacheLocked catches the head up with the MD
+// server, when it was read from the disk MD cache while the server
+// was unreachable.  Until that succeeds, writes aren't allowed
+// (unless they're journaled), since they could conflict with
+// revisions this device hasn't seen.
+func (fbo *folderBranchOps) refreshHeadFromDiskCacheLocked(
+	ctx context.Context, lState *lockState) (ImmutableRootMetadata, error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	err := fbo.getAndApplyMDUpdates(ctx, lState, fbo.applyMDUpdatesLocked)
+	if err == nil && !fbo.config.MDServer().IsConnected() {
+		err = errors.New("MD server is not connected")
+	}
+	if err != nil {
+		return ImmutableRootMetadata{}, OfflineReadOnlyError{fbo.id(), err}
+	}
+
+	fbo.headLock.Lock(lState)
+	defer fbo.headLock.Unlock(lState)
+	if fbo.head.fromDiskCache {
+		fbo.log.CDebugf(ctx, "Cached head revision %d is up to date",
+			fbo.head.Revision())
+		fbo.head.fromDiskCache = false
+	}
+	return fbo.head, nil
+}
+
 func (fbo *folderBranchOps) getSuccessorMDForWriteLockedForFilename(
 	ctx context.Context, lState *lockState, filename string) (
 	*RootMetadata, error) {
@@ -1345,7 +1462,8 @@ func (fbo *folderBranchOps) maybeUnembedAndPutBlocks(ctx context.Context,
 
 	ptrsToDelete, err := doBlockPuts(ctx, fbo.config.BlockServer(),
 		fbo.config.BlockCache(), fbo.config.Reporter(), fbo.log, fbo.deferLog, md.TlfID(),
-		md.GetTlfHandle().GetCanonicalName(), *bps)
+		md.GetTlfHandle().GetCanonicalName(), *bps,
+		blockTransferControllersForTlf(fbo.config, md.TlfID()).Puts())
 	if err != nil {
 		return nil, err
 	}
@@ -1530,6 +1648,8 @@ func (fbo *folderBranchOps) initMDLocked(
 		if err != nil {
 			return err
 		}
+		putTLFCryptKeyInDiskMDCache(
+			ctx, fbo.config, fbo.log, md.TlfID(), keyGen, *tlfCryptKey)
 	}
 
 	return nil
@@ -1816,6 +1936,64 @@ func (fbo *folderBranchOps) GetDirChildren(ctx context.Context, dir Node) (
 	return children, nil
 }
 
+// GetDirUsage implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) GetDirUsage(ctx context.Context, dir Node) (
+	usage DirUsage, err error) {
+	fbo.log.CDebugf(ctx, "GetDirUsage %s", getNodeIDStr(dir))
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "GetDirUsage %s done: %+v",
+			getNodeIDStr(dir), err)
+	}()
+
+	err = fbo.checkNode(dir)
+	if err != nil {
+		return DirUsage{}, err
+	}
+
+	err = runUnlessCanceled(ctx, func() error {
+		lState := makeFBOLockState()
+
+		dirPath, err := fbo.pathFromNodeForRead(dir)
+		if err != nil {
+			return err
+		}
+
+		if fbo.nodeCache.IsUnlinked(dir) {
+			fbo.log.CDebugf(ctx, "Returning empty usage for "+
+				"unlinked directory %v", dirPath.tailPointer())
+			return nil
+		}
+
+		md, err := fbo.getMDForReadNeedIdentify(ctx, lState)
+		if err != nil {
+			return err
+		}
+
+		var encodedSize uint32
+		if dirPath.hasValidParent() {
+			de, err := fbo.blocks.GetDirtyEntry(
+				ctx, lState, md.ReadOnly(), dirPath)
+			if err != nil {
+				return err
+			}
+			if de.Type != Dir {
+				return NotDirError{dirPath}
+			}
+			encodedSize = de.EncodedSize
+		} else {
+			encodedSize = md.data.Dir.EncodedSize
+		}
+
+		usage, err = fbo.dirUsage.usage(
+			ctx, lState, md.ReadOnly(), dirPath, encodedSize)
+		return err
+	})
+	if err != nil {
+		return DirUsage{}, err
+	}
+	return usage, nil
+}
+
 func (fbo *folderBranchOps) Lookup(ctx context.Context, dir Node, name string) (
 	node Node, ei EntryInfo, err error) {
 	fbo.log.CDebugf(ctx, "Lookup %s %s", getNodeIDStr(dir), name)
@@ -2437,644 +2615,1962 @@ func (fbo *folderBranchOps) finalizeGCOp(ctx context.Context, gco *GCOp) (
 	return fbo.notifyBatchLocked(ctx, lState, irmd)
 }
 
-func checkDisallowedPrefixes(name string) error {
-	for _, prefix := range disallowedPrefixes {
-		if strings.HasPrefix(name, prefix) {
-			return DisallowedPrefixError{name, prefix}
-		}
-	}
-	return nil
+const (
+	// reencryptChunkSize is how much file data is read and rewritten
+	// at a time during background re-encryption.
+	reencryptChunkSize = 512 * 1024
+	// reencryptSyncThreshold is how many bytes may be rewritten
+	// during background re-encryption before the folder is synced.
+	reencryptSyncThreshold = 10 * 1024 * 1024
+	// reencryptStatusInterval is how many entries are checked by
+	// background re-encryption between folder status updates.
+	reencryptStatusInterval = 100
+)
+
+// reencryptState tracks a single background re-encryption pass.
+type reencryptState struct {
+	status        ReencryptionStatus
+	unsyncedBytes int
 }
 
-func (fbo *folderBranchOps) checkNewDirSize(ctx context.Context,
-	lState *lockState, md ReadOnlyRootMetadata,
-	dirPath path, newName string) error {
-	// Check that the directory isn't past capacity already.
-	var currSize uint64
-	if dirPath.hasValidParent() {
-		de, err := fbo.blocks.GetDirtyEntry(ctx, lState, md, dirPath)
+func (rs *reencryptState) targetKeyGen() KeyGen {
+	return rs.status.TargetKeyGen
+}
+
+// reencryptOldBlocks implements the fbmHelper interface for
+// folderBranchOps.  It rewrites every file and directory whose blocks
+// are encrypted with a key generation older than the latest one, and
+// syncs the results as normal revisions.  Empty files are left
+// alone, since they have no blocks.  It returns the key generation
+// that was targeted.
+func (fbo *folderBranchOps) reencryptOldBlocks(ctx context.Context) (
+	keyGen KeyGen, err error) {
+	if fbo.id().Type() == tlf.Public {
+		// Public folders aren't encrypted.
+		return PublicKeyGen, nil
+	}
+
+	lState := makeFBOLockState()
+	md, err := fbo.getMDForReadHelper(ctx, lState, mdReadNoIdentify)
+	if err != nil {
+		return KeyGen(0), err
+	}
+	if md.MergedStatus() != Merged {
+		return KeyGen(0), errors.New(
+			"Can't re-encrypt blocks while on an unmerged branch")
+	}
+
+	session, err := fbo.config.KBPKI().GetCurrentSession(ctx)
+	if err != nil {
+		return KeyGen(0), err
+	}
+	isWriter, err := md.IsWriter(ctx, fbo.config.KBPKI(), session.UID)
+	if err != nil {
+		return KeyGen(0), err
+	}
+	if !isWriter {
+		return KeyGen(0), NewWriteAccessError(md.GetTlfHandle(),
+			session.Name, md.GetTlfHandle().GetCanonicalPath())
+	}
+
+	rs := &reencryptState{
+		status: ReencryptionStatus{
+			TargetKeyGen: md.LatestKeyGeneration(),
+			InProgress:   true,
+		},
+	}
+	fbo.status.setReencryptionStatus(rs.status)
+	defer func() {
+		rs.status.InProgress = false
 		if err != nil {
-			return err
+			rs.status.LastErr = err.Error()
 		}
-		currSize = de.Size
-	} else {
-		// dirPath is just the root.
-		currSize = md.data.Dir.Size
+		fbo.status.setReencryptionStatus(rs.status)
+	}()
+
+	rootNode, _, _, err := fbo.getRootNode(ctx)
+	if err != nil {
+		return KeyGen(0), err
 	}
-	// Just an approximation since it doesn't include the size of the
-	// directory entry itself, but that's ok -- at worst it'll be an
-	// off-by-one-entry error, and since there's a maximum name length
-	// we can't get in too much trouble.
-	if currSize+uint64(len(newName)) > fbo.config.MaxDirBytes() {
-		return DirTooBigError{dirPath, currSize + uint64(len(newName)),
-			fbo.config.MaxDirBytes()}
+	_, err = fbo.reencryptDir(ctx, rs, rootNode, md.data.Dir.KeyGen)
+	if err != nil {
+		return KeyGen(0), err
 	}
-	return nil
+
+	err = fbo.SyncAll(ctx, fbo.folderBranch)
+	if err != nil {
+		return KeyGen(0), err
+	}
+	return rs.targetKeyGen(), nil
 }
 
-// PathType returns path type
-func (fbo *folderBranchOps) PathType() PathType {
-	switch fbo.folderBranch.Tlf.Type() {
-	case tlf.Public:
-		return PublicPathType
-	case tlf.Private:
-		return PrivatePathType
-	case tlf.SingleTeam:
-		return SingleTeamPathType
-	default:
-		panic(fmt.Sprintf("Unknown TLF type: %s", fbo.folderBranch.Tlf.Type()))
+// reencryptMaybeSync syncs the folder once enough data has been
+// rewritten since the last sync, to bound the amount of dirty data.
+func (fbo *folderBranchOps) reencryptMaybeSync(
+	ctx context.Context, rs *reencryptState, rewritten int) error {
+	rs.unsyncedBytes += rewritten
+	if rs.unsyncedBytes < reencryptSyncThreshold {
+		return nil
 	}
+	rs.unsyncedBytes = 0
+	return fbo.SyncAll(ctx, fbo.folderBranch)
 }
 
-// canonicalPath returns full canonical path for dir node and name.
-func (fbo *folderBranchOps) canonicalPath(ctx context.Context, dir Node, name string) (string, error) {
+// reencryptDir re-encrypts everything under the given directory,
+// whose own block uses `dirKeyGen`, and then the directory itself.
+// It returns whether anything was rewritten; if so, the directory's
+// block will also be rewritten by the next sync.
+func (fbo *folderBranchOps) reencryptDir(
+	ctx context.Context, rs *reencryptState, dir Node,
+	dirKeyGen KeyGen) (rewrote bool, err error) {
+	lState := makeFBOLockState()
+	md, err := fbo.getMDForReadHelper(ctx, lState, mdReadNoIdentify)
+	if err != nil {
+		return false, err
+	}
 	dirPath, err := fbo.pathFromNodeForRead(dir)
 	if err != nil {
-		return "", err
+		return false, err
 	}
-	return BuildCanonicalPath(fbo.PathType(), dirPath.String(), name), nil
-}
+	children, err := fbo.blocks.GetDirtyDirChildren(
+		ctx, lState, md.ReadOnly(), dirPath)
+	if err != nil {
+		return false, err
+	}
+	names := make([]string, 0, len(children))
+	for name := range children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
 
-func (fbo *folderBranchOps) signalWrite() {
-	select {
-	case fbo.syncNeededChan <- struct{}{}:
-	default:
+	for _, name := range names {
+		rs.status.EntriesChecked++
+		if rs.status.EntriesChecked%reencryptStatusInterval == 0 {
+			fbo.status.setReencryptionStatus(rs.status)
+		}
+
+		child, de, err := fbo.blocks.Lookup(
+			ctx, lState, md.ReadOnly(), dir, name)
+		if _, ok := err.(NoSuchNameError); ok {
+			// Removed concurrently.
+			continue
+		} else if err != nil {
+			return false, err
+		}
+
+		var childRewrote bool
+		switch de.Type {
+		case Sym:
+			continue
+		case Dir:
+			childRewrote, err = fbo.reencryptDir(ctx, rs, child, de.KeyGen)
+		default:
+			childRewrote, err = fbo.reencryptFile(ctx, rs, child)
+		}
+		if err != nil {
+			return false, err
+		}
+		rewrote = rewrote || childRewrote
 	}
-	// A local write always means any ongoing CR should be canceled,
-	// because the set of unmerged writes has changed.
-	fbo.cr.ForceCancel()
-}
 
-func (fbo *folderBranchOps) syncDirUpdateOrSignal(
-	ctx context.Context, lState *lockState) error {
-	if fbo.config.BGFlushDirOpBatchSize() == 1 {
-		return fbo.syncAllLocked(ctx, lState, NoExcl)
+	if rewrote || dirKeyGen >= rs.targetKeyGen() {
+		return rewrote, nil
 	}
-	fbo.signalWrite()
-	return nil
+
+	// Nothing under this directory needed rewriting, but the
+	// directory block itself does.
+	fbo.log.CDebugf(ctx, "Re-encrypting directory %v", dirPath.tailPointer())
+	err = fbo.markDirForRewrite(lState, dir)
+	if err != nil {
+		return false, err
+	}
+	rs.status.EntriesReencrypted++
+	return true, nil
 }
 
-func (fbo *folderBranchOps) checkForUnlinkedDir(dir Node) error {
-	// Disallow directory operations within an unlinked directory.
-	// Shells don't seem to allow it, and it will just pollute the dir
-	// entry cache with unsyncable entries.
-	if fbo.nodeCache.IsUnlinked(dir) {
-		dirPath := fbo.nodeCache.PathFromNode(dir).String()
-		return errors.WithStack(UnsupportedOpInUnlinkedDirError{dirPath})
+// markDirForRewrite makes the next sync rewrite the block of the
+// given directory, and those of its parents, without changing any of
+// their entries.  It fails while a transaction is open, since that
+// sync would be the transaction's.
+func (fbo *folderBranchOps) markDirForRewrite(
+	lState *lockState, dir Node) error {
+	fbo.mdWriterLock.Lock(lState)
+	defer fbo.mdWriterLock.Unlock(lState)
+	if err := fbo.checkNoTransactionLocked(lState); err != nil {
+		return err
+	}
+	if fbo.dirsToRewrite == nil {
+		fbo.dirsToRewrite = make(map[NodeID]Node)
 	}
+	fbo.dirsToRewrite[dir.GetID()] = dir
+	fbo.status.addDirtyNode(dir)
+	fbo.signalWrite()
 	return nil
 }
 
-// entryType must not by Sym.
-func (fbo *folderBranchOps) createEntryLocked(
-	ctx context.Context, lState *lockState, dir Node, name string,
-	entryType EntryType, excl Excl) (childNode Node, de DirEntry, err error) {
-	fbo.mdWriterLock.AssertLocked(lState)
+// rewriteForReencryption rewrites the given data of a file for
+// background re-encryption, with the checks a normal write would
+// need: it fails while a transaction is open, and it leaves
+// read-only files alone.  It returns whether the data was rewritten.
+func (fbo *folderBranchOps) rewriteForReencryption(
+	ctx context.Context, lState *lockState, kmd KeyMetadata, file Node,
+	data []byte, off int64, mtime int64) (bool, error) {
+	fbo.reencryptWriteLock.Lock()
+	defer fbo.reencryptWriteLock.Unlock()
 
-	if err := checkDisallowedPrefixes(name); err != nil {
-		return nil, DirEntry{}, err
+	if err := func() error {
+		fbo.mdWriterLock.Lock(lState)
+		defer fbo.mdWriterLock.Unlock(lState)
+		return fbo.checkNoTransactionLocked(lState)
+	}(); err != nil {
+		return false, err
 	}
 
-	if uint32(len(name)) > fbo.config.MaxNameBytes() {
-		return nil, DirEntry{},
-			NameTooLongError{name, fbo.config.MaxNameBytes()}
+	filePath, err := fbo.pathFromNodeForRead(file)
+	if err != nil {
+		return false, err
 	}
-
-	if err := fbo.checkForUnlinkedDir(dir); err != nil {
-		return nil, DirEntry{}, err
+	err = fbo.checkReadOnlyEntry(ctx, lState, kmd, filePath, "re-encrypt")
+	if _, ok := errors.Cause(err).(ReadOnlyEntryError); ok {
+		fbo.log.CDebugf(ctx, "File %v is read-only; not rewriting it",
+			filePath.tailPointer())
+		return false, nil
+	} else if err != nil {
+		return false, err
 	}
 
-	filename, err := fbo.canonicalPath(ctx, dir, name)
+	return fbo.blocks.RewriteForReencryption(
+		ctx, lState, kmd, file, data, off, mtime)
+}
+
+// fileNeedsReencryption returns whether any block of the given file
+// is encrypted with a key generation older than the target one.
+func (fbo *folderBranchOps) fileNeedsReencryption(
+	ctx context.Context, lState *lockState, kmd KeyMetadata,
+	rs *reencryptState, filePath path, de DirEntry) (bool, error) {
+	if de.KeyGen < rs.targetKeyGen() {
+		return true, nil
+	}
+	infos, err := fbo.blocks.GetIndirectFileBlockInfos(
+		ctx, lState, kmd, filePath)
 	if err != nil {
-		return nil, DirEntry{}, err
+		return false, err
+	}
+	for _, info := range infos {
+		if info.KeyGen < rs.targetKeyGen() {
+			return true, nil
+		}
 	}
+	return false, nil
+}
 
-	// Verify we have permission to write (but don't make a successor yet).
-	md, err := fbo.getMDForWriteLockedForFilename(ctx, lState, filename)
+// reencryptFile rewrites all the data of the given file if any of its
+// blocks need to be re-encrypted, leaving its mtime unchanged.  If
+// the file is changed concurrently, the rewrite stops early, since
+// the concurrent change will be synced with the latest key anyway,
+// and read-only files are skipped.
+// It returns whether anything was rewritten.
+func (fbo *folderBranchOps) reencryptFile(
+	ctx context.Context, rs *reencryptState, file Node) (bool, error) {
+	lState := makeFBOLockState()
+	md, err := fbo.getMDForReadHelper(ctx, lState, mdReadNoIdentify)
 	if err != nil {
-		return nil, DirEntry{}, err
+		return false, err
 	}
-
-	dirPath, err := fbo.pathFromNodeForMDWriteLocked(lState, dir)
+	filePath, err := fbo.pathFromNodeForRead(file)
 	if err != nil {
-		return nil, DirEntry{}, err
+		return false, err
 	}
-
-	// We're not going to modify this copy of the dirblock, so just
-	// fetch it for reading.
-	dblock, err := fbo.blocks.GetDirtyDir(
-		ctx, lState, md.ReadOnly(), dirPath, blockRead)
+	de, err := fbo.blocks.GetDirtyEntry(ctx, lState, md.ReadOnly(), filePath)
 	if err != nil {
-		return nil, DirEntry{}, err
+		return false, err
 	}
-
-	// does name already exist?
-	if _, ok := dblock.Children[name]; ok {
-		return nil, DirEntry{}, NameExistsError{name}
+	if de.Size == 0 {
+		return false, nil
 	}
-
-	if err := fbo.checkNewDirSize(
-		ctx, lState, md.ReadOnly(), dirPath, name); err != nil {
-		return nil, DirEntry{}, err
+	needed, err := fbo.fileNeedsReencryption(
+		ctx, lState, md.ReadOnly(), rs, filePath, de)
+	if err != nil || !needed {
+		return false, err
 	}
 
-	parentPtr := dirPath.tailPointer()
-	co, err := newCreateOp(name, parentPtr, entryType)
-	if err != nil {
-		return nil, DirEntry{}, err
+	fbo.log.CDebugf(ctx, "Re-encrypting file %v", filePath.tailPointer())
+	buf := make([]byte, reencryptChunkSize)
+	rewrote := false
+	for off := int64(0); off < int64(de.Size); off += reencryptChunkSize {
+		n, err := fbo.blocks.Read(ctx, lState, md.ReadOnly(), file, buf, off)
+		if err != nil {
+			return rewrote, err
+		}
+		if n == 0 {
+			break
+		}
+		ok, err := fbo.rewriteForReencryption(
+			ctx, lState, md.ReadOnly(), file, buf[:n], off, de.Mtime)
+		if err != nil {
+			return rewrote, err
+		}
+		if !ok {
+			break
+		}
+		if !rewrote {
+			rewrote = true
+			fbo.status.addDirtyNode(file)
+		}
+		fbo.signalWrite()
+		err = fbo.reencryptMaybeSync(ctx, rs, int(n))
+		if err != nil {
+			return rewrote, err
+		}
+	}
+	if rewrote {
+		rs.status.EntriesReencrypted++
+	}
+	return rewrote, nil
+}
+
+// SetBackgroundReencryption implements the KBFSOps interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) SetBackgroundReencryption(
+	ctx context.Context, folderBranch FolderBranch, enabled bool) (
+	err error) {
+	fbo.log.CDebugf(ctx, "SetBackgroundReencryption %t", enabled)
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "SetBackgroundReencryption done: %+v",
+			err)
+	}()
+
+	if folderBranch != fbo.folderBranch {
+		return WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+	if fbo.config.Mode() == InitMinimal || fbo.branch() != MasterBranch {
+		return errors.New(
+			"Background re-encryption is only supported on the master " +
+				"branch of a fully-initialized client")
+	}
+
+	// The new head turns re-encryption on or off in fbm, on this
+	// device and every other one that sees it.
+	return runUnlessCanceled(ctx, func() error {
+		lState := makeFBOLockState()
+		fbo.mdWriterLock.Lock(lState)
+		defer fbo.mdWriterLock.Unlock(lState)
+		return fbo.setBackgroundReencryptionLocked(ctx, lState, enabled)
+	})
+}
+
+func (fbo *folderBranchOps) setBackgroundReencryptionLocked(
+	ctx context.Context, lState *lockState, enabled bool) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	md, err := fbo.getSuccessorMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return err
+	}
+	if md.MergedStatus() == Unmerged {
+		// The setting would be lost when the branch is resolved.
+		return UnexpectedUnmergedPutError{}
+	}
+	if md.BackgroundReencryption() == enabled {
+		return nil
+	}
+
+	md.SetBackgroundReencryption(enabled)
+	// add an empty operation to satisfy assumptions elsewhere
+	md.AddOp(newRekeyOp())
+	return fbo.putMergedMDLocked(ctx, lState, md)
+}
+
+func (fbo *folderBranchOps) makeImmutableLocked(
+	ctx context.Context, lState *lockState) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	md, err := fbo.getSuccessorMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return err
+	}
+	if md.IsImmutableSet() {
+		return nil
+	}
+	if md.MergedStatus() == Unmerged {
+		// The bit would be lost when the branch is resolved.
+		return UnexpectedUnmergedPutError{}
+	}
+
+	md.SetImmutable()
+	// add an empty operation to satisfy assumptions elsewhere
+	md.AddOp(newRekeyOp())
+
+	// Like a rekey, the bit must never end up on a conflict branch.
+	return fbo.putMergedMDLocked(ctx, lState, md)
+}
+
+// putMergedMDLocked puts an MD that changes only folder-wide
+// metadata, and no blocks, as the next merged revision.  It waits for
+// the journal to flush and then pushes the MD straight to the server,
+// so the change can't be lost on a conflict branch.
+func (fbo *folderBranchOps) putMergedMDLocked(
+	ctx context.Context, lState *lockState, md *RootMetadata) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	mdOps := fbo.config.MDOps()
+	if jServer, err := GetJournalServer(fbo.config); err == nil {
+		if err = fbo.waitForJournalLocked(ctx, lState, jServer); err != nil {
+			return err
+		}
+		mdOps = jServer.delegateMDOps
+	}
+
+	session, err := fbo.config.KBPKI().GetCurrentSession(ctx)
+	if err != nil {
+		return err
+	}
+	oldPrevRoot := md.PrevRoot()
+	irmd, err := mdOps.Put(ctx, md, session.VerifyingKey)
+	if err != nil {
+		return err
+	}
+
+	fbo.setBranchIDLocked(lState, NullBranchID)
+	rebased := (oldPrevRoot != md.PrevRoot())
+	if rebased {
+		bid := md.BID()
+		fbo.setBranchIDLocked(lState, bid)
+		fbo.cr.Resolve(ctx, md.Revision(), kbfsmd.RevisionUninitialized)
+	}
+	md.loadCachedBlockChanges(ctx, nil, fbo.log)
+
+	fbo.headLock.Lock(lState)
+	defer fbo.headLock.Unlock(lState)
+	err = fbo.setHeadSuccessorLocked(ctx, lState, irmd, rebased)
+	if err != nil {
+		return err
+	}
+	fbo.setLatestMergedRevisionLocked(ctx, lState, md.Revision(), false)
+	return nil
+}
+
+// MakeImmutable implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) MakeImmutable(
+	ctx context.Context, folderBranch FolderBranch) (err error) {
+	fbo.log.CDebugf(ctx, "MakeImmutable")
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "MakeImmutable done: %+v", err)
+	}()
+
+	if folderBranch != fbo.folderBranch {
+		return WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	return runUnlessCanceled(ctx, func() error {
+		lState := makeFBOLockState()
+		fbo.mdWriterLock.Lock(lState)
+		defer fbo.mdWriterLock.Unlock(lState)
+
+		// Older clients ignore the immutable flag, and would keep
+		// changing the folder's data.
+		if v := fbo.config.OpsVersion(); v < ImmutableOpsVer {
+			return OpsVersionTooLowError{
+				"MakeImmutable", ImmutableOpsVer, v}
+		}
+		err := fbo.checkNoTransactionLocked(lState)
+		if err != nil {
+			return err
+		}
+		// Flush any outstanding writes first, so they aren't
+		// subject to the new restrictions.
+		err = fbo.syncAllLocked(ctx, lState, NoExcl)
+		if err != nil {
+			return err
+		}
+		return fbo.makeImmutableLocked(ctx, lState)
+	})
+}
+
+func (fbo *folderBranchOps) setRetentionPolicyLocked(
+	ctx context.Context, lState *lockState, policy *RetentionPolicy) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	md, err := fbo.getSuccessorMDForWriteLocked(ctx, lState)
+	if err != nil {
+		return err
+	}
+	if md.MergedStatus() == Unmerged {
+		// The policy would be lost when the branch is resolved.
+		return UnexpectedUnmergedPutError{}
+	}
+	if old := md.RetentionPolicy(); (old == nil && policy == nil) ||
+		(old != nil && policy != nil && *old == *policy) {
+		return nil
+	}
+
+	md.SetRetentionPolicy(policy)
+	// add an empty operation to satisfy assumptions elsewhere
+	md.AddOp(newRekeyOp())
+	return fbo.putMergedMDLocked(ctx, lState, md)
+}
+
+// SetRetentionPolicy implements the KBFSOps interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) SetRetentionPolicy(
+	ctx context.Context, folderBranch FolderBranch,
+	policy *RetentionPolicy) (err error) {
+	fbo.log.CDebugf(ctx, "SetRetentionPolicy %+v", policy)
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "SetRetentionPolicy done: %+v", err)
+	}()
+
+	if folderBranch != fbo.folderBranch {
+		return WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	return runUnlessCanceled(ctx, func() error {
+		lState := makeFBOLockState()
+		fbo.mdWriterLock.Lock(lState)
+		defer fbo.mdWriterLock.Unlock(lState)
+		err := fbo.checkNoTransactionLocked(lState)
+		if err != nil {
+			return err
+		}
+		err = fbo.setRetentionPolicyLocked(ctx, lState, policy)
+		if err != nil {
+			return err
+		}
+		// Let quota reclamation pick up the new policy right away.
+		fbo.fbm.forceQuotaReclamation()
+		return nil
+	})
+}
+
+// checkImmutableFileChange returns an ImmutableFolderError if md
+// belongs to a write-once, read-many folder, and a change to the
+// given file starting at offset `off` would alter data that has
+// already been synced.  Appending past the synced end of the file is
+// allowed.
+func (fbo *folderBranchOps) checkImmutableFileChange(
+	ctx context.Context, lState *lockState, md ReadOnlyRootMetadata,
+	file Node, off uint64, opName string) error {
+	if !md.IsImmutableSet() {
+		return nil
+	}
+	filePath, err := fbo.pathFromNodeForRead(file)
+	if err != nil {
+		return err
+	}
+	size, err := fbo.blocks.GetSyncedFileSize(ctx, lState, md, filePath)
+	if err != nil {
+		return err
+	}
+	if off < size {
+		return ImmutableFolderError{opName, filePath.String()}
+	}
+	return nil
+}
+
+// checkReadOnlyEntry returns a ReadOnlyEntryError if the entry at
+// `p` has been marked read-only.  The root directory has no entry,
+// so it is never read-only.
+func (fbo *folderBranchOps) checkReadOnlyEntry(
+	ctx context.Context, lState *lockState, kmd KeyMetadata, p path,
+	opName string) error {
+	if !p.hasValidParent() {
+		return nil
+	}
+	de, err := fbo.blocks.GetDirtyEntryEvenIfDeleted(ctx, lState, kmd, p)
+	if err != nil {
+		return err
+	}
+	if de.Mode.IsReadOnly() {
+		return ReadOnlyEntryError{opName, p.String()}
+	}
+	return nil
+}
+
+func checkDisallowedPrefixes(name string) error {
+	for _, prefix := range disallowedPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return DisallowedPrefixError{name, prefix}
+		}
+	}
+	return nil
+}
+
+func (fbo *folderBranchOps) checkNewDirSize(ctx context.Context,
+	lState *lockState, md ReadOnlyRootMetadata,
+	dirPath path, newName string) error {
+	// Check that the directory isn't past capacity already.
+	var currSize uint64
+	if dirPath.hasValidParent() {
+		de, err := fbo.blocks.GetDirtyEntry(ctx, lState, md, dirPath)
+		if err != nil {
+			return err
+		}
+		currSize = de.Size
+	} else {
+		// dirPath is just the root.
+		currSize = md.data.Dir.Size
+	}
+	// Just an approximation since it doesn't include the size of the
+	// directory entry itself, but that's ok -- at worst it'll be an
+	// off-by-one-entry error, and since there's a maximum name length
+	// we can't get in too much trouble.
+	if currSize+uint64(len(newName)) > fbo.config.MaxDirBytes() {
+		return DirTooBigError{dirPath, currSize + uint64(len(newName)),
+			fbo.config.MaxDirBytes()}
+	}
+	return nil
+}
+
+// PathType returns path type
+func (fbo *folderBranchOps) PathType() PathType {
+	switch fbo.folderBranch.Tlf.Type() {
+	case tlf.Public:
+		return PublicPathType
+	case tlf.Private:
+		return PrivatePathType
+	case tlf.SingleTeam:
+		return SingleTeamPathType
+	default:
+		panic(fmt.Sprintf("Unknown TLF type: %s", fbo.folderBranch.Tlf.Type()))
+	}
+}
+
+// canonicalPath returns full canonical path for dir node and name.
+func (fbo *folderBranchOps) canonicalPath(ctx context.Context, dir Node, name string) (string, error) {
+	dirPath, err := fbo.pathFromNodeForRead(dir)
+	if err != nil {
+		return "", err
+	}
+	return BuildCanonicalPath(fbo.PathType(), dirPath.String(), name), nil
+}
+
+func (fbo *folderBranchOps) signalWrite() {
+	select {
+	case fbo.syncNeededChan <- struct{}{}:
+	default:
+	}
+	// A local write always means any ongoing CR should be canceled,
+	// because the set of unmerged writes has changed.
+	fbo.cr.ForceCancel()
+}
+
+func (fbo *folderBranchOps) syncDirUpdateOrSignal(
+	ctx context.Context, lState *lockState) error {
+	if fbo.config.BGFlushDirOpBatchSize() == 1 && !fbo.inTxn {
+		return fbo.syncAllLocked(ctx, lState, NoExcl)
+	}
+	fbo.signalWrite()
+	return nil
+}
+
+func (fbo *folderBranchOps) checkForUnlinkedDir(dir Node) error {
+	// Disallow directory operations within an unlinked directory.
+	// Shells don't seem to allow it, and it will just pollute the dir
+	// entry cache with unsyncable entries.
+	if fbo.nodeCache.IsUnlinked(dir) {
+		dirPath := fbo.nodeCache.PathFromNode(dir).String()
+		return errors.WithStack(UnsupportedOpInUnlinkedDirError{dirPath})
+	}
+	return nil
+}
+
+// entryType must not by Sym.
+func (fbo *folderBranchOps) createEntryLocked(
+	ctx context.Context, lState *lockState, dir Node, name string,
+	entryType EntryType, excl Excl) (childNode Node, de DirEntry, err error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	if err := checkDisallowedPrefixes(name); err != nil {
+		return nil, DirEntry{}, err
+	}
+
+	if uint32(len(name)) > fbo.config.MaxNameBytes() {
+		return nil, DirEntry{},
+			NameTooLongError{name, fbo.config.MaxNameBytes()}
+	}
+
+	if err := fbo.checkForUnlinkedDir(dir); err != nil {
+		return nil, DirEntry{}, err
+	}
+
+	if excl == WithExcl {
+		// An exclusive create syncs right away.
+		if err := fbo.checkNoTransactionLocked(lState); err != nil {
+			return nil, DirEntry{}, err
+		}
+	}
+
+	filename, err := fbo.canonicalPath(ctx, dir, name)
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+
+	// Verify we have permission to write (but don't make a successor yet).
+	md, err := fbo.getMDForWriteLockedForFilename(ctx, lState, filename)
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+
+	dirPath, err := fbo.pathFromNodeForMDWriteLocked(lState, dir)
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+
+	err = fbo.checkReadOnlyEntry(
+		ctx, lState, md.ReadOnly(), dirPath, "create")
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+
+	// We're not going to modify this copy of the dirblock, so just
+	// fetch it for reading.
+	dblock, err := fbo.blocks.GetDirtyDir(
+		ctx, lState, md.ReadOnly(), dirPath, blockRead)
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+
+	// does name already exist?
+	if _, ok := dblock.Children[name]; ok {
+		return nil, DirEntry{}, NameExistsError{name}
+	}
+
+	if err := fbo.checkNewDirSize(
+		ctx, lState, md.ReadOnly(), dirPath, name); err != nil {
+		return nil, DirEntry{}, err
+	}
+
+	parentPtr := dirPath.tailPointer()
+	co, err := newCreateOp(name, parentPtr, entryType)
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+	co.setFinalPath(dirPath)
+	// create new data block
+	var newBlock Block
+	if entryType == Dir {
+		newBlock = &DirBlock{
+			Children: make(map[string]DirEntry),
+		}
+	} else {
+		newBlock = &FileBlock{}
+	}
+
+	// Cache update and operations until batch happens.  Make a new
+	// temporary ID and directory entry.
+	newID, err := fbo.config.cryptoPure().MakeTemporaryBlockID()
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+
+	chargedTo, err := chargedToForTLF(
+		ctx, fbo.config.KBPKI(), md.GetTlfHandle())
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+
+	newPtr := BlockPointer{
+		ID:         newID,
+		KeyGen:     md.LatestKeyGeneration(),
+		DataVer:    fbo.config.DataVersion(),
+		DirectType: DirectBlock,
+		Context: kbfsblock.MakeFirstContext(
+			chargedTo, keybase1.BlockType_DATA),
+	}
+	co.AddRefBlock(newPtr)
+	co.AddSelfUpdate(parentPtr)
+
+	node, err := fbo.nodeCache.GetOrCreate(newPtr, name, dir)
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+
+	err = fbo.config.DirtyBlockCache().Put(
+		fbo.id(), newPtr, fbo.branch(), newBlock)
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+
+	now := fbo.nowUnixNano()
+	de = DirEntry{
+		BlockInfo: BlockInfo{
+			BlockPointer: newPtr,
+			EncodedSize:  0,
+		},
+		EntryInfo: EntryInfo{
+			Type:  entryType,
+			Size:  0,
+			Mtime: now,
+			Ctime: now,
+		},
+	}
+
+	dirCacheUndoFn := fbo.blocks.AddDirEntryInCache(lState, dirPath, name, de)
+	fbo.dirOps = append(fbo.dirOps, cachedDirOp{co, []Node{dir, node}})
+	added := fbo.status.addDirtyNode(dir)
+
+	cleanupFn := func() {
+		if added {
+			fbo.status.rmDirtyNode(dir)
+		}
+		fbo.dirOps = fbo.dirOps[:len(fbo.dirOps)-1]
+		if dirCacheUndoFn != nil {
+			dirCacheUndoFn(lState)
+		}
+		// Delete should never fail.
+		_ = fbo.config.DirtyBlockCache().Delete(fbo.id(), newPtr, fbo.branch())
+	}
+	defer func() {
+		if err != nil && cleanupFn != nil {
+			cleanupFn()
+		}
+	}()
+
+	if entryType != Dir {
+		// Dirty the file with a zero-byte write, to ensure the new
+		// block is synced in SyncAll.  TODO: remove this if we ever
+		// embed 0-byte files in the directory entry itself.
+		err = fbo.blocks.Write(
+			ctx, lState, md.ReadOnly(), node, []byte{}, 0)
+		if err != nil {
+			return nil, DirEntry{}, err
+		}
+		oldCleanupFn := cleanupFn
+		cleanupFn = func() {
+			fbo.blocks.ClearCacheInfo(lState, fbo.nodeCache.PathFromNode(node))
+			oldCleanupFn()
+		}
+	}
+
+	// It's safe to notify before we've synced, since it is only
+	// sending invalidation notifications.  At worst the upper layer
+	// will just have to refresh its cache needlessly.
+	err = fbo.notifyOneOp(ctx, lState, co, md.ReadOnly(), false)
+	if err != nil {
+		return nil, DirEntry{}, err
+	}
+
+	if excl == WithExcl {
+		// Sync this change to the server.
+		err := fbo.syncAllLocked(ctx, lState, WithExcl)
+		_, isNoUpdatesWhileDirty := errors.Cause(err).(NoUpdatesWhileDirtyError)
+		if isNoUpdatesWhileDirty {
+			// If an exclusive write hits a conflict, it will try to
+			// update, but won't be able to because of the dirty
+			// directory entries.  We need to clean up the dirty
+			// entries here first before trying to apply the updates
+			// again.  By returning `ExclOnUnmergedError` below, we
+			// force the caller to retry the whole operation again.
+			fbo.log.CDebugf(ctx, "Clearing dirty entry before applying new "+
+				"updates for exclusive write")
+			cleanupFn()
+			cleanupFn = nil
+
+			// Sync anything else that might be buffered (non-exclusively).
+			err = fbo.syncAllLocked(ctx, lState, NoExcl)
+			if err != nil {
+				return nil, DirEntry{}, err
+			}
+
+			// Now we should be in a clean state, so this should work.
+			err = fbo.getAndApplyMDUpdates(
+				ctx, lState, fbo.applyMDUpdatesLocked)
+			if err != nil {
+				return nil, DirEntry{}, err
+			}
+			return nil, DirEntry{}, ExclOnUnmergedError{}
+		} else if err != nil {
+			return nil, DirEntry{}, err
+		}
+	} else {
+		err = fbo.syncDirUpdateOrSignal(ctx, lState)
+		if err != nil {
+			return nil, DirEntry{}, err
+		}
+	}
+
+	return node, de, nil
+}
+
+func (fbo *folderBranchOps) maybeWaitForSquash(
+	ctx context.Context, bid BranchID) {
+	if bid != PendingLocalSquashBranchID {
+		return
+	}
+
+	fbo.log.CDebugf(ctx, "Blocking until squash finishes")
+	// Limit the time we wait to just under the ctx deadline if there
+	// is one, or 10s if there isn't.
+	deadline, ok := ctx.Deadline()
+	if ok {
+		deadline = deadline.Add(-1 * time.Second)
+	} else {
+		// Can't use config.Clock() since context doesn't respect it.
+		deadline = time.Now().Add(10 * time.Second)
+	}
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+	// Wait for CR to finish.  Note that if the user is issuing
+	// concurrent writes, the current CR could be canceled, and when
+	// the call belows returns, the branch still won't be squashed.
+	// That's ok, this is just an optimization.
+	err := fbo.cr.Wait(ctx)
+	if err != nil {
+		fbo.log.CDebugf(ctx, "Error while waiting for CR: %+v", err)
+	}
+}
+
+func (fbo *folderBranchOps) doMDWriteWithRetry(ctx context.Context,
+	lState *lockState, fn func(lState *lockState) error) error {
+	doUnlock := false
+	defer func() {
+		if doUnlock {
+			bid := fbo.bid
+			fbo.mdWriterLock.Unlock(lState)
+			// Don't let a pending squash get too big.
+			fbo.maybeWaitForSquash(ctx, bid)
+		}
+	}()
+
+	for i := 0; ; i++ {
+		fbo.mdWriterLock.Lock(lState)
+		doUnlock = true
+
+		// Make sure we haven't been canceled before doing anything
+		// too serious.
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		err := fn(lState)
+		if isRetriableError(err, i) {
+			fbo.log.CDebugf(ctx, "Trying again after retriable error: %v", err)
+			// Release the lock to give someone else a chance
+			doUnlock = false
+			fbo.mdWriterLock.Unlock(lState)
+			if _, ok := err.(ExclOnUnmergedError); ok {
+				if err = fbo.cr.Wait(ctx); err != nil {
+					return err
+				}
+			} else if _, ok := err.(UnmergedSelfConflictError); ok {
+				// We can only get here if we are already on an
+				// unmerged branch and an errored PutUnmerged did make
+				// it to the mdserver.  Let's force sync, with a fresh
+				// context so the observer doesn't ignore the updates
+				// (but tie the cancels together).
+				newCtx := fbo.ctxWithFBOID(context.Background())
+				newCtx, cancel := context.WithCancel(newCtx)
+				defer cancel()
+				go func() {
+					select {
+					case <-ctx.Done():
+						cancel()
+					case <-newCtx.Done():
+					}
+				}()
+				fbo.log.CDebugf(ctx, "Got a revision conflict while unmerged "+
+					"(%v); forcing a sync", err)
+				err = fbo.getAndApplyNewestUnmergedHead(newCtx, lState)
+				if err != nil {
+					// TODO: we might be stuck at this point if we're
+					// ahead of the unmerged branch on the server, in
+					// which case we might want to just abandon any
+					// cached updates and force a sync to the head.
+					return err
+				}
+				cancel()
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+		return nil
+	}
+}
+
+func (fbo *folderBranchOps) doMDWriteWithRetryUnlessCanceled(
+	ctx context.Context, fn func(lState *lockState) error) error {
+	return runUnlessCanceled(ctx, func() error {
+		lState := makeFBOLockState()
+		return fbo.doMDWriteWithRetry(ctx, lState, fn)
+	})
+}
+
+func (fbo *folderBranchOps) CreateDir(
+	ctx context.Context, dir Node, path string) (
+	n Node, ei EntryInfo, err error) {
+	fbo.log.CDebugf(ctx, "CreateDir %s %s", getNodeIDStr(dir), path)
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "CreateDir %s %s done: %v %+v",
+			getNodeIDStr(dir), path, getNodeIDStr(n), err)
+	}()
+
+	err = fbo.checkNode(dir)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+
+	var retNode Node
+	var retEntryInfo EntryInfo
+	err = fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			node, de, err :=
+				fbo.createEntryLocked(ctx, lState, dir, path, Dir, NoExcl)
+			// Don't set node and ei directly, as that can cause a
+			// race when the Create is canceled.
+			retNode = node
+			retEntryInfo = de.EntryInfo
+			return err
+		})
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+	return retNode, retEntryInfo, nil
+}
+
+func (fbo *folderBranchOps) CreateFile(
+	ctx context.Context, dir Node, path string, isExec bool, excl Excl) (
+	n Node, ei EntryInfo, err error) {
+	fbo.log.CDebugf(ctx, "CreateFile %s %s isExec=%v Excl=%s",
+		getNodeIDStr(dir), path, isExec, excl)
+	defer func() {
+		fbo.deferLog.CDebugf(ctx,
+			"CreateFile %s %s isExec=%v Excl=%s done: %v %+v",
+			getNodeIDStr(dir), path, isExec, excl,
+			getNodeIDStr(n), err)
+	}()
+
+	err = fbo.checkNode(dir)
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+
+	var entryType EntryType
+	if isExec {
+		entryType = Exec
+	} else {
+		entryType = File
+	}
+
+	// If journaling is turned on, an exclusive create may end up on a
+	// conflict branch.
+	if excl == WithExcl && TLFJournalEnabled(fbo.config, fbo.id()) {
+		fbo.log.CDebugf(ctx, "Exclusive create status is being discarded.")
+		excl = NoExcl
+	}
+
+	if excl == WithExcl {
+		if err = fbo.cr.Wait(ctx); err != nil {
+			return nil, EntryInfo{}, err
+		}
+	}
+
+	var retNode Node
+	var retEntryInfo EntryInfo
+	err = fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			// Don't set node and ei directly, as that can cause a
+			// race when the Create is canceled.
+			node, de, err :=
+				fbo.createEntryLocked(ctx, lState, dir, path, entryType, excl)
+			retNode = node
+			retEntryInfo = de.EntryInfo
+			return err
+		})
+	if err != nil {
+		return nil, EntryInfo{}, err
+	}
+	return retNode, retEntryInfo, nil
+}
+
+// notifyAndSyncOrSignal caches an op in memory and dirties the
+// relevant node, and then sends a notification for it.  If batching
+// is on, it signals the write; otherwise it syncs the change.  It
+// should only be called as the final instruction that can fail in a
+// method.
+func (fbo *folderBranchOps) notifyAndSyncOrSignal(
+	ctx context.Context, lState *lockState, undoFn dirCacheUndoFn,
+	nodesToDirty []Node, op op, md ReadOnlyRootMetadata) (err error) {
+	fbo.dirOps = append(fbo.dirOps, cachedDirOp{op, nodesToDirty})
+	var addedNodes []Node
+	for _, n := range nodesToDirty {
+		added := fbo.status.addDirtyNode(n)
+		if added {
+			addedNodes = append(addedNodes, n)
+		}
+	}
+
+	defer func() {
+		if err != nil {
+			for _, n := range addedNodes {
+				fbo.status.rmDirtyNode(n)
+			}
+			fbo.dirOps = fbo.dirOps[:len(fbo.dirOps)-1]
+			if undoFn != nil {
+				undoFn(lState)
+			}
+		}
+	}()
+
+	// It's safe to notify before we've synced, since it is only
+	// sending invalidation notifications.  At worst the upper layer
+	// will just have to refresh its cache needlessly.
+	err = fbo.notifyOneOp(ctx, lState, op, md, false)
+	if err != nil {
+		return err
+	}
+
+	return fbo.syncDirUpdateOrSignal(ctx, lState)
+}
+
+func (fbo *folderBranchOps) createLinkLocked(
+	ctx context.Context, lState *lockState, dir Node, fromName string,
+	toPath string) (DirEntry, error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	if err := checkDisallowedPrefixes(fromName); err != nil {
+		return DirEntry{}, err
+	}
+
+	if uint32(len(fromName)) > fbo.config.MaxNameBytes() {
+		return DirEntry{},
+			NameTooLongError{fromName, fbo.config.MaxNameBytes()}
+	}
+
+	if err := fbo.checkForUnlinkedDir(dir); err != nil {
+		return DirEntry{}, err
+	}
+
+	// Verify we have permission to write (but don't make a successor yet).
+	md, err := fbo.getMDForWriteLockedForFilename(ctx, lState, "")
+	if err != nil {
+		return DirEntry{}, err
+	}
+
+	dirPath, err := fbo.pathFromNodeForMDWriteLocked(lState, dir)
+	if err != nil {
+		return DirEntry{}, err
+	}
+
+	err = fbo.checkReadOnlyEntry(
+		ctx, lState, md.ReadOnly(), dirPath, "symlink")
+	if err != nil {
+		return DirEntry{}, err
+	}
+
+	// We're not going to modify this copy of the dirblock, so just
+	// fetch it for reading.
+	dblock, err := fbo.blocks.GetDirtyDir(
+		ctx, lState, md.ReadOnly(), dirPath, blockRead)
+	if err != nil {
+		return DirEntry{}, err
+	}
+
+	// TODO: validate inputs
+
+	// does name already exist?
+	if _, ok := dblock.Children[fromName]; ok {
+		return DirEntry{}, NameExistsError{fromName}
+	}
+
+	if err := fbo.checkNewDirSize(ctx, lState, md.ReadOnly(),
+		dirPath, fromName); err != nil {
+		return DirEntry{}, err
+	}
+
+	parentPtr := dirPath.tailPointer()
+	co, err := newCreateOp(fromName, parentPtr, Sym)
+	if err != nil {
+		return DirEntry{}, err
+	}
+	co.setFinalPath(dirPath)
+	co.AddSelfUpdate(parentPtr)
+
+	// Nothing below here can fail, so no need to clean up the dir
+	// entry cache on a failure.  If this ever panics, we need to add
+	// cleanup code.
+
+	// Create a direntry for the link, and then sync
+	now := fbo.nowUnixNano()
+	de := DirEntry{
+		EntryInfo: EntryInfo{
+			Type:    Sym,
+			Size:    uint64(len(toPath)),
+			SymPath: toPath,
+			Mtime:   now,
+			Ctime:   now,
+		},
+	}
+
+	dirCacheUndoFn := fbo.blocks.AddDirEntryInCache(
+		lState, dirPath, fromName, de)
+
+	err = fbo.notifyAndSyncOrSignal(
+		ctx, lState, dirCacheUndoFn, []Node{dir}, co, md.ReadOnly())
+	if err != nil {
+		return DirEntry{}, err
+	}
+	return de, nil
+}
+
+func (fbo *folderBranchOps) CreateLink(
+	ctx context.Context, dir Node, fromName string, toPath string) (
+	ei EntryInfo, err error) {
+	fbo.log.CDebugf(ctx, "CreateLink %s %s -> %s",
+		getNodeIDStr(dir), fromName, toPath)
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "CreateLink %s %s -> %s done: %+v",
+			getNodeIDStr(dir), fromName, toPath, err)
+	}()
+
+	err = fbo.checkNode(dir)
+	if err != nil {
+		return EntryInfo{}, err
+	}
+
+	var retEntryInfo EntryInfo
+	err = fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			// Don't set ei directly, as that can cause a race when
+			// the Create is canceled.
+			de, err := fbo.createLinkLocked(ctx, lState, dir, fromName, toPath)
+			retEntryInfo = de.EntryInfo
+			return err
+		})
+	if err != nil {
+		return EntryInfo{}, err
 	}
-	co.setFinalPath(dirPath)
-	// create new data block
-	var newBlock Block
-	if entryType == Dir {
-		newBlock = &DirBlock{
-			Children: make(map[string]DirEntry),
+	return retEntryInfo, nil
+}
+
+// cloneFileBlocksLocked readies a copy of the top block of the given
+// file, which must be synced, and adds new references to all of its
+// leaf blocks instead of copying their data.  The copy's blocks are
+// added to bps, and all but the top block are referenced in md.  It
+// returns the info for the copy's new top block, which the caller
+// must add to md.
+func (fbo *folderBranchOps) cloneFileBlocksLocked(
+	ctx context.Context, lState *lockState, md *RootMetadata, file path,
+	encodedSize uint32, chargedTo keybase1.UserOrTeamID,
+	bps *blockPutState) (BlockInfo, error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	dirtyBcache := simpleDirtyBlockCacheStandard()
+	// Simple dirty bcaches don't need to be shut down.
+	newPtr, _, err := fbo.blocks.DeepCopyFile(
+		ctx, lState, md.ReadOnly(), file, dirtyBcache,
+		fbo.config.DataVersion())
+	if err != nil {
+		return BlockInfo{}, err
+	}
+	block, err := dirtyBcache.Get(fbo.id(), newPtr, fbo.branch())
+	if err != nil {
+		return BlockInfo{}, err
+	}
+	fblock, isFileBlock := block.(*FileBlock)
+	if !isFileBlock {
+		return BlockInfo{}, NotFileBlockError{newPtr, fbo.branch(), file}
+	}
+
+	// If journaling is enabled, new references aren't supported, so
+	// the copied blocks have to be readied from scratch.  TODO:
+	// remove this when KBFS-1149 is fixed.
+	journalEnabled := TLFJournalEnabled(fbo.config, fbo.id())
+
+	if !fblock.IsInd && !journalEnabled {
+		// The top block holds all the data, and `DeepCopyFile`
+		// already gave it a new reference.
+		info := BlockInfo{BlockPointer: newPtr, EncodedSize: encodedSize}
+		bps.addNewBlock(newPtr, nil, ReadyBlockData{}, nil)
+		return info, nil
+	}
+
+	var infos []BlockInfo
+	if journalEnabled {
+		infos, err = fbo.blocks.UndupChildrenInCopy(
+			ctx, lState, md.ReadOnly(), file, bps, dirtyBcache, fblock)
+		if err != nil {
+			return BlockInfo{}, err
 		}
 	} else {
-		newBlock = &FileBlock{}
+		// Ready any mid-level internal children.
+		_, err = fbo.blocks.ReadyNonLeafBlocksInCopy(
+			ctx, lState, md.ReadOnly(), file, bps, dirtyBcache, fblock)
+		if err != nil {
+			return BlockInfo{}, err
+		}
+
+		infos, err = fbo.blocks.GetIndirectFileBlockInfosWithTopBlock(
+			ctx, lState, md.ReadOnly(), file, fblock)
+		if err != nil {
+			return BlockInfo{}, err
+		}
+
+		for _, info := range infos {
+			// The indirect blocks were already added to bps, so
+			// only add the new references to the leaf blocks.
+			if info.RefNonce != kbfsblock.ZeroRefNonce {
+				bps.addNewBlock(info.BlockPointer, nil, ReadyBlockData{}, nil)
+			}
+		}
+	}
+	for _, info := range infos {
+		md.AddRefBlock(info)
 	}
 
-	// Cache update and operations until batch happens.  Make a new
-	// temporary ID and directory entry.
-	newID, err := fbo.config.cryptoPure().MakeTemporaryBlockID()
+	info, _, err := fbo.prepper.readyBlockMultiple(
+		ctx, md.ReadOnly(), fblock, chargedTo, bps, keybase1.BlockType_DATA)
 	if err != nil {
-		return nil, DirEntry{}, err
+		return BlockInfo{}, err
 	}
+	return info, nil
+}
 
-	chargedTo, err := chargedToForTLF(
-		ctx, fbo.config.KBPKI(), md.GetTlfHandle())
+func (fbo *folderBranchOps) copyFileLocked(
+	ctx context.Context, lState *lockState, src Node, destDir Node,
+	destName string) (de DirEntry, err error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	if err := checkDisallowedPrefixes(destName); err != nil {
+		return DirEntry{}, err
+	}
+
+	if uint32(len(destName)) > fbo.config.MaxNameBytes() {
+		return DirEntry{},
+			NameTooLongError{destName, fbo.config.MaxNameBytes()}
+	}
+
+	if err := fbo.checkForUnlinkedDir(destDir); err != nil {
+		return DirEntry{}, err
+	}
+
+	// The copy must share synced blocks, and the destination
+	// directory is modified directly below, so flush everything
+	// first.
+	err = fbo.checkNoTransactionLocked(lState)
 	if err != nil {
-		return nil, DirEntry{}, err
+		return DirEntry{}, err
+	}
+	err = fbo.syncAllLocked(ctx, lState, NoExcl)
+	if err != nil {
+		return DirEntry{}, err
 	}
 
-	newPtr := BlockPointer{
-		ID:         newID,
-		KeyGen:     md.LatestKeyGeneration(),
-		DataVer:    fbo.config.DataVersion(),
-		DirectType: DirectBlock,
-		Context: kbfsblock.MakeFirstContext(
-			chargedTo, keybase1.BlockType_DATA),
+	filename, err := fbo.canonicalPath(ctx, destDir, destName)
+	if err != nil {
+		return DirEntry{}, err
 	}
-	co.AddRefBlock(newPtr)
-	co.AddSelfUpdate(parentPtr)
 
-	node, err := fbo.nodeCache.GetOrCreate(newPtr, name, dir)
+	md, err := fbo.getSuccessorMDForWriteLockedForFilename(
+		ctx, lState, filename)
 	if err != nil {
-		return nil, DirEntry{}, err
+		return DirEntry{}, err
 	}
 
-	err = fbo.config.DirtyBlockCache().Put(
-		fbo.id(), newPtr, fbo.branch(), newBlock)
+	srcPath, err := fbo.pathFromNodeForMDWriteLocked(lState, src)
 	if err != nil {
-		return nil, DirEntry{}, err
+		return DirEntry{}, err
+	}
+	dirPath, err := fbo.pathFromNodeForMDWriteLocked(lState, destDir)
+	if err != nil {
+		return DirEntry{}, err
+	}
+	err = fbo.checkReadOnlyEntry(
+		ctx, lState, md.ReadOnly(), dirPath, "copy")
+	if err != nil {
+		return DirEntry{}, err
 	}
 
-	now := fbo.nowUnixNano()
-	de = DirEntry{
-		BlockInfo: BlockInfo{
-			BlockPointer: newPtr,
-			EncodedSize:  0,
-		},
-		EntryInfo: EntryInfo{
-			Type:  entryType,
-			Size:  0,
-			Mtime: now,
-			Ctime: now,
-		},
+	srcDe, err := fbo.blocks.GetDirtyEntry(
+		ctx, lState, md.ReadOnly(), srcPath)
+	if err != nil {
+		return DirEntry{}, err
+	}
+	if srcDe.Type == Dir {
+		return DirEntry{}, NotFileError{srcPath}
 	}
 
-	dirCacheUndoFn := fbo.blocks.AddDirEntryInCache(lState, dirPath, name, de)
-	fbo.dirOps = append(fbo.dirOps, cachedDirOp{co, []Node{dir, node}})
-	added := fbo.status.addDirtyNode(dir)
+	// This is a copy of the block, since nothing is dirty after
+	// the sync above.
+	dblock, err := fbo.blocks.GetDir(
+		ctx, lState, md.ReadOnly(), dirPath, blockWrite)
+	if err != nil {
+		return DirEntry{}, err
+	}
 
-	cleanupFn := func() {
-		if added {
-			fbo.status.rmDirtyNode(dir)
-		}
-		fbo.dirOps = fbo.dirOps[:len(fbo.dirOps)-1]
-		if dirCacheUndoFn != nil {
-			dirCacheUndoFn(lState)
-		}
-		// Delete should never fail.
-		_ = fbo.config.DirtyBlockCache().Delete(fbo.id(), newPtr, fbo.branch())
+	if _, ok := dblock.Children[destName]; ok {
+		return DirEntry{}, NameExistsError{destName}
+	}
+
+	if err := fbo.checkNewDirSize(
+		ctx, lState, md.ReadOnly(), dirPath, destName); err != nil {
+		return DirEntry{}, err
+	}
+
+	chargedTo, err := chargedToForTLF(
+		ctx, fbo.config.KBPKI(), md.GetTlfHandle())
+	if err != nil {
+		return DirEntry{}, err
+	}
+
+	co, err := newCreateOp(destName, dirPath.tailPointer(), srcDe.Type)
+	if err != nil {
+		return DirEntry{}, err
 	}
+	co.setFinalPath(dirPath)
+	md.AddOp(co)
+
+	bps := newBlockPutState(1)
 	defer func() {
-		if err != nil && cleanupFn != nil {
-			cleanupFn()
+		if err != nil {
+			fbo.fbm.cleanUpBlockState(
+				md.ReadOnly(), bps, blockDeleteOnMDFail)
 		}
 	}()
 
-	if entryType != Dir {
-		// Dirty the file with a zero-byte write, to ensure the new
-		// block is synced in SyncAll.  TODO: remove this if we ever
-		// embed 0-byte files in the directory entry itself.
-		err = fbo.blocks.Write(
-			ctx, lState, md.ReadOnly(), node, []byte{}, 0)
+	de = srcDe
+	if srcDe.Type != Sym {
+		de.BlockInfo, err = fbo.cloneFileBlocksLocked(
+			ctx, lState, md, srcPath, srcDe.EncodedSize, chargedTo, bps)
 		if err != nil {
-			return nil, DirEntry{}, err
+			return DirEntry{}, err
 		}
-		oldCleanupFn := cleanupFn
-		cleanupFn = func() {
-			fbo.blocks.ClearCacheInfo(lState, fbo.nodeCache.PathFromNode(node))
-			oldCleanupFn()
+		md.AddRefBlock(de.BlockInfo)
+	}
+	now := fbo.nowUnixNano()
+	de.Mtime = now
+	de.Ctime = now
+	dblock.Children[destName] = de
+
+	// Ready the destination directory and everything above it.
+	_, _, dirBps, err := fbo.prepper.prepUpdateForPath(
+		ctx, lState, chargedTo, md, dblock, *dirPath.parentPath(),
+		dirPath.tailName(), Dir, true, true, zeroPtr, make(localBcache))
+	if err != nil {
+		return DirEntry{}, err
+	}
+	bps.mergeOtherBps(dirBps)
+
+	if !fbo.config.BlockSplitter().ShouldEmbedBlockChanges(
+		&md.data.Changes) {
+		err = fbo.prepper.unembedBlockChanges(
+			ctx, bps, md, &md.data.Changes, chargedTo)
+		if err != nil {
+			return DirEntry{}, err
 		}
 	}
 
-	// It's safe to notify before we've synced, since it is only
-	// sending invalidation notifications.  At worst the upper layer
-	// will just have to refresh its cache needlessly.
-	err = fbo.notifyOneOp(ctx, lState, co, md.ReadOnly(), false)
+	_, err = doBlockPuts(ctx, fbo.config.BlockServer(),
+		fbo.config.BlockCache(), fbo.config.Reporter(), fbo.log,
+		fbo.deferLog, md.TlfID(), md.GetTlfHandle().GetCanonicalName(),
+		*bps, blockTransferControllersForTlf(fbo.config, md.TlfID()).Puts())
 	if err != nil {
-		return nil, DirEntry{}, err
+		return DirEntry{}, err
 	}
 
-	if excl == WithExcl {
-		// Sync this change to the server.
-		err := fbo.syncAllLocked(ctx, lState, WithExcl)
-		_, isNoUpdatesWhileDirty := errors.Cause(err).(NoUpdatesWhileDirtyError)
-		if isNoUpdatesWhileDirty {
-			// If an exclusive write hits a conflict, it will try to
-			// update, but won't be able to because of the dirty
-			// directory entries.  We need to clean up the dirty
-			// entries here first before trying to apply the updates
-			// again.  By returning `ExclOnUnmergedError` below, we
-			// force the caller to retry the whole operation again.
-			fbo.log.CDebugf(ctx, "Clearing dirty entry before applying new "+
-				"updates for exclusive write")
-			cleanupFn()
-			cleanupFn = nil
+	err = fbo.finalizeMDWriteLocked(ctx, lState, md, bps, NoExcl,
+		func(md ImmutableRootMetadata) error {
+			return fbo.notifyBatchLocked(ctx, lState, md)
+		})
+	if err != nil {
+		return DirEntry{}, err
+	}
+	return de, nil
+}
 
-			// Sync anything else that might be buffered (non-exclusively).
-			err = fbo.syncAllLocked(ctx, lState, NoExcl)
-			if err != nil {
-				return nil, DirEntry{}, err
-			}
+// CopyFile implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) CopyFile(
+	ctx context.Context, src Node, destDir Node, destName string) (
+	ei EntryInfo, err error) {
+	fbo.log.CDebugf(ctx, "CopyFile %s -> %s %s",
+		getNodeIDStr(src), getNodeIDStr(destDir), destName)
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "CopyFile %s -> %s %s done: %+v",
+			getNodeIDStr(src), getNodeIDStr(destDir), destName, err)
+	}()
 
-			// Now we should be in a clean state, so this should work.
-			err = fbo.getAndApplyMDUpdates(
-				ctx, lState, fbo.applyMDUpdatesLocked)
-			if err != nil {
-				return nil, DirEntry{}, err
-			}
-			return nil, DirEntry{}, ExclOnUnmergedError{}
-		} else if err != nil {
-			return nil, DirEntry{}, err
-		}
-	} else {
-		err = fbo.syncDirUpdateOrSignal(ctx, lState)
-		if err != nil {
-			return nil, DirEntry{}, err
-		}
+	err = fbo.checkNode(src)
+	if err != nil {
+		return EntryInfo{}, err
+	}
+	err = fbo.checkNode(destDir)
+	if err != nil {
+		return EntryInfo{}, err
+	}
+
+	var retEntryInfo EntryInfo
+	err = fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			// Don't set ei directly, as that can cause a race when
+			// the copy is canceled.
+			de, err := fbo.copyFileLocked(ctx, lState, src, destDir, destName)
+			retEntryInfo = de.EntryInfo
+			return err
+		})
+	if err != nil {
+		return EntryInfo{}, err
+	}
+	return retEntryInfo, nil
+}
+
+func (fbo *folderBranchOps) copyFileContentsLocked(
+	ctx context.Context, lState *lockState, src Node, dest Node) (
+	de DirEntry, err error) {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	// The copy must share synced blocks, and the destination is
+	// replaced directly below, so flush everything first.
+	err = fbo.checkNoTransactionLocked(lState)
+	if err != nil {
+		return DirEntry{}, err
+	}
+	err = fbo.syncAllLocked(ctx, lState, NoExcl)
+	if err != nil {
+		return DirEntry{}, err
+	}
+
+	md, err := fbo.getSuccessorMDForWriteLockedForFilename(ctx, lState, "")
+	if err != nil {
+		return DirEntry{}, err
+	}
+
+	srcPath, err := fbo.pathFromNodeForMDWriteLocked(lState, src)
+	if err != nil {
+		return DirEntry{}, err
+	}
+	destPath, err := fbo.pathFromNodeForMDWriteLocked(lState, dest)
+	if err != nil {
+		return DirEntry{}, err
+	}
+	if fbo.nodeCache.IsUnlinked(dest) {
+		return DirEntry{}, errors.WithStack(
+			UnsupportedOpInUnlinkedDirError{destPath.String()})
+	}
+	err = fbo.checkReadOnlyEntry(
+		ctx, lState, md.ReadOnly(), destPath, "write")
+	if err != nil {
+		return DirEntry{}, err
+	}
+	err = fbo.checkImmutableFileChange(
+		ctx, lState, md.ReadOnly(), dest, 0, "overwrite")
+	if err != nil {
+		return DirEntry{}, err
 	}
 
-	return node, de, nil
-}
+	srcDe, err := fbo.blocks.GetDirtyEntry(
+		ctx, lState, md.ReadOnly(), srcPath)
+	if err != nil {
+		return DirEntry{}, err
+	}
+	if srcDe.Type == Dir || srcDe.Type == Sym {
+		return DirEntry{}, NotFileError{srcPath}
+	}
 
-func (fbo *folderBranchOps) maybeWaitForSquash(
-	ctx context.Context, bid BranchID) {
-	if bid != PendingLocalSquashBranchID {
-		return
+	// This is a copy of the block, since nothing is dirty after
+	// the sync above.
+	dirPath := *destPath.parentPath()
+	dblock, err := fbo.blocks.GetDir(
+		ctx, lState, md.ReadOnly(), dirPath, blockWrite)
+	if err != nil {
+		return DirEntry{}, err
+	}
+	destDe, ok := dblock.Children[destPath.tailName()]
+	if !ok {
+		return DirEntry{}, NoSuchNameError{destPath.tailName()}
+	}
+	if destDe.Type == Dir || destDe.Type == Sym {
+		return DirEntry{}, NotFileError{destPath}
+	}
+	if destDe.Size != 0 {
+		return DirEntry{}, FileNotEmptyError{destPath.String()}
 	}
 
-	fbo.log.CDebugf(ctx, "Blocking until squash finishes")
-	// Limit the time we wait to just under the ctx deadline if there
-	// is one, or 10s if there isn't.
-	deadline, ok := ctx.Deadline()
-	if ok {
-		deadline = deadline.Add(-1 * time.Second)
-	} else {
-		// Can't use config.Clock() since context doesn't respect it.
-		deadline = time.Now().Add(10 * time.Second)
+	chargedTo, err := chargedToForTLF(
+		ctx, fbo.config.KBPKI(), md.GetTlfHandle())
+	if err != nil {
+		return DirEntry{}, err
 	}
-	ctx, cancel := context.WithDeadline(ctx, deadline)
-	defer cancel()
-	// Wait for CR to finish.  Note that if the user is issuing
-	// concurrent writes, the current CR could be canceled, and when
-	// the call belows returns, the branch still won't be squashed.
-	// That's ok, this is just an optimization.
-	err := fbo.cr.Wait(ctx)
+
+	// Other devices see this as a write of the whole file.
+	so, err := newSyncOp(destDe.BlockPointer)
 	if err != nil {
-		fbo.log.CDebugf(ctx, "Error while waiting for CR: %+v", err)
+		return DirEntry{}, err
 	}
-}
+	so.addWrite(0, srcDe.Size)
+	so.setFinalPath(destPath)
+	md.AddOp(so)
 
-func (fbo *folderBranchOps) doMDWriteWithRetry(ctx context.Context,
-	lState *lockState, fn func(lState *lockState) error) error {
-	doUnlock := false
+	bps := newBlockPutState(1)
 	defer func() {
-		if doUnlock {
-			bid := fbo.bid
-			fbo.mdWriterLock.Unlock(lState)
-			// Don't let a pending squash get too big.
-			fbo.maybeWaitForSquash(ctx, bid)
+		if err != nil {
+			fbo.fbm.cleanUpBlockState(
+				md.ReadOnly(), bps, blockDeleteOnMDFail)
 		}
 	}()
 
-	for i := 0; ; i++ {
-		fbo.mdWriterLock.Lock(lState)
-		doUnlock = true
+	info, err := fbo.cloneFileBlocksLocked(
+		ctx, lState, md, srcPath, srcDe.EncodedSize, chargedTo, bps)
+	if err != nil {
+		return DirEntry{}, err
+	}
+	// This also points the syncOp at the new top block.
+	md.AddUpdate(destDe.BlockInfo, info)
 
-		// Make sure we haven't been canceled before doing anything
-		// too serious.
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
-		}
+	de = destDe
+	de.BlockInfo = info
+	de.Size = srcDe.Size
+	now := fbo.nowUnixNano()
+	de.Mtime = now
+	de.Ctime = now
+	dblock.Children[destPath.tailName()] = de
 
-		err := fn(lState)
-		if isRetriableError(err, i) {
-			fbo.log.CDebugf(ctx, "Trying again after retriable error: %v", err)
-			// Release the lock to give someone else a chance
-			doUnlock = false
-			fbo.mdWriterLock.Unlock(lState)
-			if _, ok := err.(ExclOnUnmergedError); ok {
-				if err = fbo.cr.Wait(ctx); err != nil {
-					return err
-				}
-			} else if _, ok := err.(UnmergedSelfConflictError); ok {
-				// We can only get here if we are already on an
-				// unmerged branch and an errored PutUnmerged did make
-				// it to the mdserver.  Let's force sync, with a fresh
-				// context so the observer doesn't ignore the updates
-				// (but tie the cancels together).
-				newCtx := fbo.ctxWithFBOID(context.Background())
-				newCtx, cancel := context.WithCancel(newCtx)
-				defer cancel()
-				go func() {
-					select {
-					case <-ctx.Done():
-						cancel()
-					case <-newCtx.Done():
-					}
-				}()
-				fbo.log.CDebugf(ctx, "Got a revision conflict while unmerged "+
-					"(%v); forcing a sync", err)
-				err = fbo.getAndApplyNewestUnmergedHead(newCtx, lState)
-				if err != nil {
-					// TODO: we might be stuck at this point if we're
-					// ahead of the unmerged branch on the server, in
-					// which case we might want to just abandon any
-					// cached updates and force a sync to the head.
-					return err
-				}
-				cancel()
-			}
-			continue
-		} else if err != nil {
-			return err
+	// Ready the parent directory and everything above it.
+	_, _, dirBps, err := fbo.prepper.prepUpdateForPath(
+		ctx, lState, chargedTo, md, dblock, *dirPath.parentPath(),
+		dirPath.tailName(), Dir, true, true, zeroPtr, make(localBcache))
+	if err != nil {
+		return DirEntry{}, err
+	}
+	bps.mergeOtherBps(dirBps)
+
+	if !fbo.config.BlockSplitter().ShouldEmbedBlockChanges(
+		&md.data.Changes) {
+		err = fbo.prepper.unembedBlockChanges(
+			ctx, bps, md, &md.data.Changes, chargedTo)
+		if err != nil {
+			return DirEntry{}, err
 		}
-		return nil
 	}
-}
 
-func (fbo *folderBranchOps) doMDWriteWithRetryUnlessCanceled(
-	ctx context.Context, fn func(lState *lockState) error) error {
-	return runUnlessCanceled(ctx, func() error {
-		lState := makeFBOLockState()
-		return fbo.doMDWriteWithRetry(ctx, lState, fn)
-	})
+	_, err = doBlockPuts(ctx, fbo.config.BlockServer(),
+		fbo.config.BlockCache(), fbo.config.Reporter(), fbo.log,
+		fbo.deferLog, md.TlfID(), md.GetTlfHandle().GetCanonicalName(),
+		*bps, blockTransferControllersForTlf(fbo.config, md.TlfID()).Puts())
+	if err != nil {
+		return DirEntry{}, err
+	}
+
+	err = fbo.finalizeMDWriteLocked(ctx, lState, md, bps, NoExcl,
+		func(md ImmutableRootMetadata) error {
+			return fbo.notifyBatchLocked(ctx, lState, md)
+		})
+	if err != nil {
+		return DirEntry{}, err
+	}
+	return de, nil
 }
 
-func (fbo *folderBranchOps) CreateDir(
-	ctx context.Context, dir Node, path string) (
-	n Node, ei EntryInfo, err error) {
-	fbo.log.CDebugf(ctx, "CreateDir %s %s", getNodeIDStr(dir), path)
+// CopyFileContents implements the KBFSOps interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) CopyFileContents(
+	ctx context.Context, src Node, dest Node) (ei EntryInfo, err error) {
+	fbo.log.CDebugf(ctx, "CopyFileContents %s -> %s",
+		getNodeIDStr(src), getNodeIDStr(dest))
 	defer func() {
-		fbo.deferLog.CDebugf(ctx, "CreateDir %s %s done: %v %+v",
-			getNodeIDStr(dir), path, getNodeIDStr(n), err)
+		fbo.deferLog.CDebugf(ctx, "CopyFileContents %s -> %s done: %+v",
+			getNodeIDStr(src), getNodeIDStr(dest), err)
 	}()
 
-	err = fbo.checkNode(dir)
+	err = fbo.checkNode(src)
 	if err != nil {
-		return nil, EntryInfo{}, err
+		return EntryInfo{}, err
+	}
+	err = fbo.checkNode(dest)
+	if err != nil {
+		return EntryInfo{}, err
 	}
 
-	var retNode Node
 	var retEntryInfo EntryInfo
 	err = fbo.doMDWriteWithRetryUnlessCanceled(ctx,
 		func(lState *lockState) error {
-			node, de, err :=
-				fbo.createEntryLocked(ctx, lState, dir, path, Dir, NoExcl)
-			// Don't set node and ei directly, as that can cause a
-			// race when the Create is canceled.
-			retNode = node
+			// Don't set ei directly, as that can cause a race when
+			// the copy is canceled.
+			de, err := fbo.copyFileContentsLocked(ctx, lState, src, dest)
 			retEntryInfo = de.EntryInfo
 			return err
 		})
 	if err != nil {
-		return nil, EntryInfo{}, err
+		return EntryInfo{}, err
 	}
-	return retNode, retEntryInfo, nil
+	return retEntryInfo, nil
 }
 
-func (fbo *folderBranchOps) CreateFile(
-	ctx context.Context, dir Node, path string, isExec bool, excl Excl) (
-	n Node, ei EntryInfo, err error) {
-	fbo.log.CDebugf(ctx, "CreateFile %s %s isExec=%v Excl=%s",
-		getNodeIDStr(dir), path, isExec, excl)
-	defer func() {
-		fbo.deferLog.CDebugf(ctx,
-			"CreateFile %s %s isExec=%v Excl=%s done: %v %+v",
-			getNodeIDStr(dir), path, isExec, excl,
-			getNodeIDStr(n), err)
-	}()
+func (fbo *folderBranchOps) startBulkFileLocked(
+	ctx context.Context, lState *lockState, dir Node, name string) (
+	md ImmutableRootMetadata, chargedTo keybase1.UserOrTeamID, err error) {
+	fbo.mdWriterLock.AssertLocked(lState)
 
-	err = fbo.checkNode(dir)
+	// Committing the file syncs right away, so refuse before any
+	// data gets written.
+	if err := fbo.checkNoTransactionLocked(lState); err != nil {
+		return ImmutableRootMetadata{}, keybase1.UserOrTeamID(""), err
+	}
+
+	if err := checkDisallowedPrefixes(name); err != nil {
+		return ImmutableRootMetadata{}, keybase1.UserOrTeamID(""), err
+	}
+
+	if uint32(len(name)) > fbo.config.MaxNameBytes() {
+		return ImmutableRootMetadata{}, keybase1.UserOrTeamID(""),
+			NameTooLongError{name, fbo.config.MaxNameBytes()}
+	}
+
+	if err := fbo.checkForUnlinkedDir(dir); err != nil {
+		return ImmutableRootMetadata{}, keybase1.UserOrTeamID(""), err
+	}
+
+	filename, err := fbo.canonicalPath(ctx, dir, name)
 	if err != nil {
-		return nil, EntryInfo{}, err
+		return ImmutableRootMetadata{}, keybase1.UserOrTeamID(""), err
 	}
 
-	var entryType EntryType
-	if isExec {
-		entryType = Exec
-	} else {
-		entryType = File
+	// Verify we have permission to write (but don't make a successor
+	// yet, since that only happens when the writer is closed).
+	md, err = fbo.getMDForWriteLockedForFilename(ctx, lState, filename)
+	if err != nil {
+		return ImmutableRootMetadata{}, keybase1.UserOrTeamID(""), err
 	}
 
-	// If journaling is turned on, an exclusive create may end up on a
-	// conflict branch.
-	if excl == WithExcl && TLFJournalEnabled(fbo.config, fbo.id()) {
-		fbo.log.CDebugf(ctx, "Exclusive create status is being discarded.")
-		excl = NoExcl
+	dirPath, err := fbo.pathFromNodeForMDWriteLocked(lState, dir)
+	if err != nil {
+		return ImmutableRootMetadata{}, keybase1.UserOrTeamID(""), err
 	}
 
-	if excl == WithExcl {
-		if err = fbo.cr.Wait(ctx); err != nil {
-			return nil, EntryInfo{}, err
-		}
+	err = fbo.checkReadOnlyEntry(
+		ctx, lState, md.ReadOnly(), dirPath, "create")
+	if err != nil {
+		return ImmutableRootMetadata{}, keybase1.UserOrTeamID(""), err
 	}
 
-	var retNode Node
-	var retEntryInfo EntryInfo
-	err = fbo.doMDWriteWithRetryUnlessCanceled(ctx,
-		func(lState *lockState) error {
-			// Don't set node and ei directly, as that can cause a
-			// race when the Create is canceled.
-			node, de, err :=
-				fbo.createEntryLocked(ctx, lState, dir, path, entryType, excl)
-			retNode = node
-			retEntryInfo = de.EntryInfo
-			return err
-		})
+	dblock, err := fbo.blocks.GetDirtyDir(
+		ctx, lState, md.ReadOnly(), dirPath, blockRead)
 	if err != nil {
-		return nil, EntryInfo{}, err
+		return ImmutableRootMetadata{}, keybase1.UserOrTeamID(""), err
 	}
-	return retNode, retEntryInfo, nil
-}
 
-// notifyAndSyncOrSignal caches an op in memory and dirties the
-// relevant node, and then sends a notification for it.  If batching
-// is on, it signals the write; otherwise it syncs the change.  It
-// should only be called as the final instruction that can fail in a
-// method.
-func (fbo *folderBranchOps) notifyAndSyncOrSignal(
-	ctx context.Context, lState *lockState, undoFn dirCacheUndoFn,
-	nodesToDirty []Node, op op, md ReadOnlyRootMetadata) (err error) {
-	fbo.dirOps = append(fbo.dirOps, cachedDirOp{op, nodesToDirty})
-	var addedNodes []Node
-	for _, n := range nodesToDirty {
-		added := fbo.status.addDirtyNode(n)
-		if added {
-			addedNodes = append(addedNodes, n)
-		}
+	// Fail early, rather than after all the data has been uploaded.
+	// The name is checked again when the writer is closed.
+	if _, ok := dblock.Children[name]; ok {
+		return ImmutableRootMetadata{}, keybase1.UserOrTeamID(""),
+			NameExistsError{name}
+	}
+
+	chargedTo, err = chargedToForTLF(
+		ctx, fbo.config.KBPKI(), md.GetTlfHandle())
+	if err != nil {
+		return ImmutableRootMetadata{}, keybase1.UserOrTeamID(""), err
 	}
+	return md, chargedTo, nil
+}
 
+// CreateBulkFile implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) CreateBulkFile(
+	ctx context.Context, dir Node, name string, isExec bool) (
+	w BulkFileWriter, err error) {
+	fbo.log.CDebugf(ctx, "CreateBulkFile %s %s isExec=%v",
+		getNodeIDStr(dir), name, isExec)
 	defer func() {
-		if err != nil {
-			for _, n := range addedNodes {
-				fbo.status.rmDirtyNode(n)
-			}
-			fbo.dirOps = fbo.dirOps[:len(fbo.dirOps)-1]
-			if undoFn != nil {
-				undoFn(lState)
-			}
-		}
+		fbo.deferLog.CDebugf(ctx, "CreateBulkFile %s %s isExec=%v done: %+v",
+			getNodeIDStr(dir), name, isExec, err)
 	}()
 
-	// It's safe to notify before we've synced, since it is only
-	// sending invalidation notifications.  At worst the upper layer
-	// will just have to refresh its cache needlessly.
-	err = fbo.notifyOneOp(ctx, lState, op, md, false)
+	err = fbo.checkNode(dir)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	entryType := File
+	if isExec {
+		entryType = Exec
 	}
 
-	return fbo.syncDirUpdateOrSignal(ctx, lState)
+	var md ImmutableRootMetadata
+	var chargedTo keybase1.UserOrTeamID
+	err = fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			var err error
+			md, chargedTo, err = fbo.startBulkFileLocked(
+				ctx, lState, dir, name)
+			return err
+		})
+	if err != nil {
+		return nil, err
+	}
+	return newBulkFileWriter(
+		ctx, fbo, dir, name, entryType, md, chargedTo), nil
 }
 
-func (fbo *folderBranchOps) createLinkLocked(
-	ctx context.Context, lState *lockState, dir Node, fromName string,
-	toPath string) (DirEntry, error) {
+// commitBulkFileLocked adds a new entry named `name` to `dir`,
+// pointing to the already-put file tree with top block `top`.
+// `infos` must hold every block in that tree.  It returns the new
+// entry, and the MD it tried to put, if any.
+func (fbo *folderBranchOps) commitBulkFileLocked(
+	ctx context.Context, lState *lockState, dir Node, name string,
+	entryType EntryType, top BlockInfo, size uint64, infos []BlockInfo) (
+	de DirEntry, md *RootMetadata, err error) {
 	fbo.mdWriterLock.AssertLocked(lState)
 
-	if err := checkDisallowedPrefixes(fromName); err != nil {
-		return DirEntry{}, err
+	if err := fbo.checkForUnlinkedDir(dir); err != nil {
+		return DirEntry{}, nil, err
 	}
 
-	if uint32(len(fromName)) > fbo.config.MaxNameBytes() {
-		return DirEntry{},
-			NameTooLongError{fromName, fbo.config.MaxNameBytes()}
+	// The destination directory is modified directly below, so
+	// flush everything first.
+	err = fbo.checkNoTransactionLocked(lState)
+	if err != nil {
+		return DirEntry{}, nil, err
+	}
+	err = fbo.syncAllLocked(ctx, lState, NoExcl)
+	if err != nil {
+		return DirEntry{}, nil, err
 	}
 
-	if err := fbo.checkForUnlinkedDir(dir); err != nil {
-		return DirEntry{}, err
+	filename, err := fbo.canonicalPath(ctx, dir, name)
+	if err != nil {
+		return DirEntry{}, nil, err
 	}
 
-	// Verify we have permission to write (but don't make a successor yet).
-	md, err := fbo.getMDForWriteLockedForFilename(ctx, lState, "")
+	md, err = fbo.getSuccessorMDForWriteLockedForFilename(
+		ctx, lState, filename)
 	if err != nil {
-		return DirEntry{}, err
+		return DirEntry{}, nil, err
 	}
 
 	dirPath, err := fbo.pathFromNodeForMDWriteLocked(lState, dir)
 	if err != nil {
-		return DirEntry{}, err
+		return DirEntry{}, nil, err
+	}
+	err = fbo.checkReadOnlyEntry(
+		ctx, lState, md.ReadOnly(), dirPath, "create")
+	if err != nil {
+		return DirEntry{}, nil, err
 	}
 
-	// We're not going to modify this copy of the dirblock, so just
-	// fetch it for reading.
-	dblock, err := fbo.blocks.GetDirtyDir(
-		ctx, lState, md.ReadOnly(), dirPath, blockRead)
+	// This is a copy of the block, since nothing is dirty after
+	// the sync above.
+	dblock, err := fbo.blocks.GetDir(
+		ctx, lState, md.ReadOnly(), dirPath, blockWrite)
 	if err != nil {
-		return DirEntry{}, err
+		return DirEntry{}, nil, err
 	}
 
-	// TODO: validate inputs
+	if _, ok := dblock.Children[name]; ok {
+		return DirEntry{}, nil, NameExistsError{name}
+	}
 
-	// does name already exist?
-	if _, ok := dblock.Children[fromName]; ok {
-		return DirEntry{}, NameExistsError{fromName}
+	if err := fbo.checkNewDirSize(
+		ctx, lState, md.ReadOnly(), dirPath, name); err != nil {
+		return DirEntry{}, nil, err
 	}
 
-	if err := fbo.checkNewDirSize(ctx, lState, md.ReadOnly(),
-		dirPath, fromName); err != nil {
-		return DirEntry{}, err
+	chargedTo, err := chargedToForTLF(
+		ctx, fbo.config.KBPKI(), md.GetTlfHandle())
+	if err != nil {
+		return DirEntry{}, nil, err
 	}
 
-	parentPtr := dirPath.tailPointer()
-	co, err := newCreateOp(fromName, parentPtr, Sym)
+	co, err := newCreateOp(name, dirPath.tailPointer(), entryType)
 	if err != nil {
-		return DirEntry{}, err
+		return DirEntry{}, nil, err
 	}
 	co.setFinalPath(dirPath)
-	co.AddSelfUpdate(parentPtr)
+	md.AddOp(co)
+	for _, info := range infos {
+		md.AddRefBlock(info)
+	}
 
-	// Nothing below here can fail, so no need to clean up the dir
-	// entry cache on a failure.  If this ever panics, we need to add
-	// cleanup code.
+	// Only the directory blocks are put here; the caller owns the
+	// file blocks.
+	var bps *blockPutState
+	defer func() {
+		if err != nil && bps != nil {
+			fbo.fbm.cleanUpBlockState(
+				md.ReadOnly(), bps, blockDeleteOnMDFail)
+		}
+	}()
 
-	// Create a direntry for the link, and then sync
 	now := fbo.nowUnixNano()
-	de := DirEntry{
+	de = DirEntry{
+		BlockInfo: top,
 		EntryInfo: EntryInfo{
-			Type:    Sym,
-			Size:    uint64(len(toPath)),
-			SymPath: toPath,
-			Mtime:   now,
-			Ctime:   now,
+			Type:  entryType,
+			Size:  size,
+			Mtime: now,
+			Ctime: now,
 		},
 	}
+	dblock.Children[name] = de
 
-	dirCacheUndoFn := fbo.blocks.AddDirEntryInCache(
-		lState, dirPath, fromName, de)
+	// Ready the destination directory and everything above it.
+	_, _, bps, err = fbo.prepper.prepUpdateForPath(
+		ctx, lState, chargedTo, md, dblock, *dirPath.parentPath(),
+		dirPath.tailName(), Dir, true, true, zeroPtr, make(localBcache))
+	if err != nil {
+		return DirEntry{}, md, err
+	}
 
-	err = fbo.notifyAndSyncOrSignal(
-		ctx, lState, dirCacheUndoFn, []Node{dir}, co, md.ReadOnly())
+	if !fbo.config.BlockSplitter().ShouldEmbedBlockChanges(
+		&md.data.Changes) {
+		err = fbo.prepper.unembedBlockChanges(
+			ctx, bps, md, &md.data.Changes, chargedTo)
+		if err != nil {
+			return DirEntry{}, md, err
+		}
+	}
+
+	_, err = doBlockPuts(ctx, fbo.config.BlockServer(),
+		fbo.config.BlockCache(), fbo.config.Reporter(), fbo.log,
+		fbo.deferLog, md.TlfID(), md.GetTlfHandle().GetCanonicalName(),
+		*bps, blockTransferControllersForTlf(fbo.config, md.TlfID()).Puts())
 	if err != nil {
-		return DirEntry{}, err
+		return DirEntry{}, md, err
 	}
-	return de, nil
+
+	err = fbo.finalizeMDWriteLocked(ctx, lState, md, bps, NoExcl,
+		func(md ImmutableRootMetadata) error {
+			return fbo.notifyBatchLocked(ctx, lState, md)
+		})
+	if err != nil {
+		return DirEntry{}, md, err
+	}
+	return de, md, nil
 }
 
-func (fbo *folderBranchOps) CreateLink(
-	ctx context.Context, dir Node, fromName string, toPath string) (
-	ei EntryInfo, err error) {
-	fbo.log.CDebugf(ctx, "CreateLink %s %s -> %s",
-		getNodeIDStr(dir), fromName, toPath)
+// commitBulkFile commits the file written by a bulkFileWriter.  On
+// failure, it also returns the last MD it tried to put, if any, so
+// the caller can tell whether the file's blocks are still needed.
+func (fbo *folderBranchOps) commitBulkFile(
+	ctx context.Context, dir Node, name string, entryType EntryType,
+	top BlockInfo, size uint64, infos []BlockInfo) (
+	de DirEntry, md *RootMetadata, err error) {
+	fbo.log.CDebugf(ctx, "Committing bulk file %s %s (size=%d, blocks=%d)",
+		getNodeIDStr(dir), name, size, len(infos))
 	defer func() {
-		fbo.deferLog.CDebugf(ctx, "CreateLink %s %s -> %s done: %+v",
-			getNodeIDStr(dir), fromName, toPath, err)
+		fbo.deferLog.CDebugf(ctx, "Committing bulk file %s %s done: %+v",
+			getNodeIDStr(dir), name, err)
 	}()
 
 	err = fbo.checkNode(dir)
 	if err != nil {
-		return EntryInfo{}, err
+		return DirEntry{}, nil, err
 	}
 
-	var retEntryInfo EntryInfo
 	err = fbo.doMDWriteWithRetryUnlessCanceled(ctx,
 		func(lState *lockState) error {
-			// Don't set ei directly, as that can cause a race when
-			// the Create is canceled.
-			de, err := fbo.createLinkLocked(ctx, lState, dir, fromName, toPath)
-			retEntryInfo = de.EntryInfo
+			attemptDe, attemptMD, err := fbo.commitBulkFileLocked(
+				ctx, lState, dir, name, entryType, top, size, infos)
+			if attemptMD != nil {
+				md = attemptMD
+			}
+			de = attemptDe
 			return err
 		})
 	if err != nil {
-		return EntryInfo{}, err
+		return DirEntry{}, md, err
 	}
-	return retEntryInfo, nil
+	return de, md, nil
 }
 
 // unrefEntry modifies md to unreference all relevant blocks for the
@@ -3140,6 +4636,10 @@ func (fbo *folderBranchOps) removeEntryLocked(ctx context.Context,
 	if err := fbo.checkForUnlinkedDir(dir); err != nil {
 		return err
 	}
+	if md.IsImmutableSet() {
+		return ImmutableFolderError{
+			"remove", dirPath.ChildPathNoPtr(name).String()}
+	}
 
 	// We're not going to modify this copy of the dirblock, so just
 	// fetch it for reading.
@@ -3153,6 +4653,14 @@ func (fbo *folderBranchOps) removeEntryLocked(ctx context.Context,
 	if !ok {
 		return NoSuchNameError{name}
 	}
+	if de.Mode.IsReadOnly() {
+		return ReadOnlyEntryError{
+			"remove", dirPath.ChildPathNoPtr(name).String()}
+	}
+	err = fbo.checkReadOnlyEntry(ctx, lState, md, dirPath, "remove")
+	if err != nil {
+		return err
+	}
 
 	parentPtr := dirPath.tailPointer()
 	ro, err := newRmOp(name, parentPtr)
@@ -3284,7 +4792,7 @@ func (fbo *folderBranchOps) RemoveEntry(ctx context.Context, dir Node,
 
 func (fbo *folderBranchOps) renameLocked(
 	ctx context.Context, lState *lockState, oldParent Node, oldName string,
-	newParent Node, newName string) (err error) {
+	newParent Node, newName string, flags RenameFlags) (err error) {
 	fbo.mdWriterLock.AssertLocked(lState)
 
 	if err := fbo.checkForUnlinkedDir(oldParent); err != nil {
@@ -3310,6 +4818,10 @@ func (fbo *folderBranchOps) renameLocked(
 	if err != nil {
 		return err
 	}
+	if md.IsImmutableSet() {
+		return ImmutableFolderError{
+			"rename", oldParentPath.ChildPathNoPtr(oldName).String()}
+	}
 
 	_, newPBlock, newDe, ro, err := fbo.blocks.PrepRename(
 		ctx, lState, md.ReadOnly(), oldParentPath, oldName, newParentPath,
@@ -3317,10 +4829,65 @@ func (fbo *folderBranchOps) renameLocked(
 	if err != nil {
 		return err
 	}
+	if flags == RenameExchange {
+		// Only exchanges need to be recorded, for conflict
+		// resolution and other clients.
+		ro.Flags = flags
+	}
 
-	// does name exist?
+	// Neither the renamed entry, the entry it replaces, nor either
+	// parent directory may be read-only.
 	replacedDe, ok := newPBlock.Children[newName]
+	if newDe.Mode.IsReadOnly() {
+		return ReadOnlyEntryError{
+			"rename", oldParentPath.ChildPathNoPtr(oldName).String()}
+	} else if ok && replacedDe.Mode.IsReadOnly() {
+		return ReadOnlyEntryError{
+			"rename", newParentPath.ChildPathNoPtr(newName).String()}
+	}
+	err = fbo.checkReadOnlyEntry(
+		ctx, lState, md.ReadOnly(), oldParentPath, "rename")
+	if err != nil {
+		return err
+	}
+	err = fbo.checkReadOnlyEntry(
+		ctx, lState, md.ReadOnly(), newParentPath, "rename")
+	if err != nil {
+		return err
+	}
+
+	nodesToDirty := []Node{oldParent}
+	if oldParent.GetID() != newParent.GetID() {
+		nodesToDirty = append(nodesToDirty, newParent)
+	}
+
+	// does name exist?
+	if flags == RenameExchange {
+		if !ok {
+			return NoSuchNameError{newName}
+		}
+		ro.Exchanged = replacedDe.BlockPointer
+		ro.ExchangedType = replacedDe.Type
+
+		// Only the ctimes change on the exchanged entries themselves.
+		now := fbo.nowUnixNano()
+		newDe.Ctime = now
+		replacedDe.Ctime = now
+
+		dirCacheUndoFn, err := fbo.blocks.ExchangeDirEntriesInCache(
+			lState, oldParentPath, oldName, newDe, newParentPath, newName,
+			replacedDe)
+		if err != nil {
+			return err
+		}
+		return fbo.notifyAndSyncOrSignal(
+			ctx, lState, dirCacheUndoFn, nodesToDirty, ro, md.ReadOnly())
+	}
 	if ok {
+		if flags == RenameNoReplace {
+			return NameExistsError{newName}
+		}
+
 		// Usually higher-level programs check these, but just in case.
 		if replacedDe.Type == Dir && newDe.Type != Dir {
 			return NotDirError{newParentPath.ChildPathNoPtr(newName)}
@@ -3361,23 +4928,20 @@ func (fbo *folderBranchOps) renameLocked(
 		return err
 	}
 
-	nodesToDirty := []Node{oldParent}
-	if oldParent.GetID() != newParent.GetID() {
-		nodesToDirty = append(nodesToDirty, newParent)
-	}
 	return fbo.notifyAndSyncOrSignal(
 		ctx, lState, dirCacheUndoFn, nodesToDirty, ro, md.ReadOnly())
 }
 
 func (fbo *folderBranchOps) Rename(
 	ctx context.Context, oldParent Node, oldName string, newParent Node,
-	newName string) (err error) {
-	fbo.log.CDebugf(ctx, "Rename %s/%s -> %s/%s", getNodeIDStr(oldParent),
-		oldName, getNodeIDStr(newParent), newName)
+	newName string, flags RenameFlags) (err error) {
+	fbo.log.CDebugf(ctx, "Rename %s/%s -> %s/%s (%s)",
+		getNodeIDStr(oldParent), oldName, getNodeIDStr(newParent), newName,
+		flags)
 	defer func() {
-		fbo.deferLog.CDebugf(ctx, "Rename %s/%s -> %s/%s done: %+v",
+		fbo.deferLog.CDebugf(ctx, "Rename %s/%s -> %s/%s (%s) done: %+v",
 			getNodeIDStr(oldParent), oldName,
-			getNodeIDStr(newParent), newName, err)
+			getNodeIDStr(newParent), newName, flags, err)
 	}()
 
 	err = fbo.checkNode(newParent)
@@ -3385,6 +4949,17 @@ func (fbo *folderBranchOps) Rename(
 		return err
 	}
 
+	switch flags {
+	case RenameFlagsNone, RenameNoReplace:
+	case RenameExchange:
+		if v := fbo.config.OpsVersion(); v < RenameExchangeOpsVer {
+			return OpsVersionTooLowError{
+				"Exchanging rename", RenameExchangeOpsVer, v}
+		}
+	default:
+		return InvalidRenameFlagsError{flags}
+	}
+
 	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
 		func(lState *lockState) error {
 			// only works for paths within the same topdir
@@ -3393,7 +4968,7 @@ func (fbo *folderBranchOps) Rename(
 			}
 
 			return fbo.renameLocked(ctx, lState, oldParent, oldName,
-				newParent, newName)
+				newParent, newName, flags)
 		})
 }
 
@@ -3489,6 +5064,26 @@ func (fbo *folderBranchOps) Write(
 			return err
 		}
 
+		err = fbo.checkImmutableFileChange(
+			ctx, lState, md.ReadOnly(), file, uint64(off), "overwrite")
+		if err != nil {
+			return err
+		}
+		filePath, err := fbo.pathFromNodeForRead(file)
+		if err != nil {
+			return err
+		}
+		err = fbo.checkReadOnlyEntry(
+			ctx, lState, md.ReadOnly(), filePath, "write")
+		if err != nil {
+			return err
+		}
+
+		err = fbo.checkTransactionSpace(lState)
+		if err != nil {
+			return err
+		}
+
 		err = fbo.blocks.Write(
 			ctx, lState, md.ReadOnly(), file, data, off)
 		if err != nil {
@@ -3525,6 +5120,26 @@ func (fbo *folderBranchOps) Truncate(
 			return err
 		}
 
+		err = fbo.checkImmutableFileChange(
+			ctx, lState, md.ReadOnly(), file, size, "truncate")
+		if err != nil {
+			return err
+		}
+		filePath, err := fbo.pathFromNodeForRead(file)
+		if err != nil {
+			return err
+		}
+		err = fbo.checkReadOnlyEntry(
+			ctx, lState, md.ReadOnly(), filePath, "truncate")
+		if err != nil {
+			return err
+		}
+
+		err = fbo.checkTransactionSpace(lState)
+		if err != nil {
+			return err
+		}
+
 		err = fbo.blocks.Truncate(
 			ctx, lState, md.ReadOnly(), file, size)
 		if err != nil {
@@ -3557,6 +5172,9 @@ func (fbo *folderBranchOps) setExLocked(
 	if err != nil {
 		return err
 	}
+	if de.Mode.IsReadOnly() {
+		return ReadOnlyEntryError{"setex", filePath.String()}
+	}
 
 	// If the file is a symlink, do nothing (to match ext4
 	// behavior).
@@ -3604,22 +5222,182 @@ func (fbo *folderBranchOps) setExLocked(
 		ctx, lState, dirCacheUndoFn, []Node{file}, sao, md.ReadOnly())
 }
 
-func (fbo *folderBranchOps) SetEx(
-	ctx context.Context, file Node, ex bool) (err error) {
-	fbo.log.CDebugf(ctx, "SetEx %s %t", getNodeIDStr(file), ex)
+func (fbo *folderBranchOps) SetEx(
+	ctx context.Context, file Node, ex bool) (err error) {
+	fbo.log.CDebugf(ctx, "SetEx %s %t", getNodeIDStr(file), ex)
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "SetEx %s %t done: %+v",
+			getNodeIDStr(file), ex, err)
+	}()
+
+	err = fbo.checkNode(file)
+	if err != nil {
+		return
+	}
+
+	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			return fbo.setExLocked(ctx, lState, file, ex)
+		})
+}
+
+// setModeLocked applies `changeFn` to the dir entry of `node`, and
+// records the change as a modeAttr setAttrOp.  If `changeFn` returns
+// false, the call is treated as a no-op.
+func (fbo *folderBranchOps) setModeLocked(
+	ctx context.Context, lState *lockState, node Node, opName string,
+	changeFn func(p path, de *DirEntry) (bool, error)) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	// Older clients would drop a modeAttr change on the floor, or
+	// let it clobber the exec bit during conflict resolution.
+	if v := fbo.config.OpsVersion(); v < ModeAttrOpsVer {
+		return OpsVersionTooLowError{opName, ModeAttrOpsVer, v}
+	}
+
+	nodePath, err := fbo.pathFromNodeForMDWriteLocked(lState, node)
+	if err != nil {
+		return err
+	}
+	if !nodePath.hasValidParent() {
+		// The root directory has no entry to hold a mode.  Ignore
+		// this rather than fail, since tools like unzip and rsync
+		// set the mode of every directory they touch.
+		fbo.log.CDebugf(ctx, "Ignoring %s on the root directory", opName)
+		return nil
+	}
+
+	// Verify we have permission to write (no need to make a successor yet).
+	md, err := fbo.getMDForWriteLockedForFilename(ctx, lState, "")
+	if err != nil {
+		return err
+	}
+
+	de, err := fbo.blocks.GetDirtyEntryEvenIfDeleted(
+		ctx, lState, md.ReadOnly(), nodePath)
+	if err != nil {
+		return err
+	}
+
+	// Symlinks have no mode of their own (to match ext4 behavior).
+	if de.Type == Sym {
+		fbo.log.CDebugf(ctx, "Ignoring %s on type %s", opName, de.Type)
+		return nil
+	}
+
+	changed, err := changeFn(nodePath, &de)
+	if err != nil {
+		return err
+	} else if !changed {
+		// Like setex, skip no-ops without updating the ctime.
+		fbo.log.CDebugf(ctx, "Ignoring no-op %s", opName)
+		return nil
+	}
+
+	de.Ctime = fbo.nowUnixNano()
+
+	parentPtr := nodePath.parentPath().tailPointer()
+	sao, err := newSetAttrOp(nodePath.tailName(), parentPtr,
+		modeAttr, nodePath.tailPointer())
+	if err != nil {
+		return err
+	}
+	sao.AddSelfUpdate(parentPtr)
+
+	// If the node has been unlinked, we can safely ignore this change.
+	if fbo.nodeCache.IsUnlinked(node) {
+		fbo.log.CDebugf(ctx, "Skipping %s for a removed entry %v",
+			opName, nodePath.tailPointer())
+		fbo.blocks.UpdateCachedEntryAttributesOnRemovedFile(
+			ctx, lState, sao, de)
+		return nil
+	}
+
+	sao.setFinalPath(nodePath)
+
+	dirCacheUndoFn := fbo.blocks.SetAttrInDirEntryInCache(
+		lState, nodePath, de, sao.Attr)
+	return fbo.notifyAndSyncOrSignal(
+		ctx, lState, dirCacheUndoFn, []Node{node}, sao, md.ReadOnly())
+}
+
+func (fbo *folderBranchOps) SetPerm(
+	ctx context.Context, node Node, perm os.FileMode) (err error) {
+	fbo.log.CDebugf(ctx, "SetPerm %s %s", getNodeIDStr(node), perm)
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "SetPerm %s %s done: %+v",
+			getNodeIDStr(node), perm, err)
+	}()
+
+	err = fbo.checkNode(node)
+	if err != nil {
+		return err
+	}
+
+	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			if fbo.config.OpsVersion() < ModeAttrOpsVer {
+				// Fall back to the only permission bit that
+				// every client understands.
+				nodePath, err := fbo.pathFromNodeForMDWriteLocked(
+					lState, node)
+				if err != nil {
+					return err
+				}
+				if !nodePath.hasValidParent() {
+					fbo.log.CDebugf(ctx,
+						"Ignoring setperm on the root directory")
+					return nil
+				}
+				return fbo.setExLocked(ctx, lState, node, perm&0100 != 0)
+			}
+			return fbo.setModeLocked(ctx, lState, node, "setperm",
+				func(p path, de *DirEntry) (bool, error) {
+					if de.Mode.IsReadOnly() {
+						return false, ReadOnlyEntryError{"setperm", p.String()}
+					}
+					newType := de.Type
+					if de.Type != Dir {
+						// The owner's exec bit is tracked in the type.
+						newType = File
+						if perm&0100 != 0 {
+							newType = Exec
+						}
+					}
+					newMode := de.Mode.WithPerm(perm)
+					if newType == de.Type && newMode == de.Mode {
+						return false, nil
+					}
+					de.Type = newType
+					de.Mode = newMode
+					return true, nil
+				})
+		})
+}
+
+func (fbo *folderBranchOps) SetReadOnly(
+	ctx context.Context, node Node, readOnly bool) (err error) {
+	fbo.log.CDebugf(ctx, "SetReadOnly %s %t", getNodeIDStr(node), readOnly)
 	defer func() {
-		fbo.deferLog.CDebugf(ctx, "SetEx %s %t done: %+v",
-			getNodeIDStr(file), ex, err)
+		fbo.deferLog.CDebugf(ctx, "SetReadOnly %s %t done: %+v",
+			getNodeIDStr(node), readOnly, err)
 	}()
 
-	err = fbo.checkNode(file)
+	err = fbo.checkNode(node)
 	if err != nil {
-		return
+		return err
 	}
 
 	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
 		func(lState *lockState) error {
-			return fbo.setExLocked(ctx, lState, file, ex)
+			return fbo.setModeLocked(ctx, lState, node, "setreadonly",
+				func(_ path, de *DirEntry) (bool, error) {
+					if de.Mode.IsReadOnly() == readOnly {
+						return false, nil
+					}
+					de.Mode ^= EntryModeReadOnly
+					return true, nil
+				})
 		})
 }
 
@@ -3644,6 +5422,9 @@ func (fbo *folderBranchOps) setMtimeLocked(
 	if err != nil {
 		return err
 	}
+	if de.Mode.IsReadOnly() {
+		return ReadOnlyEntryError{"setmtime", filePath.String()}
+	}
 	de.Mtime = mtime.UnixNano()
 	// setting the mtime counts as changing the file MD, so must set ctime too
 	de.Ctime = fbo.nowUnixNano()
@@ -3798,7 +5579,8 @@ func (fbo *folderBranchOps) syncAllLocked(
 
 	dirtyFiles := fbo.blocks.GetDirtyFileBlockRefs(lState)
 	dirtyDirs := fbo.blocks.GetDirtyDirBlockRefs(lState)
-	if len(dirtyFiles) == 0 && len(dirtyDirs) == 0 {
+	if len(dirtyFiles) == 0 && len(dirtyDirs) == 0 &&
+		len(fbo.dirsToRewrite) == 0 {
 		return nil
 	}
 
@@ -3865,11 +5647,47 @@ func (fbo *folderBranchOps) syncAllLocked(
 		}
 	}()
 
-	fbo.log.LazyTrace(ctx, "Processing %d op(s)", len(fbo.dirOps))
-
 	newBlocks := make(map[BlockPointer]bool)
 	fileBlocks := make(fileBlockMap)
 	parentsToAddChainsFor := make(map[BlockPointer]bool)
+
+	// Directories that only need to be rewritten get no-op chains
+	// for themselves and all their parents, so the prepper readies
+	// and puts new copies of their blocks.
+	for id, node := range fbo.dirsToRewrite {
+		if fbo.nodeCache.IsUnlinked(node) {
+			continue
+		}
+		dir := fbo.nodeCache.PathFromNode(node)
+		if !dir.isValid() {
+			continue
+		}
+		dirPtr := dir.tailPointer()
+		if _, ok := lbc[dirPtr]; !ok {
+			dblock, err := fbo.blocks.GetDirtyDir(
+				ctx, lState, md, dir, blockWrite)
+			if err != nil {
+				return err
+			}
+			lbc[dirPtr] = dblock
+			resolvedPaths[dirPtr] = dir
+		}
+		for _, pn := range dir.path {
+			parentsToAddChainsFor[pn.BlockPointer] = true
+		}
+		id, node := id, node
+		cleanups = append(cleanups,
+			func(ctx context.Context, lState *lockState, err error) {
+				if err != nil {
+					return
+				}
+				delete(fbo.dirsToRewrite, id)
+				fbo.status.rmDirtyNode(node)
+			})
+	}
+
+	fbo.log.LazyTrace(ctx, "Processing %d op(s)", len(fbo.dirOps))
+
 	for _, dop := range fbo.dirOps {
 		// Copy the op before modifying it, in case there's an error
 		// and we have to retry with the original ops.
@@ -3891,7 +5709,7 @@ func (fbo *folderBranchOps) syncAllLocked(
 			addSelfUpdatesAndParent(p, newOp, parentsToAddChainsFor)
 		}
 
-		var ref BlockRef
+		var refs []BlockRef
 		switch realOp := newOp.(type) {
 		case *createOp:
 			if realOp.Type == Sym {
@@ -3933,11 +5751,14 @@ func (fbo *folderBranchOps) syncAllLocked(
 
 			// If the directory is empty, we need to explicitly clean
 			// up its entry after syncing.
-			ref = newPath.tailRef()
+			refs = append(refs, newPath.tailRef())
 		case *renameOp:
-			ref = realOp.Renamed.Ref()
+			refs = append(refs, realOp.Renamed.Ref())
+			if realOp.isExchange() {
+				refs = append(refs, realOp.Exchanged.Ref())
+			}
 		case *setAttrOp:
-			ref = realOp.File.Ref()
+			refs = append(refs, realOp.File.Ref())
 		default:
 			continue
 		}
@@ -3949,11 +5770,13 @@ func (fbo *folderBranchOps) syncAllLocked(
 			if err != nil {
 				return
 			}
-			wasCleared := fbo.blocks.ClearCachedRef(lState, ref)
-			if wasCleared {
-				node := fbo.nodeCache.Get(ref)
-				if node != nil {
-					fbo.status.rmDirtyNode(node)
+			for _, ref := range refs {
+				wasCleared := fbo.blocks.ClearCachedRef(lState, ref)
+				if wasCleared {
+					node := fbo.nodeCache.Get(ref)
+					if node != nil {
+						fbo.status.rmDirtyNode(node)
+					}
 				}
 			}
 		}()
@@ -4083,7 +5906,7 @@ func (fbo *folderBranchOps) syncAllLocked(
 	head, _ := fbo.getHead(lState)
 	dummyHeadChains := newCRChainsEmpty()
 	dummyHeadChains.mostRecentChainMDInfo = mostRecentChainMetadataInfo{
-		head, head.Data().Dir.BlockInfo}
+		head, head.Data().Dir.BlockInfo, head.IsImmutableSet()}
 
 	// Squash the batch of updates together into a set of blocks and
 	// ready `md` for putting to the server.
@@ -4114,7 +5937,8 @@ func (fbo *folderBranchOps) syncAllLocked(
 	// Put all the blocks.
 	blocksToRemove, err = doBlockPuts(ctx, fbo.config.BlockServer(),
 		fbo.config.BlockCache(), fbo.config.Reporter(), fbo.log, fbo.deferLog, md.TlfID(),
-		md.GetTlfHandle().GetCanonicalName(), *bps)
+		md.GetTlfHandle().GetCanonicalName(), *bps,
+		blockTransferControllersForTlf(fbo.config, md.TlfID()).Puts())
 	if err != nil {
 		return err
 	}
@@ -4173,10 +5997,207 @@ func (fbo *folderBranchOps) SyncAll(
 
 	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
 		func(lState *lockState) error {
+			err := fbo.checkNoTransactionLocked(lState)
+			if err != nil {
+				return err
+			}
 			return fbo.syncAllLocked(ctx, lState, NoExcl)
 		})
 }
 
+// checkNoTransactionLocked returns a TransactionInProgressError if
+// a transaction is open.  Operations that have to sync right away
+// call it first, since their sync would otherwise flush the
+// transaction's changes early.  Internal syncs, like the one done
+// by conflict resolution, don't.
+func (fbo *folderBranchOps) checkNoTransactionLocked(
+	lState *lockState) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+	if fbo.inTxn {
+		return errors.WithStack(TransactionInProgressError{fbo.folderBranch})
+	}
+	return nil
+}
+
+// endTransactionLocked marks the open transaction as done, and stops
+// its timeout.
+func (fbo *folderBranchOps) endTransactionLocked(lState *lockState) {
+	fbo.mdWriterLock.AssertLocked(lState)
+	fbo.inTxn = false
+	if fbo.txnTimer != nil {
+		fbo.txnTimer.Stop()
+		fbo.txnTimer = nil
+	}
+}
+
+// abortExpiredTransaction aborts transaction number gen, if it is
+// still open.
+func (fbo *folderBranchOps) abortExpiredTransaction(gen uint64) {
+	fbo.runUnlessShutdown(func(ctx context.Context) error {
+		lState := makeFBOLockState()
+		fbo.mdWriterLock.Lock(lState)
+		defer fbo.mdWriterLock.Unlock(lState)
+		if !fbo.inTxn || fbo.txnGen != gen {
+			return nil
+		}
+		fbo.log.CWarningf(ctx, "Aborting a transaction that has been "+
+			"open for more than %s", fbo.txnTimeout)
+		err := fbo.abortTransactionLocked(ctx, lState)
+		if err != nil {
+			fbo.log.CWarningf(ctx, "Couldn't abort transaction: %+v", err)
+		}
+		if fbo.inTxn {
+			return nil
+		}
+		fbo.txnExpired = true
+
+		// Nobody may be waiting on the transaction right now, so
+		// report the lost changes too.
+		head := fbo.getTrustedHead(lState)
+		if head != (ImmutableRootMetadata{}) {
+			handle := head.GetTlfHandle()
+			fbo.config.Reporter().ReportErr(
+				ctx, handle.GetCanonicalName(), handle.Type(), WriteMode,
+				TransactionExpiredError{fbo.folderBranch, fbo.txnTimeout})
+		}
+		return nil
+	})
+}
+
+// BeginTransaction implements the KBFSOps interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) BeginTransaction(
+	ctx context.Context, folderBranch FolderBranch) (err error) {
+	fbo.log.CDebugf(ctx, "BeginTransaction")
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "BeginTransaction done: %+v", err)
+	}()
+
+	if folderBranch != fbo.folderBranch {
+		return WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	// Wait for any in-progress re-encryption write, so it's synced
+	// below rather than becoming part of the transaction.
+	fbo.reencryptWriteLock.Lock()
+	defer fbo.reencryptWriteLock.Unlock()
+
+	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			err := fbo.checkNoTransactionLocked(lState)
+			if err != nil {
+				return err
+			}
+			// Sync whatever was done before the transaction, so
+			// that it isn't part of it.
+			err = fbo.syncAllLocked(ctx, lState, NoExcl)
+			if err != nil {
+				return err
+			}
+			fbo.inTxn = true
+			fbo.txnExpired = false
+			fbo.txnGen++
+			gen := fbo.txnGen
+			fbo.txnTimer = time.AfterFunc(fbo.txnTimeout, func() {
+				fbo.abortExpiredTransaction(gen)
+			})
+			return nil
+		})
+}
+
+// CommitTransaction implements the KBFSOps interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) CommitTransaction(
+	ctx context.Context, folderBranch FolderBranch) (err error) {
+	fbo.log.CDebugf(ctx, "CommitTransaction")
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "CommitTransaction done: %+v", err)
+	}()
+
+	if folderBranch != fbo.folderBranch {
+		return WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	return fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+		func(lState *lockState) error {
+			if !fbo.inTxn {
+				if fbo.txnExpired {
+					fbo.txnExpired = false
+					return errors.WithStack(TransactionExpiredError{
+						fbo.folderBranch, fbo.txnTimeout})
+				}
+				return NoTransactionError{fbo.folderBranch}
+			}
+			err := fbo.syncAllLocked(ctx, lState, NoExcl)
+			if err != nil {
+				// Leave the transaction open, so the caller can
+				// retry the commit or abort.
+				return err
+			}
+			fbo.endTransactionLocked(lState)
+			return nil
+		})
+}
+
+func (fbo *folderBranchOps) abortTransactionLocked(
+	ctx context.Context, lState *lockState) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+	if !fbo.inTxn {
+		return NoTransactionError{fbo.folderBranch}
+	}
+
+	err := fbo.blocks.DiscardAllDirtyState(lState)
+	if err != nil {
+		return err
+	}
+	fbo.dirOps = nil
+	fbo.dirsToRewrite = nil
+	fbo.status.clearDirtyNodes()
+	fbo.endTransactionLocked(lState)
+
+	// Point every node back at the current head, which unlinks the
+	// nodes created or renamed during the transaction.
+	fbo.headLock.Lock(lState)
+	defer fbo.headLock.Unlock(lState)
+	if fbo.head == (ImmutableRootMetadata{}) {
+		return nil
+	}
+	changes, err := fbo.blocks.FastForwardAllNodes(
+		ctx, lState, fbo.head.ReadOnly())
+	if err != nil {
+		return err
+	}
+	if len(changes) > 0 {
+		fbo.observers.batchChanges(ctx, changes)
+	}
+	return nil
+}
+
+// AbortTransaction implements the KBFSOps interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) AbortTransaction(
+	ctx context.Context, folderBranch FolderBranch) (err error) {
+	fbo.log.CDebugf(ctx, "AbortTransaction")
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "AbortTransaction done: %+v", err)
+	}()
+
+	if folderBranch != fbo.folderBranch {
+		return WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	lState := makeFBOLockState()
+	fbo.mdWriterLock.Lock(lState)
+	defer fbo.mdWriterLock.Unlock(lState)
+	if !fbo.inTxn && fbo.txnExpired {
+		// The changes are already gone, which is what the caller
+		// wanted.
+		fbo.txnExpired = false
+		return nil
+	}
+	return fbo.abortTransactionLocked(ctx, lState)
+}
+
 func (fbo *folderBranchOps) FolderStatus(
 	ctx context.Context, folderBranch FolderBranch) (
 	fbs FolderBranchStatus, updateChan <-chan StatusUpdate, err error) {
@@ -4278,6 +6299,10 @@ func (fbo *folderBranchOps) getUnlinkPathBeforeUpdatingPointers(
 		node = fbo.nodeCache.Get(realOp.Dir.Unref.Ref())
 		childName = realOp.OldName
 	case *renameOp:
+		if realOp.isExchange() {
+			// Nothing is replaced by an exchange.
+			return path{}, DirEntry{}, false, nil
+		}
 		if realOp.NewDir.Unref != zeroPtr {
 			// moving to a new dir
 			if realOp.NewDir.Ref == realOp.NewDir.Unref {
@@ -4464,6 +6489,14 @@ func (fbo *folderBranchOps) notifyOneOpLocked(ctx context.Context,
 					return err
 				}
 			}
+
+			if realOp.isExchange() {
+				_, err := fbo.nodeCache.Move(
+					realOp.Exchanged.Ref(), oldNode, realOp.OldName)
+				if err != nil {
+					return err
+				}
+			}
 		}
 	case *syncOp:
 		node := fbo.nodeCache.Get(realOp.File.Ref.Ref())
@@ -5211,6 +7244,8 @@ func (fbo *folderBranchOps) rekeyLocked(ctx context.Context,
 				NeedsPaperKey: stillNeedsRekey,
 			}, err
 		}
+		putTLFCryptKeyInDiskMDCache(
+			ctx, fbo.config, fbo.log, md.TlfID(), keyGen, *tlfCryptKey)
 	}
 
 	// send rekey finish notification
@@ -5727,20 +7762,46 @@ func (fbo *folderBranchOps) getCachedDirOpsCount(lState *lockState) int {
 	return len(fbo.dirOps)
 }
 
+func (fbo *folderBranchOps) isInTransaction(lState *lockState) bool {
+	fbo.mdWriterLock.Lock(lState)
+	defer fbo.mdWriterLock.Unlock(lState)
+	return fbo.inTxn
+}
+
+// checkTransactionSpace returns a TransactionTooLargeError if the
+// dirty block cache wants this folder to sync, but it can't because
+// a transaction is open.  Otherwise a write would block until the
+// transaction times out and is aborted.
+func (fbo *folderBranchOps) checkTransactionSpace(lState *lockState) error {
+	// Check the cache first, so that most writes don't need
+	// mdWriterLock.
+	if !fbo.config.DirtyBlockCache().ShouldForceSync(fbo.id()) {
+		return nil
+	}
+	if fbo.isInTransaction(lState) {
+		return errors.WithStack(TransactionTooLargeError{fbo.folderBranch})
+	}
+	return nil
+}
+
 func (fbo *folderBranchOps) backgroundFlusher() {
 	lState := makeFBOLockState()
 	var prevDirtyFileMap map[BlockRef]bool
 	sameDirtyFileCount := 0
 	for {
 		doSelect := true
-		if fbo.blocks.GetState(lState) == dirtyState &&
+		// Nothing gets synced during a transaction, so just wait
+		// for the next signal.  Writes that would need a sync to
+		// make room fail with TransactionTooLargeError instead.
+		inTxn := fbo.isInTransaction(lState)
+		if !inTxn && fbo.blocks.GetState(lState) == dirtyState &&
 			fbo.config.DirtyBlockCache().ShouldForceSync(fbo.id()) &&
 			sameDirtyFileCount < 10 {
 			// We have dirty files, and the system has a full buffer,
 			// so don't bother waiting for a signal, just get right to
 			// the main attraction.
 			doSelect = false
-		} else if fbo.getCachedDirOpsCount(lState) >=
+		} else if !inTxn && fbo.getCachedDirOpsCount(lState) >=
 			fbo.config.BGFlushDirOpBatchSize() {
 			doSelect = false
 		}
@@ -5784,6 +7845,11 @@ func (fbo *folderBranchOps) backgroundFlusher() {
 			}
 		}
 
+		if fbo.isInTransaction(lState) {
+			sameDirtyFileCount = 0
+			continue
+		}
+
 		dirtyFiles := fbo.blocks.GetDirtyFileBlockRefs(lState)
 		dirOpsCount := fbo.getCachedDirOpsCount(lState)
 		if len(dirtyFiles) == 0 && dirOpsCount == 0 {
@@ -5830,7 +7896,10 @@ func (fbo *folderBranchOps) backgroundFlusher() {
 				context.WithTimeout(ctx, backgroundTaskTimeout)
 			defer longCancel()
 			err = fbo.SyncAll(longCtx, fbo.folderBranch)
-			if err != nil {
+			if _, ok := errors.Cause(err).(TransactionInProgressError); ok {
+				// A transaction began since the check above.
+				fbo.log.CDebugf(ctx, "Not syncing during a transaction")
+			} else if err != nil {
 				// Just log the warning and keep trying to
 				// sync the rest of the dirty files.
 				fbo.log.CWarningf(ctx, "Couldn't sync all: %+v", err)
@@ -6099,44 +8168,90 @@ func (fbo *folderBranchOps) GetUpdateHistory(ctx context.Context,
 	history.Updates = make([]UpdateSummary, 0, len(rmds))
 	writerNames := make(map[keybase1.UID]string)
 	for _, rmd := range rmds {
-		writer, ok := writerNames[rmd.LastModifyingWriter()]
-		if !ok {
-			name, err := fbo.config.KBPKI().GetNormalizedUsername(
-				ctx, rmd.LastModifyingWriter().AsUserOrTeam())
-			if err != nil {
-				return TLFUpdateHistory{}, err
-			}
-			writer = string(name)
-			writerNames[rmd.LastModifyingWriter()] = writer
+		writer, err := fbo.getWriterName(ctx, rmd, writerNames)
+		if err != nil {
+			return TLFUpdateHistory{}, err
 		}
-		updateSummary := UpdateSummary{
-			Revision:  rmd.Revision(),
-			Date:      time.Unix(0, rmd.data.Dir.Mtime),
-			Writer:    writer,
-			LiveBytes: rmd.DiskUsage(),
-			Ops:       make([]OpSummary, 0, len(rmd.data.Changes.Ops)),
+		history.Updates = append(
+			history.Updates, makeUpdateSummary(rmd, writer, nil))
+	}
+	return history, nil
+}
+
+// GetUpdateHistoryPage implements the KBFSOps interface for
+// folderBranchOps.
+func (fbo *folderBranchOps) GetUpdateHistoryPage(ctx context.Context,
+	folderBranch FolderBranch, cursor kbfsmd.Revision, limit int,
+	filter UpdateHistoryFilter) (page UpdateHistoryPage, err error) {
+	fbo.log.CDebugf(ctx, "GetUpdateHistoryPage cursor=%d limit=%d %+v",
+		cursor, limit, filter)
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "GetUpdateHistoryPage done: %d updates, "+
+			"next=%d, %+v", len(page.Updates), page.NextCursor, err)
+	}()
+
+	if folderBranch != fbo.folderBranch {
+		return UpdateHistoryPage{}, WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	lState := makeFBOLockState()
+	head, err := fbo.getMDForReadNeedIdentify(ctx, lState)
+	if err != nil {
+		return UpdateHistoryPage{}, err
+	}
+	page.ID = head.TlfID().String()
+	page.Name = head.GetTlfHandle().GetCanonicalPath()
+
+	if limit <= 0 {
+		limit = defaultUpdateHistoryPageSize
+	}
+	end := fbo.getLatestMergedRevision(lState)
+	if cursor != kbfsmd.RevisionUninitialized && cursor < end {
+		end = cursor
+	}
+
+	writerNames := make(map[keybase1.UID]string)
+	numInspected := 0
+	for end >= kbfsmd.RevisionInitial {
+		start := end - maxMDsAtATime + 1 // (kbfsmd.Revision is signed)
+		if start < kbfsmd.RevisionInitial {
+			start = kbfsmd.RevisionInitial
+		}
+		rmds, err := getMDRange(
+			ctx, fbo.config, fbo.id(), NullBranchID, start, end, Merged)
+		if err != nil {
+			return UpdateHistoryPage{}, err
 		}
-		for _, op := range rmd.data.Changes.Ops {
-			opSummary := OpSummary{
-				Op:      op.String(),
-				Refs:    make([]string, 0, len(op.Refs())),
-				Unrefs:  make([]string, 0, len(op.Unrefs())),
-				Updates: make(map[string]string),
+
+		revPaths := fbo.getUpdateOpPaths(ctx, rmds)
+		for i := len(rmds) - 1; i >= 0; i-- {
+			rmd := rmds[i]
+			if len(page.Updates) == limit ||
+				numInspected == maxUpdateHistoryRevsPerPage {
+				page.NextCursor = rmd.Revision()
+				return page, nil
 			}
-			for _, ptr := range op.Refs() {
-				opSummary.Refs = append(opSummary.Refs, ptr.String())
+			numInspected++
+
+			if !filter.Since.IsZero() &&
+				rmd.LocalTimestamp().Before(filter.Since) {
+				// The server orders revisions by time, so no
+				// older revision can match either.
+				return page, nil
 			}
-			for _, ptr := range op.Unrefs() {
-				opSummary.Unrefs = append(opSummary.Unrefs, ptr.String())
+
+			updateSummary, ok, err := fbo.makeFilteredUpdateSummary(
+				ctx, rmd, revPaths[rmd.Revision()], filter, writerNames)
+			if err != nil {
+				return UpdateHistoryPage{}, err
 			}
-			for _, update := range op.allUpdates() {
-				opSummary.Updates[update.Unref.String()] = update.Ref.String()
+			if ok {
+				page.Updates = append(page.Updates, updateSummary)
 			}
-			updateSummary.Ops = append(updateSummary.Ops, opSummary)
 		}
-		history.Updates = append(history.Updates, updateSummary)
+		end = start - 1
 	}
-	return history, nil
+	return page, nil
 }
 
 // GetEditHistory implements the KBFSOps interface for folderBranchOps
@@ -6160,6 +8275,64 @@ func (fbo *folderBranchOps) GetEditHistory(ctx context.Context,
 	return fbo.editHistory.GetComplete(ctx, head)
 }
 
+func (fbo *folderBranchOps) getSearchIndex(
+	ctx context.Context, kmd KeyMetadata) (*tlfSearchIndex, error) {
+	fbo.searchIndexLock.Lock()
+	defer fbo.searchIndexLock.Unlock()
+	if fbo.searchIndex != nil {
+		return fbo.searchIndex, nil
+	}
+	select {
+	case <-fbo.shutdownChan:
+		return nil, ShutdownHappenedError{}
+	default:
+	}
+	si, err := newTLFSearchIndex(ctx, fbo.config, fbo, kmd)
+	if err != nil {
+		return nil, err
+	}
+	fbo.searchIndex = si
+	return si, nil
+}
+
+// startSearchIndex opens the search index in the background, which
+// builds or updates it.
+func (fbo *folderBranchOps) startSearchIndex(md ImmutableRootMetadata) {
+	ctx := ctxWithRandomIDReplayable(
+		context.Background(), CtxFBOIDKey, CtxFBOOpID, fbo.log)
+	_, err := fbo.getSearchIndex(ctx, md)
+	if err != nil {
+		fbo.log.CDebugf(ctx, "Couldn't start search index: %+v", err)
+	}
+}
+
+// FindEntries implements the KBFSOps interface for folderBranchOps.
+func (fbo *folderBranchOps) FindEntries(ctx context.Context,
+	folderBranch FolderBranch, query SearchQuery) (
+	results []SearchResult, err error) {
+	fbo.log.CDebugf(ctx, "FindEntries %+v", query)
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "FindEntries done: %d results, %+v",
+			len(results), err)
+	}()
+
+	if folderBranch != fbo.folderBranch {
+		return nil, WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	lState := makeFBOLockState()
+	head, err := fbo.getMDForReadNeedIdentify(ctx, lState)
+	if err != nil {
+		return nil, err
+	}
+
+	si, err := fbo.getSearchIndex(ctx, head)
+	if err != nil {
+		return nil, err
+	}
+	return si.search(ctx, query)
+}
+
 // PushStatusChange forces a new status be fetched by status listeners.
 func (fbo *folderBranchOps) PushStatusChange() {
 	fbo.config.KBFSOps().PushStatusChange()
@@ -39,9 +39,22 @@ type FolderBranchStatus struct {
 
 	Journal *TLFJournalStatus `json:",omitempty"`
 
+	Reencryption *ReencryptionStatus `json:",omitempty"`
+
 	PermanentErr string `json:",omitempty"`
 }
 
+// ReencryptionStatus describes the progress of the background task
+// that re-encrypts the blocks of a folder with its latest key
+// generation.  It is only reported once the task has been enabled.
+type ReencryptionStatus struct {
+	TargetKeyGen       KeyGen
+	InProgress         bool
+	EntriesChecked     int
+	EntriesReencrypted int
+	LastErr            string `json:",omitempty"`
+}
+
 // KBFSStatus represents the content of the top-level status file. It is
 // suitable for encoding directly as JSON.
 // TODO: implement magical status update like FolderBranchStatus
@@ -53,6 +66,7 @@ type KBFSStatus struct {
 	FailingServices map[string]error
 	JournalServer   *JournalServerStatus  `json:",omitempty"`
 	DiskCacheStatus *DiskBlockCacheStatus `json:",omitempty"`
+	BlockTransfers  *BlockTransferStatus  `json:",omitempty"`
 }
 
 // StatusUpdate is a dummy type used to indicate status has been updated.
@@ -70,6 +84,7 @@ type folderBranchStatusKeeper struct {
 	dirtyNodes map[NodeID]Node
 	unmerged   []*crChainSummary
 	merged     []*crChainSummary
+	reencrypt  *ReencryptionStatus
 	dataMutex  sync.Mutex
 
 	updateChan  chan StatusUpdate
@@ -126,6 +141,17 @@ func (fbsk *folderBranchStatusKeeper) setPermErr(err error) {
 	fbsk.signalChangeLocked()
 }
 
+func (fbsk *folderBranchStatusKeeper) setReencryptionStatus(
+	status ReencryptionStatus) {
+	fbsk.dataMutex.Lock()
+	defer fbsk.dataMutex.Unlock()
+	if fbsk.reencrypt != nil && *fbsk.reencrypt == status {
+		return
+	}
+	fbsk.reencrypt = &status
+	fbsk.signalChangeLocked()
+}
+
 func (fbsk *folderBranchStatusKeeper) addNode(m map[NodeID]Node, n Node) bool {
 	fbsk.dataMutex.Lock()
 	defer fbsk.dataMutex.Unlock()
@@ -160,6 +186,18 @@ func (fbsk *folderBranchStatusKeeper) rmDirtyNode(n Node) bool {
 	return fbsk.rmNode(fbsk.dirtyNodes, n)
 }
 
+// clearDirtyNodes forgets all dirty nodes, after their changes have
+// been discarded.
+func (fbsk *folderBranchStatusKeeper) clearDirtyNodes() {
+	fbsk.dataMutex.Lock()
+	defer fbsk.dataMutex.Unlock()
+	if len(fbsk.dirtyNodes) == 0 {
+		return
+	}
+	fbsk.dirtyNodes = make(map[NodeID]Node)
+	fbsk.signalChangeLocked()
+}
+
 // dataMutex should be taken by the caller
 func (fbsk *folderBranchStatusKeeper) convertNodesToPathsLocked(
 	m map[NodeID]Node) []string {
@@ -227,6 +265,11 @@ func (fbsk *folderBranchStatusKeeper) getStatus(ctx context.Context,
 	fbs.Unmerged = fbsk.unmerged
 	fbs.Merged = fbsk.merged
 
+	if fbsk.reencrypt != nil {
+		reencrypt := *fbsk.reencrypt
+		fbs.Reencryption = &reencrypt
+	}
+
 	if fbsk.permErr != nil {
 		fbs.PermanentErr = fbsk.permErr.Error()
 	}
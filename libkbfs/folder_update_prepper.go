@@ -902,6 +902,9 @@ func fixOpPointersForUpdate(oldOps []op, updates map[BlockPointer]BlockPointer,
 		case *renameOp:
 			updatesToFix = append(updatesToFix, &realOp.OldDir, &realOp.NewDir)
 			ptrsToFix = append(ptrsToFix, &realOp.Renamed)
+			if realOp.isExchange() {
+				ptrsToFix = append(ptrsToFix, &realOp.Exchanged)
+			}
 			// Hack: we need to fixup local conflict renames so that the block
 			// update changes to the new block pointer.
 			for i := range realOp.Updates {
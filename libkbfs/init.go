@@ -59,6 +59,12 @@ type InitParams struct {
 	// "dir:/path/to/dir".
 	LocalFavoriteStorage string
 
+	// LocalIdentityFile, if non-empty, is the path to a JSON file
+	// defining the users and teams for LocalUser mode, which is
+	// reloaded whenever it changes; see ParseLocalIdentities for
+	// the format.
+	LocalIdentityFile string
+
 	// TLFValidDuration is the duration that TLFs are valid
 	// before marked for lazy revalidation.
 	TLFValidDuration time.Duration
@@ -67,6 +73,18 @@ type InitParams struct {
 	// when creating new metadata.
 	MetadataVersion MetadataVer
 
+	// OpsVersion is the newest version of ops to write into new
+	// metadata.
+	OpsVersion OpsVer
+
+	// BlockCryptVersion is the encryption version to use when
+	// creating new blocks.
+	BlockCryptVersion EncryptionVer
+
+	// BlockPadding is the padding scheme to use when creating new
+	// blocks with EncryptionAESGCM.
+	BlockPadding BlockPadding
+
 	// LogToFile if true, logs to a default file location.
 	LogToFile bool
 
@@ -104,6 +122,17 @@ type InitParams struct {
 
 	// Mode describes how KBFS should initialize itself.
 	Mode string
+
+	// TraceFile, if non-empty, is the path of a file to which
+	// spans for traced operations are appended, in the
+	// OpenTelemetry OTLP/JSON format.
+	TraceFile string
+
+	// RetentionPolicyFile, if non-empty, is the path of a JSON file
+	// of per-TLF retention policies for quota reclamation on this
+	// device; see ParseRetentionPolicies for the format.  A policy
+	// stored in a TLF's MD takes precedence.
+	RetentionPolicyFile string
 }
 
 // defaultBServer returns the default value for the -bserver flag.
@@ -155,11 +184,14 @@ func defaultLogPath(ctx Context) string {
 // DefaultInitParams returns default init params
 func DefaultInitParams(ctx Context) InitParams {
 	return InitParams{
-		Debug:            BoolForString(os.Getenv("KBFS_DEBUG")),
-		BServerAddr:      defaultBServer(ctx),
-		MDServerAddr:     defaultMDServer(ctx),
-		TLFValidDuration: tlfValidDurationDefault,
-		MetadataVersion:  defaultMetadataVersion(ctx),
+		Debug:             BoolForString(os.Getenv("KBFS_DEBUG")),
+		BServerAddr:       defaultBServer(ctx),
+		MDServerAddr:      defaultMDServer(ctx),
+		TLFValidDuration:  tlfValidDurationDefault,
+		MetadataVersion:   defaultMetadataVersion(ctx),
+		OpsVersion:        defaultClientOpsVer,
+		BlockCryptVersion: defaultClientBlockCryptVer,
+		BlockPadding:      defaultClientBlockPadding,
 		LogFileConfig: logger.LogFileConfig{
 			MaxAge:       30 * 24 * time.Hour,
 			MaxSize:      128 * 1024 * 1024,
@@ -183,16 +215,25 @@ func AddFlags(flags *flag.FlagSet, ctx Context) *InitParams {
 		"Print debug messages")
 
 	flags.StringVar(&params.BServerAddr, "bserver", defaultParams.BServerAddr,
-		"host:port of the block server, 'memory', or 'dir:/path/to/dir'")
+		"host:port of the block server, 'memory', or 'dir:/path/to/dir'; "+
+			"prefix with 'chaos:' and suffix with '?latency=200ms&err=0.05' "+
+			"(also disconnect, disconnect-time, bandwidth, seed) to "+
+			"inject faults")
 	flags.StringVar(&params.MDServerAddr, "mdserver",
 		defaultParams.MDServerAddr,
-		"host:port of the metadata server, 'memory', or 'dir:/path/to/dir'")
+		"host:port of the metadata server, 'memory', or "+
+			"'dir:/path/to/dir'; prefix with 'chaos:' to inject faults, as "+
+			"for -bserver")
 	flags.StringVar(&params.LocalUser, "localuser", defaultParams.LocalUser,
 		"fake local user")
 	flags.StringVar(&params.LocalFavoriteStorage, "local-fav-storage",
 		defaultParams.LocalFavoriteStorage,
 		"where to put favorites; used only when -localuser is set, then must "+
 			"either be 'memory' or 'dir:/path/to/dir'")
+	flags.StringVar(&params.LocalIdentityFile, "local-identity-file",
+		defaultParams.LocalIdentityFile,
+		"path to a JSON file of users, devices and teams to use instead of "+
+			"the built-in ones when -localuser is set; reloaded on change")
 	flags.DurationVar(&params.TLFValidDuration, "tlf-valid",
 		defaultParams.TLFValidDuration,
 		"time tlfs are valid before redoing identification")
@@ -240,10 +281,35 @@ func AddFlags(flags *flag.FlagSet, ctx Context) *InitParams {
 	flags.IntVar((*int)(&params.MetadataVersion), "md-version",
 		int(defaultParams.MetadataVersion),
 		"Metadata version to use when creating new metadata")
+	flags.IntVar((*int)(&params.OpsVersion), "ops-version",
+		int(defaultParams.OpsVersion),
+		fmt.Sprintf("Newest version of operations to write into new "+
+			"metadata (%d: understood by all clients, %d: also rename "+
+			"exchanges, %d: also permission bits and read-only flags, "+
+			"%d: also immutable folders); only raise it once every "+
+			"device using your folders understands it", FirstValidOpsVer,
+			RenameExchangeOpsVer, ModeAttrOpsVer, ImmutableOpsVer))
+	flags.IntVar((*int)(&params.BlockCryptVersion), "block-crypt-version",
+		int(defaultParams.BlockCryptVersion),
+		fmt.Sprintf("Encryption version to use when creating new blocks "+
+			"(%d: secretbox, %d: AES-GCM)", EncryptionSecretbox,
+			EncryptionAESGCM))
+	flags.IntVar((*int)(&params.BlockPadding), "block-padding",
+		int(defaultParams.BlockPadding),
+		fmt.Sprintf("Padding scheme to use for new AES-GCM blocks "+
+			"(%d: power of two, %d: Padmé)", BlockPaddingPowerOfTwo,
+			BlockPaddingPadme))
 	flags.StringVar(&params.Mode, "mode", InitDefaultString,
 		fmt.Sprintf("Overall initialization mode for KBFS, indicating how "+
 			"heavy-weight it can be (%s or %s)", InitDefaultString,
 			InitMinimalString))
+	flags.StringVar(&params.TraceFile, "trace-file", "",
+		"If non-empty, append traces of filesystem operations to this "+
+			"file, in the OpenTelemetry OTLP/JSON format")
+	flags.StringVar(&params.RetentionPolicyFile, "retention-policies", "",
+		"If non-empty, a JSON file of per-folder retention policies for "+
+			"quota reclamation on this device, for folders without a "+
+			"policy stored in their metadata")
 
 	return &params
 }
@@ -260,8 +326,8 @@ func GetRemoteUsageString() string {
 // run in a local testing environment.
 func GetLocalUsageString() string {
 	return `    [-debug]
-    [-bserver=(memory | dir:/path/to/dir | host:port)]
-    [-mdserver=(memory | dir:/path/to/dir | host:port)]
+    [-bserver=[chaos:](memory | dir:/path/to/dir | host:port)[?params]]
+    [-mdserver=[chaos:](memory | dir:/path/to/dir | host:port)[?params]]
     [-localuser=<user>]
     [-local-fav-storage=(memory | dir:/path/to/dir)]
     [-log-to-file] [-log-file=path/to/file] [-clean-bcache-cap=0]`
@@ -297,6 +363,19 @@ func parseRootDir(addr string) (string, bool) {
 func makeMDServer(config Config, mdserverAddr string,
 	rpcLogFactory *libkb.RPCLogFactory, log logger.Logger) (
 	MDServer, error) {
+	innerAddr, chaosParams, isChaos, err := parseChaosAddr(mdserverAddr)
+	if err != nil {
+		return nil, err
+	}
+	if isChaos {
+		mdServer, err := makeMDServer(config, innerAddr, rpcLogFactory, log)
+		if err != nil {
+			return nil, err
+		}
+		log.Debug("Injecting faults into mdserver %s", innerAddr)
+		return NewMDServerChaos(config, mdServer, chaosParams), nil
+	}
+
 	if mdserverAddr == memoryAddr {
 		log.Debug("Using in-memory mdserver")
 		// local in-memory MD server
@@ -323,6 +402,16 @@ func makeMDServer(config Config, mdserverAddr string,
 
 func makeKeyServer(config Config, keyserverAddr string,
 	log logger.Logger) (KeyServer, error) {
+	// Faults are only injected into the key server when it's the
+	// same as the MD server.
+	innerAddr, _, isChaos, err := parseChaosAddr(keyserverAddr)
+	if err != nil {
+		return nil, err
+	}
+	if isChaos {
+		keyserverAddr = innerAddr
+	}
+
 	if keyserverAddr == memoryAddr {
 		log.Debug("Using in-memory keyserver")
 		// local in-memory key server
@@ -342,7 +431,11 @@ func makeKeyServer(config Config, keyserverAddr string,
 
 	log.Debug("Using remote keyserver %s (same as mdserver)", keyserverAddr)
 	// currently the MD server also acts as the key server.
-	keyServer, ok := config.MDServer().(KeyServer)
+	mdServer := config.MDServer()
+	if chaos, ok := mdServer.(MDServerChaos); ok {
+		mdServer = chaos.MDServer
+	}
+	keyServer, ok := mdServer.(KeyServer)
 	if !ok {
 		return nil, errors.New("MD server is not a key server")
 	}
@@ -352,6 +445,19 @@ func makeKeyServer(config Config, keyserverAddr string,
 func makeBlockServer(config Config, bserverAddr string,
 	rpcLogFactory *libkb.RPCLogFactory,
 	log logger.Logger) (BlockServer, error) {
+	innerAddr, chaosParams, isChaos, err := parseChaosAddr(bserverAddr)
+	if err != nil {
+		return nil, err
+	}
+	if isChaos {
+		bserv, err := makeBlockServer(config, innerAddr, rpcLogFactory, log)
+		if err != nil {
+			return nil, err
+		}
+		log.Debug("Injecting faults into bserver %s", innerAddr)
+		return NewBlockServerChaos(config, bserv, chaosParams), nil
+	}
+
 	if bserverAddr == memoryAddr {
 		log.Debug("Using in-memory bserver")
 		bserverLog := config.MakeLogger("BSM")
@@ -522,6 +628,10 @@ func doInit(ctx Context, params InitParams, keybaseServiceCn KeybaseServiceCn,
 		workers = minimalBlockRetrievalWorkerQueueSize
 		prefetchWorkers = minimalPrefetchWorkerQueueSize
 	}
+	// The block ops need the controllers when they start their
+	// retrieval workers.
+	config.SetBlockTransferControllers(
+		NewBlockTransferControllers(config.Clock(), workers))
 	config.SetBlockOps(NewBlockOpsStandard(config, workers, prefetchWorkers))
 
 	bsplitter, err := NewBlockSplitterSimple(MaxBlockSizeBytesDefault, 8*1024,
@@ -542,9 +652,35 @@ func doInit(ctx Context, params InitParams, keybaseServiceCn KeybaseServiceCn,
 	}
 
 	config.SetMetadataVersion(MetadataVer(params.MetadataVersion))
+	config.SetOpsVersion(params.OpsVersion)
+	config.SetBlockCryptVersion(params.BlockCryptVersion)
+	config.SetBlockPadding(params.BlockPadding)
 	config.SetTLFValidDuration(params.TLFValidDuration)
 	config.SetBGFlushPeriod(params.BGFlushPeriod)
 
+	if params.TraceFile != "" {
+		spanExporter, err := NewSpanFileExporter(
+			params.TraceFile, config.MakeLogger("SPAN"))
+		if err != nil {
+			log.Warning("Could not open trace file: %+v", err)
+		} else {
+			config.SetSpanExporter(spanExporter)
+			log.Debug("Writing traces to %s", params.TraceFile)
+		}
+	}
+
+	if params.RetentionPolicyFile != "" {
+		// Don't fall back to the defaults on failure, since they
+		// might reclaim history that is supposed to be kept.
+		rp, err := LoadRetentionPolicies(params.RetentionPolicyFile)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"Couldn't load retention policies from %s: %+v",
+				params.RetentionPolicyFile, err)
+		}
+		config.SetRetentionPolicies(rp)
+	}
+
 	kbfsOps := NewKBFSOpsStandard(config)
 	config.SetKBFSOps(kbfsOps)
 	config.SetNotifier(kbfsOps)
@@ -646,6 +782,14 @@ func doInit(ctx Context, params InitParams, keybaseServiceCn KeybaseServiceCn,
 			config.SetDiskBlockCache(dbc)
 			log.Debug("Disk cache enabled")
 		}
+		dmc, err := newDiskMDCacheStandard(config,
+			diskMDCacheRootFromStorageRoot(params.StorageRoot))
+		if err != nil {
+			log.Warning("Could not initialize disk MD cache: %+v", err)
+		} else {
+			config.SetDiskMDCache(dmc)
+			log.Debug("Disk MD cache enabled")
+		}
 	}
 
 	if params.BGFlushDirOpBatchSize < 1 {
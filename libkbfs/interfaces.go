@@ -5,6 +5,7 @@
 package libkbfs
 
 import (
+	"os"
 	"time"
 
 	"github.com/keybase/client/go/libkb"
@@ -24,6 +25,15 @@ type dataVersioner interface {
 	DataVersion() DataVer
 }
 
+type blockCryptVersioner interface {
+	// BlockCryptVersion returns the encryption version to use for
+	// new blocks.
+	BlockCryptVersion() EncryptionVer
+	// BlockPadding returns the padding scheme to use for new blocks
+	// encrypted with EncryptionAESGCM.
+	BlockPadding() BlockPadding
+}
+
 type logMaker interface {
 	MakeLogger(module string) logger.Logger
 }
@@ -68,6 +78,20 @@ type diskBlockCacheSetter interface {
 	SetDiskBlockCache(DiskBlockCache)
 }
 
+type diskMDCacheGetter interface {
+	DiskMDCache() DiskMDCache
+}
+
+type diskMDCacheSetter interface {
+	SetDiskMDCache(DiskMDCache)
+}
+
+type spanExporterGetter interface {
+	// SpanExporter returns the exporter for new traces, or nil if
+	// spans aren't being collected.
+	SpanExporter() SpanExporter
+}
+
 type clockGetter interface {
 	Clock() Clock
 }
@@ -76,6 +100,13 @@ type diskLimiterGetter interface {
 	DiskLimiter() DiskLimiter
 }
 
+type blockTransferControllersGetter interface {
+	// BlockTransferControllers returns the controllers that limit
+	// concurrent block transfers.  It may be nil, in which case
+	// transfers are only limited by the fixed worker counts.
+	BlockTransferControllers() *BlockTransferControllers
+}
+
 // Block just needs to be (de)serialized using msgpack
 type Block interface {
 	dataVersioner
@@ -117,6 +148,28 @@ type Node interface {
 	GetBasename() string
 }
 
+// BulkFileWriter writes the contents of a brand new file straight to
+// the block servers, without going through the dirty block cache.
+// Data can only be appended.  Blocks are encrypted and put as soon as
+// they fill up, so only a few blocks are ever held in memory, and the
+// new file only becomes visible, all at once, when Close succeeds.
+//
+// A BulkFileWriter's methods must not be called concurrently.
+type BulkFileWriter interface {
+	// Write appends `data` to the file.  After an error, the writer
+	// can only be aborted.
+	Write(ctx context.Context, data []byte) error
+	// Close finishes putting the file's blocks, and links the new
+	// file into its parent directory.  This is a remote-sync
+	// operation.  Whether or not it succeeds, the writer can't be
+	// used again.
+	Close(ctx context.Context) (EntryInfo, error)
+	// Abort stops the upload, and deletes any blocks that were
+	// already put.  It does nothing if the writer was already
+	// closed or aborted.
+	Abort(ctx context.Context) error
+}
+
 // KBFSOps handles all file system operations.  Expands all indirect
 // pointers.  Operations that modify the server data change all the
 // block IDs along the path, and so must return a path with the new
@@ -227,6 +280,35 @@ type KBFSOps interface {
 	// is a remote-sync operation.
 	CreateLink(ctx context.Context, dir Node, fromName string, toPath string) (
 		EntryInfo, error)
+	// CreateBulkFile returns a writer for a new file named `name`
+	// under the given directory node.  Unlike CreateFile, the file
+	// doesn't exist until the writer is closed, and its data never
+	// passes through the dirty block cache, so it's a better fit
+	// for writing a large file in one go.  It returns a
+	// NameExistsError if `name` already exists, either now or when
+	// the writer is closed.  The writer's block puts run under
+	// `ctx`, so it must stay valid until the writer is closed or
+	// aborted.
+	CreateBulkFile(ctx context.Context, dir Node, name string, isExec bool) (
+		BulkFileWriter, error)
+	// CopyFile creates a new entry named destName under destDir,
+	// which must be in the same top-level folder as src, holding a
+	// copy of the file or symlink represented by src.  The copy
+	// shares src's data blocks by adding new references to them,
+	// rather than by reading and re-uploading the data; later
+	// writes to either file only affect that file.  Returns the
+	// new entry info for the copy.  This is a remote-sync
+	// operation.
+	CopyFile(ctx context.Context, src Node, destDir Node, destName string) (
+		EntryInfo, error)
+	// CopyFileContents replaces the contents of the empty file
+	// represented by dest with a copy of the file represented by
+	// src, which must be in the same top-level folder, sharing
+	// src's data blocks the way CopyFile does.  It returns
+	// FileNotEmptyError if dest has any data.  Returns the new
+	// entry info for dest.  This is a remote-sync operation.
+	CopyFileContents(ctx context.Context, src Node, dest Node) (
+		EntryInfo, error)
 	// RemoveDir removes the subdirectory represented by the given
 	// node, if the logged-in user has write permission to the
 	// top-level folder.  Will return an error if the subdirectory is
@@ -241,10 +323,38 @@ type KBFSOps interface {
 	// that folder, and will return an error if nodes from different
 	// folders are passed in.  Also returns an error if the new name
 	// already has an entry corresponding to an existing directory
-	// (only non-dir types may be renamed over).  This is a
-	// remote-sync operation.
+	// (only non-dir types may be renamed over).  With
+	// RenameNoReplace, it instead returns NameExistsError if the new
+	// name has any entry at all.  With RenameExchange, the entries at
+	// the old and new names, which must both exist but may be of any
+	// type, are swapped atomically; since older clients would
+	// misapply the exchange, it fails with OpsVersionTooLowError
+	// unless OpsVersion is at least RenameExchangeOpsVer.  This is
+	// a remote-sync operation.
 	Rename(ctx context.Context, oldParent Node, oldName string, newParent Node,
-		newName string) error
+		newName string, flags RenameFlags) error
+	// TransferAcrossFolders copies the entry at src, recursively,
+	// to dest, which may be in a different top-level folder, and
+	// then removes src if move is true.  The data is read from src
+	// and written anew under dest, so it's encrypted with dest's
+	// keys.  Progress is recorded under the given ID, and if the
+	// transfer is interrupted, calling this again with the same ID
+	// and paths resumes it; RollBackCrossFolderTransfer undoes it
+	// instead.  src is only removed once all of dest has been
+	// flushed to the server.  dest must not exist when the
+	// transfer starts.
+	TransferAcrossFolders(ctx context.Context, id string,
+		src, dest FolderPath, move bool) error
+	// CrossFolderTransferStatus returns the recorded progress of
+	// the unfinished cross-folder transfer with the given ID, and
+	// false if there is no such transfer.
+	CrossFolderTransferStatus(id string) (
+		CrossFolderTransferState, bool, error)
+	// RollBackCrossFolderTransfer removes everything an unfinished
+	// cross-folder transfer has created under its destination, and
+	// forgets the transfer.  A move that has started removing its
+	// source can't be rolled back, and must be resumed instead.
+	RollBackCrossFolderTransfer(ctx context.Context, id string) error
 	// Read fills in the given buffer with data from the file at the
 	// given node starting at the given offset, if the logged-in user
 	// has read permission to the top-level folder.  The read data
@@ -286,6 +396,22 @@ type KBFSOps interface {
 	// the top-level folder.  If mtime is nil, it is a noop.  This is
 	// a remote-sync operation.
 	SetMtime(ctx context.Context, file Node, mtime *time.Time) error
+	// SetPerm sets the POSIX permission bits on the file or
+	// directory represented by a given node, if the logged-in user
+	// has write permissions to the top-level folder.  For files, the
+	// user-executable bit also sets the executable bit, as in SetEx.
+	// Unless OpsVersion is at least ModeAttrOpsVer, only that
+	// executable bit is kept, since older clients don't understand
+	// the other bits.  This is a remote-sync operation.
+	SetPerm(ctx context.Context, node Node, perm os.FileMode) error
+	// SetReadOnly turns on or off the read-only flag on the file or
+	// directory represented by a given node, if the logged-in user
+	// has write permissions to the top-level folder.  While the flag
+	// is on, the entry can't be written to, removed or renamed, and
+	// the children of a directory can't be changed.  It fails with
+	// OpsVersionTooLowError unless OpsVersion is at least
+	// ModeAttrOpsVer.  This is a remote-sync operation.
+	SetReadOnly(ctx context.Context, node Node, readOnly bool) error
 	// SyncAll flushes all outstanding writes and truncates for any
 	// dirty files to the KBFS servers within the given folder, if the
 	// logged-in user has write permissions to the top-level folder.
@@ -293,6 +419,31 @@ type KBFSOps interface {
 	// modifications done via multiple file handles.  This is a
 	// remote-sync operation.
 	SyncAll(ctx context.Context, folderBranch FolderBranch) error
+	// BeginTransaction syncs any outstanding changes in the given
+	// folder branch, and then starts a transaction on it.  Until the
+	// transaction is committed or aborted, all changes made to the
+	// folder branch through this KBFSOps are only kept locally:
+	// there are no background syncs, and SyncAll fails with
+	// TransactionInProgressError, as do operations that must sync
+	// right away, like exclusive creates, CopyFile,
+	// CopyFileContents, CreateBulkFile and MakeImmutable.  The dirty
+	// data must fit in the dirty block cache; writes beyond that
+	// block until their context is canceled.  If conflict resolution
+	// runs during the transaction, it flushes the changes made so
+	// far to the local journal, and those can no longer be aborted.
+	// A transaction left open for more than ten minutes is aborted
+	// automatically, so that a client that goes away can't hold back
+	// syncs forever; its commit then fails with NoTransactionError.
+	BeginTransaction(ctx context.Context, folderBranch FolderBranch) error
+	// CommitTransaction ends the transaction on the given folder
+	// branch by syncing all of its changes as a single revision.
+	// If the sync fails, the transaction stays open.  This is a
+	// remote-sync operation.
+	CommitTransaction(ctx context.Context, folderBranch FolderBranch) error
+	// AbortTransaction ends the transaction on the given folder
+	// branch by discarding all of its changes.  Nodes created or
+	// renamed during the transaction become unlinked.
+	AbortTransaction(ctx context.Context, folderBranch FolderBranch) error
 	// FolderStatus returns the status of a particular folder/branch, along
 	// with a channel that will be closed when the status has been
 	// updated (to eliminate the need for polling this method).
@@ -328,6 +479,17 @@ type KBFSOps interface {
 	// outstanding writes from the local device.
 	GetUpdateHistory(ctx context.Context, folderBranch FolderBranch) (
 		history TLFUpdateHistory, err error)
+	// GetUpdateHistoryPage returns one page of the merged update
+	// history of the given folder, newest update first, keeping only
+	// the updates and ops selected by the filter.  The page starts
+	// at the revision given by cursor, or at the latest revision if
+	// cursor is kbfsmd.RevisionUninitialized; the returned page's
+	// NextCursor continues from where it left off.  A page may have
+	// fewer than limit updates even when there are more to come, if
+	// the filter is selective.
+	GetUpdateHistoryPage(ctx context.Context, folderBranch FolderBranch,
+		cursor kbfsmd.Revision, limit int, filter UpdateHistoryFilter) (
+		page UpdateHistoryPage, err error)
 	// GetEditHistory returns a clustered list of the most recent file
 	// edits by each of the valid writers of the given folder.  users
 	// looking to get updates to this list can register as an observer
@@ -337,6 +499,42 @@ type KBFSOps interface {
 
 	// GetNodeMetadata gets metadata associated with a Node.
 	GetNodeMetadata(ctx context.Context, node Node) (NodeMetadata, error)
+	// GetDirUsage returns the disk usage of the given directory and
+	// everything under it.  Usage is cached per directory, so
+	// repeated calls are cheap as long as the directory doesn't
+	// change.
+	GetDirUsage(ctx context.Context, dir Node) (DirUsage, error)
+	// FindEntries returns the entries of the given folder that
+	// match the given query, using a local, encrypted index of the
+	// folder.  The index is built in the background the first time
+	// this is called for a folder, and this call blocks until it's
+	// complete.
+	FindEntries(ctx context.Context, folderBranch FolderBranch,
+		query SearchQuery) ([]SearchResult, error)
+	// SetBackgroundReencryption enables or disables a background
+	// task that re-encrypts any blocks of the given folder that use
+	// an older key generation, every time the folder gets a new
+	// one.  The setting is stored in a new merged MD revision, so it
+	// survives restarts and applies on every writer's devices.  The
+	// re-encrypted blocks are written as a normal revision, and the
+	// old ones are eventually reclaimed by quota reclamation.
+	// Progress is shown in the folder's status.
+	SetBackgroundReencryption(ctx context.Context,
+		folderBranch FolderBranch, enabled bool) error
+	// MakeImmutable turns the given folder into a write-once,
+	// read-many folder, by recording it in a new merged MD
+	// revision.  From then on, every client refuses to remove,
+	// rename or overwrite its existing data, and quota reclamation
+	// skips it.  This can't be undone.  It fails with
+	// OpsVersionTooLowError unless OpsVersion is at least
+	// ImmutableOpsVer.
+	MakeImmutable(ctx context.Context, folderBranch FolderBranch) error
+	// SetRetentionPolicy stores the given retention policy in a new
+	// merged MD revision of the given folder, so that quota
+	// reclamation follows it on every device, in place of any local
+	// retention policies.  A nil policy clears the stored one.
+	SetRetentionPolicy(ctx context.Context, folderBranch FolderBranch,
+		policy *RetentionPolicy) error
 
 	// Shutdown is called to clean up any resources associated with
 	// this KBFSOps instance.
@@ -913,6 +1111,40 @@ type DiskBlockCache interface {
 	Shutdown(ctx context.Context)
 }
 
+// DiskMDCache caches the latest verified merged MD heads, and the
+// TLF crypt keys needed to read them, to the disk, so that TLFs can
+// still be read after a restart without a connection to the MD
+// server.
+type DiskMDCache interface {
+	// GetHead gets the cached head for the given TLF, along with the
+	// verifying key of its last writer.  It returns an empty
+	// ImmutableBareRootMetadata if there is no cached head.
+	GetHead(ctx context.Context, tlfID tlf.ID) (
+		ImmutableBareRootMetadata, kbfscrypto.VerifyingKey, error)
+	// GetTlfID gets the ID of the TLF with the given handle, if the
+	// cache has a head for it.
+	GetTlfID(ctx context.Context, handle *TlfHandle) (
+		tlfID tlf.ID, ok bool, err error)
+	// PutHead caches the given merged head, if it's newer than the
+	// cached head for its TLF.
+	PutHead(ctx context.Context, irmd ImmutableRootMetadata) error
+	// GetTLFCryptKey gets the given TLF crypt key from the cache.  It
+	// returns a KeyCacheMissError if the key isn't cached.
+	GetTLFCryptKey(ctx context.Context, tlfID tlf.ID, keyGen KeyGen) (
+		kbfscrypto.TLFCryptKey, error)
+	// PutTLFCryptKey caches the given TLF crypt key.
+	PutTLFCryptKey(ctx context.Context, tlfID tlf.ID, keyGen KeyGen,
+		key kbfscrypto.TLFCryptKey) error
+	// DeleteTLFCryptKeys deletes all the cached TLF crypt keys of the
+	// given TLF.
+	DeleteTLFCryptKeys(ctx context.Context, tlfID tlf.ID) error
+	// DeleteAllTLFCryptKeys deletes the cached TLF crypt keys of
+	// every TLF.
+	DeleteAllTLFCryptKeys(ctx context.Context) error
+	// Shutdown cleanly shuts down the disk MD cache.
+	Shutdown(ctx context.Context)
+}
+
 // cryptoPure contains all methods of Crypto that don't depend on
 // implicit state, i.e. they're pure functions of the input.
 type cryptoPure interface {
@@ -981,10 +1213,18 @@ type cryptoPure interface {
 	EncryptBlock(block Block, key kbfscrypto.BlockCryptKey) (
 		plainSize int, encryptedBlock EncryptedBlock, err error)
 
-	// DecryptBlock decrypts a block. Similar to EncryptBlock(),
+	// EncryptBlockAEAD is like EncryptBlock, but it encrypts the
+	// block with EncryptionAESGCM, binding the given TLF ID to it,
+	// and pads it using the given scheme.
+	EncryptBlockAEAD(block Block, tlfID tlf.ID,
+		key kbfscrypto.BlockCryptKey, padding BlockPadding) (
+		plainSize int, encryptedBlock EncryptedBlock, err error)
+
+	// DecryptBlock decrypts a block encrypted with any supported
+	// version, from the given TLF. Similar to EncryptBlock(),
 	// DecryptBlock() must guarantee that (size of the decrypted
 	// block) <= len(encryptedBlock).
-	DecryptBlock(encryptedBlock EncryptedBlock,
+	DecryptBlock(encryptedBlock EncryptedBlock, tlfID tlf.ID,
 		key kbfscrypto.BlockCryptKey, block Block) error
 
 	// GetTLFCryptKeyServerHalfID creates a unique ID for this particular
@@ -1348,6 +1588,16 @@ type MDServer interface {
 		wkbID TLFWriterKeyBundleID, rkbID TLFReaderKeyBundleID) (
 		*TLFWriterKeyBundleV3, *TLFReaderKeyBundleV3, error)
 
+	// GetMerkleProof returns the current root of the server's Merkle
+	// tree of merged TLF heads that would contain the given TLF,
+	// along with a proof of the TLF's leaf in that tree (or of its
+	// absence).  A server that doesn't support Merkle proofs returns
+	// MerkleProofsUnsupportedError, in which case MD heads from it
+	// aren't checked against any Merkle tree; so far, only the
+	// local MD servers support them.
+	GetMerkleProof(ctx context.Context, id tlf.ID) (
+		*MerkleRoot, MerkleInclusionProof, error)
+
 	// CheckReachability is called when the Keybase service sends a notification
 	// that network connectivity has changed.
 	CheckReachability(ctx context.Context)
@@ -1470,6 +1720,10 @@ type blockServerLocal interface {
 	// for the given TLF, and should only be used during testing.
 	getAllRefsForTest(ctx context.Context, tlfID tlf.ID) (
 		map[kbfsblock.ID]blockRefMap, error)
+	// getRefs returns the known references to the given block in
+	// the given TLF, which is empty if there are none.
+	getRefs(ctx context.Context, tlfID tlf.ID, id kbfsblock.ID) (
+		blockRefMap, error)
 }
 
 // BlockSplitter decides when a file or directory block needs to be split
@@ -1584,11 +1838,15 @@ type Tracer interface {
 	// MaybeStartTrace, if tracing is on, returns a new context
 	// based on the given one with an attached trace made with the
 	// given family and title. Otherwise, it returns the given
-	// context unchanged.
+	// context unchanged.  Independently, if there is a span
+	// exporter, or the given context is already part of a span
+	// trace, the returned context also gets a new span named by
+	// the family.
 	MaybeStartTrace(ctx context.Context, family, title string) context.Context
-	// MaybeFinishTrace, finishes the trace attached to the given
-	// context, if any.
+	// MaybeFinishTrace, finishes the trace and span attached to
+	// the given context, if any.
 	MaybeFinishTrace(ctx context.Context, err error)
+	spanExporterGetter
 }
 
 // Config collects all the singleton instance instantiations needed to
@@ -1596,6 +1854,7 @@ type Tracer interface {
 // do not require comments.
 type Config interface {
 	dataVersioner
+	blockCryptVersioner
 	logMaker
 	blockCacher
 	blockServerGetter
@@ -1607,8 +1866,11 @@ type Config interface {
 	currentSessionGetterGetter
 	diskBlockCacheGetter
 	diskBlockCacheSetter
+	diskMDCacheGetter
+	diskMDCacheSetter
 	clockGetter
 	diskLimiterGetter
+	blockTransferControllersGetter
 	Tracer
 	KBFSOps() KBFSOps
 	SetKBFSOps(KBFSOps)
@@ -1651,6 +1913,12 @@ type Config interface {
 	SetConflictRenamer(ConflictRenamer)
 	MetadataVersion() MetadataVer
 	SetMetadataVersion(MetadataVer)
+	// OpsVersion returns the newest version of ops that may be
+	// written into new MD revisions.
+	OpsVersion() OpsVer
+	SetOpsVersion(OpsVer)
+	SetBlockCryptVersion(EncryptionVer)
+	SetBlockPadding(BlockPadding)
 	RekeyQueue() RekeyQueue
 	SetRekeyQueue(RekeyQueue)
 	// ReqsBufSize indicates the number of read or write operations
@@ -1702,6 +1970,15 @@ type Config interface {
 	// most recently merged MD update before we can run reclamation,
 	// to avoid conflicting with a currently active writer.
 	QuotaReclamationMinHeadAge() time.Duration
+	// RetentionPolicies returns the per-TLF retention policies that
+	// quota reclamation follows, on top of the settings above.  It
+	// may be nil.
+	RetentionPolicies() *RetentionPolicies
+	// SetRetentionPolicies sets the per-TLF retention policies.
+	SetRetentionPolicies(*RetentionPolicies)
+	// SetBlockTransferControllers sets the controllers that limit
+	// concurrent block transfers.
+	SetBlockTransferControllers(*BlockTransferControllers)
 
 	// ResetCaches clears and re-initializes all data and key caches.
 	ResetCaches()
@@ -1718,6 +1995,10 @@ type Config interface {
 
 	// SetTraceOptions set the options for tracing (via x/net/trace).
 	SetTraceOptions(enabled bool)
+	// SetSpanExporter sets the exporter for the spans started by
+	// MaybeStartTrace, and by everything called with the resulting
+	// context.  A nil exporter turns span collection off.
+	SetSpanExporter(SpanExporter)
 
 	// TLFValidDuration is the time TLFs are valid before identification needs to be redone.
 	TLFValidDuration() time.Duration
@@ -1972,6 +2253,9 @@ type BareRootMetadata interface {
 	GetPrevRoot() kbfsmd.ID
 	// IsUnmergedSet returns true if the unmerged bit is set.
 	IsUnmergedSet() bool
+	// IsImmutableSet returns true if the write-once, read-many bit
+	// is set.
+	IsImmutableSet() bool
 	// GetSerializedPrivateMetadata returns the serialized private metadata as a byte slice.
 	GetSerializedPrivateMetadata() []byte
 	// GetSerializedWriterMetadata serializes the underlying writer metadata and returns the result.
@@ -2033,6 +2317,8 @@ type MutableBareRootMetadata interface {
 	ClearFinalBit()
 	// SetUnmerged sets the unmerged bit.
 	SetUnmerged()
+	// SetImmutable sets the write-once, read-many bit.
+	SetImmutable()
 	// SetBranchID sets the branch ID for this metadata revision.
 	SetBranchID(bid BranchID)
 	// SetPrevRoot sets the hash of the previous metadata revision.
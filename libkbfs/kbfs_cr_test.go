@@ -14,6 +14,7 @@ import (
 	"github.com/keybase/kbfs/ioutil"
 	"github.com/keybase/kbfs/kbfsmd"
 	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/net/context"
@@ -139,7 +140,8 @@ func testMultipleMDUpdates(t *testing.T, unembedChanges bool) {
 	rootNode2 := GetRootNodeOrBust(ctx, t, config2, name, tlf.Private)
 
 	// now user 1 renames the old file, and creates a new one
-	err = kbfsOps1.Rename(ctx, rootNode1, "a", rootNode1, "b")
+	err = kbfsOps1.Rename(ctx, rootNode1, "a", rootNode1, "b",
+		RenameFlagsNone)
 	require.NoError(t, err)
 	_, _, err = kbfsOps1.CreateFile(ctx, rootNode1, "c", false, NoExcl)
 	require.NoError(t, err)
@@ -845,6 +847,223 @@ func TestBasicCRFileCreateUnmergedWriteConflict(t *testing.T) {
 	require.Equal(t, children1, children2)
 }
 
+// Tests that concurrent mode changes to the same entries are merged
+// without conflict copies: only the permissions that both sides grant
+// survive, and a read-only flag set on either side sticks.
+func TestCRConcurrentModeChanges(t *testing.T) {
+	// simulate two users
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx, cancel := kbfsOpsConcurInit(t, userName1, userName2)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+	config1.SetOpsVersion(ModeAttrOpsVer)
+
+	config2 := ConfigAsUser(config1, userName2)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+
+	name := userName1.String() + "," + userName2.String()
+
+	// user1 creates a file and a dir in a shared dir
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, name, tlf.Private)
+
+	kbfsOps1 := config1.KBFSOps()
+	dirA1, _, err := kbfsOps1.CreateDir(ctx, rootNode1, "a")
+	require.NoError(t, err)
+	fileB1, _, err := kbfsOps1.CreateFile(ctx, dirA1, "b", false, NoExcl)
+	require.NoError(t, err)
+	dirC1, _, err := kbfsOps1.CreateDir(ctx, dirA1, "c")
+	require.NoError(t, err)
+	err = kbfsOps1.SyncAll(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+
+	// look them up on user2
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, name, tlf.Private)
+
+	kbfsOps2 := config2.KBFSOps()
+	dirA2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	fileB2, _, err := kbfsOps2.Lookup(ctx, dirA2, "b")
+	require.NoError(t, err)
+	dirC2, _, err := kbfsOps2.Lookup(ctx, dirA2, "c")
+	require.NoError(t, err)
+
+	// disable updates on user 2
+	c, err := DisableUpdatesForTesting(config2, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = DisableCRForTesting(config2, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+
+	// User 1 opens up the permissions
+	err = kbfsOps1.SetPerm(ctx, fileB1, 0750)
+	require.NoError(t, err)
+	err = kbfsOps1.SetPerm(ctx, dirC1, 0755)
+	require.NoError(t, err)
+	err = kbfsOps1.SyncAll(ctx, fileB1.GetFolderBranch())
+	require.NoError(t, err)
+
+	// User 2 sets different permissions, and makes both read-only
+	err = kbfsOps2.SetPerm(ctx, fileB2, 0710)
+	require.NoError(t, err)
+	err = kbfsOps2.SetReadOnly(ctx, fileB2, true)
+	require.NoError(t, err)
+	err = kbfsOps2.SetPerm(ctx, dirC2, 0700)
+	require.NoError(t, err)
+	err = kbfsOps2.SetReadOnly(ctx, dirC2, true)
+	require.NoError(t, err)
+	err = kbfsOps2.SyncAll(ctx, fileB2.GetFolderBranch())
+	require.NoError(t, err)
+
+	// re-enable updates, and wait for CR to complete
+	c <- struct{}{}
+	err = RestartCRForTesting(
+		BackgroundContextWithCancellationDelayer(), config2,
+		rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+	err = kbfsOps2.SyncFromServerForTesting(ctx, rootNode2.GetFolderBranch())
+	require.NoError(t, err)
+
+	err = kbfsOps1.SyncFromServerForTesting(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+
+	// Make sure they both see the merged modes, with no conflict
+	// copies.
+	children1, err := kbfsOps1.GetDirChildren(ctx, dirA1)
+	require.NoError(t, err)
+	require.Len(t, children1, 2)
+	b := children1["b"]
+	require.Equal(t, Exec, b.Type)
+	require.Equal(t, os.FileMode(0710), b.Mode.Perm(b.Type))
+	require.True(t, b.Mode.IsReadOnly())
+	cEntry := children1["c"]
+	require.Equal(t, Dir, cEntry.Type)
+	require.Equal(t, os.FileMode(0700), cEntry.Mode.Perm(cEntry.Type))
+	require.True(t, cEntry.Mode.IsReadOnly())
+
+	children2, err := kbfsOps2.GetDirChildren(ctx, dirA2)
+	require.NoError(t, err)
+	require.Equal(t, children1, children2)
+
+	// The merged flag is enforced on the merged branch.
+	err = kbfsOps1.Write(ctx, fileB1, []byte{1}, 0)
+	require.IsType(t, ReadOnlyEntryError{}, errors.Cause(err))
+}
+
+// Tests that when the merged branch makes the folder immutable, CR
+// doesn't let leftover unmerged removals, renames or overwrites lose
+// any of the merged entries.
+func TestCRUnmergedChangesInImmutableFolder(t *testing.T) {
+	// simulate two users
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx, cancel := kbfsOpsConcurInit(t, userName1, userName2)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+
+	config2 := ConfigAsUser(config1, userName2)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+
+	clock, now := newTestClockAndTimeNow()
+	config2.SetClock(clock)
+
+	name := userName1.String() + "," + userName2.String()
+
+	// user1 creates some files and a dir
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, name, tlf.Private)
+	fb := rootNode1.GetFolderBranch()
+
+	kbfsOps1 := config1.KBFSOps()
+	data := []byte{1, 2, 3}
+	for _, fileName := range []string{"a", "b", "c"} {
+		n, _, err := kbfsOps1.CreateFile(
+			ctx, rootNode1, fileName, false, NoExcl)
+		require.NoError(t, err)
+		err = kbfsOps1.Write(ctx, n, data, 0)
+		require.NoError(t, err)
+	}
+	_, _, err := kbfsOps1.CreateDir(ctx, rootNode1, "d")
+	require.NoError(t, err)
+	err = kbfsOps1.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	// look them up on user2
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, name, tlf.Private)
+
+	kbfsOps2 := config2.KBFSOps()
+	fileC2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "c")
+	require.NoError(t, err)
+
+	// disable updates on user 2
+	c, err := DisableUpdatesForTesting(config2, fb)
+	require.NoError(t, err)
+	err = DisableCRForTesting(config2, fb)
+	require.NoError(t, err)
+
+	// User 1 makes the folder immutable
+	config1.SetOpsVersion(ImmutableOpsVer)
+	err = kbfsOps1.MakeImmutable(ctx, fb)
+	require.NoError(t, err)
+
+	// User 2 removes, renames and overwrites entries
+	err = kbfsOps2.RemoveEntry(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	err = kbfsOps2.Rename(ctx, rootNode2, "b", rootNode2, "b2",
+		RenameFlagsNone)
+	require.NoError(t, err)
+	unmergedData := []byte{4, 5, 6}
+	err = kbfsOps2.Write(ctx, fileC2, unmergedData, 0)
+	require.NoError(t, err)
+	err = kbfsOps2.Rename(ctx, rootNode2, "d", rootNode2, "d2",
+		RenameFlagsNone)
+	require.NoError(t, err)
+	err = kbfsOps2.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	// re-enable updates, and wait for CR to complete
+	c <- struct{}{}
+	err = RestartCRForTesting(
+		BackgroundContextWithCancellationDelayer(), config2, fb)
+	require.NoError(t, err)
+	err = kbfsOps2.SyncFromServerForTesting(ctx, fb)
+	require.NoError(t, err)
+
+	err = kbfsOps1.SyncFromServerForTesting(ctx, fb)
+	require.NoError(t, err)
+
+	// The removal is dropped, the renamed file is forked, the
+	// overwritten file gets a conflict copy, and only the renamed
+	// directory keeps its new name.
+	cre := WriterDeviceDateConflictRenamer{}
+	cConflict := cre.ConflictRenameHelper(now, "u2", "dev1", "c")
+	expectedChildren := []string{"a", "b", "b2", "c", cConflict, "d2"}
+	children1, err := kbfsOps1.GetDirChildren(ctx, rootNode1)
+	require.NoError(t, err)
+	require.Len(t, children1, len(expectedChildren))
+	for _, child := range expectedChildren {
+		_, ok := children1[child]
+		require.True(t, ok, "Missing child %s", child)
+	}
+
+	children2, err := kbfsOps2.GetDirChildren(ctx, rootNode2)
+	require.NoError(t, err)
+	require.Equal(t, children1, children2)
+
+	checkData := func(fileName string, expected []byte) {
+		n, _, err := kbfsOps1.Lookup(ctx, rootNode1, fileName)
+		require.NoError(t, err)
+		gotData := make([]byte, len(expected))
+		_, err = kbfsOps1.Read(ctx, n, gotData, 0)
+		require.NoError(t, err)
+		require.Equal(t, expected, gotData)
+	}
+	checkData("b", data)
+	checkData("b2", data)
+	checkData("c", data)
+	checkData(cConflict, unmergedData)
+
+	// The folder is still immutable on both sides.
+	err = kbfsOps1.RemoveEntry(ctx, rootNode1, "a")
+	require.IsType(t, ImmutableFolderError{}, errors.Cause(err))
+	err = kbfsOps2.RemoveEntry(ctx, rootNode2, "b2")
+	require.IsType(t, ImmutableFolderError{}, errors.Cause(err))
+}
+
 // Test that two conflict resolutions work correctly.
 func TestCRDouble(t *testing.T) {
 	// simulate two users
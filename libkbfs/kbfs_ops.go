@@ -7,6 +7,7 @@ package libkbfs
 import (
 	"errors"
 	"fmt"
+	"os"
 	"sync"
 	"time"
 
@@ -38,6 +39,8 @@ type KBFSOpsStandard struct {
 
 	currentStatus kbfsCurrentStatus
 	quotaUsage    *EventuallyConsistentQuotaUsage
+
+	transfers *crossFolderTransfers
 }
 
 var _ KBFSOps = (*KBFSOpsStandard)(nil)
@@ -54,6 +57,7 @@ func NewKBFSOpsStandard(config Config) *KBFSOpsStandard {
 		reIdentifyControlChan: make(chan chan<- struct{}),
 		favs:       NewFavorites(config),
 		quotaUsage: NewEventuallyConsistentQuotaUsage(config, "KBFSOps"),
+		transfers:  newCrossFolderTransfers(config, log),
 	}
 	kops.currentStatus.Init()
 	go kops.markForReIdentifyIfNeededLoop()
@@ -513,6 +517,15 @@ func (fs *KBFSOpsStandard) getMaybeCreateRootNode(
 	return node, ei, nil
 }
 
+// startOpSpan starts a span for the KBFSOps method with the given
+// name, which is the root of a new trace unless the caller is
+// already being traced.
+func (fs *KBFSOpsStandard) startOpSpan(
+	ctx context.Context, name string, tlfID tlf.ID) context.Context {
+	return startRootSpan(ctx, fs.config.SpanExporter(), "KBFSOps."+name,
+		spanAttrTLF(tlfID))
+}
+
 // GetOrCreateRootNode implements the KBFSOps interface for
 // KBFSOpsStandard
 func (fs *KBFSOpsStandard) GetOrCreateRootNode(
@@ -532,28 +545,41 @@ func (fs *KBFSOpsStandard) GetRootNode(
 
 // GetDirChildren implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) GetDirChildren(ctx context.Context, dir Node) (
-	map[string]EntryInfo, error) {
+	children map[string]EntryInfo, err error) {
+	ctx = fs.startOpSpan(ctx, "GetDirChildren", dir.GetFolderBranch().Tlf)
+	defer func() { finishSpan(ctx, err) }()
+
 	ops := fs.getOpsByNode(ctx, dir)
 	return ops.GetDirChildren(ctx, dir)
 }
 
 // Lookup implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) Lookup(ctx context.Context, dir Node, name string) (
-	Node, EntryInfo, error) {
+	node Node, ei EntryInfo, err error) {
+	ctx = fs.startOpSpan(ctx, "Lookup", dir.GetFolderBranch().Tlf)
+	defer func() { finishSpan(ctx, err) }()
+
 	ops := fs.getOpsByNode(ctx, dir)
 	return ops.Lookup(ctx, dir, name)
 }
 
 // Stat implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) Stat(ctx context.Context, node Node) (
-	EntryInfo, error) {
+	ei EntryInfo, err error) {
+	ctx = fs.startOpSpan(ctx, "Stat", node.GetFolderBranch().Tlf)
+	defer func() { finishSpan(ctx, err) }()
+
 	ops := fs.getOpsByNode(ctx, node)
 	return ops.Stat(ctx, node)
 }
 
 // CreateDir implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) CreateDir(
-	ctx context.Context, dir Node, name string) (Node, EntryInfo, error) {
+	ctx context.Context, dir Node, name string) (
+	node Node, ei EntryInfo, err error) {
+	ctx = fs.startOpSpan(ctx, "CreateDir", dir.GetFolderBranch().Tlf)
+	defer func() { finishSpan(ctx, err) }()
+
 	ops := fs.getOpsByNode(ctx, dir)
 	return ops.CreateDir(ctx, dir, name)
 }
@@ -561,7 +587,10 @@ func (fs *KBFSOpsStandard) CreateDir(
 // CreateFile implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) CreateFile(
 	ctx context.Context, dir Node, name string, isExec bool, excl Excl) (
-	Node, EntryInfo, error) {
+	node Node, ei EntryInfo, err error) {
+	ctx = fs.startOpSpan(ctx, "CreateFile", dir.GetFolderBranch().Tlf)
+	defer func() { finishSpan(ctx, err) }()
+
 	ops := fs.getOpsByNode(ctx, dir)
 	return ops.CreateFile(ctx, dir, name, isExec, excl)
 }
@@ -569,21 +598,73 @@ func (fs *KBFSOpsStandard) CreateFile(
 // CreateLink implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) CreateLink(
 	ctx context.Context, dir Node, fromName string, toPath string) (
-	EntryInfo, error) {
+	ei EntryInfo, err error) {
+	ctx = fs.startOpSpan(ctx, "CreateLink", dir.GetFolderBranch().Tlf)
+	defer func() { finishSpan(ctx, err) }()
+
 	ops := fs.getOpsByNode(ctx, dir)
 	return ops.CreateLink(ctx, dir, fromName, toPath)
 }
 
+// CreateBulkFile implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) CreateBulkFile(
+	ctx context.Context, dir Node, name string, isExec bool) (
+	w BulkFileWriter, err error) {
+	ctx = fs.startOpSpan(ctx, "CreateBulkFile", dir.GetFolderBranch().Tlf)
+	defer func() { finishSpan(ctx, err) }()
+
+	ops := fs.getOpsByNode(ctx, dir)
+	return ops.CreateBulkFile(ctx, dir, name, isExec)
+}
+
+// CopyFile implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) CopyFile(
+	ctx context.Context, src Node, destDir Node, destName string) (
+	ei EntryInfo, err error) {
+	ctx = fs.startOpSpan(ctx, "CopyFile", src.GetFolderBranch().Tlf)
+	defer func() { finishSpan(ctx, err) }()
+
+	// only works for nodes within the same topdir
+	if src.GetFolderBranch() != destDir.GetFolderBranch() {
+		return EntryInfo{}, CopyAcrossDirsError{}
+	}
+
+	ops := fs.getOpsByNode(ctx, src)
+	return ops.CopyFile(ctx, src, destDir, destName)
+}
+
+// CopyFileContents implements the KBFSOps interface for
+// KBFSOpsStandard
+func (fs *KBFSOpsStandard) CopyFileContents(
+	ctx context.Context, src Node, dest Node) (ei EntryInfo, err error) {
+	ctx = fs.startOpSpan(ctx, "CopyFileContents", src.GetFolderBranch().Tlf)
+	defer func() { finishSpan(ctx, err) }()
+
+	// only works for nodes within the same topdir
+	if src.GetFolderBranch() != dest.GetFolderBranch() {
+		return EntryInfo{}, CopyAcrossDirsError{}
+	}
+
+	ops := fs.getOpsByNode(ctx, src)
+	return ops.CopyFileContents(ctx, src, dest)
+}
+
 // RemoveDir implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) RemoveDir(
-	ctx context.Context, dir Node, name string) error {
+	ctx context.Context, dir Node, name string) (err error) {
+	ctx = fs.startOpSpan(ctx, "RemoveDir", dir.GetFolderBranch().Tlf)
+	defer func() { finishSpan(ctx, err) }()
+
 	ops := fs.getOpsByNode(ctx, dir)
 	return ops.RemoveDir(ctx, dir, name)
 }
 
 // RemoveEntry implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) RemoveEntry(
-	ctx context.Context, dir Node, name string) error {
+	ctx context.Context, dir Node, name string) (err error) {
+	ctx = fs.startOpSpan(ctx, "RemoveEntry", dir.GetFolderBranch().Tlf)
+	defer func() { finishSpan(ctx, err) }()
+
 	ops := fs.getOpsByNode(ctx, dir)
 	return ops.RemoveEntry(ctx, dir, name)
 }
@@ -591,7 +672,10 @@ func (fs *KBFSOpsStandard) RemoveEntry(
 // Rename implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) Rename(
 	ctx context.Context, oldParent Node, oldName string, newParent Node,
-	newName string) error {
+	newName string, flags RenameFlags) (err error) {
+	ctx = fs.startOpSpan(ctx, "Rename", oldParent.GetFolderBranch().Tlf)
+	defer func() { finishSpan(ctx, err) }()
+
 	oldFB := oldParent.GetFolderBranch()
 	newFB := newParent.GetFolderBranch()
 
@@ -601,52 +685,145 @@ func (fs *KBFSOpsStandard) Rename(
 	}
 
 	ops := fs.getOpsByNode(ctx, oldParent)
-	return ops.Rename(ctx, oldParent, oldName, newParent, newName)
+	return ops.Rename(ctx, oldParent, oldName, newParent, newName, flags)
+}
+
+// TransferAcrossFolders implements the KBFSOps interface for
+// KBFSOpsStandard
+func (fs *KBFSOpsStandard) TransferAcrossFolders(ctx context.Context,
+	id string, src, dest FolderPath, move bool) error {
+	return fs.transfers.transfer(ctx, id, src, dest, move)
+}
+
+// CrossFolderTransferStatus implements the KBFSOps interface for
+// KBFSOpsStandard
+func (fs *KBFSOpsStandard) CrossFolderTransferStatus(id string) (
+	CrossFolderTransferState, bool, error) {
+	err := checkCrossFolderTransferID(id)
+	if err != nil {
+		return CrossFolderTransferState{}, false, err
+	}
+	return fs.transfers.getState(id)
+}
+
+// RollBackCrossFolderTransfer implements the KBFSOps interface for
+// KBFSOpsStandard
+func (fs *KBFSOpsStandard) RollBackCrossFolderTransfer(
+	ctx context.Context, id string) error {
+	return fs.transfers.rollBack(ctx, id)
 }
 
 // Read implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) Read(
 	ctx context.Context, file Node, dest []byte, off int64) (
 	numRead int64, err error) {
+	ctx = fs.startOpSpan(ctx, "Read", file.GetFolderBranch().Tlf)
+	defer func() { finishSpan(ctx, err) }()
+
 	ops := fs.getOpsByNode(ctx, file)
 	return ops.Read(ctx, file, dest, off)
 }
 
 // Write implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) Write(
-	ctx context.Context, file Node, data []byte, off int64) error {
+	ctx context.Context, file Node, data []byte, off int64) (err error) {
+	ctx = fs.startOpSpan(ctx, "Write", file.GetFolderBranch().Tlf)
+	defer func() { finishSpan(ctx, err) }()
+
 	ops := fs.getOpsByNode(ctx, file)
 	return ops.Write(ctx, file, data, off)
 }
 
 // Truncate implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) Truncate(
-	ctx context.Context, file Node, size uint64) error {
+	ctx context.Context, file Node, size uint64) (err error) {
+	ctx = fs.startOpSpan(ctx, "Truncate", file.GetFolderBranch().Tlf)
+	defer func() { finishSpan(ctx, err) }()
+
 	ops := fs.getOpsByNode(ctx, file)
 	return ops.Truncate(ctx, file, size)
 }
 
 // SetEx implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) SetEx(
-	ctx context.Context, file Node, ex bool) error {
+	ctx context.Context, file Node, ex bool) (err error) {
+	ctx = fs.startOpSpan(ctx, "SetEx", file.GetFolderBranch().Tlf)
+	defer func() { finishSpan(ctx, err) }()
+
 	ops := fs.getOpsByNode(ctx, file)
 	return ops.SetEx(ctx, file, ex)
 }
 
 // SetMtime implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) SetMtime(
-	ctx context.Context, file Node, mtime *time.Time) error {
+	ctx context.Context, file Node, mtime *time.Time) (err error) {
+	ctx = fs.startOpSpan(ctx, "SetMtime", file.GetFolderBranch().Tlf)
+	defer func() { finishSpan(ctx, err) }()
+
 	ops := fs.getOpsByNode(ctx, file)
 	return ops.SetMtime(ctx, file, mtime)
 }
 
+// SetPerm implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) SetPerm(
+	ctx context.Context, node Node, perm os.FileMode) (err error) {
+	ctx = fs.startOpSpan(ctx, "SetPerm", node.GetFolderBranch().Tlf)
+	defer func() { finishSpan(ctx, err) }()
+
+	ops := fs.getOpsByNode(ctx, node)
+	return ops.SetPerm(ctx, node, perm)
+}
+
+// SetReadOnly implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) SetReadOnly(
+	ctx context.Context, node Node, readOnly bool) (err error) {
+	ctx = fs.startOpSpan(ctx, "SetReadOnly", node.GetFolderBranch().Tlf)
+	defer func() { finishSpan(ctx, err) }()
+
+	ops := fs.getOpsByNode(ctx, node)
+	return ops.SetReadOnly(ctx, node, readOnly)
+}
+
 // SyncAll implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) SyncAll(
-	ctx context.Context, folderBranch FolderBranch) error {
+	ctx context.Context, folderBranch FolderBranch) (err error) {
+	ctx = fs.startOpSpan(ctx, "SyncAll", folderBranch.Tlf)
+	defer func() { finishSpan(ctx, err) }()
+
 	ops := fs.getOps(ctx, folderBranch, FavoritesOpAdd)
 	return ops.SyncAll(ctx, folderBranch)
 }
 
+// BeginTransaction implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) BeginTransaction(
+	ctx context.Context, folderBranch FolderBranch) (err error) {
+	ctx = fs.startOpSpan(ctx, "BeginTransaction", folderBranch.Tlf)
+	defer func() { finishSpan(ctx, err) }()
+
+	ops := fs.getOps(ctx, folderBranch, FavoritesOpNoChange)
+	return ops.BeginTransaction(ctx, folderBranch)
+}
+
+// CommitTransaction implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) CommitTransaction(
+	ctx context.Context, folderBranch FolderBranch) (err error) {
+	ctx = fs.startOpSpan(ctx, "CommitTransaction", folderBranch.Tlf)
+	defer func() { finishSpan(ctx, err) }()
+
+	ops := fs.getOps(ctx, folderBranch, FavoritesOpNoChange)
+	return ops.CommitTransaction(ctx, folderBranch)
+}
+
+// AbortTransaction implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) AbortTransaction(
+	ctx context.Context, folderBranch FolderBranch) (err error) {
+	ctx = fs.startOpSpan(ctx, "AbortTransaction", folderBranch.Tlf)
+	defer func() { finishSpan(ctx, err) }()
+
+	ops := fs.getOps(ctx, folderBranch, FavoritesOpNoChange)
+	return ops.AbortTransaction(ctx, folderBranch)
+}
+
 // FolderStatus implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) FolderStatus(
 	ctx context.Context, folderBranch FolderBranch) (
@@ -707,6 +884,7 @@ func (fs *KBFSOpsStandard) Status(ctx context.Context) (
 		FailingServices: failures,
 		JournalServer:   jServerStatus,
 		DiskCacheStatus: dbcStatus,
+		BlockTransfers:  fs.config.BlockTransferControllers().Status(),
 	}, ch, err
 }
 
@@ -740,6 +918,15 @@ func (fs *KBFSOpsStandard) GetUpdateHistory(ctx context.Context,
 	return ops.GetUpdateHistory(ctx, folderBranch)
 }
 
+// GetUpdateHistoryPage implements the KBFSOps interface for
+// KBFSOpsStandard
+func (fs *KBFSOpsStandard) GetUpdateHistoryPage(ctx context.Context,
+	folderBranch FolderBranch, cursor kbfsmd.Revision, limit int,
+	filter UpdateHistoryFilter) (page UpdateHistoryPage, err error) {
+	ops := fs.getOps(ctx, folderBranch, FavoritesOpAdd)
+	return ops.GetUpdateHistoryPage(ctx, folderBranch, cursor, limit, filter)
+}
+
 // GetEditHistory implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) GetEditHistory(ctx context.Context,
 	folderBranch FolderBranch) (edits TlfWriterEdits, err error) {
@@ -747,6 +934,43 @@ func (fs *KBFSOpsStandard) GetEditHistory(ctx context.Context,
 	return ops.GetEditHistory(ctx, folderBranch)
 }
 
+// GetDirUsage implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) GetDirUsage(ctx context.Context, dir Node) (
+	DirUsage, error) {
+	ops := fs.getOpsByNode(ctx, dir)
+	return ops.GetDirUsage(ctx, dir)
+}
+
+// FindEntries implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) FindEntries(ctx context.Context,
+	folderBranch FolderBranch, query SearchQuery) ([]SearchResult, error) {
+	ops := fs.getOps(ctx, folderBranch, FavoritesOpNoChange)
+	return ops.FindEntries(ctx, folderBranch, query)
+}
+
+// SetBackgroundReencryption implements the KBFSOps interface for
+// KBFSOpsStandard
+func (fs *KBFSOpsStandard) SetBackgroundReencryption(ctx context.Context,
+	folderBranch FolderBranch, enabled bool) error {
+	ops := fs.getOps(ctx, folderBranch, FavoritesOpNoChange)
+	return ops.SetBackgroundReencryption(ctx, folderBranch, enabled)
+}
+
+// MakeImmutable implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) MakeImmutable(ctx context.Context,
+	folderBranch FolderBranch) error {
+	ops := fs.getOps(ctx, folderBranch, FavoritesOpNoChange)
+	return ops.MakeImmutable(ctx, folderBranch)
+}
+
+// SetRetentionPolicy implements the KBFSOps interface for
+// KBFSOpsStandard
+func (fs *KBFSOpsStandard) SetRetentionPolicy(ctx context.Context,
+	folderBranch FolderBranch, policy *RetentionPolicy) error {
+	ops := fs.getOps(ctx, folderBranch, FavoritesOpNoChange)
+	return ops.SetRetentionPolicy(ctx, folderBranch, policy)
+}
+
 // GetNodeMetadata implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) GetNodeMetadata(ctx context.Context, node Node) (
 	NodeMetadata, error) {
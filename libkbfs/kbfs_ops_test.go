@@ -8,6 +8,7 @@ import (
 	"bytes"
 	"fmt"
 	"math/rand"
+	"os"
 	"testing"
 	"time"
 
@@ -1523,7 +1524,8 @@ func TestRenameFailAcrossTopLevelFolders(t *testing.T) {
 
 	expectedErr := RenameAcrossDirsError{}
 
-	if err := config.KBFSOps().Rename(ctx, n1, "b", n2, "c"); err == nil {
+	if err := config.KBFSOps().Rename(ctx, n1, "b", n2, "c",
+		RenameFlagsNone); err == nil {
 		t.Errorf("Got no expected error on rename")
 	} else if err.Error() != expectedErr.Error() {
 		t.Errorf("Got unexpected error on rename: %+v", err)
@@ -1553,7 +1555,8 @@ func TestRenameFailAcrossBranches(t *testing.T) {
 	n2 := nodeFromPath(t, ops2, p2)
 
 	expectedErr := RenameAcrossDirsError{}
-	if err := config.KBFSOps().Rename(ctx, n1, "b", n2, "c"); err == nil {
+	if err := config.KBFSOps().Rename(ctx, n1, "b", n2, "c",
+		RenameFlagsNone); err == nil {
 		t.Errorf("Got no expected error on rename")
 	} else if err.Error() != expectedErr.Error() {
 		t.Errorf("Got unexpected error on rename: %+v", err)
@@ -3007,7 +3010,7 @@ func TestKBFSOpsWriteRenameStat(t *testing.T) {
 	}
 
 	// Rename it.
-	err = kbfsOps.Rename(ctx, rootNode, "a", rootNode, "b")
+	err = kbfsOps.Rename(ctx, rootNode, "a", rootNode, "b", RenameFlagsNone)
 	if err != nil {
 		t.Fatalf("Couldn't rename; %+v", err)
 	}
@@ -3055,7 +3058,7 @@ func TestKBFSOpsWriteRenameGetDirChildren(t *testing.T) {
 	}
 
 	// Rename it.
-	err = kbfsOps.Rename(ctx, rootNode, "a", rootNode, "b")
+	err = kbfsOps.Rename(ctx, rootNode, "a", rootNode, "b", RenameFlagsNone)
 	if err != nil {
 		t.Fatalf("Couldn't rename; %+v", err)
 	}
@@ -3215,6 +3218,56 @@ func TestKBFSOpsFailToReadUnverifiableBlock(t *testing.T) {
 	}
 }
 
+func TestKBFSOpsAEADBlockEncryption(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	config.SetBlockCryptVersion(EncryptionAESGCM)
+
+	// create a file.
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(
+		ctx, rootNode, "a", false, NoExcl)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %+v", err)
+	}
+	data := []byte("hello world")
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	if err != nil {
+		t.Fatalf("Couldn't write to file: %+v", err)
+	}
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync file: %+v", err)
+	}
+
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	p := ops.nodeCache.PathFromNode(fileNode)
+	if dataVer := p.tailPointer().DataVer; dataVer != AEADEncryptionDataVer {
+		t.Errorf("Unexpected data version for file: %d", dataVer)
+	}
+
+	// Read using a different "device".
+	config2 := ConfigAsUser(config, "test_user")
+	defer CheckConfigAndShutdown(ctx, t, config2)
+
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, "test_user", tlf.Private)
+	kbfsOps2 := config2.KBFSOps()
+	fileNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	if err != nil {
+		t.Fatalf("Couldn't lookup file: %+v", err)
+	}
+	buf := make([]byte, len(data))
+	n, err := kbfsOps2.Read(ctx, fileNode2, buf, 0)
+	if err != nil {
+		t.Fatalf("Couldn't read file: %+v", err)
+	}
+	if !bytes.Equal(data, buf[:n]) {
+		t.Errorf("Read %v, expected %v", buf[:n], data)
+	}
+}
+
 // Test that the size of a single empty block doesn't change.  If this
 // test ever fails, consult max or strib before merging.
 func TestKBFSOpsEmptyTlfSize(t *testing.T) {
@@ -3517,3 +3570,579 @@ func TestKBFSOpsBasicTeamTLF(t *testing.T) {
 	_, _, err = kbfsOps3.CreateFile(ctx, rootNode3, "c", false, NoExcl)
 	require.IsType(t, WriteAccessError{}, errors.Cause(err))
 }
+
+func TestKBFSOpsImmutableFolder(t *testing.T) {
+	var u1, u2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx, cancel := kbfsOpsConcurInit(t, u1, u2)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+
+	config2 := ConfigAsUser(config1, u2)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+
+	name := u1.String() + "," + u2.String()
+
+	t.Log("Write a file and a directory, then make the folder immutable.")
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, name, tlf.Private)
+	kbfsOps1 := config1.KBFSOps()
+	fb := rootNode1.GetFolderBranch()
+	nodeA1, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps1.Write(ctx, nodeA1, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+	_, _, err = kbfsOps1.CreateDir(ctx, rootNode1, "d")
+	require.NoError(t, err)
+	err = kbfsOps1.MakeImmutable(ctx, fb)
+	require.IsType(t, OpsVersionTooLowError{}, errors.Cause(err))
+	config1.SetOpsVersion(ImmutableOpsVer)
+	err = kbfsOps1.MakeImmutable(ctx, fb)
+	require.NoError(t, err)
+
+	t.Log("Existing data can't be overwritten, removed or renamed.")
+	err = kbfsOps1.Write(ctx, nodeA1, []byte{4}, 2)
+	require.IsType(t, ImmutableFolderError{}, errors.Cause(err))
+	err = kbfsOps1.Truncate(ctx, nodeA1, 1)
+	require.IsType(t, ImmutableFolderError{}, errors.Cause(err))
+	err = kbfsOps1.RemoveEntry(ctx, rootNode1, "a")
+	require.IsType(t, ImmutableFolderError{}, errors.Cause(err))
+	err = kbfsOps1.RemoveDir(ctx, rootNode1, "d")
+	require.IsType(t, ImmutableFolderError{}, errors.Cause(err))
+	err = kbfsOps1.Rename(ctx, rootNode1, "a", rootNode1, "b",
+		RenameFlagsNone)
+	require.IsType(t, ImmutableFolderError{}, errors.Cause(err))
+
+	t.Log("Appends and new files are still allowed.")
+	err = kbfsOps1.Write(ctx, nodeA1, []byte{4}, 3)
+	require.NoError(t, err)
+	nodeB1, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "b", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps1.Write(ctx, nodeB1, []byte{1, 2}, 0)
+	require.NoError(t, err)
+	// Unsynced data can still be rewritten.
+	err = kbfsOps1.Write(ctx, nodeB1, []byte{3}, 0)
+	require.NoError(t, err)
+	err = kbfsOps1.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	err = kbfsOps1.Write(ctx, nodeB1, []byte{4}, 0)
+	require.IsType(t, ImmutableFolderError{}, errors.Cause(err))
+
+	t.Log("The other writer enforces it too.")
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, name, tlf.Private)
+	kbfsOps2 := config2.KBFSOps()
+	err = kbfsOps2.RemoveEntry(ctx, rootNode2, "b")
+	require.IsType(t, ImmutableFolderError{}, errors.Cause(err))
+	nodeA2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	gotData := make([]byte, 4)
+	_, err = kbfsOps2.Read(ctx, nodeA2, gotData, 0)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1, 2, 3, 4}, gotData)
+}
+
+func TestKBFSOpsCopyFile(t *testing.T) {
+	var u1 libkb.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, u1)
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	clock, now := newTestClockAndTimeNow()
+	config.SetClock(clock)
+
+	// Use small blocks, so the file has many leaf blocks.
+	bsplit, err := NewBlockSplitterSimple(20, 8*1024, config.Codec())
+	require.NoError(t, err)
+	config.SetBlockSplitter(bsplit)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, u1.String(), tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fb := rootNode.GetFolderBranch()
+	nodeA, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	data := make([]byte, 200)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	err = kbfsOps.Write(ctx, nodeA, data, 0)
+	require.NoError(t, err)
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "d")
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	bserverLocal, ok := config.BlockServer().(blockServerLocal)
+	require.True(t, ok)
+	preCopyBlocks, err := bserverLocal.getAllRefsForTest(ctx, fb.Tlf)
+	require.NoError(t, err)
+
+	t.Log("Copy the file into a subdirectory, without any data copies.")
+	ei, err := kbfsOps.CopyFile(ctx, nodeA, dirNode, "b")
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(data)), ei.Size)
+	require.Equal(t, File, ei.Type)
+
+	postCopyBlocks, err := bserverLocal.getAllRefsForTest(ctx, fb.Tlf)
+	require.NoError(t, err)
+	newBlocks := len(postCopyBlocks) - len(preCopyBlocks)
+	newRefs := totalBlockRefs(postCopyBlocks) - totalBlockRefs(preCopyBlocks)
+	require.True(t, newRefs > newBlocks,
+		"%d new refs, %d new blocks", newRefs, newBlocks)
+
+	nodeB, _, err := kbfsOps.Lookup(ctx, dirNode, "b")
+	require.NoError(t, err)
+	gotData := make([]byte, len(data))
+	_, err = kbfsOps.Read(ctx, nodeB, gotData, 0)
+	require.NoError(t, err)
+	require.Equal(t, data, gotData)
+
+	t.Log("Writes to the copy don't affect the original.")
+	err = kbfsOps.Write(ctx, nodeB, []byte{0xff}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	_, err = kbfsOps.Read(ctx, nodeA, gotData, 0)
+	require.NoError(t, err)
+	require.Equal(t, data, gotData)
+
+	t.Log("Removing and reclaiming the original keeps the copy intact.")
+	err = kbfsOps.RemoveEntry(ctx, rootNode, "a")
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	clock.Set(now.Add(2 * config.QuotaReclamationMinUnrefAge()))
+	_, _, err = kbfsOps.CreateDir(ctx, rootNode, "e")
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	ops := kbfsOps.(*KBFSOpsStandard).getOpsByNode(ctx, rootNode)
+	ops.fbm.forceQuotaReclamation()
+	err = ops.fbm.waitForQuotaReclamations(ctx)
+	require.NoError(t, err)
+
+	config2 := ConfigAsUser(config, u1)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, u1.String(), tlf.Private)
+	kbfsOps2 := config2.KBFSOps()
+	dirNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "d")
+	require.NoError(t, err)
+	nodeB2, _, err := kbfsOps2.Lookup(ctx, dirNode2, "b")
+	require.NoError(t, err)
+	_, err = kbfsOps2.Read(ctx, nodeB2, gotData, 0)
+	require.NoError(t, err)
+	expectedData := append([]byte{0xff}, data[1:]...)
+	require.Equal(t, expectedData, gotData)
+
+	t.Log("Existing names, directories and other folders are rejected.")
+	_, err = kbfsOps.CopyFile(ctx, nodeB, rootNode, "e")
+	require.IsType(t, NameExistsError{}, errors.Cause(err))
+	_, err = kbfsOps.CopyFile(ctx, dirNode, rootNode, "f")
+	require.IsType(t, NotFileError{}, errors.Cause(err))
+	publicRootNode := GetRootNodeOrBust(
+		ctx, t, config, u1.String(), tlf.Public)
+	_, err = kbfsOps.CopyFile(ctx, nodeB, publicRootNode, "b")
+	require.IsType(t, CopyAcrossDirsError{}, errors.Cause(err))
+}
+
+func TestKBFSOpsCopyFileContents(t *testing.T) {
+	var u1 libkb.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, u1)
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	// Use small blocks, so the file has many leaf blocks.
+	bsplit, err := NewBlockSplitterSimple(20, 8*1024, config.Codec())
+	require.NoError(t, err)
+	config.SetBlockSplitter(bsplit)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, u1.String(), tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fb := rootNode.GetFolderBranch()
+	nodeA, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	data := make([]byte, 200)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	err = kbfsOps.Write(ctx, nodeA, data, 0)
+	require.NoError(t, err)
+	nodeB, _, err := kbfsOps.CreateFile(ctx, rootNode, "b", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	bserverLocal, ok := config.BlockServer().(blockServerLocal)
+	require.True(t, ok)
+	preCopyBlocks, err := bserverLocal.getAllRefsForTest(ctx, fb.Tlf)
+	require.NoError(t, err)
+
+	t.Log("Copy the file into an empty one, without any data copies.")
+	ei, err := kbfsOps.CopyFileContents(ctx, nodeA, nodeB)
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(data)), ei.Size)
+
+	postCopyBlocks, err := bserverLocal.getAllRefsForTest(ctx, fb.Tlf)
+	require.NoError(t, err)
+	newBlocks := len(postCopyBlocks) - len(preCopyBlocks)
+	newRefs := totalBlockRefs(postCopyBlocks) - totalBlockRefs(preCopyBlocks)
+	require.True(t, newRefs > newBlocks,
+		"%d new refs, %d new blocks", newRefs, newBlocks)
+
+	gotData := make([]byte, len(data))
+	_, err = kbfsOps.Read(ctx, nodeB, gotData, 0)
+	require.NoError(t, err)
+	require.Equal(t, data, gotData)
+
+	t.Log("Writes to the copy don't affect the original.")
+	err = kbfsOps.Write(ctx, nodeB, []byte{0xff}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	_, err = kbfsOps.Read(ctx, nodeA, gotData, 0)
+	require.NoError(t, err)
+	require.Equal(t, data, gotData)
+
+	config2 := ConfigAsUser(config, u1)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, u1.String(), tlf.Private)
+	nodeB2, _, err := config2.KBFSOps().Lookup(ctx, rootNode2, "b")
+	require.NoError(t, err)
+	_, err = config2.KBFSOps().Read(ctx, nodeB2, gotData, 0)
+	require.NoError(t, err)
+	expectedData := append([]byte{0xff}, data[1:]...)
+	require.Equal(t, expectedData, gotData)
+
+	t.Log("Non-empty destinations and directories are rejected.")
+	_, err = kbfsOps.CopyFileContents(ctx, nodeA, nodeB)
+	require.IsType(t, FileNotEmptyError{}, errors.Cause(err))
+	_, err = kbfsOps.CopyFileContents(ctx, rootNode, nodeB)
+	require.IsType(t, NotFileError{}, errors.Cause(err))
+}
+
+func TestKBFSOpsTransaction(t *testing.T) {
+	var u1 libkb.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, u1)
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, u1.String(), tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fb := rootNode.GetFolderBranch()
+	getRevision := func() kbfsmd.Revision {
+		md, err := config.MDOps().GetForTLF(ctx, fb.Tlf)
+		require.NoError(t, err)
+		return md.Revision()
+	}
+
+	err := kbfsOps.CommitTransaction(ctx, fb)
+	require.IsType(t, NoTransactionError{}, errors.Cause(err))
+
+	t.Log("Changes made during a transaction land as one revision.")
+	startRev := getRevision()
+	err = kbfsOps.BeginTransaction(ctx, fb)
+	require.NoError(t, err)
+	err = kbfsOps.BeginTransaction(ctx, fb)
+	require.IsType(t, TransactionInProgressError{}, errors.Cause(err))
+	nodeA, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, nodeA, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateFile(ctx, rootNode, "b", false, NoExcl)
+	require.NoError(t, err)
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "d")
+	require.NoError(t, err)
+	err = kbfsOps.Rename(ctx, rootNode, "b", dirNode, "b", RenameFlagsNone)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.IsType(t, TransactionInProgressError{}, errors.Cause(err))
+	require.Equal(t, startRev, getRevision())
+	_, _, err = kbfsOps.CreateFile(ctx, rootNode, "x", false, WithExcl)
+	require.IsType(t, TransactionInProgressError{}, errors.Cause(err))
+	_, _, err = kbfsOps.Lookup(ctx, rootNode, "x")
+	require.IsType(t, NoSuchNameError{}, errors.Cause(err))
+	_, err = kbfsOps.CopyFile(ctx, nodeA, rootNode, "x")
+	require.IsType(t, TransactionInProgressError{}, errors.Cause(err))
+	config.SetOpsVersion(ImmutableOpsVer)
+	err = kbfsOps.MakeImmutable(ctx, fb)
+	require.IsType(t, TransactionInProgressError{}, errors.Cause(err))
+
+	err = kbfsOps.CommitTransaction(ctx, fb)
+	require.NoError(t, err)
+	require.Equal(t, startRev+1, getRevision())
+
+	config2 := ConfigAsUser(config, u1)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, u1.String(), tlf.Private)
+	kbfsOps2 := config2.KBFSOps()
+	nodeA2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	data := make([]byte, 3)
+	_, err = kbfsOps2.Read(ctx, nodeA2, data, 0)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1, 2, 3}, data)
+	dirNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "d")
+	require.NoError(t, err)
+	_, _, err = kbfsOps2.Lookup(ctx, dirNode2, "b")
+	require.NoError(t, err)
+
+	t.Log("Aborting a transaction discards its changes.")
+	err = kbfsOps.BeginTransaction(ctx, fb)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, nodeA, []byte{4, 5, 6, 7}, 0)
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateFile(ctx, rootNode, "e", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.RemoveEntry(ctx, dirNode, "b")
+	require.NoError(t, err)
+	err = kbfsOps.AbortTransaction(ctx, fb)
+	require.NoError(t, err)
+	err = kbfsOps.AbortTransaction(ctx, fb)
+	require.IsType(t, NoTransactionError{}, errors.Cause(err))
+
+	data = make([]byte, 4)
+	n, err := kbfsOps.Read(ctx, nodeA, data, 0)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1, 2, 3}, data[:n])
+	_, _, err = kbfsOps.Lookup(ctx, rootNode, "e")
+	require.IsType(t, NoSuchNameError{}, errors.Cause(err))
+	_, _, err = kbfsOps.Lookup(ctx, dirNode, "b")
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	require.Equal(t, startRev+1, getRevision())
+
+	t.Log("Internal syncs, like conflict resolution's, still flush.")
+	err = kbfsOps.BeginTransaction(ctx, fb)
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateFile(ctx, rootNode, "f", false, NoExcl)
+	require.NoError(t, err)
+	ops := getOps(config, fb.Tlf)
+	err = ops.syncAllUnlocked(ctx, makeFBOLockState())
+	require.NoError(t, err)
+	require.Equal(t, startRev+2, getRevision())
+	err = kbfsOps.CommitTransaction(ctx, fb)
+	require.NoError(t, err)
+	require.Equal(t, startRev+2, getRevision())
+
+	t.Log("A transaction left open too long is aborted.")
+	ops.txnTimeout = 10 * time.Millisecond
+	err = kbfsOps.BeginTransaction(ctx, fb)
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateFile(ctx, rootNode, "g", false, NoExcl)
+	require.NoError(t, err)
+	for ops.isInTransaction(makeFBOLockState()) {
+		time.Sleep(time.Millisecond)
+	}
+	err = kbfsOps.CommitTransaction(ctx, fb)
+	require.IsType(t, TransactionExpiredError{}, errors.Cause(err))
+	err = kbfsOps.CommitTransaction(ctx, fb)
+	require.IsType(t, NoTransactionError{}, errors.Cause(err))
+	_, _, err = kbfsOps.Lookup(ctx, rootNode, "g")
+	require.IsType(t, NoSuchNameError{}, errors.Cause(err))
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	require.Equal(t, startRev+2, getRevision())
+}
+
+func TestKBFSOpsTransactionTooLarge(t *testing.T) {
+	var u1 libkb.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, u1)
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	// Use a tiny dirty block cache, so that one write fills it.
+	err := config.DirtyBlockCache().Shutdown()
+	require.NoError(t, err)
+	config.SetDirtyBlockCache(NewDirtyBlockCacheStandard(wallClock{},
+		config.MakeLogger(""), 1<<10, 1<<10, 1<<10))
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, u1.String(), tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fb := rootNode.GetFolderBranch()
+	nodeA, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	t.Log("A write that would need a sync fails during a transaction.")
+	err = kbfsOps.BeginTransaction(ctx, fb)
+	require.NoError(t, err)
+	data := make([]byte, 2<<10)
+	err = kbfsOps.Write(ctx, nodeA, data, 0)
+	require.NoError(t, err)
+	require.True(t, config.DirtyBlockCache().ShouldForceSync(fb.Tlf))
+	err = kbfsOps.Write(ctx, nodeA, data, int64(len(data)))
+	require.IsType(t, TransactionTooLargeError{}, errors.Cause(err))
+	err = kbfsOps.Truncate(ctx, nodeA, 0)
+	require.IsType(t, TransactionTooLargeError{}, errors.Cause(err))
+
+	t.Log("The transaction stays open, so it can still be committed.")
+	err = kbfsOps.CommitTransaction(ctx, fb)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, nodeA, data, int64(len(data)))
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	ei, err := kbfsOps.Stat(ctx, nodeA)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2*len(data)), ei.Size)
+}
+
+func TestKBFSOpsRenameFlags(t *testing.T) {
+	var u1 libkb.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, u1)
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, u1.String(), tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fb := rootNode.GetFolderBranch()
+	nodeA, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, nodeA, []byte{1}, 0)
+	require.NoError(t, err)
+	nodeB, _, err := kbfsOps.CreateFile(ctx, rootNode, "b", false, NoExcl)
+	require.NoError(t, err)
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "d")
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateFile(ctx, dirNode, "c", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	t.Log("A no-replace rename fails if the new name exists.")
+	err = kbfsOps.Rename(ctx, rootNode, "a", rootNode, "b", RenameNoReplace)
+	require.IsType(t, NameExistsError{}, errors.Cause(err))
+	err = kbfsOps.Rename(ctx, rootNode, "a", rootNode, "e", RenameNoReplace)
+	require.NoError(t, err)
+
+	t.Log("Exchanges need a new enough ops version.")
+	err = kbfsOps.Rename(ctx, rootNode, "e", rootNode, "b", RenameExchange)
+	require.IsType(t, OpsVersionTooLowError{}, errors.Cause(err))
+	config.SetOpsVersion(RenameExchangeOpsVer)
+
+	t.Log("An exchange requires both names to exist.")
+	err = kbfsOps.Rename(ctx, rootNode, "e", rootNode, "f", RenameExchange)
+	require.IsType(t, NoSuchNameError{}, errors.Cause(err))
+	err = kbfsOps.Rename(ctx, rootNode, "e", rootNode, "b", RenameExchange)
+	require.NoError(t, err)
+	err = kbfsOps.Rename(
+		ctx, rootNode, "e", rootNode, "b", RenameNoReplace|RenameExchange)
+	require.IsType(t, InvalidRenameFlagsError{}, errors.Cause(err))
+
+	t.Log("A file and a directory can be exchanged across directories.")
+	err = kbfsOps.Rename(ctx, dirNode, "c", rootNode, "b", RenameExchange)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	checkExchanged := func(kbfsOps KBFSOps, rootNode Node) {
+		children, err := kbfsOps.GetDirChildren(ctx, rootNode)
+		require.NoError(t, err)
+		require.Len(t, children, 3)
+		require.Equal(t, File, children["b"].Type)
+		require.Equal(t, uint64(0), children["b"].Size)
+		require.Equal(t, File, children["e"].Type)
+		require.Equal(t, uint64(0), children["e"].Size)
+		require.Equal(t, Dir, children["d"].Type)
+		dirNode, _, err := kbfsOps.Lookup(ctx, rootNode, "d")
+		require.NoError(t, err)
+		children, err = kbfsOps.GetDirChildren(ctx, dirNode)
+		require.NoError(t, err)
+		require.Len(t, children, 1)
+		require.Equal(t, File, children["c"].Type)
+		require.Equal(t, uint64(1), children["c"].Size)
+	}
+	checkExchanged(kbfsOps, rootNode)
+	require.Equal(t, "c", nodeA.GetBasename())
+	require.Equal(t, "e", nodeB.GetBasename())
+
+	config2 := ConfigAsUser(config, u1)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, u1.String(), tlf.Private)
+	checkExchanged(config2.KBFSOps(), rootNode2)
+}
+
+func TestKBFSOpsSetPermAndReadOnly(t *testing.T) {
+	var u1 libkb.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, u1)
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, u1.String(), tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fb := rootNode.GetFolderBranch()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "d")
+	require.NoError(t, err)
+
+	t.Log("Older ops versions only keep the exec bit.")
+	err = kbfsOps.SetReadOnly(ctx, fileNode, true)
+	require.IsType(t, OpsVersionTooLowError{}, errors.Cause(err))
+	err = kbfsOps.SetPerm(ctx, fileNode, 0700)
+	require.NoError(t, err)
+	err = kbfsOps.SetPerm(ctx, dirNode, 0700)
+	require.NoError(t, err)
+	err = kbfsOps.SetPerm(ctx, rootNode, 0700)
+	require.NoError(t, err)
+	ei, err := kbfsOps.Stat(ctx, fileNode)
+	require.NoError(t, err)
+	require.Equal(t, Exec, ei.Type)
+	require.False(t, ei.Mode.IsPermSet())
+	err = kbfsOps.SetEx(ctx, fileNode, false)
+	require.NoError(t, err)
+	config.SetOpsVersion(ModeAttrOpsVer)
+
+	t.Log("Entries start out with the default permissions.")
+	ei, err = kbfsOps.Stat(ctx, fileNode)
+	require.NoError(t, err)
+	require.False(t, ei.Mode.IsPermSet())
+	require.Equal(t, os.FileMode(0600), ei.Mode.Perm(ei.Type))
+
+	t.Log("Setting the user-exec bit changes the type.")
+	err = kbfsOps.SetPerm(ctx, fileNode, 0750)
+	require.NoError(t, err)
+	ei, err = kbfsOps.Stat(ctx, fileNode)
+	require.NoError(t, err)
+	require.Equal(t, Exec, ei.Type)
+	require.Equal(t, os.FileMode(0750), ei.Mode.Perm(ei.Type))
+	err = kbfsOps.SetPerm(ctx, fileNode, 0600)
+	require.NoError(t, err)
+	err = kbfsOps.SetPerm(ctx, dirNode, 0711)
+	require.NoError(t, err)
+
+	t.Log("Setting the mode of the root directory is ignored.")
+	err = kbfsOps.SetPerm(ctx, rootNode, 0700)
+	require.NoError(t, err)
+
+	t.Log("Read-only entries can't be changed.")
+	err = kbfsOps.SetReadOnly(ctx, fileNode, true)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte{1}, 0)
+	require.IsType(t, ReadOnlyEntryError{}, errors.Cause(err))
+	err = kbfsOps.SetPerm(ctx, fileNode, 0644)
+	require.IsType(t, ReadOnlyEntryError{}, errors.Cause(err))
+	err = kbfsOps.Rename(ctx, rootNode, "a", rootNode, "b", RenameFlagsNone)
+	require.IsType(t, ReadOnlyEntryError{}, errors.Cause(err))
+	err = kbfsOps.RemoveEntry(ctx, rootNode, "a")
+	require.IsType(t, ReadOnlyEntryError{}, errors.Cause(err))
+	err = kbfsOps.SetReadOnly(ctx, dirNode, true)
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateFile(ctx, dirNode, "b", false, NoExcl)
+	require.IsType(t, ReadOnlyEntryError{}, errors.Cause(err))
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	t.Log("The mode is visible to other devices.")
+	config2 := ConfigAsUser(config, u1)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+	kbfsOps2 := config2.KBFSOps()
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, u1.String(), tlf.Private)
+	children, err := kbfsOps2.GetDirChildren(ctx, rootNode2)
+	require.NoError(t, err)
+	require.Equal(t, File, children["a"].Type)
+	require.True(t, children["a"].Mode.IsReadOnly())
+	require.Equal(t, os.FileMode(0600), children["a"].Mode.Perm(File))
+	require.True(t, children["d"].Mode.IsReadOnly())
+	require.Equal(t, os.FileMode(0711), children["d"].Mode.Perm(Dir))
+
+	t.Log("Clearing the flag makes the entry writable again.")
+	err = kbfsOps.SetReadOnly(ctx, fileNode, false)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte{1}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+}
@@ -119,6 +119,29 @@ func (km *KeyManagerStandard) getTLFCryptKey(ctx context.Context,
 		return kbfscrypto.TLFCryptKey{}, err
 	}
 
+	// Then on disk, but only if we're offline.  Otherwise the key
+	// bundles and the service decide, so that a revoked device or a
+	// removed member can't keep using keys cached before the change.
+	if dmc := km.config.DiskMDCache(); dmc != nil &&
+		!km.config.MDServer().IsConnected() {
+		tlfCryptKey, err := dmc.GetTLFCryptKey(ctx, tlfID, keyGen)
+		switch err := err.(type) {
+		case nil:
+			if flags&getTLFCryptKeyDoCache != 0 {
+				if err = kcache.PutTLFCryptKey(
+					tlfID, keyGen, tlfCryptKey); err != nil {
+					return kbfscrypto.TLFCryptKey{}, err
+				}
+			}
+			return tlfCryptKey, nil
+		case KeyCacheMissError:
+			break
+		default:
+			km.log.CDebugf(ctx, "Couldn't get key %d for %s from the "+
+				"disk MD cache: %+v", keyGen, tlfID, err)
+		}
+	}
+
 	// Team TLF keys come from the service.
 	if tlfID.Type() == tlf.SingleTeam {
 		tid, err := kmd.GetTlfHandle().FirstResolvedWriter().AsTeam()
@@ -139,6 +162,8 @@ func (km *KeyManagerStandard) getTLFCryptKey(ctx context.Context,
 				tlfID, keyGen, tlfCryptKey); err != nil {
 				return kbfscrypto.TLFCryptKey{}, err
 			}
+			putTLFCryptKeyInDiskMDCache(
+				ctx, km.config, km.log, tlfID, keyGen, tlfCryptKey)
 		}
 
 		return tlfCryptKey, nil
@@ -188,6 +213,7 @@ func (km *KeyManagerStandard) getTLFCryptKey(ctx context.Context,
 			return kbfscrypto.TLFCryptKey{}, err
 		}
 	} else if err != nil {
+		km.maybeDeleteDiskKeys(ctx, tlfID, err)
 		return kbfscrypto.TLFCryptKey{}, err
 	} else {
 		// unmask it
@@ -201,11 +227,25 @@ func (km *KeyManagerStandard) getTLFCryptKey(ctx context.Context,
 		if err = kcache.PutTLFCryptKey(tlfID, keyGen, tlfCryptKey); err != nil {
 			return kbfscrypto.TLFCryptKey{}, err
 		}
+		putTLFCryptKeyInDiskMDCache(
+			ctx, km.config, km.log, tlfID, keyGen, tlfCryptKey)
 	}
 
 	return tlfCryptKey, nil
 }
 
+// maybeDeleteDiskKeys purges the given TLF's keys from the disk MD
+// cache if err shows that this device can't read the TLF anymore.
+func (km *KeyManagerStandard) maybeDeleteDiskKeys(
+	ctx context.Context, tlfID tlf.ID, err error) {
+	switch errors.Cause(err).(type) {
+	case ReadAccessError, NeedSelfRekeyError, NeedOtherRekeyError:
+		km.log.CDebugf(ctx, "Deleting the disk-cached keys for %s: %+v",
+			tlfID, err)
+		deleteTLFCryptKeysFromDiskMDCache(ctx, km.config, km.log, tlfID)
+	}
+}
+
 func (km *KeyManagerStandard) getTLFCryptKeyParams(
 	ctx context.Context, kmd KeyMetadata,
 	keyGen KeyGen, uid keybase1.UID, username libkb.NormalizedUsername,
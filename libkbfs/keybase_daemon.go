@@ -28,21 +28,94 @@ func (k keybaseDaemon) NewKeybaseService(config Config, params InitParams, ctx C
 		return NewKeybaseDaemonRPC(config, ctx, log, params.Debug, params.CreateSimpleFSInstance), nil
 	}
 
-	users := []libkb.NormalizedUsername{
-		"strib", "max", "chris", "akalin", "jzila", "alness",
-		"jinyang", "songgao", "taru", "zanderz",
+	var localUsers []LocalUser
+	var teams []TeamInfo
+	if params.LocalIdentityFile != "" {
+		identities, err := LoadLocalIdentities(params.LocalIdentityFile)
+		if err != nil {
+			return nil, err
+		}
+		localUsers, teams = identities.Users, identities.Teams
+	} else {
+		localUsers, teams = makeDefaultLocalIdentities()
 	}
-	userIndex := -1
-	for i := range users {
-		if localUser == users[i] {
-			userIndex = i
+
+	var localUID keybase1.UID
+	for _, u := range localUsers {
+		if u.Name == localUser {
+			localUID = u.UID
 			break
 		}
 	}
-	if userIndex < 0 {
-		return nil, fmt.Errorf("user %s not in list %v", localUser, users)
+	if localUID == keybase1.UID("") {
+		names := make([]libkb.NormalizedUsername, 0, len(localUsers))
+		for _, u := range localUsers {
+			names = append(names, u.Name)
+		}
+		return nil, fmt.Errorf("user %s not in list %v", localUser, names)
+	}
+
+	codec := config.Codec()
+
+	var daemon *KeybaseDaemonLocal
+	if params.LocalFavoriteStorage == memoryAddr {
+		daemon = NewKeybaseDaemonMemory(localUID, localUsers, teams, codec)
+	} else if serverRootDir, ok := parseRootDir(
+		params.LocalFavoriteStorage); ok {
+		favPath := filepath.Join(serverRootDir, "kbfs_favs")
+		var err error
+		daemon, err = NewKeybaseDaemonDisk(
+			localUID, localUsers, teams, favPath, codec)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, errors.New("Can't user localuser without LocalFavoriteStorage being 'memory' or 'dir:/path/to/dir'")
+	}
+
+	if params.LocalIdentityFile != "" {
+		err := daemon.WatchIdentityFile(config, log, params.LocalIdentityFile)
+		if err != nil {
+			daemon.Shutdown()
+			return nil, err
+		}
+	}
+	return daemon, nil
+}
+
+func (k keybaseDaemon) NewCrypto(config Config, params InitParams, ctx Context, log logger.Logger) (Crypto, error) {
+	var crypto Crypto
+	localUser := libkb.NewNormalizedUsername(params.LocalUser)
+	if localUser == "" {
+		crypto = NewCryptoClientRPC(config, ctx)
+	} else if params.LocalIdentityFile != "" {
+		identities, err := LoadLocalIdentities(params.LocalIdentityFile)
+		if err != nil {
+			return nil, err
+		}
+		signingKey, cryptPrivateKey, err :=
+			identities.CurrentDeviceKeys(localUser)
+		if err != nil {
+			return nil, err
+		}
+		crypto = NewCryptoLocal(
+			config.Codec(), signingKey, cryptPrivateKey)
+	} else {
+		signingKey := MakeLocalUserSigningKeyOrBust(localUser)
+		cryptPrivateKey := MakeLocalUserCryptPrivateKeyOrBust(localUser)
+		crypto = NewCryptoLocal(
+			config.Codec(), signingKey, cryptPrivateKey)
 	}
+	return crypto, nil
+}
 
+// makeDefaultLocalIdentities returns the users and teams used in
+// -localuser mode when no local identity file is given.
+func makeDefaultLocalIdentities() ([]LocalUser, []TeamInfo) {
+	users := []libkb.NormalizedUsername{
+		"strib", "max", "chris", "akalin", "jzila", "alness",
+		"jinyang", "songgao", "taru", "zanderz",
+	}
 	localUsers := MakeLocalUsers(users)
 
 	// TODO: Auto-generate these, too?
@@ -57,9 +130,6 @@ func (k keybaseDaemon) NewKeybaseService(config Config, params InitParams, ctx C
 	// No asserts for 8.
 	localUsers[9].Asserts = []string{"github:zanderz"}
 
-	localUID := localUsers[userIndex].UID
-	codec := config.Codec()
-
 	teams := MakeLocalTeams([]libkb.NormalizedUsername{"kbfs", "core", "dokan"})
 	for i := range teams {
 		teams[i].Writers = make(map[keybase1.UID]bool)
@@ -90,29 +160,5 @@ func (k keybaseDaemon) NewKeybaseService(config Config, params InitParams, ctx C
 			teams[i].Readers[localUsers[9].UID] = true // zanderz
 		}
 	}
-
-	if params.LocalFavoriteStorage == memoryAddr {
-		return NewKeybaseDaemonMemory(localUID, localUsers, teams, codec), nil
-	}
-
-	if serverRootDir, ok := parseRootDir(params.LocalFavoriteStorage); ok {
-		favPath := filepath.Join(serverRootDir, "kbfs_favs")
-		return NewKeybaseDaemonDisk(localUID, localUsers, teams, favPath, codec)
-	}
-
-	return nil, errors.New("Can't user localuser without LocalFavoriteStorage being 'memory' or 'dir:/path/to/dir'")
-}
-
-func (k keybaseDaemon) NewCrypto(config Config, params InitParams, ctx Context, log logger.Logger) (Crypto, error) {
-	var crypto Crypto
-	localUser := libkb.NewNormalizedUsername(params.LocalUser)
-	if localUser == "" {
-		crypto = NewCryptoClientRPC(config, ctx)
-	} else {
-		signingKey := MakeLocalUserSigningKeyOrBust(localUser)
-		cryptPrivateKey := MakeLocalUserCryptPrivateKeyOrBust(localUser)
-		crypto = NewCryptoLocal(
-			config.Codec(), signingKey, cryptPrivateKey)
-	}
-	return crypto, nil
+	return localUsers, teams
 }
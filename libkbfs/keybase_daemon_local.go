@@ -7,12 +7,14 @@ package libkbfs
 import (
 	"errors"
 	"fmt"
+	"reflect"
 	"sync"
 
 	"golang.org/x/net/context"
 
 	"github.com/keybase/client/go/externals"
 	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/logger"
 	"github.com/keybase/client/go/protocol/keybase1"
 	"github.com/keybase/kbfs/kbfscodec"
 	"github.com/keybase/kbfs/kbfscrypto"
@@ -147,6 +149,11 @@ type KeybaseDaemonLocal struct {
 	asserts       map[string]keybase1.UserOrTeamID
 	favoriteStore favoriteStore
 	merkleSeqNo   MerkleSeqNo
+
+	// identityWatcher, if non-nil, reloads the users and teams from
+	// a local identity file.  It's set once before the daemon is
+	// used, so isn't protected by lock.
+	identityWatcher *localIdentityFileWatcher
 }
 
 var _ KeybaseService = &KeybaseDaemonLocal{}
@@ -629,8 +636,117 @@ func (k *KeybaseDaemonLocal) EstablishMountDir(ctx context.Context) (string, err
 	return "", nil
 }
 
+// WatchIdentityFile makes k reload its users and teams whenever the
+// local identity file at the given path changes, sending out the
+// same notifications to config as the real service would.  It must
+// be called before k is used.  The current device of the current
+// user can't be changed by a reload.
+func (k *KeybaseDaemonLocal) WatchIdentityFile(
+	config Config, log logger.Logger, path string) error {
+	if k.identityWatcher != nil {
+		return errors.New("Already watching a local identity file")
+	}
+	w, err := newLocalIdentityFileWatcher(config, log, k, path)
+	if err != nil {
+		return err
+	}
+	k.identityWatcher = w
+	go w.run()
+	return nil
+}
+
+// setIdentities replaces the users and teams of k with the given
+// ones.  It returns the UIDs of users whose keys changed (including
+// added or removed users), and whether any teams changed.
+func (k *KeybaseDaemonLocal) setIdentities(li *LocalIdentities) (
+	changedUIDs []keybase1.UID, teamsChanged bool, err error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	localUsers, asserts := makeLocalUserMapAndAsserts(li.Users)
+
+	// The crypto of a running process can't switch devices, so
+	// keep the current user on the device it started with.
+	if current, ok := k.localUsers[k.currentUID]; ok {
+		u, ok := localUsers[k.currentUID]
+		if !ok {
+			return nil, false, fmt.Errorf(
+				"Can't remove the current user %s", current.Name)
+		}
+		verifyingKey := current.GetCurrentVerifyingKey()
+		cryptPublicKey := current.GetCurrentCryptPublicKey()
+		u.CurrentVerifyingKeyIndex = -1
+		u.CurrentCryptPublicKeyIndex = -1
+		for i, key := range u.VerifyingKeys {
+			if key == verifyingKey {
+				u.CurrentVerifyingKeyIndex = i
+			}
+		}
+		for i, key := range u.CryptPublicKeys {
+			if key == cryptPublicKey {
+				u.CurrentCryptPublicKeyIndex = i
+			}
+		}
+		if u.CurrentVerifyingKeyIndex < 0 ||
+			u.CurrentCryptPublicKeyIndex < 0 {
+			return nil, false, fmt.Errorf(
+				"Can't remove or revoke the current device of %s",
+				current.Name)
+		}
+		localUsers[k.currentUID] = u
+	}
+
+	for uid, u := range localUsers {
+		if old, ok := k.localUsers[uid]; !ok ||
+			!reflect.DeepEqual(old.UserInfo, u.UserInfo) {
+			changedUIDs = append(changedUIDs, uid)
+		}
+	}
+	for uid := range k.localUsers {
+		if _, ok := localUsers[uid]; !ok {
+			changedUIDs = append(changedUIDs, uid)
+		}
+	}
+
+	localTeams := make(localTeamMap)
+	for _, t := range li.Teams {
+		localTeams[t.TID] = t
+		asserts[string(t.Name)+"@team"] = t.TID.AsUserOrTeam()
+		if old, ok := k.localTeams[t.TID]; ok && reflect.DeepEqual(old, t) {
+			continue
+		}
+		teamsChanged = true
+		f := keybase1.Folder{
+			Name:       string(t.Name),
+			FolderType: keybase1.FolderType_TEAM,
+		}
+		for u := range t.Writers {
+			k.favoriteStore.FavoriteAdd(u, f)
+		}
+		for u := range t.Readers {
+			k.favoriteStore.FavoriteAdd(u, f)
+		}
+	}
+	if len(localTeams) != len(k.localTeams) {
+		teamsChanged = true
+	}
+
+	k.localUsers = localUsers
+	k.localTeams = localTeams
+	k.asserts = asserts
+	if len(changedUIDs) > 0 || teamsChanged {
+		// The real service would have seen the merkle tree
+		// advance.
+		k.merkleSeqNo++
+	}
+	return changedUIDs, teamsChanged, nil
+}
+
 // Shutdown implements KeybaseDaemon for KeybaseDaemonLocal.
 func (k *KeybaseDaemonLocal) Shutdown() {
+	if k.identityWatcher != nil {
+		k.identityWatcher.shutdown()
+	}
 	k.favoriteStore.Shutdown()
 }
 
@@ -661,9 +777,8 @@ func NewKeybaseDaemonMemory(currentUID keybase1.UID,
 	return newKeybaseDaemonLocal(codec, currentUID, users, teams, favoriteStore)
 }
 
-func newKeybaseDaemonLocal(codec kbfscodec.Codec,
-	currentUID keybase1.UID, users []LocalUser, teams []TeamInfo,
-	favoriteStore favoriteStore) *KeybaseDaemonLocal {
+func makeLocalUserMapAndAsserts(users []LocalUser) (
+	localUserMap, map[string]keybase1.UserOrTeamID) {
 	localUserMap := make(localUserMap)
 	asserts := make(map[string]keybase1.UserOrTeamID)
 	for _, u := range users {
@@ -673,6 +788,13 @@ func newKeybaseDaemonLocal(codec kbfscodec.Codec,
 		}
 		asserts[string(u.Name)] = u.UID.AsUserOrTeam()
 	}
+	return localUserMap, asserts
+}
+
+func newKeybaseDaemonLocal(codec kbfscodec.Codec,
+	currentUID keybase1.UID, users []LocalUser, teams []TeamInfo,
+	favoriteStore favoriteStore) *KeybaseDaemonLocal {
+	localUserMap, asserts := makeLocalUserMapAndAsserts(users)
 	k := &KeybaseDaemonLocal{
 		codec:         codec,
 		localUsers:    localUserMap,
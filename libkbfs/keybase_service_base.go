@@ -272,6 +272,11 @@ func (k *KeybaseServiceBase) KeyfamilyChanged(ctx context.Context,
 	k.clearCachedUnverifiedKeys(uid)
 
 	if k.getCachedCurrentSession().UID == uid {
+		// One of our devices may have been revoked, so stop trusting
+		// the TLF crypt keys cached on disk.  The ones this device
+		// can still read are fetched and cached again when needed.
+		deleteTLFCryptKeysFromDiskMDCache(ctx, k.config, k.log, tlf.NullID)
+
 		// Ignore any errors for now, we don't want to block this
 		// notification and it's not worth spawning a goroutine for.
 		k.config.MDServer().CheckForRekeys(context.Background())
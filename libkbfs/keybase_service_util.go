@@ -8,6 +8,7 @@ import (
 	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/client/go/protocol/keybase1"
 	"github.com/keybase/kbfs/env"
+	"github.com/keybase/kbfs/tlf"
 	"golang.org/x/net/context"
 )
 
@@ -94,6 +95,8 @@ func serviceLoggedOut(ctx context.Context, config Config) {
 		jServer.shutdownExistingJournals(ctx)
 	}
 	config.ResetCaches()
+	deleteTLFCryptKeysFromDiskMDCache(
+		ctx, config, config.MakeLogger(""), tlf.NullID)
 	config.MDServer().RefreshAuthToken(ctx)
 	config.BlockServer().RefreshAuthToken(ctx)
 	config.KBFSOps().RefreshCachedFavorites(ctx)
@@ -0,0 +1,449 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// localIdentityFilePollPeriod is how often a local identity file is
+// checked for changes.
+const localIdentityFilePollPeriod = 1 * time.Second
+
+// localDeviceJSON is the on-disk format of a device in a local
+// identity file.  Keys are derived from seeds, which default to the
+// ones MakeLocalUsers and AddDeviceForLocalUserOrBust use.
+type localDeviceJSON struct {
+	Name           string `json:"name,omitempty"`
+	SigningKeySeed string `json:"signingKeySeed,omitempty"`
+	CryptKeySeed   string `json:"cryptKeySeed,omitempty"`
+	// RevokedAt, if set, is the RFC 3339 time at which the device
+	// was revoked.
+	RevokedAt string `json:"revokedAt,omitempty"`
+}
+
+// localUserJSON is the on-disk format of a user in a local identity
+// file.
+type localUserJSON struct {
+	Name    string            `json:"name"`
+	UID     string            `json:"uid,omitempty"`
+	Asserts []string          `json:"asserts,omitempty"`
+	Devices []localDeviceJSON `json:"devices,omitempty"`
+	// CurrentDevice indexes into Devices, and is the device a
+	// process logged in as this user runs as.
+	CurrentDevice int `json:"currentDevice,omitempty"`
+}
+
+// localTeamJSON is the on-disk format of a team in a local identity
+// file.
+type localTeamJSON struct {
+	Name    string   `json:"name"`
+	TID     string   `json:"tid,omitempty"`
+	KeyGens int      `json:"keyGens,omitempty"`
+	Writers []string `json:"writers,omitempty"`
+	Readers []string `json:"readers,omitempty"`
+}
+
+// localIdentitiesJSON is the on-disk format of LocalIdentities.
+type localIdentitiesJSON struct {
+	Users []localUserJSON `json:"users"`
+	Teams []localTeamJSON `json:"teams,omitempty"`
+}
+
+type localDeviceKeys struct {
+	signingKey      kbfscrypto.SigningKey
+	cryptPrivateKey kbfscrypto.CryptPrivateKey
+}
+
+// LocalIdentities is a set of users and teams for a
+// KeybaseDaemonLocal, along with the private keys of each user's
+// current device.
+type LocalIdentities struct {
+	Users []LocalUser
+	Teams []TeamInfo
+
+	currentKeys map[libkb.NormalizedUsername]localDeviceKeys
+}
+
+func (uj localUserJSON) toLocalUser(i int) (
+	LocalUser, localDeviceKeys, error) {
+	name := libkb.NewNormalizedUsername(uj.Name)
+	if name == "" {
+		return LocalUser{}, localDeviceKeys{}, errors.New("Empty user name")
+	}
+	uid := keybase1.MakeTestUID(uint32(i + 1))
+	if uj.UID != "" {
+		var err error
+		uid, err = keybase1.UIDFromString(uj.UID)
+		if err != nil {
+			return LocalUser{}, localDeviceKeys{}, errors.WithStack(err)
+		}
+	}
+
+	devices := uj.Devices
+	if len(devices) == 0 {
+		devices = []localDeviceJSON{{}}
+	}
+	if uj.CurrentDevice < 0 || uj.CurrentDevice >= len(devices) {
+		return LocalUser{}, localDeviceKeys{}, fmt.Errorf(
+			"Bad current device %d for %s", uj.CurrentDevice, name)
+	}
+
+	lu := LocalUser{
+		UserInfo: UserInfo{
+			Name:     name,
+			UID:      uid,
+			KIDNames: make(map[keybase1.KID]string),
+		},
+		Asserts: uj.Asserts,
+	}
+	var currentKeys localDeviceKeys
+	for j, dj := range devices {
+		keySalt := keySaltForUserDevice(name, j)
+		signingKey := MakeLocalUserSigningKeyOrBust(keySalt)
+		if dj.SigningKeySeed != "" {
+			signingKey = MakeLocalUserSigningKeyOrBust(
+				libkb.NormalizedUsername(dj.SigningKeySeed))
+		}
+		cryptPrivateKey := MakeLocalUserCryptPrivateKeyOrBust(keySalt)
+		if dj.CryptKeySeed != "" {
+			cryptPrivateKey = MakeLocalUserCryptPrivateKeyOrBust(
+				libkb.NormalizedUsername(dj.CryptKeySeed))
+		}
+		verifyingKey := signingKey.GetVerifyingKey()
+		cryptPublicKey := cryptPrivateKey.GetPublicKey()
+
+		deviceName := dj.Name
+		if deviceName == "" {
+			deviceName = fmt.Sprintf("dev%d", j+1)
+		}
+		lu.KIDNames[verifyingKey.KID()] = deviceName
+
+		if dj.RevokedAt != "" {
+			if j == uj.CurrentDevice {
+				return LocalUser{}, localDeviceKeys{}, fmt.Errorf(
+					"Current device %d of %s is revoked", j, name)
+			}
+			t, err := time.Parse(time.RFC3339, dj.RevokedAt)
+			if err != nil {
+				return LocalUser{}, localDeviceKeys{}, errors.Wrapf(
+					err, "Bad revocation time for device %d of %s", j, name)
+			}
+			if lu.RevokedVerifyingKeys == nil {
+				lu.RevokedVerifyingKeys =
+					make(map[kbfscrypto.VerifyingKey]keybase1.KeybaseTime)
+				lu.RevokedCryptPublicKeys =
+					make(map[kbfscrypto.CryptPublicKey]keybase1.KeybaseTime)
+			}
+			kbtime := keybase1.KeybaseTime{Unix: keybase1.ToTime(t)}
+			lu.RevokedVerifyingKeys[verifyingKey] = kbtime
+			lu.RevokedCryptPublicKeys[cryptPublicKey] = kbtime
+			continue
+		}
+
+		if j == uj.CurrentDevice {
+			lu.CurrentVerifyingKeyIndex = len(lu.VerifyingKeys)
+			lu.CurrentCryptPublicKeyIndex = len(lu.CryptPublicKeys)
+			currentKeys = localDeviceKeys{signingKey, cryptPrivateKey}
+		}
+		lu.VerifyingKeys = append(lu.VerifyingKeys, verifyingKey)
+		lu.CryptPublicKeys = append(lu.CryptPublicKeys, cryptPublicKey)
+	}
+	return lu, currentKeys, nil
+}
+
+func (tj localTeamJSON) toTeamInfo(
+	i int, uids map[libkb.NormalizedUsername]keybase1.UID) (
+	TeamInfo, error) {
+	name := libkb.NewNormalizedUsername(tj.Name)
+	if name == "" {
+		return TeamInfo{}, errors.New("Empty team name")
+	}
+	tid := keybase1.MakeTestTeamID(uint32(i + 1))
+	if tj.TID != "" {
+		var err error
+		tid, err = keybase1.TeamIDFromString(tj.TID)
+		if err != nil {
+			return TeamInfo{}, errors.WithStack(err)
+		}
+	}
+	keyGens := tj.KeyGens
+	if keyGens == 0 {
+		keyGens = 1
+	} else if keyGens < 0 {
+		return TeamInfo{}, fmt.Errorf(
+			"Negative key generation count %d for %s", keyGens, name)
+	}
+
+	ti := TeamInfo{
+		Name:      name,
+		TID:       tid,
+		CryptKeys: make(map[KeyGen]kbfscrypto.TLFCryptKey),
+		Writers:   make(map[keybase1.UID]bool),
+		Readers:   make(map[keybase1.UID]bool),
+	}
+	canonicalPath := buildCanonicalPathForTlfType(tlf.SingleTeam, string(name))
+	for k := 0; k < keyGens; k++ {
+		keyGen := FirstValidKeyGen + KeyGen(k)
+		ti.CryptKeys[keyGen] = MakeLocalTLFCryptKeyOrBust(canonicalPath, keyGen)
+		ti.LatestKeyGen = keyGen
+	}
+
+	for _, w := range tj.Writers {
+		uid, ok := uids[libkb.NewNormalizedUsername(w)]
+		if !ok {
+			return TeamInfo{}, fmt.Errorf(
+				"Unknown writer %s in team %s", w, name)
+		}
+		ti.Writers[uid] = true
+	}
+	for _, r := range tj.Readers {
+		uid, ok := uids[libkb.NewNormalizedUsername(r)]
+		if !ok {
+			return TeamInfo{}, fmt.Errorf(
+				"Unknown reader %s in team %s", r, name)
+		}
+		if ti.Writers[uid] {
+			// Being a writer already implies being a reader.
+			continue
+		}
+		ti.Readers[uid] = true
+	}
+	return ti, nil
+}
+
+// ParseLocalIdentities parses a set of local users and teams from
+// JSON of the form:
+//
+//	{
+//	  "users": [
+//	    {"name": "alice", "asserts": ["github:alice"], "devices": [
+//	      {"name": "laptop"},
+//	      {"name": "phone", "revokedAt": "2017-06-01T00:00:00Z"}
+//	    ]},
+//	    {"name": "bob", "currentDevice": 1,
+//	     "devices": [{}, {"signingKeySeed": "s", "cryptKeySeed": "c"}]}
+//	  ],
+//	  "teams": [
+//	    {"name": "acme", "keyGens": 2, "writers": ["alice"],
+//	     "readers": ["bob"]}
+//	  ]
+//	}
+//
+// Users and teams without an explicit "uid" or "tid" get test IDs
+// based on their position in the file, and a user without devices
+// gets a single one.  Device keys are derived from their seeds,
+// which default to the ones used by MakeLocalUsers and
+// AddDeviceForLocalUserOrBust for the device's position in the
+// list.
+func ParseLocalIdentities(data []byte) (*LocalIdentities, error) {
+	var lij localIdentitiesJSON
+	err := json.Unmarshal(data, &lij)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	li := &LocalIdentities{
+		Users:       make([]LocalUser, 0, len(lij.Users)),
+		Teams:       make([]TeamInfo, 0, len(lij.Teams)),
+		currentKeys: make(map[libkb.NormalizedUsername]localDeviceKeys),
+	}
+	uids := make(map[libkb.NormalizedUsername]keybase1.UID)
+	seenUIDs := make(map[keybase1.UID]bool)
+	for i, uj := range lij.Users {
+		lu, keys, err := uj.toLocalUser(i)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := uids[lu.Name]; ok {
+			return nil, fmt.Errorf("Duplicate user %s", lu.Name)
+		}
+		if seenUIDs[lu.UID] {
+			return nil, fmt.Errorf("Duplicate UID %s", lu.UID)
+		}
+		uids[lu.Name] = lu.UID
+		seenUIDs[lu.UID] = true
+		li.Users = append(li.Users, lu)
+		li.currentKeys[lu.Name] = keys
+	}
+
+	seenTeams := make(map[libkb.NormalizedUsername]bool)
+	seenTIDs := make(map[keybase1.TeamID]bool)
+	for i, tj := range lij.Teams {
+		ti, err := tj.toTeamInfo(i, uids)
+		if err != nil {
+			return nil, err
+		}
+		if seenTeams[ti.Name] {
+			return nil, fmt.Errorf("Duplicate team %s", ti.Name)
+		}
+		if seenTIDs[ti.TID] {
+			return nil, fmt.Errorf("Duplicate team ID %s", ti.TID)
+		}
+		seenTeams[ti.Name] = true
+		seenTIDs[ti.TID] = true
+		li.Teams = append(li.Teams, ti)
+	}
+	return li, nil
+}
+
+// LoadLocalIdentities reads a set of local users and teams from the
+// JSON file at the given path; see ParseLocalIdentities for the
+// format.
+func LoadLocalIdentities(path string) (*LocalIdentities, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseLocalIdentities(data)
+}
+
+// GetUser returns the local user with the given name.
+func (li *LocalIdentities) GetUser(name libkb.NormalizedUsername) (
+	LocalUser, error) {
+	for _, u := range li.Users {
+		if u.Name == name {
+			return u, nil
+		}
+	}
+	return LocalUser{}, NoSuchUserError{string(name)}
+}
+
+// CurrentDeviceKeys returns the private keys of the current device
+// of the local user with the given name.
+func (li *LocalIdentities) CurrentDeviceKeys(name libkb.NormalizedUsername) (
+	kbfscrypto.SigningKey, kbfscrypto.CryptPrivateKey, error) {
+	keys, ok := li.currentKeys[name]
+	if !ok {
+		return kbfscrypto.SigningKey{}, kbfscrypto.CryptPrivateKey{},
+			NoSuchUserError{string(name)}
+	}
+	return keys.signingKey, keys.cryptPrivateKey, nil
+}
+
+// localIdentityFileWatcher polls a local identity file, applies any
+// changes to a KeybaseDaemonLocal, and then sends out the
+// notifications the real service would send for them.
+type localIdentityFileWatcher struct {
+	config     Config
+	log        logger.Logger
+	daemon     *KeybaseDaemonLocal
+	path       string
+	shutdownCh chan struct{}
+
+	// Only accessed by the polling goroutine.
+	lastModTime time.Time
+	lastSize    int64
+}
+
+func newLocalIdentityFileWatcher(config Config, log logger.Logger,
+	daemon *KeybaseDaemonLocal, path string) (
+	*localIdentityFileWatcher, error) {
+	fi, err := ioutil.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	return &localIdentityFileWatcher{
+		config:      config,
+		log:         log,
+		daemon:      daemon,
+		path:        path,
+		shutdownCh:  make(chan struct{}),
+		lastModTime: fi.ModTime(),
+		lastSize:    fi.Size(),
+	}, nil
+}
+
+func (w *localIdentityFileWatcher) run() {
+	ticker := time.NewTicker(localIdentityFilePollPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ctx := ctxWithRandomIDReplayable(context.Background(),
+				CtxKeybaseServiceIDKey, CtxKeybaseServiceOpID, w.log)
+			err := w.reloadIfChanged(ctx)
+			if err != nil {
+				w.log.CWarningf(ctx, "Couldn't reload local identities "+
+					"from %s: %+v", w.path, err)
+			}
+		case <-w.shutdownCh:
+			return
+		}
+	}
+}
+
+// reloadIfChanged reloads the identity file if it has changed since
+// the last load.  On error, the file is retried only after it
+// changes again.
+func (w *localIdentityFileWatcher) reloadIfChanged(ctx context.Context) error {
+	fi, err := ioutil.Stat(w.path)
+	if err != nil {
+		return err
+	}
+	if fi.ModTime().Equal(w.lastModTime) && fi.Size() == w.lastSize {
+		return nil
+	}
+	w.lastModTime = fi.ModTime()
+	w.lastSize = fi.Size()
+
+	li, err := LoadLocalIdentities(w.path)
+	if err != nil {
+		return err
+	}
+	changedUIDs, teamsChanged, err := w.daemon.setIdentities(li)
+	if err != nil {
+		return err
+	}
+	w.log.CDebugf(ctx, "Reloaded local identities from %s: %d changed "+
+		"users, teams changed=%t", w.path, len(changedUIDs), teamsChanged)
+	w.notify(ctx, changedUIDs, teamsChanged)
+	return nil
+}
+
+// notify does what KeybaseServiceBase does on the corresponding
+// notifications from the real service.
+func (w *localIdentityFileWatcher) notify(ctx context.Context,
+	changedUIDs []keybase1.UID, teamsChanged bool) {
+	session, err := w.daemon.CurrentSession(ctx, 0)
+	if err != nil {
+		w.log.CDebugf(ctx, "No current session: %+v", err)
+	}
+
+	checkForRekeys := false
+	for _, uid := range changedUIDs {
+		w.log.CDebugf(ctx, "Key family for user %s changed", uid)
+		w.config.KeybaseService().FlushUserFromLocalCache(ctx, uid)
+		if uid == session.UID {
+			checkForRekeys = true
+		}
+	}
+
+	if teamsChanged {
+		// Team membership changes can add or remove team
+		// favorites.
+		w.config.KBFSOps().RefreshCachedFavorites(ctx)
+	}
+
+	if checkForRekeys {
+		// Ignore any errors for now, like KeyfamilyChanged does.
+		w.config.MDServer().CheckForRekeys(context.Background())
+	}
+}
+
+func (w *localIdentityFileWatcher) shutdown() {
+	close(w.shutdownCh)
+}
@@ -0,0 +1,155 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestParseLocalIdentitiesDefaults(t *testing.T) {
+	li, err := ParseLocalIdentities([]byte(`{
+		"users": [
+			{"name": "alice", "asserts": ["github:alice"]},
+			{"name": "bob"}
+		],
+		"teams": [{"name": "acme", "writers": ["alice"], "readers": ["bob"]}]
+	}`))
+	require.NoError(t, err)
+
+	// Without explicit devices, keys and IDs match the built-in
+	// local users and teams.
+	expectedUsers := MakeLocalUsers(
+		[]libkb.NormalizedUsername{"alice", "bob"})
+	require.Len(t, li.Users, 2)
+	for i, u := range li.Users {
+		require.Equal(t, expectedUsers[i].UID, u.UID)
+		require.Equal(t, expectedUsers[i].VerifyingKeys, u.VerifyingKeys)
+		require.Equal(t, expectedUsers[i].CryptPublicKeys, u.CryptPublicKeys)
+	}
+	require.Equal(t, []string{"github:alice"}, li.Users[0].Asserts)
+
+	signingKey, cryptPrivateKey, err := li.CurrentDeviceKeys("alice")
+	require.NoError(t, err)
+	require.Equal(t, MakeLocalUserSigningKeyOrBust("alice"), signingKey)
+	require.Equal(t, MakeLocalUserCryptPrivateKeyOrBust("alice"),
+		cryptPrivateKey)
+
+	expectedTeams := MakeLocalTeams([]libkb.NormalizedUsername{"acme"})
+	require.Len(t, li.Teams, 1)
+	require.Equal(t, expectedTeams[0].TID, li.Teams[0].TID)
+	require.Equal(t, expectedTeams[0].CryptKeys, li.Teams[0].CryptKeys)
+	require.Equal(t, map[keybase1.UID]bool{li.Users[0].UID: true},
+		li.Teams[0].Writers)
+	require.Equal(t, map[keybase1.UID]bool{li.Users[1].UID: true},
+		li.Teams[0].Readers)
+}
+
+func TestParseLocalIdentitiesDevices(t *testing.T) {
+	li, err := ParseLocalIdentities([]byte(`{
+		"users": [{"name": "alice", "currentDevice": 2, "devices": [
+			{"name": "laptop"},
+			{"name": "phone", "revokedAt": "2017-06-01T00:00:00Z"},
+			{"name": "desktop"}
+		]}],
+		"teams": [{"name": "acme", "keyGens": 3, "writers": ["alice"]}]
+	}`))
+	require.NoError(t, err)
+
+	u := li.Users[0]
+	crypt0, verifying0 := makeFakeKeys("alice", 0)
+	crypt1, verifying1 := makeFakeKeys("alice", 1)
+	crypt2, verifying2 := makeFakeKeys("alice", 2)
+	require.Len(t, u.VerifyingKeys, 2)
+	require.Equal(t, verifying0, u.VerifyingKeys[0])
+	require.Equal(t, verifying2, u.VerifyingKeys[1])
+	require.Equal(t, crypt0, u.CryptPublicKeys[0])
+	require.Equal(t, crypt2, u.CryptPublicKeys[1])
+	require.Equal(t, 1, u.CurrentVerifyingKeyIndex)
+	require.Equal(t, 1, u.CurrentCryptPublicKeyIndex)
+	require.Contains(t, u.RevokedVerifyingKeys, verifying1)
+	require.Contains(t, u.RevokedCryptPublicKeys, crypt1)
+	require.Equal(t, "phone", u.KIDNames[verifying1.KID()])
+
+	signingKey, _, err := li.CurrentDeviceKeys("alice")
+	require.NoError(t, err)
+	require.Equal(t, verifying2, signingKey.GetVerifyingKey())
+
+	require.Equal(t, KeyGen(3), li.Teams[0].LatestKeyGen)
+	require.Len(t, li.Teams[0].CryptKeys, 3)
+
+	_, err = ParseLocalIdentities([]byte(`{"users": [{"name": "alice",
+		"devices": [{"revokedAt": "2017-06-01T00:00:00Z"}]}]}`))
+	require.Error(t, err)
+
+	_, err = ParseLocalIdentities([]byte(`{"users": [{"name": "alice"}],
+		"teams": [{"name": "acme", "writers": ["bob"]}]}`))
+	require.Error(t, err)
+
+	_, err = ParseLocalIdentities([]byte(`{"users": [
+		{"name": "alice"}, {"name": "alice"}]}`))
+	require.Error(t, err)
+}
+
+func TestKeybaseDaemonLocalSetIdentities(t *testing.T) {
+	li, err := ParseLocalIdentities([]byte(`{
+		"users": [{"name": "alice"}, {"name": "bob"}],
+		"teams": [{"name": "acme", "writers": ["alice"]}]
+	}`))
+	require.NoError(t, err)
+	alice, bob := li.Users[0], li.Users[1]
+	codec := kbfscodec.NewMsgpack()
+	k := NewKeybaseDaemonMemory(alice.UID, li.Users, li.Teams, codec)
+	ctx := context.Background()
+
+	// Nothing changes.
+	changedUIDs, teamsChanged, err := k.setIdentities(li)
+	require.NoError(t, err)
+	require.Len(t, changedUIDs, 0)
+	require.False(t, teamsChanged)
+
+	// Bob adds a device and joins the team, and a new assertion
+	// shows up.
+	li, err = ParseLocalIdentities([]byte(`{
+		"users": [{"name": "alice"},
+			{"name": "bob", "asserts": ["twitter:bob"],
+			 "devices": [{}, {}]}],
+		"teams": [{"name": "acme", "writers": ["alice"], "readers": ["bob"]}]
+	}`))
+	require.NoError(t, err)
+	changedUIDs, teamsChanged, err = k.setIdentities(li)
+	require.NoError(t, err)
+	require.Equal(t, []keybase1.UID{bob.UID}, changedUIDs)
+	require.True(t, teamsChanged)
+
+	info, err := k.LoadUserPlusKeys(ctx, bob.UID, "")
+	require.NoError(t, err)
+	require.Len(t, info.VerifyingKeys, 2)
+	_, id, err := k.Resolve(ctx, "bob@twitter")
+	require.NoError(t, err)
+	require.Equal(t, bob.UID.AsUserOrTeam(), id)
+	teamInfo, err := k.LoadTeamPlusKeys(ctx, li.Teams[0].TID)
+	require.NoError(t, err)
+	require.True(t, teamInfo.Readers[bob.UID])
+
+	// The current device of the current user can't go away, and
+	// a failed reload changes nothing.
+	li, err = ParseLocalIdentities([]byte(`{"users": [
+		{"name": "alice", "currentDevice": 1,
+		 "devices": [{"revokedAt": "2017-06-01T00:00:00Z"}, {}]},
+		{"name": "bob"}
+	]}`))
+	require.NoError(t, err)
+	_, _, err = k.setIdentities(li)
+	require.Error(t, err)
+	info, err = k.LoadUserPlusKeys(ctx, bob.UID, "")
+	require.NoError(t, err)
+	require.Len(t, info.VerifyingKeys, 2)
+}
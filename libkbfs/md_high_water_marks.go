@@ -0,0 +1,178 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"path/filepath"
+	"sync"
+
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/tlf"
+)
+
+func mdHighWaterMarksRootFromStorageRoot(storageRoot string) string {
+	return filepath.Join(storageRoot, "kbfs_md_marks")
+}
+
+// MDHighWaterMark is the highest merged revision of a TLF that this
+// device has verified, along with the ID of the MD object for that
+// revision.
+type MDHighWaterMark struct {
+	Revision kbfsmd.Revision `codec:"r"`
+	MdID     kbfsmd.ID       `codec:"i"`
+}
+
+// mdHighWaterMarks keeps an MDHighWaterMark for every TLF, so that
+// an MD server can't roll back or fork a TLF without being noticed,
+// even across restarts.  The marks are kept in memory, and each one
+// is also stored in its own file under the storage root, which is
+// only read the first time the TLF's mark is needed.  So changes
+// made by `kbfstool md marks` while a client is running don't affect
+// that client.  If there is no storage root, the marks are only kept
+// in memory.
+type mdHighWaterMarks struct {
+	codec kbfscodec.Codec
+	// If empty, marks are only kept in memory.
+	dir string
+
+	// Serializes updates, and protects marks and loaded.
+	lock  sync.Mutex
+	marks map[tlf.ID]MDHighWaterMark
+	// loaded holds the TLFs whose mark files have been read, or
+	// which don't have a mark file.
+	loaded map[tlf.ID]bool
+}
+
+func newMDHighWaterMarks(
+	codec kbfscodec.Codec, storageRoot string) *mdHighWaterMarks {
+	m := &mdHighWaterMarks{
+		codec:  codec,
+		marks:  make(map[tlf.ID]MDHighWaterMark),
+		loaded: make(map[tlf.ID]bool),
+	}
+	if storageRoot != "" {
+		m.dir = mdHighWaterMarksRootFromStorageRoot(storageRoot)
+	}
+	return m
+}
+
+func (m *mdHighWaterMarks) markPath(id tlf.ID) string {
+	return filepath.Join(m.dir, id.String())
+}
+
+func (m *mdHighWaterMarks) getLocked(id tlf.ID) (
+	mark MDHighWaterMark, ok bool, err error) {
+	if m.dir == "" || m.loaded[id] {
+		mark, ok = m.marks[id]
+		return mark, ok, nil
+	}
+
+	err = kbfscodec.DeserializeFromFile(m.codec, m.markPath(id), &mark)
+	if ioutil.IsNotExist(err) {
+		m.loaded[id] = true
+		return MDHighWaterMark{}, false, nil
+	} else if err != nil {
+		return MDHighWaterMark{}, false, err
+	}
+	m.marks[id] = mark
+	m.loaded[id] = true
+	return mark, true, nil
+}
+
+// putLocked writes the mark for the given TLF to a temporary file,
+// and then renames it over the old one, so that a crash never
+// leaves a partly-written mark behind.
+func (m *mdHighWaterMarks) putLocked(
+	id tlf.ID, mark MDHighWaterMark) error {
+	if m.dir != "" {
+		buf, err := m.codec.Encode(mark)
+		if err != nil {
+			return err
+		}
+		err = ioutil.MkdirAll(m.dir, 0700)
+		if err != nil {
+			return err
+		}
+		path := m.markPath(id)
+		tmpPath := path + ".tmp"
+		err = ioutil.WriteFile(tmpPath, buf, 0600)
+		if err != nil {
+			return err
+		}
+		err = ioutil.Rename(tmpPath, path)
+		if err != nil {
+			return err
+		}
+	}
+	m.marks[id] = mark
+	m.loaded[id] = true
+	return nil
+}
+
+// get returns the mark for the given TLF, if there is one.
+func (m *mdHighWaterMarks) get(id tlf.ID) (
+	mark MDHighWaterMark, ok bool, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.getLocked(id)
+}
+
+// update checks the given verified merged revision and MD ID for the
+// given TLF against the TLF's mark, and raises the mark if the
+// revision is higher.  It returns an MDRollbackError if the revision
+// is the same as the mark's but the MD ID isn't.
+func (m *mdHighWaterMarks) update(
+	id tlf.ID, rev kbfsmd.Revision, mdID kbfsmd.ID) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	mark, ok, err := m.getLocked(id)
+	if err != nil {
+		return err
+	}
+	if ok && rev == mark.Revision && mdID != mark.MdID {
+		return MDRollbackError{id, rev, mdID, mark}
+	}
+	if ok && rev <= mark.Revision {
+		return nil
+	}
+	return m.putLocked(id, MDHighWaterMark{Revision: rev, MdID: mdID})
+}
+
+// reset forgets the mark for the given TLF.
+func (m *mdHighWaterMarks) reset(id tlf.ID) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.dir != "" {
+		err := ioutil.Remove(m.markPath(id))
+		if err != nil && !ioutil.IsNotExist(err) {
+			return err
+		}
+	}
+	delete(m.marks, id)
+	m.loaded[id] = true
+	return nil
+}
+
+// GetMDHighWaterMark returns the highest merged revision of the
+// given TLF that has been verified by a client using the given
+// config's storage root, if there is one.  If the config has no
+// storage root, there are no persisted marks to return.
+func GetMDHighWaterMark(config Config, id tlf.ID) (
+	mark MDHighWaterMark, ok bool, err error) {
+	marks := newMDHighWaterMarks(config.Codec(), config.StorageRoot())
+	return marks.get(id)
+}
+
+// ResetMDHighWaterMark forgets the highest merged revision of the
+// given TLF that has been verified by a client using the given
+// config's storage root, so that the next head it gets from the MD
+// server is accepted even if it's older.  This is needed after a
+// legitimate server-side rollback of the TLF.
+func ResetMDHighWaterMark(config Config, id tlf.ID) error {
+	marks := newMDHighWaterMarks(config.Codec(), config.StorageRoot())
+	return marks.reset(id)
+}
@@ -0,0 +1,81 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"os"
+	"testing"
+
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMDHighWaterMarks(t *testing.T) {
+	codec := kbfscodec.NewMsgpack()
+	tempdir, err := ioutil.TempDir(os.TempDir(), "md_high_water_marks")
+	require.NoError(t, err)
+	defer func() {
+		err := ioutil.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	id := tlf.FakeID(1, tlf.Private)
+	marks := newMDHighWaterMarks(codec, tempdir)
+	_, ok, err := marks.get(id)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	err = marks.update(id, kbfsmd.Revision(2), kbfsmd.FakeID(2))
+	require.NoError(t, err)
+
+	// Older revisions don't lower the mark.
+	err = marks.update(id, kbfsmd.Revision(1), kbfsmd.FakeID(1))
+	require.NoError(t, err)
+
+	// The mark survives a restart.
+	marks = newMDHighWaterMarks(codec, tempdir)
+	mark, ok, err := marks.get(id)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, MDHighWaterMark{
+		Revision: kbfsmd.Revision(2),
+		MdID:     kbfsmd.FakeID(2),
+	}, mark)
+
+	// Marks are only read from disk once, and are written
+	// without leaving temporary files behind.
+	err = marks.update(id, kbfsmd.Revision(3), kbfsmd.FakeID(3))
+	require.NoError(t, err)
+	fis, err := ioutil.ReadDir(mdHighWaterMarksRootFromStorageRoot(tempdir))
+	require.NoError(t, err)
+	require.Len(t, fis, 1)
+	otherMarks := newMDHighWaterMarks(codec, tempdir)
+	err = otherMarks.reset(id)
+	require.NoError(t, err)
+	mark, ok, err = marks.get(id)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, kbfsmd.Revision(3), mark.Revision)
+	_, ok, err = newMDHighWaterMarks(codec, tempdir).get(id)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// A different MD for the same revision is a fork.
+	err = marks.update(id, kbfsmd.Revision(3), kbfsmd.FakeID(4))
+	require.IsType(t, MDRollbackError{}, err)
+
+	err = marks.reset(id)
+	require.NoError(t, err)
+	_, ok, err = marks.get(id)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// Resetting twice is fine.
+	err = marks.reset(id)
+	require.NoError(t, err)
+}
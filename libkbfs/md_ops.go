@@ -27,11 +27,31 @@ import (
 type MDOpsStandard struct {
 	config Config
 	log    logger.Logger
+
+	// merkleLock protects merkleSeqNos.  It's never held across a
+	// request to the MD server.
+	merkleLock sync.Mutex
+	// The highest root sequence number seen for each Merkle tree.
+	merkleSeqNos map[keybase1.MerkleTreeID]int64
+	// noMerkleProofsOnce makes sure the MD server's lack of Merkle
+	// proofs is only logged once.
+	noMerkleProofsOnce sync.Once
+
+	// The highest merged revision verified for each TLF, persisted
+	// across restarts.  A TLF's leaf in the Merkle tree must never
+	// be older than its mark.
+	marks *mdHighWaterMarks
 }
 
 // NewMDOpsStandard returns a new MDOpsStandard
 func NewMDOpsStandard(config Config) *MDOpsStandard {
-	return &MDOpsStandard{config, config.MakeLogger("")}
+	return &MDOpsStandard{
+		config:       config,
+		log:          config.MakeLogger(""),
+		merkleSeqNos: make(map[keybase1.MerkleTreeID]int64),
+		marks: newMDHighWaterMarks(
+			config.Codec(), config.StorageRoot()),
+	}
 }
 
 // convertVerifyingKeyError gives a better error when the TLF was
@@ -193,6 +213,105 @@ func (md *MDOpsStandard) verifyWriterKey(ctx context.Context,
 	}
 }
 
+// getMerkleSeqNos returns a copy of the highest root sequence
+// numbers seen so far.
+func (md *MDOpsStandard) getMerkleSeqNos() map[keybase1.MerkleTreeID]int64 {
+	md.merkleLock.Lock()
+	defer md.merkleLock.Unlock()
+	seqNos := make(map[keybase1.MerkleTreeID]int64, len(md.merkleSeqNos))
+	for treeID, seqNo := range md.merkleSeqNos {
+		seqNos[treeID] = seqNo
+	}
+	return seqNos
+}
+
+// verifyMerkleInclusion checks the given merged MD, which must be
+// the latest one being fetched, against the MD server's Merkle tree
+// of TLF heads.  The MD's revision must be in the tree, and if it's
+// the current head there, its hash must match the tree's leaf;
+// otherwise the server is showing us a fork.  Neither the tree nor
+// the TLF's leaf may go backwards compared to what we've seen
+// before; otherwise the server has rolled back.  Older MDs are
+// covered by this check through their successors' PrevRoot links.
+//
+// So far only the local MD servers serve Merkle proofs, so this only
+// protects TLFs on them.  The remote MD server reports
+// MerkleProofsUnsupportedError, and heads from it are only protected
+// against rollbacks by the high-water marks.  Any other missing
+// proof fails the check.
+func (md *MDOpsStandard) verifyMerkleInclusion(
+	ctx context.Context, rmds *RootMetadataSigned) error {
+	if rmds.MD.MergedStatus() != Merged {
+		// Unmerged branches aren't in the tree.
+		return nil
+	}
+
+	id := rmds.MD.TlfID()
+	rev := rmds.MD.RevisionNumber()
+	// Read what we've seen before asking for the proof, so that
+	// proofs fetched concurrently can't make this one look rolled
+	// back.
+	prevMark, _, err := md.marks.get(id)
+	if err != nil {
+		return err
+	}
+	prevSeqNos := md.getMerkleSeqNos()
+	root, proof, err := md.config.MDServer().GetMerkleProof(ctx, id)
+	if _, ok := err.(MerkleProofsUnsupportedError); ok {
+		md.noMerkleProofsOnce.Do(func() {
+			md.log.CWarningf(ctx, "The MD server doesn't serve Merkle "+
+				"proofs, so MD heads are NOT being checked for forks "+
+				"against a Merkle tree")
+		})
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if root == nil {
+		return MerkleVerificationError{rev, id, errors.New(
+			"the MD server returned no Merkle proof")}
+	}
+
+	leaf, err := verifyMerkleInclusionProof(
+		md.config.Codec(), *root, proof, id)
+	if err != nil {
+		return MerkleVerificationError{rev, id, err}
+	}
+	if leaf == nil || leaf.Revision < rev {
+		return MerkleVerificationError{rev, id, errors.New(
+			"revision is not in the Merkle tree")}
+	}
+	if leaf.Revision == rev {
+		hash, err := md.config.Crypto().MakeMerkleHash(rmds)
+		if err != nil {
+			return err
+		}
+		if hash != leaf.Hash {
+			return MerkleVerificationError{rev, id, fmt.Errorf(
+				"MD hash %s doesn't match the Merkle leaf hash %s",
+				hash, leaf.Hash)}
+		}
+	}
+
+	if seqNo := prevSeqNos[root.TreeID]; root.SeqNo < seqNo {
+		return MerkleVerificationError{rev, id, fmt.Errorf(
+			"Merkle root %d is older than previously-seen root %d",
+			root.SeqNo, seqNo)}
+	}
+	if leaf.Revision < prevMark.Revision {
+		return MerkleVerificationError{rev, id, fmt.Errorf(
+			"Merkle leaf revision %d is older than previously-verified "+
+				"revision %d", leaf.Revision, prevMark.Revision)}
+	}
+
+	md.merkleLock.Lock()
+	defer md.merkleLock.Unlock()
+	if root.SeqNo > md.merkleSeqNos[root.TreeID] {
+		md.merkleSeqNos[root.TreeID] = root.SeqNo
+	}
+	return nil
+}
+
 // processMetadata converts the given rmds to an
 // ImmutableRootMetadata. After this function is called, rmds
 // shouldn't be used.
@@ -268,6 +387,16 @@ func (md *MDOpsStandard) processMetadata(ctx context.Context,
 		localTimestamp = localTimestamp.Add(offset)
 	}
 
+	if rmd.MergedStatus() == Merged {
+		// Remember the highest verified revision, and make sure
+		// the server isn't showing us a different MD for a
+		// revision we've already seen.
+		err = md.marks.update(rmd.TlfID(), rmd.Revision(), mdID)
+		if err != nil {
+			return ImmutableRootMetadata{}, err
+		}
+	}
+
 	key := rmds.GetWriterMetadataSigInfo().VerifyingKey
 	*rmds = RootMetadataSigned{}
 	irmd := MakeImmutableRootMetadata(rmd, key, mdID, localTimestamp)
@@ -276,9 +405,142 @@ func (md *MDOpsStandard) processMetadata(ctx context.Context,
 	if err != nil {
 		return ImmutableRootMetadata{}, err
 	}
+	md.putHeadInDiskCache(ctx, irmd)
 	return irmd, nil
 }
 
+// putHeadInDiskCache caches the given verified head on disk, if
+// there is a disk MD cache and the head is merged.  Failures are only
+// logged, since the disk cache is just a fallback for when the MD
+// server can't be reached.
+func (md *MDOpsStandard) putHeadInDiskCache(
+	ctx context.Context, irmd ImmutableRootMetadata) {
+	dmc := md.config.DiskMDCache()
+	if dmc == nil || irmd.MergedStatus() != Merged {
+		return
+	}
+	err := dmc.PutHead(ctx, irmd)
+	if err != nil {
+		md.log.CDebugf(ctx, "Couldn't put revision %d of %s in the disk "+
+			"MD cache: %+v", irmd.Revision(), irmd.TlfID(), err)
+	}
+}
+
+// offlineDiskCache returns the disk MD cache if the MD server is
+// currently unreachable, and so cached heads should be served in
+// place of the server's; otherwise it returns nil.
+func (md *MDOpsStandard) offlineDiskCache() DiskMDCache {
+	dmc := md.config.DiskMDCache()
+	if dmc == nil || md.config.MDServer().IsConnected() {
+		return nil
+	}
+	return dmc
+}
+
+// getHeadFromDiskCache returns the cached merged head of the given
+// TLF, or an empty ImmutableRootMetadata if there isn't one.  The
+// head was verified when it was cached, so it isn't checked again.
+func (md *MDOpsStandard) getHeadFromDiskCache(
+	ctx context.Context, dmc DiskMDCache, id tlf.ID) (
+	ImmutableRootMetadata, error) {
+	ibrmd, key, err := dmc.GetHead(ctx, id)
+	if err != nil {
+		return ImmutableRootMetadata{}, err
+	}
+	if ibrmd.BareRootMetadata == nil {
+		return ImmutableRootMetadata{}, nil
+	}
+
+	bareHandle, err := ibrmd.MakeBareTlfHandle(ibrmd.extra)
+	if err != nil {
+		return ImmutableRootMetadata{}, err
+	}
+	handle, err := MakeTlfHandle(ctx, bareHandle, md.config.KBPKI())
+	if err != nil {
+		return ImmutableRootMetadata{}, err
+	}
+
+	var uid keybase1.UID
+	if handle.Type() != tlf.Public {
+		session, err := md.config.KBPKI().GetCurrentSession(ctx)
+		if err != nil {
+			return ImmutableRootMetadata{}, err
+		}
+		uid = session.UID
+	}
+
+	// TODO: Avoid having to do this type assertion.
+	brmd, ok := ibrmd.BareRootMetadata.(MutableBareRootMetadata)
+	if !ok {
+		return ImmutableRootMetadata{}, MutableBareRootMetadataNoImplError{}
+	}
+
+	rmd := makeRootMetadata(brmd, ibrmd.extra, handle)
+	pmd, err := decryptMDPrivateData(
+		ctx, md.config.Codec(), md.config.Crypto(),
+		md.config.BlockCache(), md.config.BlockOps(),
+		md.config.KeyManager(), md.config.Mode(), uid,
+		rmd.GetSerializedPrivateMetadata(), rmd, rmd, md.log)
+	if err != nil {
+		return ImmutableRootMetadata{}, err
+	}
+	rmd.data = pmd
+
+	irmd := MakeImmutableRootMetadata(
+		rmd, key, ibrmd.mdID, ibrmd.localTimestamp)
+	irmd.fromDiskCache = true
+	md.log.CDebugf(ctx, "Using revision %d of %s from the disk MD cache",
+		irmd.Revision(), id)
+	return irmd, nil
+}
+
+// getForHandleFromDiskCache is like GetForHandle, but answers from
+// the disk MD cache.  It returns serverErr if the cache doesn't have
+// a head for the handle.
+func (md *MDOpsStandard) getForHandleFromDiskCache(ctx context.Context,
+	dmc DiskMDCache, handle *TlfHandle, mStatus MergeStatus,
+	serverErr error) (tlf.ID, ImmutableRootMetadata, error) {
+	id, ok, err := dmc.GetTlfID(ctx, handle)
+	if err != nil {
+		md.log.CDebugf(ctx, "Couldn't look up %s in the disk MD cache: %+v",
+			handle.GetCanonicalPath(), err)
+		return tlf.ID{}, ImmutableRootMetadata{}, serverErr
+	} else if !ok {
+		return tlf.ID{}, ImmutableRootMetadata{}, serverErr
+	}
+	rmd, err := md.getForTLFFromDiskCache(ctx, dmc, id, mStatus, serverErr)
+	if err != nil {
+		return tlf.ID{}, ImmutableRootMetadata{}, err
+	}
+	if mStatus == Unmerged {
+		// The caller ignores the id argument for
+		// mStatus == Unmerged.
+		return tlf.ID{}, ImmutableRootMetadata{}, nil
+	}
+	return id, rmd, nil
+}
+
+// getForTLFFromDiskCache is like getForTLF, but answers from the
+// disk MD cache.  It returns serverErr if the cache doesn't have a
+// head for the TLF.  Only merged heads are cached, so if there is
+// one, there is assumed to be no unmerged head.
+func (md *MDOpsStandard) getForTLFFromDiskCache(ctx context.Context,
+	dmc DiskMDCache, id tlf.ID, mStatus MergeStatus, serverErr error) (
+	ImmutableRootMetadata, error) {
+	rmd, err := md.getHeadFromDiskCache(ctx, dmc, id)
+	if err != nil {
+		md.log.CDebugf(ctx, "Couldn't get the head of %s from the disk "+
+			"MD cache: %+v", id, err)
+		return ImmutableRootMetadata{}, serverErr
+	} else if rmd == (ImmutableRootMetadata{}) {
+		return ImmutableRootMetadata{}, serverErr
+	}
+	if mStatus == Unmerged {
+		return ImmutableRootMetadata{}, nil
+	}
+	return rmd, nil
+}
+
 // GetForHandle implements the MDOps interface for MDOpsStandard.
 func (md *MDOpsStandard) GetForHandle(ctx context.Context, handle *TlfHandle,
 	mStatus MergeStatus) (id tlf.ID, rmd ImmutableRootMetadata, err error) {
@@ -304,6 +566,10 @@ func (md *MDOpsStandard) GetForHandle(ctx context.Context, handle *TlfHandle,
 
 	id, rmds, err := mdserv.GetForHandle(ctx, bh, mStatus)
 	if err != nil {
+		if dmc := md.offlineDiskCache(); dmc != nil {
+			return md.getForHandleFromDiskCache(
+				ctx, dmc, handle, mStatus, err)
+		}
 		return tlf.ID{}, ImmutableRootMetadata{}, err
 	}
 
@@ -313,9 +579,23 @@ func (md *MDOpsStandard) GetForHandle(ctx context.Context, handle *TlfHandle,
 			// mStatus == Unmerged.
 			return tlf.ID{}, ImmutableRootMetadata{}, nil
 		}
+		prevMark, ok, err := md.marks.get(id)
+		if err != nil {
+			return tlf.ID{}, ImmutableRootMetadata{}, err
+		}
+		if ok {
+			// We've seen revisions of this TLF before.
+			return tlf.ID{}, ImmutableRootMetadata{}, MDRollbackError{
+				id, kbfsmd.RevisionUninitialized, kbfsmd.ID{}, prevMark}
+		}
 		return id, ImmutableRootMetadata{}, nil
 	}
 
+	prevMark, _, err := md.marks.get(id)
+	if err != nil {
+		return tlf.ID{}, ImmutableRootMetadata{}, err
+	}
+
 	extra, err := md.getExtraMD(ctx, rmds.MD)
 	if err != nil {
 		return tlf.ID{}, ImmutableRootMetadata{}, err
@@ -338,6 +618,12 @@ func (md *MDOpsStandard) GetForHandle(ctx context.Context, handle *TlfHandle,
 		return tlf.ID{}, ImmutableRootMetadata{}, err
 	}
 
+	// Make sure the server isn't forking or rolling back the TLF.
+	err = md.verifyMerkleInclusion(ctx, rmds)
+	if err != nil {
+		return tlf.ID{}, ImmutableRootMetadata{}, err
+	}
+
 	// TODO: For now, use the mdHandle that came with rmds for
 	// consistency. In the future, we'd want to eventually notify
 	// the upper layers of the new name, either directly, or
@@ -347,6 +633,17 @@ func (md *MDOpsStandard) GetForHandle(ctx context.Context, handle *TlfHandle,
 		return tlf.ID{}, ImmutableRootMetadata{}, err
 	}
 
+	if mStatus == Merged && rmd.Revision() < prevMark.Revision {
+		// The TLF ID isn't known until the server responds, so the
+		// mark could have been raised by a newer head verified in
+		// the meantime.  Get the head again, checking it against
+		// the mark as of before the request.
+		rmd, err = md.getForTLF(ctx, id, NullBranchID, Merged)
+		if err != nil {
+			return tlf.ID{}, ImmutableRootMetadata{}, err
+		}
+	}
+
 	return id, rmd, nil
 }
 
@@ -375,8 +672,17 @@ func (md *MDOpsStandard) processMetadataWithID(ctx context.Context,
 
 func (md *MDOpsStandard) getForTLF(ctx context.Context, id tlf.ID,
 	bid BranchID, mStatus MergeStatus) (ImmutableRootMetadata, error) {
+	// Read the mark before asking for the head, so that heads
+	// verified concurrently can't make this one look rolled back.
+	prevMark, _, err := md.marks.get(id)
+	if err != nil {
+		return ImmutableRootMetadata{}, err
+	}
 	rmds, err := md.config.MDServer().GetForTLF(ctx, id, bid, mStatus)
 	if err != nil {
+		if dmc := md.offlineDiskCache(); dmc != nil {
+			return md.getForTLFFromDiskCache(ctx, dmc, id, mStatus, err)
+		}
 		return ImmutableRootMetadata{}, err
 	}
 	if rmds == nil {
@@ -395,10 +701,19 @@ func (md *MDOpsStandard) getForTLF(ctx context.Context, id tlf.ID,
 	if err != nil {
 		return ImmutableRootMetadata{}, err
 	}
+	// Make sure the server isn't forking or rolling back the TLF.
+	err = md.verifyMerkleInclusion(ctx, rmds)
+	if err != nil {
+		return ImmutableRootMetadata{}, err
+	}
 	rmd, err := md.processMetadataWithID(ctx, id, bid, handle, rmds, extra, nil)
 	if err != nil {
 		return ImmutableRootMetadata{}, err
 	}
+	if mStatus == Merged && rmd.Revision() < prevMark.Revision {
+		return ImmutableRootMetadata{}, MDRollbackError{
+			id, rmd.Revision(), rmd.MdID(), prevMark}
+	}
 	return rmd, nil
 }
 
@@ -422,6 +737,14 @@ func (md *MDOpsStandard) processRange(ctx context.Context, id tlf.ID,
 		return nil, nil
 	}
 
+	// Only the latest MD needs to be checked against the Merkle
+	// tree, since the rest of the range is checked against it
+	// below.
+	err := md.verifyMerkleInclusion(ctx, rmdses[len(rmdses)-1])
+	if err != nil {
+		return nil, err
+	}
+
 	eg, groupCtx := errgroup.WithContext(ctx)
 
 	// Parallelize the MD decryption, because it could involve
@@ -471,7 +794,7 @@ func (md *MDOpsStandard) processRange(ctx context.Context, id tlf.ID,
 	}
 	close(rmdsChan)
 	rmdses = nil
-	err := eg.Wait()
+	err = eg.Wait()
 	if err != nil {
 		return nil, err
 	}
@@ -592,12 +915,20 @@ func (md *MDOpsStandard) put(
 		return ImmutableRootMetadata{}, err
 	}
 
+	if rmd.MergedStatus() == Merged {
+		err = md.marks.update(rmd.TlfID(), rmd.Revision(), mdID)
+		if err != nil {
+			return ImmutableRootMetadata{}, err
+		}
+	}
+
 	irmd := MakeImmutableRootMetadata(
 		rmd, verifyingKey, mdID, md.config.Clock().Now())
 	err = md.config.MDCache().Put(irmd)
 	if err != nil {
 		return ImmutableRootMetadata{}, err
 	}
+	md.putHeadInDiskCache(ctx, irmd)
 
 	return irmd, nil
 }
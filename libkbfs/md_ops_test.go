@@ -18,6 +18,7 @@ import (
 	"github.com/keybase/kbfs/kbfsmd"
 	"github.com/keybase/kbfs/tlf"
 	"github.com/stretchr/testify/require"
+	"github.com/syndtr/goleveldb/leveldb/storage"
 	"golang.org/x/net/context"
 )
 
@@ -74,6 +75,9 @@ func mdOpsInit(t *testing.T, ver MetadataVer) (mockCtrl *gomock.Controller,
 	config.SetKeyBundleCache(NewKeyBundleCacheStandard(1))
 	config.mockMdserv.EXPECT().OffsetFromServerTime().
 		Return(time.Duration(0), true).AnyTimes()
+	// Merkle verification is tested against the local servers.
+	config.mockMdserv.EXPECT().GetMerkleProof(gomock.Any(), gomock.Any()).
+		Return(nil, nil, MerkleProofsUnsupportedError{}).AnyTimes()
 	config.mockClock.EXPECT().Now().Return(time.Now()).AnyTimes()
 	injectShimCrypto(config)
 	interposeDaemonKBPKI(config, "alice", "bob", "charlie")
@@ -339,6 +343,12 @@ func testMDOpsGetForUnresolvedMdHandlePublicSuccess(t *testing.T, ver MetadataVe
 		t.Errorf("Got error on get: %v", err)
 	}
 
+	// rmds2 and rmds3 are different MDs for the same revision,
+	// which would otherwise look like a fork.
+	err = config.MDOps().(*MDOpsStandard).marks.reset(
+		tlf.FakeID(1, tlf.Public))
+	require.NoError(t, err)
+
 	config.mockMdserv.EXPECT().GetForHandle(ctx, h.ToBareHandleOrBust(), Merged).Return(tlf.NullID, rmds3, nil)
 
 	if _, _, err := config.MDOps().GetForHandle(ctx, h, Merged); err != nil {
@@ -934,3 +944,206 @@ func TestMDOps(t *testing.T) {
 	}
 	runTestsOverMetadataVers(t, "testMDOps", tests)
 }
+
+// merkleShimMDServer serves a fixed merged head revision and a fixed
+// Merkle proof, to simulate a malicious server.
+type merkleShimMDServer struct {
+	MDServer
+	headRev kbfsmd.Revision
+	root    *MerkleRoot
+	proof   MerkleInclusionProof
+}
+
+func (s merkleShimMDServer) GetForTLF(
+	ctx context.Context, id tlf.ID, bid BranchID, mStatus MergeStatus) (
+	*RootMetadataSigned, error) {
+	rmdses, err := s.MDServer.GetRange(
+		ctx, id, bid, mStatus, s.headRev, s.headRev)
+	if err != nil {
+		return nil, err
+	}
+	return rmdses[0], nil
+}
+
+func (s merkleShimMDServer) GetMerkleProof(
+	ctx context.Context, id tlf.ID) (
+	*MerkleRoot, MerkleInclusionProof, error) {
+	return s.root, s.proof, nil
+}
+
+func TestMDOpsMerkleDetectsForkAndRollback(t *testing.T) {
+	var u1 libkb.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, u1)
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, u1.String(), tlf.Private)
+	fb := rootNode.GetFolderBranch()
+	kbfsOps := config.KBFSOps()
+	_, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	// Remember the tree as of this revision.
+	mdserv := config.MDServer()
+	oldRoot, oldProof, err := mdserv.GetMerkleProof(ctx, fb.Tlf)
+	require.NoError(t, err)
+	require.NotNil(t, oldRoot)
+	oldHead, err := mdserv.GetForTLF(ctx, fb.Tlf, NullBranchID, Merged)
+	require.NoError(t, err)
+	oldRev := oldHead.MD.RevisionNumber()
+
+	_, _, err = kbfsOps.CreateDir(ctx, rootNode, "b")
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	newHead, err := mdserv.GetForTLF(ctx, fb.Tlf, NullBranchID, Merged)
+	require.NoError(t, err)
+	newRev := newHead.MD.RevisionNumber()
+	require.True(t, newRev > oldRev)
+
+	t.Log("A new head with a stale tree is a fork")
+	config2 := ConfigAsUser(config, u1)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+	mdserv2 := config2.MDServer()
+	config2.SetMDServer(merkleShimMDServer{mdserv2, newRev, oldRoot, oldProof})
+	_, err = config2.MDOps().GetForTLF(ctx, fb.Tlf)
+	require.IsType(t, MerkleVerificationError{}, err)
+
+	t.Log("A head whose hash doesn't match its leaf is a fork")
+	forkTrees, err := newMDServerLocalMerkleTrees(
+		config.Codec(), config.Crypto(), config.Clock(),
+		storage.NewMemStorage())
+	require.NoError(t, err)
+	defer forkTrees.shutdown()
+	forkHead, err := newHead.MD.DeepCopy(config.Codec())
+	require.NoError(t, err)
+	forkHead.SetUnrefBytes(newHead.MD.UnrefBytes() + 1)
+	err = forkTrees.putHead(&RootMetadataSigned{
+		SigInfo: newHead.SigInfo,
+		MD:      forkHead,
+	})
+	require.NoError(t, err)
+	forkRoot, forkProof, err := forkTrees.getProof(fb.Tlf)
+	require.NoError(t, err)
+	config2.SetMDServer(
+		merkleShimMDServer{mdserv2, newRev, forkRoot, forkProof})
+	_, err = config2.MDOps().GetForTLF(ctx, fb.Tlf)
+	require.IsType(t, MerkleVerificationError{}, err)
+
+	t.Log("A server that supports proofs can't leave one out")
+	config2.SetMDServer(merkleShimMDServer{mdserv2, newRev, nil, nil})
+	_, err = config2.MDOps().GetForTLF(ctx, fb.Tlf)
+	require.IsType(t, MerkleVerificationError{}, err)
+
+	t.Log("The real head and tree verify")
+	config2.SetMDServer(mdserv2)
+	_, err = config2.MDOps().GetForTLF(ctx, fb.Tlf)
+	require.NoError(t, err)
+
+	t.Log("Going back to an old head and tree is a rollback")
+	config2.SetMDServer(
+		merkleShimMDServer{mdserv2, oldRev, oldRoot, oldProof})
+	_, err = config2.MDOps().GetForTLF(ctx, fb.Tlf)
+	require.IsType(t, MerkleVerificationError{}, err)
+
+	// Let the state checker see the real server.
+	config2.SetMDServer(mdserv2)
+}
+
+// countingMerkleMDServer counts the Merkle proofs it serves.
+type countingMerkleMDServer struct {
+	MDServer
+	proofs *int
+}
+
+func (s countingMerkleMDServer) GetMerkleProof(
+	ctx context.Context, id tlf.ID) (
+	*MerkleRoot, MerkleInclusionProof, error) {
+	*s.proofs++
+	return s.MDServer.GetMerkleProof(ctx, id)
+}
+
+func TestMDOpsMerkleOnlyChecksLatest(t *testing.T) {
+	var u1 libkb.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, u1)
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, u1.String(), tlf.Private)
+	fb := rootNode.GetFolderBranch()
+	kbfsOps := config.KBFSOps()
+	for _, name := range []string{"a", "b", "c"} {
+		_, _, err := kbfsOps.CreateDir(ctx, rootNode, name)
+		require.NoError(t, err)
+		err = kbfsOps.SyncAll(ctx, fb)
+		require.NoError(t, err)
+	}
+
+	config2 := ConfigAsUser(config, u1)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+	mdserv2 := config2.MDServer()
+	var proofs int
+	config2.SetMDServer(countingMerkleMDServer{mdserv2, &proofs})
+	head, err := config2.MDOps().GetForTLF(ctx, fb.Tlf)
+	require.NoError(t, err)
+	require.Equal(t, 1, proofs)
+
+	proofs = 0
+	rmds, err := config2.MDOps().GetRange(
+		ctx, fb.Tlf, kbfsmd.RevisionInitial, head.Revision())
+	require.NoError(t, err)
+	require.Len(t, rmds, int(head.Revision()-kbfsmd.RevisionInitial)+1)
+	require.Equal(t, 1, proofs)
+
+	// Let the state checker see the real server.
+	config2.SetMDServer(mdserv2)
+}
+
+func TestMDOpsHighWaterMarkDetectsRollback(t *testing.T) {
+	var u1 libkb.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, u1)
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, u1.String(), tlf.Private)
+	fb := rootNode.GetFolderBranch()
+	kbfsOps := config.KBFSOps()
+	_, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	mdserv := config.MDServer()
+	oldHead, err := mdserv.GetForTLF(ctx, fb.Tlf, NullBranchID, Merged)
+	require.NoError(t, err)
+	oldRev := oldHead.MD.RevisionNumber()
+
+	_, _, err = kbfsOps.CreateDir(ctx, rootNode, "b")
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	config2 := ConfigAsUser(config, u1)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+	mdserv2 := config2.MDServer()
+	head, err := config2.MDOps().GetForTLF(ctx, fb.Tlf)
+	require.NoError(t, err)
+	require.True(t, head.Revision() > oldRev)
+
+	t.Log("An older head is a rollback, even without Merkle proofs")
+	config2.SetMDServer(merkleShimMDServer{mdserv2, oldRev, nil, nil})
+	_, err = config2.MDOps().GetForTLF(ctx, fb.Tlf)
+	require.IsType(t, MDRollbackError{}, err)
+	_, _, err = config2.MDOps().GetForHandle(ctx, head.GetTlfHandle(), Merged)
+	require.IsType(t, MDRollbackError{}, err)
+
+	t.Log("After a reset, the older head is accepted")
+	// There's no storage root, so reset the in-memory mark directly.
+	err = config2.MDOps().(*MDOpsStandard).marks.reset(fb.Tlf)
+	require.NoError(t, err)
+	rolledBack, err := config2.MDOps().GetForTLF(ctx, fb.Tlf)
+	require.NoError(t, err)
+	require.Equal(t, oldRev, rolledBack.Revision())
+
+	// Let the state checker see the real server.
+	config2.SetMDServer(mdserv2)
+}
@@ -19,6 +19,7 @@ import (
 	"github.com/keybase/kbfs/tlf"
 	"github.com/pkg/errors"
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
 	"golang.org/x/net/context"
 )
 
@@ -34,6 +35,8 @@ type mdServerDiskShared struct {
 	// (TLF ID, device crypt public key) -> branch ID
 	branchDb   *leveldb.DB
 	tlfStorage map[tlf.ID]*mdServerTlfStorage
+	// Merkle trees of the merged heads of all TLFs.
+	merkleTrees *mdServerLocalMerkleTrees
 	// Always use memory for the lock storage, so it gets wiped
 	// after a restart.
 	truncateLockManager *mdServerLocalTruncateLockManager
@@ -67,6 +70,17 @@ func newMDServerDisk(config mdServerLocalConfig, dirPath string,
 	if err != nil {
 		return nil, err
 	}
+
+	merklePath := filepath.Join(dirPath, "merkle")
+	merkleStorage, err := storage.OpenFile(merklePath, false)
+	if err != nil {
+		return nil, err
+	}
+	merkleTrees, err := newMDServerLocalMerkleTrees(
+		config.Codec(), config.cryptoPure(), config.Clock(), merkleStorage)
+	if err != nil {
+		return nil, err
+	}
 	log := config.MakeLogger("MDSD")
 	truncateLockManager := newMDServerLocalTruncatedLockManager()
 	shared := mdServerDiskShared{
@@ -74,6 +88,7 @@ func newMDServerDisk(config mdServerLocalConfig, dirPath string,
 		handleDb:            handleDb,
 		branchDb:            branchDb,
 		tlfStorage:          make(map[tlf.ID]*mdServerTlfStorage),
+		merkleTrees:         merkleTrees,
 		truncateLockManager: &truncateLockManager,
 		updateManager:       newMDServerLocalUpdateManager(),
 		shutdownFunc:        shutdownFunc,
@@ -151,7 +166,7 @@ func (md *MDServerDisk) getStorage(tlfID tlf.ID) (*mdServerTlfStorage, error) {
 	storage = makeMDServerTlfStorage(
 		tlfID, md.config.Codec(), md.config.cryptoPure(),
 		md.config.Clock(), md.config.teamMembershipChecker(),
-		md.config.MetadataVersion(), path)
+		md.config.MetadataVersion(), path, md.merkleTrees)
 
 	md.tlfStorage[tlfID] = storage
 	return storage, nil
@@ -563,6 +578,8 @@ func (md *MDServerDisk) Shutdown() {
 		s.shutdown()
 	}
 
+	md.merkleTrees.shutdown()
+
 	if md.shutdownFunc != nil {
 		md.shutdownFunc(md.log)
 	}
@@ -704,6 +721,24 @@ func (md *MDServerDisk) GetKeyBundles(ctx context.Context,
 	return tlfStorage.getKeyBundles(tlfID, wkbID, rkbID)
 }
 
+// GetMerkleProof implements the MDServer interface for MDServerDisk.
+func (md *MDServerDisk) GetMerkleProof(ctx context.Context, id tlf.ID) (
+	*MerkleRoot, MerkleInclusionProof, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, nil, err
+	}
+
+	if md.isShutdown() {
+		return nil, nil, errors.WithStack(errMDServerDiskShutdown{})
+	}
+
+	root, proof, err := md.merkleTrees.getProof(id)
+	if err != nil {
+		return nil, nil, kbfsmd.ServerError{Err: err}
+	}
+	return root, proof, nil
+}
+
 // CheckReachability implements the MDServer interface for MDServerMemory.
 func (md *MDServerDisk) CheckReachability(ctx context.Context) {}
 
@@ -0,0 +1,281 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	merkle "github.com/keybase/go-merkle-tree"
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// mdServerLocalMerkleEngine is a merkle.StorageEngine that keeps the
+// nodes and the root of a single Merkle tree in a leveldb, under
+// keys prefixed by the tree ID.  Along with the root hash, it stores
+// the txinfo passed to CommitRoot, which is the encoded MerkleRoot
+// (minus the hash) describing that root.  It also keeps a copy of
+// every leaf value, so the tree can be rebuilt.
+type mdServerLocalMerkleEngine struct {
+	db     *leveldb.DB
+	prefix []byte
+}
+
+var _ merkle.StorageEngine = mdServerLocalMerkleEngine{}
+
+func (e mdServerLocalMerkleEngine) key(kind byte, rest []byte) []byte {
+	key := make([]byte, 0, len(e.prefix)+1+len(rest))
+	key = append(key, e.prefix...)
+	key = append(key, kind)
+	return append(key, rest...)
+}
+
+func (e mdServerLocalMerkleEngine) get(key []byte) ([]byte, error) {
+	buf, err := e.db.Get(key, nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return buf, nil
+}
+
+// StoreNode implements the merkle.StorageEngine interface for
+// mdServerLocalMerkleEngine.
+func (e mdServerLocalMerkleEngine) StoreNode(h merkle.Hash, b []byte) error {
+	return errors.WithStack(e.db.Put(e.key('n', h), b, nil))
+}
+
+// CommitRoot implements the merkle.StorageEngine interface for
+// mdServerLocalMerkleEngine.
+func (e mdServerLocalMerkleEngine) CommitRoot(
+	prev merkle.Hash, curr merkle.Hash, txinfo merkle.TxInfo) error {
+	var batch leveldb.Batch
+	batch.Put(e.key('r', nil), curr)
+	batch.Put(e.key('i', nil), txinfo)
+	return errors.WithStack(e.db.Write(&batch, nil))
+}
+
+// LookupNode implements the merkle.StorageEngine interface for
+// mdServerLocalMerkleEngine.
+func (e mdServerLocalMerkleEngine) LookupNode(h merkle.Hash) ([]byte, error) {
+	return e.get(e.key('n', h))
+}
+
+// LookupRoot implements the merkle.StorageEngine interface for
+// mdServerLocalMerkleEngine.
+func (e mdServerLocalMerkleEngine) LookupRoot() (merkle.Hash, error) {
+	return e.get(e.key('r', nil))
+}
+
+// mdServerLocalMerkleRecorder wraps a merkle.StorageEngine, and
+// remembers every node looked up through it.
+type mdServerLocalMerkleRecorder struct {
+	merkle.StorageEngine
+	nodes MerkleInclusionProof
+}
+
+// LookupNode implements the merkle.StorageEngine interface for
+// mdServerLocalMerkleRecorder.
+func (r *mdServerLocalMerkleRecorder) LookupNode(
+	h merkle.Hash) ([]byte, error) {
+	b, err := r.StorageEngine.LookupNode(h)
+	if err != nil {
+		return nil, err
+	}
+	if b != nil {
+		r.nodes = append(r.nodes, b)
+	}
+	return b, nil
+}
+
+type errMDServerLocalMerkleShutdown struct{}
+
+func (e errMDServerLocalMerkleShutdown) Error() string {
+	return "Local MD server Merkle trees are shutdown"
+}
+
+// mdServerLocalMerkleTrees keeps, for the local MDServer
+// implementations, one Merkle tree per TLF type mapping each TLF to
+// a MerkleLeaf for its current merged head, so that clients can check
+// that they aren't being shown a fork or a rollback.  Unlike the real
+// service, leaves are stored unencrypted.
+type mdServerLocalMerkleTrees struct {
+	codec  kbfscodec.Codec
+	crypto cryptoPure
+	clock  Clock
+
+	// Protects db, and serializes updates to the trees so that root
+	// sequence numbers are assigned in order.  After shutdown() is
+	// called, db is nil.
+	lock sync.Mutex
+	db   *leveldb.DB
+}
+
+func newMDServerLocalMerkleTrees(codec kbfscodec.Codec, crypto cryptoPure,
+	clock Clock, stor storage.Storage) (*mdServerLocalMerkleTrees, error) {
+	db, err := leveldb.Open(stor, leveldbOptions)
+	if err != nil {
+		return nil, err
+	}
+	return &mdServerLocalMerkleTrees{
+		codec:  codec,
+		crypto: crypto,
+		clock:  clock,
+		db:     db,
+	}, nil
+}
+
+func (m *mdServerLocalMerkleTrees) engineLocked(
+	treeID keybase1.MerkleTreeID) (mdServerLocalMerkleEngine, error) {
+	if m.db == nil {
+		return mdServerLocalMerkleEngine{}, errors.WithStack(
+			errMDServerLocalMerkleShutdown{})
+	}
+	return mdServerLocalMerkleEngine{m.db, []byte{byte(treeID)}}, nil
+}
+
+func (m *mdServerLocalMerkleTrees) getRootLocked(
+	eng mdServerLocalMerkleEngine, treeID keybase1.MerkleTreeID) (
+	MerkleRoot, error) {
+	hash, err := eng.LookupRoot()
+	if err != nil {
+		return MerkleRoot{}, err
+	}
+	if hash == nil {
+		return MerkleRoot{Version: MerkleRootVersion, TreeID: treeID}, nil
+	}
+
+	info, err := eng.get(eng.key('i', nil))
+	if err != nil {
+		return MerkleRoot{}, err
+	}
+	var root MerkleRoot
+	err = m.codec.Decode(info, &root)
+	if err != nil {
+		return MerkleRoot{}, err
+	}
+	root.Hash = hash
+	return root, nil
+}
+
+// putLeafLocked sets the leaf for the given TLF to encodedLeaf, and
+// commits a new root for the TLF's tree.
+func (m *mdServerLocalMerkleTrees) putLeafLocked(
+	id tlf.ID, encodedLeaf []byte, now int64) error {
+	treeID := merkleTreeIDForTlfType(id.Type())
+	eng, err := m.engineLocked(treeID)
+	if err != nil {
+		return err
+	}
+	prevRoot, err := m.getRootLocked(eng, treeID)
+	if err != nil {
+		return err
+	}
+	txInfo, err := m.codec.Encode(MerkleRoot{
+		Version:   MerkleRootVersion,
+		TreeID:    treeID,
+		SeqNo:     prevRoot.SeqNo + 1,
+		Timestamp: now,
+		PrevRoot:  prevRoot.Hash,
+	})
+	if err != nil {
+		return err
+	}
+
+	// Rebuild the whole tree instead of calling Upsert, since the
+	// vendored go-merkle-tree inserts a duplicate key rather than
+	// replacing the existing one when updating a leaf.  The local
+	// servers only hold a handful of TLFs, so this is cheap enough.
+	key := merkleKeyForTlfID(id)
+	leafPrefix := eng.key('l', nil)
+	kvps := []merkle.KeyValuePair{{Key: key, Value: encodedLeaf}}
+	iter := m.db.NewIterator(util.BytesPrefix(leafPrefix), nil)
+	for iter.Next() {
+		k := merkle.Hash(iter.Key()[len(leafPrefix):])
+		if k.Eq(key) {
+			continue
+		}
+		kvps = append(kvps, merkle.KeyValuePair{
+			Key:   append(merkle.Hash(nil), k...),
+			Value: append([]byte(nil), iter.Value()...),
+		})
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return errors.WithStack(err)
+	}
+
+	tree := merkle.NewTree(eng, makeMerkleTreeConfig())
+	err = tree.Build(merkle.NewSortedMapFromList(kvps), txInfo)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(m.db.Put(eng.key('l', key), encodedLeaf, nil))
+}
+
+// putHead records the given merged MD as the head of its TLF, and
+// commits a new root for the TLF's tree.
+func (m *mdServerLocalMerkleTrees) putHead(rmds *RootMetadataSigned) error {
+	hash, err := m.crypto.MakeMerkleHash(rmds)
+	if err != nil {
+		return err
+	}
+	now := m.clock.Now().Unix()
+	encodedLeaf, err := m.codec.Encode(MerkleLeaf{
+		Revision:  rmds.MD.RevisionNumber(),
+		Hash:      hash,
+		Timestamp: now,
+	})
+	if err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.putLeafLocked(rmds.MD.TlfID(), encodedLeaf, now)
+}
+
+// getProof returns the current root of the Merkle tree for the given
+// TLF, along with the nodes on the path from that root to the TLF's
+// leaf.
+func (m *mdServerLocalMerkleTrees) getProof(id tlf.ID) (
+	*MerkleRoot, MerkleInclusionProof, error) {
+	treeID := merkleTreeIDForTlfType(id.Type())
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	eng, err := m.engineLocked(treeID)
+	if err != nil {
+		return nil, nil, err
+	}
+	root, err := m.getRootLocked(eng, treeID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	recorder := &mdServerLocalMerkleRecorder{StorageEngine: eng}
+	tree := merkle.NewTree(recorder, makeMerkleTreeConfig())
+	_, _, err = tree.Find(merkleKeyForTlfID(id))
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	return &root, recorder.nodes, nil
+}
+
+func (m *mdServerLocalMerkleTrees) shutdown() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.db == nil {
+		return
+	}
+	m.db.Close()
+	m.db = nil
+}
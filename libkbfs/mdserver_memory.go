@@ -16,6 +16,7 @@ import (
 	"github.com/keybase/kbfs/kbfsmd"
 	"github.com/keybase/kbfs/tlf"
 	"github.com/pkg/errors"
+	"github.com/syndtr/goleveldb/leveldb/storage"
 	"golang.org/x/net/context"
 )
 
@@ -72,6 +73,8 @@ type mdServerMemShared struct {
 	// (TLF ID, crypt public key) -> branch ID
 	branchDb            map[mdBranchKey]BranchID
 	truncateLockManager *mdServerLocalTruncateLockManager
+	// Merkle trees of the merged heads of all TLFs.
+	merkleTrees *mdServerLocalMerkleTrees
 
 	updateManager *mdServerLocalUpdateManager
 }
@@ -97,6 +100,12 @@ func NewMDServerMemory(config mdServerLocalConfig) (*MDServerMemory, error) {
 	readerKeyBundleDb := make(map[mdExtraReaderKey]TLFReaderKeyBundleV3)
 	log := config.MakeLogger("MDSM")
 	truncateLockManager := newMDServerLocalTruncatedLockManager()
+	merkleTrees, err := newMDServerLocalMerkleTrees(
+		config.Codec(), config.cryptoPure(), config.Clock(),
+		storage.NewMemStorage())
+	if err != nil {
+		return nil, err
+	}
 	shared := mdServerMemShared{
 		handleDb:            handleDb,
 		latestHandleDb:      latestHandleDb,
@@ -105,6 +114,7 @@ func NewMDServerMemory(config mdServerLocalConfig) (*MDServerMemory, error) {
 		writerKeyBundleDb:   writerKeyBundleDb,
 		readerKeyBundleDb:   readerKeyBundleDb,
 		truncateLockManager: &truncateLockManager,
+		merkleTrees:         merkleTrees,
 		updateManager:       newMDServerLocalUpdateManager(),
 	}
 	mdserv := &MDServerMemory{config, log, &shared}
@@ -519,6 +529,16 @@ func (md *MDServerMemory) Put(ctx context.Context, rmds *RootMetadataSigned,
 		return err
 	}
 
+	if mStatus == Merged {
+		// Update the Merkle tree before the new head becomes
+		// visible, so that no client can see a head that isn't
+		// in the tree yet.
+		err = md.merkleTrees.putHead(rmds)
+		if err != nil {
+			return kbfsmd.ServerError{Err: err}
+		}
+	}
+
 	blockList, ok := md.mdDb[revKey]
 	if ok {
 		blockList.blocks = append(blockList.blocks, block)
@@ -688,6 +708,7 @@ func (md *MDServerMemory) Shutdown() {
 	md.latestHandleDb = nil
 	md.branchDb = nil
 	md.truncateLockManager = nil
+	md.merkleTrees.shutdown()
 }
 
 // IsConnected implements the MDServer interface for MDServerMemory.
@@ -889,6 +910,24 @@ func (md *MDServerMemory) GetKeyBundles(ctx context.Context,
 	return wkb, rkb, nil
 }
 
+// GetMerkleProof implements the MDServer interface for MDServerMemory.
+func (md *MDServerMemory) GetMerkleProof(ctx context.Context, id tlf.ID) (
+	*MerkleRoot, MerkleInclusionProof, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, nil, err
+	}
+
+	if md.isShutdown() {
+		return nil, nil, errors.WithStack(errMDServerMemoryShutdown{})
+	}
+
+	root, proof, err := md.merkleTrees.getProof(id)
+	if err != nil {
+		return nil, nil, kbfsmd.ServerError{Err: err}
+	}
+	return root, proof, nil
+}
+
 // CheckReachability implements the MDServer interface for MDServerMemory.
 func (md *MDServerMemory) CheckReachability(ctx context.Context) {}
 
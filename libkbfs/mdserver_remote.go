@@ -497,6 +497,14 @@ func (md *MDServerRemote) GetForHandle(ctx context.Context,
 	handle tlf.Handle, mStatus MergeStatus) (
 	tlfID tlf.ID, rmds *RootMetadataSigned, err error) {
 	ctx = rpc.WithFireNow(ctx)
+	ctx = startSpan(ctx, "MDServerRemote.GetForHandle")
+	defer func() {
+		if rmds != nil {
+			addSpanAttributes(ctx, spanAttrTLF(tlfID),
+				spanAttrRevision(rmds.MD.RevisionNumber()))
+		}
+		finishSpan(ctx, err)
+	}()
 	// TODO: Ideally, *tlf.Handle would have a nicer String() function.
 	md.log.LazyTrace(ctx, "MDServer: GetForHandle %+v %s", handle, mStatus)
 	defer func() {
@@ -531,6 +539,14 @@ func (md *MDServerRemote) GetForHandle(ctx context.Context,
 func (md *MDServerRemote) GetForTLF(ctx context.Context, id tlf.ID,
 	bid BranchID, mStatus MergeStatus) (rmds *RootMetadataSigned, err error) {
 	ctx = rpc.WithFireNow(ctx)
+	ctx = startSpan(ctx, "MDServerRemote.GetForTLF", spanAttrTLF(id))
+	defer func() {
+		if rmds != nil {
+			addSpanAttributes(
+				ctx, spanAttrRevision(rmds.MD.RevisionNumber()))
+		}
+		finishSpan(ctx, err)
+	}()
 	md.log.LazyTrace(ctx, "MDServer: GetForTLF %s %s %s", id, bid, mStatus)
 	defer func() {
 		md.deferLog.LazyTrace(ctx, "MDServer: GetForTLF %s %s %s done (err=%v)", id, bid, mStatus, err)
@@ -558,6 +574,10 @@ func (md *MDServerRemote) GetRange(ctx context.Context, id tlf.ID,
 	bid BranchID, mStatus MergeStatus, start, stop kbfsmd.Revision) (
 	rmdses []*RootMetadataSigned, err error) {
 	ctx = rpc.WithFireNow(ctx)
+	ctx = startSpan(ctx, "MDServerRemote.GetRange", spanAttrTLF(id),
+		SpanAttribute{spanAttrKeyRevision,
+			fmt.Sprintf("%d-%d", start, stop)})
+	defer func() { finishSpan(ctx, err) }()
 	md.log.LazyTrace(ctx, "MDServer: GetRange %s %s %s %d-%d", id, bid, mStatus, start, stop)
 	defer func() {
 		md.deferLog.LazyTrace(ctx, "MDServer: GetRange %s %s %s %d-%d done (err=%v)", id, bid, mStatus, start, stop, err)
@@ -579,6 +599,9 @@ func (md *MDServerRemote) GetRange(ctx context.Context, id tlf.ID,
 func (md *MDServerRemote) Put(ctx context.Context, rmds *RootMetadataSigned,
 	extra ExtraMetadata) (err error) {
 	ctx = rpc.WithFireNow(ctx)
+	ctx = startSpan(ctx, "MDServerRemote.Put", spanAttrTLF(rmds.MD.TlfID()),
+		spanAttrRevision(rmds.MD.RevisionNumber()))
+	defer func() { finishSpan(ctx, err) }()
 	md.log.LazyTrace(ctx, "MDServer: Put %s %d", rmds.MD.TlfID(), rmds.MD.RevisionNumber())
 	defer func() {
 		md.deferLog.LazyTrace(ctx, "MDServer: Put %s %d done (err=%v)", rmds.MD.TlfID(), rmds.MD.RevisionNumber(), err)
@@ -1058,6 +1081,19 @@ func (md *MDServerRemote) backgroundRekeyChecker(ctx context.Context) {
 	}
 }
 
+// GetMerkleProof implements the MDServer interface for MDServerRemote.
+func (md *MDServerRemote) GetMerkleProof(ctx context.Context, id tlf.ID) (
+	*MerkleRoot, MerkleInclusionProof, error) {
+	// The mdserver protocol doesn't serve the KBFS Merkle trees;
+	// they are only reachable through the keybase service.  Until
+	// they're fetched from there, heads from the remote server are
+	// NOT checked against a Merkle tree, only against the local
+	// high-water marks.
+	//
+	// TODO: Get the proofs from the keybase service.
+	return nil, nil, MerkleProofsUnsupportedError{}
+}
+
 // GetKeyBundles implements the MDServer interface for MDServerRemote.
 func (md *MDServerRemote) GetKeyBundles(ctx context.Context,
 	tlf tlf.ID, wkbID TLFWriterKeyBundleID, rkbID TLFReaderKeyBundleID) (
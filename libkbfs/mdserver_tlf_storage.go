@@ -69,6 +69,8 @@ type mdServerTlfStorage struct {
 	teamMemChecker TeamMembershipChecker
 	mdVer          MetadataVer
 	dir            string
+	// If non-nil, updated with every new merged head.
+	merkleTrees *mdServerLocalMerkleTrees
 
 	// Protects any IO operations in dir or any of its children,
 	// as well as branchJournals and its contents.
@@ -78,7 +80,8 @@ type mdServerTlfStorage struct {
 
 func makeMDServerTlfStorage(tlfID tlf.ID, codec kbfscodec.Codec,
 	crypto cryptoPure, clock Clock, teamMemChecker TeamMembershipChecker,
-	mdVer MetadataVer, dir string) *mdServerTlfStorage {
+	mdVer MetadataVer, dir string,
+	merkleTrees *mdServerLocalMerkleTrees) *mdServerTlfStorage {
 	journal := &mdServerTlfStorage{
 		tlfID:          tlfID,
 		codec:          codec,
@@ -87,6 +90,7 @@ func makeMDServerTlfStorage(tlfID tlf.ID, codec kbfscodec.Codec,
 		teamMemChecker: teamMemChecker,
 		mdVer:          mdVer,
 		dir:            dir,
+		merkleTrees:    merkleTrees,
 		branchJournals: make(map[BranchID]mdIDJournal),
 	}
 	return journal
@@ -484,6 +488,16 @@ func (s *mdServerTlfStorage) put(ctx context.Context,
 		}
 	}
 
+	if mStatus == Merged && s.merkleTrees != nil {
+		// Update the Merkle tree before the new head becomes
+		// visible, so that no client can see a head that isn't
+		// in the tree yet.
+		err = s.merkleTrees.putHead(rmds)
+		if err != nil {
+			return false, kbfsmd.ServerError{Err: err}
+		}
+	}
+
 	id, err := s.putMDLocked(rmds)
 	if err != nil {
 		return false, kbfsmd.ServerError{Err: err}
@@ -6,12 +6,16 @@ package libkbfs
 
 import (
 	"encoding"
+	"encoding/hex"
 
 	"github.com/keybase/client/go/protocol/keybase1"
 	merkle "github.com/keybase/go-merkle-tree"
+	"github.com/keybase/kbfs/kbfscodec"
 	"github.com/keybase/kbfs/kbfscrypto"
 	"github.com/keybase/kbfs/kbfshash"
 	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
 )
 
 // MerkleRootVersion is the current Merkle root version.
@@ -86,3 +90,123 @@ func (h MerkleHash) MarshalBinary() (data []byte, err error) {
 func (h *MerkleHash) UnmarshalBinary(data []byte) error {
 	return h.h.UnmarshalBinary(data)
 }
+
+const (
+	// merkleTreeFanout is the number of children of each interior
+	// node of a Merkle tree of TLF heads.
+	merkleTreeFanout = 256
+	// merkleTreeMaxLeafEntries is the number of TLFs a Merkle tree
+	// leaf node can hold before it gets split.
+	merkleTreeMaxLeafEntries = 512
+)
+
+// makeMerkleTreeConfig returns the shape of the Merkle trees of TLF
+// heads.  The leaves hold encoded MerkleLeaf objects.
+func makeMerkleTreeConfig() merkle.Config {
+	return merkle.NewConfig(merkle.SHA512Hasher{},
+		merkleTreeFanout, merkleTreeMaxLeafEntries, MerkleLeaf{})
+}
+
+// merkleTreeIDForTlfType returns the ID of the Merkle tree that
+// holds the heads of TLFs of the given type.
+func merkleTreeIDForTlfType(t tlf.Type) keybase1.MerkleTreeID {
+	switch t {
+	case tlf.Public:
+		return keybase1.MerkleTreeID_KBFS_PUBLIC
+	case tlf.SingleTeam:
+		return keybase1.MerkleTreeID_KBFS_PRIVATETEAM
+	default:
+		return keybase1.MerkleTreeID_KBFS_PRIVATE
+	}
+}
+
+// merkleKeyForTlfID returns the key under which the head of the
+// given TLF is stored in its Merkle tree.
+func merkleKeyForTlfID(id tlf.ID) merkle.Hash {
+	return merkle.Hash(id.Bytes())
+}
+
+// MerkleInclusionProof is the list of encoded Merkle tree nodes on
+// the path from a root down to the leaf node that holds (or would
+// hold) a given TLF.
+type MerkleInclusionProof [][]byte
+
+// merkleProofEngine is a read-only merkle.StorageEngine that serves
+// only the nodes of an inclusion proof, so that a lookup through it
+// fails unless the proof contains a full path from the root.
+type merkleProofEngine struct {
+	root  merkle.Hash
+	nodes map[string][]byte
+}
+
+var _ merkle.StorageEngine = merkleProofEngine{}
+
+// StoreNode implements the merkle.StorageEngine interface for
+// merkleProofEngine.
+func (e merkleProofEngine) StoreNode(merkle.Hash, []byte) error {
+	return errors.New("Can't store nodes in a Merkle proof")
+}
+
+// CommitRoot implements the merkle.StorageEngine interface for
+// merkleProofEngine.
+func (e merkleProofEngine) CommitRoot(
+	prev merkle.Hash, curr merkle.Hash, txinfo merkle.TxInfo) error {
+	return errors.New("Can't commit a root to a Merkle proof")
+}
+
+// LookupNode implements the merkle.StorageEngine interface for
+// merkleProofEngine.
+func (e merkleProofEngine) LookupNode(h merkle.Hash) ([]byte, error) {
+	return e.nodes[hex.EncodeToString(h)], nil
+}
+
+// LookupRoot implements the merkle.StorageEngine interface for
+// merkleProofEngine.
+func (e merkleProofEngine) LookupRoot() (merkle.Hash, error) {
+	return e.root, nil
+}
+
+// verifyMerkleInclusionProof checks that the given proof is a valid
+// path down the Merkle tree with the given root to the leaf node for
+// the given TLF, and returns the TLF's leaf.  If the proof shows that
+// the TLF isn't in the tree, it returns nil.
+func verifyMerkleInclusionProof(codec kbfscodec.Codec, root MerkleRoot,
+	proof MerkleInclusionProof, id tlf.ID) (*MerkleLeaf, error) {
+	if treeID := merkleTreeIDForTlfType(id.Type()); root.TreeID != treeID {
+		return nil, errors.Errorf(
+			"Merkle root is for tree %d, expected %d", root.TreeID, treeID)
+	}
+	if len(root.Hash) == 0 {
+		// Empty tree.
+		return nil, nil
+	}
+
+	hasher := merkle.SHA512Hasher{}
+	nodes := make(map[string][]byte, len(proof))
+	for _, node := range proof {
+		nodes[hex.EncodeToString(hasher.Hash(node))] = node
+	}
+	tree := merkle.NewTree(
+		merkleProofEngine{root.Hash, nodes}, makeMerkleTreeConfig())
+	val, _, err := tree.Find(merkleKeyForTlfID(id))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if val == nil {
+		return nil, nil
+	}
+	encodedLeaf, ok := val.([]byte)
+	if !ok {
+		return nil, errors.Errorf("Unexpected Merkle leaf type %T", val)
+	}
+	if len(encodedLeaf) == 0 {
+		return nil, nil
+	}
+
+	var leaf MerkleLeaf
+	err = codec.Decode(encodedLeaf, &leaf)
+	if err != nil {
+		return nil, err
+	}
+	return &leaf, nil
+}
@@ -0,0 +1,97 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+// Test that inclusion proofs from a Merkle tree big enough to need
+// interior nodes verify, and that tampered proofs don't.
+func TestMerkleInclusionProof(t *testing.T) {
+	codec := kbfscodec.NewMsgpack()
+	trees, err := newMDServerLocalMerkleTrees(
+		codec, MakeCryptoCommon(codec), wallClock{},
+		storage.NewMemStorage())
+	require.NoError(t, err)
+	defer trees.shutdown()
+
+	// Fill the tree directly, since putHead needs real MD objects.
+	const numTlfs = 2 * merkleTreeMaxLeafEntries
+	ids := make([]tlf.ID, numTlfs)
+	for i := range ids {
+		ids[i], err = tlf.MakeRandomID(tlf.Private)
+		require.NoError(t, err)
+		encodedLeaf, err := codec.Encode(MerkleLeaf{
+			Revision: kbfsmd.Revision(1),
+		})
+		require.NoError(t, err)
+		err = trees.putLeafLocked(ids[i], encodedLeaf, 0)
+		require.NoError(t, err)
+	}
+
+	// Update every leaf.
+	for i, id := range ids {
+		encodedLeaf, err := codec.Encode(MerkleLeaf{
+			Revision: kbfsmd.Revision(i + 1),
+		})
+		require.NoError(t, err)
+		err = trees.putLeafLocked(id, encodedLeaf, 0)
+		require.NoError(t, err)
+	}
+
+	for i, id := range ids {
+		root, proof, err := trees.getProof(id)
+		require.NoError(t, err)
+		require.Equal(t, int64(2*numTlfs), root.SeqNo)
+		require.True(t, len(proof) > 1)
+		leaf, err := verifyMerkleInclusionProof(codec, *root, proof, id)
+		require.NoError(t, err)
+		require.NotNil(t, leaf)
+		require.Equal(t, kbfsmd.Revision(i+1), leaf.Revision)
+	}
+
+	// A TLF that isn't in the tree.
+	missingID, err := tlf.MakeRandomID(tlf.Private)
+	require.NoError(t, err)
+	root, proof, err := trees.getProof(missingID)
+	require.NoError(t, err)
+	leaf, err := verifyMerkleInclusionProof(codec, *root, proof, missingID)
+	require.NoError(t, err)
+	require.Nil(t, leaf)
+
+	// A proof for one TLF can at most vouch for the real leaf of
+	// another TLF that shares its leaf node.
+	root, proof, err = trees.getProof(ids[0])
+	require.NoError(t, err)
+	leaf, err = verifyMerkleInclusionProof(codec, *root, proof, ids[1])
+	if err == nil && leaf != nil {
+		require.Equal(t, kbfsmd.Revision(2), leaf.Revision)
+	}
+
+	// Missing and corrupted nodes.
+	_, err = verifyMerkleInclusionProof(
+		codec, *root, proof[:len(proof)-1], ids[0])
+	require.Error(t, err)
+	corruptProof := make(MerkleInclusionProof, len(proof))
+	copy(corruptProof, proof)
+	last := append([]byte(nil), proof[len(proof)-1]...)
+	last[len(last)-1] ^= 0xff
+	corruptProof[len(proof)-1] = last
+	_, err = verifyMerkleInclusionProof(codec, *root, corruptProof, ids[0])
+	require.Error(t, err)
+
+	// A root for the wrong tree.
+	publicRoot := *root
+	publicRoot.TreeID = merkleTreeIDForTlfType(tlf.Public)
+	_, err = verifyMerkleInclusionProof(codec, publicRoot, proof, ids[0])
+	require.Error(t, err)
+}
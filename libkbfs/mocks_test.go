@@ -15,6 +15,7 @@ import (
 	tlf "github.com/keybase/kbfs/tlf"
 	go_metrics "github.com/rcrowley/go-metrics"
 	context "golang.org/x/net/context"
+	os "os"
 	time "time"
 )
 
@@ -49,6 +50,47 @@ func (_mr *_MockdataVersionerRecorder) DataVersion() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "DataVersion")
 }
 
+// Mock of blockCryptVersioner interface
+type MockblockCryptVersioner struct {
+	ctrl     *gomock.Controller
+	recorder *_MockblockCryptVersionerRecorder
+}
+
+// Recorder for MockblockCryptVersioner (not exported)
+type _MockblockCryptVersionerRecorder struct {
+	mock *MockblockCryptVersioner
+}
+
+func NewMockblockCryptVersioner(ctrl *gomock.Controller) *MockblockCryptVersioner {
+	mock := &MockblockCryptVersioner{ctrl: ctrl}
+	mock.recorder = &_MockblockCryptVersionerRecorder{mock}
+	return mock
+}
+
+func (_m *MockblockCryptVersioner) EXPECT() *_MockblockCryptVersionerRecorder {
+	return _m.recorder
+}
+
+func (_m *MockblockCryptVersioner) BlockCryptVersion() EncryptionVer {
+	ret := _m.ctrl.Call(_m, "BlockCryptVersion")
+	ret0, _ := ret[0].(EncryptionVer)
+	return ret0
+}
+
+func (_mr *_MockblockCryptVersionerRecorder) BlockCryptVersion() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "BlockCryptVersion")
+}
+
+func (_m *MockblockCryptVersioner) BlockPadding() BlockPadding {
+	ret := _m.ctrl.Call(_m, "BlockPadding")
+	ret0, _ := ret[0].(BlockPadding)
+	return ret0
+}
+
+func (_mr *_MockblockCryptVersionerRecorder) BlockPadding() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "BlockPadding")
+}
+
 // Mock of logMaker interface
 type MocklogMaker struct {
 	ctrl     *gomock.Controller
@@ -388,6 +430,97 @@ func (_mr *_MockdiskBlockCacheSetterRecorder) SetDiskBlockCache(arg0 interface{}
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetDiskBlockCache", arg0)
 }
 
+// Mock of diskMDCacheGetter interface
+type MockdiskMDCacheGetter struct {
+	ctrl     *gomock.Controller
+	recorder *_MockdiskMDCacheGetterRecorder
+}
+
+// Recorder for MockdiskMDCacheGetter (not exported)
+type _MockdiskMDCacheGetterRecorder struct {
+	mock *MockdiskMDCacheGetter
+}
+
+func NewMockdiskMDCacheGetter(ctrl *gomock.Controller) *MockdiskMDCacheGetter {
+	mock := &MockdiskMDCacheGetter{ctrl: ctrl}
+	mock.recorder = &_MockdiskMDCacheGetterRecorder{mock}
+	return mock
+}
+
+func (_m *MockdiskMDCacheGetter) EXPECT() *_MockdiskMDCacheGetterRecorder {
+	return _m.recorder
+}
+
+func (_m *MockdiskMDCacheGetter) DiskMDCache() DiskMDCache {
+	ret := _m.ctrl.Call(_m, "DiskMDCache")
+	ret0, _ := ret[0].(DiskMDCache)
+	return ret0
+}
+
+func (_mr *_MockdiskMDCacheGetterRecorder) DiskMDCache() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "DiskMDCache")
+}
+
+// Mock of diskMDCacheSetter interface
+type MockdiskMDCacheSetter struct {
+	ctrl     *gomock.Controller
+	recorder *_MockdiskMDCacheSetterRecorder
+}
+
+// Recorder for MockdiskMDCacheSetter (not exported)
+type _MockdiskMDCacheSetterRecorder struct {
+	mock *MockdiskMDCacheSetter
+}
+
+func NewMockdiskMDCacheSetter(ctrl *gomock.Controller) *MockdiskMDCacheSetter {
+	mock := &MockdiskMDCacheSetter{ctrl: ctrl}
+	mock.recorder = &_MockdiskMDCacheSetterRecorder{mock}
+	return mock
+}
+
+func (_m *MockdiskMDCacheSetter) EXPECT() *_MockdiskMDCacheSetterRecorder {
+	return _m.recorder
+}
+
+func (_m *MockdiskMDCacheSetter) SetDiskMDCache(_param0 DiskMDCache) {
+	_m.ctrl.Call(_m, "SetDiskMDCache", _param0)
+}
+
+func (_mr *_MockdiskMDCacheSetterRecorder) SetDiskMDCache(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetDiskMDCache", arg0)
+}
+
+// Mock of spanExporterGetter interface
+type MockspanExporterGetter struct {
+	ctrl     *gomock.Controller
+	recorder *_MockspanExporterGetterRecorder
+}
+
+// Recorder for MockspanExporterGetter (not exported)
+type _MockspanExporterGetterRecorder struct {
+	mock *MockspanExporterGetter
+}
+
+func NewMockspanExporterGetter(ctrl *gomock.Controller) *MockspanExporterGetter {
+	mock := &MockspanExporterGetter{ctrl: ctrl}
+	mock.recorder = &_MockspanExporterGetterRecorder{mock}
+	return mock
+}
+
+func (_m *MockspanExporterGetter) EXPECT() *_MockspanExporterGetterRecorder {
+	return _m.recorder
+}
+
+func (_m *MockspanExporterGetter) SpanExporter() SpanExporter {
+	ret := _m.ctrl.Call(_m, "SpanExporter")
+	ret0, _ := ret[0].(SpanExporter)
+	return ret0
+}
+
+func (_mr *_MockspanExporterGetterRecorder) SpanExporter() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SpanExporter")
+}
+
 // Mock of clockGetter interface
 type MockclockGetter struct {
 	ctrl     *gomock.Controller
@@ -450,6 +583,37 @@ func (_mr *_MockdiskLimiterGetterRecorder) DiskLimiter() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "DiskLimiter")
 }
 
+// Mock of blockTransferControllersGetter interface
+type MockblockTransferControllersGetter struct {
+	ctrl     *gomock.Controller
+	recorder *_MockblockTransferControllersGetterRecorder
+}
+
+// Recorder for MockblockTransferControllersGetter (not exported)
+type _MockblockTransferControllersGetterRecorder struct {
+	mock *MockblockTransferControllersGetter
+}
+
+func NewMockblockTransferControllersGetter(ctrl *gomock.Controller) *MockblockTransferControllersGetter {
+	mock := &MockblockTransferControllersGetter{ctrl: ctrl}
+	mock.recorder = &_MockblockTransferControllersGetterRecorder{mock}
+	return mock
+}
+
+func (_m *MockblockTransferControllersGetter) EXPECT() *_MockblockTransferControllersGetterRecorder {
+	return _m.recorder
+}
+
+func (_m *MockblockTransferControllersGetter) BlockTransferControllers() *BlockTransferControllers {
+	ret := _m.ctrl.Call(_m, "BlockTransferControllers")
+	ret0, _ := ret[0].(*BlockTransferControllers)
+	return ret0
+}
+
+func (_mr *_MockblockTransferControllersGetterRecorder) BlockTransferControllers() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "BlockTransferControllers")
+}
+
 // Mock of Block interface
 type MockBlock struct {
 	ctrl     *gomock.Controller
@@ -609,6 +773,58 @@ func (_mr *_MockNodeRecorder) GetBasename() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetBasename")
 }
 
+// Mock of BulkFileWriter interface
+type MockBulkFileWriter struct {
+	ctrl     *gomock.Controller
+	recorder *_MockBulkFileWriterRecorder
+}
+
+// Recorder for MockBulkFileWriter (not exported)
+type _MockBulkFileWriterRecorder struct {
+	mock *MockBulkFileWriter
+}
+
+func NewMockBulkFileWriter(ctrl *gomock.Controller) *MockBulkFileWriter {
+	mock := &MockBulkFileWriter{ctrl: ctrl}
+	mock.recorder = &_MockBulkFileWriterRecorder{mock}
+	return mock
+}
+
+func (_m *MockBulkFileWriter) EXPECT() *_MockBulkFileWriterRecorder {
+	return _m.recorder
+}
+
+func (_m *MockBulkFileWriter) Write(ctx context.Context, data []byte) error {
+	ret := _m.ctrl.Call(_m, "Write", ctx, data)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockBulkFileWriterRecorder) Write(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Write", arg0, arg1)
+}
+
+func (_m *MockBulkFileWriter) Close(ctx context.Context) (EntryInfo, error) {
+	ret := _m.ctrl.Call(_m, "Close", ctx)
+	ret0, _ := ret[0].(EntryInfo)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockBulkFileWriterRecorder) Close(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Close", arg0)
+}
+
+func (_m *MockBulkFileWriter) Abort(ctx context.Context) error {
+	ret := _m.ctrl.Call(_m, "Abort", ctx)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockBulkFileWriterRecorder) Abort(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Abort", arg0)
+}
+
 // Mock of KBFSOps interface
 type MockKBFSOps struct {
 	ctrl     *gomock.Controller
@@ -785,6 +1001,39 @@ func (_mr *_MockKBFSOpsRecorder) CreateLink(arg0, arg1, arg2, arg3 interface{})
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "CreateLink", arg0, arg1, arg2, arg3)
 }
 
+func (_m *MockKBFSOps) CreateBulkFile(ctx context.Context, dir Node, name string, isExec bool) (BulkFileWriter, error) {
+	ret := _m.ctrl.Call(_m, "CreateBulkFile", ctx, dir, name, isExec)
+	ret0, _ := ret[0].(BulkFileWriter)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) CreateBulkFile(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "CreateBulkFile", arg0, arg1, arg2, arg3)
+}
+
+func (_m *MockKBFSOps) CopyFile(ctx context.Context, src Node, destDir Node, destName string) (EntryInfo, error) {
+	ret := _m.ctrl.Call(_m, "CopyFile", ctx, src, destDir, destName)
+	ret0, _ := ret[0].(EntryInfo)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) CopyFile(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "CopyFile", arg0, arg1, arg2, arg3)
+}
+
+func (_m *MockKBFSOps) CopyFileContents(ctx context.Context, src Node, dest Node) (EntryInfo, error) {
+	ret := _m.ctrl.Call(_m, "CopyFileContents", ctx, src, dest)
+	ret0, _ := ret[0].(EntryInfo)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) CopyFileContents(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "CopyFileContents", arg0, arg1, arg2)
+}
+
 func (_m *MockKBFSOps) RemoveDir(ctx context.Context, dir Node, dirName string) error {
 	ret := _m.ctrl.Call(_m, "RemoveDir", ctx, dir, dirName)
 	ret0, _ := ret[0].(error)
@@ -805,14 +1054,46 @@ func (_mr *_MockKBFSOpsRecorder) RemoveEntry(arg0, arg1, arg2 interface{}) *gomo
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "RemoveEntry", arg0, arg1, arg2)
 }
 
-func (_m *MockKBFSOps) Rename(ctx context.Context, oldParent Node, oldName string, newParent Node, newName string) error {
-	ret := _m.ctrl.Call(_m, "Rename", ctx, oldParent, oldName, newParent, newName)
+func (_m *MockKBFSOps) Rename(ctx context.Context, oldParent Node, oldName string, newParent Node, newName string, flags RenameFlags) error {
+	ret := _m.ctrl.Call(_m, "Rename", ctx, oldParent, oldName, newParent, newName, flags)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) Rename(arg0, arg1, arg2, arg3, arg4, arg5 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Rename", arg0, arg1, arg2, arg3, arg4, arg5)
+}
+
+func (_m *MockKBFSOps) TransferAcrossFolders(ctx context.Context, id string, src FolderPath, dest FolderPath, move bool) error {
+	ret := _m.ctrl.Call(_m, "TransferAcrossFolders", ctx, id, src, dest, move)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) TransferAcrossFolders(arg0, arg1, arg2, arg3, arg4 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "TransferAcrossFolders", arg0, arg1, arg2, arg3, arg4)
+}
+
+func (_m *MockKBFSOps) CrossFolderTransferStatus(id string) (CrossFolderTransferState, bool, error) {
+	ret := _m.ctrl.Call(_m, "CrossFolderTransferStatus", id)
+	ret0, _ := ret[0].(CrossFolderTransferState)
+	ret1, _ := ret[1].(bool)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+func (_mr *_MockKBFSOpsRecorder) CrossFolderTransferStatus(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "CrossFolderTransferStatus", arg0)
+}
+
+func (_m *MockKBFSOps) RollBackCrossFolderTransfer(ctx context.Context, id string) error {
+	ret := _m.ctrl.Call(_m, "RollBackCrossFolderTransfer", ctx, id)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
-func (_mr *_MockKBFSOpsRecorder) Rename(arg0, arg1, arg2, arg3, arg4 interface{}) *gomock.Call {
-	return _mr.mock.ctrl.RecordCall(_mr.mock, "Rename", arg0, arg1, arg2, arg3, arg4)
+func (_mr *_MockKBFSOpsRecorder) RollBackCrossFolderTransfer(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "RollBackCrossFolderTransfer", arg0, arg1)
 }
 
 func (_m *MockKBFSOps) Read(ctx context.Context, file Node, dest []byte, off int64) (int64, error) {
@@ -866,6 +1147,26 @@ func (_mr *_MockKBFSOpsRecorder) SetMtime(arg0, arg1, arg2 interface{}) *gomock.
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetMtime", arg0, arg1, arg2)
 }
 
+func (_m *MockKBFSOps) SetPerm(ctx context.Context, node Node, perm os.FileMode) error {
+	ret := _m.ctrl.Call(_m, "SetPerm", ctx, node, perm)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) SetPerm(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetPerm", arg0, arg1, arg2)
+}
+
+func (_m *MockKBFSOps) SetReadOnly(ctx context.Context, node Node, readOnly bool) error {
+	ret := _m.ctrl.Call(_m, "SetReadOnly", ctx, node, readOnly)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) SetReadOnly(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetReadOnly", arg0, arg1, arg2)
+}
+
 func (_m *MockKBFSOps) SyncAll(ctx context.Context, folderBranch FolderBranch) error {
 	ret := _m.ctrl.Call(_m, "SyncAll", ctx, folderBranch)
 	ret0, _ := ret[0].(error)
@@ -876,6 +1177,36 @@ func (_mr *_MockKBFSOpsRecorder) SyncAll(arg0, arg1 interface{}) *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "SyncAll", arg0, arg1)
 }
 
+func (_m *MockKBFSOps) BeginTransaction(ctx context.Context, folderBranch FolderBranch) error {
+	ret := _m.ctrl.Call(_m, "BeginTransaction", ctx, folderBranch)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) BeginTransaction(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "BeginTransaction", arg0, arg1)
+}
+
+func (_m *MockKBFSOps) CommitTransaction(ctx context.Context, folderBranch FolderBranch) error {
+	ret := _m.ctrl.Call(_m, "CommitTransaction", ctx, folderBranch)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) CommitTransaction(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "CommitTransaction", arg0, arg1)
+}
+
+func (_m *MockKBFSOps) AbortTransaction(ctx context.Context, folderBranch FolderBranch) error {
+	ret := _m.ctrl.Call(_m, "AbortTransaction", ctx, folderBranch)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) AbortTransaction(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "AbortTransaction", arg0, arg1)
+}
+
 func (_m *MockKBFSOps) FolderStatus(ctx context.Context, folderBranch FolderBranch) (FolderBranchStatus, <-chan StatusUpdate, error) {
 	ret := _m.ctrl.Call(_m, "FolderStatus", ctx, folderBranch)
 	ret0, _ := ret[0].(FolderBranchStatus)
@@ -939,6 +1270,17 @@ func (_mr *_MockKBFSOpsRecorder) GetUpdateHistory(arg0, arg1 interface{}) *gomoc
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetUpdateHistory", arg0, arg1)
 }
 
+func (_m *MockKBFSOps) GetUpdateHistoryPage(ctx context.Context, folderBranch FolderBranch, cursor kbfsmd.Revision, limit int, filter UpdateHistoryFilter) (UpdateHistoryPage, error) {
+	ret := _m.ctrl.Call(_m, "GetUpdateHistoryPage", ctx, folderBranch, cursor, limit, filter)
+	ret0, _ := ret[0].(UpdateHistoryPage)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) GetUpdateHistoryPage(arg0, arg1, arg2, arg3, arg4 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetUpdateHistoryPage", arg0, arg1, arg2, arg3, arg4)
+}
+
 func (_m *MockKBFSOps) GetEditHistory(ctx context.Context, folderBranch FolderBranch) (TlfWriterEdits, error) {
 	ret := _m.ctrl.Call(_m, "GetEditHistory", ctx, folderBranch)
 	ret0, _ := ret[0].(TlfWriterEdits)
@@ -950,6 +1292,58 @@ func (_mr *_MockKBFSOpsRecorder) GetEditHistory(arg0, arg1 interface{}) *gomock.
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetEditHistory", arg0, arg1)
 }
 
+func (_m *MockKBFSOps) GetDirUsage(ctx context.Context, dir Node) (DirUsage, error) {
+	ret := _m.ctrl.Call(_m, "GetDirUsage", ctx, dir)
+	ret0, _ := ret[0].(DirUsage)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) GetDirUsage(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetDirUsage", arg0, arg1)
+}
+
+func (_m *MockKBFSOps) FindEntries(ctx context.Context, folderBranch FolderBranch, query SearchQuery) ([]SearchResult, error) {
+	ret := _m.ctrl.Call(_m, "FindEntries", ctx, folderBranch, query)
+	ret0, _ := ret[0].([]SearchResult)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockKBFSOpsRecorder) FindEntries(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "FindEntries", arg0, arg1, arg2)
+}
+
+func (_m *MockKBFSOps) SetBackgroundReencryption(ctx context.Context, folderBranch FolderBranch, enabled bool) error {
+	ret := _m.ctrl.Call(_m, "SetBackgroundReencryption", ctx, folderBranch, enabled)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) SetBackgroundReencryption(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetBackgroundReencryption", arg0, arg1, arg2)
+}
+
+func (_m *MockKBFSOps) MakeImmutable(ctx context.Context, folderBranch FolderBranch) error {
+	ret := _m.ctrl.Call(_m, "MakeImmutable", ctx, folderBranch)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) MakeImmutable(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "MakeImmutable", arg0, arg1)
+}
+
+func (_m *MockKBFSOps) SetRetentionPolicy(ctx context.Context, folderBranch FolderBranch, policy *RetentionPolicy) error {
+	ret := _m.ctrl.Call(_m, "SetRetentionPolicy", ctx, folderBranch, policy)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockKBFSOpsRecorder) SetRetentionPolicy(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetRetentionPolicy", arg0, arg1, arg2)
+}
+
 func (_m *MockKBFSOps) GetNodeMetadata(ctx context.Context, node Node) (NodeMetadata, error) {
 	ret := _m.ctrl.Call(_m, "GetNodeMetadata", ctx, node)
 	ret0, _ := ret[0].(NodeMetadata)
@@ -2538,6 +2932,110 @@ func (_mr *_MockDiskBlockCacheRecorder) Shutdown(arg0 interface{}) *gomock.Call
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Shutdown", arg0)
 }
 
+// Mock of DiskMDCache interface
+type MockDiskMDCache struct {
+	ctrl     *gomock.Controller
+	recorder *_MockDiskMDCacheRecorder
+}
+
+// Recorder for MockDiskMDCache (not exported)
+type _MockDiskMDCacheRecorder struct {
+	mock *MockDiskMDCache
+}
+
+func NewMockDiskMDCache(ctrl *gomock.Controller) *MockDiskMDCache {
+	mock := &MockDiskMDCache{ctrl: ctrl}
+	mock.recorder = &_MockDiskMDCacheRecorder{mock}
+	return mock
+}
+
+func (_m *MockDiskMDCache) EXPECT() *_MockDiskMDCacheRecorder {
+	return _m.recorder
+}
+
+func (_m *MockDiskMDCache) GetHead(ctx context.Context, tlfID tlf.ID) (ImmutableBareRootMetadata, kbfscrypto.VerifyingKey, error) {
+	ret := _m.ctrl.Call(_m, "GetHead", ctx, tlfID)
+	ret0, _ := ret[0].(ImmutableBareRootMetadata)
+	ret1, _ := ret[1].(kbfscrypto.VerifyingKey)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+func (_mr *_MockDiskMDCacheRecorder) GetHead(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetHead", arg0, arg1)
+}
+
+func (_m *MockDiskMDCache) GetTlfID(ctx context.Context, handle *TlfHandle) (tlf.ID, bool, error) {
+	ret := _m.ctrl.Call(_m, "GetTlfID", ctx, handle)
+	ret0, _ := ret[0].(tlf.ID)
+	ret1, _ := ret[1].(bool)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+func (_mr *_MockDiskMDCacheRecorder) GetTlfID(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetTlfID", arg0, arg1)
+}
+
+func (_m *MockDiskMDCache) PutHead(ctx context.Context, irmd ImmutableRootMetadata) error {
+	ret := _m.ctrl.Call(_m, "PutHead", ctx, irmd)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockDiskMDCacheRecorder) PutHead(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "PutHead", arg0, arg1)
+}
+
+func (_m *MockDiskMDCache) GetTLFCryptKey(ctx context.Context, tlfID tlf.ID, keyGen KeyGen) (kbfscrypto.TLFCryptKey, error) {
+	ret := _m.ctrl.Call(_m, "GetTLFCryptKey", ctx, tlfID, keyGen)
+	ret0, _ := ret[0].(kbfscrypto.TLFCryptKey)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockDiskMDCacheRecorder) GetTLFCryptKey(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetTLFCryptKey", arg0, arg1, arg2)
+}
+
+func (_m *MockDiskMDCache) PutTLFCryptKey(ctx context.Context, tlfID tlf.ID, keyGen KeyGen, key kbfscrypto.TLFCryptKey) error {
+	ret := _m.ctrl.Call(_m, "PutTLFCryptKey", ctx, tlfID, keyGen, key)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockDiskMDCacheRecorder) PutTLFCryptKey(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "PutTLFCryptKey", arg0, arg1, arg2, arg3)
+}
+
+func (_m *MockDiskMDCache) DeleteTLFCryptKeys(ctx context.Context, tlfID tlf.ID) error {
+	ret := _m.ctrl.Call(_m, "DeleteTLFCryptKeys", ctx, tlfID)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockDiskMDCacheRecorder) DeleteTLFCryptKeys(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "DeleteTLFCryptKeys", arg0, arg1)
+}
+
+func (_m *MockDiskMDCache) DeleteAllTLFCryptKeys(ctx context.Context) error {
+	ret := _m.ctrl.Call(_m, "DeleteAllTLFCryptKeys", ctx)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockDiskMDCacheRecorder) DeleteAllTLFCryptKeys(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "DeleteAllTLFCryptKeys", arg0)
+}
+
+func (_m *MockDiskMDCache) Shutdown(ctx context.Context) {
+	_m.ctrl.Call(_m, "Shutdown", ctx)
+}
+
+func (_mr *_MockDiskMDCacheRecorder) Shutdown(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Shutdown", arg0)
+}
+
 // Mock of cryptoPure interface
 type MockcryptoPure struct {
 	ctrl     *gomock.Controller
@@ -2706,14 +3204,26 @@ func (_mr *_MockcryptoPureRecorder) EncryptBlock(arg0, arg1 interface{}) *gomock
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "EncryptBlock", arg0, arg1)
 }
 
-func (_m *MockcryptoPure) DecryptBlock(encryptedBlock EncryptedBlock, key kbfscrypto.BlockCryptKey, block Block) error {
-	ret := _m.ctrl.Call(_m, "DecryptBlock", encryptedBlock, key, block)
+func (_m *MockcryptoPure) EncryptBlockAEAD(block Block, tlfID tlf.ID, key kbfscrypto.BlockCryptKey, padding BlockPadding) (int, EncryptedBlock, error) {
+	ret := _m.ctrl.Call(_m, "EncryptBlockAEAD", block, tlfID, key, padding)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(EncryptedBlock)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+func (_mr *_MockcryptoPureRecorder) EncryptBlockAEAD(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "EncryptBlockAEAD", arg0, arg1, arg2, arg3)
+}
+
+func (_m *MockcryptoPure) DecryptBlock(encryptedBlock EncryptedBlock, tlfID tlf.ID, key kbfscrypto.BlockCryptKey, block Block) error {
+	ret := _m.ctrl.Call(_m, "DecryptBlock", encryptedBlock, tlfID, key, block)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
-func (_mr *_MockcryptoPureRecorder) DecryptBlock(arg0, arg1, arg2 interface{}) *gomock.Call {
-	return _mr.mock.ctrl.RecordCall(_mr.mock, "DecryptBlock", arg0, arg1, arg2)
+func (_mr *_MockcryptoPureRecorder) DecryptBlock(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "DecryptBlock", arg0, arg1, arg2, arg3)
 }
 
 func (_m *MockcryptoPure) GetTLFCryptKeyServerHalfID(user keybase1.UID, devicePubKey kbfscrypto.CryptPublicKey, serverHalf kbfscrypto.TLFCryptKeyServerHalf) (TLFCryptKeyServerHalfID, error) {
@@ -2971,14 +3481,26 @@ func (_mr *_MockCryptoRecorder) EncryptBlock(arg0, arg1 interface{}) *gomock.Cal
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "EncryptBlock", arg0, arg1)
 }
 
-func (_m *MockCrypto) DecryptBlock(encryptedBlock EncryptedBlock, key kbfscrypto.BlockCryptKey, block Block) error {
-	ret := _m.ctrl.Call(_m, "DecryptBlock", encryptedBlock, key, block)
+func (_m *MockCrypto) EncryptBlockAEAD(block Block, tlfID tlf.ID, key kbfscrypto.BlockCryptKey, padding BlockPadding) (int, EncryptedBlock, error) {
+	ret := _m.ctrl.Call(_m, "EncryptBlockAEAD", block, tlfID, key, padding)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(EncryptedBlock)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+func (_mr *_MockCryptoRecorder) EncryptBlockAEAD(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "EncryptBlockAEAD", arg0, arg1, arg2, arg3)
+}
+
+func (_m *MockCrypto) DecryptBlock(encryptedBlock EncryptedBlock, tlfID tlf.ID, key kbfscrypto.BlockCryptKey, block Block) error {
+	ret := _m.ctrl.Call(_m, "DecryptBlock", encryptedBlock, tlfID, key, block)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
-func (_mr *_MockCryptoRecorder) DecryptBlock(arg0, arg1, arg2 interface{}) *gomock.Call {
-	return _mr.mock.ctrl.RecordCall(_mr.mock, "DecryptBlock", arg0, arg1, arg2)
+func (_mr *_MockCryptoRecorder) DecryptBlock(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "DecryptBlock", arg0, arg1, arg2, arg3)
 }
 
 func (_m *MockCrypto) GetTLFCryptKeyServerHalfID(user keybase1.UID, devicePubKey kbfscrypto.CryptPublicKey, serverHalf kbfscrypto.TLFCryptKeyServerHalf) (TLFCryptKeyServerHalfID, error) {
@@ -3701,6 +4223,18 @@ func (_mr *_MockMDServerRecorder) GetKeyBundles(arg0, arg1, arg2, arg3 interface
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetKeyBundles", arg0, arg1, arg2, arg3)
 }
 
+func (_m *MockMDServer) GetMerkleProof(ctx context.Context, id tlf.ID) (*MerkleRoot, MerkleInclusionProof, error) {
+	ret := _m.ctrl.Call(_m, "GetMerkleProof", ctx, id)
+	ret0, _ := ret[0].(*MerkleRoot)
+	ret1, _ := ret[1].(MerkleInclusionProof)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+func (_mr *_MockMDServerRecorder) GetMerkleProof(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetMerkleProof", arg0, arg1)
+}
+
 func (_m *MockMDServer) CheckReachability(ctx context.Context) {
 	_m.ctrl.Call(_m, "CheckReachability", ctx)
 }
@@ -3911,6 +4445,18 @@ func (_mr *_MockmdServerLocalRecorder) GetKeyBundles(arg0, arg1, arg2, arg3 inte
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetKeyBundles", arg0, arg1, arg2, arg3)
 }
 
+func (_m *MockmdServerLocal) GetMerkleProof(ctx context.Context, id tlf.ID) (*MerkleRoot, MerkleInclusionProof, error) {
+	ret := _m.ctrl.Call(_m, "GetMerkleProof", ctx, id)
+	ret0, _ := ret[0].(*MerkleRoot)
+	ret1, _ := ret[1].(MerkleInclusionProof)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+func (_mr *_MockmdServerLocalRecorder) GetMerkleProof(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "GetMerkleProof", arg0, arg1)
+}
+
 func (_m *MockmdServerLocal) CheckReachability(ctx context.Context) {
 	_m.ctrl.Call(_m, "CheckReachability", ctx)
 }
@@ -4245,6 +4791,17 @@ func (_mr *_MockblockServerLocalRecorder) getAllRefsForTest(arg0, arg1 interface
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "getAllRefsForTest", arg0, arg1)
 }
 
+func (_m *MockblockServerLocal) getRefs(ctx context.Context, tlfID tlf.ID, id kbfsblock.ID) (blockRefMap, error) {
+	ret := _m.ctrl.Call(_m, "getRefs", ctx, tlfID, id)
+	ret0, _ := ret[0].(blockRefMap)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockblockServerLocalRecorder) getRefs(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "getRefs", arg0, arg1, arg2)
+}
+
 // Mock of BlockSplitter interface
 type MockBlockSplitter struct {
 	ctrl     *gomock.Controller
@@ -4554,6 +5111,16 @@ func (_mr *_MockTracerRecorder) MaybeFinishTrace(arg0, arg1 interface{}) *gomock
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "MaybeFinishTrace", arg0, arg1)
 }
 
+func (_m *MockTracer) SpanExporter() SpanExporter {
+	ret := _m.ctrl.Call(_m, "SpanExporter")
+	ret0, _ := ret[0].(SpanExporter)
+	return ret0
+}
+
+func (_mr *_MockTracerRecorder) SpanExporter() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SpanExporter")
+}
+
 // Mock of Config interface
 type MockConfig struct {
 	ctrl     *gomock.Controller
@@ -4585,6 +5152,26 @@ func (_mr *_MockConfigRecorder) DataVersion() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "DataVersion")
 }
 
+func (_m *MockConfig) BlockCryptVersion() EncryptionVer {
+	ret := _m.ctrl.Call(_m, "BlockCryptVersion")
+	ret0, _ := ret[0].(EncryptionVer)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) BlockCryptVersion() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "BlockCryptVersion")
+}
+
+func (_m *MockConfig) BlockPadding() BlockPadding {
+	ret := _m.ctrl.Call(_m, "BlockPadding")
+	ret0, _ := ret[0].(BlockPadding)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) BlockPadding() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "BlockPadding")
+}
+
 func (_m *MockConfig) MakeLogger(module string) logger.Logger {
 	ret := _m.ctrl.Call(_m, "MakeLogger", module)
 	ret0, _ := ret[0].(logger.Logger)
@@ -4693,6 +5280,24 @@ func (_mr *_MockConfigRecorder) SetDiskBlockCache(arg0 interface{}) *gomock.Call
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetDiskBlockCache", arg0)
 }
 
+func (_m *MockConfig) DiskMDCache() DiskMDCache {
+	ret := _m.ctrl.Call(_m, "DiskMDCache")
+	ret0, _ := ret[0].(DiskMDCache)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) DiskMDCache() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "DiskMDCache")
+}
+
+func (_m *MockConfig) SetDiskMDCache(_param0 DiskMDCache) {
+	_m.ctrl.Call(_m, "SetDiskMDCache", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetDiskMDCache(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetDiskMDCache", arg0)
+}
+
 func (_m *MockConfig) Clock() Clock {
 	ret := _m.ctrl.Call(_m, "Clock")
 	ret0, _ := ret[0].(Clock)
@@ -4713,6 +5318,16 @@ func (_mr *_MockConfigRecorder) DiskLimiter() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "DiskLimiter")
 }
 
+func (_m *MockConfig) BlockTransferControllers() *BlockTransferControllers {
+	ret := _m.ctrl.Call(_m, "BlockTransferControllers")
+	ret0, _ := ret[0].(*BlockTransferControllers)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) BlockTransferControllers() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "BlockTransferControllers")
+}
+
 func (_m *MockConfig) MaybeStartTrace(ctx context.Context, family string, title string) context.Context {
 	ret := _m.ctrl.Call(_m, "MaybeStartTrace", ctx, family, title)
 	ret0, _ := ret[0].(context.Context)
@@ -4731,6 +5346,16 @@ func (_mr *_MockConfigRecorder) MaybeFinishTrace(arg0, arg1 interface{}) *gomock
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "MaybeFinishTrace", arg0, arg1)
 }
 
+func (_m *MockConfig) SpanExporter() SpanExporter {
+	ret := _m.ctrl.Call(_m, "SpanExporter")
+	ret0, _ := ret[0].(SpanExporter)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) SpanExporter() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SpanExporter")
+}
+
 func (_m *MockConfig) KBFSOps() KBFSOps {
 	ret := _m.ctrl.Call(_m, "KBFSOps")
 	ret0, _ := ret[0].(KBFSOps)
@@ -5095,6 +5720,40 @@ func (_mr *_MockConfigRecorder) SetMetadataVersion(arg0 interface{}) *gomock.Cal
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetMetadataVersion", arg0)
 }
 
+func (_m *MockConfig) OpsVersion() OpsVer {
+	ret := _m.ctrl.Call(_m, "OpsVersion")
+	ret0, _ := ret[0].(OpsVer)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) OpsVersion() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "OpsVersion")
+}
+
+func (_m *MockConfig) SetOpsVersion(_param0 OpsVer) {
+	_m.ctrl.Call(_m, "SetOpsVersion", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetOpsVersion(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetOpsVersion", arg0)
+}
+
+func (_m *MockConfig) SetBlockCryptVersion(_param0 EncryptionVer) {
+	_m.ctrl.Call(_m, "SetBlockCryptVersion", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetBlockCryptVersion(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetBlockCryptVersion", arg0)
+}
+
+func (_m *MockConfig) SetBlockPadding(_param0 BlockPadding) {
+	_m.ctrl.Call(_m, "SetBlockPadding", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetBlockPadding(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetBlockPadding", arg0)
+}
+
 func (_m *MockConfig) RekeyQueue() RekeyQueue {
 	ret := _m.ctrl.Call(_m, "RekeyQueue")
 	ret0, _ := ret[0].(RekeyQueue)
@@ -5237,6 +5896,32 @@ func (_mr *_MockConfigRecorder) QuotaReclamationMinHeadAge() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "QuotaReclamationMinHeadAge")
 }
 
+func (_m *MockConfig) RetentionPolicies() *RetentionPolicies {
+	ret := _m.ctrl.Call(_m, "RetentionPolicies")
+	ret0, _ := ret[0].(*RetentionPolicies)
+	return ret0
+}
+
+func (_mr *_MockConfigRecorder) RetentionPolicies() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "RetentionPolicies")
+}
+
+func (_m *MockConfig) SetRetentionPolicies(_param0 *RetentionPolicies) {
+	_m.ctrl.Call(_m, "SetRetentionPolicies", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetRetentionPolicies(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetRetentionPolicies", arg0)
+}
+
+func (_m *MockConfig) SetBlockTransferControllers(_param0 *BlockTransferControllers) {
+	_m.ctrl.Call(_m, "SetBlockTransferControllers", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetBlockTransferControllers(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetBlockTransferControllers", arg0)
+}
+
 func (_m *MockConfig) ResetCaches() {
 	_m.ctrl.Call(_m, "ResetCaches")
 }
@@ -5281,6 +5966,14 @@ func (_mr *_MockConfigRecorder) SetTraceOptions(arg0 interface{}) *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetTraceOptions", arg0)
 }
 
+func (_m *MockConfig) SetSpanExporter(_param0 SpanExporter) {
+	_m.ctrl.Call(_m, "SetSpanExporter", _param0)
+}
+
+func (_mr *_MockConfigRecorder) SetSpanExporter(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetSpanExporter", arg0)
+}
+
 func (_m *MockConfig) TLFValidDuration() time.Duration {
 	ret := _m.ctrl.Call(_m, "TLFValidDuration")
 	ret0, _ := ret[0].(time.Duration)
@@ -5933,6 +6626,16 @@ func (_mr *_MockBareRootMetadataRecorder) IsUnmergedSet() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "IsUnmergedSet")
 }
 
+func (_m *MockBareRootMetadata) IsImmutableSet() bool {
+	ret := _m.ctrl.Call(_m, "IsImmutableSet")
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+func (_mr *_MockBareRootMetadataRecorder) IsImmutableSet() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "IsImmutableSet")
+}
+
 func (_m *MockBareRootMetadata) GetSerializedPrivateMetadata() []byte {
 	ret := _m.ctrl.Call(_m, "GetSerializedPrivateMetadata")
 	ret0, _ := ret[0].([]byte)
@@ -6381,6 +7084,16 @@ func (_mr *_MockMutableBareRootMetadataRecorder) IsUnmergedSet() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "IsUnmergedSet")
 }
 
+func (_m *MockMutableBareRootMetadata) IsImmutableSet() bool {
+	ret := _m.ctrl.Call(_m, "IsImmutableSet")
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+func (_mr *_MockMutableBareRootMetadataRecorder) IsImmutableSet() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "IsImmutableSet")
+}
+
 func (_m *MockMutableBareRootMetadata) GetSerializedPrivateMetadata() []byte {
 	ret := _m.ctrl.Call(_m, "GetSerializedPrivateMetadata")
 	ret0, _ := ret[0].([]byte)
@@ -6586,6 +7299,14 @@ func (_mr *_MockMutableBareRootMetadataRecorder) SetUnmerged() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetUnmerged")
 }
 
+func (_m *MockMutableBareRootMetadata) SetImmutable() {
+	_m.ctrl.Call(_m, "SetImmutable")
+}
+
+func (_mr *_MockMutableBareRootMetadataRecorder) SetImmutable() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetImmutable")
+}
+
 func (_m *MockMutableBareRootMetadata) SetBranchID(bid BranchID) {
 	_m.ctrl.Call(_m, "SetBranchID", bid)
 }
@@ -580,7 +580,9 @@ func (ro *rmOp) getDefaultAction(mergedPath path) crAction {
 // directory, NewDir will be equivalent to blockUpdate{}.  renameOp
 // records the moved pointer, even though it doesn't change as part of
 // the operation, to make it possible to track the full path of
-// directories for the purposes of conflict resolution.
+// directories for the purposes of conflict resolution.  For an
+// exchange, Exchanged records the pointer of the entry that moved
+// from the new name to the old name.
 type renameOp struct {
 	OpCommon
 	OldName     string       `codec:"on"`
@@ -589,6 +591,10 @@ type renameOp struct {
 	NewDir      blockUpdate  `codec:"nd"`
 	Renamed     BlockPointer `codec:"re"`
 	RenamedType EntryType    `codec:"rt"`
+
+	Flags         RenameFlags  `codec:"f,omitempty"`
+	Exchanged     BlockPointer `codec:"ex,omitempty"`
+	ExchangedType EntryType    `codec:"et,omitempty"`
 }
 
 func newRenameOp(oldName string, oldOldDir BlockPointer,
@@ -674,7 +680,15 @@ func (ro *renameOp) checkValid() error {
 	return ro.checkUpdatesValid()
 }
 
+func (ro *renameOp) isExchange() bool {
+	return ro.Flags == RenameExchange
+}
+
 func (ro *renameOp) String() string {
+	if ro.isExchange() {
+		return fmt.Sprintf("exchange %s (%s) <-> %s (%s)",
+			ro.OldName, ro.RenamedType, ro.NewName, ro.ExchangedType)
+	}
 	return fmt.Sprintf("rename %s -> %s (%s)",
 		ro.OldName, ro.NewName, ro.RenamedType)
 }
@@ -691,14 +705,83 @@ func (ro *renameOp) StringWithRefs(numRefIndents int) string {
 		res += indent + fmt.Sprintf("NewDir: same as above\n")
 	}
 	res += indent + fmt.Sprintf("Renamed: %v\n", ro.Renamed)
+	if ro.isExchange() {
+		res += indent + fmt.Sprintf("Exchanged: %v\n", ro.Exchanged)
+	}
 	res += ro.stringWithRefs(numRefIndents)
 	return res
 }
 
+// newDirUpdate returns the update for the directory containing the
+// new name, which is OldDir for a rename within the same directory.
+func (ro *renameOp) newDirUpdate() blockUpdate {
+	if ro.NewDir == (blockUpdate{}) {
+		return ro.OldDir
+	}
+	return ro.NewDir
+}
+
+// createOps returns the create ops that this rename is split into
+// for the purposes of conflict resolution: one for the renamed node
+// under its new name and, for an exchange, one for the exchanged
+// node under the old name.
+func (ro *renameOp) createOps() ([]*createOp, error) {
+	nd := ro.newDirUpdate()
+	co, err := newCreateOp(ro.NewName, nd.Unref, ro.RenamedType)
+	if err != nil {
+		return nil, err
+	}
+	co.setWriterInfo(ro.getWriterInfo())
+	co.setLocalTimestamp(ro.getLocalTimestamp())
+	co.renamed = true
+	// nd.Ref may be zero if this is a post-resolution chain, so set
+	// co.Dir.Ref manually.
+	co.Dir.Ref = nd.Ref
+	if !ro.isExchange() {
+		return []*createOp{co}, nil
+	}
+
+	eco, err := newCreateOp(ro.OldName, ro.OldDir.Unref, ro.ExchangedType)
+	if err != nil {
+		return nil, err
+	}
+	eco.setWriterInfo(ro.getWriterInfo())
+	eco.setLocalTimestamp(ro.getLocalTimestamp())
+	eco.renamed = true
+	eco.Dir.Ref = ro.OldDir.Ref
+	return []*createOp{co, eco}, nil
+}
+
 func (ro *renameOp) checkConflict(
 	ctx context.Context, renamer ConflictRenamer, mergedOp op,
 	isFile bool) (crAction, error) {
-	return nil, fmt.Errorf("Unexpected conflict check on a rename op: %s", ro)
+	// A rename conflicts wherever one of the create ops it splits
+	// into would.  Those are all marked as renamed, so a
+	// conflicting entry in the merged branch is never replaced;
+	// instead, the unmerged entry gets a conflict name.  That keeps
+	// the no-replace guarantee, and for an exchange it means both
+	// swapped entries survive even if the merged branch created a
+	// new entry under one of the names.
+	cos, err := ro.createOps()
+	if err != nil {
+		return nil, err
+	}
+	if ro.NewDir != (blockUpdate{}) {
+		// An unsplit rename lives only in the chain of its new
+		// directory, so the old name can't conflict with any
+		// merged op checked against it.
+		cos = cos[:1]
+	}
+	for _, co := range cos {
+		action, err := co.checkConflict(ctx, renamer, mergedOp, isFile)
+		if err != nil {
+			return nil, err
+		}
+		if action != nil {
+			return action, nil
+		}
+	}
+	return nil, nil
 }
 
 func (ro *renameOp) getDefaultAction(mergedPath path) crAction {
@@ -1022,6 +1105,7 @@ const (
 	exAttr attrChange = iota
 	mtimeAttr
 	sizeAttr // only used during conflict resolution
+	modeAttr
 )
 
 func (ac attrChange) String() string {
@@ -1032,6 +1116,8 @@ func (ac attrChange) String() string {
 		return "mtime"
 	case sizeAttr:
 		return "size"
+	case modeAttr:
+		return "mode"
 	}
 	return "<invalid attrChange>"
 }
@@ -1125,6 +1211,17 @@ func (sao *setAttrOp) checkConflict(
 	isFile bool) (crAction, error) {
 	switch realMergedOp := mergedOp.(type) {
 	case *setAttrOp:
+		if realMergedOp.Attr == modeAttr && sao.Attr == modeAttr {
+			// Concurrent mode changes never need a conflict copy;
+			// they are combined so that the result is no more
+			// permissive than either of them.
+			return &copyUnmergedAttrAction{
+				fromName:   sao.getFinalPath().tailName(),
+				toName:     mergedOp.getFinalPath().tailName(),
+				attr:       []attrChange{modeAttr},
+				mergeModes: true,
+			}, nil
+		}
 		if realMergedOp.Attr == sao.Attr {
 			var symPath string
 			var causedByAttr attrChange
@@ -1357,11 +1454,16 @@ func invertOpForLocalNotifications(oldOp op) (newOp op, err error) {
 		if op.NewDir == (blockUpdate{}) {
 			newDirRef = op.OldDir.Ref
 		}
-		newOp, err = newRenameOp(op.NewName, newDirRef,
+		rop, err := newRenameOp(op.NewName, newDirRef,
 			op.OldName, op.OldDir.Ref, op.Renamed, op.RenamedType)
 		if err != nil {
 			return nil, err
 		}
+		// Exchanging the same entries again undoes an exchange.
+		rop.Flags = op.Flags
+		rop.Exchanged = op.Exchanged
+		rop.ExchangedType = op.ExchangedType
+		newOp = rop
 	case *syncOp:
 		// Just replay the writes; for notifications purposes, they
 		// will do the right job of marking the right bytes as
@@ -305,6 +305,9 @@ func makeFakeRenameOpFuture(t *testing.T) renameOpFuture {
 			makeFakeBlockUpdate(t),
 			makeFakeBlockPointer(t),
 			Exec,
+			RenameExchange,
+			makeFakeBlockPointer(t),
+			File,
 		},
 		kbfscodec.MakeExtraOrBust("renameOp", t),
 	}
@@ -133,13 +133,32 @@ func (p *blockPrefetcher) request(priority int, kmd KeyMetadata,
 
 func (p *blockPrefetcher) prefetchIndirectFileBlock(b *FileBlock,
 	kmd KeyMetadata) {
-	// Prefetch indirect block pointers.
-	p.log.CDebugf(context.TODO(), "Prefetching pointers for indirect file "+
-		"block. Num pointers to prefetch: %d", len(b.IPtrs))
+	// Prefetch only the child pointers that are themselves indirect
+	// blocks.  Data blocks are left to the adaptive read-ahead in
+	// folderBlockOps, so random reads don't pull in the whole file.
+	numIndirect := 0
 	for _, ptr := range b.IPtrs {
+		switch ptr.DirectType {
+		case IndirectBlock:
+		case DirectBlock, UnknownDirectType:
+			// Like `fileData.getBlocksForOffsetRange`, assume an
+			// unlabeled pointer is to a data block, since there
+			// weren't multiple levels of indirection before the
+			// label was introduced.  Read-ahead finds these
+			// through the same function.
+			continue
+		default:
+			p.log.CDebugf(context.TODO(), "Not prefetching %v with "+
+				"unexpected direct type %s", ptr.BlockPointer,
+				ptr.DirectType)
+			continue
+		}
+		numIndirect++
 		p.request(fileIndirectBlockPrefetchPriority, kmd, ptr.BlockPointer,
 			b.NewEmpty(), "")
 	}
+	p.log.CDebugf(context.TODO(), "Prefetched pointers for indirect file "+
+		"block. Num pointers prefetched: %d of %d", numIndirect, len(b.IPtrs))
 }
 
 func (p *blockPrefetcher) prefetchIndirectDirBlock(b *DirBlock,
@@ -28,6 +28,7 @@ func makeRandomDirEntry(t *testing.T, typ EntryType, size uint64, path string) D
 			path,
 			101,
 			102,
+			0,
 		},
 		codec.UnknownFieldSetHandler{},
 	}
@@ -91,20 +92,30 @@ func TestPrefetcherIndirectFileBlock(t *testing.T) {
 	q, bg, config := initPrefetcherTest(t)
 	defer shutdownPrefetcherTest(q)
 
-	t.Log("Initialize an indirect file block pointing to 2 file data blocks.")
+	t.Log("Initialize an indirect file block pointing to another indirect " +
+		"block, to a file data block, and to an unlabeled block from " +
+		"before direct types were recorded.")
 	ptrs := []IndirectFilePtr{
 		makeFakeIndirectFilePtr(t, 0),
 		makeFakeIndirectFilePtr(t, 150),
+		makeFakeIndirectFilePtr(t, 300),
 	}
+	ptrs[0].DirectType = IndirectBlock
+	ptrs[1].DirectType = DirectBlock
+	ptrs[2].DirectType = UnknownDirectType
 	ptr1 := makeRandomBlockPointer(t)
 	block1 := &FileBlock{IPtrs: ptrs}
 	block1.IsInd = true
-	block2 := makeFakeFileBlock(t, true)
+	block2 := &FileBlock{IPtrs: []IndirectFilePtr{
+		makeFakeIndirectFilePtr(t, 0),
+	}}
+	block2.IsInd = true
 	block3 := makeFakeFileBlock(t, true)
 
 	_, continueCh1 := bg.setBlockToReturn(ptr1, block1)
 	_, continueCh2 := bg.setBlockToReturn(ptrs[0].BlockPointer, block2)
-	_, continueCh3 := bg.setBlockToReturn(ptrs[1].BlockPointer, block3)
+	bg.setBlockToReturn(ptrs[1].BlockPointer, block3)
+	bg.setBlockToReturn(ptrs[2].BlockPointer, makeFakeFileBlock(t, true))
 
 	var block Block = &FileBlock{}
 	ch := q.Request(context.Background(), defaultOnDemandRequestPriority, makeKMD(), ptr1, block, TransientEntry)
@@ -115,18 +126,19 @@ func TestPrefetcherIndirectFileBlock(t *testing.T) {
 
 	t.Log("Shutdown the prefetcher and wait until it's done prefetching.")
 	continueCh2 <- nil
-	continueCh3 <- nil
 	<-q.Prefetcher().Shutdown()
 
-	t.Log("Ensure that the prefetched blocks are in the cache.")
+	t.Log("Ensure that only the indirect child block was prefetched; " +
+		"data blocks, including unlabeled ones, are left to read-ahead.")
 	testPrefetcherCheckGet(
 		t, config.BlockCache(), ptr1, block1, true, TransientEntry)
 	testPrefetcherCheckGet(
 		t, config.BlockCache(), ptrs[0].BlockPointer, block2, false,
 		TransientEntry)
-	testPrefetcherCheckGet(
-		t, config.BlockCache(), ptrs[1].BlockPointer, block3, false,
-		TransientEntry)
+	_, err = config.BlockCache().Get(ptrs[1].BlockPointer)
+	require.EqualError(t, err, NoSuchBlockError{ptrs[1].ID}.Error())
+	_, err = config.BlockCache().Get(ptrs[2].BlockPointer)
+	require.EqualError(t, err, NoSuchBlockError{ptrs[2].ID}.Error())
 }
 
 func TestPrefetcherIndirectDirBlock(t *testing.T) {
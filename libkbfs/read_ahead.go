@@ -0,0 +1,153 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+
+	lru "github.com/hashicorp/golang-lru"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+const (
+	// readAheadInitialWindow is the number of bytes read ahead of
+	// the first read of a newly-detected sequential stream.
+	readAheadInitialWindow int64 = 512 * 1024
+	// readAheadMaxWindow caps how far ahead of a sequential stream
+	// we read, no matter how long the stream has been going.
+	readAheadMaxWindow int64 = 16 * 1024 * 1024
+	// readAheadMaxTrackedFiles is the number of files per folder
+	// whose access patterns are remembered.
+	readAheadMaxTrackedFiles int = 100
+	// readAheadPriority is the retrieval priority of read-ahead
+	// blocks.  It's higher than the other prefetches, since the
+	// reader will probably need the blocks soon, but lower than
+	// on-demand requests.
+	readAheadPriority int = -50
+)
+
+// readAheadState tracks the access pattern of one file.
+type readAheadState struct {
+	// nextOff is the offset just past the most recent read.
+	nextOff int64
+	// window is the number of bytes to read ahead of the next
+	// read, or 0 if the file is being accessed randomly.
+	window int64
+	// The half-inclusive byte range `[issuedStart, issuedEnd)` for
+	// which read-ahead requests have already been issued.
+	issuedStart int64
+	issuedEnd   int64
+}
+
+// readAheadTracker detects sequential reads on files, and decides how
+// far ahead of each read the blocks should be fetched.  The window
+// doubles on every sequential read, and is dropped entirely as soon
+// as a read doesn't follow the previous one.  It is goroutine-safe.
+//
+// Reads are tracked per file, not per open handle, since KBFSOps.Read
+// doesn't know which handle a read comes through.  So two readers
+// streaming the same file at different offsets look like random
+// access to each other, and get no read-ahead until one of them
+// stops.
+type readAheadTracker struct {
+	lock  sync.Mutex
+	files *lru.Cache // BlockRef of the file -> *readAheadState
+
+	// Shared by all folders; nil if there's no metrics registry.
+	hitCounter    metrics.Counter
+	missCounter   metrics.Counter
+	issuedCounter metrics.Counter
+}
+
+func newReadAheadTracker(r metrics.Registry) *readAheadTracker {
+	files, err := lru.New(readAheadMaxTrackedFiles)
+	if err != nil {
+		// This should never happen since the capacity is positive.
+		panic(err)
+	}
+	rat := &readAheadTracker{files: files}
+	if r != nil {
+		rat.hitCounter = metrics.GetOrRegisterCounter("ReadAhead.Hit", r)
+		rat.missCounter = metrics.GetOrRegisterCounter("ReadAhead.Miss", r)
+		rat.issuedCounter = metrics.GetOrRegisterCounter(
+			"ReadAhead.BlocksIssued", r)
+		hits, misses := rat.hitCounter, rat.missCounter
+		r.GetOrRegister("ReadAhead.HitRatio",
+			metrics.NewFunctionalGaugeFloat64(func() float64 {
+				h, m := hits.Count(), misses.Count()
+				if h+m == 0 {
+					return 0
+				}
+				return float64(h) / float64(h+m)
+			}))
+	}
+	return rat
+}
+
+// update records a read of `n` bytes at `off` in the file identified
+// by `ref`, and returns the half-inclusive range `[start, end)` that
+// should now be read ahead.  If `start == end`, nothing should be.
+func (rat *readAheadTracker) update(ref BlockRef, off, n int64) (
+	start, end int64) {
+	rat.lock.Lock()
+	defer rat.lock.Unlock()
+
+	var s *readAheadState
+	if v, ok := rat.files.Get(ref); ok {
+		s = v.(*readAheadState)
+	} else {
+		// A brand new file counts as sequential if it's read from
+		// the beginning.
+		s = &readAheadState{}
+		rat.files.Add(ref, s)
+	}
+
+	readEnd := off + n
+	if s.issuedStart <= off && readEnd <= s.issuedEnd {
+		if rat.hitCounter != nil {
+			rat.hitCounter.Inc(1)
+		}
+	} else if rat.missCounter != nil {
+		rat.missCounter.Inc(1)
+	}
+
+	switch {
+	case off != s.nextOff:
+		// Random access: forget the stream.
+		s.window = 0
+		s.issuedStart, s.issuedEnd = 0, 0
+	case s.window == 0:
+		s.window = readAheadInitialWindow
+	case s.window < readAheadMaxWindow:
+		s.window *= 2
+		if s.window > readAheadMaxWindow {
+			s.window = readAheadMaxWindow
+		}
+	}
+	s.nextOff = readEnd
+
+	if s.window == 0 {
+		return 0, 0
+	}
+	start, end = readEnd, readEnd+s.window
+	if s.issuedStart <= start && start < s.issuedEnd {
+		// Only issue the part that hasn't been requested yet.
+		start = s.issuedEnd
+	} else {
+		s.issuedStart = start
+	}
+	if start >= end {
+		return 0, 0
+	}
+	s.issuedEnd = end
+	return start, end
+}
+
+// markIssued records that `n` read-ahead block requests were issued.
+func (rat *readAheadTracker) markIssued(n int) {
+	if rat.issuedCounter != nil {
+		rat.issuedCounter.Inc(int64(n))
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/keybase/kbfs/kbfsblock"
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadAheadTrackerSequential(t *testing.T) {
+	r := metrics.NewRegistry()
+	rat := newReadAheadTracker(r)
+	ref := BlockRef{ID: kbfsblock.FakeID(1)}
+
+	t.Log("The first read from the start of a file begins a stream.")
+	start, end := rat.update(ref, 0, 100)
+	require.Equal(t, int64(100), start)
+	require.Equal(t, 100+readAheadInitialWindow, end)
+
+	t.Log("The window doubles, and only the new part is issued.")
+	start, end = rat.update(ref, 100, 100)
+	require.Equal(t, 100+readAheadInitialWindow, start)
+	require.Equal(t, 200+2*readAheadInitialWindow, end)
+
+	t.Log("The window never grows past the maximum.")
+	off := int64(200)
+	for i := 0; i < 20; i++ {
+		_, end = rat.update(ref, off, 100)
+		off += 100
+	}
+	require.Equal(t, off+readAheadMaxWindow, end)
+
+	require.Equal(t, int64(21), r.Get("ReadAhead.Hit").(metrics.Counter).Count())
+	require.Equal(t, int64(1), r.Get("ReadAhead.Miss").(metrics.Counter).Count())
+	ratio := r.Get("ReadAhead.HitRatio").(metrics.GaugeFloat64).Value()
+	require.InDelta(t, 21.0/22.0, ratio, 0.0001)
+}
+
+func TestReadAheadTrackerRandom(t *testing.T) {
+	rat := newReadAheadTracker(nil)
+	ref := BlockRef{ID: kbfsblock.FakeID(1)}
+
+	t.Log("A first read from the middle of a file is random access.")
+	start, end := rat.update(ref, 1000, 100)
+	require.Equal(t, start, end)
+	start, end = rat.update(ref, 5000, 100)
+	require.Equal(t, start, end)
+
+	t.Log("A sequential run after random reads starts a new stream.")
+	start, end = rat.update(ref, 5100, 100)
+	require.Equal(t, int64(5200), start)
+	require.Equal(t, 5200+readAheadInitialWindow, end)
+
+	t.Log("Seeking away drops the window again.")
+	start, end = rat.update(ref, 0, 100)
+	require.Equal(t, start, end)
+}
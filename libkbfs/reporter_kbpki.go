@@ -134,6 +134,8 @@ func (r *ReporterKBPKI) ReportErr(ctx context.Context,
 		}
 	case UnverifiableTlfUpdateError:
 		code = keybase1.FSErrorType_REVOKED_DATA_DETECTED
+	case MDRollbackError:
+		code = keybase1.FSErrorType_BAD_FOLDER
 	case NoCurrentSessionError:
 		code = keybase1.FSErrorType_NOT_LOGGED_IN
 	case NeedSelfRekeyError:
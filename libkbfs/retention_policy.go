@@ -0,0 +1,240 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+)
+
+// RetentionPolicy controls how much of a TLF's history quota
+// reclamation leaves restorable.  The zero value keeps the global
+// quota reclamation settings.  A policy stored in a TLF's MD (see
+// KBFSOps.SetRetentionPolicy) applies on every device.
+type RetentionPolicy struct {
+	// NeverReclaim turns off quota reclamation for the TLF, so
+	// that its full history stays restorable.
+	NeverReclaim bool `codec:"nr,omitempty"`
+	// MinUnrefAge, if non-zero, overrides
+	// Config.QuotaReclamationMinUnrefAge for the TLF.
+	MinUnrefAge time.Duration `codec:"ua,omitempty"`
+	// KeepRevisions, if non-zero, keeps the given number of most
+	// recent revisions fully restorable, by never reclaiming the
+	// blocks they reference.
+	KeepRevisions int64 `codec:"kr,omitempty"`
+	// Period, if non-zero, overrides Config.QuotaReclamationPeriod
+	// for the TLF.
+	Period time.Duration `codec:"p,omitempty"`
+}
+
+// retentionPolicyForMD returns the retention policy quota
+// reclamation should follow as of the given MD.  A policy stored in
+// the MD wins over the local retention policies, which only affect
+// this device.
+func retentionPolicyForMD(
+	config Config, id tlf.ID, rmd ReadOnlyRootMetadata) RetentionPolicy {
+	var policy RetentionPolicy
+	if p := rmd.RetentionPolicy(); p != nil {
+		policy = *p
+	} else {
+		policy = config.RetentionPolicies().PolicyFor(id, rmd.GetTlfHandle())
+	}
+	if rmd.IsImmutableSet() {
+		// Write-once, read-many folders keep their full history.
+		policy.NeverReclaim = true
+	}
+	return policy
+}
+
+// minUnrefAge returns the minimum time a block must have been
+// unreferenced before it can be reclaimed under this policy.
+func (p RetentionPolicy) minUnrefAge(config Config) time.Duration {
+	if p.MinUnrefAge > 0 {
+		return p.MinUnrefAge
+	}
+	return config.QuotaReclamationMinUnrefAge()
+}
+
+// period returns how often reclamation should run under this policy.
+func (p RetentionPolicy) period(config Config) time.Duration {
+	if p.Period > 0 {
+		return p.Period
+	}
+	return config.QuotaReclamationPeriod()
+}
+
+// latestReclaimableRev returns the latest revision up to which quota
+// reclamation may reclaim blocks, given the head revision.  It
+// returns kbfsmd.RevisionUninitialized if nothing may be reclaimed.
+func (p RetentionPolicy) latestReclaimableRev(
+	head kbfsmd.Revision) kbfsmd.Revision {
+	if p.NeverReclaim {
+		return kbfsmd.RevisionUninitialized
+	}
+	if p.KeepRevisions <= 0 {
+		return head
+	}
+	// Reclaiming the blocks unreferenced by revision R only makes
+	// the revisions before R unrestorable.
+	rev := head - kbfsmd.Revision(p.KeepRevisions) + 1
+	if rev < kbfsmd.RevisionInitial {
+		return kbfsmd.RevisionUninitialized
+	}
+	return rev
+}
+
+// retentionPolicyJSON is the on-disk format of a RetentionPolicy.
+// Ages and periods are Go durations, optionally in days, e.g. "90d".
+type retentionPolicyJSON struct {
+	NeverReclaim  bool   `json:"neverReclaim,omitempty"`
+	MinUnrefAge   string `json:"minUnrefAge,omitempty"`
+	KeepRevisions int64  `json:"keepRevisions,omitempty"`
+	Period        string `json:"period,omitempty"`
+}
+
+// retentionPoliciesJSON is the on-disk format of RetentionPolicies.
+type retentionPoliciesJSON struct {
+	Default *retentionPolicyJSON `json:"default,omitempty"`
+	// Folders is keyed by canonical TLF path
+	// (e.g. "/keybase/team/acme") or by TLF ID.
+	Folders map[string]retentionPolicyJSON `json:"folders"`
+}
+
+func parseRetentionDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.ParseFloat(strings.TrimSuffix(s, "d"), 64)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(days * float64(24*time.Hour)), nil
+	}
+	return time.ParseDuration(s)
+}
+
+func (pj retentionPolicyJSON) toPolicy() (p RetentionPolicy, err error) {
+	p.NeverReclaim = pj.NeverReclaim
+	p.KeepRevisions = pj.KeepRevisions
+	if p.KeepRevisions < 0 {
+		return RetentionPolicy{}, fmt.Errorf(
+			"Negative keepRevisions %d", p.KeepRevisions)
+	}
+	p.MinUnrefAge, err = parseRetentionDuration(pj.MinUnrefAge)
+	if err != nil {
+		return RetentionPolicy{}, errors.Wrapf(
+			err, "Bad minUnrefAge %q", pj.MinUnrefAge)
+	}
+	p.Period, err = parseRetentionDuration(pj.Period)
+	if err != nil {
+		return RetentionPolicy{}, errors.Wrapf(err, "Bad period %q", pj.Period)
+	}
+	if p.MinUnrefAge < 0 || p.Period < 0 {
+		return RetentionPolicy{}, errors.New("Negative retention durations")
+	}
+	return p, nil
+}
+
+// RetentionPolicies maps TLFs to the retention policies quota
+// reclamation on this device should follow for them, when their MD
+// doesn't name one.  A nil *RetentionPolicies gives every such TLF
+// the zero RetentionPolicy.
+type RetentionPolicies struct {
+	defaultPolicy RetentionPolicy
+	byPath        map[string]RetentionPolicy
+	byID          map[tlf.ID]RetentionPolicy
+}
+
+// ParseRetentionPolicy parses a single retention policy from JSON of the form
+// {"minUnrefAge": "90d", "keepRevisions": 100}, as used for each
+// folder by ParseRetentionPolicies.
+func ParseRetentionPolicy(data []byte) (RetentionPolicy, error) {
+	var pj retentionPolicyJSON
+	err := json.Unmarshal(data, &pj)
+	if err != nil {
+		return RetentionPolicy{}, errors.WithStack(err)
+	}
+	return pj.toPolicy()
+}
+
+// ParseRetentionPolicies parses retention policies from JSON of the
+// form:
+//
+//	{
+//	  "default": {"minUnrefAge": "1h"},
+//	  "folders": {
+//	    "/keybase/team/acme.compliance": {"neverReclaim": true},
+//	    "/keybase/private/alice": {"minUnrefAge": "90d", "keepRevisions": 100}
+//	  }
+//	}
+//
+// Folders are named by canonical TLF path or by TLF ID.
+func ParseRetentionPolicies(data []byte) (*RetentionPolicies, error) {
+	var rpj retentionPoliciesJSON
+	err := json.Unmarshal(data, &rpj)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	rp := &RetentionPolicies{
+		byPath: make(map[string]RetentionPolicy),
+		byID:   make(map[tlf.ID]RetentionPolicy),
+	}
+	if rpj.Default != nil {
+		rp.defaultPolicy, err = rpj.Default.toPolicy()
+		if err != nil {
+			return nil, errors.Wrap(err, "Bad default retention policy")
+		}
+	}
+	for name, pj := range rpj.Folders {
+		p, err := pj.toPolicy()
+		if err != nil {
+			return nil, errors.Wrapf(err, "Bad retention policy for %s", name)
+		}
+		if id, err := tlf.ParseID(name); err == nil {
+			rp.byID[id] = p
+		} else {
+			rp.byPath[strings.TrimSuffix(name, "/")] = p
+		}
+	}
+	return rp, nil
+}
+
+// LoadRetentionPolicies reads retention policies from the JSON file
+// at the given path; see ParseRetentionPolicies for the format.
+func LoadRetentionPolicies(path string) (*RetentionPolicies, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseRetentionPolicies(data)
+}
+
+// PolicyFor returns the retention policy for the TLF with the given
+// ID and handle.  The handle may be nil, in which case only
+// ID-specific policies are considered.
+func (rp *RetentionPolicies) PolicyFor(
+	id tlf.ID, h *TlfHandle) RetentionPolicy {
+	if rp == nil {
+		return RetentionPolicy{}
+	}
+	if p, ok := rp.byID[id]; ok {
+		return p
+	}
+	if h != nil {
+		if p, ok := rp.byPath[h.GetCanonicalPath()]; ok {
+			return p
+		}
+	}
+	return rp.defaultPolicy
+}
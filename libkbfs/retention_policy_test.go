@@ -0,0 +1,59 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRetentionPolicies(t *testing.T) {
+	id := tlf.FakeID(1, tlf.Private)
+	rp, err := ParseRetentionPolicies([]byte(`{
+		"default": {"minUnrefAge": "1h", "period": "30s"},
+		"folders": {
+			"/keybase/team/compliance/": {"neverReclaim": true},
+			"` + id.String() + `": {"minUnrefAge": "90d", "keepRevisions": 100}
+		}
+	}`))
+	require.NoError(t, err)
+
+	require.Equal(t, RetentionPolicy{
+		MinUnrefAge:   90 * 24 * time.Hour,
+		KeepRevisions: 100,
+	}, rp.PolicyFor(id, nil))
+	require.Equal(t, RetentionPolicy{MinUnrefAge: time.Hour, Period: 30 * time.Second},
+		rp.PolicyFor(tlf.FakeID(2, tlf.Private), nil))
+	require.Equal(t, RetentionPolicy{NeverReclaim: true},
+		rp.byPath["/keybase/team/compliance"])
+
+	var nilRP *RetentionPolicies
+	require.Equal(t, RetentionPolicy{}, nilRP.PolicyFor(id, nil))
+
+	for _, bad := range []string{
+		`{"folders": {"x": {"minUnrefAge": "soon"}}}`,
+		`{"folders": {"x": {"keepRevisions": -1}}}`,
+		`{"default": {"period": "-1h"}}`,
+		`not json`,
+	} {
+		_, err = ParseRetentionPolicies([]byte(bad))
+		require.Error(t, err, bad)
+	}
+}
+
+func TestRetentionPolicyLatestReclaimableRev(t *testing.T) {
+	require.Equal(t, kbfsmd.Revision(10),
+		RetentionPolicy{}.latestReclaimableRev(10))
+	require.Equal(t, kbfsmd.Revision(8),
+		RetentionPolicy{KeepRevisions: 3}.latestReclaimableRev(10))
+	require.Equal(t, kbfsmd.RevisionUninitialized,
+		RetentionPolicy{KeepRevisions: 11}.latestReclaimableRev(10))
+	require.Equal(t, kbfsmd.RevisionUninitialized,
+		RetentionPolicy{NeverReclaim: true}.latestReclaimableRev(10))
+}
@@ -36,6 +36,10 @@ type WriterFlags byte
 // Possible flags set in the WriterFlags bitfield.
 const (
 	MetadataFlagUnmerged WriterFlags = 1 << iota
+	// MetadataFlagImmutable marks a write-once, read-many folder,
+	// whose existing entries and file contents can't be removed,
+	// renamed or overwritten.  Once set, it is never cleared.
+	MetadataFlagImmutable
 )
 
 // PrivateMetadata contains the portion of metadata that's secret for private
@@ -53,6 +57,15 @@ type PrivateMetadata struct {
 	// was performed on this TLF.
 	LastGCRevision kbfsmd.Revision `codec:"lgc"`
 
+	// The retention policy that quota reclamation follows for this
+	// TLF on every device, if one has been set.
+	RetentionPolicy *RetentionPolicy `codec:"rp,omitempty"`
+
+	// Whether writers of this TLF re-encrypt blocks that use older
+	// key generations in the background; see
+	// KBFSOps.SetBackgroundReencryption.
+	BackgroundReencryption bool `codec:"bre,omitempty"`
+
 	codec.UnknownFieldSetHandler
 
 	// When the above Changes field gets unembedded into its own
@@ -386,6 +399,30 @@ func (md *RootMetadata) SetLastGCRevision(rev kbfsmd.Revision) {
 	md.data.LastGCRevision = rev
 }
 
+// RetentionPolicy returns the retention policy stored in this MD,
+// or nil if none has been set.
+func (md *RootMetadata) RetentionPolicy() *RetentionPolicy {
+	return md.data.RetentionPolicy
+}
+
+// SetRetentionPolicy stores the given retention policy in this MD;
+// nil clears it.
+func (md *RootMetadata) SetRetentionPolicy(policy *RetentionPolicy) {
+	md.data.RetentionPolicy = policy
+}
+
+// BackgroundReencryption returns whether background re-encryption is
+// enabled in this MD.
+func (md *RootMetadata) BackgroundReencryption() bool {
+	return md.data.BackgroundReencryption
+}
+
+// SetBackgroundReencryption enables or disables background
+// re-encryption in this MD.
+func (md *RootMetadata) SetBackgroundReencryption(enabled bool) {
+	md.data.BackgroundReencryption = enabled
+}
+
 // updateFromTlfHandle updates the current RootMetadata's fields to
 // reflect the given handle, which must be the result of running the
 // current handle with ResolveAgain().
@@ -668,6 +705,16 @@ func (md *RootMetadata) SetUnmerged() {
 	md.bareMd.SetUnmerged()
 }
 
+// IsImmutableSet wraps the respective method of the underlying BareRootMetadata for convenience.
+func (md *RootMetadata) IsImmutableSet() bool {
+	return md.bareMd.IsImmutableSet()
+}
+
+// SetImmutable wraps the respective method of the underlying BareRootMetadata for convenience.
+func (md *RootMetadata) SetImmutable() {
+	md.bareMd.SetImmutable()
+}
+
 // SetBranchID wraps the respective method of the underlying BareRootMetadata for convenience.
 func (md *RootMetadata) SetBranchID(bid BranchID) {
 	md.bareMd.SetBranchID(bid)
@@ -954,6 +1001,10 @@ type ImmutableRootMetadata struct {
 	// persists in the journal or in the cache, localTimestamp comes
 	// directly from the local clock.
 	localTimestamp time.Time
+	// fromDiskCache is set if this ImmutableRootMetadata was read
+	// from the disk MD cache while the MD server was unreachable,
+	// and so might not be the latest revision of its TLF.
+	fromDiskCache bool
 }
 
 // MakeImmutableRootMetadata makes a new ImmutableRootMetadata from
@@ -981,7 +1032,7 @@ func MakeImmutableRootMetadata(
 		}
 	}
 	return ImmutableRootMetadata{
-		rmd.ReadOnly(), mdID, writerVerifyingKey, localTimestamp}
+		rmd.ReadOnly(), mdID, writerVerifyingKey, localTimestamp, false}
 }
 
 // MdID returns the pre-computed MdID of the contained RootMetadata
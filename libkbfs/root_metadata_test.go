@@ -77,6 +77,8 @@ func makeFakePrivateMetadataFuture(t *testing.T) privateMetadataFuture {
 				0,
 			},
 			0,
+			&RetentionPolicy{KeepRevisions: 10},
+			true,
 			codec.UnknownFieldSetHandler{},
 			BlockChanges{},
 		},
@@ -0,0 +1,732 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"os"
+	stdpath "path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/kbfssync"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"golang.org/x/net/context"
+)
+
+const (
+	searchIndexVersion     = 1
+	searchIndexDirPrefix   = "d"
+	searchIndexMetaKey     = "m"
+	searchIndexKeyDeriving = "KBFS search index"
+)
+
+var searchIndexMACDeriving = []byte("KBFS search index path MAC")
+
+func searchIndexRootFromStorageRoot(storageRoot string) string {
+	return filepath.Join(storageRoot, "kbfs_search_index")
+}
+
+// SearchQuery describes which entries of a TLF should be returned
+// by a search.  Each non-zero field further restricts the results.
+type SearchQuery struct {
+	// NamePattern is a glob pattern, in the syntax accepted by
+	// path.Match, that the basename of each result must match.
+	NamePattern string
+	// PathPrefix is a directory, relative to the TLF root, under
+	// which all results must be.
+	PathPrefix string
+	// Types restricts the results to entries of the given types.
+	Types []EntryType
+	// MinSize and MaxSize bound the size of each result.  A
+	// MaxSize of zero means there is no upper bound.
+	MinSize uint64
+	MaxSize uint64
+	// ModifiedAfter and ModifiedBefore bound the mtime of each
+	// result.
+	ModifiedAfter  time.Time
+	ModifiedBefore time.Time
+	// LastWriter restricts the results to entries last written by
+	// the given user.
+	LastWriter libkb.NormalizedUsername
+	// Limit, if positive, is the maximum number of results to
+	// return.
+	Limit int
+}
+
+// SearchResult is a single entry returned by a search.
+type SearchResult struct {
+	// Path is relative to the TLF root.
+	Path string
+	EntryInfo
+	LastWriterID keybase1.UserOrTeamID
+	// LastWriter is the resolved name of LastWriterID, if any.
+	LastWriter libkb.NormalizedUsername
+}
+
+// searchIndexEntry is the indexed information about a single
+// directory entry.
+type searchIndexEntry struct {
+	EntryInfo
+	Writer keybase1.UserOrTeamID `codec:"w"`
+}
+
+// searchIndexDir is the unit of storage of the search index: the
+// (encrypted) set of entries of a single directory.
+type searchIndexDir struct {
+	Path     string                      `codec:"p"`
+	Children map[string]searchIndexEntry `codec:"c"`
+}
+
+type searchIndexMeta struct {
+	Version  int             `codec:"v"`
+	Complete bool            `codec:"c"`
+	Revision kbfsmd.Revision `codec:"r"`
+}
+
+// searchIndexRelPath returns the given path relative to the TLF
+// root, with "/" as the separator.
+func searchIndexRelPath(p path) string {
+	names := make([]string, 0, len(p.path)-1)
+	for _, n := range p.path[1:] {
+		names = append(names, n.Name)
+	}
+	return strings.Join(names, "/")
+}
+
+// tlfSearchIndex keeps a local, encrypted index of the names and
+// attributes of all the entries in a TLF, so that they can be
+// searched without fetching every directory block.  It's built once
+// by a background walk of the TLF, and is then kept up-to-date by
+// observing the changes to the TLF.  It's stored in the storage
+// root, alongside the disk block cache, if there is one; otherwise
+// it's only kept in memory.
+type tlfSearchIndex struct {
+	config Config
+	fbo    *folderBranchOps
+	log    logger.Logger
+	db     *leveldb.DB
+	crypto CryptoCommon
+
+	encKey [32]byte
+	macKey []byte
+
+	pendingLock sync.Mutex
+	pending     map[NodeID]Node
+	pendingCh   chan struct{}
+	// Tracks the queued updates, for tests.
+	updatesWG kbfssync.RepeatedWaitGroup
+
+	builtCh  chan struct{}
+	buildErr error
+
+	shutdownCh chan struct{}
+	doneCh     chan struct{}
+}
+
+var _ Observer = (*tlfSearchIndex)(nil)
+
+func openSearchIndexStorage(config Config, tlfID tlf.ID) (
+	storage.Storage, error) {
+	storageRoot := config.StorageRoot()
+	if storageRoot == "" {
+		return storage.NewMemStorage(), nil
+	}
+	dirPath := filepath.Join(
+		searchIndexRootFromStorageRoot(storageRoot), tlfID.String())
+	err := os.MkdirAll(dirPath, 0700)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return storage.OpenFile(dirPath, false)
+}
+
+// searchIndexKeyForTLF returns the key that the search index for
+// the given TLF is encrypted with.  It's derived from the first
+// generation of the TLF's crypt key, so that it stays the same
+// across rekeys.
+func searchIndexKeyForTLF(ctx context.Context, config Config,
+	kmd KeyMetadata) (kbfscrypto.TLFCryptKey, error) {
+	if kmd.TlfID().Type() == tlf.Public {
+		return kbfscrypto.PublicTLFCryptKey, nil
+	}
+	keys, err := config.KeyManager().GetTLFCryptKeyOfAllGenerations(
+		ctx, kmd)
+	if err != nil {
+		return kbfscrypto.TLFCryptKey{}, err
+	}
+	if len(keys) == 0 {
+		return kbfscrypto.TLFCryptKey{}, errors.Errorf(
+			"No keys for TLF %s", kmd.TlfID())
+	}
+	return keys[0], nil
+}
+
+// newTLFSearchIndex opens the search index for the TLF of the given
+// folderBranchOps, and starts building it in the background if
+// it's not already complete.
+func newTLFSearchIndex(ctx context.Context, config Config,
+	fbo *folderBranchOps, kmd KeyMetadata) (*tlfSearchIndex, error) {
+	tlfKey, err := searchIndexKeyForTLF(ctx, config, kmd)
+	if err != nil {
+		return nil, err
+	}
+
+	stor, err := openSearchIndexStorage(config, kmd.TlfID())
+	if err != nil {
+		return nil, err
+	}
+	db, err := openLevelDB(stor)
+	if err != nil {
+		stor.Close()
+		return nil, err
+	}
+
+	keyData := tlfKey.Data()
+	encMAC := hmac.New(sha256.New, keyData[:])
+	encMAC.Write([]byte(searchIndexKeyDeriving))
+	macMAC := hmac.New(sha256.New, keyData[:])
+	macMAC.Write(searchIndexMACDeriving)
+
+	si := &tlfSearchIndex{
+		config:     config,
+		fbo:        fbo,
+		log:        config.MakeLogger("SI"),
+		db:         db,
+		crypto:     MakeCryptoCommon(config.Codec()),
+		macKey:     macMAC.Sum(nil),
+		pending:    make(map[NodeID]Node),
+		pendingCh:  make(chan struct{}, 1),
+		builtCh:    make(chan struct{}),
+		shutdownCh: make(chan struct{}),
+		doneCh:     make(chan struct{}),
+	}
+	copy(si.encKey[:], encMAC.Sum(nil))
+
+	// Register before building, so no changes are missed during
+	// the walk.
+	fbo.observers.add(si)
+	go si.loop(kmd)
+	return si, nil
+}
+
+func (si *tlfSearchIndex) dirKey(relPath string) []byte {
+	mac := hmac.New(sha256.New, si.macKey)
+	mac.Write([]byte(relPath))
+	return mac.Sum([]byte(searchIndexDirPrefix))
+}
+
+func (si *tlfSearchIndex) getMeta() (searchIndexMeta, error) {
+	buf, err := si.db.Get([]byte(searchIndexMetaKey), nil)
+	if err == leveldb.ErrNotFound {
+		return searchIndexMeta{}, nil
+	} else if err != nil {
+		return searchIndexMeta{}, err
+	}
+	var meta searchIndexMeta
+	err = si.config.Codec().Decode(buf, &meta)
+	if err != nil {
+		return searchIndexMeta{}, err
+	}
+	return meta, nil
+}
+
+func (si *tlfSearchIndex) putMeta(meta searchIndexMeta) error {
+	buf, err := si.config.Codec().Encode(meta)
+	if err != nil {
+		return err
+	}
+	return si.db.Put([]byte(searchIndexMetaKey), buf, nil)
+}
+
+func (si *tlfSearchIndex) decodeDir(buf []byte) (searchIndexDir, error) {
+	var ed encryptedData
+	err := si.config.Codec().Decode(buf, &ed)
+	if err != nil {
+		return searchIndexDir{}, err
+	}
+	plain, err := si.crypto.decryptData(ed, si.encKey)
+	if err != nil {
+		return searchIndexDir{}, err
+	}
+	var dir searchIndexDir
+	err = si.config.Codec().Decode(plain, &dir)
+	if err != nil {
+		return searchIndexDir{}, err
+	}
+	return dir, nil
+}
+
+func (si *tlfSearchIndex) getDir(relPath string) (
+	dir searchIndexDir, ok bool, err error) {
+	buf, err := si.db.Get(si.dirKey(relPath), nil)
+	if err == leveldb.ErrNotFound {
+		return searchIndexDir{}, false, nil
+	} else if err != nil {
+		return searchIndexDir{}, false, err
+	}
+	dir, err = si.decodeDir(buf)
+	if err != nil {
+		return searchIndexDir{}, false, err
+	}
+	return dir, true, nil
+}
+
+func (si *tlfSearchIndex) putDir(dir searchIndexDir) error {
+	plain, err := si.config.Codec().Encode(dir)
+	if err != nil {
+		return err
+	}
+	ed, err := si.crypto.encryptData(plain, si.encKey)
+	if err != nil {
+		return err
+	}
+	buf, err := si.config.Codec().Encode(ed)
+	if err != nil {
+		return err
+	}
+	return si.db.Put(si.dirKey(dir.Path), buf, nil)
+}
+
+// deleteSubtree removes the records for the given directory and all
+// of its indexed subdirectories.
+func (si *tlfSearchIndex) deleteSubtree(relPath string) error {
+	dir, ok, err := si.getDir(relPath)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+	for name, entry := range dir.Children {
+		if entry.Type != Dir {
+			continue
+		}
+		err := si.deleteSubtree(stdpath.Join(relPath, name))
+		if err != nil {
+			return err
+		}
+	}
+	return si.db.Delete(si.dirKey(relPath), nil)
+}
+
+// indexDir updates the record for the given directory from its
+// current (possibly dirty) contents.  Subdirectories that are new
+// to the index are walked recursively, as are all subdirectories if
+// `recursive` is true; subdirectories that have disappeared are
+// removed from the index.
+func (si *tlfSearchIndex) indexDir(ctx context.Context, lState *lockState,
+	kmd KeyMetadata, dirPath path, recursive bool) error {
+	select {
+	case <-si.shutdownCh:
+		return context.Canceled
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+
+	dblock, err := si.fbo.blocks.GetDirtyDir(
+		ctx, lState, kmd, dirPath, blockRead)
+	if err != nil {
+		return err
+	}
+
+	relPath := searchIndexRelPath(dirPath)
+	oldDir, _, err := si.getDir(relPath)
+	if err != nil {
+		return err
+	}
+
+	newDir := searchIndexDir{
+		Path:     relPath,
+		Children: make(map[string]searchIndexEntry, len(dblock.Children)),
+	}
+	for name, de := range dblock.Children {
+		writer := de.Writer
+		if writer == keybase1.UserOrTeamID("") {
+			writer = de.Creator
+		}
+		newDir.Children[name] = searchIndexEntry{de.EntryInfo, writer}
+	}
+	err = si.putDir(newDir)
+	if err != nil {
+		return err
+	}
+
+	for name, oldEntry := range oldDir.Children {
+		if oldEntry.Type != Dir {
+			continue
+		}
+		if newEntry, ok := newDir.Children[name]; ok &&
+			newEntry.Type == Dir {
+			continue
+		}
+		err := si.deleteSubtree(stdpath.Join(relPath, name))
+		if err != nil {
+			return err
+		}
+	}
+
+	for name, de := range dblock.Children {
+		if de.Type != Dir {
+			continue
+		}
+		if oldEntry, ok := oldDir.Children[name]; !recursive && ok &&
+			oldEntry.Type == Dir {
+			continue
+		}
+		err := si.indexDir(ctx, lState, kmd,
+			dirPath.ChildPath(name, de.BlockPointer), true)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// build walks the whole TLF, unless the stored index is already
+// complete and up-to-date.
+func (si *tlfSearchIndex) build(ctx context.Context, kmd KeyMetadata) error {
+	lState := makeFBOLockState()
+	meta, err := si.getMeta()
+	if err != nil {
+		return err
+	}
+	if meta.Version == searchIndexVersion && meta.Complete &&
+		meta.Revision == si.fbo.getCurrMDRevision(lState) {
+		si.log.CDebugf(ctx, "Search index is up-to-date at revision %d",
+			meta.Revision)
+		return nil
+	}
+
+	si.log.CDebugf(ctx, "Building search index")
+	// Clear out any stale or partial index.
+	iter := si.db.NewIterator(util.BytesPrefix(
+		[]byte(searchIndexDirPrefix)), nil)
+	for iter.Next() {
+		err := si.db.Delete(iter.Key(), nil)
+		if err != nil {
+			iter.Release()
+			return err
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	rootNode, _, _, err := si.fbo.getRootNode(ctx)
+	if err != nil {
+		return err
+	}
+	rootPath, err := si.fbo.pathFromNodeForRead(rootNode)
+	if err != nil {
+		return err
+	}
+	rev := si.fbo.getCurrMDRevision(lState)
+	err = si.indexDir(ctx, lState, kmd, rootPath, true)
+	if err != nil {
+		return err
+	}
+	si.log.CDebugf(ctx, "Finished building search index at revision %d",
+		rev)
+	return si.putMeta(searchIndexMeta{
+		Version:  searchIndexVersion,
+		Complete: true,
+		Revision: rev,
+	})
+}
+
+// processPending re-indexes all the directories that have changed
+// since the last call.
+func (si *tlfSearchIndex) processPending(
+	ctx context.Context, kmd KeyMetadata) error {
+	si.pendingLock.Lock()
+	pending := si.pending
+	si.pending = make(map[NodeID]Node)
+	si.pendingLock.Unlock()
+	defer func() {
+		for range pending {
+			si.updatesWG.Done()
+		}
+	}()
+
+	lState := makeFBOLockState()
+	rev := si.fbo.getCurrMDRevision(lState)
+	for _, node := range pending {
+		if si.fbo.nodeCache.IsUnlinked(node) {
+			// The parent directory will have been re-indexed.
+			continue
+		}
+		p, err := si.fbo.pathFromNodeForRead(node)
+		if err != nil {
+			si.log.CDebugf(ctx, "Skipping index update for %s: %+v",
+				getNodeIDStr(node), err)
+			continue
+		}
+		err = si.indexDir(ctx, lState, kmd, p, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	meta, err := si.getMeta()
+	if err != nil {
+		return err
+	}
+	meta.Revision = rev
+	return si.putMeta(meta)
+}
+
+func (si *tlfSearchIndex) loop(kmd KeyMetadata) {
+	defer close(si.doneCh)
+	ctx, cancel := context.WithCancel(
+		ctxWithRandomIDReplayable(context.Background(), CtxFBOIDKey,
+			CtxFBOOpID, si.log))
+	defer cancel()
+	go func() {
+		select {
+		case <-si.shutdownCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	si.buildErr = si.build(ctx, kmd)
+	close(si.builtCh)
+	if si.buildErr != nil {
+		si.log.CWarningf(ctx, "Couldn't build search index: %+v",
+			si.buildErr)
+		return
+	}
+
+	for {
+		select {
+		case <-si.pendingCh:
+			// Use the latest MD for decrypting any new blocks.
+			lState := makeFBOLockState()
+			md, err := si.fbo.getMDForReadNoIdentify(ctx, lState)
+			if err == nil {
+				kmd = md
+			}
+			err = si.processPending(ctx, kmd)
+			if err != nil {
+				si.log.CDebugf(ctx, "Couldn't update search index: %+v",
+					err)
+			}
+		case <-si.shutdownCh:
+			return
+		}
+	}
+}
+
+func (si *tlfSearchIndex) queueUpdate(node Node) {
+	si.pendingLock.Lock()
+	defer si.pendingLock.Unlock()
+	if _, ok := si.pending[node.GetID()]; !ok {
+		si.updatesWG.Add(1)
+	}
+	si.pending[node.GetID()] = node
+	select {
+	case si.pendingCh <- struct{}{}:
+	default:
+	}
+}
+
+// LocalChange implements the Observer interface for tlfSearchIndex.
+func (si *tlfSearchIndex) LocalChange(
+	ctx context.Context, node Node, write WriteRange) {
+	// Writes only change file sizes, which will be picked up
+	// by the next batch of changes.
+}
+
+// BatchChanges implements the Observer interface for tlfSearchIndex.
+func (si *tlfSearchIndex) BatchChanges(
+	ctx context.Context, changes []NodeChange) {
+	for _, change := range changes {
+		if len(change.DirUpdated) > 0 {
+			si.queueUpdate(change.Node)
+			continue
+		}
+		// The attributes of a file or directory changed, so the
+		// record of its parent needs an update.
+		p := si.fbo.nodeCache.PathFromNode(change.Node)
+		if !p.hasValidParent() {
+			continue
+		}
+		parent := si.fbo.nodeCache.Get(p.parentPath().tailPointer().Ref())
+		if parent == nil {
+			continue
+		}
+		si.queueUpdate(parent)
+	}
+}
+
+// TlfHandleChange implements the Observer interface for
+// tlfSearchIndex.
+func (si *tlfSearchIndex) TlfHandleChange(
+	ctx context.Context, newHandle *TlfHandle) {
+	// Paths are stored relative to the TLF root, so nothing
+	// needs to change.
+}
+
+func (si *tlfSearchIndex) waitForBuild(ctx context.Context) error {
+	select {
+	case <-si.builtCh:
+		return si.buildErr
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// waitForUpdatesForTest waits until the index is built, and all the
+// changes observed so far are reflected in it.
+func (si *tlfSearchIndex) waitForUpdatesForTest(ctx context.Context) error {
+	err := si.waitForBuild(ctx)
+	if err != nil {
+		return err
+	}
+	return si.updatesWG.Wait(ctx)
+}
+
+func searchQueryMatches(query SearchQuery, relPath string,
+	entry searchIndexEntry, writer keybase1.UserOrTeamID) (bool, error) {
+	if query.PathPrefix != "" {
+		prefix := strings.Trim(query.PathPrefix, "/")
+		if prefix != "" && !strings.HasPrefix(relPath, prefix+"/") {
+			return false, nil
+		}
+	}
+	if query.NamePattern != "" {
+		match, err := stdpath.Match(
+			query.NamePattern, stdpath.Base(relPath))
+		if err != nil {
+			return false, err
+		}
+		if !match {
+			return false, nil
+		}
+	}
+	if len(query.Types) > 0 {
+		found := false
+		for _, t := range query.Types {
+			if entry.Type == t {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false, nil
+		}
+	}
+	if entry.Size < query.MinSize ||
+		(query.MaxSize > 0 && entry.Size > query.MaxSize) {
+		return false, nil
+	}
+	if !query.ModifiedAfter.IsZero() &&
+		entry.Mtime < query.ModifiedAfter.UnixNano() {
+		return false, nil
+	}
+	if !query.ModifiedBefore.IsZero() &&
+		entry.Mtime > query.ModifiedBefore.UnixNano() {
+		return false, nil
+	}
+	if writer != keybase1.UserOrTeamID("") && entry.Writer != writer {
+		return false, nil
+	}
+	return true, nil
+}
+
+// search returns all the indexed entries that match the given
+// query, sorted by path.
+func (si *tlfSearchIndex) search(ctx context.Context, query SearchQuery) (
+	results []SearchResult, err error) {
+	err = si.waitForBuild(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var writer keybase1.UserOrTeamID
+	if query.LastWriter != "" {
+		_, writer, err = si.config.KBPKI().Resolve(
+			ctx, query.LastWriter.String())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	iter := si.db.NewIterator(util.BytesPrefix(
+		[]byte(searchIndexDirPrefix)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		dir, err := si.decodeDir(iter.Value())
+		if err != nil {
+			return nil, err
+		}
+		for name, entry := range dir.Children {
+			relPath := stdpath.Join(dir.Path, name)
+			match, err := searchQueryMatches(query, relPath, entry, writer)
+			if err != nil {
+				return nil, err
+			}
+			if !match {
+				continue
+			}
+			results = append(results, SearchResult{
+				Path:         relPath,
+				EntryInfo:    entry.EntryInfo,
+				LastWriterID: entry.Writer,
+			})
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Path < results[j].Path
+	})
+	if query.Limit > 0 && len(results) > query.Limit {
+		results = results[:query.Limit]
+	}
+
+	for i, r := range results {
+		if r.LastWriterID == keybase1.UserOrTeamID("") {
+			continue
+		}
+		name, err := si.config.KBPKI().GetNormalizedUsername(
+			ctx, r.LastWriterID)
+		if err != nil {
+			return nil, err
+		}
+		results[i].LastWriter = name
+	}
+	return results, nil
+}
+
+func (si *tlfSearchIndex) shutdown() {
+	si.fbo.observers.remove(si)
+	select {
+	case <-si.shutdownCh:
+		return
+	default:
+	}
+	close(si.shutdownCh)
+	<-si.doneCh
+	si.db.Close()
+}
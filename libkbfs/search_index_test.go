@@ -0,0 +1,132 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func searchResultPaths(results []SearchResult) []string {
+	paths := make([]string, 0, len(results))
+	for _, r := range results {
+		paths = append(paths, r.Path)
+	}
+	return paths
+}
+
+func testSearchIndexFind(ctx context.Context, t *testing.T, config Config,
+	fb FolderBranch, query SearchQuery) []string {
+	results, err := config.KBFSOps().FindEntries(ctx, fb, query)
+	require.NoError(t, err)
+	return searchResultPaths(results)
+}
+
+func TestSearchIndexFindEntries(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "u1")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	fb := rootNode.GetFolderBranch()
+	kbfsOps := config.KBFSOps()
+
+	dirA, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	fileB, _, err := kbfsOps.CreateFile(ctx, dirA, "b.txt", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileB, []byte("hello"), 0)
+	require.NoError(t, err)
+	dirC, _, err := kbfsOps.CreateDir(ctx, dirA, "c")
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateFile(ctx, dirC, "d.go", false, NoExcl)
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateFile(ctx, rootNode, "e.txt", true, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	t.Log("The first search builds the index from scratch")
+	require.Equal(t, []string{"a", "a/b.txt", "a/c", "a/c/d.go", "e.txt"},
+		testSearchIndexFind(ctx, t, config, fb, SearchQuery{}))
+	require.Equal(t, []string{"a/b.txt", "e.txt"},
+		testSearchIndexFind(ctx, t, config, fb,
+			SearchQuery{NamePattern: "*.txt"}))
+	require.Equal(t, []string{"a", "a/c"},
+		testSearchIndexFind(ctx, t, config, fb,
+			SearchQuery{Types: []EntryType{Dir}}))
+	require.Equal(t, []string{"a/c/d.go"},
+		testSearchIndexFind(ctx, t, config, fb,
+			SearchQuery{PathPrefix: "a/c"}))
+	require.Equal(t, []string{"a/b.txt"},
+		testSearchIndexFind(ctx, t, config, fb,
+			SearchQuery{MinSize: 1, Types: []EntryType{File}}))
+	require.Equal(t, []string{"a"},
+		testSearchIndexFind(ctx, t, config, fb, SearchQuery{Limit: 1}))
+
+	results, err := kbfsOps.FindEntries(
+		ctx, fb, SearchQuery{NamePattern: "b.txt", LastWriter: "u1"})
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	require.Equal(t, "u1", results[0].LastWriter.String())
+	require.Equal(t, uint64(5), results[0].Size)
+
+	t.Log("Later changes are reflected in the index")
+	err = kbfsOps.Rename(ctx, dirA, "c", rootNode, "f", RenameFlagsNone)
+	require.NoError(t, err)
+	err = kbfsOps.RemoveEntry(ctx, rootNode, "e.txt")
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	ops := getOps(config, fb.Tlf)
+	err = ops.searchIndex.waitForUpdatesForTest(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "a/b.txt", "f", "f/d.go"},
+		testSearchIndexFind(ctx, t, config, fb, SearchQuery{}))
+}
+
+func TestSearchIndexStartsOnFirstRead(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "u1")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	fb := rootNode.GetFolderBranch()
+	_, _, err := config.KBFSOps().CreateFile(
+		ctx, rootNode, "a.txt", false, NoExcl)
+	require.NoError(t, err)
+	err = config.KBFSOps().SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	tempdir, err := ioutil.TempDir(os.TempDir(), "search_index")
+	require.NoError(t, err)
+	defer func() {
+		err := ioutil.RemoveAll(tempdir)
+		require.NoError(t, err)
+	}()
+
+	t.Log("A device that keeps the index on disk starts building it " +
+		"as soon as the TLF is read")
+	config2 := ConfigAsUser(config, "u1")
+	config2.storageRoot = tempdir
+	defer CheckConfigAndShutdown(ctx, t, config2)
+	GetRootNodeOrBust(ctx, t, config2, "u1", tlf.Private)
+	ops2 := getOps(config2, fb.Tlf)
+	var si *tlfSearchIndex
+	for si == nil {
+		ops2.searchIndexLock.Lock()
+		si = ops2.searchIndex
+		ops2.searchIndexLock.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+	err = si.waitForBuild(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a.txt"},
+		testSearchIndexFind(ctx, t, config2, fb, SearchQuery{}))
+}
@@ -0,0 +1,511 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"math/rand"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/kbfsblock"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// chaosAddrPrefix is the prefix of server addresses that wrap
+// another server address in a fault-injecting server, e.g.
+// "chaos:dir:/tmp/x?latency=200ms&err=0.05".
+const chaosAddrPrefix = "chaos:"
+
+// The default length of an injected disconnect.
+const defaultChaosDisconnectDuration = 10 * time.Second
+
+// ChaosParams describes the faults injected by BlockServerChaos and
+// MDServerChaos.  The zero value injects nothing.
+type ChaosParams struct {
+	// Latency is added to every call.
+	Latency time.Duration
+	// ErrRate is the probability that a call fails with a
+	// ChaosInjectedError without reaching the wrapped server.
+	ErrRate float64
+	// DisconnectRate is the probability that a call starts a
+	// disconnect, during which every call fails.
+	DisconnectRate float64
+	// DisconnectDuration is how long each disconnect lasts.
+	DisconnectDuration time.Duration
+	// Bandwidth, if non-zero, caps the rate in bytes/sec at which
+	// block data is sent to and received from the block server.
+	Bandwidth int64
+	// Seed, if non-zero, seeds the random source, so that the same
+	// sequence of calls sees the same faults.
+	Seed int64
+}
+
+// parseChaosAddr splits a server address of the form
+// "chaos:<addr>?<params>" into the wrapped address and the fault
+// parameters.  It returns false if addr isn't a chaos address.
+//
+// The params are a URL query string with the keys "latency" and
+// "disconnect-time" (durations), "err" and "disconnect"
+// (probabilities), "bandwidth" (a size per second, like "1mi"), and
+// "seed".
+func parseChaosAddr(addr string) (
+	innerAddr string, params ChaosParams, ok bool, err error) {
+	if !strings.HasPrefix(addr, chaosAddrPrefix) {
+		return "", ChaosParams{}, false, nil
+	}
+	innerAddr = addr[len(chaosAddrPrefix):]
+	var query string
+	if i := strings.LastIndex(innerAddr, "?"); i >= 0 {
+		innerAddr, query = innerAddr[:i], innerAddr[i+1:]
+	}
+	if len(innerAddr) == 0 {
+		return "", ChaosParams{}, false, errors.Errorf(
+			"No wrapped server address in %q", addr)
+	}
+
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return "", ChaosParams{}, false, err
+	}
+	params.DisconnectDuration = defaultChaosDisconnectDuration
+	for key, vals := range values {
+		val := vals[len(vals)-1]
+		switch key {
+		case "latency":
+			params.Latency, err = time.ParseDuration(val)
+		case "disconnect-time":
+			params.DisconnectDuration, err = time.ParseDuration(val)
+		case "err":
+			params.ErrRate, err = strconv.ParseFloat(val, 64)
+		case "disconnect":
+			params.DisconnectRate, err = strconv.ParseFloat(val, 64)
+		case "bandwidth":
+			err = SizeFlag{&params.Bandwidth}.Set(val)
+		case "seed":
+			params.Seed, err = strconv.ParseInt(val, 10, 64)
+		default:
+			err = errors.Errorf("Unknown chaos parameter %q", key)
+		}
+		if err != nil {
+			return "", ChaosParams{}, false, errors.Wrapf(
+				err, "Bad chaos parameter %q", key)
+		}
+	}
+	if params.ErrRate < 0 || params.ErrRate > 1 ||
+		params.DisconnectRate < 0 || params.DisconnectRate > 1 {
+		return "", ChaosParams{}, false, errors.Errorf(
+			"Chaos probabilities must be between 0 and 1 in %q", addr)
+	}
+	return innerAddr, params, true, nil
+}
+
+// serverChaosConfig is the subset of the Config interface needed by
+// the fault-injecting servers.
+type serverChaosConfig interface {
+	logMaker
+	clockGetter
+	KBFSOps() KBFSOps
+}
+
+// serverChaos decides which faults to inject into the calls to one
+// wrapped server, and reports injected disconnects through
+// KBFSOps.PushConnectionStatusChange.
+type serverChaos struct {
+	config  serverChaosConfig
+	service string
+	params  ChaosParams
+	log     logger.Logger
+
+	lock sync.Mutex
+	rand *rand.Rand
+	// disconnectedUntil is non-zero during a disconnect.
+	disconnectedUntil time.Time
+	// disconnectCh is closed when the next disconnect starts.
+	disconnectCh chan struct{}
+}
+
+func newServerChaos(config serverChaosConfig, service string,
+	params ChaosParams) *serverChaos {
+	seed := params.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	log := config.MakeLogger("CHAOS")
+	log.Debug("Injecting faults into %s with %+v (seed=%d)",
+		service, params, seed)
+	return &serverChaos{
+		config:       config,
+		service:      service,
+		params:       params,
+		log:          log,
+		rand:         rand.New(rand.NewSource(seed)),
+		disconnectCh: make(chan struct{}),
+	}
+}
+
+func (sc *serverChaos) pushStatus(err error) {
+	if kbfsOps := sc.config.KBFSOps(); kbfsOps != nil {
+		kbfsOps.PushConnectionStatusChange(sc.service, err)
+	}
+}
+
+// isConnected returns false during an injected disconnect.
+func (sc *serverChaos) isConnected() bool {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	return sc.disconnectedUntil.IsZero() ||
+		!sc.config.Clock().Now().Before(sc.disconnectedUntil)
+}
+
+// disconnected returns a channel that is closed when the next
+// injected disconnect starts.
+func (sc *serverChaos) disconnected() <-chan struct{} {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	return sc.disconnectCh
+}
+
+// roll decides whether the given call fails without reaching the
+// wrapped server.
+func (sc *serverChaos) roll(op string) error {
+	var pushErr error
+	pushReconnected := false
+	defer func() {
+		// Push outside of the lock, since KBFSOps may call back
+		// into the server.
+		if pushErr != nil {
+			sc.pushStatus(pushErr)
+		} else if pushReconnected {
+			sc.pushStatus(nil)
+		}
+	}()
+
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	now := sc.config.Clock().Now()
+	if !sc.disconnectedUntil.IsZero() {
+		if now.Before(sc.disconnectedUntil) {
+			return ChaosInjectedError{sc.service, op, true}
+		}
+		sc.log.Debug("Ending injected disconnect of %s", sc.service)
+		sc.disconnectedUntil = time.Time{}
+		pushReconnected = true
+	}
+
+	if sc.params.DisconnectRate > 0 &&
+		sc.rand.Float64() < sc.params.DisconnectRate {
+		sc.log.Debug("Injecting a %s disconnect of %s during %s",
+			sc.params.DisconnectDuration, sc.service, op)
+		sc.disconnectedUntil = now.Add(sc.params.DisconnectDuration)
+		close(sc.disconnectCh)
+		sc.disconnectCh = make(chan struct{})
+		pushErr = ChaosInjectedError{sc.service, op, true}
+		pushReconnected = false
+		return pushErr
+	}
+
+	if sc.params.ErrRate > 0 && sc.rand.Float64() < sc.params.ErrRate {
+		sc.log.Debug("Injecting an error into %s %s", sc.service, op)
+		return ChaosInjectedError{sc.service, op, false}
+	}
+	return nil
+}
+
+// transferTime returns how long it takes to transfer the given
+// number of bytes at the configured bandwidth.
+func (sc *serverChaos) transferTime(numBytes int) time.Duration {
+	if sc.params.Bandwidth <= 0 || numBytes <= 0 {
+		return 0
+	}
+	return time.Duration(
+		int64(numBytes) * int64(time.Second) / sc.params.Bandwidth)
+}
+
+func (sc *serverChaos) delay(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return errors.WithStack(ctx.Err())
+	}
+}
+
+// before is called before each call to the wrapped server, with the
+// number of bytes being sent.
+func (sc *serverChaos) before(
+	ctx context.Context, op string, numBytes int) error {
+	if err := sc.roll(op); err != nil {
+		return err
+	}
+	return sc.delay(ctx, sc.params.Latency+sc.transferTime(numBytes))
+}
+
+// BlockServerChaos delegates to another BlockServer, injecting
+// latency, errors, disconnects and a bandwidth cap into its calls.
+type BlockServerChaos struct {
+	BlockServer
+	chaos *serverChaos
+}
+
+var _ BlockServer = BlockServerChaos{}
+
+// NewBlockServerChaos returns a BlockServerChaos wrapping the given
+// delegate.
+func NewBlockServerChaos(config serverChaosConfig, delegate BlockServer,
+	params ChaosParams) BlockServerChaos {
+	return BlockServerChaos{
+		delegate, newServerChaos(config, BlockServiceName, params)}
+}
+
+// Get implements the BlockServer interface for BlockServerChaos.
+func (b BlockServerChaos) Get(ctx context.Context, tlfID tlf.ID,
+	id kbfsblock.ID, context kbfsblock.Context) (
+	[]byte, kbfscrypto.BlockCryptKeyServerHalf, error) {
+	if err := b.chaos.before(ctx, "Get", 0); err != nil {
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, err
+	}
+	buf, serverHalf, err := b.BlockServer.Get(ctx, tlfID, id, context)
+	if err != nil {
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, err
+	}
+	// Model the download as happening after the request.
+	if err := b.chaos.delay(
+		ctx, b.chaos.transferTime(len(buf))); err != nil {
+		return nil, kbfscrypto.BlockCryptKeyServerHalf{}, err
+	}
+	return buf, serverHalf, nil
+}
+
+// Put implements the BlockServer interface for BlockServerChaos.
+func (b BlockServerChaos) Put(ctx context.Context, tlfID tlf.ID,
+	id kbfsblock.ID, context kbfsblock.Context, buf []byte,
+	serverHalf kbfscrypto.BlockCryptKeyServerHalf) error {
+	if err := b.chaos.before(ctx, "Put", len(buf)); err != nil {
+		return err
+	}
+	return b.BlockServer.Put(ctx, tlfID, id, context, buf, serverHalf)
+}
+
+// PutAgain implements the BlockServer interface for BlockServerChaos.
+func (b BlockServerChaos) PutAgain(ctx context.Context, tlfID tlf.ID,
+	id kbfsblock.ID, context kbfsblock.Context, buf []byte,
+	serverHalf kbfscrypto.BlockCryptKeyServerHalf) error {
+	if err := b.chaos.before(ctx, "PutAgain", len(buf)); err != nil {
+		return err
+	}
+	return b.BlockServer.PutAgain(ctx, tlfID, id, context, buf, serverHalf)
+}
+
+// AddBlockReference implements the BlockServer interface for
+// BlockServerChaos.
+func (b BlockServerChaos) AddBlockReference(ctx context.Context,
+	tlfID tlf.ID, id kbfsblock.ID, context kbfsblock.Context) error {
+	if err := b.chaos.before(ctx, "AddBlockReference", 0); err != nil {
+		return err
+	}
+	return b.BlockServer.AddBlockReference(ctx, tlfID, id, context)
+}
+
+// RemoveBlockReferences implements the BlockServer interface for
+// BlockServerChaos.
+func (b BlockServerChaos) RemoveBlockReferences(ctx context.Context,
+	tlfID tlf.ID, contexts kbfsblock.ContextMap) (
+	map[kbfsblock.ID]int, error) {
+	if err := b.chaos.before(ctx, "RemoveBlockReferences", 0); err != nil {
+		return nil, err
+	}
+	return b.BlockServer.RemoveBlockReferences(ctx, tlfID, contexts)
+}
+
+// ArchiveBlockReferences implements the BlockServer interface for
+// BlockServerChaos.
+func (b BlockServerChaos) ArchiveBlockReferences(ctx context.Context,
+	tlfID tlf.ID, contexts kbfsblock.ContextMap) error {
+	if err := b.chaos.before(ctx, "ArchiveBlockReferences", 0); err != nil {
+		return err
+	}
+	return b.BlockServer.ArchiveBlockReferences(ctx, tlfID, contexts)
+}
+
+// GetUserQuotaInfo implements the BlockServer interface for
+// BlockServerChaos.
+func (b BlockServerChaos) GetUserQuotaInfo(ctx context.Context) (
+	*kbfsblock.QuotaInfo, error) {
+	if err := b.chaos.before(ctx, "GetUserQuotaInfo", 0); err != nil {
+		return nil, err
+	}
+	return b.BlockServer.GetUserQuotaInfo(ctx)
+}
+
+// GetTeamQuotaInfo implements the BlockServer interface for
+// BlockServerChaos.
+func (b BlockServerChaos) GetTeamQuotaInfo(
+	ctx context.Context, tid keybase1.TeamID) (*kbfsblock.QuotaInfo, error) {
+	if err := b.chaos.before(ctx, "GetTeamQuotaInfo", 0); err != nil {
+		return nil, err
+	}
+	return b.BlockServer.GetTeamQuotaInfo(ctx, tid)
+}
+
+// MDServerChaos delegates to another MDServer, injecting latency,
+// errors and disconnects into its calls.
+type MDServerChaos struct {
+	MDServer
+	chaos *serverChaos
+}
+
+var _ MDServer = MDServerChaos{}
+
+// NewMDServerChaos returns an MDServerChaos wrapping the given
+// delegate.
+func NewMDServerChaos(config serverChaosConfig, delegate MDServer,
+	params ChaosParams) MDServerChaos {
+	return MDServerChaos{
+		delegate, newServerChaos(config, MDServiceName, params)}
+}
+
+// GetForHandle implements the MDServer interface for MDServerChaos.
+func (md MDServerChaos) GetForHandle(ctx context.Context,
+	handle tlf.Handle, mStatus MergeStatus) (
+	tlf.ID, *RootMetadataSigned, error) {
+	if err := md.chaos.before(ctx, "GetForHandle", 0); err != nil {
+		return tlf.ID{}, nil, err
+	}
+	return md.MDServer.GetForHandle(ctx, handle, mStatus)
+}
+
+// GetForTLF implements the MDServer interface for MDServerChaos.
+func (md MDServerChaos) GetForTLF(ctx context.Context, id tlf.ID,
+	bid BranchID, mStatus MergeStatus) (*RootMetadataSigned, error) {
+	if err := md.chaos.before(ctx, "GetForTLF", 0); err != nil {
+		return nil, err
+	}
+	return md.MDServer.GetForTLF(ctx, id, bid, mStatus)
+}
+
+// GetRange implements the MDServer interface for MDServerChaos.
+func (md MDServerChaos) GetRange(ctx context.Context, id tlf.ID,
+	bid BranchID, mStatus MergeStatus, start, stop kbfsmd.Revision) (
+	[]*RootMetadataSigned, error) {
+	if err := md.chaos.before(ctx, "GetRange", 0); err != nil {
+		return nil, err
+	}
+	return md.MDServer.GetRange(ctx, id, bid, mStatus, start, stop)
+}
+
+// Put implements the MDServer interface for MDServerChaos.
+func (md MDServerChaos) Put(ctx context.Context, rmds *RootMetadataSigned,
+	extra ExtraMetadata) error {
+	if err := md.chaos.before(ctx, "Put", 0); err != nil {
+		return err
+	}
+	return md.MDServer.Put(ctx, rmds, extra)
+}
+
+// PruneBranch implements the MDServer interface for MDServerChaos.
+func (md MDServerChaos) PruneBranch(
+	ctx context.Context, id tlf.ID, bid BranchID) error {
+	if err := md.chaos.before(ctx, "PruneBranch", 0); err != nil {
+		return err
+	}
+	return md.MDServer.PruneBranch(ctx, id, bid)
+}
+
+// RegisterForUpdate implements the MDServer interface for
+// MDServerChaos.  An injected disconnect cancels the registration,
+// as a real disconnect would.
+func (md MDServerChaos) RegisterForUpdate(ctx context.Context, id tlf.ID,
+	currHead kbfsmd.Revision) (<-chan error, error) {
+	if err := md.chaos.before(ctx, "RegisterForUpdate", 0); err != nil {
+		return nil, err
+	}
+	disconnected := md.chaos.disconnected()
+	innerCh, err := md.MDServer.RegisterForUpdate(ctx, id, currHead)
+	if err != nil {
+		return nil, err
+	}
+
+	c := make(chan error, 1)
+	go func() {
+		defer close(c)
+		select {
+		case err := <-innerCh:
+			c <- err
+		case <-disconnected:
+			// Clear out the wrapped registration, so that the
+			// caller can register again once reconnected.
+			md.MDServer.CancelRegistration(context.Background(), id)
+			<-innerCh
+			c <- ChaosInjectedError{MDServiceName, "RegisterForUpdate", true}
+		}
+	}()
+	return c, nil
+}
+
+// TruncateLock implements the MDServer interface for MDServerChaos.
+func (md MDServerChaos) TruncateLock(
+	ctx context.Context, id tlf.ID) (bool, error) {
+	if err := md.chaos.before(ctx, "TruncateLock", 0); err != nil {
+		return false, err
+	}
+	return md.MDServer.TruncateLock(ctx, id)
+}
+
+// TruncateUnlock implements the MDServer interface for MDServerChaos.
+func (md MDServerChaos) TruncateUnlock(
+	ctx context.Context, id tlf.ID) (bool, error) {
+	if err := md.chaos.before(ctx, "TruncateUnlock", 0); err != nil {
+		return false, err
+	}
+	return md.MDServer.TruncateUnlock(ctx, id)
+}
+
+// IsConnected implements the MDServer interface for MDServerChaos.
+func (md MDServerChaos) IsConnected() bool {
+	return md.chaos.isConnected() && md.MDServer.IsConnected()
+}
+
+// GetLatestHandleForTLF implements the MDServer interface for
+// MDServerChaos.
+func (md MDServerChaos) GetLatestHandleForTLF(
+	ctx context.Context, id tlf.ID) (tlf.Handle, error) {
+	if err := md.chaos.before(ctx, "GetLatestHandleForTLF", 0); err != nil {
+		return tlf.Handle{}, err
+	}
+	return md.MDServer.GetLatestHandleForTLF(ctx, id)
+}
+
+// GetKeyBundles implements the MDServer interface for MDServerChaos.
+func (md MDServerChaos) GetKeyBundles(ctx context.Context, tlfID tlf.ID,
+	wkbID TLFWriterKeyBundleID, rkbID TLFReaderKeyBundleID) (
+	*TLFWriterKeyBundleV3, *TLFReaderKeyBundleV3, error) {
+	if err := md.chaos.before(ctx, "GetKeyBundles", 0); err != nil {
+		return nil, nil, err
+	}
+	return md.MDServer.GetKeyBundles(ctx, tlfID, wkbID, rkbID)
+}
+
+// GetMerkleProof implements the MDServer interface for MDServerChaos.
+func (md MDServerChaos) GetMerkleProof(ctx context.Context, id tlf.ID) (
+	*MerkleRoot, MerkleInclusionProof, error) {
+	if err := md.chaos.before(ctx, "GetMerkleProof", 0); err != nil {
+		return nil, nil, err
+	}
+	return md.MDServer.GetMerkleProof(ctx, id)
+}
@@ -0,0 +1,115 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseChaosAddr(t *testing.T) {
+	innerAddr, params, ok, err := parseChaosAddr("dir:/tmp/x")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	innerAddr, params, ok, err = parseChaosAddr(
+		"chaos:dir:/tmp/x?latency=200ms&err=0.05&disconnect=0.01&" +
+			"disconnect-time=1m&bandwidth=1mi&seed=7")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "dir:/tmp/x", innerAddr)
+	require.Equal(t, ChaosParams{
+		Latency:            200 * time.Millisecond,
+		ErrRate:            0.05,
+		DisconnectRate:     0.01,
+		DisconnectDuration: time.Minute,
+		Bandwidth:          1024 * 1024,
+		Seed:               7,
+	}, params)
+
+	innerAddr, params, ok, err = parseChaosAddr("chaos:memory")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, memoryAddr, innerAddr)
+	require.Equal(t, ChaosParams{
+		DisconnectDuration: defaultChaosDisconnectDuration,
+	}, params)
+
+	for _, bad := range []string{
+		"chaos:", "chaos:?err=0.1", "chaos:memory?err=2",
+		"chaos:memory?latency=fast", "chaos:memory?bogus=1",
+	} {
+		_, _, _, err = parseChaosAddr(bad)
+		require.Error(t, err, bad)
+	}
+}
+
+func TestMDServerChaosDisconnect(t *testing.T) {
+	var u1 libkb.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, u1)
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	clock := newTestClockNow()
+	config.SetClock(clock)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, u1.String(), tlf.Private)
+	fb := rootNode.GetFolderBranch()
+	head, err := config.MDOps().GetForTLF(ctx, fb.Tlf)
+	require.NoError(t, err)
+
+	// Use a separate session, so that its update registration
+	// doesn't collide with the one made by config's KBFSOps.
+	mdServer := config.MDServer().(mdServerLocal).copy(
+		mdServerLocalConfigAdapter{config})
+	defer mdServer.Shutdown()
+	chaos := NewMDServerChaos(config, mdServer, ChaosParams{
+		DisconnectDuration: time.Minute,
+		Seed:               1,
+	})
+
+	t.Log("Without faults, calls go through")
+	_, err = chaos.GetForTLF(ctx, fb.Tlf, NullBranchID, Merged)
+	require.NoError(t, err)
+	updateCh, err := chaos.RegisterForUpdate(ctx, fb.Tlf, head.Revision())
+	require.NoError(t, err)
+
+	t.Log("A disconnect fails calls and registrations, and is reported")
+	chaos.chaos.params.DisconnectRate = 1
+	_, err = chaos.GetForTLF(ctx, fb.Tlf, NullBranchID, Merged)
+	require.Equal(t, ChaosInjectedError{MDServiceName, "GetForTLF", true}, err)
+	chaos.chaos.params.DisconnectRate = 0
+	require.False(t, chaos.IsConnected())
+	select {
+	case err := <-updateCh:
+		require.IsType(t, ChaosInjectedError{}, err)
+	case <-ctx.Done():
+		t.Fatal(ctx.Err())
+	}
+	_, err = chaos.GetForTLF(ctx, fb.Tlf, NullBranchID, Merged)
+	require.Equal(t, ChaosInjectedError{MDServiceName, "GetForTLF", true}, err)
+	status, _, err := config.KBFSOps().Status(ctx)
+	require.NoError(t, err)
+	require.Contains(t, status.FailingServices, MDServiceName)
+
+	t.Log("Calls go through again after the disconnect")
+	clock.Add(time.Minute)
+	require.True(t, chaos.IsConnected())
+	_, err = chaos.GetForTLF(ctx, fb.Tlf, NullBranchID, Merged)
+	require.NoError(t, err)
+	status, _, err = config.KBFSOps().Status(ctx)
+	require.NoError(t, err)
+	require.NotContains(t, status.FailingServices, MDServiceName)
+	_, err = chaos.RegisterForUpdate(ctx, fb.Tlf, head.Revision())
+	require.NoError(t, err)
+
+	t.Log("Injected errors fail single calls")
+	chaos.chaos.params.ErrRate = 1
+	_, err = chaos.GetForTLF(ctx, fb.Tlf, NullBranchID, Merged)
+	require.Equal(t, ChaosInjectedError{MDServiceName, "GetForTLF", false}, err)
+	require.True(t, chaos.IsConnected())
+}
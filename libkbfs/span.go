@@ -0,0 +1,171 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"crypto/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/keybase/kbfs/kbfsblock"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/tlf"
+	"golang.org/x/net/context"
+)
+
+// SpanAttribute is a key/value pair describing a span.
+type SpanAttribute struct {
+	Key   string
+	Value string
+}
+
+// Keys for the span attributes set by KBFS.
+const (
+	spanAttrKeyTitle    = "kbfs.title"
+	spanAttrKeyTLF      = "kbfs.tlf"
+	spanAttrKeyRevision = "kbfs.revision"
+	spanAttrKeyBlockID  = "kbfs.block_id"
+)
+
+func spanAttrTitle(title string) SpanAttribute {
+	return SpanAttribute{spanAttrKeyTitle, title}
+}
+
+func spanAttrTLF(tlfID tlf.ID) SpanAttribute {
+	return SpanAttribute{spanAttrKeyTLF, tlfID.String()}
+}
+
+func spanAttrRevision(rev kbfsmd.Revision) SpanAttribute {
+	return SpanAttribute{spanAttrKeyRevision, strconv.FormatInt(int64(rev), 10)}
+}
+
+func spanAttrBlockID(id kbfsblock.ID) SpanAttribute {
+	return SpanAttribute{spanAttrKeyBlockID, id.String()}
+}
+
+// SpanData describes a single finished span.
+type SpanData struct {
+	TraceID      [16]byte
+	SpanID       [8]byte
+	ParentSpanID [8]byte
+	Name         string
+	Start        time.Time
+	End          time.Time
+	Attributes   []SpanAttribute
+	// Err, if non-nil, is the error the spanned operation failed
+	// with.
+	Err error
+}
+
+// HasParent returns whether this span has a parent span.
+func (sd SpanData) HasParent() bool {
+	return sd.ParentSpanID != [8]byte{}
+}
+
+// SpanExporter receives finished spans, e.g. to write them out to a
+// file.  Implementations must be safe for concurrent use.
+type SpanExporter interface {
+	// ExportSpan is called once for each finished span.  It must
+	// not block for long, since it is called inline with the
+	// spanned operation.
+	ExportSpan(sd SpanData)
+	// Shutdown flushes any buffered spans and releases all the
+	// exporter's resources.
+	Shutdown(ctx context.Context) error
+}
+
+// span is an in-progress span, attached to a context.
+type span struct {
+	exporter SpanExporter
+
+	lock     sync.Mutex
+	data     SpanData
+	finished bool
+}
+
+type ctxSpanKeyType int
+
+const (
+	// ctxSpanKey is the context key for the current span.
+	ctxSpanKey ctxSpanKeyType = iota
+)
+
+func spanFromContext(ctx context.Context) *span {
+	s, _ := ctx.Value(ctxSpanKey).(*span)
+	return s
+}
+
+// startRootSpan returns a new context with a new span attached.  If
+// the given context already has a span, the new span is its child
+// and is exported the same way as its parent; otherwise the new span
+// starts a new trace exported to `exporter`.  If there's no parent
+// and `exporter` is nil, the context is returned unchanged.
+func startRootSpan(ctx context.Context, exporter SpanExporter, name string,
+	attrs ...SpanAttribute) context.Context {
+	parent := spanFromContext(ctx)
+	if parent == nil && exporter == nil {
+		return ctx
+	}
+
+	s := &span{
+		exporter: exporter,
+		data: SpanData{
+			Name:       name,
+			Start:      time.Now(),
+			Attributes: attrs,
+		},
+	}
+	// If the random source fails, the IDs are just less unique.
+	_, _ = rand.Read(s.data.SpanID[:])
+	if parent != nil {
+		s.exporter = parent.exporter
+		s.data.TraceID = parent.data.TraceID
+		s.data.ParentSpanID = parent.data.SpanID
+	} else {
+		_, _ = rand.Read(s.data.TraceID[:])
+	}
+	return context.WithValue(ctx, ctxSpanKey, s)
+}
+
+// startSpan returns a new context with a child of the context's
+// current span attached, or the given context unchanged if it isn't
+// part of a trace.
+func startSpan(ctx context.Context, name string,
+	attrs ...SpanAttribute) context.Context {
+	return startRootSpan(ctx, nil, name, attrs...)
+}
+
+// addSpanAttributes adds the given attributes to the context's
+// current span, if any.
+func addSpanAttributes(ctx context.Context, attrs ...SpanAttribute) {
+	s := spanFromContext(ctx)
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.data.Attributes = append(s.data.Attributes, attrs...)
+}
+
+// finishSpan ends the context's current span, if any, and exports
+// it.  Only the first call for a given span has any effect.
+func finishSpan(ctx context.Context, err error) {
+	s := spanFromContext(ctx)
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	if s.finished {
+		s.lock.Unlock()
+		return
+	}
+	s.finished = true
+	s.data.End = time.Now()
+	s.data.Err = err
+	sd := s.data
+	s.lock.Unlock()
+	s.exporter.ExportSpan(sd)
+}
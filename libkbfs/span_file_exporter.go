@@ -0,0 +1,261 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/ioutil"
+	"golang.org/x/net/context"
+)
+
+const (
+	// The number of finished spans that can be waiting to be
+	// written out before new ones are dropped.
+	spanFileExporterBufferSize = 10000
+	// The most spans written out in one line of the file.
+	spanFileExporterMaxBatch = 512
+	// How often buffered spans are written out, even if there
+	// aren't enough for a full batch.
+	spanFileExporterFlushPeriod = 5 * time.Second
+
+	otlpSpanKindInternal = 1
+	otlpStatusCodeError  = 2
+)
+
+// The following types mirror the OTLP/JSON encoding of an
+// ExportTraceServiceRequest, so that the files can be read by
+// standard OpenTelemetry tooling.
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpTracesData struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func makeOTLPSpan(sd SpanData) otlpSpan {
+	s := otlpSpan{
+		TraceID:           hex.EncodeToString(sd.TraceID[:]),
+		SpanID:            hex.EncodeToString(sd.SpanID[:]),
+		Name:              sd.Name,
+		Kind:              otlpSpanKindInternal,
+		StartTimeUnixNano: strconv.FormatInt(sd.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(sd.End.UnixNano(), 10),
+	}
+	if sd.HasParent() {
+		s.ParentSpanID = hex.EncodeToString(sd.ParentSpanID[:])
+	}
+	for _, attr := range sd.Attributes {
+		s.Attributes = append(s.Attributes,
+			otlpKeyValue{attr.Key, otlpAnyValue{attr.Value}})
+	}
+	if sd.Err != nil {
+		s.Status = otlpStatus{otlpStatusCodeError, sd.Err.Error()}
+	}
+	return s
+}
+
+// SpanFileExporter is a SpanExporter that appends spans to a local
+// file in the OpenTelemetry OTLP/JSON format, one batch of spans per
+// line, as written by the OpenTelemetry Collector's file exporter.
+type SpanFileExporter struct {
+	log      logger.Logger
+	f        *os.File
+	w        *bufio.Writer
+	spanCh   chan SpanData
+	shutdown chan struct{}
+	done     chan struct{}
+
+	shutdownOnce sync.Once
+	lock         sync.Mutex
+	numDropped   int
+	// closeErr is only valid once done is closed.
+	closeErr error
+}
+
+var _ SpanExporter = (*SpanFileExporter)(nil)
+
+// NewSpanFileExporter returns a SpanFileExporter that appends to the
+// file at the given path, creating it if necessary.
+func NewSpanFileExporter(
+	path string, log logger.Logger) (*SpanFileExporter, error) {
+	f, err := ioutil.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	e := &SpanFileExporter{
+		log:      log,
+		f:        f,
+		w:        bufio.NewWriter(f),
+		spanCh:   make(chan SpanData, spanFileExporterBufferSize),
+		shutdown: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go e.loop()
+	return e, nil
+}
+
+// ExportSpan implements the SpanExporter interface for
+// SpanFileExporter.  If too many spans are waiting to be written
+// out, the span is dropped.
+func (e *SpanFileExporter) ExportSpan(sd SpanData) {
+	select {
+	case <-e.shutdown:
+		return
+	default:
+	}
+
+	select {
+	case e.spanCh <- sd:
+	default:
+		e.lock.Lock()
+		defer e.lock.Unlock()
+		e.numDropped++
+	}
+}
+
+func (e *SpanFileExporter) writeBatch(batch []SpanData) {
+	if len(batch) == 0 {
+		return
+	}
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, sd := range batch {
+		spans = append(spans, makeOTLPSpan(sd))
+	}
+	data := otlpTracesData{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: []otlpKeyValue{
+					{"service.name", otlpAnyValue{"kbfs"}},
+				},
+			},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{"github.com/keybase/kbfs/libkbfs"},
+				Spans: spans,
+			}},
+		}},
+	}
+	buf, err := json.Marshal(data)
+	if err == nil {
+		buf = append(buf, '\n')
+		_, err = e.w.Write(buf)
+	}
+	if err != nil {
+		e.log.Warning("Couldn't write %d spans: %+v", len(batch), err)
+	}
+}
+
+func (e *SpanFileExporter) flush() {
+	err := e.w.Flush()
+	if err != nil {
+		e.log.Warning("Couldn't flush spans: %+v", err)
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.numDropped > 0 {
+		e.log.Warning("Dropped %d spans", e.numDropped)
+		e.numDropped = 0
+	}
+}
+
+func (e *SpanFileExporter) loop() {
+	defer close(e.done)
+	ticker := time.NewTicker(spanFileExporterFlushPeriod)
+	defer ticker.Stop()
+	batch := make([]SpanData, 0, spanFileExporterMaxBatch)
+	for {
+		select {
+		case sd := <-e.spanCh:
+			batch = append(batch, sd)
+			if len(batch) >= spanFileExporterMaxBatch {
+				e.writeBatch(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			e.writeBatch(batch)
+			batch = batch[:0]
+			e.flush()
+		case <-e.shutdown:
+			// Drain whatever is still buffered.
+			for {
+				select {
+				case sd := <-e.spanCh:
+					batch = append(batch, sd)
+					if len(batch) >= spanFileExporterMaxBatch {
+						e.writeBatch(batch)
+						batch = batch[:0]
+					}
+				default:
+					e.writeBatch(batch)
+					e.flush()
+					e.closeErr = e.f.Close()
+					return
+				}
+			}
+		}
+	}
+}
+
+// Shutdown implements the SpanExporter interface for
+// SpanFileExporter.
+func (e *SpanFileExporter) Shutdown(ctx context.Context) error {
+	e.shutdownOnce.Do(func() { close(e.shutdown) })
+	select {
+	case <-e.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return e.closeErr
+}
@@ -0,0 +1,162 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+type testSpanExporter struct {
+	lock  sync.Mutex
+	spans []SpanData
+}
+
+func (e *testSpanExporter) ExportSpan(sd SpanData) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.spans = append(e.spans, sd)
+}
+
+func (e *testSpanExporter) Shutdown(_ context.Context) error {
+	return nil
+}
+
+func (e *testSpanExporter) getSpans(name string) (res []SpanData) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	for _, sd := range e.spans {
+		if sd.Name == name {
+			res = append(res, sd)
+		}
+	}
+	return res
+}
+
+func getSpanAttr(sd SpanData, key string) string {
+	for _, attr := range sd.Attributes {
+		if attr.Key == key {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+func TestSpanPropagation(t *testing.T) {
+	var u1 libkb.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, u1)
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, u1.String(), tlf.Private)
+	fb := rootNode.GetFolderBranch()
+
+	t.Log("Nothing is traced without an exporter")
+	require.Nil(t,
+		spanFromContext(config.MaybeStartTrace(ctx, "Test.Op", "title")))
+
+	exporter := &testSpanExporter{}
+	config.SetSpanExporter(exporter)
+
+	t.Log("KBFSOps calls are children of the caller's trace")
+	traceCtx := config.MaybeStartTrace(ctx, "Test.Op", "title")
+	kbfsOps := config.KBFSOps()
+	_, _, err := kbfsOps.CreateDir(traceCtx, rootNode, "a")
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(traceCtx, fb)
+	require.NoError(t, err)
+	config.MaybeFinishTrace(traceCtx, nil)
+	// A second finish has no effect.
+	config.MaybeFinishTrace(traceCtx, errors.New("fake"))
+
+	roots := exporter.getSpans("Test.Op")
+	require.Len(t, roots, 1)
+	root := roots[0]
+	require.False(t, root.HasParent())
+	require.NoError(t, root.Err)
+	require.Equal(t, "title", getSpanAttr(root, spanAttrKeyTitle))
+	for _, name := range []string{"KBFSOps.CreateDir", "KBFSOps.SyncAll"} {
+		spans := exporter.getSpans(name)
+		require.Len(t, spans, 1, name)
+		require.Equal(t, root.TraceID, spans[0].TraceID)
+		require.Equal(t, root.SpanID, spans[0].ParentSpanID)
+		require.Equal(t, fb.Tlf.String(), getSpanAttr(spans[0], spanAttrKeyTLF))
+		require.False(t, spans[0].End.Before(spans[0].Start))
+	}
+
+	t.Log("KBFSOps calls start their own trace otherwise, and record errors")
+	_, _, err = kbfsOps.Lookup(ctx, rootNode, "b")
+	require.IsType(t, NoSuchNameError{}, errors.Cause(err))
+	lookups := exporter.getSpans("KBFSOps.Lookup")
+	require.Len(t, lookups, 1)
+	require.False(t, lookups[0].HasParent())
+	require.NotEqual(t, root.TraceID, lookups[0].TraceID)
+	require.Equal(t, err, lookups[0].Err)
+}
+
+func TestSpanFileExporter(t *testing.T) {
+	tempdir, err := ioutil.TempDir(os.TempDir(), "span_file_exporter")
+	require.NoError(t, err)
+	defer func() {
+		err := ioutil.RemoveAll(tempdir)
+		assert.NoError(t, err)
+	}()
+
+	path := filepath.Join(tempdir, "trace.json")
+	exporter, err := NewSpanFileExporter(path, logger.NewTestLogger(t))
+	require.NoError(t, err)
+
+	ctx := startRootSpan(context.Background(), exporter, "parent")
+	childCtx := startSpan(ctx, "child", spanAttrTLF(tlf.FakeID(1, tlf.Private)))
+	finishSpan(childCtx, errors.New("fake"))
+	finishSpan(ctx, nil)
+	err = exporter.Shutdown(context.Background())
+	require.NoError(t, err)
+	// Spans exported after shutdown are dropped.
+	exporter.ExportSpan(SpanData{Name: "late"})
+
+	f, err := ioutil.OpenFile(path, os.O_RDONLY, 0)
+	require.NoError(t, err)
+	defer f.Close()
+	var spans []otlpSpan
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var data otlpTracesData
+		err = json.Unmarshal(scanner.Bytes(), &data)
+		require.NoError(t, err)
+		for _, rs := range data.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}
+	require.NoError(t, scanner.Err())
+
+	require.Len(t, spans, 2)
+	child, parent := spans[0], spans[1]
+	require.Equal(t, "child", child.Name)
+	require.Equal(t, "parent", parent.Name)
+	require.Equal(t, parent.TraceID, child.TraceID)
+	require.Equal(t, parent.SpanID, child.ParentSpanID)
+	require.Equal(t, "", parent.ParentSpanID)
+	require.Equal(t, otlpStatusCodeError, child.Status.Code)
+	require.Equal(t, "fake", child.Status.Message)
+	require.Equal(t, 0, parent.Status.Code)
+	require.Equal(t, []otlpKeyValue{
+		{spanAttrKeyTLF, otlpAnyValue{tlf.FakeID(1, tlf.Private).String()}},
+	}, child.Attributes)
+}
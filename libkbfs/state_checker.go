@@ -85,7 +85,7 @@ func (sc *StateChecker) findAllBlocksInPath(ctx context.Context,
 }
 
 func (sc *StateChecker) getLastGCData(ctx context.Context,
-	tlfID tlf.ID) (time.Time, kbfsmd.Revision) {
+	tlfID tlf.ID, head ImmutableRootMetadata) (time.Time, kbfsmd.Revision) {
 	config, ok := sc.config.(*ConfigLocal)
 	if !ok {
 		return time.Time{}, kbfsmd.RevisionUninitialized
@@ -108,7 +108,9 @@ func (sc *StateChecker) getLastGCData(ctx context.Context,
 
 	sc.log.CDebugf(ctx, "Last qr data for TLF %s: revTime=%s, rev=%d",
 		tlfID, latestTime, latestRev)
-	return latestTime.Add(-sc.config.QuotaReclamationMinUnrefAge()), latestRev
+	unrefAge := retentionPolicyForMD(
+		sc.config, tlfID, head.ReadOnly()).minUnrefAge(sc.config)
+	return latestTime.Add(-unrefAge), latestRev
 }
 
 // CheckMergedState verifies that the state for the given tlf is
@@ -140,7 +142,8 @@ func (sc *StateChecker) CheckMergedState(ctx context.Context, tlfID tlf.ID) erro
 
 	fb := FolderBranch{tlfID, MasterBranch}
 	ops := kbfsOps.getOps(context.Background(), fb, FavoritesOpNoChange)
-	lastGCRevisionTime, lastGCRev := sc.getLastGCData(ctx, tlfID)
+	lastGCRevisionTime, lastGCRev := sc.getLastGCData(
+		ctx, tlfID, rmds[len(rmds)-1])
 
 	// Build the expected block list.
 	expectedLiveBlocks := make(map[BlockPointer]bool)
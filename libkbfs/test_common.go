@@ -197,6 +197,9 @@ func configAsUserWithMode(config *ConfigLocal,
 	loggedInUser libkb.NormalizedUsername, mode InitMode) *ConfigLocal {
 	c := newConfigForTest(mode, config.loggerFn)
 	c.SetMetadataVersion(config.MetadataVersion())
+	c.SetOpsVersion(config.OpsVersion())
+	c.SetBlockCryptVersion(config.BlockCryptVersion())
+	c.SetBlockPadding(config.BlockPadding())
 	c.SetRekeyWithPromptWaitTime(config.RekeyWithPromptWaitTime())
 
 	kbfsOps := NewKBFSOpsStandard(c)
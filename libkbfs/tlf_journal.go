@@ -7,6 +7,7 @@ package libkbfs
 import (
 	"fmt"
 	"path/filepath"
+	"strconv"
 	"sync"
 	"time"
 
@@ -45,6 +46,8 @@ type tlfJournalConfig interface {
 	diskLimitTimeout() time.Duration
 	teamMembershipChecker() TeamMembershipChecker
 	BGFlushDirOpBatchSize() int
+	spanExporterGetter
+	blockTransferControllersGetter
 }
 
 // tlfJournalConfigWrapper is an adapter for Config objects to the
@@ -731,6 +734,12 @@ func (j *tlfJournal) flush(ctx context.Context) (err error) {
 	j.flushLock.Lock()
 	defer j.flushLock.Unlock()
 
+	// Flushes happen in the background, so each one starts its own
+	// trace.
+	ctx = startRootSpan(ctx, j.config.SpanExporter(), "tlfJournal.flush",
+		spanAttrTLF(j.tlfID))
+	defer func() { finishSpan(ctx, err) }()
+
 	flushedBlockEntries := 0
 	flushedMDEntries := 0
 	defer func() {
@@ -960,6 +969,14 @@ func (j *tlfJournal) flushBlockEntries(
 	ctx context.Context, end journalOrdinal) (
 	numFlushed int, maxMDRevToFlush kbfsmd.Revision,
 	converted bool, err error) {
+	ctx = startSpan(ctx, "tlfJournal.flushBlockEntries",
+		spanAttrTLF(j.tlfID))
+	defer func() {
+		addSpanAttributes(ctx, spanAttrRevision(maxMDRevToFlush),
+			SpanAttribute{"kbfs.num_blocks", strconv.Itoa(numFlushed)})
+		finishSpan(ctx, err)
+	}()
+
 	entries, maxMDRevToFlush, err := j.getNextBlockEntriesToFlush(ctx, end)
 	if err != nil {
 		return 0, kbfsmd.RevisionUninitialized, false, err
@@ -1009,7 +1026,8 @@ func (j *tlfJournal) flushBlockEntries(
 		defer convertCancel()
 		return flushBlockEntries(groupCtx, j.log, j.deferLog,
 			j.delegateBlockServer, j.config.BlockCache(), j.config.Reporter(),
-			j.tlfID, tlfName, entries)
+			j.tlfID, tlfName, entries,
+			j.config.BlockTransferControllers().Puts())
 	})
 	converted = false
 	eg.Go(func() error {
@@ -1329,6 +1347,9 @@ func (j *tlfJournal) flushOneMDOp(
 		return false, nil
 	}
 
+	ctx = startSpan(ctx, "tlfJournal.flushOneMDOp", spanAttrTLF(j.tlfID))
+	defer func() { finishSpan(ctx, err) }()
+
 	j.log.CDebugf(ctx, "Flushing one MD to server")
 	defer func() {
 		if err != nil {
@@ -1345,6 +1366,7 @@ func (j *tlfJournal) flushOneMDOp(
 	if mdID == (kbfsmd.ID{}) {
 		return false, nil
 	}
+	addSpanAttributes(ctx, spanAttrRevision(rmds.MD.RevisionNumber()))
 
 	j.log.CDebugf(ctx, "Flushing MD for TLF=%s with id=%s, rev=%s, bid=%s",
 		rmds.MD.TlfID(), mdID, rmds.MD.RevisionNumber(), rmds.MD.BID())
@@ -97,6 +97,10 @@ func (c testTLFJournalConfig) Clock() Clock {
 	return wallClock{}
 }
 
+func (c testTLFJournalConfig) SpanExporter() SpanExporter {
+	return nil
+}
+
 func (c testTLFJournalConfig) Crypto() Crypto {
 	return c.crypto
 }
@@ -154,6 +158,10 @@ func (c testTLFJournalConfig) BGFlushDirOpBatchSize() int {
 	return 1
 }
 
+func (c testTLFJournalConfig) BlockTransferControllers() *BlockTransferControllers {
+	return nil
+}
+
 func (c testTLFJournalConfig) makeBlock(data []byte) (
 	kbfsblock.ID, kbfsblock.Context, kbfscrypto.BlockCryptKeyServerHalf) {
 	id, err := kbfsblock.MakePermanentID(data)
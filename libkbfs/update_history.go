@@ -0,0 +1,372 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"strings"
+	"time"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/kbfsmd"
+	"golang.org/x/net/context"
+)
+
+const (
+	// The number of updates in a history page, if the caller
+	// doesn't ask for a specific number.
+	defaultUpdateHistoryPageSize = 100
+	// The most revisions that are inspected to fill a single
+	// history page.  If a selective filter means that fewer updates
+	// than requested are found within this many revisions, a short
+	// page is returned, and the caller can continue from its cursor.
+	maxUpdateHistoryRevsPerPage = 200
+)
+
+// UpdateHistoryFilter selects which updates, and which ops within
+// them, are returned in an UpdateHistoryPage.  The zero value selects
+// everything.
+type UpdateHistoryFilter struct {
+	// Writers, if non-empty, selects only updates by one of these
+	// users.
+	Writers []string
+	// Since, if non-zero, selects only updates made at or after
+	// this time.
+	Since time.Time
+	// Until, if non-zero, selects only updates made before this
+	// time.
+	Until time.Time
+	// PathPrefix, if non-empty, selects only ops that affect this
+	// path, relative to the TLF root, or anything under it.
+	PathPrefix string
+	// OpTypes, if non-empty, selects only ops of these types
+	// ("create", "rm", "rename", "sync", "setAttr", "resolution",
+	// "rekey" or "gc").
+	OpTypes []string
+}
+
+func (f UpdateHistoryFilter) hasOpFilters() bool {
+	return f.PathPrefix != "" || len(f.OpTypes) > 0
+}
+
+func (f UpdateHistoryFilter) matchesWriter(writer string) bool {
+	if len(f.Writers) == 0 {
+		return true
+	}
+	for _, w := range f.Writers {
+		if w == writer {
+			return true
+		}
+	}
+	return false
+}
+
+func (f UpdateHistoryFilter) matchesTime(t time.Time) bool {
+	if !f.Since.IsZero() && t.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !t.Before(f.Until) {
+		return false
+	}
+	return true
+}
+
+func (f UpdateHistoryFilter) matchesOp(opSummary OpSummary) bool {
+	if len(f.OpTypes) > 0 {
+		found := false
+		for _, t := range f.OpTypes {
+			if t == opSummary.Type {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	prefix := strings.Trim(f.PathPrefix, "/")
+	if prefix == "" {
+		return true
+	}
+	return opSummary.Path == prefix ||
+		strings.HasPrefix(opSummary.Path, prefix+"/")
+}
+
+// UpdateHistoryPage is one page of a TLF's merged update history,
+// newest update first.
+type UpdateHistoryPage struct {
+	ID      string
+	Name    string
+	Updates []UpdateSummary
+	// NextCursor is the cursor to pass in to get the next page, or
+	// kbfsmd.RevisionUninitialized if there are no older updates.
+	NextCursor kbfsmd.Revision
+}
+
+// opTypeName returns the name of the type of the given op, as used in
+// OpSummary and UpdateHistoryFilter.
+func opTypeName(o op) string {
+	switch o.(type) {
+	case *createOp:
+		return "create"
+	case *rmOp:
+		return "rm"
+	case *renameOp:
+		return "rename"
+	case *syncOp:
+		return "sync"
+	case *setAttrOp:
+		return "setAttr"
+	case *resolutionOp:
+		return "resolution"
+	case *rekeyOp:
+		return "rekey"
+	case *GCOp:
+		return "gc"
+	default:
+		return "unknown"
+	}
+}
+
+// opNodePointer returns the pointer to the node whose path an op's
+// path is relative to, as of the end of the op's revision.
+func opNodePointer(o op) BlockPointer {
+	switch realOp := o.(type) {
+	case *createOp:
+		return realOp.Dir.Ref
+	case *rmOp:
+		return realOp.Dir.Ref
+	case *renameOp:
+		if realOp.NewDir != (blockUpdate{}) {
+			return realOp.NewDir.Ref
+		}
+		return realOp.OldDir.Ref
+	case *syncOp:
+		return realOp.File.Ref
+	case *setAttrOp:
+		return realOp.Dir.Ref
+	default:
+		return BlockPointer{}
+	}
+}
+
+// opChildName returns the name of the entry an op affects within its
+// node, or "" if the op affects the node itself.
+func opChildName(o op) string {
+	switch realOp := o.(type) {
+	case *createOp:
+		return realOp.NewName
+	case *rmOp:
+		return realOp.OldName
+	case *renameOp:
+		return realOp.NewName
+	case *setAttrOp:
+		return realOp.Name
+	default:
+		return ""
+	}
+}
+
+// getOpPointerPaths returns the path of the node of every op in the
+// given MDs, as of the newest of them, keyed by the op's node
+// pointer.  Nodes that don't exist anymore by then are left out.
+func (fbo *folderBranchOps) getOpPointerPaths(
+	ctx context.Context, rmds []ImmutableRootMetadata) (
+	map[BlockPointer]path, error) {
+	chains, err := newCRChainsForIRMDs(
+		ctx, fbo.config.Codec(), rmds, &fbo.blocks, false)
+	if err != nil {
+		return nil, err
+	}
+	paths, err := chains.getPaths(
+		ctx, &fbo.blocks, fbo.log, fbo.nodeCache, true)
+	if err != nil {
+		return nil, err
+	}
+
+	// The chains hold copies of the ops, so match them up with the
+	// originals by pointer.
+	ptrPaths := make(map[BlockPointer]path)
+	for _, p := range paths {
+		chain, ok := chains.byMostRecent[p.tailPointer()]
+		if !ok {
+			continue
+		}
+		for _, o := range chain.ops {
+			if ptr := opNodePointer(o); ptr.IsInitialized() {
+				ptrPaths[ptr] = p
+			}
+		}
+	}
+	return ptrPaths, nil
+}
+
+// makeOpPaths returns the path affected by each of the given ops,
+// relative to the TLF root, using the paths in ptrPaths.  It also
+// returns whether any op affects a path that isn't in ptrPaths.
+func makeOpPaths(ops opsList, ptrPaths map[BlockPointer]path) (
+	opPaths []string, missing bool) {
+	opPaths = make([]string, len(ops))
+	for i, o := range ops {
+		ptr := opNodePointer(o)
+		if !ptr.IsInitialized() {
+			continue
+		}
+		p, ok := ptrPaths[ptr]
+		if !ok {
+			missing = true
+			continue
+		}
+		names := make([]string, 0, len(p.path))
+		// Skip the TLF root.
+		for _, node := range p.path[1:] {
+			names = append(names, node.Name)
+		}
+		if name := opChildName(o); name != "" {
+			names = append(names, name)
+		}
+		opPaths[i] = strings.Join(names, "/")
+	}
+	return opPaths, missing
+}
+
+// getUpdateOpPaths returns the path affected by each op of each of
+// the given consecutive MDs, relative to the TLF root, keyed by
+// revision.  The paths of all the MDs are found together, as of the
+// newest one, so that the blocks on the way to them are only looked
+// up once.  Only the ops whose nodes were removed by then are looked
+// up again, as of their own MD.  Ops that don't affect a path, or
+// whose path can't be found, get an empty path, and unreadable MDs
+// or MDs whose paths can't be found at all are left out.
+func (fbo *folderBranchOps) getUpdateOpPaths(
+	ctx context.Context, rmds []ImmutableRootMetadata) (
+	revPaths map[kbfsmd.Revision][]string) {
+	readable := make([]ImmutableRootMetadata, 0, len(rmds))
+	for _, rmd := range rmds {
+		if rmd.IsReadable() {
+			readable = append(readable, rmd)
+		}
+	}
+	revPaths = make(map[kbfsmd.Revision][]string, len(readable))
+	if len(readable) == 0 {
+		return revPaths
+	}
+
+	ptrPaths, err := fbo.getOpPointerPaths(ctx, readable)
+	if err != nil {
+		// Old blocks might have been garbage-collected already;
+		// summarize the ops without their paths.
+		fbo.log.CDebugf(ctx, "Couldn't get op paths for revisions "+
+			"%d-%d: %+v", readable[0].Revision(),
+			readable[len(readable)-1].Revision(), err)
+		return revPaths
+	}
+	for _, rmd := range readable {
+		opPaths, missing := makeOpPaths(rmd.data.Changes.Ops, ptrPaths)
+		if missing && len(readable) > 1 {
+			revPtrPaths, err := fbo.getOpPointerPaths(
+				ctx, []ImmutableRootMetadata{rmd})
+			if err != nil {
+				fbo.log.CDebugf(ctx, "Couldn't get op paths for "+
+					"revision %d: %+v", rmd.Revision(), err)
+			} else {
+				opPaths, _ = makeOpPaths(rmd.data.Changes.Ops, revPtrPaths)
+			}
+		}
+		revPaths[rmd.Revision()] = opPaths
+	}
+	return revPaths
+}
+
+// getWriterName returns the name of the last writer of the given MD,
+// caching it in writerNames.
+func (fbo *folderBranchOps) getWriterName(ctx context.Context,
+	rmd ImmutableRootMetadata, writerNames map[keybase1.UID]string) (
+	string, error) {
+	writer, ok := writerNames[rmd.LastModifyingWriter()]
+	if ok {
+		return writer, nil
+	}
+	name, err := fbo.config.KBPKI().GetNormalizedUsername(
+		ctx, rmd.LastModifyingWriter().AsUserOrTeam())
+	if err != nil {
+		return "", err
+	}
+	writer = string(name)
+	writerNames[rmd.LastModifyingWriter()] = writer
+	return writer, nil
+}
+
+// makeUpdateSummary summarizes the given MD.  opPaths, if non-nil,
+// holds the path affected by each op.
+func makeUpdateSummary(rmd ImmutableRootMetadata, writer string,
+	opPaths []string) UpdateSummary {
+	updateSummary := UpdateSummary{
+		Revision:   rmd.Revision(),
+		Date:       time.Unix(0, rmd.data.Dir.Mtime),
+		ServerTime: rmd.LocalTimestamp(),
+		Writer:     writer,
+		LiveBytes:  rmd.DiskUsage(),
+		Ops:        make([]OpSummary, 0, len(rmd.data.Changes.Ops)),
+	}
+	for i, op := range rmd.data.Changes.Ops {
+		opSummary := OpSummary{
+			Op:      op.String(),
+			Type:    opTypeName(op),
+			Refs:    make([]string, 0, len(op.Refs())),
+			Unrefs:  make([]string, 0, len(op.Unrefs())),
+			Updates: make(map[string]string),
+		}
+		if opPaths != nil {
+			opSummary.Path = opPaths[i]
+		}
+		for _, ptr := range op.Refs() {
+			opSummary.Refs = append(opSummary.Refs, ptr.String())
+		}
+		for _, ptr := range op.Unrefs() {
+			opSummary.Unrefs = append(opSummary.Unrefs, ptr.String())
+		}
+		for _, update := range op.allUpdates() {
+			opSummary.Updates[update.Unref.String()] = update.Ref.String()
+		}
+		updateSummary.Ops = append(updateSummary.Ops, opSummary)
+	}
+	return updateSummary
+}
+
+// makeFilteredUpdateSummary summarizes the given MD, keeping only the
+// ops selected by the filter.  opPaths, if non-nil, holds the path
+// affected by each op.  It returns false if the filter doesn't select
+// the MD at all.
+func (fbo *folderBranchOps) makeFilteredUpdateSummary(ctx context.Context,
+	rmd ImmutableRootMetadata, opPaths []string, filter UpdateHistoryFilter,
+	writerNames map[keybase1.UID]string) (UpdateSummary, bool, error) {
+	if !filter.matchesTime(rmd.LocalTimestamp()) {
+		return UpdateSummary{}, false, nil
+	}
+	writer, err := fbo.getWriterName(ctx, rmd, writerNames)
+	if err != nil {
+		return UpdateSummary{}, false, err
+	}
+	if !filter.matchesWriter(writer) {
+		return UpdateSummary{}, false, nil
+	}
+
+	updateSummary := makeUpdateSummary(rmd, writer, opPaths)
+	if !filter.hasOpFilters() {
+		return updateSummary, true, nil
+	}
+
+	ops := updateSummary.Ops[:0]
+	for _, opSummary := range updateSummary.Ops {
+		if filter.matchesOp(opSummary) {
+			ops = append(ops, opSummary)
+		}
+	}
+	if len(ops) == 0 {
+		return UpdateSummary{}, false, nil
+	}
+	updateSummary.Ops = ops
+	return updateSummary, true, nil
+}
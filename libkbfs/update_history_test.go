@@ -0,0 +1,125 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetUpdateHistoryPage(t *testing.T) {
+	var u1, u2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx, cancel := kbfsOpsInitNoMocks(t, u1, u2)
+	defer kbfsTestShutdownNoMocks(t, config1, ctx, cancel)
+	config2 := ConfigAsUser(config1, u2)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+
+	name := u1.String() + "," + u2.String()
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, name, tlf.Private)
+	fb := rootNode1.GetFolderBranch()
+	kbfsOps1 := config1.KBFSOps()
+	aNode, _, err := kbfsOps1.CreateDir(ctx, rootNode1, "a")
+	require.NoError(t, err)
+	err = kbfsOps1.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	_, _, err = kbfsOps1.CreateFile(ctx, aNode, "f", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps1.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, name, tlf.Private)
+	kbfsOps2 := config2.KBFSOps()
+	_, _, err = kbfsOps2.CreateDir(ctx, rootNode2, "b")
+	require.NoError(t, err)
+	err = kbfsOps2.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	err = kbfsOps1.SyncFromServerForTesting(ctx, fb)
+	require.NoError(t, err)
+
+	head, err := config1.MDOps().GetForTLF(ctx, fb.Tlf)
+	require.NoError(t, err)
+	headRev := head.Revision()
+	revs := func(page UpdateHistoryPage) (res []kbfsmd.Revision) {
+		for _, u := range page.Updates {
+			res = append(res, u.Revision)
+		}
+		return res
+	}
+
+	t.Log("Pages go from newest to oldest")
+	page, err := kbfsOps1.GetUpdateHistoryPage(
+		ctx, fb, kbfsmd.RevisionUninitialized, 2, UpdateHistoryFilter{})
+	require.NoError(t, err)
+	require.Equal(t, []kbfsmd.Revision{headRev, headRev - 1}, revs(page))
+	require.Equal(t, headRev-2, page.NextCursor)
+	require.Equal(t, u2.String(), page.Updates[0].Writer)
+	require.Equal(t, u1.String(), page.Updates[1].Writer)
+	page, err = kbfsOps1.GetUpdateHistoryPage(
+		ctx, fb, page.NextCursor, 0, UpdateHistoryFilter{})
+	require.NoError(t, err)
+	require.Equal(t, headRev-2, page.Updates[0].Revision)
+	require.Equal(t, kbfsmd.RevisionInitial,
+		page.Updates[len(page.Updates)-1].Revision)
+	require.Equal(t, kbfsmd.RevisionUninitialized, page.NextCursor)
+
+	t.Log("Filter by writer")
+	page, err = kbfsOps1.GetUpdateHistoryPage(
+		ctx, fb, kbfsmd.RevisionUninitialized, 0,
+		UpdateHistoryFilter{Writers: []string{u2.String()}})
+	require.NoError(t, err)
+	require.Equal(t, []kbfsmd.Revision{headRev}, revs(page))
+
+	t.Log("Filter by path prefix")
+	page, err = kbfsOps1.GetUpdateHistoryPage(
+		ctx, fb, kbfsmd.RevisionUninitialized, 0,
+		UpdateHistoryFilter{PathPrefix: "a"})
+	require.NoError(t, err)
+	require.Equal(t, []kbfsmd.Revision{headRev - 1, headRev - 2}, revs(page))
+	for _, u := range page.Updates {
+		for _, o := range u.Ops {
+			require.True(t, o.Path == "a" || strings.HasPrefix(o.Path, "a/"),
+				"Unexpected path %q", o.Path)
+		}
+	}
+
+	t.Log("Filter by op type and path")
+	page, err = kbfsOps1.GetUpdateHistoryPage(
+		ctx, fb, kbfsmd.RevisionUninitialized, 0,
+		UpdateHistoryFilter{PathPrefix: "a/f", OpTypes: []string{"create"}})
+	require.NoError(t, err)
+	require.Equal(t, []kbfsmd.Revision{headRev - 1}, revs(page))
+	require.Len(t, page.Updates[0].Ops, 1)
+	require.Equal(t, "a/f", page.Updates[0].Ops[0].Path)
+
+	t.Log("Filter by time")
+	page, err = kbfsOps1.GetUpdateHistoryPage(
+		ctx, fb, kbfsmd.RevisionUninitialized, 0,
+		UpdateHistoryFilter{Since: head.LocalTimestamp().Add(time.Hour)})
+	require.NoError(t, err)
+	require.Len(t, page.Updates, 0)
+	require.Equal(t, kbfsmd.RevisionUninitialized, page.NextCursor)
+
+	t.Log("Paths of entries removed later are still found")
+	err = kbfsOps1.RemoveEntry(ctx, aNode, "f")
+	require.NoError(t, err)
+	err = kbfsOps1.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	err = kbfsOps1.RemoveDir(ctx, rootNode1, "a")
+	require.NoError(t, err)
+	err = kbfsOps1.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	page, err = kbfsOps1.GetUpdateHistoryPage(
+		ctx, fb, kbfsmd.RevisionUninitialized, 0,
+		UpdateHistoryFilter{PathPrefix: "a/f", OpTypes: []string{"create"}})
+	require.NoError(t, err)
+	require.Equal(t, []kbfsmd.Revision{headRev - 1}, revs(page))
+	require.Equal(t, "a/f", page.Updates[0].Ops[0].Path)
+}
@@ -5,18 +5,22 @@
 package simplefs
 
 import (
+	"encoding/hex"
 	"encoding/json"
 	"io"
 	"os"
 	stdpath "path"
 	"strings"
 	"sync"
+	"time"
 
 	"golang.org/x/net/context"
 
+	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/client/go/logger"
 	"github.com/keybase/client/go/protocol/keybase1"
 	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/kbfsmd"
 	"github.com/keybase/kbfs/libkbfs"
 	"github.com/keybase/kbfs/tlf"
 )
@@ -27,7 +31,7 @@ type SimpleFS struct {
 	log logger.Logger
 	// config for the fs - constant, does not need locking.
 	config libkbfs.Config
-	// lock protects handles and inProgress
+	// lock protects handles, inProgress, uploads and uploadSweeper
 	lock sync.RWMutex
 	// handles contains handles opened by SimpleFSOpen,
 	// closed by SimpleFSClose (or SimpleFSCancel) and used
@@ -36,6 +40,18 @@ type SimpleFS struct {
 	// inProgress is for keeping state of operations in progress,
 	// values are removed by SimpleFSWait (or SimpleFSCancel).
 	inProgress map[keybase1.OpID]*inprogress
+	// uploads contains resumable upload sessions, started by
+	// SimpleFSUploadStart or SimpleFSCopy and removed by
+	// SimpleFSUploadFinish, SimpleFSUploadAbort, a failed copy, or
+	// after being idle for uploadSessionIdleTimeout.
+	uploads map[keybase1.OpID]*uploadSession
+	// uploadsDir holds a record of each upload session, so they
+	// survive a restart; if empty, they're only kept in memory.
+	// Constant, does not need locking.
+	uploadsDir string
+	// uploadSweeper removes idle upload sessions; it's only set
+	// while there are any.
+	uploadSweeper *time.Timer
 }
 
 type inprogress struct {
@@ -59,13 +75,30 @@ func NewSimpleFS(config libkbfs.Config) keybase1.SimpleFSInterface {
 }
 
 func newSimpleFS(config libkbfs.Config) *SimpleFS {
+	var uploadsDir string
+	if storageRoot := config.StorageRoot(); storageRoot != "" {
+		uploadsDir = uploadsDirFromStorageRoot(storageRoot)
+	}
+	return newSimpleFSWithUploadsDir(config, uploadsDir)
+}
+
+func newSimpleFSWithUploadsDir(
+	config libkbfs.Config, uploadsDir string) *SimpleFS {
 	log := config.MakeLogger("simplefs")
-	return &SimpleFS{
+	k := &SimpleFS{
 		config:     config,
 		handles:    map[keybase1.OpID]*handle{},
 		inProgress: map[keybase1.OpID]*inprogress{},
+		uploads:    map[keybase1.OpID]*uploadSession{},
+		uploadsDir: uploadsDir,
 		log:        log,
 	}
+	err := k.loadUploads()
+	if err != nil {
+		log.CWarningf(context.Background(),
+			"Couldn't load upload sessions from %s: %+v", uploadsDir, err)
+	}
+	return k
 }
 
 // SimpleFSList - Begin list of items in directory at path
@@ -205,14 +238,69 @@ func (k *SimpleFS) SimpleFSReadList(ctx context.Context, opid keybase1.OpID) (ke
 }
 
 // SimpleFSCopy - Begin copy of file or directory
+// A file copied into KBFS is uploaded with a bulk file writer, and
+// only appears once it's complete.  If an upload session with the
+// same OpID already exists, e.g. from an interrupted
+// SimpleFSUploadStart, the copy resumes that session instead.
 func (k *SimpleFS) SimpleFSCopy(ctx context.Context, arg keybase1.SimpleFSCopyArg) error {
 	return k.startAsync(arg.OpID, keybase1.NewOpDescriptionWithCopy(
 		keybase1.CopyArgs{OpID: arg.OpID, Src: arg.Src, Dest: arg.Dest}),
 		func(ctx context.Context) (err error) {
+			pt, err := arg.Dest.PathType()
+			if err != nil {
+				return err
+			}
+			if pt == keybase1.PathType_KBFS {
+				cloned, err := k.cloneInTlf(ctx, arg.Src, arg.Dest)
+				if err != nil || cloned {
+					return err
+				}
+				return k.doResumableCopy(ctx, arg.OpID, arg.Src, arg.Dest)
+			}
 			return k.doCopy(ctx, arg.Src, arg.Dest)
 		})
 }
 
+// cloneInTlf copies the file at srcPath to destPath by reference,
+// without reading or writing its data, when both are in the same
+// KBFS folder.  It returns false if the copy must be done the
+// regular way instead, e.g. because destPath already exists.
+func (k *SimpleFS) cloneInTlf(ctx context.Context,
+	srcPath, destPath keybase1.Path) (bool, error) {
+	pt, err := srcPath.PathType()
+	if err != nil {
+		return false, err
+	}
+	if pt != keybase1.PathType_KBFS {
+		return false, nil
+	}
+
+	src, ei, err := k.getRemoteNode(ctx, srcPath)
+	if err != nil {
+		return false, err
+	}
+	if ei.Type != libkbfs.File && ei.Type != libkbfs.Exec {
+		return false, nil
+	}
+	destDir, destName, err := k.getRemoteNodeParent(ctx, destPath)
+	if err != nil {
+		return false, err
+	}
+	if destName == "" ||
+		src.GetFolderBranch() != destDir.GetFolderBranch() {
+		return false, nil
+	}
+
+	_, err = k.config.KBFSOps().CopyFile(ctx, src, destDir, destName)
+	if _, ok := err.(libkbfs.NameExistsError); ok {
+		// A regular copy replaces the existing file.
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
 func (k *SimpleFS) doCopy(ctx context.Context, srcPath, destPath keybase1.Path) error {
 	// Note this is also used by move, so if this changes update SimpleFSMove
 	// code also.
@@ -222,6 +310,12 @@ func (k *SimpleFS) doCopy(ctx context.Context, srcPath, destPath keybase1.Path)
 	}
 	defer src.Close()
 
+	if bulk, err := k.canBulkCopy(src, destPath); err != nil {
+		return err
+	} else if bulk {
+		return k.bulkCopy(ctx, src, destPath)
+	}
+
 	dst, err := k.pathIO(ctx, destPath, keybase1.OpenFlags_WRITE|keybase1.OpenFlags_REPLACE, src)
 	if err != nil {
 		return err
@@ -255,6 +349,116 @@ func copyWithCancellation(ctx context.Context, dst io.Writer, src io.Reader) err
 	}
 }
 
+// canBulkCopy returns true if the file `src` should be copied to
+// destPath with bulkCopy.
+func (k *SimpleFS) canBulkCopy(src ioer, destPath keybase1.Path) (
+	bool, error) {
+	if src.Type() != keybase1.DirentType_FILE &&
+		src.Type() != keybase1.DirentType_EXEC {
+		return false, nil
+	}
+	pt, err := destPath.PathType()
+	if err != nil {
+		return false, err
+	}
+	return pt == keybase1.PathType_KBFS, nil
+}
+
+// bulkCopyTempName returns a random name under which a file can be
+// uploaded before it replaces an existing one.
+func bulkCopyTempName() (string, error) {
+	var buf [8]byte
+	err := kbfscrypto.RandRead(buf[:])
+	if err != nil {
+		return "", err
+	}
+	return ".simplefs-copy-" + hex.EncodeToString(buf[:]), nil
+}
+
+// bulkCopy copies the file `src` to destPath in KBFS through a
+// libkbfs.BulkFileWriter, so that the data is uploaded as it's read,
+// rather than piling up in the dirty block cache.  Like a regular
+// copy, it replaces any existing file at destPath, but only once the
+// new file is complete.
+func (k *SimpleFS) bulkCopy(
+	ctx context.Context, src ioer, destPath keybase1.Path) (err error) {
+	destDir, destName, err := k.getRemoteNodeParent(ctx, destPath)
+	if err != nil {
+		return err
+	}
+	if destName == "" {
+		return errInvalidRemotePath
+	}
+
+	kbfsOps := k.config.KBFSOps()
+	_, ei, err := kbfsOps.Lookup(ctx, destDir, destName)
+	name := destName
+	switch err.(type) {
+	case nil:
+		if ei.Type == libkbfs.Dir {
+			return simpleFSError{"Cannot replace a directory with a file"}
+		}
+		// Upload under a temporary name, and rename the result over
+		// the existing file, so a failed copy leaves it untouched.
+		name, err = bulkCopyTempName()
+		if err != nil {
+			return err
+		}
+	case libkbfs.NoSuchNameError:
+	default:
+		return err
+	}
+
+	w, err := kbfsOps.CreateBulkFile(ctx, destDir, name,
+		src.Type() == keybase1.DirentType_EXEC)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			// Abort never fails for a real error.
+			_ = w.Abort(ctx)
+		}
+	}()
+
+	buf := make([]byte, 64*1024)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		n, err := io.ReadFull(src, buf)
+		if n > 0 {
+			if wErr := w.Write(ctx, buf[:n]); wErr != nil {
+				return wErr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+
+	_, err = w.Close(ctx)
+	if err != nil || name == destName {
+		return err
+	}
+
+	err = kbfsOps.Rename(
+		ctx, destDir, name, destDir, destName, libkbfs.RenameFlagsNone)
+	if err != nil {
+		// Don't leave the temporary file behind.
+		if rmErr := kbfsOps.RemoveEntry(ctx, destDir, name); rmErr != nil {
+			k.log.CDebugf(ctx, "Couldn't remove temporary copy %s: %+v",
+				name, rmErr)
+		}
+		return err
+	}
+	return nil
+}
+
 type pathPair struct {
 	src, dest keybase1.Path
 }
@@ -284,6 +488,12 @@ func (k *SimpleFS) SimpleFSCopyRecursive(ctx context.Context,
 					}
 					defer src.Close()
 
+					if bulk, err := k.canBulkCopy(src, path.dest); err != nil {
+						return err
+					} else if bulk {
+						return k.bulkCopy(ctx, src, path.dest)
+					}
+
 					dst, err := k.pathIO(ctx, path.dest, keybase1.OpenFlags_WRITE|keybase1.OpenFlags_REPLACE, src)
 					if err != nil {
 						return err
@@ -334,6 +544,10 @@ func (k *SimpleFS) SimpleFSMove(ctx context.Context, arg keybase1.SimpleFSMoveAr
 		keybase1.MoveArgs{
 			OpID: arg.OpID, Src: arg.Src, Dest: arg.Dest,
 		}), func(ctx context.Context) (err error) {
+		moved, err := k.moveAcrossFolders(ctx, arg.OpID, arg.Src, arg.Dest)
+		if err != nil || moved {
+			return err
+		}
 
 		err = k.doCopy(ctx, arg.Src, arg.Dest)
 		if err != nil {
@@ -354,6 +568,50 @@ func (k *SimpleFS) SimpleFSMove(ctx context.Context, arg keybase1.SimpleFSMoveAr
 	})
 }
 
+// moveAcrossFolders moves the entry at srcPath to destPath with
+// KBFSOps.TransferAcrossFolders, when both are in KBFS but in
+// different folders.  The transfer is recorded under the OpID, so
+// moving again with the same OpID resumes an interrupted move.  It
+// returns false if the move must be done some other way.
+func (k *SimpleFS) moveAcrossFolders(ctx context.Context,
+	opid keybase1.OpID, srcPath, destPath keybase1.Path) (bool, error) {
+	srcPs, srcType, err := remotePath(srcPath)
+	if err != nil {
+		return false, nil
+	}
+	destPs, destType, err := remotePath(destPath)
+	if err != nil {
+		return false, nil
+	}
+	if len(srcPs) < 2 || len(destPs) < 2 {
+		return false, nil
+	}
+
+	srcParent, _, err := k.getRemoteNodeParent(ctx, srcPath)
+	if err != nil {
+		return false, err
+	}
+	destParent, _, err := k.getRemoteNodeParent(ctx, destPath)
+	if err != nil {
+		return false, err
+	}
+	if srcParent.GetFolderBranch() == destParent.GetFolderBranch() {
+		return false, nil
+	}
+
+	err = k.config.KBFSOps().TransferAcrossFolders(ctx,
+		hex.EncodeToString(opid[:]),
+		libkbfs.FolderPath{
+			TlfName: srcPs[0], TlfType: srcType, Path: srcPs[1:]},
+		libkbfs.FolderPath{
+			TlfName: destPs[0], TlfType: destType, Path: destPs[1:]},
+		true)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
 // SimpleFSRename - Rename file or directory, KBFS side only
 func (k *SimpleFS) SimpleFSRename(ctx context.Context, arg keybase1.SimpleFSRenameArg) (err error) {
 	// This is not async.
@@ -371,10 +629,56 @@ func (k *SimpleFS) SimpleFSRename(ctx context.Context, arg keybase1.SimpleFSRena
 	if err != nil {
 		return err
 	}
-	err = k.config.KBFSOps().Rename(ctx, snode, sleaf, dnode, dleaf)
+	err = k.config.KBFSOps().Rename(
+		ctx, snode, sleaf, dnode, dleaf, libkbfs.RenameFlagsNone)
 	return err
 }
 
+// transactionOp runs fn on the folder branch containing the given
+// remote path.
+func (k *SimpleFS) transactionOp(ctx context.Context, opName string,
+	path keybase1.Path,
+	fn func(context.Context, libkbfs.FolderBranch) error) (err error) {
+	ctx, err = k.startSyncOp(ctx, opName, path)
+	if err != nil {
+		return err
+	}
+	defer func() { k.doneSyncOp(ctx, err) }()
+
+	node, _, _, err := k.getRemoteRootNode(ctx, path)
+	if err != nil {
+		return err
+	}
+	return fn(ctx, node.GetFolderBranch())
+}
+
+// SimpleFSBeginTransaction - Start a transaction on the folder
+// containing the given path.  Until it is committed or aborted,
+// changes to the folder are not synced; if neither happens within
+// ten minutes, it is aborted.
+func (k *SimpleFS) SimpleFSBeginTransaction(
+	ctx context.Context, path keybase1.Path) error {
+	return k.transactionOp(ctx, "BeginTransaction", path,
+		k.config.KBFSOps().BeginTransaction)
+}
+
+// SimpleFSCommitTransaction - Sync all changes made to the folder
+// containing the given path during its transaction, as a single
+// revision.
+func (k *SimpleFS) SimpleFSCommitTransaction(
+	ctx context.Context, path keybase1.Path) error {
+	return k.transactionOp(ctx, "CommitTransaction", path,
+		k.config.KBFSOps().CommitTransaction)
+}
+
+// SimpleFSAbortTransaction - Discard all changes made to the folder
+// containing the given path during its transaction.
+func (k *SimpleFS) SimpleFSAbortTransaction(
+	ctx context.Context, path keybase1.Path) error {
+	return k.transactionOp(ctx, "AbortTransaction", path,
+		k.config.KBFSOps().AbortTransaction)
+}
+
 // SimpleFSOpen - Create/open a file and leave it open
 // or create a directory
 // Files must be closed afterwards.
@@ -551,6 +855,129 @@ func (k *SimpleFS) SimpleFSStat(ctx context.Context, path keybase1.Path) (_ keyb
 	return wrapStat(ei, err)
 }
 
+// searchQueryFromProtocol converts the protocol form of a search
+// query into the libkbfs form, restricted to the given directory.
+func searchQueryFromProtocol(q keybase1.SimpleFSSearchQuery,
+	pathPrefix string) libkbfs.SearchQuery {
+	query := libkbfs.SearchQuery{
+		NamePattern:    q.NamePattern,
+		PathPrefix:     pathPrefix,
+		ModifiedAfter:  keybase1.FromTime(q.ModifiedAfter),
+		ModifiedBefore: keybase1.FromTime(q.ModifiedBefore),
+		LastWriter:     libkb.NewNormalizedUsername(q.LastWriter),
+		Limit:          q.Limit,
+	}
+	if q.MinSize > 0 {
+		query.MinSize = uint64(q.MinSize)
+	}
+	if q.MaxSize > 0 {
+		query.MaxSize = uint64(q.MaxSize)
+	}
+	for _, t := range q.Types {
+		switch t {
+		case keybase1.DirentType_FILE:
+			query.Types = append(query.Types, libkbfs.File)
+		case keybase1.DirentType_DIR:
+			query.Types = append(query.Types, libkbfs.Dir)
+		case keybase1.DirentType_SYM:
+			query.Types = append(query.Types, libkbfs.Sym)
+		case keybase1.DirentType_EXEC:
+			query.Types = append(query.Types, libkbfs.Exec)
+		}
+	}
+	return query
+}
+
+// SimpleFSFind - Search the local index of a TLF for entries under a
+// directory.  The names in the returned entries are paths relative to
+// the TLF root.
+func (k *SimpleFS) SimpleFSFind(ctx context.Context,
+	arg keybase1.SimpleFSFindArg) (_ []keybase1.Dirent, err error) {
+	ctx, err = k.startSyncOp(ctx, "Find", arg)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { k.doneSyncOp(ctx, err) }()
+
+	node, _, ps, err := k.getRemoteRootNode(ctx, arg.Path)
+	if err != nil {
+		return nil, err
+	}
+	query := searchQueryFromProtocol(arg.Query, strings.Join(ps, "/"))
+	results, err := k.config.KBFSOps().FindEntries(
+		ctx, node.GetFolderBranch(), query)
+	if err != nil {
+		return nil, err
+	}
+	des := make([]keybase1.Dirent, len(results))
+	for i, r := range results {
+		setStat(&des[i], &r.EntryInfo)
+		des[i].Name = r.Path
+	}
+	return des, nil
+}
+
+// historyPageToProtocol converts a page of update history into its
+// protocol form.  The block pointers of each op aren't included.
+func historyPageToProtocol(
+	page libkbfs.UpdateHistoryPage) keybase1.SimpleFSHistoryPage {
+	res := keybase1.SimpleFSHistoryPage{
+		Updates:    make([]keybase1.SimpleFSUpdateSummary, len(page.Updates)),
+		NextCursor: int64(page.NextCursor),
+	}
+	for i, u := range page.Updates {
+		ops := make([]keybase1.SimpleFSOpSummary, len(u.Ops))
+		for j, o := range u.Ops {
+			ops[j] = keybase1.SimpleFSOpSummary{
+				Op:   o.Op,
+				Type: o.Type,
+				Path: o.Path,
+			}
+		}
+		res.Updates[i] = keybase1.SimpleFSUpdateSummary{
+			Revision:   int64(u.Revision),
+			Date:       keybase1.ToTime(u.Date),
+			ServerTime: keybase1.ToTime(u.ServerTime),
+			Writer:     u.Writer,
+			LiveBytes:  int64(u.LiveBytes),
+			Ops:        ops,
+		}
+	}
+	return res
+}
+
+// SimpleFSHistory - Get a page of the update history of a TLF, newest
+// update first.  Op paths in the returned updates are relative to the
+// TLF root.
+func (k *SimpleFS) SimpleFSHistory(ctx context.Context,
+	arg keybase1.SimpleFSHistoryArg) (
+	_ keybase1.SimpleFSHistoryPage, err error) {
+	ctx, err = k.startSyncOp(ctx, "History", arg)
+	if err != nil {
+		return keybase1.SimpleFSHistoryPage{}, err
+	}
+	defer func() { k.doneSyncOp(ctx, err) }()
+
+	node, _, ps, err := k.getRemoteRootNode(ctx, arg.Path)
+	if err != nil {
+		return keybase1.SimpleFSHistoryPage{}, err
+	}
+	filter := libkbfs.UpdateHistoryFilter{
+		Writers:    arg.Filter.Writers,
+		Since:      keybase1.FromTime(arg.Filter.Since),
+		Until:      keybase1.FromTime(arg.Filter.Until),
+		PathPrefix: strings.Join(ps, "/"),
+		OpTypes:    arg.Filter.OpTypes,
+	}
+	page, err := k.config.KBFSOps().GetUpdateHistoryPage(
+		ctx, node.GetFolderBranch(), kbfsmd.Revision(arg.Cursor),
+		arg.Limit, filter)
+	if err != nil {
+		return keybase1.SimpleFSHistoryPage{}, err
+	}
+	return historyPageToProtocol(page), nil
+}
+
 // SimpleFSMakeOpid - Convenience helper for generating new random value
 func (k *SimpleFS) SimpleFSMakeOpid(_ context.Context) (keybase1.OpID, error) {
 	var opid keybase1.OpID
@@ -890,6 +1317,18 @@ func (r *kbfsIO) Write(bs []byte) (int, error) {
 	return len(bs), err
 }
 
+func (r *kbfsIO) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		r.offset = offset
+	case io.SeekCurrent:
+		r.offset += offset
+	default:
+		return r.offset, simpleFSError{"Unsupported seek"}
+	}
+	return r.offset, nil
+}
+
 func (r *kbfsIO) Close() error {
 	return r.sfs.config.KBFSOps().SyncAll(r.ctx, r.node.GetFolderBranch())
 }
@@ -10,7 +10,9 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"testing"
+	"time"
 
 	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/client/go/protocol/keybase1"
@@ -160,6 +162,39 @@ func TestList(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestTransactionHistory(t *testing.T) {
+	ctx := context.Background()
+	sfs := newSimpleFS(libkbfs.MakeTestConfigOrBust(t, "jdoe"))
+	defer closeSimpleFS(ctx, t, sfs)
+
+	path1 := keybase1.NewPathWithKbfs(`/private/jdoe`)
+	err := sfs.SimpleFSBeginTransaction(ctx, path1)
+	require.NoError(t, err)
+	writeRemoteFile(ctx, t, sfs, pathAppend(path1, `test1.txt`), []byte(`foo`))
+	writeRemoteFile(ctx, t, sfs, pathAppend(path1, `test2.txt`), []byte(`foo`))
+	err = sfs.SimpleFSCommitTransaction(ctx, path1)
+	require.NoError(t, err)
+
+	page, err := sfs.SimpleFSHistory(ctx, keybase1.SimpleFSHistoryArg{
+		Path:  path1,
+		Limit: 1,
+		Filter: keybase1.SimpleFSHistoryFilter{
+			OpTypes: []string{"create"},
+		},
+	})
+	require.NoError(t, err)
+	require.Len(t, page.Updates, 1)
+	update := page.Updates[0]
+	require.Equal(t, "jdoe", update.Writer)
+	var paths []string
+	for _, o := range update.Ops {
+		require.Equal(t, "create", o.Type)
+		paths = append(paths, o.Path)
+	}
+	sort.Strings(paths)
+	require.Equal(t, []string{"test1.txt", "test2.txt"}, paths)
+}
+
 func TestCopyToLocal(t *testing.T) {
 	ctx := context.Background()
 	sfs := newSimpleFS(libkbfs.MakeTestConfigOrBust(t, "jdoe"))
@@ -246,6 +281,50 @@ func TestCopyToRemote(t *testing.T) {
 		string(readRemoteFile(ctx, t, sfs, pathAppend(path2, "test1.txt"))))
 }
 
+func TestCopyToRemoteReplace(t *testing.T) {
+	ctx := context.Background()
+	sfs := newSimpleFS(libkbfs.MakeTestConfigOrBust(t, "jdoe"))
+	defer closeSimpleFS(ctx, t, sfs)
+
+	tempdir, err := ioutil.TempDir("", "simpleFstest")
+	defer os.RemoveAll(tempdir)
+	require.NoError(t, err)
+	srcPath := keybase1.NewPathWithLocal(filepath.Join(tempdir, "test1.txt"))
+	err = ioutil.WriteFile(srcPath.Local(), []byte("new contents"), 0644)
+	require.NoError(t, err)
+	destPath := keybase1.NewPathWithKbfs(`/private/jdoe/test1.txt`)
+	writeRemoteFile(ctx, t, sfs, destPath, []byte("old"))
+
+	opid, err := sfs.SimpleFSMakeOpid(ctx)
+	require.NoError(t, err)
+	err = sfs.SimpleFSCopy(ctx, keybase1.SimpleFSCopyArg{
+		OpID: opid,
+		Src:  srcPath,
+		Dest: destPath,
+	})
+	require.NoError(t, err)
+	err = sfs.SimpleFSWait(ctx, opid)
+	require.NoError(t, err)
+
+	require.Equal(t, "new contents",
+		string(readRemoteFile(ctx, t, sfs, destPath)))
+
+	// The temporary upload name doesn't stick around.
+	opid, err = sfs.SimpleFSMakeOpid(ctx)
+	require.NoError(t, err)
+	err = sfs.SimpleFSList(ctx, keybase1.SimpleFSListArg{
+		OpID: opid,
+		Path: keybase1.NewPathWithKbfs(`/private/jdoe`),
+	})
+	require.NoError(t, err)
+	err = sfs.SimpleFSWait(ctx, opid)
+	require.NoError(t, err)
+	listResult, err := sfs.SimpleFSReadList(ctx, opid)
+	require.NoError(t, err)
+	require.Len(t, listResult.Entries, 1)
+	require.Equal(t, "test1.txt", listResult.Entries[0].Name)
+}
+
 func writeRemoteFile(ctx context.Context, t *testing.T, sfs *SimpleFS, path keybase1.Path, data []byte) {
 	opid, err := sfs.SimpleFSMakeOpid(ctx)
 	require.NoError(t, err)
@@ -292,3 +371,194 @@ func readRemoteFile(ctx context.Context, t *testing.T, sfs *SimpleFS, path keyba
 
 	return data.Data
 }
+
+func TestUploadResume(t *testing.T) {
+	ctx := context.Background()
+	sfs := newSimpleFS(libkbfs.MakeTestConfigOrBust(t, "jdoe"))
+	defer closeSimpleFS(ctx, t, sfs)
+
+	path := keybase1.NewPathWithKbfs(`/private/jdoe/upload.txt`)
+	opid, err := sfs.SimpleFSMakeOpid(ctx)
+	require.NoError(t, err)
+
+	state, err := sfs.SimpleFSUploadStart(ctx, keybase1.SimpleFSUploadStartArg{
+		OpID:         opid,
+		Dest:         path,
+		SyncInterval: 4,
+	})
+	require.NoError(t, err)
+	require.Equal(t, int64(0), state.CommittedOffset)
+
+	t.Log("Writing past the sync interval makes the data durable")
+	state, err = sfs.SimpleFSUploadWrite(ctx, keybase1.SimpleFSUploadWriteArg{
+		OpID: opid, Offset: 0, Content: []byte("abcd"),
+	})
+	require.NoError(t, err)
+	require.Equal(t, int64(4), state.CommittedOffset)
+	state, err = sfs.SimpleFSUploadWrite(ctx, keybase1.SimpleFSUploadWriteArg{
+		OpID: opid, Offset: 4, Content: []byte("ef"),
+	})
+	require.NoError(t, err)
+	require.Equal(t, int64(4), state.CommittedOffset)
+	require.Equal(t, int64(6), state.WrittenOffset)
+
+	t.Log("Writes can't leave gaps")
+	_, err = sfs.SimpleFSUploadWrite(ctx, keybase1.SimpleFSUploadWriteArg{
+		OpID: opid, Offset: 7, Content: []byte("g"),
+	})
+	require.IsType(t, uploadOffsetError{}, err)
+
+	t.Log("Resuming goes back to the last durable offset")
+	state, err = sfs.SimpleFSUploadStart(ctx, keybase1.SimpleFSUploadStartArg{
+		OpID: opid,
+		Dest: path,
+	})
+	require.NoError(t, err)
+	require.Equal(t, int64(4), state.CommittedOffset)
+	require.Equal(t, int64(4), state.WrittenOffset)
+	state, err = sfs.SimpleFSUploadState(ctx, opid)
+	require.NoError(t, err)
+	require.Equal(t, int64(4), state.WrittenOffset)
+
+	_, err = sfs.SimpleFSUploadWrite(ctx, keybase1.SimpleFSUploadWriteArg{
+		OpID: opid, Offset: 4, Content: []byte("EF"),
+	})
+	require.NoError(t, err)
+	state, err = sfs.SimpleFSUploadFinish(ctx, opid)
+	require.NoError(t, err)
+	require.Equal(t, int64(6), state.CommittedOffset)
+	_, err = sfs.SimpleFSUploadState(ctx, opid)
+	require.Equal(t, errNoSuchUpload, err)
+
+	require.Equal(t, "abcdEF", string(readRemoteFile(ctx, t, sfs, path)))
+}
+
+func TestUploadIdleSweep(t *testing.T) {
+	ctx := context.Background()
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	clock := &libkbfs.TestClock{}
+	clock.Set(time.Now())
+	config.SetClock(clock)
+	sfs := newSimpleFS(config)
+	defer closeSimpleFS(ctx, t, sfs)
+
+	opid1, err := sfs.SimpleFSMakeOpid(ctx)
+	require.NoError(t, err)
+	_, err = sfs.SimpleFSUploadStart(ctx, keybase1.SimpleFSUploadStartArg{
+		OpID: opid1,
+		Dest: keybase1.NewPathWithKbfs(`/private/jdoe/upload1.txt`),
+	})
+	require.NoError(t, err)
+	clock.Add(uploadSessionIdleTimeout / 2)
+	opid2, err := sfs.SimpleFSMakeOpid(ctx)
+	require.NoError(t, err)
+	_, err = sfs.SimpleFSUploadStart(ctx, keybase1.SimpleFSUploadStartArg{
+		OpID: opid2,
+		Dest: keybase1.NewPathWithKbfs(`/private/jdoe/upload2.txt`),
+	})
+	require.NoError(t, err)
+
+	t.Log("Only the session that's been idle long enough is swept.")
+	clock.Add(uploadSessionIdleTimeout / 2)
+	sfs.sweepIdleUploads()
+	_, err = sfs.SimpleFSUploadState(ctx, opid1)
+	require.Equal(t, errNoSuchUpload, err)
+	_, err = sfs.SimpleFSUploadState(ctx, opid2)
+	require.NoError(t, err)
+}
+
+func TestUploadResumeAfterRestart(t *testing.T) {
+	ctx := context.Background()
+	config := libkbfs.MakeTestConfigOrBust(t, "jdoe")
+	tempdir, err := ioutil.TempDir("", "simpleFsUploads")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempdir)
+	sfs := newSimpleFSWithUploadsDir(config, tempdir)
+	defer closeSimpleFS(ctx, t, sfs)
+
+	path := keybase1.NewPathWithKbfs(`/private/jdoe/upload.txt`)
+	opid, err := sfs.SimpleFSMakeOpid(ctx)
+	require.NoError(t, err)
+	_, err = sfs.SimpleFSUploadStart(ctx, keybase1.SimpleFSUploadStartArg{
+		OpID:         opid,
+		Dest:         path,
+		SyncInterval: 4,
+	})
+	require.NoError(t, err)
+	_, err = sfs.SimpleFSUploadWrite(ctx, keybase1.SimpleFSUploadWriteArg{
+		OpID: opid, Offset: 0, Content: []byte("abcd"),
+	})
+	require.NoError(t, err)
+	_, err = sfs.SimpleFSUploadWrite(ctx, keybase1.SimpleFSUploadWriteArg{
+		OpID: opid, Offset: 4, Content: []byte("ef"),
+	})
+	require.NoError(t, err)
+
+	t.Log("The destination isn't touched until the upload is finished")
+	_, err = sfs.SimpleFSStat(ctx, path)
+	require.IsType(t, libkbfs.NoSuchNameError{}, err)
+
+	t.Log("A new instance picks the session up from its record")
+	sfs2 := newSimpleFSWithUploadsDir(config, tempdir)
+	state, err := sfs2.SimpleFSUploadState(ctx, opid)
+	require.NoError(t, err)
+	require.Equal(t, int64(4), state.CommittedOffset)
+	require.Equal(t, int64(4), state.WrittenOffset)
+	require.Equal(t, path, state.Dest)
+
+	_, err = sfs2.SimpleFSUploadWrite(ctx, keybase1.SimpleFSUploadWriteArg{
+		OpID: opid, Offset: 4, Content: []byte("EF"),
+	})
+	require.NoError(t, err)
+	_, err = sfs2.SimpleFSUploadFinish(ctx, opid)
+	require.NoError(t, err)
+	require.Equal(t, "abcdEF", string(readRemoteFile(ctx, t, sfs2, path)))
+
+	t.Log("Finishing removes the record and the temporary file")
+	fis, err := ioutil.ReadDir(tempdir)
+	require.NoError(t, err)
+	require.Len(t, fis, 0)
+	_, err = sfs2.SimpleFSStat(ctx, keybase1.NewPathWithKbfs(
+		`/private/jdoe/`+uploadTempName(opid)))
+	require.IsType(t, libkbfs.NoSuchNameError{}, err)
+}
+
+func TestCopyToRemoteResume(t *testing.T) {
+	ctx := context.Background()
+	sfs := newSimpleFS(libkbfs.MakeTestConfigOrBust(t, "jdoe"))
+	defer closeSimpleFS(ctx, t, sfs)
+
+	tempdir, err := ioutil.TempDir("", "simpleFstest")
+	defer os.RemoveAll(tempdir)
+	require.NoError(t, err)
+	srcPath := keybase1.NewPathWithLocal(filepath.Join(tempdir, "test1.txt"))
+	err = ioutil.WriteFile(srcPath.Local(), []byte("hello world"), 0644)
+	require.NoError(t, err)
+	destPath := keybase1.NewPathWithKbfs(`/private/jdoe/test1.txt`)
+
+	opid, err := sfs.SimpleFSMakeOpid(ctx)
+	require.NoError(t, err)
+
+	// Pretend an earlier copy made the first five bytes durable
+	// before being interrupted.  Use different contents, to tell
+	// whether the copy really resumes.
+	s, err := sfs.startUpload(ctx, opid, destPath, &srcPath, 1)
+	require.NoError(t, err)
+	state, err := s.write(ctx, sfs, []byte("HELLO"), 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(5), state.CommittedOffset)
+
+	err = sfs.SimpleFSCopy(ctx, keybase1.SimpleFSCopyArg{
+		OpID: opid,
+		Src:  srcPath,
+		Dest: destPath,
+	})
+	require.NoError(t, err)
+	err = sfs.SimpleFSWait(ctx, opid)
+	require.NoError(t, err)
+
+	require.Equal(t, "HELLO world",
+		string(readRemoteFile(ctx, t, sfs, destPath)))
+	_, err = sfs.SimpleFSUploadState(ctx, opid)
+	require.Equal(t, errNoSuchUpload, err)
+}
@@ -0,0 +1,677 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package simplefs
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	stdpath "path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/ioutil"
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/keybase/kbfs/libkbfs"
+)
+
+// defaultUploadSyncInterval is how many bytes an upload session
+// writes between syncs, unless the caller asks for something else.
+const defaultUploadSyncInterval = 64 * 1024 * 1024
+
+// uploadSessionIdleTimeout is how long an upload session may go
+// unused before it's removed, e.g. because the client that started
+// it went away.
+const uploadSessionIdleTimeout = 1 * time.Hour
+
+func uploadsDirFromStorageRoot(storageRoot string) string {
+	return filepath.Join(storageRoot, "kbfs_simplefs_uploads")
+}
+
+// uploadTempName returns the name of the temporary file that the
+// upload `opid` writes to, next to its destination, until it's
+// finished.
+func uploadTempName(opid keybase1.OpID) string {
+	return ".simplefs-upload-" + hex.EncodeToString(opid[:])
+}
+
+// uploadTempPath returns the path of the temporary file named
+// `tempName` next to `dest`, which must be in KBFS.
+func uploadTempPath(dest keybase1.Path, tempName string) (
+	keybase1.Path, error) {
+	pt, err := dest.PathType()
+	if err != nil {
+		return keybase1.Path{}, err
+	}
+	if pt != keybase1.PathType_KBFS {
+		return keybase1.Path{}, errInvalidRemotePath
+	}
+	return keybase1.NewPathWithKbfs(
+		stdpath.Join(stdpath.Dir(dest.Kbfs()), tempName)), nil
+}
+
+// uploadRecord is what's stored for each upload session, so that it
+// can be resumed after a restart.  Only the durable part of the
+// upload is recorded, since anything written past CommittedOffset is
+// lost with the dirty data anyway.
+type uploadRecord struct {
+	Dest keybase1.Path  `codec:"d"`
+	Src  *keybase1.Path `codec:"s,omitempty"`
+	// TempName is the name, in the directory of Dest, of the file
+	// being uploaded to.
+	TempName        string `codec:"t"`
+	SyncInterval    int64  `codec:"i"`
+	CommittedOffset int64  `codec:"c"`
+}
+
+// uploadSession tracks a resumable upload to a single remote file.
+// The data is written to a temporary file next to the destination,
+// which replaces the destination when the upload is finished.
+// Sessions are keyed by OpID, and are independent of handles and of
+// the RPC connection that started them, so they survive a client
+// reconnecting; they're also recorded under the storage root, if
+// there is one, so they survive a restart.  They're removed by
+// SimpleFSUploadFinish and SimpleFSUploadAbort, or once they've been
+// idle for uploadSessionIdleTimeout.
+type uploadSession struct {
+	// src is the path being copied from, for sessions started by
+	// SimpleFSCopy.  Constant, does not need locking.
+	src *keybase1.Path
+	// syncInterval and tempName are constant, do not need locking.
+	syncInterval int64
+	tempName     string
+	// lastUsed is protected by SimpleFS.lock, not by lock.
+	lastUsed time.Time
+
+	// lock protects node and state, and serializes writes.
+	lock sync.Mutex
+	// node is the temporary file, or nil if the session was loaded
+	// from its record and hasn't been resumed yet.
+	node  libkbfs.Node
+	state keybase1.UploadSessionState
+}
+
+var errNoSuchUpload = simpleFSError{"No such upload session"}
+
+// uploadOffsetError is returned when a write to an upload session
+// doesn't start within the part of the file the session has
+// written.
+type uploadOffsetError struct {
+	state  keybase1.UploadSessionState
+	offset int64
+}
+
+// Error implements the error interface for uploadOffsetError.
+func (e uploadOffsetError) Error() string {
+	return fmt.Sprintf("Upload write at offset %d, but only %d bytes "+
+		"have been written (%d durably)", e.offset,
+		e.state.WrittenOffset, e.state.CommittedOffset)
+}
+
+// ToStatus implements the keybase1.ToStatusAble interface for
+// uploadOffsetError.
+func (e uploadOffsetError) ToStatus() keybase1.Status {
+	return keybase1.Status{
+		Name: "UploadOffsetError",
+		Code: int(keybase1.StatusCode_SCGeneric),
+		Desc: e.Error(),
+	}
+}
+
+// recordLocked returns the record of s.  s.lock must be held, unless
+// s isn't shared yet.
+func (s *uploadSession) recordLocked() uploadRecord {
+	return uploadRecord{
+		Dest:            s.state.Dest,
+		Src:             s.src,
+		TempName:        s.tempName,
+		SyncInterval:    s.syncInterval,
+		CommittedOffset: s.state.CommittedOffset,
+	}
+}
+
+// syncLocked syncs everything written so far, and records the new
+// durable offset.  s.lock must be held.
+func (s *uploadSession) syncLocked(ctx context.Context, k *SimpleFS) error {
+	if s.state.CommittedOffset == s.state.WrittenOffset {
+		return nil
+	}
+	err := k.config.KBFSOps().SyncAll(ctx, s.node.GetFolderBranch())
+	if err != nil {
+		return err
+	}
+	s.state.CommittedOffset = s.state.WrittenOffset
+	err = k.putUploadRecord(s.state.OpID, s.recordLocked())
+	if err != nil {
+		// The data is durable either way; after a restart, the
+		// upload just resumes from the previously recorded offset.
+		k.log.CWarningf(ctx, "Couldn't record upload %X at offset %d: %+v",
+			s.state.OpID, s.state.CommittedOffset, err)
+	}
+	return nil
+}
+
+// write writes `data` at `offset`, which must be between the
+// committed and written offsets, and syncs if enough has been
+// written since the last sync.
+func (s *uploadSession) write(ctx context.Context, k *SimpleFS,
+	data []byte, offset int64) (keybase1.UploadSessionState, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if offset < s.state.CommittedOffset || offset > s.state.WrittenOffset {
+		return s.state, uploadOffsetError{s.state, offset}
+	}
+	err := k.config.KBFSOps().Write(ctx, s.node, data, offset)
+	if err != nil {
+		return s.state, err
+	}
+	if end := offset + int64(len(data)); end > s.state.WrittenOffset {
+		s.state.WrittenOffset = end
+	}
+	if s.state.WrittenOffset-s.state.CommittedOffset >= s.syncInterval {
+		err = s.syncLocked(ctx, k)
+		if err != nil {
+			return s.state, err
+		}
+	}
+	return s.state, nil
+}
+
+func (s *uploadSession) getState() keybase1.UploadSessionState {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.state
+}
+
+func (k *SimpleFS) uploadRecordPath(opid keybase1.OpID) string {
+	return filepath.Join(k.uploadsDir, hex.EncodeToString(opid[:]))
+}
+
+// putUploadRecord stores the record of the upload `opid`, if upload
+// sessions are kept on disk.
+func (k *SimpleFS) putUploadRecord(
+	opid keybase1.OpID, rec uploadRecord) error {
+	if k.uploadsDir == "" {
+		return nil
+	}
+	return kbfscodec.SerializeToFile(
+		k.config.Codec(), rec, k.uploadRecordPath(opid))
+}
+
+func (k *SimpleFS) removeUploadRecord(opid keybase1.OpID) error {
+	if k.uploadsDir == "" {
+		return nil
+	}
+	err := ioutil.Remove(k.uploadRecordPath(opid))
+	if ioutil.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// loadUploads adds a session for each upload recorded under
+// k.uploadsDir.  None of them have been resumed yet, so their
+// temporary files are looked up again when they're next used.
+func (k *SimpleFS) loadUploads() error {
+	if k.uploadsDir == "" {
+		return nil
+	}
+	fis, err := ioutil.ReadDir(k.uploadsDir)
+	if ioutil.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	now := k.config.Clock().Now()
+	for _, fi := range fis {
+		var opid keybase1.OpID
+		buf, err := hex.DecodeString(fi.Name())
+		if err != nil || len(buf) != len(opid) {
+			k.log.CDebugf(nil, "Ignoring unknown upload record %s",
+				fi.Name())
+			continue
+		}
+		copy(opid[:], buf)
+		var rec uploadRecord
+		err = kbfscodec.DeserializeFromFile(
+			k.config.Codec(), k.uploadRecordPath(opid), &rec)
+		if err != nil {
+			return err
+		}
+		k.uploads[opid] = &uploadSession{
+			src:          rec.Src,
+			syncInterval: rec.SyncInterval,
+			tempName:     rec.TempName,
+			lastUsed:     now,
+			state: keybase1.UploadSessionState{
+				OpID:            opid,
+				Dest:            rec.Dest,
+				CommittedOffset: rec.CommittedOffset,
+				WrittenOffset:   rec.CommittedOffset,
+			},
+		}
+	}
+	k.scheduleUploadSweepLocked()
+	return nil
+}
+
+// resumeUploadLocked looks up the temporary file of `s` again, in
+// case it was renamed or its node went stale while the upload was
+// interrupted, and truncates it back to the last durable offset.
+// s.lock must be held.
+func (k *SimpleFS) resumeUploadLocked(
+	ctx context.Context, s *uploadSession) error {
+	tempPath, err := uploadTempPath(s.state.Dest, s.tempName)
+	if err != nil {
+		return err
+	}
+	node, _, err := k.open(ctx, tempPath, keybase1.OpenFlags_WRITE|
+		keybase1.OpenFlags_EXISTING)
+	if err != nil {
+		return err
+	}
+	err = k.config.KBFSOps().Truncate(
+		ctx, node, uint64(s.state.CommittedOffset))
+	if err != nil {
+		return err
+	}
+	s.node = node
+	s.state.WrittenOffset = s.state.CommittedOffset
+	k.log.CDebugf(ctx, "Resuming upload %X at offset %d",
+		s.state.OpID, s.state.CommittedOffset)
+	return nil
+}
+
+// startUpload returns the upload session for `opid`, creating it if
+// necessary.  If the session already exists, the file is truncated
+// back to the last durable offset, so that the caller can resume
+// from there.
+func (k *SimpleFS) startUpload(ctx context.Context, opid keybase1.OpID,
+	dest keybase1.Path, src *keybase1.Path, syncInterval int64) (
+	*uploadSession, error) {
+	if syncInterval <= 0 {
+		syncInterval = defaultUploadSyncInterval
+	}
+
+	k.lock.Lock()
+	s, ok := k.uploads[opid]
+	if ok {
+		s.lastUsed = k.config.Clock().Now()
+	}
+	k.lock.Unlock()
+	if !ok {
+		tempName := uploadTempName(opid)
+		tempPath, err := uploadTempPath(dest, tempName)
+		if err != nil {
+			return nil, err
+		}
+		node, _, err := k.open(ctx, tempPath,
+			keybase1.OpenFlags_WRITE|keybase1.OpenFlags_REPLACE)
+		if err != nil {
+			return nil, err
+		}
+		s = &uploadSession{
+			src:          src,
+			syncInterval: syncInterval,
+			tempName:     tempName,
+			node:         node,
+			state: keybase1.UploadSessionState{
+				OpID: opid, Dest: dest},
+		}
+		k.lock.Lock()
+		defer k.lock.Unlock()
+		if _, ok := k.uploads[opid]; ok {
+			return nil, simpleFSError{"Upload session already started"}
+		}
+		err = k.putUploadRecord(opid, s.recordLocked())
+		if err != nil {
+			return nil, err
+		}
+		s.lastUsed = k.config.Clock().Now()
+		k.uploads[opid] = s
+		k.scheduleUploadSweepLocked()
+		return s, nil
+	}
+
+	if !pathsEqual(s.state.Dest, dest) || (s.src == nil) != (src == nil) ||
+		(src != nil && !pathsEqual(*s.src, *src)) {
+		return nil, simpleFSError{
+			"Upload session exists for different paths"}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	err := k.resumeUploadLocked(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// pathsEqual returns whether the two paths are the same.  Paths
+// can't be compared with ==, since they hold their strings by
+// pointer.
+func pathsEqual(a, b keybase1.Path) bool {
+	aType, err := a.PathType()
+	if err != nil {
+		return false
+	}
+	bType, err := b.PathType()
+	if err != nil || aType != bType {
+		return false
+	}
+	switch aType {
+	case keybase1.PathType_LOCAL:
+		return a.Local() == b.Local()
+	case keybase1.PathType_KBFS:
+		return a.Kbfs() == b.Kbfs()
+	}
+	return false
+}
+
+func (k *SimpleFS) getUpload(opid keybase1.OpID) (*uploadSession, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	s, ok := k.uploads[opid]
+	if !ok {
+		return nil, errNoSuchUpload
+	}
+	s.lastUsed = k.config.Clock().Now()
+	return s, nil
+}
+
+// removeUpload ends the upload session for `opid`, if there is one,
+// and returns it.
+func (k *SimpleFS) removeUpload(
+	ctx context.Context, opid keybase1.OpID) *uploadSession {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	s, ok := k.uploads[opid]
+	if !ok {
+		return nil
+	}
+	delete(k.uploads, opid)
+	err := k.removeUploadRecord(opid)
+	if err != nil {
+		k.log.CWarningf(ctx, "Couldn't remove record of upload %X: %+v",
+			opid, err)
+	}
+	return s
+}
+
+// discardUpload ends the upload session for `opid`, if there is one,
+// and removes its temporary file.  It returns whether there was a
+// session.
+func (k *SimpleFS) discardUpload(
+	ctx context.Context, opid keybase1.OpID) bool {
+	s := k.removeUpload(ctx, opid)
+	if s == nil {
+		return false
+	}
+	k.removeUploadTemp(ctx, s)
+	return true
+}
+
+// removeUploadTemp removes the temporary file of an ended upload
+// session, if it's still there.
+func (k *SimpleFS) removeUploadTemp(ctx context.Context, s *uploadSession) {
+	tempPath, err := uploadTempPath(s.state.Dest, s.tempName)
+	if err != nil {
+		return
+	}
+	parent, name, err := k.getRemoteNodeParent(ctx, tempPath)
+	if err == nil {
+		err = k.config.KBFSOps().RemoveEntry(ctx, parent, name)
+	}
+	if _, ok := err.(libkbfs.NoSuchNameError); err != nil && !ok {
+		k.log.CDebugf(ctx, "Couldn't remove upload file %s: %+v",
+			name, err)
+	}
+}
+
+// scheduleUploadSweepLocked makes sure idle upload sessions will be
+// swept, if there are any.  k.lock must be held.
+func (k *SimpleFS) scheduleUploadSweepLocked() {
+	if k.uploadSweeper != nil || len(k.uploads) == 0 {
+		return
+	}
+	k.uploadSweeper = time.AfterFunc(
+		uploadSessionIdleTimeout, k.sweepIdleUploads)
+}
+
+// sweepIdleUploads removes all upload sessions that have been idle
+// for at least uploadSessionIdleTimeout, along with their temporary
+// files.
+func (k *SimpleFS) sweepIdleUploads() {
+	ctx := context.Background()
+	var idle []*uploadSession
+	func() {
+		k.lock.Lock()
+		defer k.lock.Unlock()
+		now := k.config.Clock().Now()
+		for opid, s := range k.uploads {
+			if now.Sub(s.lastUsed) >= uploadSessionIdleTimeout {
+				k.log.CDebugf(ctx, "Removing idle upload session %X", opid)
+				delete(k.uploads, opid)
+				err := k.removeUploadRecord(opid)
+				if err != nil {
+					k.log.CWarningf(ctx, "Couldn't remove record of "+
+						"upload %X: %+v", opid, err)
+				}
+				idle = append(idle, s)
+			}
+		}
+		k.uploadSweeper = nil
+		k.scheduleUploadSweepLocked()
+	}()
+
+	for _, s := range idle {
+		k.removeUploadTemp(ctx, s)
+	}
+}
+
+// SimpleFSUploadStart - Start a resumable upload to a remote file.
+// The data goes to a temporary file next to it, which replaces the
+// file when the upload is finished.  If an upload session with the
+// same OpID already exists, possibly from before a restart, it is
+// resumed instead: anything written past the last durable offset is
+// discarded, and the caller should continue writing from the
+// returned CommittedOffset.
+func (k *SimpleFS) SimpleFSUploadStart(ctx context.Context,
+	arg keybase1.SimpleFSUploadStartArg) (
+	_ keybase1.UploadSessionState, err error) {
+	ctx, err = k.startSyncOp(ctx, "UploadStart", arg)
+	if err != nil {
+		return keybase1.UploadSessionState{}, err
+	}
+	defer func() { k.doneSyncOp(ctx, err) }()
+
+	s, err := k.startUpload(ctx, arg.OpID, arg.Dest, nil, arg.SyncInterval)
+	if err != nil {
+		return keybase1.UploadSessionState{}, err
+	}
+	return s.getState(), nil
+}
+
+// SimpleFSUploadWrite - Write content to a resumable upload.  The
+// offset may not be past what has been written already, nor before
+// the last durable offset, so a write whose result was lost can
+// simply be repeated.  The data is synced whenever enough has been
+// written since the last sync.
+func (k *SimpleFS) SimpleFSUploadWrite(ctx context.Context,
+	arg keybase1.SimpleFSUploadWriteArg) (
+	_ keybase1.UploadSessionState, err error) {
+	s, err := k.getUpload(arg.OpID)
+	if err != nil {
+		return keybase1.UploadSessionState{}, err
+	}
+
+	opDesc := keybase1.NewOpDescriptionWithWrite(
+		keybase1.WriteArgs{
+			OpID: arg.OpID, Path: s.state.Dest, Offset: arg.Offset,
+		})
+	ctx, err = k.startReadWriteOp(ctx, arg.OpID, opDesc)
+	if err != nil {
+		return keybase1.UploadSessionState{}, err
+	}
+	defer func() { k.doneReadWriteOp(ctx, arg.OpID, err) }()
+
+	err = k.reopenUpload(ctx, s)
+	if err != nil {
+		return s.getState(), err
+	}
+	return s.write(ctx, k, arg.Content, arg.Offset)
+}
+
+// reopenUpload resumes `s` if it was loaded from its record and
+// hasn't been resumed yet, so that it can be written to.
+func (k *SimpleFS) reopenUpload(ctx context.Context, s *uploadSession) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.node != nil {
+		return nil
+	}
+	return k.resumeUploadLocked(ctx, s)
+}
+
+// SimpleFSUploadState - Get the state of a resumable upload, which
+// may also have been started by SimpleFSCopy.
+func (k *SimpleFS) SimpleFSUploadState(_ context.Context,
+	opid keybase1.OpID) (keybase1.UploadSessionState, error) {
+	s, err := k.getUpload(opid)
+	if err != nil {
+		return keybase1.UploadSessionState{}, err
+	}
+	return s.getState(), nil
+}
+
+// SimpleFSUploadFinish - Sync everything written to a resumable
+// upload, move it into place over its destination, and end the
+// session.
+func (k *SimpleFS) SimpleFSUploadFinish(ctx context.Context,
+	opid keybase1.OpID) (_ keybase1.UploadSessionState, err error) {
+	ctx, err = k.startSyncOp(ctx, "UploadFinish", opid)
+	if err != nil {
+		return keybase1.UploadSessionState{}, err
+	}
+	defer func() { k.doneSyncOp(ctx, err) }()
+	return k.finishUpload(ctx, opid)
+}
+
+func (k *SimpleFS) finishUpload(ctx context.Context, opid keybase1.OpID) (
+	keybase1.UploadSessionState, error) {
+	s, err := k.getUpload(opid)
+	if err != nil {
+		return keybase1.UploadSessionState{}, err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	err = s.syncLocked(ctx, k)
+	if err != nil {
+		return s.state, err
+	}
+
+	destDir, destName, err := k.getRemoteNodeParent(ctx, s.state.Dest)
+	if err != nil {
+		return s.state, err
+	}
+	if destName == "" {
+		return s.state, errInvalidRemotePath
+	}
+	kbfsOps := k.config.KBFSOps()
+	err = kbfsOps.Rename(ctx, destDir, s.tempName, destDir, destName,
+		libkbfs.RenameFlagsNone)
+	if err != nil {
+		return s.state, err
+	}
+	err = kbfsOps.SyncAll(ctx, destDir.GetFolderBranch())
+	if err != nil {
+		return s.state, err
+	}
+	k.removeUpload(ctx, opid)
+	return s.state, nil
+}
+
+// SimpleFSUploadAbort - End a resumable upload without syncing
+// anything more, and remove its temporary file.  The destination is
+// left as it was.
+func (k *SimpleFS) SimpleFSUploadAbort(ctx context.Context,
+	opid keybase1.OpID) error {
+	if !k.discardUpload(ctx, opid) {
+		return errNoSuchUpload
+	}
+	return nil
+}
+
+// doResumableCopy copies a single file into KBFS through the
+// existing upload session for `opid`, picking up from its last
+// durable offset.  If there's no such session, or the source isn't a
+// single file, it's copied with doCopy instead, which uploads files
+// with a bulk file writer.  The session is only kept after a failure
+// if the copy was canceled, since only then can it be resumed.
+func (k *SimpleFS) doResumableCopy(ctx context.Context, opid keybase1.OpID,
+	srcPath, destPath keybase1.Path) (err error) {
+	if _, err := k.getUpload(opid); err == errNoSuchUpload {
+		return k.doCopy(ctx, srcPath, destPath)
+	}
+
+	src, err := k.pathIO(ctx, srcPath,
+		keybase1.OpenFlags_READ|keybase1.OpenFlags_EXISTING, nil)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	seeker, ok := src.(io.Seeker)
+	if !ok || (src.Type() != keybase1.DirentType_FILE &&
+		src.Type() != keybase1.DirentType_EXEC) {
+		return k.doCopy(ctx, srcPath, destPath)
+	}
+
+	s, err := k.startUpload(ctx, opid, destPath, &srcPath, 0)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil && ctx.Err() == nil {
+			k.discardUpload(ctx, opid)
+		}
+	}()
+	offset := s.getState().CommittedOffset
+	_, err = seeker.Seek(offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 64*1024)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		n, err := src.Read(buf)
+		if n > 0 {
+			state, wErr := s.write(ctx, k, buf[:n], offset)
+			if wErr != nil {
+				return wErr
+			}
+			offset = state.WrittenOffset
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	_, err = k.finishUpload(ctx, opid)
+	return err
+}
@@ -7,6 +7,7 @@ package test
 import (
 	"bytes"
 	"fmt"
+	"os"
 	"path"
 	"reflect"
 	"regexp"
@@ -20,6 +21,7 @@ import (
 	"github.com/keybase/kbfs/libfs"
 	"github.com/keybase/kbfs/libkbfs"
 	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
 )
 
 type m map[string]string
@@ -394,6 +396,22 @@ func expectError(op fileOp, reasonPrefix string) fileOp {
 			op.description, reasonPrefix)}
 }
 
+// ignoreNotExist runs the given op, but treats a failure caused by a
+// missing file as success.  It's useful for generated ops, which may
+// refer to files that were never created or that another user has
+// already removed.
+func ignoreNotExist(op fileOp) fileOp {
+	return fileOp{func(c *ctx) error {
+		err := op.operation(c)
+		if _, ok := errors.Cause(err).(libkbfs.NoSuchNameError); ok ||
+			os.IsNotExist(err) {
+			c.tb.Logf("Ignoring error for %s: %v", op.description, err)
+			return nil
+		}
+		return err
+	}, op.flags, fmt.Sprintf("ignoreNotExist(%s)", op.description)}
+}
+
 func noSync() fileOp {
 	return fileOp{func(c *ctx) error {
 		c.noSyncInit = true
@@ -337,7 +337,7 @@ func (k *LibKBFS) Rename(u User, srcDir Node, srcName string,
 	kbfsOps := u.(*libkbfs.ConfigLocal).KBFSOps()
 	ctx, cancel := k.newContext(u)
 	defer cancel()
-	return kbfsOps.Rename(ctx, srcDir.(libkbfs.Node), srcName, dstDir.(libkbfs.Node), dstName)
+	return kbfsOps.Rename(ctx, srcDir.(libkbfs.Node), srcName, dstDir.(libkbfs.Node), dstName, libkbfs.RenameFlagsNone)
 }
 
 // WriteFile implements the Engine interface.
@@ -0,0 +1,700 @@
+// Copyright 2017 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+// This file generates random interleavings of the DSL's file
+// operations across several users, checks that all the users
+// converge on the same tree once they've synced, and shrinks any
+// failing scenario down to a minimal reproduction.
+
+package test
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/keybase/client/go/libkb"
+)
+
+var (
+	randomSeed = flag.Int64("random-seed", 0,
+		"Seed for TestRandomConvergence; if 0, one is picked based on "+
+			"the current time")
+	randomIters = flag.Int("random-iters", 0,
+		"Number of scenarios TestRandomConvergence runs, per journal "+
+			"mode; if 0, the test is skipped")
+	randomRounds = flag.Int("random-rounds", 6,
+		"Number of rounds in each TestRandomConvergence scenario")
+	randomShrinkRuns = flag.Int("random-shrink-runs", 100,
+		"Maximum number of runs TestRandomConvergence spends shrinking "+
+			"a failing scenario")
+)
+
+const (
+	// The most steps in a single round of a random scenario.
+	randomMaxSteps = 6
+	// How long a single run of a scenario may take before it's
+	// considered hung.
+	randomScenarioTimeout = 2 * time.Minute
+	// How many times checkConvergence syncs everyone before giving
+	// up on them converging.
+	convergencePasses = 4
+)
+
+// The metadata version that random scenarios are run with.
+var randomMetadataVer = testMetadataVers[len(testMetadataVers)-1]
+
+var randomUsers = []username{alice, bob, charlie}
+
+// The dirs are created up front and never touched again, so that the
+// generated ops can only act on files, and can only fail when a file
+// doesn't exist.
+var randomDirs = []string{"a", "b"}
+var randomFiles = []string{"a/x", "a/y", "b/x", "b/y"}
+
+type randomStepKind int
+
+const (
+	randomWrite randomStepKind = iota
+	randomTruncate
+	randomRename
+	randomRm
+	randomSetex
+	numRandomStepKinds
+)
+
+// randomStep is a single file operation by a single user.
+type randomStep struct {
+	user     username
+	kind     randomStepKind
+	path     string
+	dst      string
+	contents string
+	size     uint64
+	ex       bool
+}
+
+func (s randomStep) fileOp() fileOp {
+	switch s.kind {
+	case randomWrite:
+		return write(s.path, s.contents)
+	case randomTruncate:
+		return truncate(s.path, s.size)
+	case randomRename:
+		return ignoreNotExist(rename(s.path, s.dst))
+	case randomRm:
+		return ignoreNotExist(rm(s.path))
+	case randomSetex:
+		return ignoreNotExist(setex(s.path, s.ex))
+	default:
+		panic(fmt.Sprintf("Unknown step kind %d", s.kind))
+	}
+}
+
+// source returns the DSL source code for the step's op.
+func (s randomStep) source() string {
+	switch s.kind {
+	case randomWrite:
+		return fmt.Sprintf("write(%q, %q)", s.path, s.contents)
+	case randomTruncate:
+		return fmt.Sprintf("truncate(%q, %d)", s.path, s.size)
+	case randomRename:
+		return fmt.Sprintf("ignoreNotExist(rename(%q, %q))", s.path, s.dst)
+	case randomRm:
+		return fmt.Sprintf("ignoreNotExist(rm(%q))", s.path)
+	case randomSetex:
+		return fmt.Sprintf("ignoreNotExist(setex(%q, %t))", s.path, s.ex)
+	default:
+		panic(fmt.Sprintf("Unknown step kind %d", s.kind))
+	}
+}
+
+type randomRoundKind int
+
+const (
+	// All users stay online during the round.
+	randomRoundOnline randomRoundKind = iota
+	// Some users disable updates for the round, and go unmerged
+	// once they write.
+	randomRoundDisabled
+	// Some users pause their journals for the round.  Only valid
+	// with journaling.
+	randomRoundPaused
+	// One user's MD puts are stalled while the others write.
+	// Only valid without journaling, since the journal doesn't
+	// put MDs through the stallable MDOps.
+	randomRoundStalled
+)
+
+// randomRound is a sequence of steps, run one `as` at a time, so
+// that the users' ops interleave.
+type randomRound struct {
+	kind randomRoundKind
+	// offline holds the users whose updates are disabled, or whose
+	// journals are paused, for the round.
+	offline []username
+	// staller is the user whose MD puts are stalled, and
+	// stallWrite the write that makes sure it puts something.
+	staller    username
+	stallWrite randomStep
+	steps      []randomStep
+}
+
+func (r randomRound) isOffline(u username) bool {
+	for _, o := range r.offline {
+		if o == u {
+			return true
+		}
+	}
+	return false
+}
+
+// randomScenario is a full randomly-generated test.
+type randomScenario struct {
+	journal bool
+	users   []username
+	rounds  []randomRound
+}
+
+// randomProgram accumulates both the DSL actions for a scenario and
+// their source code.
+type randomProgram struct {
+	actions []optionOp
+	lines   []string
+}
+
+func (p *randomProgram) add(action optionOp, src string) {
+	p.actions = append(p.actions, action)
+	p.lines = append(p.lines, src)
+}
+
+func asSource(u username, ops ...string) string {
+	return fmt.Sprintf("as(%s, %s)", u, strings.Join(ops, ", "))
+}
+
+func (sc randomScenario) addRound(p *randomProgram, r randomRound) {
+	switch r.kind {
+	case randomRoundOnline:
+		for _, s := range r.steps {
+			p.add(as(s.user, s.fileOp()), asSource(s.user, s.source()))
+		}
+	case randomRoundDisabled, randomRoundPaused:
+		for _, u := range r.offline {
+			if r.kind == randomRoundDisabled {
+				p.add(as(u, disableUpdates()),
+					asSource(u, "disableUpdates()"))
+			} else {
+				p.add(as(u, pauseJournal()), asSource(u, "pauseJournal()"))
+			}
+		}
+		for _, s := range r.steps {
+			if r.isOffline(s.user) {
+				p.add(as(s.user, noSync(), s.fileOp()),
+					asSource(s.user, "noSync()", s.source()))
+			} else {
+				p.add(as(s.user, s.fileOp()), asSource(s.user, s.source()))
+			}
+		}
+		for _, u := range r.offline {
+			if r.kind == randomRoundDisabled {
+				p.add(as(u, noSync(), reenableUpdates()),
+					asSource(u, "noSync()", "reenableUpdates()"))
+			} else {
+				p.add(as(u, noSync(), resumeJournal(), flushJournal()),
+					asSource(u, "noSync()", "resumeJournal()",
+						"flushJournal()"))
+			}
+		}
+	case randomRoundStalled:
+		stallerOps := []fileOp{r.stallWrite.fileOp()}
+		stallerSrc := []string{r.stallWrite.source()}
+		var others []optionOp
+		var othersSrc []string
+		for _, s := range r.steps {
+			if s.user == r.staller {
+				stallerOps = append(stallerOps, s.fileOp())
+				stallerSrc = append(stallerSrc, s.source())
+			} else {
+				others = append(others, as(s.user, s.fileOp()))
+				othersSrc = append(othersSrc, asSource(s.user, s.source()))
+			}
+		}
+		p.add(as(r.staller, stallOnMDPut()),
+			asSource(r.staller, "stallOnMDPut()"))
+		seq := []optionOp{as(r.staller, noSync(), waitForStalledMDPut())}
+		seqSrc := []string{
+			asSource(r.staller, "noSync()", "waitForStalledMDPut()")}
+		seq = append(seq, others...)
+		seqSrc = append(seqSrc, othersSrc...)
+		seq = append(seq, as(r.staller, noSync(), undoStallOnMDPut()))
+		seqSrc = append(seqSrc,
+			asSource(r.staller, "noSync()", "undoStallOnMDPut()"))
+		p.add(parallel(as(r.staller, stallerOps...), sequential(seq...)),
+			fmt.Sprintf(
+				"parallel(\n\t\t%s,\n\t\tsequential(\n\t\t\t%s,\n\t\t),\n\t)",
+				asSource(r.staller, stallerSrc...),
+				strings.Join(seqSrc, ",\n\t\t\t")))
+	default:
+		panic(fmt.Sprintf("Unknown round kind %d", r.kind))
+	}
+}
+
+func (sc randomScenario) program() *randomProgram {
+	p := &randomProgram{}
+	if sc.journal {
+		p.add(journal(), "journal()")
+	}
+	var names []string
+	for _, u := range sc.users {
+		names = append(names, fmt.Sprintf("%q", string(u)))
+	}
+	p.add(users(sc.users...),
+		fmt.Sprintf("users(%s)", strings.Join(names, ", ")))
+
+	var mkdirs []fileOp
+	var mkdirsSrc []string
+	for _, d := range randomDirs {
+		mkdirs = append(mkdirs, mkdir(d))
+		mkdirsSrc = append(mkdirsSrc, fmt.Sprintf("mkdir(%q)", d))
+	}
+	p.add(as(sc.users[0], mkdirs...), asSource(sc.users[0], mkdirsSrc...))
+	if sc.journal {
+		for _, u := range sc.users {
+			p.add(as(u, enableJournal()), asSource(u, "enableJournal()"))
+		}
+	}
+
+	for _, r := range sc.rounds {
+		sc.addRound(p, r)
+	}
+	p.add(checkConvergence(), "checkConvergence()")
+	return p
+}
+
+// source returns the scenario as a DSL test, ready to be pasted into
+// a test file.
+func (sc randomScenario) source() string {
+	return fmt.Sprintf("test(t,\n\t%s,\n)",
+		strings.Join(sc.program().lines, ",\n\t"))
+}
+
+func randomContents(r *rand.Rand, u username, n int) string {
+	return strings.Repeat(fmt.Sprintf("%s%d.", u, n), 1+r.Intn(3))
+}
+
+func generateRandomStep(
+	r *rand.Rand, u username, kind randomStepKind, n int) randomStep {
+	s := randomStep{
+		user: u,
+		kind: kind,
+		path: randomFiles[r.Intn(len(randomFiles))],
+	}
+	switch kind {
+	case randomWrite:
+		s.contents = randomContents(r, u, n)
+	case randomTruncate:
+		s.size = uint64(r.Intn(12))
+	case randomRename:
+		// Renaming a file onto itself isn't interesting.
+		for s.dst == "" || s.dst == s.path {
+			s.dst = randomFiles[r.Intn(len(randomFiles))]
+		}
+	case randomSetex:
+		s.ex = r.Intn(2) == 0
+	}
+	return s
+}
+
+// generateRandomScenario returns a scenario with the given number of
+// rounds, generated deterministically from `r`.
+func generateRandomScenario(
+	r *rand.Rand, journal bool, numRounds int) randomScenario {
+	sc := randomScenario{
+		journal: journal,
+		users:   randomUsers[:2+r.Intn(len(randomUsers)-1)],
+	}
+	kinds := []randomRoundKind{randomRoundOnline, randomRoundDisabled}
+	if journal {
+		kinds = append(kinds, randomRoundPaused)
+	} else {
+		kinds = append(kinds, randomRoundStalled)
+	}
+
+	n := 0
+	for i := 0; i < numRounds; i++ {
+		round := randomRound{kind: kinds[r.Intn(len(kinds))]}
+		switch round.kind {
+		case randomRoundDisabled, randomRoundPaused:
+			for _, j := range r.Perm(len(sc.users))[:1+r.Intn(len(sc.users))] {
+				round.offline = append(round.offline, sc.users[j])
+			}
+		case randomRoundStalled:
+			round.staller = sc.users[r.Intn(len(sc.users))]
+			round.stallWrite = generateRandomStep(
+				r, round.staller, randomWrite, n)
+			n++
+		}
+		numSteps := 1 + r.Intn(randomMaxSteps)
+		for j := 0; j < numSteps; j++ {
+			u := sc.users[r.Intn(len(sc.users))]
+			kind := randomStepKind(r.Intn(int(numRandomStepKinds)))
+			round.steps = append(round.steps, generateRandomStep(r, u, kind, n))
+			n++
+		}
+		sc.rounds = append(sc.rounds, round)
+	}
+	return sc
+}
+
+// shrinkCandidates returns all the scenarios that are one
+// simplification away from `sc`.
+func (sc randomScenario) shrinkCandidates() (candidates []randomScenario) {
+	withRound := func(i int, r randomRound) randomScenario {
+		rounds := append([]randomRound(nil), sc.rounds...)
+		rounds[i] = r
+		return randomScenario{sc.journal, sc.users, rounds}
+	}
+
+	// Drop whole rounds.
+	for i := range sc.rounds {
+		rounds := append([]randomRound(nil), sc.rounds[:i]...)
+		rounds = append(rounds, sc.rounds[i+1:]...)
+		candidates = append(candidates,
+			randomScenario{sc.journal, sc.users, rounds})
+	}
+	// Turn rounds into plain online rounds.
+	for i, r := range sc.rounds {
+		if r.kind != randomRoundOnline {
+			candidates = append(candidates, withRound(i, randomRound{
+				kind:  randomRoundOnline,
+				steps: r.steps,
+			}))
+		}
+	}
+	// Bring single users back online.
+	for i, r := range sc.rounds {
+		if len(r.offline) < 2 {
+			continue
+		}
+		for j := range r.offline {
+			newR := r
+			newR.offline = append([]username(nil), r.offline[:j]...)
+			newR.offline = append(newR.offline, r.offline[j+1:]...)
+			candidates = append(candidates, withRound(i, newR))
+		}
+	}
+	// Drop single steps.
+	for i, r := range sc.rounds {
+		for j := range r.steps {
+			newR := r
+			newR.steps = append([]randomStep(nil), r.steps[:j]...)
+			newR.steps = append(newR.steps, r.steps[j+1:]...)
+			candidates = append(candidates, withRound(i, newR))
+		}
+	}
+	return candidates
+}
+
+// recordingTBAbort is panicked with to abort a scenario run by a
+// recordingTB.
+type recordingTBAbort struct{}
+
+// recordingTB is a testing.TB that records failures instead of
+// reporting them, so that failing scenarios can be re-run while
+// they're shrunk.  It drops all logging.  Fatal failures and skips
+// abort the run by panicking with recordingTBAbort.
+type recordingTB struct {
+	testing.TB
+
+	lock     sync.Mutex
+	failures []string
+	skipped  bool
+}
+
+func (r *recordingTB) record(failure string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.failures = append(r.failures, failure)
+}
+
+func (r *recordingTB) getFailures() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]string(nil), r.failures...)
+}
+
+func (r *recordingTB) Log(args ...interface{})                 {}
+func (r *recordingTB) Logf(format string, args ...interface{}) {}
+
+func (r *recordingTB) Error(args ...interface{}) {
+	r.record(fmt.Sprint(args...))
+}
+
+func (r *recordingTB) Errorf(format string, args ...interface{}) {
+	r.record(fmt.Sprintf(format, args...))
+}
+
+func (r *recordingTB) Fail() {
+	r.record("Fail()")
+}
+
+func (r *recordingTB) FailNow() {
+	r.Fail()
+	panic(recordingTBAbort{})
+}
+
+func (r *recordingTB) Failed() bool {
+	return len(r.getFailures()) > 0
+}
+
+func (r *recordingTB) Fatal(args ...interface{}) {
+	r.Error(args...)
+	panic(recordingTBAbort{})
+}
+
+func (r *recordingTB) Fatalf(format string, args ...interface{}) {
+	r.Errorf(format, args...)
+	panic(recordingTBAbort{})
+}
+
+func (r *recordingTB) SkipNow() {
+	r.lock.Lock()
+	r.skipped = true
+	r.lock.Unlock()
+	panic(recordingTBAbort{})
+}
+
+func (r *recordingTB) Skip(args ...interface{}) {
+	r.SkipNow()
+}
+
+func (r *recordingTB) Skipf(format string, args ...interface{}) {
+	r.SkipNow()
+}
+
+func (r *recordingTB) Skipped() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.skipped
+}
+
+// runRandomScenario runs the given scenario, and returns the
+// failures it ran into, if any.  A hung run is reported as a
+// failure, and its goroutines are leaked.
+func runRandomScenario(t *testing.T, sc randomScenario) (
+	failures []string, skipped bool) {
+	tb := &recordingTB{TB: t}
+	actions := sc.program().actions
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer func() {
+			if r := recover(); r != nil {
+				if _, ok := r.(recordingTBAbort); !ok {
+					tb.record(fmt.Sprintf("panic: %v", r))
+				}
+			}
+		}()
+		runOneTestOrBenchmark(tb, randomMetadataVer, actions...)
+	}()
+	select {
+	case <-done:
+	case <-time.After(randomScenarioTimeout):
+		tb.record(fmt.Sprintf("Timed out after %s", randomScenarioTimeout))
+	}
+	return tb.getFailures(), tb.Skipped()
+}
+
+// shrinkRandomScenario greedily simplifies the failing scenario `sc`
+// for as long as the simpler scenario still fails, and returns the
+// simplest one it found along with its failures.
+func shrinkRandomScenario(t *testing.T, sc randomScenario,
+	failures []string) (randomScenario, []string) {
+	runs := 0
+	for runs < *randomShrinkRuns {
+		shrunk := false
+		for _, candidate := range sc.shrinkCandidates() {
+			if runs >= *randomShrinkRuns {
+				break
+			}
+			runs++
+			f, _ := runRandomScenario(t, candidate)
+			if len(f) > 0 {
+				sc, failures = candidate, f
+				shrunk = true
+				break
+			}
+		}
+		if !shrunk {
+			break
+		}
+	}
+	t.Logf("Shrinking took %d runs", runs)
+	return sc, failures
+}
+
+// readTree returns a description of every entry under `dir`, keyed
+// by path relative to the TLF root.
+func (c *ctx) readTree(dir Node, prefix string, tree map[string]string) error {
+	children, err := c.engine.GetDirChildrenTypes(c.user, dir)
+	if err != nil {
+		return err
+	}
+	for name, ty := range children {
+		p := path.Join(prefix, name)
+		node, symPath, err := c.engine.Lookup(c.user, dir, name)
+		if err != nil {
+			return err
+		}
+		switch ty {
+		case "DIR":
+			tree[p] = ty
+			err = c.readTree(node, p, tree)
+			if err != nil {
+				return err
+			}
+		case "SYM":
+			tree[p] = ty + ":" + symPath
+		default:
+			var contents bytes.Buffer
+			buf := make([]byte, 4096)
+			for off := int64(0); ; {
+				n, err := c.engine.ReadFile(c.user, node, off, buf)
+				if err != nil && err != io.EOF {
+					return err
+				}
+				if n == 0 {
+					break
+				}
+				contents.Write(buf[:n])
+				off += int64(n)
+			}
+			tree[p] = ty + ":" + contents.String()
+		}
+	}
+	return nil
+}
+
+func diffTrees(a, b map[string]string) (diffs []string) {
+	for p, desc := range a {
+		if bDesc, ok := b[p]; !ok {
+			diffs = append(diffs, fmt.Sprintf("only in first: %s (%q)", p, desc))
+		} else if bDesc != desc {
+			diffs = append(diffs, fmt.Sprintf("%s: %q vs %q", p, desc, bDesc))
+		}
+	}
+	for p, desc := range b {
+		if _, ok := a[p]; !ok {
+			diffs = append(diffs,
+				fmt.Sprintf("only in second: %s (%q)", p, desc))
+		}
+	}
+	sort.Strings(diffs)
+	return diffs
+}
+
+// checkConvergence syncs every user with the server, flushing their
+// journals if journaling is on, until they all see identical trees.
+// If they still differ after a few passes, the test fails.  With
+// journaling on, every user must have enabled their journal.
+func checkConvergence() optionOp {
+	return func(o *opt) {
+		o.tb.Log("checkConvergence")
+		o.runInitOnce()
+		var diffs []string
+		for pass := 0; pass < convergencePasses; pass++ {
+			trees := make(map[libkb.NormalizedUsername]map[string]string)
+			for _, u := range o.usernames {
+				c := &ctx{
+					opt:      o,
+					user:     o.users[u],
+					username: u,
+					staller:  o.stallers[u],
+				}
+				fops := []fileOp{initRoot()}
+				if o.journal {
+					fops = []fileOp{flushJournal(), initRoot(), flushJournal()}
+				}
+				for _, fop := range fops {
+					desc, err := runFileOp(c, fop)
+					o.expectSuccess(desc, err)
+				}
+				tree := make(map[string]string)
+				err := c.readTree(c.rootNode, "", tree)
+				o.expectSuccess("readTree", err)
+				trees[u] = tree
+			}
+
+			diffs = nil
+			first := o.usernames[0]
+			for _, u := range o.usernames[1:] {
+				for _, d := range diffTrees(trees[first], trees[u]) {
+					diffs = append(diffs,
+						fmt.Sprintf("%s vs %s: %s", first, u, d))
+				}
+			}
+			// Even if everyone agrees, do at least two passes,
+			// so that everyone has seen the results of every
+			// conflict resolution done in the first pass.
+			if pass > 0 && len(diffs) == 0 {
+				return
+			}
+		}
+		o.tb.Errorf("Users didn't converge:\n%s", strings.Join(diffs, "\n"))
+	}
+}
+
+// TestRandomConvergence runs randomly-generated scenarios that
+// interleave conflicting writes, renames, removals and setexes by
+// several users, with updates disabled, journals paused and MD puts
+// stalled, and checks that all the users end up with identical
+// trees.  A failing scenario is shrunk and printed as a DSL test.
+// It's slow and nondeterministic, so it only runs when asked to with
+// -random-iters.  Use -random-seed to reproduce a run.
+func TestRandomConvergence(t *testing.T) {
+	if *randomIters <= 0 {
+		t.Skip("Skipping random scenarios; set -random-iters to run them")
+	}
+	seed := *randomSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	// Print the seed even if the test passes, or times out before
+	// any failure is logged.
+	fmt.Printf("TestRandomConvergence seed: %d\n", seed)
+	t.Logf("Seed: %d", seed)
+
+	for i := 0; i < *randomIters; i++ {
+		for _, journal := range []bool{false, true} {
+			scenarioSeed := seed + int64(i)
+			journal := journal // capture range variable.
+			name := fmt.Sprintf("seed=%d/journal=%t", scenarioSeed, journal)
+			t.Run(name, func(t *testing.T) {
+				sc := generateRandomScenario(
+					rand.New(rand.NewSource(scenarioSeed)), journal,
+					*randomRounds)
+				failures, skipped := runRandomScenario(t, sc)
+				if skipped {
+					t.Skip("Engine skipped the scenario")
+				}
+				if len(failures) == 0 {
+					return
+				}
+				t.Logf("Scenario failed, shrinking:\n%s\n%s",
+					strings.Join(failures, "\n"), sc.source())
+				sc, failures = shrinkRandomScenario(t, sc, failures)
+				t.Errorf("Minimal failing scenario:\n%s\n\nFailures:\n%s",
+					sc.source(), strings.Join(failures, "\n"))
+			})
+		}
+	}
+}